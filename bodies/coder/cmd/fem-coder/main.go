@@ -203,7 +203,7 @@ func (a *Agent) registerWithBroker() error {
 			CommonHeaders: protocol.CommonHeaders{
 				Agent: a.ID,
 				TS:    time.Now().UnixMilli(),
-				Nonce: fmt.Sprintf("%d", time.Now().UnixNano()),
+				Nonce: protocol.NewNonce(),
 			},
 		},
 		Body: protocol.RegisterAgentBody{
@@ -322,7 +322,7 @@ func (a *Agent) handleToolCall(envelope *protocol.ToolCallEnvelope) (*protocol.T
 			CommonHeaders: protocol.CommonHeaders{
 				Agent: a.ID,
 				TS:    time.Now().UnixMilli(),
-				Nonce: fmt.Sprintf("%d", time.Now().UnixNano()),
+				Nonce: protocol.NewNonce(),
 			},
 		},
 		Body: protocol.ToolResultBody{
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// acmeRenewBefore is how long before expiry an ACME certificate is renewed
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeCheckInterval is how often the certificate's expiry is checked,
+	// and how long a failed order waits before it is tried again
+	acmeCheckInterval = time.Hour
+	// acmeOrderTimeout bounds one certificate order
+	acmeOrderTimeout = 5 * time.Minute
+)
+
+// Files kept in the ACME cache directory
+const (
+	acmeAccountKeyFile = "account.key"
+	acmeCertFile       = "broker.crt"
+	acmeKeyFile        = "broker.key"
+)
+
+// ACMEConfig configures automatic certificates from an ACME CA
+type ACMEConfig struct {
+	Domains      []string // Names the certificate covers
+	Email        string   // Contact for the CA account, optional
+	CacheDir     string   // Holds the account key and the current certificate
+	DirectoryURL string   // ACME directory; Let's Encrypt's if empty
+}
+
+// ACMEManager obtains and renews the broker's certificate from an ACME CA
+// such as Let's Encrypt. It proves control of the domains with the
+// tls-alpn-01 challenge, answered on the broker's own TLS listener, which
+// the CA reaches on port 443.
+type ACMEManager struct {
+	config     ACMEConfig
+	broker     *Broker
+	client     *acme.Client
+	challenges map[string]*tls.Certificate // tls-alpn-01 answers by domain
+	mu         sync.Mutex
+}
+
+// NewACMEManager creates a manager, loading the CA account key from the
+// cache directory or creating it there
+func NewACMEManager(broker *Broker, config ACMEConfig) (*ACMEManager, error) {
+	if len(config.Domains) == 0 {
+		return nil, errors.New("no ACME domains given")
+	}
+	if config.CacheDir == "" {
+		return nil, errors.New("an ACME cache directory is required, so certificates survive restarts")
+	}
+	if config.DirectoryURL == "" {
+		config.DirectoryURL = acme.LetsEncryptURL
+	}
+	if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateECKey(filepath.Join(config.CacheDir, acmeAccountKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("ACME account key: %w", err)
+	}
+	return &ACMEManager{
+		config:     config,
+		broker:     broker,
+		client:     &acme.Client{Key: key, DirectoryURL: config.DirectoryURL, UserAgent: "fem-broker"},
+		challenges: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// GetCertificate answers tls-alpn-01 challenges and otherwise offers the
+// broker's current certificate
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto != acme.ALPNProto {
+			continue
+		}
+		m.mu.Lock()
+		cert, exists := m.challenges[hello.ServerName]
+		m.mu.Unlock()
+		if !exists {
+			return nil, fmt.Errorf("no ACME challenge pending for %q", hello.ServerName)
+		}
+		return cert, nil
+	}
+	return m.broker.getCertificate(hello)
+}
+
+// LoadCached serves the certificate saved by an earlier order, reporting
+// whether there was one that does not yet need renewing
+func (m *ACMEManager) LoadCached() bool {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(m.config.CacheDir, acmeCertFile), filepath.Join(m.config.CacheDir, acmeKeyFile))
+	if err != nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || !acmeCoversDomains(leaf, m.config.Domains) {
+		return false
+	}
+	cert.Leaf = leaf
+	m.broker.SetCertificate(cert)
+	return !acmeNeedsRenewal(leaf, time.Now())
+}
+
+// Obtain orders a certificate for the configured domains and serves it
+func (m *ACMEManager) Obtain(ctx context.Context) error {
+	account := &acme.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.config.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to order certificate: %w", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, url); err != nil {
+			return err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("certificate order failed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.config.Domains}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize certificate order: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("CA issued an invalid certificate: %w", err)
+	}
+
+	if err := m.save(chain, key); err != nil {
+		slog.Warn("Failed to cache ACME certificate", "dir", m.config.CacheDir, "error", err)
+	}
+	m.broker.SetCertificate(tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf})
+	slog.Info("Obtained ACME certificate", "domains", m.config.Domains, "expires", leaf.NotAfter,
+		"certFingerprint", m.broker.Identity().CertFingerprint)
+	return nil
+}
+
+// authorize proves control of one domain with a tls-alpn-01 challenge
+func (m *ACMEManager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := authz.Identifier.Value
+
+	var challenge *acme.Challenge
+	for _, offered := range authz.Challenges {
+		if offered.Type == "tls-alpn-01" {
+			challenge = offered
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("CA offers no tls-alpn-01 challenge for %s", domain)
+	}
+	cert, err := m.client.TLSALPN01ChallengeCert(challenge.Token, domain)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.challenges[domain] = &cert
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.challenges, domain)
+		m.mu.Unlock()
+	}()
+
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge for %s: %w", domain, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("failed to prove control of %s: %w", domain, err)
+	}
+	return nil
+}
+
+// save writes the certificate chain and key to the cache directory
+func (m *ACMEManager) save(chain [][]byte, key *ecdsa.PrivateKey) error {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.config.CacheDir, acmeKeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.config.CacheDir, acmeCertFile), certPEM, 0600)
+}
+
+// Run obtains a certificate unless a usable one is cached, then renews it
+// before it expires, until stop is closed
+func (m *ACMEManager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(acmeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		cert := m.broker.certificate.Load()
+		if cert == nil || cert.Leaf == nil || !acmeCoversDomains(cert.Leaf, m.config.Domains) || acmeNeedsRenewal(cert.Leaf, time.Now()) {
+			ctx, cancel := context.WithTimeout(context.Background(), acmeOrderTimeout)
+			if err := m.Obtain(ctx); err != nil {
+				slog.Error("Failed to obtain ACME certificate, retrying later", "domains", m.config.Domains, "error", err)
+			}
+			cancel()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// acmeNeedsRenewal reports whether a certificate is within the renewal
+// window of its expiry
+func acmeNeedsRenewal(leaf *x509.Certificate, now time.Time) bool {
+	return now.Add(acmeRenewBefore).After(leaf.NotAfter)
+}
+
+// acmeCoversDomains reports whether a certificate names every domain
+func acmeCoversDomains(leaf *x509.Certificate, domains []string) bool {
+	for _, domain := range domains {
+		if leaf.VerifyHostname(domain) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadOrCreateECKey reads a PEM EC private key, creating the file with a
+// new P-256 key if it is missing
+func loadOrCreateECKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key found", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeTestCert creates a self-signed certificate for domain expiring at notAfter
+func acmeTestCert(t *testing.T, domain string, notAfter time.Time) ([][]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return [][]byte{der}, key
+}
+
+func TestACMEManagerAccountKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "acme")
+	config := ACMEConfig{Domains: []string{"broker.example.com"}, CacheDir: dir}
+	first, err := NewACMEManager(NewBroker(), config)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	second, err := NewACMEManager(NewBroker(), config)
+	if err != nil {
+		t.Fatalf("Failed to create manager again: %v", err)
+	}
+	if !first.client.Key.(*ecdsa.PrivateKey).Equal(second.client.Key) {
+		t.Error("Expected the account key to be kept in the cache directory")
+	}
+	if first.client.DirectoryURL != acme.LetsEncryptURL {
+		t.Errorf("Expected Let's Encrypt by default, got %s", first.client.DirectoryURL)
+	}
+
+	if _, err := NewACMEManager(NewBroker(), ACMEConfig{Domains: []string{"broker.example.com"}}); err == nil {
+		t.Error("Expected a manager without a cache directory to be refused")
+	}
+}
+
+func TestACMEManagerAnswersChallenges(t *testing.T) {
+	broker := NewBroker()
+	served := doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	broker.SetCertificate(served)
+	manager, err := NewACMEManager(broker, ACMEConfig{Domains: []string{"broker.example.com"}, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	challenge, err := manager.client.TLSALPN01ChallengeCert("token", "broker.example.com")
+	if err != nil {
+		t.Fatalf("Failed to create challenge certificate: %v", err)
+	}
+	manager.challenges["broker.example.com"] = &challenge
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "broker.example.com", SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || cert != &challenge {
+		t.Errorf("Expected the challenge certificate for the validator, got %v", err)
+	}
+	if _, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com", SupportedProtos: []string{acme.ALPNProto}}); err == nil {
+		t.Error("Expected no answer for a domain without a pending challenge")
+	}
+	cert, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "broker.example.com", SupportedProtos: []string{"h2"}})
+	if err != nil || string(cert.Certificate[0]) != string(served.Certificate[0]) {
+		t.Errorf("Expected ordinary clients to get the broker's certificate, got %v", err)
+	}
+}
+
+func TestACMEManagerCache(t *testing.T) {
+	broker := NewBroker()
+	manager, err := NewACMEManager(broker, ACMEConfig{Domains: []string{"broker.example.com"}, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	if manager.LoadCached() {
+		t.Error("Expected an empty cache to have no certificate")
+	}
+
+	chain, key := acmeTestCert(t, "broker.example.com", time.Now().Add(60*24*time.Hour))
+	if err := manager.save(chain, key); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+	if !manager.LoadCached() {
+		t.Fatal("Expected the cached certificate to be used")
+	}
+	if string(broker.certificate.Load().Certificate[0]) != string(chain[0]) {
+		t.Error("Expected the cached certificate to be served")
+	}
+
+	// A certificate inside the renewal window is served, but renewed
+	expiring, key := acmeTestCert(t, "broker.example.com", time.Now().Add(10*24*time.Hour))
+	manager.save(expiring, key)
+	if manager.LoadCached() {
+		t.Error("Expected a certificate expiring in ten days to need renewal")
+	}
+	if string(broker.certificate.Load().Certificate[0]) != string(expiring[0]) {
+		t.Error("Expected the expiring certificate to be served until it is renewed")
+	}
+
+	// A certificate for other domains is not used
+	other, key := acmeTestCert(t, "other.example.com", time.Now().Add(60*24*time.Hour))
+	manager.save(other, key)
+	if manager.LoadCached() {
+		t.Error("Expected a certificate for another domain to be ignored")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// adminTokenSize is the number of random bytes in a generated admin token
+const adminTokenSize = 32
+
+// SetAdminToken requires /admin/ requests to carry "Authorization: Bearer
+// <token>". With no token and no -jwt-keys, the admin API refuses every
+// request.
+func (b *Broker) SetAdminToken(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.adminToken = token
+}
+
+// SetAdminTokenFile sets the file a generated admin token is written to. If
+// empty, the token goes to a new file in the temporary directory.
+func (b *Broker) SetAdminTokenFile(path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokenFile = path
+}
+
+// ensureAdminToken gives the broker an admin token if it has neither a
+// token nor -jwt-keys, so the admin API is never open. The token is
+// generated once, written to a file only its owner can read, and kept by
+// reloads that configure none. Only the file's path is logged.
+func (b *Broker) ensureAdminToken() error {
+	if b.jwtAuthEnabled() {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.adminToken != "" {
+		return nil
+	}
+	if b.autoToken == "" {
+		random := make([]byte, adminTokenSize)
+		if _, err := rand.Read(random); err != nil {
+			return fmt.Errorf("failed to generate admin token: %w", err)
+		}
+		token := base64.RawURLEncoding.EncodeToString(random)
+		path, err := writeAdminToken(b.tokenFile, token)
+		if err != nil {
+			return fmt.Errorf("failed to write admin token: %w", err)
+		}
+		b.autoToken = token
+		slog.Warn("No admin token or JWT keys configured, generated an admin token", "file", path)
+	}
+	b.adminToken = b.autoToken
+	return nil
+}
+
+// writeAdminToken writes a generated admin token to a file readable by its
+// owner only, at path or a new file in the temporary directory, and returns
+// the file's path
+func writeAdminToken(path, token string) (string, error) {
+	var file *os.File
+	var err error
+	if path == "" {
+		file, err = os.CreateTemp("", "fem-admin-token-*")
+	} else {
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	}
+	if err != nil {
+		return "", err
+	}
+	// An existing file keeps its mode when opened
+	if err := file.Chmod(0o600); err != nil {
+		file.Close()
+		return "", err
+	}
+	if _, err := file.WriteString(token + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// bearerToken returns the token of a request's "Authorization: Bearer"
+// header, if any
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// adminAuthorized reports whether the request carries the admin token, or
+// a JWT whose role grants the request. Without an admin token or
+// -jwt-keys, no request is authorized.
+func (b *Broker) adminAuthorized(r *http.Request) bool {
+	b.mu.RLock()
+	token := b.adminToken
+	b.mu.RUnlock()
+
+	presented := bearerToken(r)
+	if token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+		return true
+	}
+	return presented != "" && b.adminJWTAuthorized(r, presented)
+}
+
+// AdminAgent is an agent as listed by /admin/agents
+type AdminAgent struct {
+	ID              string         `json:"id"`
+	Capabilities    []string       `json:"capabilities"`
+	Endpoint        string         `json:"endpoint,omitempty"`
+	MCPEndpoint     string         `json:"mcpEndpoint,omitempty"`
+	EnvironmentType string         `json:"environmentType,omitempty"`
+	PubKey          string         `json:"pubkey,omitempty"`
+	CertFingerprint string         `json:"certFingerprint,omitempty"` // Client certificate the agent is bound to
+	RegisteredAt    time.Time      `json:"registeredAt"`
+	LastSeen        time.Time      `json:"lastSeen"`
+	Stale           bool           `json:"stale"`
+	Connected       bool           `json:"connected"` // Holds a WebSocket or event stream
+	InFlight        int            `json:"inFlight"`
+	Queued          int            `json:"queued"`
+	Outbox          OutboxPressure `json:"outbox"` // Unacked envelopes kept for it, and those evicted
+	Tools           []string       `json:"tools"`  // Names of the tools the agent offers
+}
+
+// AdminAgentDetail is one agent as served by /admin/agents/{id}
+type AdminAgentDetail struct {
+	AdminAgent
+	Tools          []protocol.MCPTool       `json:"tools"`
+	BodyDefinition *protocol.BodyDefinition `json:"bodyDefinition,omitempty"`
+	Subscription   *Subscription            `json:"subscription,omitempty"`
+
+	// Capabilities the agent's tools imply that it has not declared
+	SuggestedCapabilities []string `json:"suggestedCapabilities"`
+}
+
+// AdminTool is a tool as listed by /admin/tools
+type AdminTool struct {
+	Name            string    `json:"name"`
+	Description     string    `json:"description,omitempty"`
+	AgentID         string    `json:"agentId"`
+	MCPEndpoint     string    `json:"mcpEndpoint,omitempty"`
+	EnvironmentType string    `json:"environmentType,omitempty"`
+	Proxy           string    `json:"proxy,omitempty"`
+	Tier            string    `json:"tier"` // Service tier calls to the tool are limited and metered under
+	RegisteredAt    time.Time `json:"registeredAt"`
+	LastSeen        time.Time `json:"lastSeen"`
+	Stale           bool      `json:"stale"`
+}
+
+// AdminBroker is a federated peer as listed by /admin/brokers
+type AdminBroker struct {
+	ID        string       `json:"id"`
+	Endpoint  string       `json:"endpoint"`
+	PublicKey string       `json:"publicKey,omitempty"`
+	Status    BrokerStatus `json:"status,omitempty"`
+	LastSeen  time.Time    `json:"lastSeen"`
+	ToolCount int          `json:"toolCount"`
+	Role      string       `json:"role,omitempty"` // parent or child in a broker hierarchy
+}
+
+// adminAgent describes a registered agent. Caller must hold b.mu.
+func (b *Broker) adminAgent(agent *Agent) AdminAgent {
+	listing := AdminAgent{
+		ID:              agent.ID,
+		Capabilities:    agent.Capabilities,
+		Endpoint:        agent.Endpoint,
+		RegisteredAt:    agent.RegisteredAt,
+		LastSeen:        agent.LastSeen,
+		Stale:           agent.Stale,
+		Connected:       b.hub.IsConnected(agent.ID),
+		InFlight:        agent.InFlight,
+		Queued:          agent.Queued,
+		Outbox:          b.outbox.Pressure(agent.ID),
+		Tools:           []string{},
+		CertFingerprint: agent.CertFingerprint,
+	}
+	if agent.PubKey != nil {
+		listing.PubKey, _ = protocol.FormatPublicKey(agent.PubKey)
+	}
+	if listing.Capabilities == nil {
+		listing.Capabilities = []string{}
+	}
+	if mcpAgent, exists := b.mcpRegistry.GetAgent(agent.ID); exists {
+		listing.MCPEndpoint = mcpAgent.MCPEndpoint
+		listing.EnvironmentType = mcpAgent.EnvironmentType
+		for _, tool := range mcpAgent.Tools {
+			listing.Tools = append(listing.Tools, tool.Name)
+		}
+	}
+	return listing
+}
+
+// handleAdminAgents serves GET /admin/agents, every registered agent by ID
+func (b *Broker) handleAdminAgents(w http.ResponseWriter, r *http.Request) {
+	b.mu.RLock()
+	agents := make([]AdminAgent, 0, len(b.agents))
+	for _, agent := range b.agents {
+		agents = append(agents, b.adminAgent(agent))
+	}
+	b.mu.RUnlock()
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+
+	writeAdminJSON(w, agents)
+}
+
+// handleAdminAgent serves GET /admin/agents/{id}, with the agent's full
+// tool definitions, body definition and event subscription
+func (b *Broker) handleAdminAgent(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/agents/")
+
+	b.mu.RLock()
+	agent, exists := b.agents[id]
+	var detail AdminAgentDetail
+	if exists {
+		detail.AdminAgent = b.adminAgent(agent)
+	}
+	b.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Unknown agent", http.StatusNotFound)
+		return
+	}
+
+	detail.Tools = []protocol.MCPTool{}
+	if mcpAgent, exists := b.mcpRegistry.GetAgent(id); exists {
+		detail.Tools = append(detail.Tools, mcpAgent.Tools...)
+		detail.BodyDefinition = mcpAgent.BodyDefinition
+	}
+	if subscription, exists := b.subscriptions.GetSubscription(id); exists {
+		detail.Subscription = &subscription
+	}
+	detail.SuggestedCapabilities = b.suggestedCapabilities(id)
+	writeAdminJSON(w, detail)
+}
+
+// handleAdminTools serves GET /admin/tools, every indexed tool, including
+// stale ones that discovery hides
+func (b *Broker) handleAdminTools(w http.ResponseWriter, r *http.Request) {
+	registered := b.mcpRegistry.ListTools()
+	tools := make([]AdminTool, 0, len(registered))
+	for _, tool := range registered {
+		tools = append(tools, AdminTool{
+			Name:            tool.Tool.Name,
+			Description:     tool.Tool.Description,
+			AgentID:         tool.AgentID,
+			MCPEndpoint:     tool.MCPEndpoint,
+			EnvironmentType: tool.EnvironmentType,
+			Proxy:           tool.Proxy,
+			Tier:            b.toolTier(tool).Name,
+			RegisteredAt:    tool.RegisteredAt,
+			LastSeen:        tool.LastSeen,
+			Stale:           tool.Stale,
+		})
+	}
+	sort.Slice(tools, func(i, j int) bool {
+		if tools[i].Name != tools[j].Name {
+			return tools[i].Name < tools[j].Name
+		}
+		return tools[i].AgentID < tools[j].AgentID
+	})
+
+	writeAdminJSON(w, tools)
+}
+
+// handleAdminBrokers serves GET /admin/brokers, the federated peers
+func (b *Broker) handleAdminBrokers(w http.ResponseWriter, r *http.Request) {
+	peers := b.peers.List()
+	brokers := make([]AdminBroker, 0, len(peers))
+	for _, peer := range peers {
+		toolCount := peer.ToolCount
+		if peer.Role == peerRoleChild {
+			toolCount = b.hierarchy.ToolCount(peer.ID)
+		}
+		brokers = append(brokers, AdminBroker{
+			ID:        peer.ID,
+			Endpoint:  peer.Endpoint,
+			PublicKey: peer.PublicKey,
+			Status:    peer.Status,
+			LastSeen:  peer.LastSeen,
+			ToolCount: toolCount,
+			Role:      peer.Role,
+		})
+	}
+
+	writeAdminJSON(w, brokers)
+}
+
+// writeAdminJSON writes an admin API response
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+// testAdminToken is the admin token tests give brokers to reach /admin/
+const testAdminToken = "s3cret"
+
+// adminTransport presents testAdminToken on every request
+type adminTransport struct {
+	base http.RoundTripper
+}
+
+func (a adminTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return a.base.RoundTrip(req)
+}
+
+// adminClient sets testAdminToken on broker and returns a client of server
+// that presents it
+func adminClient(broker *Broker, server *httptest.Server) *http.Client {
+	broker.SetAdminToken(testAdminToken)
+	client := *server.Client()
+	client.Transport = adminTransport{base: client.Transport}
+	return &client
+}
+
+func TestAdminRegistryListings(t *testing.T) {
+	broker := NewBroker()
+	broker.agents["agent-b"] = &Agent{ID: "agent-b", Capabilities: []string{"code.execute"}, Queued: 2}
+	broker.agents["agent-a"] = &Agent{ID: "agent-a", Stale: true}
+	broker.mcpRegistry.RegisterAgent("agent-b", &MCPAgent{
+		ID:          "agent-b",
+		MCPEndpoint: "http://agent-b/mcp",
+		Tools:       []protocol.MCPTool{{Name: "shell.run"}, {Name: "file.read"}},
+	})
+	broker.subscriptions.Subscribe("agent-b", "http://agent-b/events", []string{"build.*"})
+	broker.peers.Add(&FederatedBroker{ID: "broker-west", Endpoint: "https://west", ToolCount: 4})
+
+	server := httptest.NewServer(broker)
+	defer server.Close()
+	client := adminClient(broker, server)
+	get := func(path string, v interface{}) int {
+		t.Helper()
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("GET %s returned invalid JSON: %v", path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var agents []AdminAgent
+	get("/admin/agents", &agents)
+	if len(agents) != 2 || agents[0].ID != "agent-a" || !agents[0].Stale {
+		t.Fatalf("Unexpected agents %+v", agents)
+	}
+	if b := agents[1]; b.MCPEndpoint != "http://agent-b/mcp" || len(b.Tools) != 2 || b.Queued != 2 {
+		t.Errorf("Unexpected agent-b listing %+v", b)
+	}
+
+	var detail AdminAgentDetail
+	get("/admin/agents/agent-b", &detail)
+	if len(detail.Tools) != 2 || detail.Subscription == nil || detail.Subscription.Patterns[0] != "build.*" {
+		t.Errorf("Unexpected agent-b detail %+v", detail)
+	}
+	if status := get("/admin/agents/agent-missing", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown agent, got %d", status)
+	}
+
+	var tools []AdminTool
+	get("/admin/tools", &tools)
+	if len(tools) != 2 || tools[0].Name != "file.read" || tools[1].AgentID != "agent-b" {
+		t.Errorf("Unexpected tools %+v", tools)
+	}
+
+	var brokers []AdminBroker
+	get("/admin/brokers", &brokers)
+	if len(brokers) != 1 || brokers[0].ID != "broker-west" || brokers[0].ToolCount != 4 {
+		t.Errorf("Unexpected brokers %+v", brokers)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	broker := NewBroker()
+	broker.SetAdminToken(testAdminToken)
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	for _, path := range []string{"/admin/agents", "/admin/storage"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected %s without the token to be refused, got %d", path, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/admin/agents", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /admin/agents failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the token to be accepted, got %d", resp.StatusCode)
+	}
+
+	// The public endpoints stay open
+	resp, err = http.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatalf("GET /health failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected /health to stay open, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminAPIClosedWithoutToken(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	get := func(token string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/admin/agents", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /admin/agents failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get(""); status != http.StatusUnauthorized {
+		t.Errorf("Expected the admin API to be closed without a token, got %d", status)
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	broker.SetAdminTokenFile(tokenFile)
+	if err := broker.ensureAdminToken(); err != nil {
+		t.Fatalf("Generating an admin token failed: %v", err)
+	}
+	generated := broker.adminToken
+	if generated == "" {
+		t.Fatal("Expected an admin token to be generated")
+	}
+
+	// The token is written to a file only its owner can read, not logged
+	written, err := os.ReadFile(tokenFile)
+	if err != nil || strings.TrimSpace(string(written)) != generated {
+		t.Errorf("Expected the generated token in %s, got %q, %v", tokenFile, written, err)
+	}
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatalf("Failed to stat the token file: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the token file to be readable by its owner only, got %v", info.Mode().Perm())
+	}
+	if status := get(generated); status != http.StatusOK {
+		t.Errorf("Expected the generated token to be accepted, got %d", status)
+	}
+
+	// A reload configuring no token keeps the generated one
+	broker.SetAdminToken("")
+	broker.ensureAdminToken()
+	if broker.adminToken != generated {
+		t.Errorf("Expected the generated token to be kept, got %q", broker.adminToken)
+	}
+	if status := get(""); status != http.StatusUnauthorized {
+		t.Errorf("Expected requests without the token to be refused, got %d", status)
+	}
+}
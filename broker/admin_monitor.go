@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// defaultMonitorInterval is how often /admin/monitor sends a snapshot
+	defaultMonitorInterval = time.Second
+	// minMonitorInterval bounds how often a client may ask for snapshots
+	minMonitorInterval = 100 * time.Millisecond
+)
+
+// agentActivity counts the envelopes one agent has sent since the broker
+// started
+type agentActivity struct {
+	envelopes int64
+	errors    int64
+	lastSeen  time.Time
+}
+
+// Monitor keeps running totals of the envelopes the broker handles, for
+// operators watching it live. Unlike UsageTracker it is never reset, so
+// clients derive rates from the difference between two snapshots.
+type Monitor struct {
+	started   time.Time
+	envelopes int64
+	errors    int64
+	types     map[protocol.EnvelopeType]int64
+	agents    map[string]*agentActivity
+	mu        sync.Mutex
+}
+
+// NewMonitor creates a monitor with zeroed totals
+func NewMonitor() *Monitor {
+	return &Monitor{
+		started: time.Now(),
+		types:   make(map[protocol.EnvelopeType]int64),
+		agents:  make(map[string]*agentActivity),
+	}
+}
+
+// Record counts an envelope and whether the broker rejected it
+func (m *Monitor) Record(envType protocol.EnvelopeType, agentID string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failed := status < 200 || status >= 300
+	m.envelopes++
+	m.types[envType]++
+	if failed {
+		m.errors++
+	}
+	if agentID == "" {
+		return
+	}
+	activity, exists := m.agents[agentID]
+	if !exists {
+		activity = &agentActivity{}
+		m.agents[agentID] = activity
+	}
+	activity.envelopes++
+	activity.lastSeen = time.Now()
+	if failed {
+		activity.errors++
+	}
+}
+
+// Forget drops an agent's totals, once it has left the broker
+func (m *Monitor) Forget(agentID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.agents, agentID)
+}
+
+// MonitorAgent is one agent's line in a MonitorSnapshot
+type MonitorAgent struct {
+	ID        string    `json:"id"`
+	Envelopes int64     `json:"envelopes"` // Sent since the broker started
+	Errors    int64     `json:"errors"`    // Of those, rejected by the broker
+	LastSeen  time.Time `json:"lastSeen,omitempty"`
+	Connected bool      `json:"connected"`          // Holds a WebSocket or event stream
+	Stale     bool      `json:"stale,omitempty"`    // Missed its heartbeat
+	InFlight  int       `json:"inFlight,omitempty"` // Tool calls running, as of its last heartbeat
+	Queued    int       `json:"queued,omitempty"`   // Tool calls waiting, as of its last heartbeat
+}
+
+// MonitorQueues are the depths of the broker's internal queues
+type MonitorQueues struct {
+	PendingToolCalls int `json:"pendingToolCalls"`
+	Broadcasts       int `json:"broadcasts"`
+	Streams          int `json:"streams"`
+	Connections      int `json:"connections"`
+}
+
+// MonitorSnapshot is sent by /admin/monitor every interval
+type MonitorSnapshot struct {
+	At        time.Time                       `json:"at"`
+	Started   time.Time                       `json:"started"`
+	Envelopes int64                           `json:"envelopes"`
+	Errors    int64                           `json:"errors"`
+	Types     map[protocol.EnvelopeType]int64 `json:"types"`
+	Agents    []MonitorAgent                  `json:"agents"` // Registered agents and any others that sent envelopes, by ID
+	Queues    MonitorQueues                   `json:"queues"`
+	Limiter   RateLimitStats                  `json:"rateLimits"`
+	Outbox    OutboxStats                     `json:"outbox"`
+}
+
+// MonitorSnapshot gathers the broker's totals and queue depths
+func (b *Broker) MonitorSnapshot() MonitorSnapshot {
+	m := b.monitor
+	m.mu.Lock()
+	snapshot := MonitorSnapshot{
+		At:        time.Now(),
+		Started:   m.started,
+		Envelopes: m.envelopes,
+		Errors:    m.errors,
+		Types:     make(map[protocol.EnvelopeType]int64, len(m.types)),
+	}
+	for envType, count := range m.types {
+		snapshot.Types[envType] = count
+	}
+	agents := make(map[string]*MonitorAgent, len(m.agents))
+	for id, activity := range m.agents {
+		agents[id] = &MonitorAgent{ID: id, Envelopes: activity.envelopes, Errors: activity.errors, LastSeen: activity.lastSeen}
+	}
+	m.mu.Unlock()
+
+	b.mu.RLock()
+	for id, agent := range b.agents {
+		line, exists := agents[id]
+		if !exists {
+			line = &MonitorAgent{ID: id}
+			agents[id] = line
+		}
+		line.Stale, line.InFlight, line.Queued = agent.Stale, agent.InFlight, agent.Queued
+	}
+	b.mu.RUnlock()
+
+	snapshot.Agents = make([]MonitorAgent, 0, len(agents))
+	for id, line := range agents {
+		line.Connected = b.hub.IsConnected(id)
+		snapshot.Agents = append(snapshot.Agents, *line)
+	}
+	sort.Slice(snapshot.Agents, func(i, j int) bool { return snapshot.Agents[i].ID < snapshot.Agents[j].ID })
+
+	snapshot.Queues = MonitorQueues{
+		PendingToolCalls: b.pending.GetPendingCount(),
+		Broadcasts:       b.broadcasts.GetBroadcastCount(),
+		Streams:          b.streams.GetStreamCount(),
+		Connections:      b.hub.GetConnectionCount(),
+	}
+	snapshot.Limiter = b.limiter.Stats()
+	snapshot.Outbox = b.outbox.Stats()
+	return snapshot
+}
+
+// recordEnvelope counts an envelope and the broker's reply for usage
+// reports and the live monitor
+func (b *Broker) recordEnvelope(envelope *protocol.GenericEnvelope, bytesIn, bytesOut, status int) {
+	b.usage.RecordEnvelope(envelope.Agent, bytesIn, bytesOut, status)
+	b.monitor.Record(envelope.Type, envelope.Agent, status)
+}
+
+// handleMonitorStream serves GET /admin/monitor?interval=1s, streaming a
+// MonitorSnapshot as a Server-Sent Event every interval
+func (b *Broker) handleMonitorStream(w http.ResponseWriter, r *http.Request) {
+	interval := defaultMonitorInterval
+	if value := r.URL.Query().Get("interval"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < minMonitorInterval {
+			http.Error(w, fmt.Sprintf("Invalid interval, expected a duration of at least %v", minMonitorInterval), http.StatusBadRequest)
+			return
+		}
+		interval = parsed
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(b.MonitorSnapshot())
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestMonitorSnapshot(t *testing.T) {
+	broker := NewBroker()
+	pusher := newFakePusher()
+	broker.broadcasts = NewBroadcastTable(pusher)
+	broker.agents["agent-a"] = &Agent{ID: "agent-a", InFlight: 2, Queued: 5}
+	broker.agents["agent-idle"] = &Agent{ID: "agent-idle", Stale: true}
+	broker.broadcasts.Send("agent-a", "config.updated", []byte("{}"), []string{"agent-idle"}, 0)
+
+	ping := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopePing}}
+	ping.Agent = "agent-a"
+	broker.recordEnvelope(ping, 10, 10, http.StatusOK)
+	broker.recordEnvelope(ping, 10, 10, http.StatusConflict)
+	ping.Agent = "unregistered"
+	broker.recordEnvelope(ping, 10, 10, http.StatusUnauthorized)
+
+	snapshot := broker.MonitorSnapshot()
+	if snapshot.Envelopes != 3 || snapshot.Errors != 2 || snapshot.Types[protocol.EnvelopePing] != 3 {
+		t.Errorf("Unexpected totals %+v", snapshot)
+	}
+	if len(snapshot.Agents) != 3 {
+		t.Fatalf("Expected registered and active agents, got %+v", snapshot.Agents)
+	}
+	if a := snapshot.Agents[0]; a.ID != "agent-a" || a.Envelopes != 2 || a.Errors != 1 || a.InFlight != 2 || a.Queued != 5 {
+		t.Errorf("Unexpected agent-a line %+v", a)
+	}
+	if idle := snapshot.Agents[1]; !idle.Stale || idle.Envelopes != 0 {
+		t.Errorf("Unexpected agent-idle line %+v", idle)
+	}
+	if snapshot.Queues.Broadcasts != 1 {
+		t.Errorf("Expected the pending broadcast to be counted, got %+v", snapshot.Queues)
+	}
+
+	// Agents that leave are dropped from the totals
+	broker.removeAgent("unregistered")
+	if len(broker.MonitorSnapshot().Agents) != 2 {
+		t.Error("Expected the removed agent to be forgotten")
+	}
+}
+
+func TestHandleMonitorStream(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(broker)
+	defer server.Close()
+	client := adminClient(broker, server)
+
+	resp, err := client.Get(server.URL + "/admin/monitor?interval=100ms")
+	if err != nil {
+		t.Fatalf("Monitor request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	snapshots := 0
+	for snapshots < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %v", err)
+		}
+		if data, found := strings.CutPrefix(strings.TrimSpace(line), "data: "); found {
+			var snapshot MonitorSnapshot
+			if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+				t.Fatalf("Invalid snapshot %q: %v", data, err)
+			}
+			snapshots++
+		}
+	}
+
+	resp, err = client.Get(server.URL + "/admin/monitor?interval=1ms")
+	if err != nil {
+		t.Fatalf("Monitor request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected too short an interval to be rejected, got %d", resp.StatusCode)
+	}
+}
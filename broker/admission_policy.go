@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// admissionTimeout bounds how long a policy may take over one envelope
+const admissionTimeout = time.Second
+
+// regoAdmissionQuery is the document a Rego admission policy defines, with
+// an "allow" rule and optionally a "deny" set of reasons
+const regoAdmissionQuery = "data.fem.admission"
+
+// AdmissionPolicy decides whether the broker accepts an envelope. It runs
+// before the envelope's handler, so operators can add their own admission
+// rules without changing the broker.
+type AdmissionPolicy interface {
+	Admit(ctx context.Context, input *AdmissionInput) (AdmissionDecision, error)
+}
+
+// AdmissionPolicyFunc lets an ordinary function serve as a policy
+type AdmissionPolicyFunc func(ctx context.Context, input *AdmissionInput) (AdmissionDecision, error)
+
+// Admit calls f
+func (f AdmissionPolicyFunc) Admit(ctx context.Context, input *AdmissionInput) (AdmissionDecision, error) {
+	return f(ctx, input)
+}
+
+// AdmissionInput is what a policy decides on: the envelope's headers and
+// body, and what the registry knows of its sender. Anyone can claim to be
+// any agent, so rules trusting Agent, Sender or Peer should also require
+// Verified.
+type AdmissionInput struct {
+	Type       string                 `json:"type"`
+	Agent      string                 `json:"agent"`
+	TS         int64                  `json:"ts"`
+	Nonce      string                 `json:"nonce"`
+	Hops       int                    `json:"hops"`                 // Brokers that relayed the envelope
+	RemoteAddr string                 `json:"remoteAddr,omitempty"` // Address it arrived from
+	Body       map[string]interface{} `json:"body"`
+	Sender     *AdmissionSender       `json:"sender,omitempty"` // The registered agent the envelope claims to be from
+	Peer       bool                   `json:"peer"`             // The envelope claims to be from a peer broker
+	Verified   bool                   `json:"verified"`         // Signed by the key on record for the sender or peer
+}
+
+// AdmissionSender is the registry's record of an envelope's sender
+type AdmissionSender struct {
+	Capabilities []string  `json:"capabilities"`
+	Tools        []string  `json:"tools"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	Stale        bool      `json:"stale"`
+}
+
+// AdmissionDecision is a policy's verdict on an envelope
+type AdmissionDecision struct {
+	Allow   bool
+	Reasons []string // Why the envelope was denied, if the policy says
+}
+
+// newRegoPolicy compiles a Rego module into a policy. It is set by builds
+// with the opa tag, which link the OPA evaluator; other builds cannot load
+// Rego policies.
+var newRegoPolicy func(name, module string) (AdmissionPolicy, error)
+
+// LoadAdmissionPolicy reads and compiles the Rego policy at path
+func LoadAdmissionPolicy(path string) (AdmissionPolicy, error) {
+	module, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if newRegoPolicy == nil {
+		return nil, fmt.Errorf("loading Rego policies needs a build with -tags opa")
+	}
+	policy, err := newRegoPolicy(filepath.Base(path), string(module))
+	if err != nil {
+		return nil, fmt.Errorf("invalid admission policy %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// regoDecision reads the value of regoAdmissionQuery. The envelope is
+// admitted only if "allow" is true and "deny" holds no reasons.
+func regoDecision(value interface{}) (AdmissionDecision, error) {
+	document, ok := value.(map[string]interface{})
+	if !ok {
+		return AdmissionDecision{}, fmt.Errorf("%s is not an object", regoAdmissionQuery)
+	}
+
+	var decision AdmissionDecision
+	decision.Allow, _ = document["allow"].(bool)
+	if deny, exists := document["deny"]; exists {
+		reasons, ok := deny.([]interface{})
+		if !ok {
+			return AdmissionDecision{}, fmt.Errorf("%s.deny is not a set", regoAdmissionQuery)
+		}
+		for _, reason := range reasons {
+			decision.Reasons = append(decision.Reasons, fmt.Sprint(reason))
+		}
+	}
+	if len(decision.Reasons) > 0 {
+		decision.Allow = false
+	}
+	return decision, nil
+}
+
+// SetAdmissionPolicy sets the policy envelopes must pass, or none
+func (b *Broker) SetAdmissionPolicy(policy AdmissionPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.admission = policy
+}
+
+// admissionInput describes an envelope and its sender to a policy
+func (b *Broker) admissionInput(envelope *protocol.GenericEnvelope) *AdmissionInput {
+	input := &AdmissionInput{
+		Type:       string(envelope.Type),
+		Agent:      envelope.Agent,
+		TS:         envelope.TS,
+		Nonce:      envelope.Nonce,
+		Hops:       envelope.Hops,
+		RemoteAddr: envelope.RemoteAddr,
+	}
+	json.Unmarshal(envelope.Body, &input.Body)
+
+	b.mu.RLock()
+	agent, registered := b.agents[envelope.Agent]
+	var pubKey protocol.PublicKey
+	if registered {
+		input.Sender = &AdmissionSender{
+			Capabilities: append([]string{}, agent.Capabilities...),
+			Tools:        []string{},
+			RegisteredAt: agent.RegisteredAt,
+			Stale:        agent.Stale,
+		}
+		pubKey = agent.PubKey
+	}
+	b.mu.RUnlock()
+
+	if registered {
+		if mcpAgent, exists := b.mcpRegistry.GetAgent(envelope.Agent); exists {
+			for _, tool := range mcpAgent.Tools {
+				input.Sender.Tools = append(input.Sender.Tools, tool.Name)
+			}
+		}
+	}
+	peer, isPeer := b.peers.Get(envelope.Agent)
+	input.Peer = isPeer
+	if isPeer {
+		if key, err := protocol.DecodePublicKey(peer.PublicKey); err == nil {
+			pubKey = key
+		}
+	}
+
+	// The policy runs before handlers check signatures, so it is told
+	// whether the sender is proven
+	if pubKey != nil {
+		input.Verified = b.sessions.Valid(envelope.Session, envelope.Agent, envelope.RemoteAddr, time.Now()) ||
+			envelope.VerifyKey(pubKey) == nil
+	}
+	return input
+}
+
+// admitEnvelope runs the admission policy over an envelope, answering 403
+// if it is denied. A policy that fails denies the envelope with 500.
+func (b *Broker) admitEnvelope(w http.ResponseWriter, envelope *protocol.GenericEnvelope) bool {
+	b.mu.RLock()
+	policy := b.admission
+	b.mu.RUnlock()
+	if policy == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), admissionTimeout)
+	defer cancel()
+	decision, err := policy.Admit(ctx, b.admissionInput(envelope))
+	if err != nil {
+		slog.Error("Admission policy failed", "type", envelope.Type, "agent", envelope.Agent, "error", err)
+		http.Error(w, "Admission policy failed", http.StatusInternalServerError)
+		return false
+	}
+	if decision.Allow {
+		return true
+	}
+
+	slog.Info("Envelope denied by admission policy", "type", envelope.Type, "agent", envelope.Agent, "reasons", decision.Reasons)
+	message := fmt.Sprintf("%s envelope denied by admission policy", envelope.Type)
+	if len(decision.Reasons) > 0 {
+		message += ": " + strings.Join(decision.Reasons, "; ")
+	}
+	b.replyError(w, envelope, http.StatusForbidden, protocol.ErrorAdmissionDenied, message)
+	return false
+}
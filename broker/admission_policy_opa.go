@@ -0,0 +1,51 @@
+//go:build opa
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func init() {
+	newRegoPolicy = func(name, module string) (AdmissionPolicy, error) {
+		query, err := rego.New(
+			rego.Query(regoAdmissionQuery),
+			rego.Module(name, module),
+		).PrepareForEval(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return &regoPolicy{query: query}, nil
+	}
+}
+
+// regoPolicy evaluates a compiled Rego module over each envelope
+type regoPolicy struct {
+	query rego.PreparedEvalQuery
+}
+
+// Admit evaluates the module with the envelope as its input. A module that
+// leaves the decision undefined denies the envelope.
+func (p *regoPolicy) Admit(ctx context.Context, input *AdmissionInput) (AdmissionDecision, error) {
+	// Rego takes its input as plain JSON values
+	data, err := json.Marshal(input)
+	if err != nil {
+		return AdmissionDecision{}, err
+	}
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return AdmissionDecision{}, err
+	}
+
+	results, err := p.query.Eval(ctx, rego.EvalInput(document))
+	if err != nil {
+		return AdmissionDecision{}, err
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return AdmissionDecision{}, nil
+	}
+	return regoDecision(results[0].Expressions[0].Value)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestRegoDecision(t *testing.T) {
+	cases := []struct {
+		value interface{}
+		allow bool
+	}{
+		{map[string]interface{}{"allow": true}, true},
+		{map[string]interface{}{"allow": true, "deny": []interface{}{}}, true},
+		{map[string]interface{}{"allow": true, "deny": []interface{}{"quota exceeded"}}, false},
+		{map[string]interface{}{}, false},
+	}
+	for _, c := range cases {
+		decision, err := regoDecision(c.value)
+		if err != nil || decision.Allow != c.allow {
+			t.Errorf("regoDecision(%v) = %+v, %v; want allow %v", c.value, decision, err, c.allow)
+		}
+	}
+	if decision, _ := regoDecision(map[string]interface{}{"deny": []interface{}{"quota exceeded"}}); len(decision.Reasons) != 1 || decision.Reasons[0] != "quota exceeded" {
+		t.Errorf("Expected the deny reason, got %+v", decision)
+	}
+	for _, value := range []interface{}{true, map[string]interface{}{"deny": "no"}} {
+		if _, err := regoDecision(value); err == nil {
+			t.Errorf("Expected %v to be rejected", value)
+		}
+	}
+}
+
+func TestLoadAdmissionPolicy(t *testing.T) {
+	if newRegoPolicy != nil {
+		t.Skip("Rego support is built in")
+	}
+	path := filepath.Join(t.TempDir(), "admission.rego")
+	os.WriteFile(path, []byte("package fem.admission\n\nallow := true\n"), 0600)
+	if _, err := LoadAdmissionPolicy(path); err == nil || !strings.Contains(err.Error(), "-tags opa") {
+		t.Errorf("Expected builds without opa to refuse Rego policies, got %v", err)
+	}
+}
+
+func TestAdmissionPolicyGatesEnvelopes(t *testing.T) {
+	broker := NewBroker()
+	pubKey, key, _ := protocol.GenerateKeyPair()
+	broker.agents["sensor-agent"] = &Agent{ID: "sensor-agent", Capabilities: []string{"sensor.read"}, PubKey: pubKey}
+
+	var seen *AdmissionInput
+	broker.SetAdmissionPolicy(AdmissionPolicyFunc(func(ctx context.Context, input *AdmissionInput) (AdmissionDecision, error) {
+		seen = input
+		switch {
+		case input.Type == string(protocol.EnvelopeEmitEvent) && input.Sender == nil:
+			return AdmissionDecision{Reasons: []string{"unregistered senders may not emit events"}}, nil
+		case input.Body["event"] == "explode":
+			return AdmissionDecision{}, errors.New("policy store unavailable")
+		}
+		return AdmissionDecision{Allow: true}, nil
+	}))
+
+	emitSigned := func(agent, event string, signer ed25519.PrivateKey) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeEmitEvent}}
+		env.Agent = agent
+		env.Nonce = protocol.NewNonce()
+		env.TS = time.Now().UnixMilli()
+		env.Body, _ = json.Marshal(protocol.EmitEventBody{Event: event})
+		if signer != nil {
+			protocol.SignEnvelope(env, signer)
+		}
+		recorder := newBufferedResponse()
+		broker.dispatchEnvelope(recorder, env)
+		return recorder
+	}
+	emit := func(agent, event string) *bufferedResponse {
+		return emitSigned(agent, event, key)
+	}
+
+	recorder := emitSigned("stranger-agent", "sensor.reading", nil)
+	if recorder.status != http.StatusForbidden || !strings.Contains(recorder.body.String(), "unregistered senders") {
+		t.Errorf("Expected the policy to deny the stranger with its reason, got %d: %s", recorder.status, recorder.body.String())
+	}
+
+	// The policy sees the body and the sender's registration
+	recorder = emit("sensor-agent", "sensor.reading")
+	if recorder.status == http.StatusForbidden {
+		t.Errorf("Expected the registered agent to be admitted, got %s", recorder.body.String())
+	}
+	if seen.Sender == nil || seen.Sender.Capabilities[0] != "sensor.read" || seen.Body["event"] != "sensor.reading" || !seen.Verified {
+		t.Errorf("Unexpected policy input %+v", seen)
+	}
+
+	// ...and whether the envelope is proven to come from it
+	emitSigned("sensor-agent", "sensor.reading", nil)
+	if seen.Sender == nil || seen.Verified {
+		t.Errorf("Expected an unsigned envelope not to be verified, got %+v", seen)
+	}
+
+	// A failing policy admits nothing
+	if recorder = emit("sensor-agent", "explode"); recorder.status != http.StatusInternalServerError {
+		t.Errorf("Expected a failing policy to deny with 500, got %d", recorder.status)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/fep-fem/protocol"
+)
+
+// handleDeregisterAgent removes an agent that is leaving of its own accord,
+// along with its MCP tools and subscriptions, and tells subscribers it left
+func (b *Broker) handleDeregisterAgent(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.DeregisterAgentBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	if !registered {
+		http.Error(w, fmt.Sprintf("Agent %s is not registered", env.Agent), http.StatusNotFound)
+		return
+	}
+	if agent.PubKey != nil {
+		if err := b.verifySender(w, env, agent.PubKey); err != nil {
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+			return
+		}
+	}
+
+	b.removeAgent(env.Agent)
+	slog.Info("Agent deregistered", "agent", env.Agent, "reason", body.Reason)
+
+	event := protocol.EmitEventBody{
+		Event: protocol.EventAgentDeregistered,
+		Payload: map[string]interface{}{
+			"agent":  env.Agent,
+			"reason": body.Reason,
+		},
+	}
+	if notice, err := b.signedEvent(event); err != nil {
+		slog.Error("Failed to sign deregistration event", "agent", env.Agent, "error", err)
+	} else {
+		// The notice is about one agent, so it stays in that agent's namespace
+		b.publishEventIn(agentNamespace(env.Agent), notice, event)
+	}
+
+	response := map[string]interface{}{
+		"status": "deregistered",
+		"agent":  env.Agent,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// removeAgent forgets an agent everywhere the broker tracks it: the agent
+// table, the MCP registry, subscriptions and storage
+func (b *Broker) removeAgent(id string) {
+	b.mu.Lock()
+	delete(b.agents, id)
+	b.mu.Unlock()
+
+	b.revokeSessions(id)
+
+	b.mcpRegistry.UnregisterAgent(id)
+	b.subscriptions.RemoveAgent(id)
+	b.monitor.Forget(id)
+	b.tiers.Forget(id)
+	b.outbox.Forget(id)
+	b.persistSubscription(id)
+	if err := b.storage().DeleteAgent(id); err != nil {
+		slog.Error("Failed to delete agent from storage", "agent", id, "error", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestAgentDeregistration(t *testing.T) {
+	received := make(chan protocol.EmitEventBody, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env protocol.GenericEnvelope
+		var body protocol.EmitEventBody
+		if err := json.NewDecoder(r.Body).Decode(&env); err == nil && env.GetBodyAs(&body) == nil {
+			received <- body
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer subscriber.Close()
+
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent},
+	}
+	env.Agent = "worker-agent"
+	env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+		PubKey:         protocol.EncodePublicKey(pubKey),
+		MCPEndpoint:    "https://worker-agent/mcp",
+		BodyDefinition: &protocol.BodyDefinition{Name: "worker", MCPTools: []protocol.MCPTool{{Name: "job.run"}}},
+	})
+	recorder := newBufferedResponse()
+	broker.handleRegisterAgent(recorder, env)
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+	broker.subscriptions.Subscribe("worker-agent", "https://worker-agent/events", []string{"job.*"})
+	broker.subscriptions.Subscribe("monitor-agent", subscriber.URL, []string{"agent.*"})
+
+	// Only the agent itself may deregister
+	_, otherKey, _ := protocol.GenerateKeyPair()
+	impostor := NewMCPClient(MCPClientConfig{
+		AgentID:     "worker-agent",
+		BrokerURL:   server.URL,
+		PrivateKey:  otherKey,
+		TLSInsecure: true,
+	})
+	if err := impostor.Deregister("hijack"); err == nil {
+		t.Fatal("Expected deregistration with the wrong key to be rejected")
+	}
+
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "worker-agent",
+		BrokerURL:   server.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+	if err := client.Deregister("shutting down"); err != nil {
+		t.Fatalf("Deregister failed: %v", err)
+	}
+
+	if _, exists := broker.agents["worker-agent"]; exists {
+		t.Error("Expected agent to be removed")
+	}
+	if broker.mcpRegistry.GetToolCount() != 0 {
+		t.Errorf("Expected agent's tools to be removed, got %d", broker.mcpRegistry.GetToolCount())
+	}
+	if _, exists := broker.subscriptions.GetSubscription("worker-agent"); exists {
+		t.Error("Expected agent's subscription to be removed")
+	}
+
+	select {
+	case event := <-received:
+		if event.Event != protocol.EventAgentDeregistered || event.Payload["agent"] != "worker-agent" || event.Payload["reason"] != "shutting down" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected subscribers to be notified of the deregistration")
+	}
+
+	// A second deregistration finds nothing to remove
+	if err := client.Deregister("again"); err == nil {
+		t.Error("Expected deregistration of an unknown agent to be rejected")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// maxHostedRequest bounds the inbound requests an AgentHost reads
+const maxHostedRequest = 4 << 20
+
+// AgentHostConfig configures an AgentHost
+type AgentHostConfig struct {
+	BrokerURL    string
+	FailoverURLs []string
+	// BaseURL is where the broker reaches the host's handler. Each
+	// identity registers BaseURL/<agent ID> as its MCP endpoint, which also
+	// receives the events it subscribes to.
+	BaseURL        string
+	RequestTimeout time.Duration
+	TLSInsecure    bool
+	DisableMsgPack bool
+	// MaxConnsPerHost caps the connections the identities share to each
+	// broker (unlimited if 0)
+	MaxConnsPerHost int
+}
+
+// AgentIdentity is one agent an AgentHost registers and operates
+type AgentIdentity struct {
+	AgentID    string
+	PrivateKey ed25519.PrivateKey
+	// Registration is sent as the agent's registration, with its public
+	// key and MCP endpoint filled in
+	Registration protocol.RegisterAgentBody
+	BearerToken  string
+	// OnToolCall runs a call of one of the agent's tools. Without it,
+	// calls are refused.
+	OnToolCall func(ctx context.Context, call protocol.ToolCallBody) (interface{}, error)
+	// OnEnvelope receives the other envelopes delivered to the agent, such
+	// as the events it subscribed to
+	OnEnvelope func(env *protocol.GenericEnvelope)
+}
+
+// HostedAgent is an identity registered by an AgentHost. Its MCPClient
+// sends the agent's envelopes, signed with its own key.
+type HostedAgent struct {
+	*MCPClient
+	identity AgentIdentity
+}
+
+// AgentHost runs several agent identities in one process, for gateways
+// fronting many logical agents. Each identity has its own key, capabilities
+// and embodiment, but they share one pool of connections to the broker.
+// The host is the http.Handler serving every identity's MCP endpoint, and
+// routes inbound tool calls and envelopes to the identity by path.
+type AgentHost struct {
+	config     AgentHostConfig
+	httpClient *http.Client
+	agents     map[string]*HostedAgent
+	mu         sync.RWMutex
+}
+
+// NewAgentHost creates a host without identities
+func NewAgentHost(config AgentHostConfig) *AgentHost {
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = 30 * time.Second
+	}
+	transport := &http.Transport{
+		MaxConnsPerHost:     config.MaxConnsPerHost,
+		MaxIdleConnsPerHost: 64,
+	}
+	if config.TLSInsecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &AgentHost{
+		config:     config,
+		httpClient: &http.Client{Transport: transport, Timeout: config.RequestTimeout},
+		agents:     make(map[string]*HostedAgent),
+	}
+}
+
+// Endpoint returns the MCP endpoint an identity registers
+func (h *AgentHost) Endpoint(agentID string) string {
+	return strings.TrimSuffix(h.config.BaseURL, "/") + "/" + url.PathEscape(agentID)
+}
+
+// Add registers an identity with the broker and starts routing its
+// inbound calls and envelopes. An identity held for approval is added,
+// and Add returns protocol.ErrRegistrationPending.
+func (h *AgentHost) Add(identity AgentIdentity) (*HostedAgent, error) {
+	if identity.AgentID == "" || identity.PrivateKey == nil {
+		return nil, errors.New("an agent ID and private key are required")
+	}
+	h.mu.Lock()
+	if _, exists := h.agents[identity.AgentID]; exists {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("agent %s is already hosted", identity.AgentID)
+	}
+	agent := &HostedAgent{
+		MCPClient: NewMCPClient(MCPClientConfig{
+			AgentID:        identity.AgentID,
+			BrokerURL:      h.config.BrokerURL,
+			FailoverURLs:   h.config.FailoverURLs,
+			PrivateKey:     identity.PrivateKey,
+			DisableMsgPack: h.config.DisableMsgPack,
+			BearerToken:    identity.BearerToken,
+			HTTPClient:     h.httpClient,
+		}),
+		identity: identity,
+	}
+	// Routed before registering, since the broker may list the agent's
+	// tools while it registers
+	h.agents[identity.AgentID] = agent
+	h.mu.Unlock()
+
+	registration := identity.Registration
+	registration.PubKey = protocol.EncodePublicKey(identity.PrivateKey.Public().(ed25519.PublicKey))
+	registration.MCPEndpoint = h.Endpoint(identity.AgentID)
+	err := agent.Register(registration)
+	if err != nil && !errors.Is(err, protocol.ErrRegistrationPending) {
+		h.mu.Lock()
+		delete(h.agents, identity.AgentID)
+		h.mu.Unlock()
+		return nil, err
+	}
+	return agent, err
+}
+
+// Remove deregisters an identity and stops routing to it
+func (h *AgentHost) Remove(agentID, reason string) error {
+	h.mu.Lock()
+	agent, exists := h.agents[agentID]
+	delete(h.agents, agentID)
+	h.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("agent %s is not hosted", agentID)
+	}
+	return agent.Deregister(reason)
+}
+
+// Get returns a hosted identity
+func (h *AgentHost) Get(agentID string) (*HostedAgent, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	agent, exists := h.agents[agentID]
+	return agent, exists
+}
+
+// Agents lists the hosted identities, sorted by ID
+func (h *AgentHost) Agents() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]string, 0, len(h.agents))
+	for id := range h.agents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Heartbeat reports every hosted identity alive, returning the first
+// failure
+func (h *AgentHost) Heartbeat(status string) error {
+	var first error
+	for _, id := range h.Agents() {
+		if agent, exists := h.Get(id); exists {
+			if _, err := agent.Heartbeat(status); err != nil && first == nil {
+				first = fmt.Errorf("%s: %w", id, err)
+			}
+		}
+	}
+	return first
+}
+
+// Close deregisters every hosted identity
+func (h *AgentHost) Close() {
+	for _, id := range h.Agents() {
+		if err := h.Remove(id, "host shutting down"); err != nil {
+			slog.Warn("Failed to deregister hosted agent", "agent", id, "error", err)
+		}
+	}
+	h.httpClient.CloseIdleConnections()
+}
+
+// hostedRPC is the part of a JSON-RPC request the host reads
+type hostedRPC struct {
+	Method string `json:"method"`
+	Params struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+		Meta      struct {
+			RequestID string `json:"requestId"`
+		} `json:"_meta"`
+	} `json:"params"`
+	ID interface{} `json:"id"`
+}
+
+// ServeHTTP routes a request to the identity named by the last element of
+// its path: JSON-RPC tools/list and tools/call requests to its tools, and
+// envelopes to its OnEnvelope
+func (h *AgentHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := url.PathUnescape(r.URL.EscapedPath()[strings.LastIndex(r.URL.EscapedPath(), "/")+1:])
+	agent, exists := h.Get(id)
+	if err != nil || !exists {
+		http.Error(w, "Unknown agent", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxHostedRequest))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	var rpc hostedRPC
+	if err := json.Unmarshal(data, &rpc); err == nil && rpc.Method != "" {
+		agent.serveRPC(w, r, rpc)
+		return
+	}
+	env, err := protocol.ParseEnvelope(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid envelope: %v", err), http.StatusBadRequest)
+		return
+	}
+	env.RemoteAddr = r.RemoteAddr
+	if agent.identity.OnEnvelope != nil {
+		agent.identity.OnEnvelope(env)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveRPC answers tools/list with the identity's tools and tools/call by
+// running its OnToolCall
+func (a *HostedAgent) serveRPC(w http.ResponseWriter, r *http.Request, rpc hostedRPC) {
+	switch rpc.Method {
+	case "tools/list":
+		tools := []protocol.MCPTool{}
+		if definition := a.identity.Registration.BodyDefinition; definition != nil {
+			tools = definition.MCPTools
+		}
+		writeHostedRPC(w, rpc.ID, map[string]interface{}{"tools": tools}, nil)
+	case "tools/call":
+		if a.identity.OnToolCall == nil {
+			writeHostedRPC(w, rpc.ID, nil, fmt.Errorf("agent %s has no tools", a.agentID))
+			return
+		}
+		result, err := a.identity.OnToolCall(r.Context(), protocol.ToolCallBody{
+			Tool:       rpc.Params.Name,
+			Parameters: rpc.Params.Arguments,
+			RequestID:  rpc.Params.Meta.RequestID,
+		})
+		writeHostedRPC(w, rpc.ID, result, err)
+	default:
+		writeHostedRPC(w, rpc.ID, nil, errors.New("method not found: "+rpc.Method))
+	}
+}
+
+func writeHostedRPC(w http.ResponseWriter, id interface{}, result interface{}, err error) {
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		response["error"] = map[string]interface{}{"code": -32000, "message": err.Error()}
+	} else {
+		response["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestAgentHostRoutesByIdentity(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	host := NewAgentHost(AgentHostConfig{BrokerURL: server.URL, TLSInsecure: true, MaxConnsPerHost: 2})
+	gateway := httptest.NewServer(host)
+	defer gateway.Close()
+	host.config.BaseURL = gateway.URL + "/agents"
+
+	events := make(chan string, 1)
+	add := func(id, tool string, run func(string) string) *HostedAgent {
+		_, key, _ := protocol.GenerateKeyPair()
+		agent, err := host.Add(AgentIdentity{
+			AgentID:    id,
+			PrivateKey: key,
+			Registration: protocol.RegisterAgentBody{
+				Capabilities:   []string{tool},
+				BodyDefinition: &protocol.BodyDefinition{Name: id, MCPTools: []protocol.MCPTool{{Name: tool}}},
+			},
+			OnToolCall: func(ctx context.Context, call protocol.ToolCallBody) (interface{}, error) {
+				if call.Tool != tool {
+					return nil, errors.New("unknown tool " + call.Tool)
+				}
+				return run(call.Parameters["text"].(string)), nil
+			},
+			OnEnvelope: func(env *protocol.GenericEnvelope) {
+				events <- id + ":" + env.Agent
+			},
+		})
+		if err != nil {
+			t.Fatalf("Adding %s failed: %v", id, err)
+		}
+		return agent
+	}
+	add("gw-echo", "echo", func(text string) string { return text })
+	upper := add("gw-upper", "upper", strings.ToUpper)
+
+	if agents := host.Agents(); len(agents) != 2 || agents[0] != "gw-echo" {
+		t.Fatalf("Expected both identities to be hosted, got %v", agents)
+	}
+	for _, id := range []string{"gw-echo", "gw-upper"} {
+		if _, registered := broker.agents[id]; !registered {
+			t.Errorf("Expected %s to be registered", id)
+		}
+	}
+
+	caller, _ := approvalClient(server, "caller")
+	for _, tc := range []struct{ agent, tool, want string }{
+		{"gw-echo", "echo", "hello"},
+		{"gw-upper", "upper", "HELLO"},
+	} {
+		result, err := caller.CallTool(tc.agent, tc.tool, map[string]interface{}{"text": "hello"})
+		if err != nil || result != tc.want {
+			t.Errorf("Calling %s on %s: expected %q, got %v (%v)", tc.tool, tc.agent, tc.want, result, err)
+		}
+	}
+	if _, err := caller.CallTool("gw-echo", "upper", map[string]interface{}{"text": "hello"}); err == nil {
+		t.Error("Expected gw-echo not to run gw-upper's tool")
+	}
+
+	// Events reach the identity that subscribed
+	subscribe := protocol.NewEnvelope(protocol.EnvelopeSubscribe, "gw-upper")
+	subscribe.Body, _ = json.Marshal(protocol.SubscribeBody{Events: []string{"text.*"}})
+	protocol.SignEnvelope(subscribe, upper.signer)
+	if _, err := upper.sendRequest(subscribe); err != nil {
+		t.Fatalf("Subscribing failed: %v", err)
+	}
+	if err := caller.EmitEvent("text.changed", map[string]interface{}{"text": "hi"}); err != nil {
+		t.Fatalf("Emitting failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		if event != "gw-upper:caller" {
+			t.Errorf("Expected the event to reach gw-upper, got %s", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the event to be delivered")
+	}
+
+	if err := host.Heartbeat("ok"); err != nil {
+		t.Errorf("Heartbeat failed: %v", err)
+	}
+	host.Close()
+	if len(host.Agents()) != 0 || len(broker.agents) != 0 {
+		t.Errorf("Expected closing the host to deregister its identities, %d agents left", len(broker.agents))
+	}
+}
+
+func TestAgentHostRefusesDuplicates(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	host := NewAgentHost(AgentHostConfig{BrokerURL: server.URL, BaseURL: "http://gateway.invalid", TLSInsecure: true})
+	_, key, _ := protocol.GenerateKeyPair()
+	if _, err := host.Add(AgentIdentity{AgentID: "gw-1", PrivateKey: key}); err != nil {
+		t.Fatalf("Adding gw-1 failed: %v", err)
+	}
+	if _, err := host.Add(AgentIdentity{AgentID: "gw-1", PrivateKey: key}); err == nil {
+		t.Error("Expected a second gw-1 to be refused")
+	}
+	if err := host.Remove("gw-2", "test"); err == nil {
+		t.Error("Expected removing an unknown identity to fail")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMCPStartTimeout bounds how long a manifest's MCP server has to
+// start answering tools/list
+const defaultMCPStartTimeout = 30 * time.Second
+
+// AgentManifest declares an agent: its identity, capabilities and body, the
+// broker it registers with, and the MCP server serving its tools. An
+// AgentSupervisor runs the agent it declares, so common agents need no Go
+// code of their own.
+type AgentManifest struct {
+	AgentID string `json:"id"`
+	// KeyFile holds the agent's base64 Ed25519 key, created if missing
+	// (a new key each start if empty)
+	KeyFile         string                 `json:"keyFile,omitempty"`
+	Capabilities    []string               `json:"capabilities,omitempty"` // The body's capabilities if empty
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	EnvironmentType string                 `json:"environmentType,omitempty"` // The body's environment if empty
+	// Body is the agent's embodiment, constraints included. Its tools are
+	// filled in from the MCP server's tools/list if it lists none.
+	Body          *protocol.BodyDefinition `json:"body,omitempty"`
+	Broker        ManifestBroker           `json:"broker"`
+	MCP           ManifestMCP              `json:"mcp"`
+	Subscriptions []string                 `json:"subscriptions,omitempty"` // Event patterns delivered to the MCP endpoint
+	// Heartbeat is the interval between heartbeats, a third of the
+	// broker's agent TTL if empty
+	Heartbeat string `json:"heartbeat,omitempty"`
+	Acks      bool   `json:"acks,omitempty"`
+
+	heartbeat    time.Duration
+	startTimeout time.Duration
+}
+
+// ManifestBroker is the broker a manifest's agent registers with
+type ManifestBroker struct {
+	URL            string   `json:"url"`
+	FailoverURLs   []string `json:"failoverUrls,omitempty"`
+	TLSInsecure    bool     `json:"tlsInsecure,omitempty"`
+	BearerToken    string   `json:"bearerToken,omitempty"`
+	BootstrapToken string   `json:"bootstrapToken,omitempty"`
+	Invitation     string   `json:"invitation,omitempty"`
+}
+
+// ManifestMCP is the MCP server serving a manifest's agent. Without a
+// command, the server at the endpoint is run by something else.
+type ManifestMCP struct {
+	Command      []string          `json:"command,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Dir          string            `json:"dir,omitempty"`
+	Endpoint     string            `json:"endpoint"`
+	StartTimeout string            `json:"startTimeout,omitempty"`
+}
+
+// LoadAgentManifest reads a manifest from a YAML or JSON file. ${VAR}
+// references are replaced from the environment, so secrets such as tokens
+// need not be written into the file, and relative paths are taken from the
+// file's directory.
+func LoadAgentManifest(path string) (*AgentManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseAgentManifest([]byte(os.ExpandEnv(string(data))))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	if manifest.KeyFile != "" && !filepath.IsAbs(manifest.KeyFile) {
+		manifest.KeyFile = filepath.Join(dir, manifest.KeyFile)
+	}
+	if manifest.MCP.Dir == "" {
+		manifest.MCP.Dir = dir
+	} else if !filepath.IsAbs(manifest.MCP.Dir) {
+		manifest.MCP.Dir = filepath.Join(dir, manifest.MCP.Dir)
+	}
+	return manifest, nil
+}
+
+// ParseAgentManifest parses and validates a YAML or JSON manifest. Unknown
+// fields are refused, so a misspelled setting is not silently ignored.
+func ParseAgentManifest(data []byte) (*AgentManifest, error) {
+	// YAML is decoded generically and read through the JSON field names,
+	// which the protocol's body definition already has; JSON is YAML too
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	converted, err := json.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	var manifest AgentManifest
+	decoder := json.NewDecoder(bytes.NewReader(converted))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (m *AgentManifest) validate() error {
+	switch {
+	case m.AgentID == "":
+		return errors.New("id is required")
+	case m.Broker.URL == "":
+		return errors.New("broker.url is required")
+	case m.MCP.Endpoint == "":
+		return errors.New("mcp.endpoint is required")
+	}
+
+	var err error
+	if m.Heartbeat != "" {
+		if m.heartbeat, err = time.ParseDuration(m.Heartbeat); err != nil || m.heartbeat <= 0 {
+			return fmt.Errorf("heartbeat must be a positive duration, got %q", m.Heartbeat)
+		}
+	}
+	m.startTimeout = defaultMCPStartTimeout
+	if m.MCP.StartTimeout != "" {
+		if m.startTimeout, err = time.ParseDuration(m.MCP.StartTimeout); err != nil || m.startTimeout <= 0 {
+			return fmt.Errorf("mcp.startTimeout must be a positive duration, got %q", m.MCP.StartTimeout)
+		}
+	}
+	return nil
+}
+
+// ClientConfig returns the configuration of the agent's broker client
+func (m *AgentManifest) ClientConfig(key ed25519.PrivateKey) MCPClientConfig {
+	return MCPClientConfig{
+		AgentID:      m.AgentID,
+		BrokerURL:    m.Broker.URL,
+		FailoverURLs: m.Broker.FailoverURLs,
+		PrivateKey:   key,
+		TLSInsecure:  m.Broker.TLSInsecure,
+		BearerToken:  m.Broker.BearerToken,
+	}
+}
+
+// Registration returns the agent's registration, signed for by key
+func (m *AgentManifest) Registration(key ed25519.PrivateKey) protocol.RegisterAgentBody {
+	registration := protocol.RegisterAgentBody{
+		PubKey:          protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Capabilities:    m.Capabilities,
+		Metadata:        m.Metadata,
+		MCPEndpoint:     m.MCP.Endpoint,
+		EnvironmentType: m.EnvironmentType,
+		Invitation:      m.Broker.Invitation,
+		BootstrapToken:  m.Broker.BootstrapToken,
+		Acks:            m.Acks,
+	}
+	if m.Body != nil {
+		body := *m.Body
+		registration.BodyDefinition = &body
+		if len(registration.Capabilities) == 0 {
+			registration.Capabilities = body.Capabilities
+		}
+		if registration.EnvironmentType == "" {
+			registration.EnvironmentType = body.Environment
+		}
+	}
+	return registration
+}
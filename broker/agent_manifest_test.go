@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+const testManifest = `
+id: sensor-1
+keyFile: sensor.key
+metadata:
+  owner: lab
+body:
+  name: sensor
+  environment: edge
+  capabilities: [sensor.read]
+  constraints:
+    maxRate: 10
+broker:
+  url: https://broker:4433
+  bearerToken: ${TEST_MANIFEST_TOKEN}
+mcp:
+  command: [./sensor-server, --port, "9000"]
+  env:
+    SENSOR_BUS: i2c-1
+  endpoint: http://127.0.0.1:9000/mcp
+  startTimeout: 5s
+subscriptions: [calibration.*]
+heartbeat: 20s
+`
+
+func TestLoadAgentManifest(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TEST_MANIFEST_TOKEN", "secret")
+
+	yamlPath := filepath.Join(dir, "sensor.yaml")
+	os.WriteFile(yamlPath, []byte(testManifest), 0o600)
+	manifest, err := LoadAgentManifest(yamlPath)
+	if err != nil {
+		t.Fatalf("Loading the YAML manifest failed: %v", err)
+	}
+	if manifest.Broker.BearerToken != "secret" || manifest.KeyFile != filepath.Join(dir, "sensor.key") || manifest.MCP.Dir != dir {
+		t.Errorf("Expected the token expanded and paths resolved, got %+v", manifest)
+	}
+	if manifest.heartbeat.Seconds() != 20 || manifest.startTimeout.Seconds() != 5 {
+		t.Errorf("Expected the durations parsed, got %s and %s", manifest.heartbeat, manifest.startTimeout)
+	}
+
+	_, key, _ := protocol.GenerateKeyPair()
+	registration := manifest.Registration(key)
+	if len(registration.Capabilities) != 1 || registration.EnvironmentType != "edge" ||
+		registration.BodyDefinition.Constraints["maxRate"] != float64(10) || registration.MCPEndpoint != "http://127.0.0.1:9000/mcp" {
+		t.Errorf("Unexpected registration %+v", registration)
+	}
+
+	// The same manifest as JSON
+	converted, _ := ParseAgentManifest([]byte(testManifest))
+	data, _ := json.Marshal(converted)
+	jsonPath := filepath.Join(dir, "sensor.json")
+	os.WriteFile(jsonPath, data, 0o600)
+	if fromJSON, err := LoadAgentManifest(jsonPath); err != nil || fromJSON.AgentID != "sensor-1" || len(fromJSON.MCP.Command) != 3 {
+		t.Errorf("Expected the JSON manifest to load, got %+v (%v)", fromJSON, err)
+	}
+}
+
+func TestAgentManifestValidation(t *testing.T) {
+	valid := "id: a\nbroker: {url: https://broker}\nmcp: {endpoint: http://mcp}\n"
+	if _, err := ParseAgentManifest([]byte(valid)); err != nil {
+		t.Fatalf("Expected the minimal manifest to parse, got %v", err)
+	}
+	for name, manifest := range map[string]string{
+		"no id":           "broker: {url: https://broker}\nmcp: {endpoint: http://mcp}\n",
+		"no broker":       "id: a\nmcp: {endpoint: http://mcp}\n",
+		"no endpoint":     "id: a\nbroker: {url: https://broker}\n",
+		"unknown field":   valid + "capabilitys: [x]\n",
+		"bad heartbeat":   valid + "heartbeat: often\n",
+		"bad timeout":     "id: a\nbroker: {url: https://broker}\nmcp: {endpoint: http://mcp, startTimeout: -1s}\n",
+		"not a manifest":  "- a\n- b\n",
+		"malformed input": "id: [a\n",
+	} {
+		if _, err := ParseAgentManifest([]byte(manifest)); err == nil {
+			t.Errorf("%s: expected the manifest to be refused", name)
+		}
+	}
+}
+
+func TestAgentSupervisorRegisters(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	mcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request hostedRPC
+		json.NewDecoder(r.Body).Decode(&request)
+		writeHostedRPC(w, request.ID, map[string]interface{}{"tools": []protocol.MCPTool{{Name: "read"}}}, nil)
+	}))
+	defer mcp.Close()
+
+	manifest, err := ParseAgentManifest([]byte(`
+id: sensor-1
+body: {name: sensor, capabilities: [sensor.read]}
+broker: {url: ` + server.URL + `, tlsInsecure: true}
+mcp: {endpoint: ` + mcp.URL + `}
+subscriptions: [calibration.*]
+`))
+	if err != nil {
+		t.Fatalf("Parsing the manifest failed: %v", err)
+	}
+	supervisor, err := NewAgentSupervisor(manifest)
+	if err != nil {
+		t.Fatalf("Creating the supervisor failed: %v", err)
+	}
+	if err := supervisor.Start(); err != nil {
+		t.Fatalf("Starting the agent failed: %v", err)
+	}
+
+	tools := broker.mcpRegistry.AgentTools("sensor-1")
+	if len(tools) != 1 || tools[0].Tool.Name != "read" || tools[0].MCPEndpoint != mcp.URL {
+		t.Fatalf("Expected the agent registered with its listed tools, got %+v", tools)
+	}
+	if _, subscribed := broker.subscriptions.GetSubscription("sensor-1"); !subscribed {
+		t.Error("Expected the agent to be subscribed")
+	}
+
+	if err := supervisor.Stop(); err != nil {
+		t.Errorf("Stopping the agent failed: %v", err)
+	}
+	if _, registered := broker.agents["sensor-1"]; registered {
+		t.Error("Expected stopping to deregister the agent")
+	}
+}
+
+func TestAgentSupervisorServerExits(t *testing.T) {
+	if _, err := exec.LookPath("false"); err != nil {
+		t.Skip("false is not available")
+	}
+	manifest, err := ParseAgentManifest([]byte("id: a\nbroker: {url: https://127.0.0.1:1}\nmcp: {command: [\"false\"], endpoint: http://127.0.0.1:1/mcp}\n"))
+	if err != nil {
+		t.Fatalf("Parsing the manifest failed: %v", err)
+	}
+	supervisor, err := NewAgentSupervisor(manifest)
+	if err != nil {
+		t.Fatalf("Creating the supervisor failed: %v", err)
+	}
+	err = supervisor.Start()
+	if err == nil || !strings.Contains(err.Error(), "exited before answering") || errors.Is(err, protocol.ErrRegistrationPending) {
+		t.Errorf("Expected a server that exits to fail the start, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// agentEvictionFactor is how many TTLs an agent may stay silent before it is
+// evicted; after one TTL it is only marked stale
+const agentEvictionFactor = 3
+
+// SetAgentTTL sets how long an agent may go without a heartbeat before it
+// is marked stale. Zero disables stale marking and eviction.
+func (b *Broker) SetAgentTTL(ttl time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.agentTTL = ttl
+}
+
+// handleAgentHeartbeat records that a registered agent is alive. Heartbeats
+// from agents with a known key must carry a valid signature.
+func (b *Broker) handleAgentHeartbeat(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.AgentHeartbeatBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	if !registered {
+		http.Error(w, fmt.Sprintf("Agent %s is not registered", env.Agent), http.StatusNotFound)
+		return
+	}
+	if agent.PubKey != nil {
+		if err := b.verifySender(w, env, agent.PubKey); err != nil {
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+			return
+		}
+	}
+
+	b.mu.Lock()
+	wasStale := agent.Stale
+	agent.LastSeen = time.Now()
+	agent.Stale = false
+	agent.InFlight = body.InFlight
+	agent.Queued = body.Queued
+	ttl := b.agentTTL
+	b.mu.Unlock()
+
+	b.mcpRegistry.UpdateAgentHeartbeat(env.Agent)
+	if wasStale {
+		slog.Info("Agent is alive again", "agent", env.Agent)
+	}
+
+	// Brokers sharing storage reap from the stored heartbeat time
+	if _, shared := b.storage().(SharedStorage); shared {
+		b.persistAgent(env.Agent)
+	}
+
+	response := map[string]interface{}{
+		"status": "alive",
+		"agent":  env.Agent,
+		"ttlMs":  ttl.Milliseconds(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// leastBusyProvider picks the provider to route a call to: the first whose
+// agent reported no queued calls in its last heartbeat, or else the one
+// with the shortest queue
+func (b *Broker) leastBusyProvider(providers []*RegisteredTool) *RegisteredTool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	best, bestQueued := providers[0], -1
+	for _, provider := range providers {
+		queued := 0
+		if agent, exists := b.agents[provider.AgentID]; exists {
+			queued = agent.Queued
+		}
+		if bestQueued < 0 || queued < bestQueued {
+			best, bestQueued = provider, queued
+		}
+		if queued == 0 {
+			break
+		}
+	}
+	return best
+}
+
+// ReapAgents checks for silent agents on every interval until stop is
+// closed, marking them stale after the agent TTL and evicting them after
+// agentEvictionFactor TTLs
+func (b *Broker) ReapAgents(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.reapAgents(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reapAgents marks and evicts agents that have been silent since before now
+func (b *Broker) reapAgents(now time.Time) {
+	var stale, evicted []string
+
+	b.mu.Lock()
+	ttl := b.agentTTL
+	if ttl <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	for id, agent := range b.agents {
+		silent := now.Sub(agent.LastSeen)
+		switch {
+		case silent > ttl*agentEvictionFactor:
+			delete(b.agents, id)
+			evicted = append(evicted, id)
+		case silent > ttl && !agent.Stale:
+			agent.Stale = true
+			stale = append(stale, id)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, id := range stale {
+		b.mcpRegistry.MarkAgentStale(id)
+		slog.Warn("Agent missed its heartbeat and is stale", "agent", id)
+	}
+
+	for _, id := range evicted {
+		// Another broker sharing the store may have seen a heartbeat
+		if shared, ok := b.storage().(SharedStorage); ok {
+			stored, _, _, err := shared.LoadAgent(id)
+			if err == nil && stored != nil && now.Sub(stored.LastSeen) <= ttl*agentEvictionFactor {
+				b.refreshAgent(shared, id)
+				continue
+			}
+		}
+
+		b.removeAgent(id)
+		slog.Warn("Evicted agent without a heartbeat", "agent", id, "after", ttl*agentEvictionFactor)
+	}
+}
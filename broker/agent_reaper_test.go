@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestAgentHeartbeatAndEviction(t *testing.T) {
+	broker := NewBroker()
+	broker.SetAgentTTL(time.Minute)
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent},
+	}
+	env.Agent = "sensor-agent"
+	env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+		PubKey:         protocol.EncodePublicKey(pubKey),
+		MCPEndpoint:    "https://sensor-agent/mcp",
+		BodyDefinition: &protocol.BodyDefinition{Name: "sensor", MCPTools: []protocol.MCPTool{{Name: "sensor.read"}}},
+	})
+	recorder := newBufferedResponse()
+	broker.handleRegisterAgent(recorder, env)
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+	broker.subscriptions.Subscribe("sensor-agent", "https://sensor-agent/events", []string{"sensor.*"})
+
+	discoverable := func() bool {
+		tools, _ := broker.mcpRegistry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"sensor.*"}})
+		return len(tools) == 1
+	}
+
+	// Silent for longer than the TTL: stale and hidden from discovery
+	broker.reapAgents(time.Now().Add(2 * time.Minute))
+	if discoverable() {
+		t.Error("Expected stale agent's tools to be hidden from discovery")
+	}
+	if _, exists := broker.agents["sensor-agent"]; !exists {
+		t.Fatal("Expected stale agent to stay registered")
+	}
+
+	// A heartbeat brings it back
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "sensor-agent",
+		BrokerURL:   server.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+	ttl, err := client.Heartbeat("ok")
+	if err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	if ttl != time.Minute {
+		t.Errorf("Expected TTL of 1m, got %v", ttl)
+	}
+	if !discoverable() {
+		t.Error("Expected agent to be discoverable after its heartbeat")
+	}
+
+	// Silent for longer than the eviction window: removed with its tools
+	broker.reapAgents(time.Now().Add(4 * time.Minute))
+	if _, exists := broker.agents["sensor-agent"]; exists {
+		t.Error("Expected agent to be evicted")
+	}
+	if broker.mcpRegistry.GetToolCount() != 0 {
+		t.Errorf("Expected evicted agent's tools to be removed, got %d", broker.mcpRegistry.GetToolCount())
+	}
+	if _, exists := broker.subscriptions.GetSubscription("sensor-agent"); exists {
+		t.Error("Expected evicted agent's subscription to be removed")
+	}
+	if agents, _ := broker.storage().LoadAgents(); len(agents) != 0 {
+		t.Errorf("Expected evicted agent to be deleted from storage, got %d agents", len(agents))
+	}
+
+	// Evicted agents must register again before sending heartbeats
+	if _, err := client.Heartbeat("ok"); err == nil {
+		t.Error("Expected heartbeat from an evicted agent to be rejected")
+	}
+}
+
+func TestReapAgentsDisabledWithoutTTL(t *testing.T) {
+	broker := NewBroker()
+	broker.agents["quiet-agent"] = &Agent{ID: "quiet-agent", LastSeen: time.Now().Add(-time.Hour)}
+
+	broker.reapAgents(time.Now())
+	if _, exists := broker.agents["quiet-agent"]; !exists {
+		t.Error("Expected agents to be kept when no TTL is set")
+	}
+}
+
+func TestLeastBusyProvider(t *testing.T) {
+	broker := NewBroker()
+	broker.agents["gpu-a"] = &Agent{ID: "gpu-a", Queued: 5}
+	broker.agents["gpu-b"] = &Agent{ID: "gpu-b", Queued: 2}
+	broker.agents["gpu-c"] = &Agent{ID: "gpu-c", Queued: 3}
+	providers := []*RegisteredTool{{AgentID: "gpu-a"}, {AgentID: "gpu-b"}, {AgentID: "gpu-c"}}
+
+	if provider := broker.leastBusyProvider(providers); provider.AgentID != "gpu-b" {
+		t.Errorf("Expected the shortest queue to win, got %s", provider.AgentID)
+	}
+
+	broker.agents["gpu-c"].Queued = 0
+	if provider := broker.leastBusyProvider(providers); provider.AgentID != "gpu-c" {
+		t.Errorf("Expected an idle agent to win, got %s", provider.AgentID)
+	}
+}
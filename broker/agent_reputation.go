@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// ReputationSettings tune how agents' trust scores move. Scores run from
+// 0 to 1.
+type ReputationSettings struct {
+	Neutral    float64       // Score of a new agent, and the one idle agents drift back to
+	Decay      time.Duration // Idle time over which a score moves halfway back to Neutral; 0 never decays
+	Reward     float64       // Added for each successful call
+	Penalty    float64       // Taken for each failed call
+	Quarantine float64       // Score below which an agent is quarantined
+	Release    float64       // Score a quarantined agent must regain
+	Probation  int           // Successful calls in a row a quarantined agent must also make
+	Recovery   float64       // Share of Reward a quarantined agent earns
+}
+
+// defaultReputationSettings quarantine an agent after about three failures
+// more than successes, and release it after 20 good calls in a row
+var defaultReputationSettings = ReputationSettings{
+	Neutral:    0.5,
+	Decay:      24 * time.Hour,
+	Reward:     0.02,
+	Penalty:    0.1,
+	Quarantine: 0.2,
+	Release:    0.5,
+	Probation:  20,
+	Recovery:   0.5,
+}
+
+// ParseReputationSettings parses settings written as
+// "decay=24h,penalty=0.1,probation=20". Settings left out keep their
+// defaults.
+func ParseReputationSettings(spec string) (ReputationSettings, error) {
+	settings := defaultReputationSettings
+	for _, field := range parseSinkList(spec) {
+		name, value, found := strings.Cut(field, "=")
+		if !found {
+			return settings, fmt.Errorf("invalid reputation setting %q, expected name=value", field)
+		}
+		var err error
+		switch name {
+		case "decay":
+			settings.Decay, err = time.ParseDuration(value)
+			if err == nil && settings.Decay < 0 {
+				err = fmt.Errorf("negative")
+			}
+		case "probation":
+			settings.Probation, err = strconv.Atoi(value)
+			if err == nil && settings.Probation < 0 {
+				err = fmt.Errorf("negative")
+			}
+		case "neutral", "reward", "penalty", "quarantine", "release", "recovery":
+			var score float64
+			score, err = strconv.ParseFloat(value, 64)
+			if err == nil && (score < 0 || score > 1) {
+				err = fmt.Errorf("not between 0 and 1")
+			}
+			*settings.score(name) = score
+		default:
+			return settings, fmt.Errorf("unknown reputation setting %q", name)
+		}
+		if err != nil {
+			return settings, fmt.Errorf("invalid reputation %s %q: %v", name, value, err)
+		}
+	}
+	if settings.Quarantine >= settings.Neutral || settings.Quarantine >= settings.Release {
+		return settings, fmt.Errorf("reputation quarantine %v must be below neutral %v and release %v", settings.Quarantine, settings.Neutral, settings.Release)
+	}
+	return settings, nil
+}
+
+// score returns the setting named name, one of those between 0 and 1
+func (s *ReputationSettings) score(name string) *float64 {
+	switch name {
+	case "neutral":
+		return &s.Neutral
+	case "reward":
+		return &s.Reward
+	case "penalty":
+		return &s.Penalty
+	case "quarantine":
+		return &s.Quarantine
+	case "release":
+		return &s.Release
+	default:
+		return &s.Recovery
+	}
+}
+
+// String formats the settings as ParseReputationSettings reads them
+func (s ReputationSettings) String() string {
+	return fmt.Sprintf("neutral=%v,decay=%v,reward=%v,penalty=%v,quarantine=%v,release=%v,probation=%d,recovery=%v",
+		s.Neutral, s.Decay, s.Reward, s.Penalty, s.Quarantine, s.Release, s.Probation, s.Recovery)
+}
+
+// agentReputation is one agent's standing
+type agentReputation struct {
+	score       float64
+	updated     time.Time // When score was last decayed
+	active      time.Time // When the agent last answered a call
+	quarantined bool
+	streak      int // Successful calls in a row
+}
+
+// ReputationRecord is an agent's standing as the admin API reports it
+type ReputationRecord struct {
+	Agent        string    `json:"agent"`
+	Score        float64   `json:"score"`
+	Quarantined  bool      `json:"quarantined"`
+	Streak       int       `json:"streak"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// Reputation scores agents by how the calls routed to them turn out.
+// Scores drift back to neutral while an agent is idle, so old failures are
+// forgiven and old successes do not last forever. An agent whose score
+// falls too low is quarantined: discovery leaves it out until it has
+// earned its way back with a run of successful calls. Records outlive
+// registrations, so re-registering does not clear a quarantine.
+type Reputation struct {
+	settings ReputationSettings
+	agents   map[string]*agentReputation
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+// NewReputation creates a table with the default settings
+func NewReputation() *Reputation {
+	return &Reputation{
+		settings: defaultReputationSettings,
+		agents:   make(map[string]*agentReputation),
+		now:      time.Now,
+	}
+}
+
+// SetSettings replaces the settings. Scores are kept; they move by the new
+// settings from now on.
+func (r *Reputation) SetSettings(settings ReputationSettings) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	for _, agent := range r.agents {
+		r.decay(agent, now)
+	}
+	r.settings = settings
+}
+
+// decay moves an agent's score toward neutral for the time since it was
+// last decayed. The caller holds the lock.
+func (r *Reputation) decay(agent *agentReputation, now time.Time) {
+	if r.settings.Decay > 0 && now.After(agent.updated) {
+		idle := now.Sub(agent.updated).Seconds() / r.settings.Decay.Seconds()
+		agent.score = r.settings.Neutral + (agent.score-r.settings.Neutral)*math.Pow(0.5, idle)
+	}
+	agent.updated = now
+}
+
+// Record scores the outcome of a call routed to an agent
+func (r *Reputation) Record(agentID string, success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	agent, exists := r.agents[agentID]
+	if !exists {
+		agent = &agentReputation{score: r.settings.Neutral, updated: now}
+		r.agents[agentID] = agent
+	}
+	r.decay(agent, now)
+	agent.active = now
+
+	if !success {
+		agent.streak = 0
+		agent.score = math.Max(0, agent.score-r.settings.Penalty)
+		if !agent.quarantined && agent.score < r.settings.Quarantine {
+			agent.quarantined = true
+			slog.Warn("Agent quarantined for its failure rate", "agent", agentID, "score", agent.score)
+		}
+		return
+	}
+
+	agent.streak++
+	reward := r.settings.Reward
+	if agent.quarantined {
+		reward *= r.settings.Recovery
+	}
+	agent.score = math.Min(1, agent.score+reward)
+	if agent.quarantined && agent.streak >= r.settings.Probation && agent.score >= r.settings.Release {
+		agent.quarantined = false
+		slog.Info("Agent released from quarantine", "agent", agentID, "score", agent.score)
+	}
+}
+
+// Score returns an agent's current score and whether it is quarantined.
+// Agents without a record have the neutral score.
+func (r *Reputation) Score(agentID string) (float64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return r.settings.Neutral, false
+	}
+	r.decay(agent, r.now())
+	return agent.score, agent.quarantined
+}
+
+// Records returns every agent's standing, sorted by agent ID
+func (r *Reputation) Records() []ReputationRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	records := make([]ReputationRecord, 0, len(r.agents))
+	for agentID, agent := range r.agents {
+		r.decay(agent, now)
+		records = append(records, ReputationRecord{
+			Agent:        agentID,
+			Score:        agent.score,
+			Quarantined:  agent.quarantined,
+			Streak:       agent.streak,
+			LastActivity: agent.active,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Agent < records[j].Agent })
+	return records
+}
+
+// withReputation sets discovered tools' trust scores from their agents'
+// reputations and leaves out the tools of quarantined agents
+func (b *Broker) withReputation(tools []protocol.DiscoveredTool) []protocol.DiscoveredTool {
+	kept := tools[:0]
+	for _, tool := range tools {
+		score, quarantined := b.reputation.Score(tool.AgentID)
+		if quarantined {
+			continue
+		}
+		tool.Metadata.TrustScore = score
+		kept = append(kept, tool)
+	}
+	return kept
+}
+
+// handleReputation serves GET /admin/reputation, every scored agent's
+// standing
+func (b *Broker) handleReputation(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, b.reputation.Records())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestParseReputationSettings(t *testing.T) {
+	settings, err := ParseReputationSettings("decay=1h,penalty=0.25,probation=5")
+	if err != nil {
+		t.Fatalf("ParseReputationSettings: %v", err)
+	}
+	if settings.Decay != time.Hour || settings.Penalty != 0.25 || settings.Probation != 5 {
+		t.Errorf("Unexpected settings: %+v", settings)
+	}
+	if settings.Reward != defaultReputationSettings.Reward {
+		t.Errorf("Expected settings left out to keep their defaults, got reward %v", settings.Reward)
+	}
+
+	roundTrip, err := ParseReputationSettings(defaultReputationSettings.String())
+	if err != nil || roundTrip != defaultReputationSettings {
+		t.Errorf("Expected the defaults to round-trip, got %+v, %v", roundTrip, err)
+	}
+
+	for _, spec := range []string{"penalty", "penalty=2", "decay=-1h", "probation=x", "strictness=1", "quarantine=0.6"} {
+		if _, err := ParseReputationSettings(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestReputationDecaysTowardNeutral(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	reputation := NewReputation()
+	reputation.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		reputation.Record("agent-a", true)
+	}
+	score, _ := reputation.Score("agent-a")
+	if math.Abs(score-0.7) > 1e-9 {
+		t.Fatalf("Expected ten successes to raise the score to 0.7, got %v", score)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if score, _ := reputation.Score("agent-a"); math.Abs(score-0.6) > 1e-9 {
+		t.Errorf("Expected a day idle to halve the distance to neutral, got %v", score)
+	}
+	now = now.Add(30 * 24 * time.Hour)
+	if score, _ := reputation.Score("agent-a"); math.Abs(score-0.5) > 1e-6 {
+		t.Errorf("Expected a long idle agent to return to neutral, got %v", score)
+	}
+
+	if score, quarantined := reputation.Score("unknown"); score != 0.5 || quarantined {
+		t.Errorf("Expected an unscored agent to be neutral, got %v, %v", score, quarantined)
+	}
+}
+
+func TestReputationQuarantineAndRelease(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	reputation := NewReputation()
+	reputation.now = func() time.Time { return now }
+	reputation.SetSettings(ReputationSettings{Neutral: 0.5, Reward: 0.25, Penalty: 0.25, Quarantine: 0.25, Release: 0.5, Probation: 4, Recovery: 0.5})
+
+	reputation.Record("agent-a", false)
+	if _, quarantined := reputation.Score("agent-a"); quarantined {
+		t.Fatal("Expected one failure not to quarantine the agent")
+	}
+	reputation.Record("agent-a", false)
+	if _, quarantined := reputation.Score("agent-a"); !quarantined {
+		t.Fatal("Expected the agent to be quarantined below 0.25")
+	}
+
+	// Recovery is at half the reward, and a failure restarts the streak
+	for i := 0; i < 3; i++ {
+		reputation.Record("agent-a", true)
+	}
+	reputation.Record("agent-a", false)
+	for i := 0; i < 3; i++ {
+		reputation.Record("agent-a", true)
+		if _, quarantined := reputation.Score("agent-a"); !quarantined {
+			t.Fatalf("Expected the agent to stay quarantined after %d successes", i+1)
+		}
+	}
+	reputation.Record("agent-a", true)
+	score, quarantined := reputation.Score("agent-a")
+	if quarantined || score < 0.5 {
+		t.Errorf("Expected the agent to be released at 0.5, got %v, quarantined %v", score, quarantined)
+	}
+}
+
+func TestDiscoveryLeavesOutQuarantinedAgents(t *testing.T) {
+	broker := NewBroker()
+	now := time.Unix(1700000000, 0)
+	broker.reputation.now = func() time.Time { return now }
+	for i := 0; i < 4; i++ {
+		broker.reputation.Record("agent-b", false)
+	}
+	broker.reputation.Record("agent-c", true)
+
+	tools := broker.withReputation([]protocol.DiscoveredTool{{AgentID: "agent-a"}, {AgentID: "agent-b"}, {AgentID: "agent-c"}})
+	if len(tools) != 2 || tools[0].AgentID != "agent-a" || tools[1].AgentID != "agent-c" {
+		t.Fatalf("Expected the quarantined agent to be left out, got %+v", tools)
+	}
+	if tools[0].Metadata.TrustScore != 0.5 || tools[1].Metadata.TrustScore != 0.52 {
+		t.Errorf("Expected trust scores from reputation, got %v and %v", tools[0].Metadata.TrustScore, tools[1].Metadata.TrustScore)
+	}
+
+	records := broker.reputation.Records()
+	if len(records) != 2 || records[0].Agent != "agent-b" || !records[0].Quarantined || records[1].Streak != 1 {
+		t.Errorf("Unexpected reputation records: %+v", records)
+	}
+}
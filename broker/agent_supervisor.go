@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// minRestartBackoff and maxRestartBackoff bound the wait before an MCP
+	// server that exited is started again. The wait doubles with each
+	// restart that fails to answer.
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 30 * time.Second
+	// mcpStopGrace is how long an MCP server has to exit after an
+	// interrupt before it is killed
+	mcpStopGrace = 5 * time.Second
+	// mcpReadyPoll is the interval between tools/list probes of a starting
+	// MCP server
+	mcpReadyPoll = 200 * time.Millisecond
+)
+
+// AgentSupervisor runs the agent an AgentManifest declares. It starts the
+// agent's MCP server, registers the agent once the server answers,
+// subscribes it to its events and keeps it alive with heartbeats, starting
+// the server again whenever it exits.
+type AgentSupervisor struct {
+	*MCPClient
+	manifest *AgentManifest
+	key      ed25519.PrivateKey
+	tools    *MCPToolClient
+	server   *exec.Cmd
+	exited   chan struct{} // Closed when server exits; nil without a command
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewAgentSupervisor loads a manifest's key and creates its supervisor
+func NewAgentSupervisor(manifest *AgentManifest) (*AgentSupervisor, error) {
+	key, err := LoadIdentityKey(manifest.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load agent key: %w", err)
+	}
+	return &AgentSupervisor{
+		MCPClient: NewMCPClient(manifest.ClientConfig(key)),
+		manifest:  manifest,
+		key:       key,
+		tools:     NewMCPToolClient(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Start starts the MCP server, registers the agent and subscribes it, then
+// supervises it until Stop. A registration held for approval is
+// supervised, and Start returns protocol.ErrRegistrationPending.
+func (s *AgentSupervisor) Start() error {
+	tools, err := s.startServer()
+	if err != nil {
+		return err
+	}
+
+	registration := s.manifest.Registration(s.key)
+	if registration.BodyDefinition != nil && len(registration.BodyDefinition.MCPTools) == 0 {
+		registration.BodyDefinition.MCPTools = tools
+	}
+	pending := s.Register(registration)
+	if pending != nil && !errors.Is(pending, protocol.ErrRegistrationPending) {
+		s.stopServer()
+		return pending
+	}
+	if pending == nil && len(s.manifest.Subscriptions) > 0 {
+		if err := s.subscribe(); err != nil {
+			s.Deregister("subscription failed")
+			s.stopServer()
+			return err
+		}
+	}
+
+	interval := s.manifest.heartbeat
+	if interval == 0 && pending == nil {
+		// The first heartbeat learns the broker's TTL
+		if ttl, err := s.Heartbeat("ok"); err == nil {
+			interval = ttl / 3
+		}
+	}
+	go s.run(interval)
+	return pending
+}
+
+// Stop deregisters the agent and stops its MCP server
+func (s *AgentSupervisor) Stop() error {
+	close(s.stop)
+	<-s.done
+	err := s.Deregister("agent stopping")
+	s.stopServer()
+	return err
+}
+
+// run heartbeats every interval (not at all if zero) and starts the MCP
+// server again when it exits, until Stop
+func (s *AgentSupervisor) run(interval time.Duration) {
+	defer close(s.done)
+
+	var heartbeats <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+	backoff := minRestartBackoff
+	for {
+		select {
+		case <-heartbeats:
+			if _, err := s.Heartbeat("ok"); err != nil {
+				slog.Warn("Heartbeat failed", "agent", s.manifest.AgentID, "error", err)
+			}
+		case <-s.exited:
+			slog.Warn("MCP server exited, restarting", "agent", s.manifest.AgentID, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return
+			}
+			if _, err := s.startServer(); err != nil {
+				slog.Warn("Failed to restart MCP server", "agent", s.manifest.AgentID, "error", err)
+				backoff = min(backoff*2, maxRestartBackoff)
+				continue
+			}
+			backoff = minRestartBackoff
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// startServer starts the manifest's MCP server command, if it has one, and
+// waits until the endpoint answers tools/list, returning the tools listed
+func (s *AgentSupervisor) startServer() ([]protocol.MCPTool, error) {
+	mcp := s.manifest.MCP
+	if len(mcp.Command) > 0 {
+		server := exec.Command(mcp.Command[0], mcp.Command[1:]...)
+		server.Dir = mcp.Dir
+		server.Env = os.Environ()
+		names := make([]string, 0, len(mcp.Env))
+		for name := range mcp.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			server.Env = append(server.Env, name+"="+mcp.Env[name])
+		}
+		server.Stdout = os.Stdout
+		server.Stderr = os.Stderr
+		if err := server.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start MCP server: %w", err)
+		}
+
+		exited := make(chan struct{})
+		go func() {
+			err := server.Wait()
+			slog.Info("MCP server exited", "agent", s.manifest.AgentID, "pid", server.Process.Pid, "error", err)
+			close(exited)
+		}()
+		s.server, s.exited = server, exited
+	}
+
+	deadline := time.Now().Add(s.manifest.startTimeout)
+	for {
+		tools, err := s.tools.ListTools(mcp.Endpoint)
+		if err == nil {
+			return tools, nil
+		}
+		if time.Now().After(deadline) {
+			s.stopServer()
+			return nil, fmt.Errorf("MCP server at %s did not answer within %s: %w", mcp.Endpoint, s.manifest.startTimeout, err)
+		}
+		select {
+		case <-s.exited:
+			return nil, fmt.Errorf("MCP server exited before answering: %w", err)
+		case <-time.After(mcpReadyPoll):
+		}
+	}
+}
+
+// stopServer interrupts the MCP server, killing it if it does not exit in
+// time
+func (s *AgentSupervisor) stopServer() {
+	if s.server == nil {
+		return
+	}
+	s.server.Process.Signal(os.Interrupt)
+	select {
+	case <-s.exited:
+	case <-time.After(mcpStopGrace):
+		s.server.Process.Kill()
+		<-s.exited
+	}
+}
+
+// subscribe subscribes the agent to the manifest's events, delivered to its
+// MCP endpoint
+func (s *AgentSupervisor) subscribe() error {
+	subscribe := protocol.NewEnvelope(protocol.EnvelopeSubscribe, s.manifest.AgentID)
+	body, err := json.Marshal(protocol.SubscribeBody{Events: s.manifest.Subscriptions})
+	if err != nil {
+		return err
+	}
+	subscribe.Body = body
+	if err := subscribe.Sign(s.key); err != nil {
+		return fmt.Errorf("failed to sign subscription: %w", err)
+	}
+	if _, err := s.sendRequest(subscribe); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	return nil
+}
+
+// RunAgentManifest runs the agent a manifest file declares until the
+// process is interrupted or terminated
+func RunAgentManifest(path string) error {
+	manifest, err := LoadAgentManifest(path)
+	if err != nil {
+		return err
+	}
+	supervisor, err := NewAgentSupervisor(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = supervisor.Start()
+	switch {
+	case errors.Is(err, protocol.ErrRegistrationPending):
+		slog.Info("Agent registration awaits approval", "agent", manifest.AgentID)
+	case err != nil:
+		return err
+	default:
+		slog.Info("Agent registered", "agent", manifest.AgentID, "endpoint", manifest.MCP.Endpoint)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	<-signals
+	return supervisor.Stop()
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// defaultAuditMaxSize is the size at which the journal file is rotated
+	defaultAuditMaxSize = 100 << 20
+	// defaultAuditMaxBody is the largest body recorded verbatim; larger
+	// bodies are recorded by hash and size
+	defaultAuditMaxBody = 4 << 10
+	// defaultAuditQueryLimit bounds the records one query returns
+	defaultAuditQueryLimit = 1000
+)
+
+// AuditRecord is one accepted envelope in the audit journal. Each record
+// includes the hash of the one before it, so removing or editing a record
+// breaks the chain from that point on.
+type AuditRecord struct {
+	Seq      int64                 `json:"seq"`
+	At       time.Time             `json:"at"` // When the broker accepted the envelope
+	Type     protocol.EnvelopeType `json:"type"`
+	Agent    string                `json:"agent"`
+	TS       int64                 `json:"ts"`
+	Nonce    string                `json:"nonce"`
+	Sig      string                `json:"sig,omitempty"`
+	Body     json.RawMessage       `json:"body,omitempty"`     // Absent if larger than the journal's body limit
+	BodySize int                   `json:"bodySize"`           // Bytes in the envelope body
+	BodyHash string                `json:"bodyHash,omitempty"` // SHA-256 of an omitted body
+	Prev     string                `json:"prev"`               // Hash of the previous record, empty for the first
+	Hash     string                `json:"hash"`
+}
+
+// computeHash returns the record's hash: SHA-256 of its JSON without the
+// hash field
+func (r AuditRecord) computeHash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditQuery selects journal records. Zero fields match everything.
+type AuditQuery struct {
+	Agent string
+	Type  protocol.EnvelopeType
+	Since time.Time // Inclusive
+	Until time.Time // Exclusive
+	Limit int
+}
+
+// matches reports whether a record is selected by the query
+func (q AuditQuery) matches(record AuditRecord) bool {
+	if q.Agent != "" && record.Agent != q.Agent {
+		return false
+	}
+	if q.Type != "" && record.Type != q.Type {
+		return false
+	}
+	if !q.Since.IsZero() && record.At.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !record.At.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditJournal appends every accepted envelope to a hash-chained,
+// newline-delimited JSON file. When the file reaches its size limit it is
+// renamed with the sequence number of its last record and a new file
+// continues the chain. Methods on a nil journal do nothing.
+type AuditJournal struct {
+	path    string
+	maxSize int64
+	maxBody int
+	file    *os.File
+	size    int64
+	seq     int64
+	last    string // Hash of the last record written
+	mu      sync.Mutex
+}
+
+// OpenAuditJournal opens the journal at path, continuing the chain of any
+// records already in it or its rotated files
+func OpenAuditJournal(path string, maxSize int64, maxBody int) (*AuditJournal, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if maxBody < 0 {
+		maxBody = 0
+	}
+	j := &AuditJournal{path: path, maxSize: maxSize, maxBody: maxBody}
+
+	files, err := j.files()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0 && j.last == ""; i-- {
+		if err := j.scan(files[i], func(record AuditRecord) bool {
+			j.seq, j.last = record.Seq, record.Hash
+			return true
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := j.openFile(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// openFile opens the current journal file for appending
+func (j *AuditJournal) openFile() error {
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	j.file, j.size = file, info.Size()
+	return nil
+}
+
+// files returns the rotated journal files, oldest first, followed by the
+// current one if it exists
+func (j *AuditJournal) files() ([]string, error) {
+	rotated, err := filepath.Glob(j.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range rotated {
+		if _, err := strconv.ParseInt(filepath.Ext(name)[1:], 10, 64); err == nil {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(j.path); err == nil {
+		files = append(files, j.path)
+	}
+	return files, nil
+}
+
+// scan calls fn with each record of a journal file until fn returns false
+func (j *AuditJournal) scan(name string, fn func(AuditRecord) bool) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("corrupt audit record in %s: %w", name, err)
+		}
+		if !fn(record) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Append records an accepted envelope
+func (j *AuditJournal) Append(env *protocol.GenericEnvelope) error {
+	if j == nil {
+		return nil
+	}
+	record := AuditRecord{
+		At:       time.Now().UTC(),
+		Type:     env.Type,
+		Agent:    env.Agent,
+		TS:       env.TS,
+		Nonce:    env.Nonce,
+		Sig:      env.Sig,
+		BodySize: len(env.Body),
+	}
+	if len(env.Body) <= j.maxBody {
+		record.Body = env.Body
+	} else {
+		sum := sha256.Sum256(env.Body)
+		record.BodyHash = hex.EncodeToString(sum[:])
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	record.Seq = j.seq + 1
+	record.Prev = j.last
+	hash, err := record.computeHash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if j.size > 0 && j.size+int64(len(data))+1 > j.maxSize {
+		if err := j.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := j.file.Write(append(data, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	j.seq, j.last = record.Seq, record.Hash
+	return nil
+}
+
+// rotateLocked renames the current file after its last record and starts
+// a new one. Caller must hold the lock.
+func (j *AuditJournal) rotateLocked() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(j.path, fmt.Sprintf("%s.%012d", j.path, j.seq)); err != nil {
+		return err
+	}
+	return j.openFile()
+}
+
+// Query returns the records selected by query, oldest first
+func (j *AuditJournal) Query(query AuditQuery) ([]AuditRecord, error) {
+	if j == nil {
+		return nil, nil
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultAuditQueryLimit
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files, err := j.files()
+	if err != nil {
+		return nil, err
+	}
+	records := []AuditRecord{}
+	for _, name := range files {
+		if err := j.scan(name, func(record AuditRecord) bool {
+			if query.matches(record) {
+				records = append(records, record)
+			}
+			return len(records) < query.Limit
+		}); err != nil {
+			return nil, err
+		}
+		if len(records) >= query.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// AuditVerification reports the result of checking the journal's chain
+type AuditVerification struct {
+	Records int    `json:"records"`
+	Valid   bool   `json:"valid"`
+	BrokeAt int64  `json:"brokeAt,omitempty"` // Sequence number of the first bad record
+	Error   string `json:"error,omitempty"`
+}
+
+// Verify walks every record, checking its hash and its link to the record
+// before it
+func (j *AuditJournal) Verify() (*AuditVerification, error) {
+	result := &AuditVerification{Valid: true}
+	if j == nil {
+		return result, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files, err := j.files()
+	if err != nil {
+		return nil, err
+	}
+	prev, seq := "", int64(0)
+	for _, name := range files {
+		if err := j.scan(name, func(record AuditRecord) bool {
+			hash, err := record.computeHash()
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+			case hash != record.Hash:
+				result.Error = "record hash does not match its contents"
+			case seq > 0 && record.Prev != prev:
+				result.Error = "record does not follow the previous one"
+			case seq > 0 && record.Seq != seq+1:
+				result.Error = fmt.Sprintf("expected sequence %d", seq+1)
+			}
+			if result.Error != "" {
+				result.Valid, result.BrokeAt = false, record.Seq
+				return false
+			}
+			prev, seq = record.Hash, record.Seq
+			result.Records++
+			return true
+		}); err != nil {
+			return nil, err
+		}
+		if !result.Valid {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Close closes the journal file
+func (j *AuditJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// SetAuditJournal records accepted envelopes in journal, those of the types
+// the persistence policy sends there
+func (b *Broker) SetAuditJournal(journal *AuditJournal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.audit = journal
+}
+
+// recordAudit appends an accepted envelope to the audit journal, if any
+func (b *Broker) recordAudit(env *protocol.GenericEnvelope) {
+	b.mu.RLock()
+	journal := b.audit
+	b.mu.RUnlock()
+
+	if err := journal.Append(env); err != nil {
+		slog.Error("Failed to append to audit journal", "type", env.Type, "agent", env.Agent, "nonce", env.Nonce, "error", err)
+	}
+}
+
+// handleAuditQuery serves GET /admin/audit?agent=&type=&since=&until=&limit=,
+// with times in RFC 3339
+func (b *Broker) handleAuditQuery(w http.ResponseWriter, r *http.Request) {
+	b.mu.RLock()
+	journal := b.audit
+	b.mu.RUnlock()
+	if journal == nil {
+		http.Error(w, "Audit journal is not enabled", http.StatusNotFound)
+		return
+	}
+
+	values := r.URL.Query()
+	query := AuditQuery{Agent: values.Get("agent"), Type: protocol.EnvelopeType(values.Get("type"))}
+	for name, field := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := values.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s, expected RFC 3339", name), http.StatusBadRequest)
+				return
+			}
+			*field = parsed
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = parsed
+	}
+
+	records, err := journal.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// handleAuditVerify serves GET /admin/audit/verify
+func (b *Broker) handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	b.mu.RLock()
+	journal := b.audit
+	b.mu.RUnlock()
+	if journal == nil {
+		http.Error(w, "Audit journal is not enabled", http.StatusNotFound)
+		return
+	}
+
+	result, err := journal.Verify()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
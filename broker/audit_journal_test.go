@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func auditEnvelope(agent string, envType protocol.EnvelopeType, body string) *protocol.GenericEnvelope {
+	env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: envType}}
+	env.Agent = agent
+	env.Nonce = protocol.NewNonce()
+	env.TS = time.Now().UnixMilli()
+	env.Body = json.RawMessage(body)
+	return env
+}
+
+func TestAuditJournalChainAndRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	journal, err := OpenAuditJournal(path, 600, 64)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+
+	large := `{"payload":"` + strings.Repeat("x", 100) + `"}`
+	for i := 0; i < 6; i++ {
+		journal.Append(auditEnvelope("agent-a", protocol.EnvelopeEmitEvent, `{"event":"tick"}`))
+		journal.Append(auditEnvelope("agent-b", protocol.EnvelopeToolCall, large))
+	}
+	journal.Close()
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) == 0 {
+		t.Fatal("Expected the journal to rotate")
+	}
+
+	// Reopening continues the chain across the rotated files
+	journal, err = OpenAuditJournal(path, 600, 64)
+	if err != nil {
+		t.Fatalf("Failed to reopen journal: %v", err)
+	}
+	defer journal.Close()
+	journal.Append(auditEnvelope("agent-a", protocol.EnvelopeEmitEvent, `{"event":"tock"}`))
+
+	result, err := journal.Verify()
+	if err != nil || !result.Valid || result.Records != 13 {
+		t.Fatalf("Expected 13 chained records, got %+v (%v)", result, err)
+	}
+
+	records, err := journal.Query(AuditQuery{Agent: "agent-b"})
+	if err != nil || len(records) != 6 {
+		t.Fatalf("Expected 6 records for agent-b, got %d (%v)", len(records), err)
+	}
+	if records[0].Body != nil || records[0].BodyHash == "" || records[0].BodySize != len(large) {
+		t.Errorf("Expected the large body to be recorded by hash, got %+v", records[0])
+	}
+	records, _ = journal.Query(AuditQuery{Type: protocol.EnvelopeEmitEvent, Limit: 3})
+	if len(records) != 3 || string(records[0].Body) != `{"event":"tick"}` {
+		t.Errorf("Expected the first 3 events with their bodies, got %+v", records)
+	}
+	if records, _ := journal.Query(AuditQuery{Since: time.Now().Add(time.Hour)}); len(records) != 0 {
+		t.Errorf("Expected no records in the future, got %d", len(records))
+	}
+}
+
+func TestAuditJournalDetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	journal, _ := OpenAuditJournal(path, 0, defaultAuditMaxBody)
+	for _, agent := range []string{"agent-a", "agent-b", "agent-c"} {
+		journal.Append(auditEnvelope(agent, protocol.EnvelopeEmitEvent, `{"event":"tick"}`))
+	}
+	journal.Close()
+
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(data), "agent-b", "agent-x", 1)), 0600)
+
+	journal, _ = OpenAuditJournal(path, 0, defaultAuditMaxBody)
+	defer journal.Close()
+	result, err := journal.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if result.Valid || result.BrokeAt != 2 || result.Records != 1 {
+		t.Errorf("Expected the edited second record to break the chain, got %+v", result)
+	}
+}
+
+func TestHandleAuditQuery(t *testing.T) {
+	broker := NewBroker()
+	journal, _ := OpenAuditJournal(filepath.Join(t.TempDir(), "audit.jsonl"), 0, defaultAuditMaxBody)
+	defer journal.Close()
+	broker.SetAuditJournal(journal)
+
+	broker.dispatchEnvelope(newBufferedResponse(), auditEnvelope("agent-a", protocol.EnvelopePing, `{}`))
+	broker.dispatchEnvelope(newBufferedResponse(), auditEnvelope("agent-b", protocol.EnvelopePing, `{}`))
+
+	server := httptest.NewServer(broker)
+	defer server.Close()
+	client := adminClient(broker, server)
+	resp, err := client.Get(server.URL + "/admin/audit?agent=agent-b&type=ping&since=" + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("Audit query failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var records []AuditRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatalf("Failed to decode records: %v", err)
+	}
+	if len(records) != 1 || records[0].Agent != "agent-b" || records[0].Seq != 2 {
+		t.Errorf("Unexpected records %+v", records)
+	}
+
+	resp, err = client.Get(server.URL + "/admin/audit?since=yesterday")
+	if err != nil {
+		t.Fatalf("Audit query failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a bad time to be rejected, got %d", resp.StatusCode)
+	}
+}
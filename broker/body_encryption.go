@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/fep-fem/protocol"
+)
+
+// withEncryptionKeys adds to discovered tools the encryption keys their
+// agents registered, so callers can seal parameters to them. The broker
+// only passes sealed parameters along; it holds no key to open them.
+func (b *Broker) withEncryptionKeys(tools []protocol.DiscoveredTool) []protocol.DiscoveredTool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for i := range tools {
+		if agent, exists := b.agents[tools[i].AgentID]; exists {
+			tools[i].EncKey = agent.EncKey
+		}
+	}
+	return tools
+}
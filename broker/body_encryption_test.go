@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestSealedParametersPassThroughBroker(t *testing.T) {
+	agentKey, _ := protocol.GenerateEncryptionKey()
+
+	// The agent opens the parameters the broker could not read
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Params struct {
+				Arguments map[string]interface{} `json:"arguments"`
+				Meta      map[string]string      `json:"_meta"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		call := &protocol.ToolCallEnvelope{Body: protocol.ToolCallBody{RequestID: request.Params.Meta["requestId"], Parameters: request.Params.Arguments}}
+		json.Unmarshal([]byte(request.Params.Meta["enc"]), &call.Body.Enc)
+		if err := call.DecryptParameters(agentKey); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": call.Body.Parameters, "id": 1})
+	}))
+	defer agent.Close()
+
+	broker := NewBroker()
+	register := func(encKey string) *bufferedResponse {
+		pubKey, _, _ := protocol.GenerateKeyPair()
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+		env.Agent = "vault-agent"
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+			PubKey:         protocol.EncodePublicKey(pubKey),
+			MCPEndpoint:    agent.URL,
+			BodyDefinition: &protocol.BodyDefinition{MCPTools: []protocol.MCPTool{{Name: "vault.store"}}},
+			EncKey:         encKey,
+		})
+		recorder := newBufferedResponse()
+		broker.handleRegisterAgent(recorder, env)
+		return recorder
+	}
+	if recorder := register("not-a-key"); recorder.status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid encryption key refused, got %d", recorder.status)
+	}
+	if recorder := register(protocol.EncodeEncryptionKey(agentKey.PublicKey())); recorder.status != http.StatusOK {
+		t.Fatalf("Registration failed: %d %s", recorder.status, recorder.body.String())
+	}
+
+	// Callers find the key through discovery
+	discovered, _ := broker.mcpRegistry.DiscoverToolsFor(protocol.ToolQuery{Capabilities: []string{"vault.store"}}, "caller-agent")
+	discovered = broker.withEncryptionKeys(discovered)
+	if len(discovered) != 1 || discovered[0].EncKey == "" {
+		t.Fatalf("Expected the encryption key in discovery, got %+v", discovered)
+	}
+	recipient, _ := protocol.ParseEncryptionKey(discovered[0].EncKey)
+
+	call, _ := protocol.NewToolCall("caller-agent").Tool("vault.store").Param("secret", "hunter2").EncryptFor(recipient).Build()
+	env := &protocol.GenericEnvelope{BaseEnvelope: call.BaseEnvelope}
+	env.Body, _ = json.Marshal(call.Body)
+	recorder := newBufferedResponse()
+	broker.handleToolCall(recorder, env)
+
+	var response protocol.ToolResultEnvelope
+	json.Unmarshal(recorder.body.Bytes(), &response)
+	if result, _ := response.Body.Result.(map[string]interface{}); !response.Body.Success || result["secret"] != "hunter2" {
+		t.Errorf("Expected the agent to open the parameters, got %+v", response.Body)
+	}
+}
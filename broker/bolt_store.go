@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltAgentsBucket    = []byte("agents")
+	boltMCPAgentsBucket = []byte("mcp_agents")
+	boltToolsBucket     = []byte("tools")
+	boltSubsBucket      = []byte("subscriptions")
+	boltNoncesBucket    = []byte("nonces")
+	boltEnvelopesBucket = []byte("envelopes")
+	boltRevokedBucket   = []byte("revocations")
+)
+
+// BoltStore persists broker state to an embedded BoltDB file so it
+// survives restarts
+type BoltStore struct {
+	db     *bolt.DB
+	cipher *RecordCipher
+}
+
+// OpenBoltStore opens (creating if needed) the BoltDB file at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltAgentsBucket, boltMCPAgentsBucket, boltToolsBucket, boltSubsBucket, boltNoncesBucket, boltEnvelopesBucket, boltRevokedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize %s: %w", path, err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// SpaceUsage returns the size of the database file and the bytes held by
+// free pages. BoltDB reuses free pages but never shrinks the file.
+func (s *BoltStore) SpaceUsage() (size, free int64, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size, int64(s.db.Stats().FreeAlloc), err
+}
+
+// SaveAgent stores an agent together with its MCP registration and indexed
+// tools in a single transaction, replacing anything previously stored for
+// the agent. mcpAgent may be nil for agents without MCP tools.
+func (s *BoltStore) SaveAgent(agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteAgentTx(tx, agent.ID); err != nil {
+			return err
+		}
+
+		if err := s.putJSON(tx.Bucket(boltAgentsBucket), agent.ID, agent.ID, agent); err != nil {
+			return err
+		}
+		if mcpAgent != nil {
+			if err := s.putJSON(tx.Bucket(boltMCPAgentsBucket), agent.ID, agent.ID, mcpAgent); err != nil {
+				return err
+			}
+		}
+		for _, tool := range tools {
+			if err := s.putJSON(tx.Bucket(boltToolsBucket), toolKey(tool.AgentID, tool.Tool.Name), tool.AgentID, tool); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteAgent removes everything stored for an agent
+func (s *BoltStore) DeleteAgent(agentID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteAgentTx(tx, agentID)
+	})
+}
+
+// LoadAgents returns all stored agents
+func (s *BoltStore) LoadAgents() ([]*Agent, error) {
+	var agents []*Agent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAgentsBucket).ForEach(func(k, v []byte) error {
+			var agent Agent
+			if err := s.cipher.open(v, &agent); err != nil {
+				return fmt.Errorf("corrupt agent record %s: %w", k, err)
+			}
+			agents = append(agents, &agent)
+			return nil
+		})
+	})
+	return agents, err
+}
+
+// LoadMCPAgents returns all stored MCP registrations
+func (s *BoltStore) LoadMCPAgents() ([]*MCPAgent, error) {
+	var agents []*MCPAgent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMCPAgentsBucket).ForEach(func(k, v []byte) error {
+			var agent MCPAgent
+			if err := s.cipher.open(v, &agent); err != nil {
+				return fmt.Errorf("corrupt MCP agent record %s: %w", k, err)
+			}
+			agents = append(agents, &agent)
+			return nil
+		})
+	})
+	return agents, err
+}
+
+// LoadTools returns all stored tool index entries
+func (s *BoltStore) LoadTools() ([]*RegisteredTool, error) {
+	var tools []*RegisteredTool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltToolsBucket).ForEach(func(k, v []byte) error {
+			var tool RegisteredTool
+			if err := s.cipher.open(v, &tool); err != nil {
+				return fmt.Errorf("corrupt tool record %s: %w", k, err)
+			}
+			tools = append(tools, &tool)
+			return nil
+		})
+	})
+	return tools, err
+}
+
+// SaveSubscription stores an agent's subscription
+func (s *BoltStore) SaveSubscription(sub Subscription) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putJSON(tx.Bucket(boltSubsBucket), sub.AgentID, sub.AgentID, sub)
+	})
+}
+
+// DeleteSubscription removes an agent's subscription
+func (s *BoltStore) DeleteSubscription(agentID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSubsBucket).Delete([]byte(agentID))
+	})
+}
+
+// LoadSubscriptions returns all stored subscriptions ordered by agent
+func (s *BoltStore) LoadSubscriptions() ([]Subscription, error) {
+	var subs []Subscription
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSubsBucket).ForEach(func(k, v []byte) error {
+			var sub Subscription
+			if err := s.cipher.open(v, &sub); err != nil {
+				return fmt.Errorf("corrupt subscription record %s: %w", k, err)
+			}
+			subs = append(subs, sub)
+			return nil
+		})
+	})
+	return subs, err
+}
+
+// SaveRevocation stores what was revoked from an agent
+func (s *BoltStore) SaveRevocation(revocation Revocation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putJSON(tx.Bucket(boltRevokedBucket), revocation.AgentID, revocation.AgentID, revocation)
+	})
+}
+
+// DeleteRevocation forgets what was revoked from an agent
+func (s *BoltStore) DeleteRevocation(agentID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRevokedBucket).Delete([]byte(agentID))
+	})
+}
+
+// LoadRevocations returns all stored revocations ordered by agent
+func (s *BoltStore) LoadRevocations() ([]Revocation, error) {
+	var revocations []Revocation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRevokedBucket).ForEach(func(k, v []byte) error {
+			var revocation Revocation
+			if err := s.cipher.open(v, &revocation); err != nil {
+				return fmt.Errorf("corrupt revocation record %s: %w", k, err)
+			}
+			revocations = append(revocations, revocation)
+			return nil
+		})
+	})
+	return revocations, err
+}
+
+// RecordNonce remembers a nonce, reporting whether it is new. Expiry times
+// are stored as big-endian Unix milliseconds.
+func (s *BoltStore) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	fresh := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltNoncesBucket)
+		key := []byte(agentID + "/" + nonce)
+
+		if value := bucket.Get(key); len(value) == 8 {
+			expiry := time.UnixMilli(int64(binary.BigEndian.Uint64(value)))
+			if time.Now().Before(expiry) {
+				return nil
+			}
+		}
+
+		fresh = true
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(expiresAt.UnixMilli()))
+		return bucket.Put(key, value)
+	})
+	return fresh, err
+}
+
+// PruneNonces forgets expired nonces
+func (s *BoltStore) PruneNonces(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltNoncesBucket)
+
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) < before.UnixMilli() {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveEnvelope keeps an accepted envelope, sealed for the namespace of its
+// sender. Keys start with the big-endian acceptance time in nanoseconds,
+// so envelopes are read back in the order accepted.
+func (s *BoltStore) SaveEnvelope(envelope StoredEnvelope) error {
+	key := make([]byte, 8, 8+len(envelope.Nonce))
+	binary.BigEndian.PutUint64(key, uint64(envelope.At.UnixNano()))
+	key = append(key, envelope.Nonce...)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putJSON(tx.Bucket(boltEnvelopesBucket), string(key), envelope.Agent, envelope)
+	})
+}
+
+// LoadEnvelopes returns the kept envelopes of a type in the order accepted
+func (s *BoltStore) LoadEnvelopes(envType protocol.EnvelopeType) ([]StoredEnvelope, error) {
+	var envelopes []StoredEnvelope
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltEnvelopesBucket).ForEach(func(k, v []byte) error {
+			var envelope StoredEnvelope
+			if err := s.cipher.open(v, &envelope); err != nil {
+				return fmt.Errorf("corrupt envelope record %x: %w", k, err)
+			}
+			if envType == "" || envelope.Type == envType {
+				envelopes = append(envelopes, envelope)
+			}
+			return nil
+		})
+	})
+	return envelopes, err
+}
+
+// PruneEnvelopes removes expired envelopes
+func (s *BoltStore) PruneEnvelopes(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltEnvelopesBucket)
+
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var envelope StoredEnvelope
+			if err := s.cipher.open(v, &envelope); err != nil || envelope.Expires.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteAgentTx removes an agent's records, including every tool keyed
+// under "agentID/"
+func deleteAgentTx(tx *bolt.Tx, agentID string) error {
+	if err := tx.Bucket(boltAgentsBucket).Delete([]byte(agentID)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltMCPAgentsBucket).Delete([]byte(agentID)); err != nil {
+		return err
+	}
+
+	prefix := agentID + "/"
+	cursor := tx.Bucket(boltToolsBucket).Cursor()
+	for k, _ := cursor.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = cursor.Seek([]byte(prefix)) {
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCipher encrypts records saved from now on; records already stored
+// stay readable
+func (s *BoltStore) SetCipher(c *RecordCipher) {
+	s.cipher = c
+}
+
+// putJSON stores value under key, sealed for the namespace of agentID
+func (s *BoltStore) putJSON(bucket *bolt.Bucket, key, agentID string, value interface{}) error {
+	data, err := s.cipher.seal(agentID, value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+// toolKey is the tool index key shared by the registry and the store
+func toolKey(agentID, toolName string) string {
+	return fmt.Sprintf("%s/%s", agentID, toolName)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestBoltStoreRestoresRegistrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	broker := NewBroker()
+	if err := broker.SetStore(store); err != nil {
+		t.Fatalf("Failed to attach store: %v", err)
+	}
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent},
+	}
+	env.Agent = "persistent-agent"
+	env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+		PubKey:       protocol.EncodePublicKey(pubKey),
+		Capabilities: []string{"math"},
+		MCPEndpoint:  "https://persistent-agent/mcp",
+		BodyDefinition: &protocol.BodyDefinition{
+			Name:     "calculator",
+			MCPTools: []protocol.MCPTool{{Name: "math.add"}, {Name: "math.multiply"}},
+		},
+	})
+
+	recorder := newBufferedResponse()
+	broker.handleRegisterAgent(recorder, env)
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+
+	subEnv := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeSubscribe},
+	}
+	subEnv.Agent = "persistent-agent"
+	subEnv.Body, _ = json.Marshal(protocol.SubscribeBody{Events: []string{"math.*"}})
+	subEnv.Nonce = protocol.NewNonce()
+	protocol.SignEnvelope(subEnv, privKey)
+
+	recorder = newBufferedResponse()
+	broker.handleSubscribe(recorder, subEnv)
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+
+	// Only the agent may drop its subscription
+	unsubEnv := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeUnsubscribe},
+	}
+	unsubEnv.Agent = "persistent-agent"
+	unsubEnv.Body, _ = json.Marshal(protocol.UnsubscribeBody{})
+	recorder = newBufferedResponse()
+	broker.handleUnsubscribe(recorder, unsubEnv)
+	if recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned unsubscribe to be refused, got %d", recorder.status)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+
+	// A fresh broker restores the agent, its key and its tools
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	restored := NewBroker()
+	if err := restored.SetStore(store); err != nil {
+		t.Fatalf("Failed to restore store: %v", err)
+	}
+
+	agent, exists := restored.agents["persistent-agent"]
+	if !exists {
+		t.Fatal("Expected agent to be restored")
+	}
+	if !agent.PubKey.Equal(pubKey) || agent.Endpoint != "https://persistent-agent/mcp" {
+		t.Errorf("Unexpected restored agent: %+v", agent)
+	}
+
+	sub, exists := restored.subscriptions.GetSubscription("persistent-agent")
+	if !exists || sub.Endpoint != "https://persistent-agent/mcp" || len(sub.Patterns) != 1 {
+		t.Errorf("Unexpected restored subscription: %+v", sub)
+	}
+
+	if restored.mcpRegistry.GetToolCount() != 2 {
+		t.Errorf("Expected 2 restored tools, got %d", restored.mcpRegistry.GetToolCount())
+	}
+
+	tools, err := restored.mcpRegistry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"math.*"}})
+	if err != nil {
+		t.Fatalf("Failed to discover tools: %v", err)
+	}
+	if len(tools) != 1 || tools[0].AgentID != "persistent-agent" || tools[0].MCPEndpoint != "https://persistent-agent/mcp" {
+		t.Errorf("Unexpected discovered tools: %+v", tools)
+	}
+
+	// Deleted agents are not restored
+	if err := store.DeleteAgent("persistent-agent"); err != nil {
+		t.Fatalf("Failed to delete agent: %v", err)
+	}
+	loadedTools, err := store.LoadTools()
+	if err != nil {
+		t.Fatalf("Failed to load tools: %v", err)
+	}
+	if len(loadedTools) != 0 {
+		t.Errorf("Expected tools to be deleted with their agent, got %d", len(loadedTools))
+	}
+}
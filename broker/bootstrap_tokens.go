@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultBootstrapTTL is how long a bootstrap token lasts unless the
+// operator sets its own
+const defaultBootstrapTTL = 24 * time.Hour
+
+// ErrRegistrationClosed is returned for registrations without a bootstrap
+// token when the broker is closed to registration
+var ErrRegistrationClosed = errors.New("registration is closed: a bootstrap token is required")
+
+// SetClosedRegistration sets whether agents need a bootstrap token to
+// register
+func (b *Broker) SetClosedRegistration(closed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = closed
+}
+
+// MintBootstrapToken creates a bootstrap token, signed by the broker, for
+// agents matching agent to register with the given capabilities
+func (b *Broker) MintBootstrapToken(agent string, capabilities []string, ttl time.Duration) (*protocol.BootstrapToken, string, error) {
+	token, err := protocol.NewBootstrapToken(b.id, b.privateKey, agent, capabilities, time.Now().Add(ttl))
+	if err != nil {
+		return nil, "", err
+	}
+	encoded, err := protocol.EncodeBootstrapToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	return token, encoded, nil
+}
+
+// claimedCapabilities lists everything a registration claims: its declared
+// capabilities, those of its body definition, and its tools, which
+// discovery treats as capabilities
+func claimedCapabilities(body protocol.RegisterAgentBody) []string {
+	claimed := append([]string(nil), body.Capabilities...)
+	if body.BodyDefinition != nil {
+		claimed = append(claimed, body.BodyDefinition.Capabilities...)
+		for _, tool := range body.BodyDefinition.MCPTools {
+			claimed = append(claimed, tool.Name)
+		}
+	}
+	return claimed
+}
+
+// checkGranted returns an error naming the first claimed capability that
+// none of the granted patterns covers
+func checkGranted(claimed, granted []string) error {
+	for _, capability := range claimed {
+		covered := false
+		for _, pattern := range granted {
+			if matchPattern(capability, pattern) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return fmt.Errorf("capability %s is not allowed by the bootstrap token", capability)
+		}
+	}
+	return nil
+}
+
+// checkBootstrapToken verifies an encoded bootstrap token for an agent and
+// returns the capability patterns it grants
+func (b *Broker) checkBootstrapToken(agent, encoded string, now time.Time) ([]string, error) {
+	token, err := protocol.DecodeBootstrapToken(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if err := token.Verify(b.privateKey.Public().(ed25519.PublicKey)); err != nil {
+		return nil, err
+	}
+	switch {
+	case token.Broker != b.id:
+		return nil, fmt.Errorf("bootstrap token was issued by %s", token.Broker)
+	case now.UnixMilli() >= token.Expires:
+		return nil, fmt.Errorf("bootstrap token %s has %w", token.ID, protocol.ErrExpired)
+	case !matchPattern(agent, token.Agent):
+		return nil, fmt.Errorf("bootstrap token %s is not for agent %s", token.ID, agent)
+	}
+	return token.Capabilities, nil
+}
+
+// registrationGrant returns the capability patterns a registration may
+// claim when the broker is closed: those of the bootstrap token it
+// carries, or for an agent already registered with the same key, those
+// its earlier registration was granted
+func (b *Broker) registrationGrant(agentID string, body protocol.RegisterAgentBody, pubKey protocol.PublicKey) ([]string, error) {
+	if body.BootstrapToken != "" {
+		return b.checkBootstrapToken(agentID, body.BootstrapToken, time.Now())
+	}
+
+	b.mu.RLock()
+	agent, registered := b.agents[agentID]
+	b.mu.RUnlock()
+	if registered && pubKey != nil && agent.PubKey.Equal(pubKey) && agent.Granted != nil {
+		return agent.Granted, nil
+	}
+	return nil, ErrRegistrationClosed
+}
+
+// grantedCapabilities returns the grant to record with a registration that
+// has been admitted: its bootstrap token's capability patterns, or those
+// of the agent's earlier registration. It is nil for registrations made
+// without a token while the broker was open.
+func (b *Broker) grantedCapabilities(agentID string, body protocol.RegisterAgentBody) []string {
+	if body.BootstrapToken != "" {
+		if token, err := protocol.DecodeBootstrapToken(body.BootstrapToken); err == nil {
+			return append([]string{}, token.Capabilities...)
+		}
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if agent, registered := b.agents[agentID]; registered {
+		return agent.Granted
+	}
+	return nil
+}
+
+// admitBootstrap refuses registrations without a valid bootstrap token, or
+// claiming capabilities their token does not allow, when the broker is
+// closed to registration
+func (b *Broker) admitBootstrap(w http.ResponseWriter, env *protocol.GenericEnvelope, body protocol.RegisterAgentBody, pubKey protocol.PublicKey) bool {
+	b.mu.RLock()
+	closed := b.closed
+	b.mu.RUnlock()
+	if !closed {
+		return true
+	}
+
+	granted, err := b.registrationGrant(env.Agent, body, pubKey)
+	if err == nil {
+		err = checkGranted(claimedCapabilities(body), granted)
+	}
+	if err != nil {
+		slog.Warn("Registration refused", "agent", env.Agent, "error", err)
+		b.replyError(w, env, http.StatusForbidden, protocol.ErrorRegistrationClosed, err.Error())
+		return false
+	}
+	return true
+}
+
+// handleAdminMintToken mints a bootstrap token from a JSON body of the
+// form {"agent": "worker-*", "capabilities": ["echo"], "ttl": "24h"}. The
+// agent pattern defaults to any agent and the TTL to a day.
+func (b *Broker) handleAdminMintToken(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Agent        string   `json:"agent"`
+		Capabilities []string `json:"capabilities"`
+		TTL          string   `json:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid token request", http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Agent == "" {
+		request.Agent = "*"
+	}
+	ttl := defaultBootstrapTTL
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid token TTL", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	token, encoded, err := b.MintBootstrapToken(request.Agent, request.Capabilities, ttl)
+	if err != nil {
+		http.Error(w, "Failed to mint token", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Bootstrap token minted", "id", token.ID, "agent", token.Agent, "capabilities", token.Capabilities)
+	writeAdminJSON(w, map[string]interface{}{
+		"token":        encoded,
+		"id":           token.ID,
+		"agent":        token.Agent,
+		"capabilities": token.Capabilities,
+		"expires":      time.UnixMilli(token.Expires).UTC(),
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func registerWithToken(broker *Broker, agent string, key ed25519.PrivateKey, capabilities []string, token string) *bufferedResponse {
+	env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+	env.Agent = agent
+	env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+		PubKey:         protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Capabilities:   capabilities,
+		BootstrapToken: token,
+	})
+	protocol.SignEnvelope(env, key)
+	recorder := newBufferedResponse()
+	broker.handleRegisterAgent(recorder, env)
+	return recorder
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	broker := NewBroker()
+	broker.SetClosedRegistration(true)
+	_, key, _ := protocol.GenerateKeyPair()
+
+	if recorder := registerWithToken(broker, "worker-1", key, []string{"echo"}, ""); recorder.status != http.StatusForbidden {
+		t.Errorf("Expected a registration without a token to be refused, got %d", recorder.status)
+	}
+
+	_, token, _ := broker.MintBootstrapToken("worker-*", []string{"echo", "file.*"}, time.Hour)
+	if recorder := registerWithToken(broker, "worker-1", key, []string{"echo", "file.read"}, token); recorder.status != http.StatusOK {
+		t.Fatalf("Expected the token to admit worker-1, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if recorder := registerWithToken(broker, "worker-2", key, []string{"shell.execute"}, token); recorder.status != http.StatusForbidden {
+		t.Errorf("Expected a capability outside the token to be refused, got %d", recorder.status)
+	}
+	if recorder := registerWithToken(broker, "guest", key, []string{"echo"}, token); recorder.status != http.StatusForbidden {
+		t.Errorf("Expected an agent outside the token's pattern to be refused, got %d", recorder.status)
+	}
+
+	// The grant outlives the token for re-registrations with the same key
+	if recorder := registerWithToken(broker, "worker-1", key, []string{"file.write"}, ""); recorder.status != http.StatusOK {
+		t.Errorf("Expected worker-1 to register again within its grant, got %d", recorder.status)
+	}
+	if recorder := registerWithToken(broker, "worker-1", key, []string{"shell.execute"}, ""); recorder.status != http.StatusForbidden {
+		t.Errorf("Expected worker-1 not to widen its grant, got %d", recorder.status)
+	}
+	// Another key waits for an operator instead
+	_, otherKey, _ := protocol.GenerateKeyPair()
+	recorder := registerWithToken(broker, "worker-1", otherKey, []string{"echo"}, "")
+	if !strings.Contains(recorder.body.String(), protocol.StatusPendingApproval) {
+		t.Errorf("Expected the grant not to carry over to another key, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if !broker.agents["worker-1"].PubKey.Equal(key.Public()) {
+		t.Error("Expected worker-1 to keep its key until the change is approved")
+	}
+
+	_, expired, _ := broker.MintBootstrapToken("*", []string{"echo"}, -time.Minute)
+	if recorder := registerWithToken(broker, "worker-3", key, []string{"echo"}, expired); recorder.status != http.StatusForbidden {
+		t.Errorf("Expected an expired token to be refused, got %d", recorder.status)
+	}
+	_, foreign, _ := NewBroker().MintBootstrapToken("*", []string{"echo"}, time.Hour)
+	if recorder := registerWithToken(broker, "worker-3", key, []string{"echo"}, foreign); recorder.status != http.StatusForbidden {
+		t.Errorf("Expected a token signed by another broker to be refused, got %d", recorder.status)
+	}
+}
+
+func TestAdminMintsBootstrapTokens(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	resp, err := adminClient(broker, server).Post(server.URL+"/admin/tokens", "application/json",
+		strings.NewReader(`{"agent": "worker-*", "capabilities": ["echo"], "ttl": "1h"}`))
+	if err != nil {
+		t.Fatalf("Minting failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var minted struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&minted)
+
+	token, err := protocol.DecodeBootstrapToken(minted.Token)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("Expected a token, got %d, %v", resp.StatusCode, err)
+	}
+	if err := token.Verify(broker.privateKey.Public().(ed25519.PublicKey)); err != nil || token.Agent != "worker-*" {
+		t.Errorf("Expected a token for worker-* signed by the broker, got %+v, %v", token, err)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// defaultBroadcastTTL is how long deliveries to offline recipients
+	// are kept when the broadcast sets no TTL
+	defaultBroadcastTTL = 10 * time.Minute
+	// maxBroadcastTTL caps the TTL a broadcast may ask for
+	maxBroadcastTTL = 24 * time.Hour
+	// broadcastWorkers bounds the concurrent pushes of one fan-out
+	broadcastWorkers = 32
+)
+
+// Delivery states of a broadcast recipient
+const (
+	BroadcastPending   = "pending"   // Not connected yet, or the last push failed
+	BroadcastDelivered = "delivered" // Pushed over the recipient's connection
+	BroadcastExpired   = "expired"   // Still pending when the broadcast expired
+	BroadcastHandedOff = "handedOff" // Handed to a successor broker while draining
+)
+
+// BroadcastDelivery tracks one recipient of a broadcast
+type BroadcastDelivery struct {
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts,omitempty"`
+	DeliveredAt time.Time `json:"deliveredAt,omitempty"`
+	Error       string    `json:"error,omitempty"` // Why the last push failed
+}
+
+// broadcast is one envelope sent to many agents. Its bytes are stored once
+// and every recipient's queue refers to it by ID.
+type broadcast struct {
+	id         string
+	sender     string
+	event      string
+	data       []byte
+	createdAt  time.Time
+	expiresAt  time.Time
+	deliveries map[string]*BroadcastDelivery
+}
+
+// BroadcastStatus reports the delivery of a broadcast
+type BroadcastStatus struct {
+	ID         string                       `json:"id"`
+	Sender     string                       `json:"sender"`
+	Event      string                       `json:"event"`
+	Size       int                          `json:"size"` // Bytes stored for the envelope, shared by all recipients
+	CreatedAt  time.Time                    `json:"createdAt"`
+	ExpiresAt  time.Time                    `json:"expiresAt"`
+	Counts     map[string]int               `json:"counts"` // Recipients by delivery state
+	Recipients map[string]BroadcastDelivery `json:"recipients"`
+}
+
+// BroadcastTable fans broadcasts out over live agent connections. Agents
+// that are not connected keep a queue of the broadcasts owed to them, which
+// is delivered when they connect.
+type BroadcastTable struct {
+	broadcasts map[string]*broadcast
+	owed       map[string][]string // Broadcast IDs by recipient, oldest first
+	pusher     EnvelopePusher
+	ttl        time.Duration
+	mu         sync.Mutex
+}
+
+// NewBroadcastTable creates a table delivering through pusher
+func NewBroadcastTable(pusher EnvelopePusher) *BroadcastTable {
+	return &BroadcastTable{
+		broadcasts: make(map[string]*broadcast),
+		owed:       make(map[string][]string),
+		pusher:     pusher,
+		ttl:        defaultBroadcastTTL,
+	}
+}
+
+// SetTTL sets how long broadcasts without their own TTL are kept
+func (t *BroadcastTable) SetTTL(ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ttl = ttl
+}
+
+// Send stores a serialized envelope once and pushes it to every connected
+// recipient. ttl of zero uses the table's default. It returns the
+// broadcast's ID once every connected recipient has been tried.
+func (t *BroadcastTable) Send(sender, event string, data []byte, recipients []string, ttl time.Duration) string {
+	now := time.Now()
+	b := &broadcast{
+		id:         protocol.NewNonce(),
+		sender:     sender,
+		event:      event,
+		data:       data,
+		createdAt:  now,
+		deliveries: make(map[string]*BroadcastDelivery, len(recipients)),
+	}
+
+	t.mu.Lock()
+	if ttl <= 0 {
+		ttl = t.ttl
+	}
+	b.expiresAt = now.Add(ttl)
+	t.broadcasts[b.id] = b
+	for _, recipient := range recipients {
+		b.deliveries[recipient] = &BroadcastDelivery{Status: BroadcastPending}
+		t.owed[recipient] = append(t.owed[recipient], b.id)
+	}
+	t.mu.Unlock()
+
+	var connected []string
+	for _, recipient := range recipients {
+		if t.pusher.IsConnected(recipient) {
+			connected = append(connected, recipient)
+		}
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < broadcastWorkers && i < len(connected); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for recipient := range work {
+				t.push(b, recipient)
+			}
+		}()
+	}
+	for _, recipient := range connected {
+		work <- recipient
+	}
+	close(work)
+	wg.Wait()
+	return b.id
+}
+
+// push delivers a broadcast to one recipient and records the outcome
+func (t *BroadcastTable) push(b *broadcast, recipient string) {
+	err := t.pusher.SendRaw(recipient, b.data)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delivery := b.deliveries[recipient]
+	if delivery == nil || delivery.Status != BroadcastPending {
+		return
+	}
+	delivery.Attempts++
+	if err != nil {
+		delivery.Error = err.Error()
+		slog.Warn("Failed to push broadcast", "broadcast", b.id, "agent", recipient, "error", err)
+		return
+	}
+	delivery.Status = BroadcastDelivered
+	delivery.DeliveredAt = time.Now()
+	delivery.Error = ""
+	t.forgetLocked(recipient, b.id)
+}
+
+// forgetLocked removes a broadcast from a recipient's queue
+func (t *BroadcastTable) forgetLocked(recipient, id string) {
+	owed := t.owed[recipient]
+	for i, owedID := range owed {
+		if owedID == id {
+			owed = append(owed[:i], owed[i+1:]...)
+			break
+		}
+	}
+	if len(owed) == 0 {
+		delete(t.owed, recipient)
+	} else {
+		t.owed[recipient] = owed
+	}
+}
+
+// Deliver pushes the broadcasts owed to an agent that just connected, in
+// the order they were sent
+func (t *BroadcastTable) Deliver(agentID string) {
+	t.mu.Lock()
+	var pending []*broadcast
+	for _, id := range t.owed[agentID] {
+		if b, exists := t.broadcasts[id]; exists {
+			pending = append(pending, b)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, b := range pending {
+		t.push(b, agentID)
+	}
+}
+
+// Status reports a broadcast's delivery to each recipient
+func (t *BroadcastTable) Status(id string) (*BroadcastStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, exists := t.broadcasts[id]
+	if !exists {
+		return nil, false
+	}
+	status := &BroadcastStatus{
+		ID:         b.id,
+		Sender:     b.sender,
+		Event:      b.event,
+		Size:       len(b.data),
+		CreatedAt:  b.createdAt,
+		ExpiresAt:  b.expiresAt,
+		Counts:     map[string]int{BroadcastPending: 0, BroadcastDelivered: 0},
+		Recipients: make(map[string]BroadcastDelivery, len(b.deliveries)),
+	}
+	for recipient, delivery := range b.deliveries {
+		status.Counts[delivery.Status]++
+		status.Recipients[recipient] = *delivery
+	}
+	return status, true
+}
+
+// Prune forgets broadcasts that expired before now, dropping their pending
+// deliveries
+func (t *BroadcastTable) Prune(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pruned := 0
+	for id, b := range t.broadcasts {
+		if now.Before(b.expiresAt) {
+			continue
+		}
+		for recipient, delivery := range b.deliveries {
+			if delivery.Status == BroadcastPending {
+				delivery.Status = BroadcastExpired
+				t.forgetLocked(recipient, id)
+			}
+		}
+		delete(t.broadcasts, id)
+		pruned++
+	}
+	return pruned
+}
+
+// Run prunes expired broadcasts every interval until stop is closed
+func (t *BroadcastTable) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if pruned := t.Prune(time.Now()); pruned > 0 {
+				slog.Info("Expired broadcasts", "count", pruned)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Owed returns the live broadcasts with the recipients each is still owed
+// to, oldest first, for handing over to a successor broker
+func (t *BroadcastTable) Owed(now time.Time) []protocol.HandoffBroadcast {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	live := make([]*broadcast, 0, len(t.broadcasts))
+	for _, b := range t.broadcasts {
+		if now.Before(b.expiresAt) {
+			live = append(live, b)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].createdAt.Before(live[j].createdAt) })
+
+	owed := make([]protocol.HandoffBroadcast, 0)
+	for _, b := range live {
+		handoff := protocol.HandoffBroadcast{
+			ID:       b.id,
+			Sender:   b.sender,
+			Event:    b.event,
+			Envelope: b.data,
+			Expires:  b.expiresAt.UnixMilli(),
+		}
+		for recipient, delivery := range b.deliveries {
+			if delivery.Status == BroadcastPending {
+				handoff.Recipients = append(handoff.Recipients, recipient)
+			}
+		}
+		if len(handoff.Recipients) > 0 {
+			sort.Strings(handoff.Recipients)
+			owed = append(owed, handoff)
+		}
+	}
+	return owed
+}
+
+// HandOff marks the pending deliveries of the given broadcasts as handed
+// to a successor broker, which delivers them from now on
+func (t *BroadcastTable) HandOff(handoffs []protocol.HandoffBroadcast) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, handoff := range handoffs {
+		b, exists := t.broadcasts[handoff.ID]
+		if !exists {
+			continue
+		}
+		for _, recipient := range handoff.Recipients {
+			if delivery := b.deliveries[recipient]; delivery != nil && delivery.Status == BroadcastPending {
+				delivery.Status = BroadcastHandedOff
+				t.forgetLocked(recipient, b.id)
+			}
+		}
+	}
+}
+
+// Adopt takes over a broadcast handed off by a draining broker, owing it
+// to the recipients it still had pending. A broadcast already known is
+// left alone.
+func (t *BroadcastTable) Adopt(handoff protocol.HandoffBroadcast) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.broadcasts[handoff.ID]; exists {
+		return
+	}
+	b := &broadcast{
+		id:         handoff.ID,
+		sender:     handoff.Sender,
+		event:      handoff.Event,
+		data:       handoff.Envelope,
+		createdAt:  time.Now(),
+		expiresAt:  time.UnixMilli(handoff.Expires),
+		deliveries: make(map[string]*BroadcastDelivery, len(handoff.Recipients)),
+	}
+	t.broadcasts[b.id] = b
+	for _, recipient := range handoff.Recipients {
+		b.deliveries[recipient] = &BroadcastDelivery{Status: BroadcastPending}
+		t.owed[recipient] = append(t.owed[recipient], b.id)
+	}
+}
+
+// GetBroadcastCount returns the number of broadcasts still tracked
+func (t *BroadcastTable) GetBroadcastCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.broadcasts)
+}
+
+// broadcastRecipients resolves a broadcast's recipients: the listed agents
+// and every agent with the capability, without the sender or duplicates.
+// Like events, a broadcast only reaches the sender's namespace and those a
+// bridge forwards its event to. Listed agents that are not registered, or
+// that it cannot reach, are returned as unknown.
+func (b *Broker) broadcastRecipients(sender string, body protocol.BroadcastBody) (recipients, unknown []string) {
+	namespace := agentNamespace(sender)
+	reaches := func(agentID string) bool {
+		return b.eventBridges.Reaches(namespace, agentNamespace(agentID), body.Event)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	seen := map[string]bool{sender: true}
+	for _, agentID := range body.Recipients {
+		if seen[agentID] {
+			continue
+		}
+		seen[agentID] = true
+		if _, registered := b.agents[agentID]; registered && reaches(agentID) {
+			recipients = append(recipients, agentID)
+		} else {
+			unknown = append(unknown, agentID)
+		}
+	}
+	if body.Capability != "" {
+		for agentID, agent := range b.agents {
+			if !seen[agentID] && containsString(agent.Capabilities, body.Capability) && reaches(agentID) {
+				seen[agentID] = true
+				recipients = append(recipients, agentID)
+			}
+		}
+	}
+	sort.Strings(recipients)
+	return recipients, unknown
+}
+
+// handleBroadcast stores a broadcast envelope once and fans it out to its
+// recipients. Only registered agents proven by their key may broadcast, as
+// recipients trust the broadcast's sender and namespace.
+func (b *Broker) handleBroadcast(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.BroadcastBody
+	if err := env.GetBodyAs(&body); err != nil || body.Event == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	verified, err := b.verifyCaller(w, env)
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+	if !verified {
+		b.replyError(w, env, http.StatusForbidden, protocol.ErrorForbidden, fmt.Sprintf("Agent %s must be registered with a key to broadcast", env.Agent))
+		return
+	}
+
+	recipients, unknown := b.broadcastRecipients(env.Agent, body)
+	if len(recipients) == 0 {
+		http.Error(w, "Broadcast has no registered recipients", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		http.Error(w, "Failed to encode broadcast", http.StatusInternalServerError)
+		return
+	}
+	ttl := time.Duration(body.TTL) * time.Millisecond
+	if ttl > maxBroadcastTTL {
+		ttl = maxBroadcastTTL
+	}
+
+	id := b.broadcasts.Send(env.Agent, body.Event, data, recipients, ttl)
+	status, _ := b.broadcasts.Status(id)
+	slog.Info("Broadcast sent", "broadcast", id, "event", body.Event, "agent", env.Agent,
+		"recipients", len(recipients), "delivered", status.Counts[BroadcastDelivered])
+
+	response := map[string]interface{}{
+		"status":     "broadcast",
+		"broadcast":  id,
+		"recipients": len(recipients),
+		"delivered":  status.Counts[BroadcastDelivered],
+		"pending":    status.Counts[BroadcastPending],
+	}
+	if len(unknown) > 0 {
+		response["unknown"] = unknown
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleBroadcastStatus serves GET /broadcasts/{id} to operators holding
+// the admin token, as it lists who was sent the broadcast
+func (b *Broker) handleBroadcastStatus(w http.ResponseWriter, r *http.Request) {
+	if !b.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	status, exists := b.broadcasts.Status(strings.TrimPrefix(r.URL.Path, "/broadcasts/"))
+	if !exists {
+		http.Error(w, "Unknown or expired broadcast", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// fakePusher records pushes to agents marked connected
+type fakePusher struct {
+	connected map[string]bool
+	failing   map[string]bool
+	received  map[string][][]byte
+	mu        sync.Mutex
+}
+
+func newFakePusher() *fakePusher {
+	return &fakePusher{connected: make(map[string]bool), failing: make(map[string]bool), received: make(map[string][][]byte)}
+}
+
+func (p *fakePusher) IsConnected(agentID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected[agentID]
+}
+
+func (p *fakePusher) SendRaw(agentID string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected[agentID] {
+		return ErrAgentNotConnected
+	}
+	if p.failing[agentID] {
+		return errors.New("write timeout")
+	}
+	p.received[agentID] = append(p.received[agentID], data)
+	return nil
+}
+
+func TestBroadcastTableFanOut(t *testing.T) {
+	pusher := newFakePusher()
+	var recipients []string
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("fleet.%04d", i)
+		recipients = append(recipients, id)
+		pusher.connected[id] = i%2 == 0
+	}
+	pusher.failing["fleet.0000"] = true
+
+	table := NewBroadcastTable(pusher)
+	data := []byte(`{"type":"broadcast"}`)
+	id := table.Send("controller", "config.updated", data, recipients, 0)
+
+	status, exists := table.Status(id)
+	if !exists {
+		t.Fatal("Expected the broadcast to be tracked")
+	}
+	if status.Counts[BroadcastDelivered] != 499 || status.Counts[BroadcastPending] != 501 {
+		t.Errorf("Unexpected delivery counts %v", status.Counts)
+	}
+	if delivery := status.Recipients["fleet.0000"]; delivery.Attempts != 1 || delivery.Error == "" {
+		t.Errorf("Expected the failed push to be recorded, got %+v", delivery)
+	}
+
+	// Every recipient shares the stored envelope rather than a copy
+	if &pusher.received["fleet.0002"][0][0] != &data[0] {
+		t.Error("Expected recipients to be sent the stored envelope")
+	}
+
+	// Offline recipients get it when they connect, failed ones on retry
+	pusher.connected["fleet.0001"] = true
+	pusher.failing["fleet.0000"] = false
+	table.Deliver("fleet.0001")
+	table.Deliver("fleet.0000")
+	table.Deliver("fleet.0001")
+	status, _ = table.Status(id)
+	if status.Counts[BroadcastDelivered] != 501 {
+		t.Errorf("Expected two more deliveries, got %v", status.Counts)
+	}
+	if len(pusher.received["fleet.0001"]) != 1 {
+		t.Errorf("Expected a single delivery to fleet.0001, got %d", len(pusher.received["fleet.0001"]))
+	}
+
+	// Expiry drops what is still owed
+	if pruned := table.Prune(time.Now().Add(defaultBroadcastTTL)); pruned != 1 {
+		t.Errorf("Expected one broadcast to expire, got %d", pruned)
+	}
+	if _, exists := table.Status(id); exists {
+		t.Error("Expected the expired broadcast to be forgotten")
+	}
+	if len(table.owed) != 0 {
+		t.Errorf("Expected no owed broadcasts after expiry, got %d", len(table.owed))
+	}
+}
+
+func TestHandleBroadcast(t *testing.T) {
+	broker := NewBroker()
+	pusher := newFakePusher()
+	broker.broadcasts = NewBroadcastTable(pusher)
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	broker.agents["controller"] = &Agent{ID: "controller", Capabilities: []string{"camera"}, PubKey: pub}
+	broker.agents["cam-a"] = &Agent{ID: "cam-a", Capabilities: []string{"camera"}}
+	broker.agents["cam-b"] = &Agent{ID: "cam-b", Capabilities: []string{"camera"}}
+	broker.agents["lidar-a"] = &Agent{ID: "lidar-a", Capabilities: []string{"lidar"}}
+	pusher.connected["cam-a"] = true
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeBroadcast},
+	}
+	env.Agent = "controller"
+	env.Body, _ = json.Marshal(protocol.BroadcastBody{
+		Recipients: []string{"lidar-a", "cam-a", "ghost"},
+		Capability: "camera",
+		Event:      "config.updated",
+	})
+
+	// Only a registered sender proven by its key may broadcast
+	recorder := newBufferedResponse()
+	broker.handleBroadcast(recorder, env)
+	if recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned broadcast to be refused, got %d", recorder.status)
+	}
+	impostor := *env
+	impostor.Agent = "cam-b"
+	recorder = newBufferedResponse()
+	broker.handleBroadcast(recorder, &impostor)
+	if recorder.status != http.StatusForbidden {
+		t.Errorf("Expected a sender without a key to be refused, got %d", recorder.status)
+	}
+	if broker.broadcasts.GetBroadcastCount() != 0 {
+		t.Fatal("Expected refused broadcasts not to be sent")
+	}
+
+	env.Nonce = protocol.NewNonce()
+	protocol.SignEnvelope(env, priv)
+	recorder = newBufferedResponse()
+	broker.handleBroadcast(recorder, env)
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+	var response struct {
+		Broadcast  string   `json:"broadcast"`
+		Recipients int      `json:"recipients"`
+		Delivered  int      `json:"delivered"`
+		Pending    int      `json:"pending"`
+		Unknown    []string `json:"unknown"`
+	}
+	if err := json.Unmarshal(recorder.body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	// The sender is left out and cam-a, listed and matched, counts once
+	if response.Recipients != 3 || response.Delivered != 1 || response.Pending != 2 {
+		t.Errorf("Unexpected response %+v", response)
+	}
+	if len(response.Unknown) != 1 || response.Unknown[0] != "ghost" {
+		t.Errorf("Expected ghost to be reported unknown, got %v", response.Unknown)
+	}
+
+	// Delivery status is for operators
+	server := httptest.NewServer(broker)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/broadcasts/" + response.Broadcast)
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the status to need the admin token, got %d", resp.StatusCode)
+	}
+	resp, err = adminClient(broker, server).Get(server.URL + "/broadcasts/" + response.Broadcast)
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var status BroadcastStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if status.Recipients["cam-a"].Status != BroadcastDelivered || status.Recipients["cam-b"].Status != BroadcastPending {
+		t.Errorf("Unexpected recipient states %+v", status.Recipients)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// drainRefused are the envelope types a draining broker no longer accepts,
+// since they start work it would not finish. Results of calls already
+// made, deregistrations, open streams and federation traffic are still
+// accepted.
+var drainRefused = map[protocol.EnvelopeType]bool{
+	protocol.EnvelopeRegisterAgent:     true,
+	protocol.EnvelopeEmitEvent:         true,
+	protocol.EnvelopeRenderInstruction: true,
+	protocol.EnvelopeToolCall:          true,
+	protocol.EnvelopeDiscoverTools:     true,
+	protocol.EnvelopeEmbodimentUpdate:  true,
+	protocol.EnvelopeSubscribe:         true,
+	protocol.EnvelopePing:              true,
+	protocol.EnvelopeAgentHeartbeat:    true,
+	protocol.EnvelopeStreamOpen:        true,
+	protocol.EnvelopeBroadcast:         true,
+}
+
+// DrainStatus reports a broker's drain, as served by /admin/drain. The
+// drain is complete once the successor has accepted the broker's state and
+// every tool call still awaiting a result here has been answered or has
+// expired.
+type DrainStatus struct {
+	Draining    bool      `json:"draining"`
+	Successor   string    `json:"successor,omitempty"`
+	Endpoint    string    `json:"endpoint,omitempty"` // URL agents are redirected to
+	StartedAt   time.Time `json:"startedAt,omitempty"`
+	HandedOffAt time.Time `json:"handedOffAt,omitempty"` // When the successor accepted the state
+	Broadcasts  int       `json:"broadcasts"`            // Broadcasts handed off with pending recipients
+	Requests    int       `json:"requests"`              // Tool calls whose results the successor relays back
+	Notified    int       `json:"notified"`              // Connected agents sent a brokerDraining notice
+	Pending     int       `json:"pending"`               // Tool calls still awaiting results here
+	Connected   int       `json:"connected"`             // Agents still holding a live connection here
+	Error       string    `json:"error,omitempty"`       // Why the last handoff failed
+	Complete    bool      `json:"complete"`
+	CompletedAt time.Time `json:"completedAt,omitempty"`
+}
+
+// handedOffRequest is a tool call another broker was waiting on when it
+// drained into this one
+type handedOffRequest struct {
+	origin  string
+	target  string
+	expires time.Time
+}
+
+// HandedOffRequests holds the tool calls handed over by draining brokers,
+// so that results their targets send here are relayed back to the broker
+// whose caller is waiting
+type HandedOffRequests struct {
+	requests map[string]handedOffRequest
+	mu       sync.Mutex
+}
+
+// NewHandedOffRequests creates an empty table
+func NewHandedOffRequests() *HandedOffRequests {
+	return &HandedOffRequests{requests: make(map[string]handedOffRequest)}
+}
+
+// Add records the calls a draining broker handed over, dropping those
+// that have expired
+func (h *HandedOffRequests) Add(origin string, requests []protocol.HandoffRequest, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for id, req := range h.requests {
+		if !now.Before(req.expires) {
+			delete(h.requests, id)
+		}
+	}
+	for _, req := range requests {
+		h.requests[req.RequestID] = handedOffRequest{origin: origin, target: req.Target, expires: time.UnixMilli(req.Expires)}
+	}
+}
+
+// Take returns the broker a result from agentID for the request should be
+// relayed to, forgetting the request
+func (h *HandedOffRequests) Take(requestID, agentID string, now time.Time) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	req, exists := h.requests[requestID]
+	if !exists || req.target != agentID {
+		return "", false
+	}
+	delete(h.requests, requestID)
+	return req.origin, now.Before(req.expires)
+}
+
+// Drain stops the broker taking on new work and hands its state over to a
+// federated peer: broadcasts still owed to offline recipients, and the
+// tool calls awaiting results. Agents are told to move to the successor at
+// endpoint, or at the peer's federation endpoint if endpoint is empty. A
+// failed handoff leaves the broker draining; Drain may be called again.
+func (b *Broker) Drain(successor, endpoint string) (*DrainStatus, error) {
+	peer, exists := b.peers.Get(successor)
+	if !exists {
+		return nil, fmt.Errorf("broker %s is not a peer", successor)
+	}
+	if endpoint == "" {
+		endpoint = peer.Endpoint
+	}
+
+	b.mu.Lock()
+	b.drain = &DrainStatus{
+		Draining:  true,
+		Successor: successor,
+		Endpoint:  endpoint,
+		StartedAt: time.Now(),
+	}
+	b.mu.Unlock()
+	slog.Warn("Draining", "successor", successor, "endpoint", endpoint)
+
+	broadcasts := b.broadcasts.Owed(time.Now())
+	requests := b.pending.Outstanding()
+	if err := b.sendHandoff(peer, protocol.StateHandoffBody{Broadcasts: broadcasts, Requests: requests}); err != nil {
+		b.mu.Lock()
+		b.drain.Error = err.Error()
+		b.mu.Unlock()
+		slog.Error("State handoff failed", "successor", successor, "error", err)
+		return b.DrainStatus(), err
+	}
+	b.broadcasts.HandOff(broadcasts)
+
+	notified := 0
+	if notice, err := b.drainingNotice(successor, endpoint); err == nil {
+		notified = b.hub.Broadcast(notice, "")
+	}
+
+	b.mu.Lock()
+	b.drain.HandedOffAt = time.Now()
+	b.drain.Broadcasts, b.drain.Requests, b.drain.Notified = len(broadcasts), len(requests), notified
+	b.drain.Error = ""
+	b.mu.Unlock()
+	slog.Info("State handed off", "successor", successor, "broadcasts", len(broadcasts), "requests", len(requests), "notified", notified)
+	return b.DrainStatus(), nil
+}
+
+// DrainStatus reports the broker's drain, noting its completion the first
+// time it is seen complete
+func (b *Broker) DrainStatus() *DrainStatus {
+	pending := b.pending.GetPendingCount()
+	connected := len(b.hub.ConnectedAgents())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.drain == nil {
+		return &DrainStatus{Pending: pending, Connected: connected}
+	}
+	status := *b.drain
+	status.Pending, status.Connected = pending, connected
+	if !status.HandedOffAt.IsZero() && pending == 0 && !status.Complete {
+		status.Complete, status.CompletedAt = true, time.Now()
+		b.drain.Complete, b.drain.CompletedAt = status.Complete, status.CompletedAt
+		slog.Info("Drain complete", "successor", status.Successor, "duration", status.CompletedAt.Sub(status.StartedAt))
+	}
+	return &status
+}
+
+// draining returns the drain in progress, or nil
+func (b *Broker) draining() *DrainStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.drain
+}
+
+// drainingNotice creates a signed brokerDraining envelope naming the
+// successor
+func (b *Broker) drainingNotice(successor, endpoint string) (*protocol.BrokerDrainingEnvelope, error) {
+	notice := protocol.NewBrokerDraining(b.id, successor, endpoint)
+	if err := notice.Sign(b.privateKey); err != nil {
+		return nil, err
+	}
+	return notice, nil
+}
+
+// admitDraining refuses envelopes that would start new work while the
+// broker drains, answering them with a brokerDraining notice and the
+// successor's URL in HeaderSuccessor
+func (b *Broker) admitDraining(w http.ResponseWriter, env *protocol.GenericEnvelope) bool {
+	drain := b.draining()
+	if drain == nil || !drainRefused[env.Type] {
+		return true
+	}
+
+	notice, err := b.drainingNotice(drain.Successor, drain.Endpoint)
+	if err != nil {
+		http.Error(w, "Broker is draining", http.StatusServiceUnavailable)
+		return false
+	}
+	w.Header().Set(protocol.HeaderSuccessor, drain.Endpoint)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(notice)
+	return false
+}
+
+// sendHandoff sends the successor a stateHandoff signed by this broker
+func (b *Broker) sendHandoff(successor *FederatedBroker, body protocol.StateHandoffBody) error {
+	handoff := protocol.NewStateHandoff(b.id, body)
+	if err := handoff.Sign(b.privateKey); err != nil {
+		return fmt.Errorf("failed to sign handoff: %w", err)
+	}
+	generic := &protocol.GenericEnvelope{BaseEnvelope: handoff.BaseEnvelope}
+	generic.Body, _ = json.Marshal(handoff.Body)
+
+	status, _, err := b.peers.forward(successor, generic)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("successor answered with status %d", status)
+	}
+	return nil
+}
+
+// handleStateHandoff takes over the state of a draining peer: its owed
+// broadcasts are delivered from here, and results of its outstanding tool
+// calls are relayed back to it
+func (b *Broker) handleStateHandoff(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.StateHandoffBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	peer, exists := b.peers.Get(env.Agent)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Broker %s is not a peer", env.Agent), http.StatusNotFound)
+		return
+	}
+	pubKey, err := protocol.DecodePublicKey(peer.PublicKey)
+	if err == nil {
+		err = env.Verify(pubKey)
+	}
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+
+	for _, broadcast := range body.Broadcasts {
+		b.broadcasts.Adopt(broadcast)
+	}
+	b.handoffs.Add(env.Agent, body.Requests, time.Now())
+	slog.Info("Took over state", "broker", env.Agent, "broadcasts", len(body.Broadcasts), "requests", len(body.Requests))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "accepted",
+		"broadcasts": len(body.Broadcasts),
+		"requests":   len(body.Requests),
+	})
+}
+
+// relayHandedOffResult relays a toolResult for a call a drained broker
+// handed over back to that broker, whose caller is waiting for it. It
+// reports whether the result was one.
+func (b *Broker) relayHandedOffResult(w http.ResponseWriter, env *protocol.GenericEnvelope, requestID string) bool {
+	origin, live := b.handoffs.Take(requestID, env.Agent, time.Now())
+	if origin == "" {
+		return false
+	}
+	peer, exists := b.peers.Get(origin)
+	if !live || !exists {
+		http.Error(w, "The caller's broker is no longer waiting for this result", http.StatusGone)
+		return true
+	}
+
+	status, data, err := b.peers.forward(peer, env)
+	if err != nil {
+		slog.Warn("Failed to relay handed-off result", "broker", origin, "requestId", requestID, "error", err)
+		http.Error(w, "Failed to relay result to the caller's broker", http.StatusBadGateway)
+		return true
+	}
+	slog.Debug("Relayed handed-off result", "broker", origin, "requestId", requestID, "agent", env.Agent)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+	return true
+}
+
+// handleAdminDrain serves POST /admin/drain, starting a drain into the
+// successor named by a JSON body of the form {"successor": "broker-b",
+// "endpoint": "https://broker-b:4433"}, and GET /admin/drain, its status
+func (b *Broker) handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeAdminJSON(w, b.DrainStatus())
+		return
+	}
+
+	var request struct {
+		Successor string `json:"successor"`
+		Endpoint  string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Successor == "" {
+		http.Error(w, "A successor broker is required", http.StatusBadRequest)
+		return
+	}
+	if _, exists := b.peers.Get(request.Successor); !exists {
+		http.Error(w, fmt.Sprintf("Broker %s is not a peer", request.Successor), http.StatusNotFound)
+		return
+	}
+
+	status, err := b.Drain(request.Successor, request.Endpoint)
+	if err != nil {
+		http.Error(w, "State handoff failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeAdminJSON(w, status)
+}
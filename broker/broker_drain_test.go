@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestBrokerDrainHandoff(t *testing.T) {
+	brokerA, serverA, brokerB, serverB := federatedPair(t)
+
+	_, key, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{AgentID: "worker", BrokerURL: serverA.URL, PrivateKey: key, TLSInsecure: true})
+	if err := client.Register(protocol.RegisterAgentBody{PubKey: protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)), Capabilities: []string{"echo"}}); err != nil {
+		t.Fatalf("Registration failed: %v", err)
+	}
+
+	// State that would be lost with broker-a: a broadcast owed to an
+	// offline agent, and a call awaiting the worker's result
+	broadcast := brokerA.broadcasts.Send("controller", "config.updated", []byte(`{"type":"broadcast"}`), []string{"offline"}, time.Hour)
+	req, _ := brokerA.pending.Track("req-1", "caller", "worker", "echo")
+
+	status, err := brokerA.Drain("broker-b", "")
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if status.Broadcasts != 1 || status.Requests != 1 || status.Endpoint != serverB.URL || status.Complete {
+		t.Errorf("Unexpected drain status %+v", status)
+	}
+	if owed, _ := brokerA.broadcasts.Status(broadcast); owed.Recipients["offline"].Status != BroadcastHandedOff {
+		t.Errorf("Expected the broadcast to be handed off, got %+v", owed.Recipients)
+	}
+	if brokerB.broadcasts.GetBroadcastCount() != 1 {
+		t.Error("Expected broker-b to take over the broadcast")
+	}
+	if resp, err := serverA.Client().Get(serverA.URL + "/health"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a draining broker to fail its health check, got %v", resp)
+	}
+
+	// The worker is redirected to broker-b, and its result relayed back
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Expected the ping to be redirected, got %v", err)
+	}
+	if client.currentBroker() != serverB.URL {
+		t.Errorf("Expected the client to move to %s, got %s", serverB.URL, client.currentBroker())
+	}
+	if _, registered := brokerB.agents["worker"]; !registered {
+		t.Error("Expected the worker to register with broker-b")
+	}
+
+	result := protocol.NewEnvelope(protocol.EnvelopeToolResult, "worker")
+	result.Body, _ = json.Marshal(protocol.ToolResultBody{RequestID: "req-1", Success: true, Result: "done"})
+	result.Sign(key)
+	if _, err := client.sendRequest(result); err != nil {
+		t.Fatalf("Failed to send the result: %v", err)
+	}
+	if answer := brokerA.pending.Wait(req); !answer.Success || answer.Result != "done" {
+		t.Errorf("Expected the result to reach broker-a's caller, got %+v", answer)
+	}
+	if status := brokerA.DrainStatus(); !status.Complete || status.CompletedAt.IsZero() {
+		t.Errorf("Expected the drain to be complete, got %+v", status)
+	}
+}
+
+func TestBrokerDrainRequiresPeer(t *testing.T) {
+	broker := NewBroker()
+	if _, err := broker.Drain("broker-z", ""); err == nil {
+		t.Error("Expected draining into an unknown broker to fail")
+	}
+	if broker.draining() != nil {
+		t.Error("Expected the broker not to be draining")
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// maxFederationHops bounds how many brokers may relay one envelope
+const maxFederationHops = 3
+
+// PeerBrokers is the table of brokers this broker federates with. Peers are
+// added by a verified registerBroker in either direction.
+type PeerBrokers struct {
+	peers      map[string]*FederatedBroker
+	httpClient *http.Client
+	mu         sync.RWMutex
+}
+
+// NewPeerBrokers creates an empty peer table
+func NewPeerBrokers() *PeerBrokers {
+	return &PeerBrokers{
+		peers: make(map[string]*FederatedBroker),
+		httpClient: &http.Client{
+			Timeout: defaultToolCallTimeout,
+			Transport: &http.Transport{
+				// Peers are authenticated by their envelope signatures
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+// Add records or refreshes a peer broker, reporting whether it is new
+func (p *PeerBrokers) Add(peer *FederatedBroker) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	peer.LastSeen = time.Now()
+	peer.Status = BrokerStatusActive
+	_, known := p.peers[peer.ID]
+	p.peers[peer.ID] = peer
+	return !known
+}
+
+// RemoveEndpoint forgets the peer reached at endpoint, returning its ID
+func (p *PeerBrokers) RemoveEndpoint(endpoint string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, peer := range p.peers {
+		if peer.Endpoint == endpoint {
+			delete(p.peers, id)
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// Get returns a peer broker by ID
+func (p *PeerBrokers) Get(id string) (*FederatedBroker, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	peer, exists := p.peers[id]
+	return peer, exists
+}
+
+// List returns the peer brokers ordered by ID
+func (p *PeerBrokers) List() []*FederatedBroker {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	peers := make([]*FederatedBroker, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// forward posts an envelope to a peer, counting this broker as one more hop
+func (p *PeerBrokers) forward(peer *FederatedBroker, env *protocol.GenericEnvelope) (int, []byte, error) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, peer.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", protocol.ContentTypeJSON)
+	req.Header.Set(protocol.HeaderHops, strconv.Itoa(env.Hops+1))
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// requestHops reads the relay count of an incoming envelope
+func requestHops(r *http.Request) int {
+	hops, err := strconv.Atoi(r.Header.Get(protocol.HeaderHops))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// SetBrokerID sets the identity the broker signs envelopes with. Federated
+// brokers must each have a distinct ID.
+func (b *Broker) SetBrokerID(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.id = id
+}
+
+// SetFederationEndpoint sets the URL peers should use to reach this broker
+func (b *Broker) SetFederationEndpoint(endpoint string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoint = endpoint
+}
+
+// localPeerInfo describes this broker to a peer
+func (b *Broker) localPeerInfo() protocol.RegisterBrokerBody {
+	federation, chain := b.trust.Membership()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return protocol.RegisterBrokerBody{
+		BrokerID:     b.id,
+		Endpoint:     b.endpoint,
+		PubKey:       protocol.EncodePublicKey(b.privateKey.Public().(ed25519.PublicKey)),
+		Capabilities: []string{"federation"},
+		Federation:   federation,
+		TrustChain:   chain,
+	}
+}
+
+// handleRegisterBroker adds the sending broker to the peer table. The
+// envelope must be signed with the key it registers, and the response
+// describes this broker so the sender can add it in turn.
+func (b *Broker) handleRegisterBroker(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.RegisterBrokerBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.BrokerID == "" {
+		body.BrokerID = env.Agent
+	}
+	if body.BrokerID != env.Agent {
+		http.Error(w, "brokerId must match the envelope agent", http.StatusBadRequest)
+		return
+	}
+	if body.BrokerID == b.id {
+		http.Error(w, "A broker cannot peer with itself", http.StatusConflict)
+		return
+	}
+	if body.Endpoint == "" {
+		http.Error(w, "endpoint is required", http.StatusBadRequest)
+		return
+	}
+
+	pubKey, err := protocol.DecodePublicKey(body.PubKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid public key: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := env.Verify(pubKey); err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+	if err := b.trust.Verify(body, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// A known peer may only re-register with the same key
+	if existing, exists := b.peers.Get(body.BrokerID); exists && existing.PublicKey != body.PubKey {
+		http.Error(w, fmt.Sprintf("Broker %s is already registered with a different key", body.BrokerID), http.StatusConflict)
+		return
+	}
+
+	var role string
+	if body.Role == protocol.BrokerRoleChild {
+		role = peerRoleChild
+	}
+	peer := &FederatedBroker{
+		ID:           body.BrokerID,
+		Endpoint:     body.Endpoint,
+		PublicKey:    body.PubKey,
+		Capabilities: body.Capabilities,
+		Role:         role,
+		Federation:   body.Federation,
+	}
+	joined := b.peers.Add(peer)
+
+	slog.Info("Broker registration", "broker", env.Agent, "endpoint", body.Endpoint, "role", body.Role, "federation", body.Federation)
+	if joined {
+		b.peerJoined(peer)
+	}
+
+	response := map[string]interface{}{
+		"status": "registered",
+		"broker": env.Agent,
+		"peer":   b.localPeerInfo(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// JoinFederation registers this broker with the peer at endpoint and adds
+// the peer from its response, so envelopes are relayed in both directions
+func (b *Broker) JoinFederation(endpoint string) error {
+	return b.joinBroker(endpoint, "")
+}
+
+// joinBroker registers this broker with the broker at endpoint in the given
+// role, empty for a mesh peer, and adds it from its response
+func (b *Broker) joinBroker(endpoint, role string) error {
+	info := b.localPeerInfo()
+	info.Role = role
+	registration := &protocol.RegisterBrokerEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{
+			Type: protocol.EnvelopeRegisterBroker,
+			CommonHeaders: protocol.CommonHeaders{
+				Agent: info.BrokerID,
+				TS:    time.Now().UnixMilli(),
+				Nonce: protocol.NewNonce(),
+			},
+		},
+		Body: info,
+	}
+	if err := registration.Sign(b.privateKey); err != nil {
+		return fmt.Errorf("failed to sign broker registration: %w", err)
+	}
+
+	data, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+	resp, err := b.peers.httpClient.Post(endpoint, protocol.ContentTypeJSON, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to reach peer %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("peer %s rejected registration (%d): %s", endpoint, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var response struct {
+		Peer protocol.RegisterBrokerBody `json:"peer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("invalid registration response from %s: %w", endpoint, err)
+	}
+	if response.Peer.BrokerID == "" || response.Peer.BrokerID == info.BrokerID {
+		return fmt.Errorf("peer %s did not identify itself", endpoint)
+	}
+	if _, err := protocol.DecodePublicKey(response.Peer.PubKey); err != nil {
+		return fmt.Errorf("peer %s sent an invalid public key: %w", endpoint, err)
+	}
+	if err := b.trust.Verify(response.Peer, time.Now()); err != nil {
+		return fmt.Errorf("peer %s: %w", endpoint, err)
+	}
+
+	// Reach the peer where we found it, whatever it advertises
+	var peerRole string
+	if role == peerRoleChild {
+		peerRole = peerRoleParent
+	}
+	peer := &FederatedBroker{
+		ID:           response.Peer.BrokerID,
+		Endpoint:     endpoint,
+		PublicKey:    response.Peer.PubKey,
+		Capabilities: response.Peer.Capabilities,
+		Role:         peerRole,
+		Federation:   response.Peer.Federation,
+	}
+	joined := b.peers.Add(peer)
+
+	slog.Info("Federated with broker", "broker", response.Peer.BrokerID, "endpoint", endpoint, "role", peerRole)
+	if joined {
+		b.peerJoined(peer)
+	}
+	return nil
+}
+
+// peerJoined runs the OnPeerJoined hook for a peer new to the table
+func (b *Broker) peerJoined(peer *FederatedBroker) {
+	if hook := b.currentHooks().OnPeerJoined; hook != nil {
+		hook(PeerJoinedEvent{
+			BrokerID:     peer.ID,
+			Endpoint:     peer.Endpoint,
+			Role:         peer.Role,
+			Federation:   peer.Federation,
+			Capabilities: peer.Capabilities,
+		})
+	}
+}
+
+// forwardToolCall relays a toolCall no local agent can serve to each peer
+// in turn, returning the first result a peer signed and the peer's ID.
+// Child brokers are only tried if their catalog lists the tool. It reports
+// false if no peer could serve the call.
+func (b *Broker) forwardToolCall(env *protocol.GenericEnvelope, tool string) (protocol.ToolResultBody, string, bool) {
+	if env.Hops >= maxFederationHops {
+		return protocol.ToolResultBody{}, "", false
+	}
+
+	for _, peer := range b.toolCallRoute(tool) {
+		status, body, err := b.peers.forward(peer, env)
+		if err != nil {
+			slog.Warn("Failed to forward tool call", "tool", tool, "broker", peer.ID, "error", err)
+			continue
+		}
+		if status != http.StatusOK {
+			if status != http.StatusNotFound {
+				slog.Warn("Broker answered tool call with an error", "broker", peer.ID, "tool", tool, "status", status)
+			}
+			continue
+		}
+
+		result, err := protocol.ParseEnvelope(body)
+		if err != nil || result.Type != protocol.EnvelopeToolResult || result.Agent != peer.ID {
+			slog.Warn("Broker sent an invalid tool result", "broker", peer.ID, "tool", tool)
+			continue
+		}
+		pubKey, err := protocol.DecodePublicKey(peer.PublicKey)
+		if err == nil {
+			err = result.Verify(pubKey)
+		}
+		if err != nil {
+			slog.Warn("Rejected tool result", "tool", tool, "broker", peer.ID, "error", err)
+			continue
+		}
+
+		var resultBody protocol.ToolResultBody
+		if err := result.GetBodyAs(&resultBody); err != nil {
+			slog.Warn("Broker sent an invalid tool result", "broker", peer.ID, "tool", tool, "error", err)
+			continue
+		}
+
+		slog.Debug("Tool call served through broker", "tool", tool, "broker", peer.ID)
+		return resultBody, peer.ID, true
+	}
+
+	return protocol.ToolResultBody{}, "", false
+}
+
+// forwardEvent relays an accepted event to every peer so their subscribers
+// receive it too. Deliveries run in the background.
+func (b *Broker) forwardEvent(env *protocol.GenericEnvelope, event string) int {
+	if env.Hops >= maxFederationHops {
+		return 0
+	}
+
+	peers := b.peers.List()
+	for _, peer := range peers {
+		go func(peer *FederatedBroker) {
+			status, body, err := b.peers.forward(peer, env)
+			switch {
+			case err != nil:
+				slog.Warn("Failed to forward event", "event", event, "broker", peer.ID, "error", err)
+			case status == http.StatusConflict:
+				// The peer already has it by another route
+			case status != http.StatusOK:
+				slog.Warn("Broker rejected event", "broker", peer.ID, "event", event, "status", status, "reason", strings.TrimSpace(string(body)))
+			}
+		}(peer)
+	}
+	return len(peers)
+}
+
+// federatedDiscoveryTimeout bounds how long discovery waits for peers;
+// peers that answer later are left out of the results
+const federatedDiscoveryTimeout = 5 * time.Second
+
+// discoverFederated adds the results of peer brokers to a discovery query's
+// local results. Every result is annotated with the broker the agent is
+// registered with, and an agent found by more than one route is listed once,
+// preferring local results and then peers in ID order. Agents of brokers
+// that did not answer are listed from the gossiped registry. Peer listings
+// are weighed by the federation trust policy.
+func (b *Broker) discoverFederated(env *protocol.GenericEnvelope, query protocol.ToolQuery, local []protocol.DiscoveredTool) []protocol.DiscoveredTool {
+	for i := range local {
+		local[i].Broker = b.id
+	}
+	if env.Hops >= maxFederationHops {
+		return local
+	}
+
+	type answer struct {
+		index int
+		tools []protocol.DiscoveredTool
+		ok    bool
+	}
+
+	peers := b.peers.List()
+	answered := make(chan answer, len(peers))
+	for i, peer := range peers {
+		go func(i int, peer *FederatedBroker) {
+			tools, ok := b.discoverFromPeer(peer, env)
+			answered <- answer{i, tools, ok}
+		}(i, peer)
+	}
+
+	answers := make([][]protocol.DiscoveredTool, len(peers), len(peers)+1)
+	live := map[string]bool{b.id: true}
+	timeout := time.NewTimer(federatedDiscoveryTimeout)
+	defer timeout.Stop()
+wait:
+	for range peers {
+		select {
+		case a := <-answered:
+			answers[a.index] = a.tools
+			live[peers[a.index].ID] = a.ok
+		case <-timeout.C:
+			slog.Warn("Federated discovery timed out waiting for peers")
+			break wait
+		}
+	}
+
+	answers = append(answers, b.gossip.Discover(query, live))
+	for i := range answers {
+		answers[i] = b.trust.Weigh(answers[i])
+	}
+	return mergeDiscoveredTools(local, answers, query.MaxResults)
+}
+
+// discoverFromPeer forwards a discovery query to a peer and returns its
+// results, annotated with the peer as broker where it did not say. It
+// reports false if the peer did not answer.
+func (b *Broker) discoverFromPeer(peer *FederatedBroker, env *protocol.GenericEnvelope) ([]protocol.DiscoveredTool, bool) {
+	status, body, err := b.peers.forward(peer, env)
+	if err != nil {
+		slog.Warn("Failed to forward discovery", "broker", peer.ID, "error", err)
+		return nil, false
+	}
+	if status != http.StatusOK {
+		if status != http.StatusConflict {
+			slog.Warn("Broker answered discovery with an error", "broker", peer.ID, "status", status)
+			return nil, false
+		}
+		// The peer already answered this query by another route
+		return nil, true
+	}
+
+	var response struct {
+		Tools []protocol.DiscoveredTool `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		slog.Warn("Broker sent invalid discovery results", "broker", peer.ID, "error", err)
+		return nil, false
+	}
+	for i := range response.Tools {
+		if response.Tools[i].Broker == "" {
+			response.Tools[i].Broker = peer.ID
+		}
+	}
+	return response.Tools, true
+}
+
+// mergeDiscoveredTools combines local and peer results, keeping the first
+// listing of each agent and at most maxResults entries (0 for no limit)
+func mergeDiscoveredTools(local []protocol.DiscoveredTool, remote [][]protocol.DiscoveredTool, maxResults int) []protocol.DiscoveredTool {
+	seen := make(map[string]bool)
+	merged := make([]protocol.DiscoveredTool, 0, len(local))
+
+	add := func(tools []protocol.DiscoveredTool) {
+		for _, tool := range tools {
+			if seen[tool.AgentID] || (maxResults > 0 && len(merged) >= maxResults) {
+				continue
+			}
+			seen[tool.AgentID] = true
+			merged = append(merged, tool)
+		}
+	}
+
+	add(local)
+	for _, tools := range remote {
+		add(tools)
+	}
+	return merged
+}
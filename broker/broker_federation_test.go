@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// federatedPair starts two brokers and peers them
+func federatedPair(t *testing.T) (*Broker, *httptest.Server, *Broker, *httptest.Server) {
+	t.Helper()
+
+	start := func(id string) (*Broker, *httptest.Server) {
+		broker := NewBroker()
+		broker.SetBrokerID(id)
+		server := httptest.NewTLSServer(broker)
+		t.Cleanup(server.Close)
+		broker.SetFederationEndpoint(server.URL)
+		return broker, server
+	}
+
+	brokerA, serverA := start("broker-a")
+	brokerB, serverB := start("broker-b")
+	if err := brokerB.JoinFederation(serverA.URL); err != nil {
+		t.Fatalf("Failed to federate: %v", err)
+	}
+	return brokerA, serverA, brokerB, serverB
+}
+
+func TestBrokerFederationPeering(t *testing.T) {
+	brokerA, _, brokerB, serverB := federatedPair(t)
+
+	if peer, exists := brokerA.peers.Get("broker-b"); !exists || peer.Endpoint != serverB.URL {
+		t.Errorf("Expected broker-a to record broker-b at %s, got %+v", serverB.URL, peer)
+	}
+	if _, exists := brokerB.peers.Get("broker-a"); !exists {
+		t.Error("Expected broker-b to record broker-a from the registration response")
+	}
+
+	// Registrations must be signed with the key they register
+	_, otherKey, _ := protocol.GenerateKeyPair()
+	pubKey, _, _ := protocol.GenerateKeyPair()
+	env := protocol.NewEnvelope(protocol.EnvelopeRegisterBroker, "broker-c")
+	env.Body, _ = json.Marshal(protocol.RegisterBrokerBody{
+		BrokerID: "broker-c",
+		Endpoint: "https://broker-c",
+		PubKey:   protocol.EncodePublicKey(pubKey),
+	})
+	env.Sign(otherKey)
+
+	generic := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: env.Type, CommonHeaders: env.CommonHeaders}, Body: env.Body}
+	recorder := newBufferedResponse()
+	brokerA.handleRegisterBroker(recorder, generic)
+	if recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a forged registration, got %d: %s", recorder.status, recorder.body.String())
+	}
+}
+
+func TestBrokerFederationForwardsToolCalls(t *testing.T) {
+	_, serverA, brokerB, _ := federatedPair(t)
+
+	calls := make(chan string, 1)
+	agentServer := fakeMCPServer(t, calls)
+	brokerB.mcpRegistry.RegisterAgent("weather-agent", &MCPAgent{
+		ID:            "weather-agent",
+		MCPEndpoint:   agentServer.URL,
+		Tools:         []protocol.MCPTool{{Name: "weather.read"}},
+		LastHeartbeat: time.Now(),
+	})
+
+	// A caller on broker-a reaches an agent registered only on broker-b
+	_, privKey, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "caller-agent",
+		BrokerURL:   serverA.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+	result, err := client.CallTool("weather-agent", "weather.read", nil)
+	if err != nil {
+		t.Fatalf("Federated tool call failed: %v", err)
+	}
+	if result.(map[string]interface{})["celsius"] != 19.5 {
+		t.Errorf("Unexpected result: %v", result)
+	}
+	if name := <-calls; name != "weather.read" {
+		t.Errorf("Expected agent to receive weather.read, got %s", name)
+	}
+
+	// Tools nobody offers fail without looping between the peers
+	if _, err := client.CallTool("", "nothing.here", nil); err == nil {
+		t.Error("Expected call for an unknown tool to fail")
+	}
+}
+
+func TestBrokerFederationForwardsEvents(t *testing.T) {
+	brokerA, serverA, brokerB, _ := federatedPair(t)
+
+	received := make(chan string, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env protocol.GenericEnvelope
+		if err := json.NewDecoder(r.Body).Decode(&env); err == nil {
+			received <- env.Agent
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer subscriber.Close()
+	brokerB.subscriptions.Subscribe("listener-agent", subscriber.URL, []string{"build.*"})
+
+	_, privKey, _ := protocol.GenerateKeyPair()
+	env := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "builder-agent")
+	env.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "build.finished"})
+	env.Sign(privKey)
+	data, _ := json.Marshal(env)
+
+	resp, err := brokerA.peers.httpClient.Post(serverA.URL, protocol.ContentTypeJSON, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to emit event: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	select {
+	case sender := <-received:
+		if sender != "builder-agent" {
+			t.Errorf("Expected event to keep its original sender, got %s", sender)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected event to reach a subscriber on the peer broker")
+	}
+
+	// Envelopes that have used up their hops are not forwarded again
+	generic := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeEmitEvent},
+		Hops:         maxFederationHops,
+	}
+	if forwarded := brokerA.forwardEvent(generic, "build.finished"); forwarded != 0 {
+		t.Errorf("Expected no forwarding at the hop limit, got %d peers", forwarded)
+	}
+}
+
+func TestBrokerFederatedDiscovery(t *testing.T) {
+	brokerA, serverA, brokerB, _ := federatedPair(t)
+
+	register := func(broker *Broker, agentID, tool string) {
+		broker.mcpRegistry.RegisterAgent(agentID, &MCPAgent{
+			ID:            agentID,
+			MCPEndpoint:   "https://" + agentID + "/mcp",
+			Tools:         []protocol.MCPTool{{Name: tool}},
+			LastHeartbeat: time.Now(),
+		})
+	}
+	register(brokerA, "local-agent", "file.read")
+	register(brokerB, "remote-agent", "file.write")
+	// Shared by both brokers: listed once, from the local broker
+	register(brokerA, "shared-agent", "file.stat")
+	register(brokerB, "shared-agent", "file.stat")
+
+	_, privKey, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "caller-agent",
+		BrokerURL:   serverA.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+
+	tools, err := client.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"file.*"}})
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	if len(tools) != 2 {
+		t.Errorf("Expected 2 local results without federation, got %d", len(tools))
+	}
+
+	tools, err = client.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"file.*"}, Federated: true})
+	if err != nil {
+		t.Fatalf("Federated discovery failed: %v", err)
+	}
+
+	brokers := make(map[string]string)
+	for _, tool := range tools {
+		if _, duplicate := brokers[tool.AgentID]; duplicate {
+			t.Errorf("Agent %s listed more than once", tool.AgentID)
+		}
+		brokers[tool.AgentID] = tool.Broker
+	}
+	expected := map[string]string{"local-agent": "broker-a", "shared-agent": "broker-a", "remote-agent": "broker-b"}
+	for agentID, broker := range expected {
+		if brokers[agentID] != broker {
+			t.Errorf("Expected %s behind %s, got %q", agentID, broker, brokers[agentID])
+		}
+	}
+	if len(brokers) != len(expected) {
+		t.Errorf("Expected %d federated results, got %v", len(expected), brokers)
+	}
+}
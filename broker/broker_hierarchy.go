@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultCatalogInterval is how often a child broker sends its parent the
+// catalog of tools below it
+const defaultCatalogInterval = 30 * time.Second
+
+// childCatalogTTL is how long a parent routes by a child's catalog without
+// hearing from it again
+const childCatalogTTL = 5 * time.Minute
+
+// Roles of a peer broker within a broker hierarchy; mesh peers have none
+const (
+	peerRoleParent = "parent"
+	peerRoleChild  = protocol.BrokerRoleChild
+)
+
+// BrokerHierarchy holds the tool catalogs child brokers publish, so a
+// parent can route calls down to the child with an agent offering the tool
+// without knowing the agents themselves
+type BrokerHierarchy struct {
+	catalogs map[string]childCatalog // By child broker ID
+	now      func() time.Time
+	mu       sync.RWMutex
+}
+
+// childCatalog is the latest catalog of one child broker
+type childCatalog struct {
+	tools    map[string]protocol.CatalogTool // By tool name
+	received time.Time
+}
+
+// NewBrokerHierarchy creates a hierarchy with no children
+func NewBrokerHierarchy() *BrokerHierarchy {
+	return &BrokerHierarchy{
+		catalogs: make(map[string]childCatalog),
+		now:      time.Now,
+	}
+}
+
+// SetCatalog replaces the catalog of a child broker
+func (h *BrokerHierarchy) SetCatalog(child string, tools []protocol.CatalogTool) {
+	catalog := childCatalog{tools: make(map[string]protocol.CatalogTool, len(tools)), received: h.now()}
+	for _, tool := range tools {
+		if tool.Name != "" {
+			catalog.tools[tool.Name] = tool
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.catalogs[child] = catalog
+}
+
+// Forget drops the catalog of a child broker
+func (h *BrokerHierarchy) Forget(child string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.catalogs, child)
+}
+
+// Children returns the children whose current catalog lists a tool, those
+// with the most agents offering it first, then in ID order
+func (h *BrokerHierarchy) Children(tool string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	cutoff := h.now().Add(-childCatalogTTL)
+	var children []string
+	for child, catalog := range h.catalogs {
+		if _, listed := catalog.tools[tool]; listed && catalog.received.After(cutoff) {
+			children = append(children, child)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := h.catalogs[children[i]].tools[tool].Providers, h.catalogs[children[j]].tools[tool].Providers
+		if a != b {
+			return a > b
+		}
+		return children[i] < children[j]
+	})
+	return children
+}
+
+// ToolCount returns how many tools a child's current catalog lists
+func (h *BrokerHierarchy) ToolCount(child string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	catalog, exists := h.catalogs[child]
+	if !exists || !catalog.received.After(h.now().Add(-childCatalogTTL)) {
+		return 0
+	}
+	return len(catalog.tools)
+}
+
+// Catalog returns the tools of every current child catalog, with the
+// providers of a tool listed by several children added together
+func (h *BrokerHierarchy) Catalog() []protocol.CatalogTool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	cutoff := h.now().Add(-childCatalogTTL)
+	var tools []protocol.CatalogTool
+	for _, catalog := range h.catalogs {
+		if !catalog.received.After(cutoff) {
+			continue
+		}
+		for _, tool := range catalog.tools {
+			tools = append(tools, tool)
+		}
+	}
+	return mergeCatalogTools(tools)
+}
+
+// mergeCatalogTools combines the entries for each tool name, adding up
+// their providers and keeping the first description and schema given. The
+// result is ordered by name.
+func mergeCatalogTools(tools []protocol.CatalogTool) []protocol.CatalogTool {
+	merged := make(map[string]*protocol.CatalogTool)
+	for _, tool := range tools {
+		existing, exists := merged[tool.Name]
+		if !exists {
+			tool := tool
+			merged[tool.Name] = &tool
+			continue
+		}
+		existing.Providers += tool.Providers
+		if existing.Description == "" {
+			existing.Description = tool.Description
+		}
+		if existing.InputSchema == nil {
+			existing.InputSchema = tool.InputSchema
+		}
+	}
+
+	catalog := make([]protocol.CatalogTool, 0, len(merged))
+	for _, tool := range merged {
+		catalog = append(catalog, *tool)
+	}
+	sort.Slice(catalog, func(i, j int) bool { return catalog[i].Name < catalog[j].Name })
+	return catalog
+}
+
+// SetParent sets the URL of the broker this broker is a child of, or ""
+// for none
+func (b *Broker) SetParent(endpoint string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.parent = endpoint
+}
+
+// JoinParent registers this broker as a child of the broker at endpoint and
+// sends it the catalog of local tools
+func (b *Broker) JoinParent(endpoint string) error {
+	if err := b.joinBroker(endpoint, peerRoleChild); err != nil {
+		return err
+	}
+	b.publishCatalog()
+	return nil
+}
+
+// catalog summarizes the tools reachable through this broker: those of its
+// own agents and those its children list
+func (b *Broker) catalog() []protocol.CatalogTool {
+	listings, err := b.mcpRegistry.DiscoverTools(protocol.ToolQuery{})
+	if err != nil {
+		slog.Error("Failed to list agents for the catalog", "error", err)
+	}
+
+	tools := b.hierarchy.Catalog()
+	for _, listing := range listings {
+		for _, tool := range listing.MCPTools {
+			tools = append(tools, protocol.CatalogTool{
+				Name:        tool.Name,
+				Description: tool.Description,
+				InputSchema: tool.InputSchema,
+				Providers:   1,
+			})
+		}
+	}
+	return mergeCatalogTools(tools)
+}
+
+// PublishCatalog sends the catalog to the parent broker now and on each
+// interval until stop is closed, joining the parent again if it was never
+// reached or has forgotten this broker
+func (b *Broker) PublishCatalog(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		b.mu.RLock()
+		parent := b.parent
+		b.mu.RUnlock()
+		if parent != "" && !b.publishCatalog() {
+			if err := b.JoinParent(parent); err != nil {
+				slog.Warn("Failed to join parent broker", "parent", parent, "error", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// publishCatalog sends the catalog to each parent broker, reporting whether
+// any accepted it
+func (b *Broker) publishCatalog() bool {
+	tools := b.catalog()
+	accepted := false
+	for _, peer := range b.peers.List() {
+		if peer.Role != peerRoleParent {
+			continue
+		}
+		if err := b.sendCatalog(peer, tools); err != nil {
+			slog.Warn("Failed to publish catalog", "broker", peer.ID, "error", err)
+			continue
+		}
+		accepted = true
+	}
+	return accepted
+}
+
+// sendCatalog sends a parent a catalogSummary signed by this broker
+func (b *Broker) sendCatalog(parent *FederatedBroker, tools []protocol.CatalogTool) error {
+	summary := protocol.NewCatalogSummary(b.id, tools)
+	if err := summary.Sign(b.privateKey); err != nil {
+		return fmt.Errorf("failed to sign catalog: %w", err)
+	}
+	generic := &protocol.GenericEnvelope{BaseEnvelope: summary.BaseEnvelope}
+	generic.Body, _ = json.Marshal(summary.Body)
+
+	status, _, err := b.peers.forward(parent, generic)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("parent answered with status %d", status)
+	}
+	return nil
+}
+
+// handleCatalogSummary stores the catalog a child broker sent, so calls for
+// its tools are routed down to it
+func (b *Broker) handleCatalogSummary(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.CatalogSummaryBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	peer, exists := b.peers.Get(env.Agent)
+	if !exists || peer.Role != peerRoleChild {
+		http.Error(w, fmt.Sprintf("Broker %s is not a child of this broker", env.Agent), http.StatusNotFound)
+		return
+	}
+	pubKey, err := protocol.DecodePublicKey(peer.PublicKey)
+	if err == nil {
+		err = env.Verify(pubKey)
+	}
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+
+	b.hierarchy.SetCatalog(env.Agent, body.Tools)
+	slog.Debug("Child broker catalog", "broker", env.Agent, "tools", len(body.Tools))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "accepted",
+		"tools":  len(body.Tools),
+	})
+}
+
+// toolCallRoute orders the peers a toolCall for tool, a bare name or an
+// agent/tool reference, is forwarded to: the children whose catalog lists
+// the tool, then the parent and mesh peers. Children that do not list it
+// are left out.
+func (b *Broker) toolCallRoute(tool string) []*FederatedBroker {
+	if _, name, isReference := strings.Cut(tool, "/"); isReference {
+		tool = name
+	}
+
+	var route []*FederatedBroker
+	for _, id := range b.hierarchy.Children(tool) {
+		if peer, exists := b.peers.Get(id); exists && peer.Role == peerRoleChild {
+			route = append(route, peer)
+		}
+	}
+	for _, peer := range b.peers.List() {
+		if peer.Role != peerRoleChild {
+			route = append(route, peer)
+		}
+	}
+	return route
+}
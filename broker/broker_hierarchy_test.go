@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// hierarchyBroker starts a broker serving over TLS
+func hierarchyBroker(t *testing.T, id string) (*Broker, *httptest.Server) {
+	t.Helper()
+	broker := NewBroker()
+	broker.SetBrokerID(id)
+	server := httptest.NewTLSServer(broker)
+	t.Cleanup(server.Close)
+	broker.SetFederationEndpoint(server.URL)
+	return broker, server
+}
+
+func TestBrokerHierarchyRoutesDown(t *testing.T) {
+	parent, parentServer := hierarchyBroker(t, "region")
+	edgeA, _ := hierarchyBroker(t, "edge-a")
+	edgeB, _ := hierarchyBroker(t, "edge-b")
+
+	calls := make(chan string, 1)
+	agentServer := fakeMCPServer(t, calls)
+	edgeA.mcpRegistry.RegisterAgent("weather-agent", &MCPAgent{
+		ID:            "weather-agent",
+		MCPEndpoint:   agentServer.URL,
+		Tools:         []protocol.MCPTool{{Name: "weather.read", Description: "Current weather"}},
+		LastHeartbeat: time.Now(),
+	})
+	edgeB.mcpRegistry.RegisterAgent("camera-agent", &MCPAgent{
+		ID:            "camera-agent",
+		MCPEndpoint:   "https://camera-agent/mcp",
+		Tools:         []protocol.MCPTool{{Name: "camera.capture"}},
+		LastHeartbeat: time.Now(),
+	})
+
+	for _, child := range []*Broker{edgeA, edgeB} {
+		if err := child.JoinParent(parentServer.URL); err != nil {
+			t.Fatalf("Failed to join parent: %v", err)
+		}
+	}
+	if peer, _ := parent.peers.Get("edge-a"); peer == nil || peer.Role != peerRoleChild {
+		t.Errorf("Expected the parent to record edge-a as a child, got %+v", peer)
+	}
+	if peer, _ := edgeA.peers.Get("region"); peer == nil || peer.Role != peerRoleParent {
+		t.Errorf("Expected edge-a to record region as its parent, got %+v", peer)
+	}
+
+	// Calls are routed only to the children listing the tool
+	for _, tool := range []string{"weather.read", "weather-agent/weather.read"} {
+		route := parent.toolCallRoute(tool)
+		if len(route) != 1 || route[0].ID != "edge-a" {
+			t.Errorf("Expected %s to be routed to edge-a only, got %d peers", tool, len(route))
+		}
+	}
+	catalog := parent.catalog()
+	if len(catalog) != 2 || catalog[0].Name != "camera.capture" || catalog[1].Description != "Current weather" {
+		t.Errorf("Expected the parent's catalog to aggregate both children, got %+v", catalog)
+	}
+
+	_, privKey, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "caller-agent",
+		BrokerURL:   parentServer.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+	result, err := client.CallTool("weather-agent", "weather.read", nil)
+	if err != nil {
+		t.Fatalf("Tool call through the parent failed: %v", err)
+	}
+	if result.(map[string]interface{})["celsius"] != 19.5 {
+		t.Errorf("Unexpected result: %v", result)
+	}
+	if name := <-calls; name != "weather.read" {
+		t.Errorf("Expected the edge agent to receive weather.read, got %s", name)
+	}
+	if _, err := client.CallTool("", "nothing.here", nil); err == nil {
+		t.Error("Expected a call for a tool no child lists to fail")
+	}
+}
+
+func TestBrokerHierarchyCatalogSummary(t *testing.T) {
+	parent, parentServer := hierarchyBroker(t, "region")
+	mesh, _ := hierarchyBroker(t, "mesh-peer")
+	if err := mesh.JoinFederation(parentServer.URL); err != nil {
+		t.Fatalf("Failed to federate: %v", err)
+	}
+
+	// Only children may publish a catalog
+	summary := protocol.NewCatalogSummary("mesh-peer", []protocol.CatalogTool{{Name: "file.read", Providers: 1}})
+	summary.Sign(mesh.privateKey)
+	generic := &protocol.GenericEnvelope{BaseEnvelope: summary.BaseEnvelope}
+	generic.Body, _ = json.Marshal(summary.Body)
+	recorder := newBufferedResponse()
+	parent.handleCatalogSummary(recorder, generic)
+	if recorder.status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a catalog from a mesh peer, got %d", recorder.status)
+	}
+	if mesh.publishCatalog() {
+		t.Error("Expected a broker without a parent to publish nowhere")
+	}
+}
+
+func TestBrokerHierarchyCatalogs(t *testing.T) {
+	hierarchy := NewBrokerHierarchy()
+	now := time.Now()
+	hierarchy.now = func() time.Time { return now }
+
+	hierarchy.SetCatalog("edge-a", []protocol.CatalogTool{{Name: "weather.read", Providers: 1}})
+	hierarchy.SetCatalog("edge-b", []protocol.CatalogTool{
+		{Name: "weather.read", Description: "Current weather", Providers: 3},
+		{Name: "camera.capture", Providers: 1},
+	})
+
+	if children := hierarchy.Children("weather.read"); len(children) != 2 || children[0] != "edge-b" {
+		t.Errorf("Expected the child with the most providers first, got %v", children)
+	}
+	catalog := hierarchy.Catalog()
+	if len(catalog) != 2 || catalog[1].Name != "weather.read" || catalog[1].Providers != 4 || catalog[1].Description != "Current weather" {
+		t.Errorf("Expected providers of a shared tool to be added up, got %+v", catalog)
+	}
+
+	// A child that stops publishing is no longer routed to
+	now = now.Add(childCatalogTTL / 2)
+	hierarchy.SetCatalog("edge-b", []protocol.CatalogTool{{Name: "camera.capture", Providers: 1}})
+	now = now.Add(childCatalogTTL/2 + time.Second)
+	if children := hierarchy.Children("weather.read"); len(children) != 0 {
+		t.Errorf("Expected no route to a tool only a stale catalog lists, got %v", children)
+	}
+	if count := hierarchy.ToolCount("edge-b"); count != 1 {
+		t.Errorf("Expected edge-b to list 1 tool, got %d", count)
+	}
+
+	hierarchy.Forget("edge-b")
+	if catalog := hierarchy.Catalog(); len(catalog) != 0 {
+		t.Errorf("Expected no tools after forgetting the children, got %+v", catalog)
+	}
+}
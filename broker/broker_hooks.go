@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+)
+
+// BrokerHooks are callbacks for Go programs embedding the broker, so they
+// can react to registry and federation activity without polling the admin
+// API. Each hook runs after the change takes effect, outside the broker's
+// locks, on the goroutine handling the envelope; hooks must return quickly
+// and hand longer work to a goroutine of their own. Nil hooks are skipped.
+type BrokerHooks struct {
+	OnAgentRegistered func(AgentRegisteredEvent)
+	OnToolCallRouted  func(ToolCallRoutedEvent)
+	OnRevocation      func(RevocationEvent)
+	OnPeerJoined      func(PeerJoinedEvent)
+}
+
+// AgentRegisteredEvent describes an agent whose registration became active,
+// including one registering again
+type AgentRegisteredEvent struct {
+	AgentID         string
+	Capabilities    []string
+	Tools           []string // Tools declared at registration; probed tools are indexed later
+	MCPEndpoint     string
+	EnvironmentType string
+	RegisteredAt    time.Time
+}
+
+// ToolCallRoutedEvent describes where a tool call was sent. A call served
+// by a local agent names its provider; one relayed to a peer broker names
+// the peer instead.
+type ToolCallRoutedEvent struct {
+	RequestID string
+	Caller    string
+	Tool      string
+	Provider  string // Agent offering the tool
+	Via       string // Agent the call was delivered to, when a discovery proxy relays it
+	Peer      string // Broker that served the call, for calls forwarded through federation
+}
+
+// RevocationEvent describes a revocation. Revoking a whole agent leaves
+// Capabilities and Tools empty.
+type RevocationEvent struct {
+	Target       string
+	Reason       string
+	Capabilities []string
+	Tools        []string
+}
+
+// PeerJoinedEvent describes a broker newly added to the peer table, by
+// its registering with this broker or this broker joining it
+type PeerJoinedEvent struct {
+	BrokerID     string
+	Endpoint     string
+	Role         string // "child" or "parent" in a broker hierarchy, empty for a mesh peer
+	Federation   string
+	Capabilities []string
+}
+
+// SetHooks sets the callbacks run on registry and federation activity,
+// replacing any set before
+func (b *Broker) SetHooks(hooks BrokerHooks) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = hooks
+}
+
+// currentHooks returns the hooks set, for handlers not holding b.mu
+func (b *Broker) currentHooks() BrokerHooks {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.hooks
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestBrokerHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []interface{}
+	record := func(event interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	recorded := func() []interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		seen := events
+		events = nil
+		return seen
+	}
+	hooks := BrokerHooks{
+		OnAgentRegistered: func(event AgentRegisteredEvent) { record(event) },
+		OnToolCallRouted:  func(event ToolCallRoutedEvent) { record(event) },
+		OnRevocation:      func(event RevocationEvent) { record(event) },
+		OnPeerJoined:      func(event PeerJoinedEvent) { record(event) },
+	}
+
+	start := func(id string) (*Broker, *httptest.Server) {
+		broker := NewBroker()
+		broker.SetBrokerID(id)
+		broker.SetHooks(hooks)
+		server := httptest.NewTLSServer(broker)
+		t.Cleanup(server.Close)
+		broker.SetFederationEndpoint(server.URL)
+		return broker, server
+	}
+	brokerA, serverA := start("broker-a")
+	brokerB, _ := start("broker-b")
+
+	// Each side of a new peering runs its hook once
+	for i := 0; i < 2; i++ {
+		if err := brokerB.JoinFederation(serverA.URL); err != nil {
+			t.Fatalf("Failed to federate: %v", err)
+		}
+	}
+	joined := map[string]bool{}
+	for _, event := range recorded() {
+		joined[event.(PeerJoinedEvent).BrokerID] = true
+	}
+	if len(joined) != 2 || !joined["broker-a"] || !joined["broker-b"] {
+		t.Errorf("Expected each broker to see the other join once, got %v", joined)
+	}
+
+	calls := make(chan string, 2)
+	agentServer := fakeMCPServer(t, calls)
+	_, key, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{AgentID: "weather-agent", BrokerURL: serverA.URL, PrivateKey: key, TLSInsecure: true})
+	err := client.Register(protocol.RegisterAgentBody{
+		PubKey:         protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Capabilities:   []string{"weather.read"},
+		MCPEndpoint:    agentServer.URL,
+		BodyDefinition: &protocol.BodyDefinition{Name: "weather", MCPTools: []protocol.MCPTool{{Name: "weather.read"}}},
+	})
+	if err != nil {
+		t.Fatalf("Registration failed: %v", err)
+	}
+	if seen := recorded(); len(seen) != 1 || seen[0].(AgentRegisteredEvent).AgentID != "weather-agent" || seen[0].(AgentRegisteredEvent).Tools[0] != "weather.read" {
+		t.Errorf("Expected the registration reported, got %+v", seen)
+	}
+
+	// A call served locally names its provider; one served by a peer, the
+	// peer. Both brokers run the same hooks here.
+	brokerB.mcpRegistry.RegisterAgent("tide-agent", &MCPAgent{
+		ID:            "tide-agent",
+		MCPEndpoint:   agentServer.URL,
+		Tools:         []protocol.MCPTool{{Name: "tide.read"}},
+		LastHeartbeat: time.Now(),
+	})
+	caller := NewMCPClient(MCPClientConfig{AgentID: "caller-agent", BrokerURL: serverA.URL, PrivateKey: key, TLSInsecure: true})
+	for agent, tool := range map[string]string{"weather-agent": "weather.read", "tide-agent": "tide.read"} {
+		if _, err := caller.CallTool(agent, tool, nil); err != nil {
+			t.Fatalf("Calling %s failed: %v", tool, err)
+		}
+		<-calls
+	}
+	routes := map[string]ToolCallRoutedEvent{}
+	for _, event := range recorded() {
+		route := event.(ToolCallRoutedEvent)
+		routes[route.Provider+route.Peer] = route
+	}
+	if route := routes["weather-agent"]; route.Tool != "weather.read" || route.Caller != "caller-agent" {
+		t.Errorf("Expected the local call routed to weather-agent, got %+v", routes)
+	}
+	if route := routes["broker-b"]; route.Tool != "tide-agent/tide.read" {
+		t.Errorf("Expected the forwarded call routed to broker-b, got %+v", routes)
+	}
+
+	revoke := newRevoker(t, brokerA)
+	revoke(protocol.RevokeBody{Target: "weather-agent", Capability: "weather.read", Reason: "audit"})
+	revoke(protocol.RevokeBody{Target: "weather-agent", Reason: "retired"})
+	seen := recorded()
+	if len(seen) != 2 || len(seen[0].(RevocationEvent).Capabilities) != 1 || seen[1].(RevocationEvent).Reason != "retired" {
+		t.Errorf("Expected both revocations reported, got %+v", seen)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fep-fem/protocol"
+)
+
+// LoadIdentityKey reads the broker's Ed25519 identity key, stored base64
+// encoded in path. A missing file is created with a new key, so the broker
+// keeps the identity agents pin across restarts. An empty path generates
+// a key that lasts until the broker exits.
+func LoadIdentityKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		_, key, err := protocol.GenerateKeyPair()
+		return key, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := protocol.GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(protocol.EncodePrivateKey(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to save identity key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := protocol.DecodePrivateKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// SetIdentity replaces the key the broker signs envelopes with. If
+// previous is given, the broker publishes a transition from it, signed
+// with it, so agents pinning the old key follow the rotation.
+func (b *Broker) SetIdentity(key, previous ed25519.PrivateKey) error {
+	var transitions []protocol.KeyTransition
+	if previous != nil && !previous.Equal(key) {
+		transition, err := protocol.NewKeyTransition(b.id, previous, key.Public().(ed25519.PublicKey))
+		if err != nil {
+			return err
+		}
+		transitions = append(transitions, *transition)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.privateKey = key
+	b.transitions = transitions
+	return nil
+}
+
+// identityKeys returns the broker's public key and the keys it rotated from
+func (b *Broker) identityKeys() []ed25519.PublicKey {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	keys := []ed25519.PublicKey{b.privateKey.Public().(ed25519.PublicKey)}
+	for _, transition := range b.transitions {
+		if key, err := protocol.DecodePublicKey(transition.From); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Identity describes the key and certificate agents pin this broker by
+func (b *Broker) Identity() *protocol.BrokerIdentity {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	identity := &protocol.BrokerIdentity{
+		Broker:      b.id,
+		PubKey:      protocol.EncodePublicKey(b.privateKey.Public().(ed25519.PublicKey)),
+		Transitions: b.transitions,
+	}
+	if cert := b.certificate.Load(); cert != nil && len(cert.Certificate) > 0 {
+		identity.CertFingerprint = protocol.CertFingerprint(cert.Certificate[0])
+	}
+	return identity
+}
+
+// handleIdentity serves GET /identity
+func (b *Broker) handleIdentity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.Identity())
+}
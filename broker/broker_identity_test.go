@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestLoadIdentityKeyPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	created, err := LoadIdentityKey(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity key: %v", err)
+	}
+	loaded, err := LoadIdentityKey(path)
+	if err != nil {
+		t.Fatalf("Failed to load identity key: %v", err)
+	}
+	if !created.Equal(loaded) {
+		t.Error("Expected the saved identity key to be loaded again")
+	}
+}
+
+func TestIdentityRotationFollowedByPins(t *testing.T) {
+	_, oldKey, _ := protocol.GenerateKeyPair()
+	_, newKey, _ := protocol.GenerateKeyPair()
+
+	broker := NewBroker()
+	broker.SetBrokerID("broker-a")
+	if err := broker.SetIdentity(newKey, oldKey); err != nil {
+		t.Fatalf("Failed to set identity: %v", err)
+	}
+	broker.SetCertificate(doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)))
+
+	server := httptest.NewServer(broker)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/identity")
+	if err != nil {
+		t.Fatalf("Identity request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var identity protocol.BrokerIdentity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		t.Fatalf("Failed to decode identity: %v", err)
+	}
+	if identity.CertFingerprint == "" || len(identity.Transitions) != 1 {
+		t.Fatalf("Unexpected identity %+v", identity)
+	}
+
+	// An agent that pinned the old key follows the transition to the new one
+	pins, _ := protocol.NewBrokerPins(protocol.PinConfig{PublicKeys: []string{protocol.EncodePublicKey(oldKey.Public().(ed25519.PublicKey))}})
+	if err := pins.Update(&identity); err != nil {
+		t.Fatalf("Expected the rotation to be accepted, got %v", err)
+	}
+
+	recorder := newBufferedResponse()
+	broker.writeToolResult(recorder, protocol.ToolResultBody{RequestID: "req-1", Success: true})
+	env, err := protocol.ParseEnvelope(recorder.body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse tool result: %v", err)
+	}
+	if err := pins.VerifyEnvelope(env); err != nil {
+		t.Errorf("Expected the broker's responses to verify against the rotated pin, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -392,6 +393,49 @@ func TestBrokerBackwardsCompatibility(t *testing.T) {
 	})
 }
 
+func TestEmbodimentUpdateRequiresAgentKey(t *testing.T) {
+	broker := NewBroker()
+	pubKey, privKey, _ := protocol.GenerateKeyPair()
+	broker.agents["math-agent"] = &Agent{ID: "math-agent", PubKey: pubKey}
+	broker.mcpRegistry.RegisterAgent("math-agent", &MCPAgent{
+		ID:            "math-agent",
+		MCPEndpoint:   "https://math-agent.internal/mcp",
+		Tools:         []protocol.MCPTool{{Name: "math.add"}},
+		LastHeartbeat: time.Now(),
+	})
+
+	update := func(signer ed25519.PrivateKey) int {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeEmbodimentUpdate}}
+		env.Agent = "math-agent"
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.EmbodimentUpdateBody{
+			EnvironmentType: "production",
+			BodyDefinition:  protocol.BodyDefinition{MCPTools: []protocol.MCPTool{{Name: "math.add"}}},
+			MCPEndpoint:     "https://attacker.example/mcp",
+		})
+		if signer != nil {
+			protocol.SignEnvelope(env, signer)
+		}
+		recorder := newBufferedResponse()
+		broker.handleEmbodimentUpdate(recorder, env)
+		return recorder.status
+	}
+
+	_, otherKey, _ := protocol.GenerateKeyPair()
+	for name, signer := range map[string]ed25519.PrivateKey{"unsigned": nil, "another key": otherKey} {
+		if status := update(signer); status != http.StatusUnauthorized {
+			t.Errorf("%s: expected the update to be refused, got %d", name, status)
+		}
+	}
+	if agent, _ := broker.mcpRegistry.GetAgent("math-agent"); agent.MCPEndpoint != "https://math-agent.internal/mcp" {
+		t.Fatalf("Expected a refused update to leave the endpoint alone, got %s", agent.MCPEndpoint)
+	}
+
+	if status := update(privKey); status != http.StatusOK {
+		t.Errorf("Expected the agent's own update to be applied, got %d", status)
+	}
+}
+
 func TestBrokerErrorHandling(t *testing.T) {
 	broker := NewBroker()
 	server := httptest.NewTLSServer(broker)
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// builtinTool is a tool the broker runs itself, so orchestrators can look
+// into the federation with the same toolCall they use for agent tools
+type builtinTool struct {
+	tool protocol.MCPTool
+	run  func(b *Broker, caller string, parameters map[string]interface{}) (interface{}, error)
+}
+
+// builtinTools are the tools every broker offers, under its own ID
+var builtinTools = []builtinTool{
+	{
+		tool: protocol.MCPTool{
+			Name:        "echo",
+			Description: "Return the call's parameters unchanged",
+			InputSchema: map[string]interface{}{"type": "object"},
+			Idempotent:  true,
+		},
+		run: func(b *Broker, caller string, parameters map[string]interface{}) (interface{}, error) {
+			return parameters, nil
+		},
+	},
+	{
+		tool: protocol.MCPTool{
+			Name:        "time",
+			Description: "Return the broker's clock",
+			InputSchema: map[string]interface{}{"type": "object"},
+			Idempotent:  true,
+		},
+		run: func(b *Broker, caller string, parameters map[string]interface{}) (interface{}, error) {
+			now := time.Now()
+			return map[string]interface{}{"time": now.UTC().Format(time.RFC3339Nano), "unixMs": now.UnixMilli()}, nil
+		},
+	},
+	{
+		tool: protocol.MCPTool{
+			Name:        "registry.query",
+			Description: "Find the tools registered with the broker, as discoverTools does",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"capabilities":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+					"environmentType": map[string]interface{}{"type": "string"},
+					"maxResults":      map[string]interface{}{"type": "integer"},
+				},
+			},
+			Idempotent: true,
+		},
+		run: func(b *Broker, caller string, parameters map[string]interface{}) (interface{}, error) {
+			var query protocol.ToolQuery
+			data, _ := json.Marshal(parameters)
+			if err := json.Unmarshal(data, &query); err != nil {
+				return nil, fmt.Errorf("invalid query: %w", err)
+			}
+			tools, err := b.mcpRegistry.DiscoverToolsFor(query, caller)
+			if err != nil {
+				return nil, err
+			}
+			if tools == nil {
+				tools = []protocol.DiscoveredTool{}
+			}
+			tools = b.withReputation(b.withEncryptionKeys(tools))
+			return map[string]interface{}{"tools": tools, "totalResults": len(tools)}, nil
+		},
+	},
+	{
+		tool: protocol.MCPTool{
+			Name:        "federation.status",
+			Description: "Report the broker's federation and the peers it federates with",
+			InputSchema: map[string]interface{}{"type": "object"},
+			Idempotent:  true,
+		},
+		run: func(b *Broker, caller string, parameters map[string]interface{}) (interface{}, error) {
+			peers := b.peers.List()
+			listed := make([]map[string]interface{}, 0, len(peers))
+			for _, peer := range peers {
+				toolCount := peer.ToolCount
+				if peer.Role == peerRoleChild {
+					toolCount = b.hierarchy.ToolCount(peer.ID)
+				}
+				listed = append(listed, map[string]interface{}{
+					"id":        peer.ID,
+					"status":    peer.Status,
+					"role":      peer.Role,
+					"toolCount": toolCount,
+					"lastSeen":  peer.LastSeen.UnixMilli(),
+				})
+			}
+			federation, _ := b.trust.Membership()
+			return map[string]interface{}{
+				"broker":     b.id,
+				"federation": federation,
+				"agents":     b.mcpRegistry.GetAgentCount(),
+				"peers":      listed,
+			}, nil
+		},
+	},
+}
+
+// findBuiltinTool returns the built-in tool a reference names. The broker's
+// own tools are always reached as "brokerID/name"; a bare name reaches one
+// only when no agent offers a tool of that name, so agent tools win.
+func (b *Broker) findBuiltinTool(ref string, offered bool) (builtinTool, bool) {
+	name, targeted := strings.CutPrefix(ref, b.id+"/")
+	if !targeted && offered {
+		return builtinTool{}, false
+	}
+	for _, builtin := range builtinTools {
+		if builtin.tool.Name == name {
+			return builtin, true
+		}
+	}
+	return builtinTool{}, false
+}
+
+// callBuiltinTool runs a built-in tool and answers the call with its result.
+// The broker is the provider, so a receipt times the run itself.
+func (b *Broker) callBuiltinTool(w http.ResponseWriter, caller string, body protocol.ToolCallBody, builtin builtinTool, received time.Time) {
+	if body.RequestID == "" {
+		body.RequestID = protocol.NewNonce()
+	}
+	if hook := b.currentHooks().OnToolCallRouted; hook != nil {
+		hook(ToolCallRoutedEvent{RequestID: body.RequestID, Caller: caller, Tool: builtin.tool.Name, Provider: b.id})
+	}
+
+	// The broker holds no key to open sealed parameters
+	if body.Enc != nil {
+		b.writeToolResult(w, protocol.ToolResultBody{RequestID: body.RequestID, Error: fmt.Sprintf("Built-in tool %s takes no sealed parameters", builtin.tool.Name)})
+		return
+	}
+	started := time.Now()
+	output, err := builtin.run(b, caller, body.Parameters)
+	timing := &protocol.DeliveryReceipt{Accepted: started.UnixMilli(), Started: started.UnixMilli(), Finished: time.Now().UnixMilli()}
+	receipt := deliveryReceipt(body, received, started, timing)
+	if err != nil {
+		b.writeToolResult(w, protocol.ToolResultBody{RequestID: body.RequestID, Error: err.Error(), Receipt: receipt})
+		return
+	}
+	b.writeToolResult(w, protocol.ToolResultBody{RequestID: body.RequestID, Success: true, Result: output, Receipt: receipt})
+}
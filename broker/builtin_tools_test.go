@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestBuiltinTools(t *testing.T) {
+	broker := NewBroker()
+	broker.SetBrokerID("broker-a")
+	broker.mcpRegistry.RegisterAgent("weather-agent", &MCPAgent{
+		ID:            "weather-agent",
+		Tools:         []protocol.MCPTool{{Name: "weather.read"}, {Name: "echo"}},
+		LastHeartbeat: time.Now(),
+	})
+
+	call := func(tool string, parameters map[string]interface{}) (int, protocol.ToolResultBody) {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+		env.Agent = "orchestrator"
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: tool, Parameters: parameters, RequestID: "req-" + tool})
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+		var response protocol.ToolResultEnvelope
+		json.Unmarshal(recorder.body.Bytes(), &response)
+		return recorder.status, response.Body
+	}
+
+	status, result := call("broker-a/echo", map[string]interface{}{"text": "hello"})
+	if status != http.StatusOK || !result.Success || result.Result.(map[string]interface{})["text"] != "hello" {
+		t.Errorf("Expected the parameters echoed, got %d %+v", status, result)
+	}
+	if _, result := call("time", nil); !result.Success || result.Result.(map[string]interface{})["unixMs"] == nil {
+		t.Errorf("Expected the broker's time, got %+v", result)
+	}
+
+	_, result = call("registry.query", map[string]interface{}{"capabilities": []string{"weather.read"}})
+	tools, _ := result.Result.(map[string]interface{})["tools"].([]interface{})
+	if !result.Success || len(tools) != 1 || tools[0].(map[string]interface{})["agentId"] != "weather-agent" {
+		t.Errorf("Expected the weather agent found, got %+v", result)
+	}
+
+	_, result = call("federation.status", nil)
+	if status := result.Result.(map[string]interface{}); !result.Success || status["broker"] != "broker-a" || status["agents"] != float64(1) {
+		t.Errorf("Expected the federation status, got %+v", result)
+	}
+
+	// An agent's tool of the same name wins over the broker's
+	if status, result := call("echo", nil); status != http.StatusOK || result.Success {
+		t.Errorf("Expected the call routed to weather-agent, which has no endpoint, got %d %+v", status, result)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/fep-fem/protocol"
+)
+
+// capabilityVerbs maps words found in tool names to the verb of the
+// capability they exercise
+var capabilityVerbs = map[string]string{
+	"read": "read", "get": "read", "fetch": "read", "load": "read", "view": "read", "cat": "read", "show": "read", "open": "read",
+	"write": "write", "save": "write", "put": "write", "create": "write", "update": "write", "edit": "write", "append": "write", "set": "write", "delete": "write", "remove": "write", "rm": "write",
+	"run": "execute", "exec": "execute", "execute": "execute", "eval": "execute", "invoke": "execute",
+	"list": "list", "ls": "list",
+	"search": "search", "find": "search", "query": "search", "grep": "search", "lookup": "search",
+}
+
+// capabilityNouns maps words found in tool names and parameter names to
+// the resource a capability is scoped to
+var capabilityNouns = map[string]string{
+	"file": "file", "files": "file", "path": "file", "filename": "file", "dir": "file", "directory": "file",
+	"shell": "shell", "command": "shell", "cmd": "shell", "bash": "shell",
+	"code": "code", "script": "code", "python": "code", "javascript": "code",
+	"url": "web", "web": "web", "http": "web", "page": "web",
+}
+
+// InferCapabilities derives the capabilities an agent exercises from the
+// tools it offers. Dotted names such as "file.read" are capabilities
+// already; others are read as a verb and a resource, as in "read_file" or
+// "runCommand", falling back to the tool's parameter names for the
+// resource. Tools neither says anything about are skipped.
+func InferCapabilities(tools []protocol.MCPTool) []string {
+	seen := make(map[string]bool)
+	for _, tool := range tools {
+		if capability := inferCapability(tool); capability != "" {
+			seen[capability] = true
+		}
+	}
+	capabilities := make([]string, 0, len(seen))
+	for capability := range seen {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+// inferCapability reads one tool's capability, or "" if it cannot tell
+func inferCapability(tool protocol.MCPTool) string {
+	if strings.Contains(tool.Name, ".") {
+		return tool.Name
+	}
+
+	var verb, noun string
+	for _, word := range splitToolName(tool.Name) {
+		if v, ok := capabilityVerbs[word]; ok && verb == "" {
+			verb = v
+			continue
+		}
+		if noun == "" {
+			noun = word
+			if n, ok := capabilityNouns[word]; ok {
+				noun = n
+			}
+		}
+	}
+	if verb == "" {
+		return ""
+	}
+	if noun == "" {
+		noun = schemaNoun(tool.InputSchema)
+	}
+	if noun == "" {
+		return ""
+	}
+	return noun + "." + verb
+}
+
+// splitToolName breaks a tool name into lower-case words at underscores,
+// dashes, slashes, spaces and camel-case humps
+func splitToolName(name string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' || r == '-' || r == '/' || unicode.IsSpace(r):
+			flush()
+		case unicode.IsUpper(r) && i > 0 && len(word) > 0 && !unicode.IsUpper(word[len(word)-1]):
+			flush()
+			word = append(word, r)
+		default:
+			word = append(word, r)
+		}
+	}
+	flush()
+	return words
+}
+
+// schemaNoun names the resource a tool's parameters point at, such as
+// "file" for a tool taking a path, or "" if none does. Parameters are
+// checked in name order so the answer does not depend on map order.
+func schemaNoun(schema map[string]interface{}) string {
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, word := range splitToolName(name) {
+			if noun, ok := capabilityNouns[word]; ok {
+				return noun
+			}
+		}
+	}
+	return ""
+}
+
+// undeclaredCapabilities returns the inferred capabilities no declared
+// capability covers; declared ones may be patterns such as "file.*"
+func undeclaredCapabilities(declared, inferred []string) []string {
+	missing := []string{}
+	for _, capability := range inferred {
+		covered := false
+		for _, pattern := range declared {
+			if matchPattern(capability, pattern) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			missing = append(missing, capability)
+		}
+	}
+	return missing
+}
+
+// reconcileCapabilities compares an agent's declared capabilities with
+// those its tools imply. An agent that declared none takes the inferred
+// list; otherwise the ones it left out are returned as suggestions.
+func (b *Broker) reconcileCapabilities(agentID string, tools []protocol.MCPTool) []string {
+	inferred := InferCapabilities(tools)
+	if len(inferred) == 0 {
+		return []string{}
+	}
+
+	b.mu.Lock()
+	agent, exists := b.agents[agentID]
+	if !exists {
+		b.mu.Unlock()
+		return []string{}
+	}
+	// Capabilities revoked from the agent are not inferred back
+	if revoked := b.revocations[agentID]; revoked != nil {
+		kept := inferred[:0]
+		for _, capability := range inferred {
+			if !revoked.coversCapability(capability) {
+				kept = append(kept, capability)
+			}
+		}
+		inferred = kept
+	}
+	if len(agent.Capabilities) == 0 {
+		agent.Capabilities = inferred
+		b.mu.Unlock()
+		slog.Info("Filled in capabilities from the agent's tools", "agent", agentID, "capabilities", inferred)
+		return []string{}
+	}
+	suggested := undeclaredCapabilities(agent.Capabilities, inferred)
+	b.mu.Unlock()
+
+	if len(suggested) > 0 {
+		slog.Info("Agent's tools imply undeclared capabilities", "agent", agentID, "suggested", suggested)
+	}
+	return suggested
+}
+
+// probeMCPTools lists the tools of an agent that registered an MCP endpoint
+// without declaring any, indexing them and reconciling its capabilities
+func (b *Broker) probeMCPTools(agentID, endpoint string) {
+	tools, err := b.toolClient.ListTools(endpoint)
+	if err != nil {
+		slog.Debug("Could not list the agent's MCP tools", "agent", agentID, "endpoint", endpoint, "error", err)
+		return
+	}
+	if len(tools) == 0 || validateTools(tools) != nil {
+		return
+	}
+
+	mcpAgent, exists := b.mcpRegistry.GetAgent(agentID)
+	if !exists || len(mcpAgent.Tools) > 0 || mcpAgent.MCPEndpoint != endpoint {
+		return
+	}
+	probed := *mcpAgent
+	probed.Tools = tools
+	if err := b.mcpRegistry.RegisterAgent(agentID, &probed); err != nil {
+		slog.Error("Failed to index probed MCP tools", "agent", agentID, "error", err)
+		return
+	}
+	b.applyRevocation(agentID)
+	slog.Info("Indexed tools listed by the agent's MCP endpoint", "agent", agentID, "tools", len(tools))
+	b.announceTools(agentID)
+	b.recordSchemas(agentID, tools)
+	b.reconcileCapabilities(agentID, tools)
+	b.persistAgent(agentID)
+}
+
+// suggestedCapabilities returns the capabilities an agent's indexed tools
+// imply that it has not declared
+func (b *Broker) suggestedCapabilities(agentID string) []string {
+	mcpAgent, exists := b.mcpRegistry.GetAgent(agentID)
+	if !exists {
+		return []string{}
+	}
+	b.mu.RLock()
+	var declared []string
+	if agent, exists := b.agents[agentID]; exists {
+		declared = agent.Capabilities
+	}
+	b.mu.RUnlock()
+	return undeclaredCapabilities(declared, InferCapabilities(mcpAgent.Tools))
+}
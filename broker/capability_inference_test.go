@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestInferCapabilities(t *testing.T) {
+	tools := []protocol.MCPTool{
+		{Name: "file.read"},
+		{Name: "read_file"},
+		{Name: "runCommand"},
+		{Name: "execute-python"},
+		{Name: "fetch", InputSchema: map[string]interface{}{
+			"properties": map[string]interface{}{"url": map[string]interface{}{"type": "string"}},
+		}},
+		{Name: "search_issues"},
+		{Name: "frobnicate"},
+		{Name: "delete", InputSchema: map[string]interface{}{}},
+	}
+	expected := []string{"code.execute", "file.read", "issues.search", "shell.execute", "web.read"}
+	if inferred := InferCapabilities(tools); !reflect.DeepEqual(inferred, expected) {
+		t.Errorf("Expected %v, got %v", expected, inferred)
+	}
+
+	missing := undeclaredCapabilities([]string{"file.*", "shell.execute"}, expected)
+	if !reflect.DeepEqual(missing, []string{"code.execute", "issues.search", "web.read"}) {
+		t.Errorf("Unexpected undeclared capabilities %v", missing)
+	}
+}
+
+func TestRegisterAgentReconcilesCapabilities(t *testing.T) {
+	broker := NewBroker()
+	register := func(agent string, capabilities []string) map[string]interface{} {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+		env.Agent = agent
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+			Capabilities: capabilities,
+			BodyDefinition: &protocol.BodyDefinition{
+				Name:     agent,
+				MCPTools: []protocol.MCPTool{{Name: "read_file"}, {Name: "run_command"}},
+			},
+		})
+		recorder := newBufferedResponse()
+		broker.handleRegisterAgent(recorder, env)
+		var response map[string]interface{}
+		json.Unmarshal(recorder.body.Bytes(), &response)
+		return response
+	}
+
+	// Declaring nothing takes the inferred capabilities
+	register("quiet-agent", nil)
+	broker.mu.RLock()
+	filled := broker.agents["quiet-agent"].Capabilities
+	broker.mu.RUnlock()
+	if !reflect.DeepEqual(filled, []string{"file.read", "shell.execute"}) {
+		t.Errorf("Expected capabilities to be filled in, got %v", filled)
+	}
+
+	// Declared capabilities stand; the missing ones are suggested
+	response := register("partial-agent", []string{"file.*"})
+	if suggested, _ := response["suggestedCapabilities"].([]interface{}); len(suggested) != 1 || suggested[0] != "shell.execute" {
+		t.Errorf("Expected shell.execute to be suggested, got %v", response)
+	}
+	if suggested := broker.suggestedCapabilities("partial-agent"); !reflect.DeepEqual(suggested, []string{"shell.execute"}) {
+		t.Errorf("Expected the admin API to suggest shell.execute, got %v", suggested)
+	}
+}
+
+func TestProbeMCPTools(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		if request["method"] != "tools/list" {
+			http.Error(w, "unexpected method", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      request["id"],
+			"result": map[string]interface{}{
+				"tools": []protocol.MCPTool{{Name: "write_file", Description: "Write a file"}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	broker := NewBroker()
+	env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+	env.Agent = "mcp-agent"
+	env.Body, _ = json.Marshal(protocol.RegisterAgentBody{MCPEndpoint: server.URL})
+	broker.handleRegisterAgent(newBufferedResponse(), env)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(broker.mcpRegistry.AgentTools("mcp-agent")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the probed tools to be indexed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	broker.mu.RLock()
+	capabilities := broker.agents["mcp-agent"].Capabilities
+	broker.mu.RUnlock()
+	if !reflect.DeepEqual(capabilities, []string{"file.write"}) {
+		t.Errorf("Expected capabilities inferred from the probed tools, got %v", capabilities)
+	}
+}
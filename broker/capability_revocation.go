@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/fep-fem/protocol"
+)
+
+// Revocation is what has been revoked from an agent. It outlives the
+// agent's registration, so that registering again does not restore it.
+type Revocation struct {
+	AgentID      string   `json:"agentId"`
+	Capabilities []string `json:"capabilities,omitempty"` // Patterns, which also cover the tools they match
+	Tools        []string `json:"tools,omitempty"`
+}
+
+// coversCapability reports whether the revocation takes a capability, or
+// tool, away; a nil revocation takes nothing
+func (r *Revocation) coversCapability(name string) bool {
+	if r == nil {
+		return false
+	}
+	for _, revoked := range r.Capabilities {
+		if name == revoked || matchPattern(name, revoked) {
+			return true
+		}
+	}
+	return false
+}
+
+// coversTool reports whether the revocation takes a tool away, by name or
+// by a capability matching it
+func (r *Revocation) coversTool(name string) bool {
+	if r == nil {
+		return false
+	}
+	for _, revoked := range r.Tools {
+		if name == revoked {
+			return true
+		}
+	}
+	return r.coversCapability(name)
+}
+
+// authorizeRevoker checks that a revoke envelope comes from a verified
+// agent holding protocol.RevokeCapability, replying with an error if not
+func (b *Broker) authorizeRevoker(w http.ResponseWriter, env *protocol.GenericEnvelope) bool {
+	verified, err := b.verifyCaller(w, env)
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return false
+	}
+
+	var held []string
+	var revoked *Revocation
+	b.mu.RLock()
+	if agent, exists := b.agents[env.Agent]; verified && exists {
+		held = b.heldCapabilities(agent)
+		revoked = b.revocations[env.Agent]
+	}
+	b.mu.RUnlock()
+	if !holdsCapability(held, protocol.RevokeCapability) || revoked.coversCapability(protocol.RevokeCapability) {
+		slog.Warn("Revocation refused", "agent", env.Agent, "verified", verified)
+		b.replyError(w, env, http.StatusForbidden, protocol.ErrorForbidden,
+			fmt.Sprintf("Agent %s does not hold the %s capability", env.Agent, protocol.RevokeCapability))
+		return false
+	}
+	return true
+}
+
+// handleCapabilityRevoke revokes some capabilities or tools of an agent,
+// leaving the rest of its registration in place. A capability may end in a
+// wildcard, such as "file.*", and covers the tools whose names it matches.
+// The revocation is kept, and applied again whenever the agent registers.
+// The agent is sent a capability.revoked event, now if it is connected and
+// otherwise when it next connects.
+func (b *Broker) handleCapabilityRevoke(w http.ResponseWriter, body protocol.RevokeBody) {
+	revocation := &Revocation{AgentID: body.Target}
+	if body.Capability != "" {
+		revocation.Capabilities = []string{body.Capability}
+	}
+	if body.Tool != "" {
+		revocation.Tools = []string{body.Tool}
+	}
+
+	b.mu.RLock()
+	_, exists := b.agents[body.Target]
+	b.mu.RUnlock()
+	if !exists {
+		http.Error(w, fmt.Sprintf("Agent %s is not registered", body.Target), http.StatusNotFound)
+		return
+	}
+
+	capabilities, tools := b.revokeFromAgent(body.Target, revocation)
+	if len(capabilities) == 0 && len(tools) == 0 {
+		http.Error(w, fmt.Sprintf("Agent %s has no such capability or tool", body.Target), http.StatusNotFound)
+		return
+	}
+	b.recordRevocation(revocation)
+	b.persistAgent(body.Target)
+	slog.Info("Revoked capabilities", "target", body.Target, "capabilities", capabilities, "tools", tools, "reason", body.Reason)
+	b.notifyRevocation(body.Target, capabilities, tools, body.Reason)
+	if hook := b.currentHooks().OnRevocation; hook != nil {
+		hook(RevocationEvent{Target: body.Target, Reason: body.Reason, Capabilities: capabilities, Tools: tools})
+	}
+
+	response := map[string]interface{}{
+		"status":       "revoked",
+		"target":       body.Target,
+		"capabilities": capabilities,
+		"tools":        tools,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// revokeFromAgent takes what a revocation covers away from an agent's
+// registration and its indexed tools, returning what was taken
+func (b *Broker) revokeFromAgent(agentID string, revocation *Revocation) (capabilities, tools []string) {
+	b.mu.Lock()
+	if agent, exists := b.agents[agentID]; exists {
+		kept := make([]string, 0, len(agent.Capabilities))
+		for _, capability := range agent.Capabilities {
+			if revocation.coversCapability(capability) {
+				capabilities = append(capabilities, capability)
+			} else {
+				kept = append(kept, capability)
+			}
+		}
+		agent.Capabilities = kept
+	}
+	b.mu.Unlock()
+
+	tools = b.mcpRegistry.RevokeTools(agentID, revocation.coversTool, revocation.coversCapability)
+	return capabilities, tools
+}
+
+// applyRevocation takes what was revoked from an agent away from its new
+// registration, or from tools found after it registered
+func (b *Broker) applyRevocation(agentID string) {
+	b.mu.RLock()
+	revocation := b.revocations[agentID]
+	b.mu.RUnlock()
+	if revocation == nil {
+		return
+	}
+	if capabilities, tools := b.revokeFromAgent(agentID, revocation); len(capabilities) > 0 || len(tools) > 0 {
+		slog.Info("Kept capabilities revoked", "agent", agentID, "capabilities", capabilities, "tools", tools)
+	}
+}
+
+// recordRevocation adds to what was revoked from an agent and persists it
+func (b *Broker) recordRevocation(revocation *Revocation) {
+	b.mu.Lock()
+	merged := Revocation{AgentID: revocation.AgentID}
+	if existing := b.revocations[revocation.AgentID]; existing != nil {
+		merged = *existing
+	}
+	merged.Capabilities = appendMissing(merged.Capabilities, revocation.Capabilities...)
+	merged.Tools = appendMissing(merged.Tools, revocation.Tools...)
+	b.revocations[revocation.AgentID] = &merged
+	store := b.store
+	b.mu.Unlock()
+
+	if err := store.SaveRevocation(merged); err != nil {
+		slog.Error("Failed to persist revocation", "agent", revocation.AgentID, "error", err)
+	}
+}
+
+// appendMissing appends the values not already in list
+func appendMissing(list []string, values ...string) []string {
+	for _, value := range values {
+		if !containsString(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// LiftRevocation forgets what was revoked from an agent, reporting whether
+// anything was. The agent gets it back when it next registers.
+func (b *Broker) LiftRevocation(agentID string) (bool, error) {
+	b.mu.Lock()
+	_, exists := b.revocations[agentID]
+	delete(b.revocations, agentID)
+	store := b.store
+	b.mu.Unlock()
+	if !exists {
+		return false, nil
+	}
+	if err := store.DeleteRevocation(agentID); err != nil {
+		return true, err
+	}
+	// Brokers sharing the store reload the agent's revocations with it
+	b.persistAgent(agentID)
+	return true, nil
+}
+
+// Revocations returns what was revoked from each agent, ordered by agent
+func (b *Broker) Revocations() []Revocation {
+	b.mu.RLock()
+	revocations := make([]Revocation, 0, len(b.revocations))
+	for _, revocation := range b.revocations {
+		revocations = append(revocations, *revocation)
+	}
+	b.mu.RUnlock()
+	sort.Slice(revocations, func(i, j int) bool { return revocations[i].AgentID < revocations[j].AgentID })
+	return revocations
+}
+
+// handleAdminRevocations lists what was revoked from agents
+func (b *Broker) handleAdminRevocations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revocations": b.Revocations()})
+}
+
+// handleAdminLiftRevocation lifts the revocations of the agent named in
+// the path
+func (b *Broker) handleAdminLiftRevocation(w http.ResponseWriter, r *http.Request) {
+	agentID := strings.TrimPrefix(r.URL.Path, "/admin/revocations/")
+	lifted, err := b.LiftRevocation(agentID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to lift revocation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !lifted {
+		http.Error(w, fmt.Sprintf("Nothing was revoked from agent %s", agentID), http.StatusNotFound)
+		return
+	}
+	slog.Info("Lifted revocation", "agent", agentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "lifted", "agent": agentID})
+}
+
+// notifyRevocation sends an agent a capability.revoked event listing what
+// it lost
+func (b *Broker) notifyRevocation(agentID string, capabilities, tools []string, reason string) {
+	event := protocol.EmitEventBody{
+		Event: protocol.EventCapabilityRevoked,
+		Payload: map[string]interface{}{
+			"agent":        agentID,
+			"capabilities": capabilities,
+			"tools":        tools,
+			"reason":       reason,
+		},
+	}
+	notice, err := b.signedEvent(event)
+	if err != nil {
+		slog.Error("Failed to sign revocation event", "agent", agentID, "error", err)
+		return
+	}
+	data, err := json.Marshal(notice)
+	if err != nil {
+		slog.Error("Failed to encode revocation event", "agent", agentID, "error", err)
+		return
+	}
+	b.broadcasts.Send(b.id, event.Event, data, []string{agentID}, 0)
+}
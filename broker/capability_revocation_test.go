@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestCapabilityRevocation(t *testing.T) {
+	broker := NewBroker()
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	register := func() {
+		env := &protocol.GenericEnvelope{
+			BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent},
+		}
+		env.Agent = "worker-agent"
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+			PubKey:       protocol.EncodePublicKey(pubKey),
+			Capabilities: []string{"file.*", "job.run"},
+			MCPEndpoint:  "https://worker-agent/mcp",
+			BodyDefinition: &protocol.BodyDefinition{
+				Name:         "worker",
+				Capabilities: []string{"file.*", "job.run"},
+				MCPTools:     []protocol.MCPTool{{Name: "file.read"}, {Name: "file.write"}, {Name: "job.run"}},
+			},
+		})
+		protocol.SignEnvelope(env, privKey)
+		recorder := newBufferedResponse()
+		broker.handleRegisterAgent(recorder, env)
+		if recorder.status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+		}
+	}
+	register()
+
+	revoke := newRevoker(t, broker)
+
+	// Revoking a wildcard capability takes the tools it covers with it
+	recorder := revoke(protocol.RevokeBody{Target: "worker-agent", Capability: "file.*", Reason: "policy"})
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if capabilities := broker.agents["worker-agent"].Capabilities; len(capabilities) != 1 || capabilities[0] != "job.run" {
+		t.Errorf("Expected only job.run to remain, got %v", capabilities)
+	}
+	if count := broker.mcpRegistry.GetToolCount(); count != 1 {
+		t.Errorf("Expected 1 tool to remain, got %d", count)
+	}
+	tools, _ := broker.mcpRegistry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"file.*"}})
+	if len(tools) != 0 {
+		t.Errorf("Expected revoked tools to be undiscoverable, got %+v", tools)
+	}
+	agent, _ := broker.mcpRegistry.GetAgent("worker-agent")
+	if body := agent.BodyDefinition; len(body.MCPTools) != 1 || len(body.Capabilities) != 1 {
+		t.Errorf("Expected the body definition to drop the revoked tools, got %+v", body)
+	}
+
+	// The agent is not connected, so the notice waits for it
+	if owed := broker.broadcasts.owed["worker-agent"]; len(owed) != 1 {
+		t.Fatalf("Expected a revocation notice to be owed to the agent, got %v", owed)
+	}
+	var notice protocol.GenericEnvelope
+	var event protocol.EmitEventBody
+	if err := json.Unmarshal(broker.broadcasts.broadcasts[broker.broadcasts.owed["worker-agent"][0]].data, &notice); err != nil || notice.GetBodyAs(&event) != nil {
+		t.Fatalf("Failed to decode revocation notice: %v", err)
+	}
+	if event.Event != protocol.EventCapabilityRevoked || event.Payload["reason"] != "policy" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	// A single tool can be revoked, and the agent stays registered
+	recorder = revoke(protocol.RevokeBody{Target: "worker-agent", Tool: "job.run"})
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if count := broker.mcpRegistry.GetToolCount(); count != 0 {
+		t.Errorf("Expected no tools to remain, got %d", count)
+	}
+	if _, exists := broker.agents["worker-agent"]; !exists {
+		t.Error("Expected the agent to stay registered")
+	}
+
+	// Revoking what the agent does not have is reported
+	if recorder = revoke(protocol.RevokeBody{Target: "worker-agent", Tool: "job.run"}); recorder.status != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", recorder.status)
+	}
+	if recorder = revoke(protocol.RevokeBody{Target: "ghost-agent", Capability: "file.*"}); recorder.status != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", recorder.status)
+	}
+
+	// Registering again does not restore what was revoked
+	register()
+	if capabilities := broker.agents["worker-agent"].Capabilities; len(capabilities) != 1 || capabilities[0] != "job.run" {
+		t.Errorf("Expected file.* to stay revoked, got %v", capabilities)
+	}
+	if count := broker.mcpRegistry.GetToolCount(); count != 0 {
+		t.Errorf("Expected the revoked tools to stay unindexed, got %d", count)
+	}
+	if revocations := broker.Revocations(); len(revocations) != 1 || len(revocations[0].Capabilities) != 1 || len(revocations[0].Tools) != 1 {
+		t.Errorf("Unexpected revocations: %+v", revocations)
+	}
+
+	// Until an operator lifts the revocations
+	broker.SetAdminToken(testAdminToken)
+	request := httptest.NewRequest(http.MethodDelete, "/admin/revocations/worker-agent", nil)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", response.Code, response.Body.String())
+	}
+	register()
+	if count := broker.mcpRegistry.GetToolCount(); count != 3 {
+		t.Errorf("Expected the tools to be restored, got %d", count)
+	}
+}
+
+func TestRevokeRequiresGrantedCapability(t *testing.T) {
+	broker := NewBroker()
+	broker.agents["worker-agent"] = &Agent{ID: "worker-agent", Capabilities: []string{"job.run"}}
+
+	// Declaring the capability is not enough without a grant
+	pubKey, privKey, _ := ed25519.GenerateKey(nil)
+	broker.agents["rogue-agent"] = &Agent{ID: "rogue-agent", Capabilities: []string{protocol.RevokeCapability}, PubKey: pubKey}
+	revoke := func(agent string, signer ed25519.PrivateKey) int {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRevoke}}
+		env.Agent = agent
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.RevokeBody{Target: "worker-agent"})
+		if signer != nil {
+			protocol.SignEnvelope(env, signer)
+		}
+		recorder := newBufferedResponse()
+		broker.handleRevoke(recorder, env)
+		return recorder.status
+	}
+	if status := revoke("rogue-agent", privKey); status != http.StatusForbidden {
+		t.Errorf("Expected an ungranted revoker to be refused, got %d", status)
+	}
+	if status := revoke("anonymous-agent", nil); status != http.StatusForbidden {
+		t.Errorf("Expected an unregistered revoker to be refused, got %d", status)
+	}
+
+	// Granted, it must still prove it is the agent
+	broker.SetCapabilityGrants([]CapabilityGrant{{Agent: "rogue-agent", Capability: protocol.RevokeCapability}})
+	if status := revoke("rogue-agent", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned revocation to be refused, got %d", status)
+	}
+	if _, exists := broker.agents["worker-agent"]; !exists {
+		t.Fatal("Expected refused revocations to leave the agent registered")
+	}
+	if status := revoke("rogue-agent", privKey); status != http.StatusOK {
+		t.Errorf("Expected a granted revoker to be obeyed, got %d", status)
+	}
+}
+
+// newRevoker registers an agent granted protocol.RevokeCapability, and
+// returns a function sending revoke envelopes signed by it
+func newRevoker(t *testing.T, broker *Broker) func(body protocol.RevokeBody) *bufferedResponse {
+	t.Helper()
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	broker.mu.Lock()
+	broker.agents["ops-agent"] = &Agent{ID: "ops-agent", Capabilities: []string{protocol.RevokeCapability}, PubKey: pubKey}
+	broker.grants = append(broker.grants, CapabilityGrant{Agent: "ops-agent", Capability: protocol.RevokeCapability})
+	broker.mu.Unlock()
+
+	return func(body protocol.RevokeBody) *bufferedResponse {
+		env := &protocol.GenericEnvelope{
+			BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRevoke},
+		}
+		env.Agent = "ops-agent"
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(body)
+		protocol.SignEnvelope(env, privKey)
+		recorder := newBufferedResponse()
+		broker.handleRevoke(recorder, env)
+		return recorder
+	}
+}
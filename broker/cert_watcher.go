@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultCertWatchInterval is how often the certificate files are checked
+const defaultCertWatchInterval = 30 * time.Second
+
+// CertWatcher swaps in the serving certificate when its files change on
+// disk, so renewals by certbot or cert-manager take effect without a
+// SIGHUP. The files are polled by content: that needs no dependency, and
+// catches the symlink swaps of Kubernetes secret volumes and copies that
+// keep the old modification time alike.
+type CertWatcher struct {
+	broker   *Broker
+	certFile string
+	keyFile  string
+	loaded   string // Digest of the files last loaded
+	failed   string // Digest of the files last failing to load, so each failure is logged once
+	mu       sync.Mutex
+}
+
+// NewCertWatcher creates a watcher with no files to watch
+func NewCertWatcher(broker *Broker) *CertWatcher {
+	return &CertWatcher{broker: broker}
+}
+
+// SetFiles watches a certificate and key, taking their current contents
+// as already loaded. Empty names stop the watching.
+func (w *CertWatcher) SetFiles(certFile, keyFile string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.certFile, w.keyFile = certFile, keyFile
+	w.loaded, _ = certFilesDigest(certFile, keyFile)
+	w.failed = ""
+}
+
+// Check loads the certificate again if its files changed since they were
+// last loaded, reporting whether it swapped one in. A pair that does not
+// load, such as a certificate renewed before its key, is retried on the
+// next check while the current certificate stays in use.
+func (w *CertWatcher) Check() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.certFile == "" {
+		return false
+	}
+
+	digest, err := certFilesDigest(w.certFile, w.keyFile)
+	if err != nil || digest == w.loaded {
+		if err != nil && digest != w.failed {
+			w.failed = digest
+			slog.Warn("Failed to read certificate files", "cert", w.certFile, "error", err)
+		}
+		return false
+	}
+	cert, err := loadCertificate(w.certFile, w.keyFile)
+	if err != nil {
+		if digest != w.failed {
+			w.failed = digest
+			slog.Warn("Changed certificate files do not load, keeping the current certificate", "cert", w.certFile, "error", err)
+		}
+		return false
+	}
+
+	w.broker.SetCertificate(cert)
+	w.loaded, w.failed = digest, ""
+	slog.Info("Swapped in renewed certificate", "cert", w.certFile, "certFingerprint", w.broker.Identity().CertFingerprint)
+	return true
+}
+
+// Run checks the files every interval until stop is closed
+func (w *CertWatcher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// certFilesDigest hashes the contents of a certificate and key file
+func certFilesDigest(certFile, keyFile string) (string, error) {
+	digest := sha256.New()
+	for _, path := range []string{certFile, keyFile} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "error:" + err.Error(), err
+		}
+		digest.Write(data)
+		digest.Write([]byte{0})
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertWatcherSwapsRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "broker.crt"), filepath.Join(dir, "broker.key")
+	first := doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	writeCertificateFiles(t, first, certFile, keyFile)
+
+	broker := NewBroker()
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	broker.SetCertificate(cert)
+	broker.certs.SetFiles(certFile, keyFile)
+
+	// A connection made before the renewal keeps its certificate
+	server := newCertWatcherServer(t, broker)
+	established, err := tls.Dial("tcp", server, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer established.Close()
+
+	if broker.certs.Check() {
+		t.Error("Expected unchanged files not to be reloaded")
+	}
+
+	second := doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(48*time.Hour))
+	writeCertificateFiles(t, second, certFile, keyFile)
+	if !broker.certs.Check() {
+		t.Fatal("Expected the renewed certificate to be swapped in")
+	}
+	if served := broker.certificate.Load().Certificate[0]; string(served) != string(second.Certificate[0]) {
+		t.Error("Expected the renewed certificate to be served")
+	}
+
+	conn, err := tls.Dial("tcp", server, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Failed to connect after the swap: %v", err)
+	}
+	defer conn.Close()
+	if string(conn.ConnectionState().PeerCertificates[0].Raw) != string(second.Certificate[0]) {
+		t.Error("Expected new connections to get the renewed certificate")
+	}
+	if _, err := established.Write([]byte("GET /health HTTP/1.1\r\nHost: broker\r\n\r\n")); err != nil {
+		t.Errorf("Expected the established connection to survive the swap: %v", err)
+	}
+
+	// A certificate written before its key does not load; the current one
+	// stays until the pair matches again
+	third := doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	writeCertificateFiles(t, third, filepath.Join(dir, "next.crt"), filepath.Join(dir, "next.key"))
+	renewed, _ := os.ReadFile(filepath.Join(dir, "next.crt"))
+	os.WriteFile(certFile, renewed, 0600)
+	if broker.certs.Check() {
+		t.Error("Expected a mismatched pair not to be swapped in")
+	}
+	if served := broker.certificate.Load().Certificate[0]; string(served) != string(second.Certificate[0]) {
+		t.Error("Expected the current certificate to stay after a failed load")
+	}
+	key, _ := os.ReadFile(filepath.Join(dir, "next.key"))
+	os.WriteFile(keyFile, key, 0600)
+	if !broker.certs.Check() {
+		t.Error("Expected the pair to be swapped in once the key matches")
+	}
+}
+
+// newCertWatcherServer serves broker over TLS with its current certificate,
+// returning the address
+func newCertWatcherServer(t *testing.T, broker *Broker) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: broker.getCertificate})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffer := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buffer); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
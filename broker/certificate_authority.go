@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// defaultClientCertValidity is how long an issued client certificate
+	// lasts; agents renew by registering again
+	defaultClientCertValidity = 24 * time.Hour
+	// caValidity is how long the broker's CA certificate lasts
+	caValidity = 10 * 365 * 24 * time.Hour
+	// caClockSkew backdates issued certificates, so clients whose clocks run
+	// a little behind the broker's accept them at once
+	caClockSkew = 5 * time.Minute
+)
+
+// Files kept in the CA directory
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+)
+
+// CertificateAuthority issues short-lived client certificates to agents
+// that register with a certificate request, so client certificates can be
+// required without a separate PKI
+type CertificateAuthority struct {
+	cert     *x509.Certificate
+	certPEM  []byte
+	key      *ecdsa.PrivateKey
+	validity time.Duration
+	now      func() time.Time
+}
+
+// LoadOrCreateCA loads the CA kept in dir, creating the directory, key and
+// a self-signed CA certificate named for the broker if they are missing
+func LoadOrCreateCA(dir, brokerID string, validity time.Duration) (*CertificateAuthority, error) {
+	if validity <= 0 {
+		return nil, errors.New("client certificate validity must be positive")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateECKey(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("CA key: %w", err)
+	}
+	ca := &CertificateAuthority{key: key, validity: validity, now: time.Now}
+
+	certPath := filepath.Join(dir, caCertFile)
+	data, err := os.ReadFile(certPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := ca.createCertificate(brokerID); err != nil {
+			return nil, err
+		}
+		return ca, os.WriteFile(certPath, ca.certPEM, 0600)
+	case err != nil:
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("%s does not match %s", certPath, caKeyFile)
+	}
+	ca.cert, ca.certPEM = cert, data
+	return ca, nil
+}
+
+// createCertificate self-signs the CA certificate
+func (ca *CertificateAuthority) createCertificate(brokerID string) error {
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := ca.now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"FEM Broker"}, CommonName: brokerID + " CA"},
+		NotBefore:             now.Add(-caClockSkew),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	ca.cert, _ = x509.ParseCertificate(der)
+	ca.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return nil
+}
+
+// CertificatePEM returns the CA certificate, for clients to trust
+func (ca *CertificateAuthority) CertificatePEM() []byte {
+	return ca.certPEM
+}
+
+// IssueClientCert signs a client certificate naming agentID for the key of
+// a PEM certificate request, whatever names the request asks for. It
+// returns the PEM certificate and its fingerprint.
+func (ca *CertificateAuthority) IssueClientCert(agentID, csrPEM string) (string, string, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", "", errors.New("no PEM certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", "", err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", "", fmt.Errorf("certificate request is not signed by its key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", err
+	}
+	now := ca.now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: agentID},
+		NotBefore:    now.Add(-caClockSkew),
+		NotAfter:     now.Add(ca.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), protocol.CertFingerprint(der), nil
+}
+
+// ServerCertificate issues the broker a serving certificate for hosts, in
+// place of a self-signed one, so clients trusting the CA can verify it
+func (ca *CertificateAuthority) ServerCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := ca.now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"FEM Broker"}},
+		NotBefore:    now.Add(-caClockSkew),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// randomSerial returns a random 128-bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// SetCA makes the broker issue client certificates to agents that register
+// with a certificate request
+func (b *Broker) SetCA(ca *CertificateAuthority) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ca = ca
+}
+
+// issuedClientCert is a client certificate issued to a registering agent
+type issuedClientCert struct {
+	certPEM     string
+	caPEM       string
+	fingerprint string
+}
+
+// issueClientCert issues a client certificate for a registration carrying
+// a certificate request. The registration must be signed with the key it
+// registers, and by the key the agent already holds if it is registered,
+// so nobody is issued a certificate naming another agent. A refusal comes
+// with the HTTP status to answer it with.
+func (b *Broker) issueClientCert(env *protocol.GenericEnvelope, pubKey protocol.PublicKey, csr string) (*issuedClientCert, int, error) {
+	b.mu.RLock()
+	ca := b.ca
+	var registered protocol.PublicKey
+	if agent, exists := b.agents[env.Agent]; exists {
+		registered = agent.PubKey
+	}
+	b.mu.RUnlock()
+
+	if ca == nil {
+		return nil, http.StatusBadRequest, errors.New("this broker does not issue client certificates")
+	}
+	if pubKey == nil {
+		return nil, http.StatusBadRequest, errors.New("a client certificate needs a registration with a public key")
+	}
+	if err := env.VerifyKey(pubKey); err != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("invalid signature: %w", err)
+	}
+	if registered != nil && !registered.Equal(pubKey) {
+		return nil, http.StatusForbidden, fmt.Errorf("agent %s is registered with another key", env.Agent)
+	}
+
+	certPEM, fingerprint, err := ca.IssueClientCert(env.Agent, csr)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid certificate request: %w", err)
+	}
+	return &issuedClientCert{certPEM: certPEM, caPEM: string(ca.CertificatePEM()), fingerprint: fingerprint}, 0, nil
+}
+
+// handleCACertificate serves GET /ca.crt, the PEM certificate of the CA
+// issuing client certificates
+func (b *Broker) handleCACertificate(w http.ResponseWriter, r *http.Request) {
+	b.mu.RLock()
+	ca := b.ca
+	b.mu.RUnlock()
+	if ca == nil {
+		http.Error(w, "This broker does not issue client certificates", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(ca.CertificatePEM())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	first, err := LoadOrCreateCA(dir, "broker-a", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	if !first.cert.IsCA || first.cert.Subject.CommonName != "broker-a CA" {
+		t.Errorf("Expected a CA certificate named for the broker, got %+v", first.cert.Subject)
+	}
+	second, err := LoadOrCreateCA(dir, "broker-a", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to load CA: %v", err)
+	}
+	if !bytes.Equal(first.CertificatePEM(), second.CertificatePEM()) {
+		t.Error("Expected the CA to be kept in its directory")
+	}
+	if _, err := LoadOrCreateCA(dir, "broker-a", 0); err == nil {
+		t.Error("Expected a zero certificate validity to be refused")
+	}
+
+	// The serving certificate chains to the CA
+	cert, err := first.ServerCertificate([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to issue serving certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(first.CertificatePEM())
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: roots}); err != nil {
+		t.Errorf("Expected the serving certificate to verify against the CA: %v", err)
+	}
+}
+
+func TestIssueClientCertificates(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir(), "fem-broker", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.CertificatePEM())
+
+	broker := NewBroker()
+	broker.SetCA(ca)
+	broker.SetClientAuth(tls.VerifyClientCertIfGiven)
+	server := httptest.NewUnstartedServer(broker)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+	}
+	send := func(client *http.Client, envelopeType protocol.EnvelopeType, agent string, signer ed25519.PrivateKey, body protocol.RegisterAgentBody) (int, map[string]interface{}) {
+		env := protocol.NewEnvelope(envelopeType, agent)
+		env.Body, _ = json.Marshal(body)
+		env.Sign(signer)
+		data, _ := json.Marshal(env)
+		resp, err := client.Post(server.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to send envelope: %v", err)
+		}
+		defer resp.Body.Close()
+		var response map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&response)
+		return resp.StatusCode, response
+	}
+
+	pubKey, privKey, _ := protocol.GenerateKeyPair()
+	csr, certKey, err := protocol.NewCertificateRequest("ignored-name")
+	if err != nil {
+		t.Fatalf("Failed to create certificate request: %v", err)
+	}
+	registration := protocol.RegisterAgentBody{PubKey: protocol.EncodePublicKey(pubKey), CSR: csr}
+
+	// Registrations must be signed with the key they register
+	_, forgedKey, _ := protocol.GenerateKeyPair()
+	if status, _ := send(client(), protocol.EnvelopeRegisterAgent, "agent-a", forgedKey, registration); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a forged registration, got %d", status)
+	}
+
+	status, response := send(client(), protocol.EnvelopeRegisterAgent, "agent-a", privKey, registration)
+	if status != http.StatusOK {
+		t.Fatalf("Expected registration to succeed, got %d", status)
+	}
+	certPEM, _ := response["clientCert"].(string)
+	if response["caCert"] != string(ca.CertificatePEM()) {
+		t.Error("Expected the CA certificate in the response")
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		t.Fatalf("Expected a PEM client certificate, got %v", response)
+	}
+	leaf, _ := x509.ParseCertificate(block.Bytes)
+	if leaf.Subject.CommonName != "agent-a" || leaf.NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected a short-lived certificate naming the registering agent, got %s until %s", leaf.Subject.CommonName, leaf.NotAfter)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Expected the client certificate to verify against the CA: %v", err)
+	}
+	broker.mu.RLock()
+	bound := broker.agents["agent-a"].CertFingerprint
+	broker.mu.RUnlock()
+	if bound != protocol.CertFingerprint(leaf.Raw) {
+		t.Error("Expected the agent to be bound to its issued certificate")
+	}
+
+	// The agent is now held to its certificate
+	issued, err := protocol.IssuedCertificate(certPEM, certKey)
+	if err != nil {
+		t.Fatalf("Failed to load issued certificate: %v", err)
+	}
+	heartbeat := protocol.RegisterAgentBody{}
+	if status, _ := send(client(issued), protocol.EnvelopeAgentHeartbeat, "agent-a", privKey, heartbeat); status == http.StatusForbidden {
+		t.Error("Expected the issued certificate to be accepted")
+	}
+	if status, _ := send(client(), protocol.EnvelopeAgentHeartbeat, "agent-a", privKey, heartbeat); status != http.StatusForbidden {
+		t.Errorf("Expected an envelope without the issued certificate to be refused, got %d", status)
+	}
+
+	// Nobody else is issued a certificate naming the agent
+	otherPub, otherKey, _ := protocol.GenerateKeyPair()
+	hijack := protocol.RegisterAgentBody{PubKey: protocol.EncodePublicKey(otherPub), CSR: csr}
+	if status, _ := send(client(), protocol.EnvelopeRegisterAgent, "agent-a", otherKey, hijack); status != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a certificate naming a registered agent, got %d", status)
+	}
+
+	// Brokers without a CA issue nothing
+	plain := NewBroker()
+	recorder := newBufferedResponse()
+	env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+	env.Agent = "agent-b"
+	env.Body, _ = json.Marshal(registration)
+	plain.handleRegisterAgent(recorder, env)
+	if recorder.status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 from a broker without a CA, got %d", recorder.status)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/fep-fem/protocol"
+)
+
+// Client certificate modes for the TLS listener
+const (
+	ClientAuthNone    = "none"    // Certificates are not asked for
+	ClientAuthRequest = "request" // Verified if presented; agents that register with one are bound to it
+	ClientAuthRequire = "require" // Every connection must present a verified certificate
+)
+
+// ParseClientAuth maps a -client-auth mode to the TLS setting enforcing it
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case ClientAuthNone, "":
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q (want none, request or require)", mode)
+}
+
+// LoadClientCAs reads the PEM certificates client certificates must chain to
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// SetClientAuth makes the broker check envelopes against the client
+// certificates of the connections they arrive over
+func (b *Broker) SetClientAuth(mode tls.ClientAuthType) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clientAuth = mode
+}
+
+// clientCertificate returns the verified certificate a request's client
+// presented, or nil
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// certificateNames returns the identities a client certificate vouches
+// for: its subject common name and DNS names
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// checkClientCert rejects envelopes whose client certificate does not name
+// the claimed agent, or that an agent bound to a certificate at
+// registration sends without it. Envelopes relayed by a peer carry the
+// peer's certificate, which must name a federated broker.
+func (b *Broker) checkClientCert(envelope *protocol.GenericEnvelope) error {
+	b.mu.RLock()
+	mode := b.clientAuth
+	var bound string
+	if agent, exists := b.agents[envelope.Agent]; exists {
+		bound = agent.CertFingerprint
+	}
+	b.mu.RUnlock()
+	if mode == tls.NoClientCert {
+		return nil
+	}
+
+	cert := envelope.ClientCert
+	if cert == nil {
+		if bound != "" {
+			return fmt.Errorf("agent %s is bound to a client certificate", envelope.Agent)
+		}
+		return nil
+	}
+	if envelope.Hops > 0 {
+		for _, name := range certificateNames(cert) {
+			if _, exists := b.peers.Get(name); exists {
+				return nil
+			}
+		}
+		return errors.New("client certificate does not name a federated broker")
+	}
+	if !containsString(certificateNames(cert), envelope.Agent) {
+		return fmt.Errorf("client certificate does not name agent %s", envelope.Agent)
+	}
+	if bound != "" && envelope.Type != protocol.EnvelopeRegisterAgent && protocol.CertFingerprint(cert.Raw) != bound {
+		return fmt.Errorf("client certificate is not the one agent %s registered with", envelope.Agent)
+	}
+	return nil
+}
+
+// clientCertFingerprint returns the fingerprint an agent registering with
+// an envelope is bound to, or "" if it presented no certificate
+func clientCertFingerprint(envelope *protocol.GenericEnvelope) string {
+	if envelope.ClientCert == nil {
+		return ""
+	}
+	return protocol.CertFingerprint(envelope.ClientCert.Raw)
+}
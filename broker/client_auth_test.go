@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// clientAuthCA issues client certificates for tests
+type clientAuthCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newClientAuthCA(t *testing.T) *clientAuthCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Agent CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &clientAuthCA{cert: cert, key: key, pool: pool}
+}
+
+// issue creates a client certificate naming agent
+func (ca *clientAuthCA) issue(t *testing.T, agent string, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: agent},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for mode, expected := range map[string]tls.ClientAuthType{
+		"none":    tls.NoClientCert,
+		"request": tls.VerifyClientCertIfGiven,
+		"require": tls.RequireAndVerifyClientCert,
+	} {
+		if got, err := ParseClientAuth(mode); err != nil || got != expected {
+			t.Errorf("Expected %q to be %v, got %v %v", mode, expected, got, err)
+		}
+	}
+	if _, err := ParseClientAuth("optional"); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
+
+func TestClientCertificateBoundToAgent(t *testing.T) {
+	ca := newClientAuthCA(t)
+	broker := NewBroker()
+	broker.SetClientAuth(tls.VerifyClientCertIfGiven)
+	server := httptest.NewUnstartedServer(broker)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: ca.pool}
+	server.StartTLS()
+	defer server.Close()
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+	}
+	send := func(client *http.Client, envelopeType protocol.EnvelopeType, agent string) int {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: envelopeType}}
+		env.Agent = agent
+		env.TS = time.Now().UnixMilli()
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{Capabilities: []string{"job.run"}})
+		data, _ := json.Marshal(env)
+		resp, err := client.Post(server.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to send envelope: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	agentA := client(ca.issue(t, "agent-a", 2))
+	if status := send(agentA, protocol.EnvelopeRegisterAgent, "agent-a"); status != http.StatusOK {
+		t.Fatalf("Expected agent-a to register over its certificate, got %d", status)
+	}
+	broker.mu.RLock()
+	bound := broker.agents["agent-a"].CertFingerprint
+	broker.mu.RUnlock()
+	if bound == "" {
+		t.Fatal("Expected agent-a to be bound to its certificate")
+	}
+
+	if status := send(agentA, protocol.EnvelopeRegisterAgent, "agent-b"); status != http.StatusForbidden {
+		t.Errorf("Expected agent-a's certificate to be refused for agent-b, got %d", status)
+	}
+	if status := send(client(), protocol.EnvelopeAgentHeartbeat, "agent-a"); status != http.StatusForbidden {
+		t.Errorf("Expected a bound agent's envelope without its certificate to be refused, got %d", status)
+	}
+	if status := send(client(ca.issue(t, "agent-a", 3)), protocol.EnvelopeAgentHeartbeat, "agent-a"); status != http.StatusForbidden {
+		t.Errorf("Expected another certificate naming agent-a to be refused, got %d", status)
+	}
+	if status := send(agentA, protocol.EnvelopeAgentHeartbeat, "agent-a"); status == http.StatusForbidden {
+		t.Error("Expected agent-a's own certificate to be accepted")
+	}
+
+	// Certificates stay optional for agents that never presented one
+	if status := send(client(), protocol.EnvelopeRegisterAgent, "agent-c"); status != http.StatusOK {
+		t.Errorf("Expected agent-c to register without a certificate, got %d", status)
+	}
+}
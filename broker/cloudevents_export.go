@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// CloudEvents content modes supported for export
+const (
+	CloudEventsBinary     = "binary"
+	CloudEventsStructured = "structured"
+)
+
+// CloudEventsExporter re-emits accepted FEM events as CloudEvents 1.0 over
+// HTTP to configured sinks (e.g. a Knative broker). Envelope headers map to
+// CloudEvents attributes:
+//
+//	nonce -> id
+//	agent -> source (fem://<broker>/agents/<agent>) and the femagent extension
+//	event -> type
+//	ts    -> time
+//	sig   -> the femsig extension
+//
+// The event payload is sent as JSON data.
+type CloudEventsExporter struct {
+	sinks      []string
+	mode       string
+	brokerID   string
+	httpClient *http.Client
+	mu         sync.RWMutex
+}
+
+// NewCloudEventsExporter creates an exporter with no sinks, delivering in
+// binary content mode
+func NewCloudEventsExporter(brokerID string) *CloudEventsExporter {
+	return &CloudEventsExporter{
+		mode:     CloudEventsBinary,
+		brokerID: brokerID,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+// Configure sets the sink URLs and content mode
+func (e *CloudEventsExporter) Configure(sinks []string, mode string) error {
+	if mode == "" {
+		mode = CloudEventsBinary
+	}
+	if mode != CloudEventsBinary && mode != CloudEventsStructured {
+		return fmt.Errorf("unknown CloudEvents mode %q", mode)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sinks = sinks
+	e.mode = mode
+	return nil
+}
+
+// GetSinkCount returns the number of configured sinks
+func (e *CloudEventsExporter) GetSinkCount() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.sinks)
+}
+
+// ToCloudEvent maps an emitEvent envelope to a structured-mode CloudEvent
+func (e *CloudEventsExporter) ToCloudEvent(env *protocol.GenericEnvelope, body protocol.EmitEventBody) map[string]interface{} {
+	ce := map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              env.Nonce,
+		"source":          fmt.Sprintf("fem://%s/agents/%s", e.brokerID, env.Agent),
+		"type":            body.Event,
+		"time":            time.UnixMilli(env.TS).UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+		"femagent":        env.Agent,
+	}
+	if env.Sig != "" {
+		ce["femsig"] = env.Sig
+	}
+	if body.Payload != nil {
+		ce["data"] = body.Payload
+	}
+	return ce
+}
+
+// Export delivers an event to every sink in the background
+func (e *CloudEventsExporter) Export(env *protocol.GenericEnvelope, body protocol.EmitEventBody) {
+	e.mu.RLock()
+	sinks := e.sinks
+	mode := e.mode
+	e.mu.RUnlock()
+
+	if len(sinks) == 0 {
+		return
+	}
+
+	ce := e.ToCloudEvent(env, body)
+	for _, sink := range sinks {
+		go func(sink string) {
+			if err := e.deliver(sink, mode, ce); err != nil {
+				slog.Warn("Failed to export event", "event", body.Event, "sink", sink, "error", err)
+			}
+		}(sink)
+	}
+}
+
+// deliver posts a CloudEvent to a sink in the given content mode
+func (e *CloudEventsExporter) deliver(sink, mode string, ce map[string]interface{}) error {
+	// Binary mode sends the data as the body and attributes as ce-* headers
+	var payload interface{} = ce["data"]
+	contentType := "application/json"
+	if mode == CloudEventsStructured {
+		payload = ce
+		contentType = "application/cloudevents+json"
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sink, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if mode == CloudEventsBinary {
+		for attr, value := range ce {
+			if attr != "data" && attr != "datacontenttype" {
+				req.Header.Set("Ce-"+attr, fmt.Sprint(value))
+			}
+		}
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// parseSinkList splits a comma-separated list of sink URLs
+func parseSinkList(value string) []string {
+	var sinks []string
+	for _, sink := range strings.Split(value, ",") {
+		if sink = strings.TrimSpace(sink); sink != "" {
+			sinks = append(sinks, sink)
+		}
+	}
+	return sinks
+}
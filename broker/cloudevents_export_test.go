@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestCloudEventMapping(t *testing.T) {
+	exporter := NewCloudEventsExporter("test-broker")
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeEmitEvent},
+	}
+	env.Agent = "sensor-agent"
+	env.TS = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC).UnixMilli()
+	env.Nonce = "nonce-1"
+	env.Sig = "c2ln"
+
+	ce := exporter.ToCloudEvent(env, protocol.EmitEventBody{
+		Event:   "sensor.temperature",
+		Payload: map[string]interface{}{"celsius": 21.5},
+	})
+
+	expected := map[string]interface{}{
+		"specversion": "1.0",
+		"id":          "nonce-1",
+		"source":      "fem://test-broker/agents/sensor-agent",
+		"type":        "sensor.temperature",
+		"time":        "2025-06-01T12:00:00Z",
+		"femagent":    "sensor-agent",
+		"femsig":      "c2ln",
+	}
+	for attr, value := range expected {
+		if ce[attr] != value {
+			t.Errorf("Expected %s=%v, got %v", attr, value, ce[attr])
+		}
+	}
+
+	if err := exporter.Configure(nil, "protobuf"); err == nil {
+		t.Error("Expected unknown content mode to be rejected")
+	}
+}
+
+func TestCloudEventsExportRoundTrip(t *testing.T) {
+	for _, mode := range []string{CloudEventsBinary, CloudEventsStructured} {
+		t.Run(mode, func(t *testing.T) {
+			// A second broker ingests the exported CloudEvents
+			received := make(chan protocol.Envelope, 1)
+			subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var env protocol.Envelope
+				if err := json.NewDecoder(r.Body).Decode(&env); err == nil {
+					received <- env
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer subscriber.Close()
+
+			downstream := NewBroker()
+			downstream.subscriptions.Subscribe("listener-agent", subscriber.URL, []string{"sensor.*"})
+			sink := httptest.NewTLSServer(downstream)
+			defer sink.Close()
+
+			upstream := NewBroker()
+			if err := upstream.exporter.Configure([]string{sink.URL + "/ingest/cloudevents"}, mode); err != nil {
+				t.Fatalf("Failed to configure exporter: %v", err)
+			}
+
+			env := &protocol.GenericEnvelope{
+				BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeEmitEvent},
+			}
+			env.Agent = "sensor-agent"
+			env.TS = time.Now().UnixMilli()
+			env.Nonce = protocol.NewNonce()
+			env.Body, _ = json.Marshal(protocol.EmitEventBody{
+				Event:   "sensor.temperature",
+				Payload: map[string]interface{}{"celsius": 21.5},
+			})
+
+			recorder := newBufferedResponse()
+			upstream.handleEmitEvent(recorder, env)
+			if recorder.status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+			}
+
+			select {
+			case delivered := <-received:
+				var body protocol.EmitEventBody
+				if err := json.Unmarshal(delivered.Body, &body); err != nil {
+					t.Fatalf("Failed to decode delivered event: %v", err)
+				}
+				if body.Event != "sensor.temperature" || body.Payload["id"] != env.Nonce || body.Payload["femagent"] != "sensor-agent" {
+					t.Errorf("Unexpected delivered event: %+v", body)
+				}
+				data, _ := body.Payload["data"].(map[string]interface{})
+				if data["celsius"] != 21.5 {
+					t.Errorf("Expected data to survive export, got %v", body.Payload["data"])
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for exported event")
+			}
+		})
+	}
+}
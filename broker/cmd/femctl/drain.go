@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// drainPollInterval is how often drain -wait checks on the handoff
+const drainPollInterval = time.Second
+
+// drainOptions are the flags of femctl drain
+type drainOptions struct {
+	connection
+	successor string
+	endpoint  string
+	wait      bool
+}
+
+// drainStatus mirrors the broker's /admin/drain
+type drainStatus struct {
+	Draining    bool      `json:"draining"`
+	Successor   string    `json:"successor"`
+	Endpoint    string    `json:"endpoint"`
+	Broadcasts  int       `json:"broadcasts"`
+	Requests    int       `json:"requests"`
+	Notified    int       `json:"notified"`
+	Pending     int       `json:"pending"`
+	Connected   int       `json:"connected"`
+	Error       string    `json:"error"`
+	Complete    bool      `json:"complete"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+func (s *drainStatus) String() string {
+	if !s.Draining {
+		return "not draining"
+	}
+	state := "handing off"
+	switch {
+	case s.Error != "":
+		state = "handoff failed: " + s.Error
+	case s.Complete:
+		state = "complete at " + s.CompletedAt.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("draining into %s (%s): %d broadcasts and %d calls handed off, %d agents notified, %d calls pending, %d agents connected; %s",
+		s.Successor, s.Endpoint, s.Broadcasts, s.Requests, s.Notified, s.Pending, s.Connected, state)
+}
+
+// runDrain starts draining the broker into its successor, or without
+// -successor reports the drain in progress
+func runDrain(args []string) error {
+	var options drainOptions
+	flags := flag.NewFlagSet("drain", flag.ContinueOnError)
+	options.register(flags)
+	flags.StringVar(&options.successor, "successor", "", "ID of the federated broker to hand state and agents over to")
+	flags.StringVar(&options.endpoint, "endpoint", "", "URL agents reach the successor at (default its federation endpoint)")
+	flags.BoolVar(&options.wait, "wait", false, "Wait until the handoff is complete")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	var status *drainStatus
+	if options.successor != "" {
+		status, err = startDrain(client, options.broker, options.successor, options.endpoint)
+	} else {
+		status, err = fetchDrain(client, options.broker)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(status)
+
+	for options.wait && status.Draining && !status.Complete {
+		time.Sleep(drainPollInterval)
+		if status, err = fetchDrain(client, options.broker); err != nil {
+			return err
+		}
+		if status.Complete {
+			fmt.Println(status)
+		}
+	}
+	return nil
+}
+
+// startDrain asks the broker to drain into successor
+func startDrain(client *http.Client, broker, successor, endpoint string) (*drainStatus, error) {
+	request, err := json.Marshal(map[string]string{"successor": successor, "endpoint": endpoint})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(strings.TrimSuffix(broker, "/")+"/admin/drain", "application/json", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	return readDrainStatus(resp)
+}
+
+// fetchDrain reads the broker's drain status
+func fetchDrain(client *http.Client, broker string) (*drainStatus, error) {
+	resp, err := client.Get(strings.TrimSuffix(broker, "/") + "/admin/drain")
+	if err != nil {
+		return nil, err
+	}
+	return readDrainStatus(resp)
+}
+
+func readDrainStatus(resp *http.Response) (*drainStatus, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var status drainStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &status, nil
+}
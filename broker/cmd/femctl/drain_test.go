@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDrainRequests(t *testing.T) {
+	var request map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/drain" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			json.NewDecoder(r.Body).Decode(&request)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"draining": true, "successor": "broker-b", "requests": 2, "complete": r.Method == http.MethodGet})
+	}))
+	defer server.Close()
+
+	status, err := startDrain(server.Client(), server.URL, "broker-b", "")
+	if err != nil {
+		t.Fatalf("Starting the drain failed: %v", err)
+	}
+	if request["successor"] != "broker-b" || status.Requests != 2 || status.Complete {
+		t.Errorf("Unexpected request %v or status %+v", request, status)
+	}
+
+	status, err = fetchDrain(server.Client(), server.URL+"/")
+	if err != nil || !status.Complete || !strings.Contains(status.String(), "complete") {
+		t.Errorf("Expected a complete drain, got %v, %v", status, err)
+	}
+	if _, err := fetchDrain(server.Client(), server.URL+"/missing"); err == nil {
+		t.Error("Expected an error status to be reported")
+	}
+}
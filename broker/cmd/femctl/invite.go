@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// inviteOptions are the flags of femctl invite
+type inviteOptions struct {
+	connection
+	agent        string
+	capabilities string
+	ttl          time.Duration
+}
+
+// mintedToken mirrors the broker's answer to POST /admin/tokens
+type mintedToken struct {
+	Token        string    `json:"token"`
+	ID           string    `json:"id"`
+	Agent        string    `json:"agent"`
+	Capabilities []string  `json:"capabilities"`
+	Expires      time.Time `json:"expires"`
+}
+
+// runInvite mints a bootstrap token and prints it on stdout, so it can be
+// captured into an agent's configuration
+func runInvite(args []string) error {
+	var options inviteOptions
+	flags := flag.NewFlagSet("invite", flag.ContinueOnError)
+	options.register(flags)
+	flags.StringVar(&options.agent, "agent", "*", "Agent IDs the token admits, such as worker-*")
+	flags.StringVar(&options.capabilities, "capabilities", "", "Comma-separated capability patterns agents may register with the token, such as file.*,echo")
+	flags.DurationVar(&options.ttl, "ttl", 24*time.Hour, "How long the token is valid")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	token, err := mintToken(client, options.broker, options.agent, splitList(options.capabilities), options.ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Token %s for %s, capabilities %s, expires %s\n",
+		token.ID, token.Agent, strings.Join(token.Capabilities, ","), token.Expires.Format(time.RFC3339))
+	fmt.Println(token.Token)
+	return nil
+}
+
+// mintToken asks the broker for a bootstrap token
+func mintToken(client *http.Client, broker, agent string, capabilities []string, ttl time.Duration) (*mintedToken, error) {
+	request, err := json.Marshal(map[string]interface{}{
+		"agent":        agent,
+		"capabilities": capabilities,
+		"ttl":          ttl.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(strings.TrimSuffix(broker, "/")+"/admin/tokens", "application/json", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token mintedToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &token, nil
+}
+
+// splitList splits a comma-separated flag, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
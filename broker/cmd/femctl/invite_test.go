@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMintToken(t *testing.T) {
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/tokens" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": "abc", "id": "1", "agent": request["agent"]})
+	}))
+	defer server.Close()
+
+	token, err := mintToken(server.Client(), server.URL+"/", "worker-*", splitList("echo, file.*,"), 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Minting failed: %v", err)
+	}
+	if token.Token != "abc" || token.Agent != "worker-*" {
+		t.Errorf("Unexpected token %+v", token)
+	}
+	capabilities, _ := request["capabilities"].([]interface{})
+	if len(capabilities) != 2 || capabilities[1] != "file.*" || request["ttl"] != "2h0m0s" {
+		t.Errorf("Unexpected request %v", request)
+	}
+
+	if _, err := mintToken(server.Client(), server.URL+"/missing", "*", nil, time.Hour); err == nil {
+		t.Error("Expected an error status to be reported")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtOptions are the flags of femctl jwt
+type jwtOptions struct {
+	connection
+	subject string
+	roles   string
+	ttl     time.Duration
+}
+
+// issuedJWT mirrors the broker's answer to POST /admin/jwt
+type issuedJWT struct {
+	Token   string    `json:"token"`
+	Subject string    `json:"subject"`
+	Roles   []string  `json:"roles"`
+	Expires time.Time `json:"expires"`
+}
+
+// runJWT has the broker issue a JWT and prints it on stdout, so it can be
+// handed to a dashboard, an operator's femctl -token or an agent
+func runJWT(args []string) error {
+	var options jwtOptions
+	flags := flag.NewFlagSet("jwt", flag.ContinueOnError)
+	options.register(flags)
+	flags.StringVar(&options.subject, "subject", "", "Who the token is for; with the agent role, the agent IDs it admits, such as worker-*")
+	flags.StringVar(&options.roles, "roles", "viewer", "Comma-separated roles the token grants: admin, viewer or agent")
+	flags.DurationVar(&options.ttl, "ttl", time.Hour, "How long the token is valid")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if options.subject == "" {
+		return fmt.Errorf("a -subject is required")
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	token, err := issueJWT(client, options.broker, options.subject, splitList(options.roles), options.ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "JWT for %s, roles %s, expires %s\n",
+		token.Subject, strings.Join(token.Roles, ","), token.Expires.Format(time.RFC3339))
+	fmt.Println(token.Token)
+	return nil
+}
+
+// issueJWT asks the broker for a JWT
+func issueJWT(client *http.Client, broker, subject string, roles []string, ttl time.Duration) (*issuedJWT, error) {
+	request, err := json.Marshal(map[string]interface{}{
+		"subject": subject,
+		"roles":   roles,
+		"ttl":     ttl.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(strings.TrimSuffix(broker, "/")+"/admin/jwt", "application/json", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token issuedJWT
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &token, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIssueJWT(t *testing.T) {
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/jwt" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": "a.b.c", "subject": request["subject"], "roles": request["roles"]})
+	}))
+	defer server.Close()
+
+	token, err := issueJWT(server.Client(), server.URL+"/", "dashboard", splitList("viewer,"), 8*time.Hour)
+	if err != nil {
+		t.Fatalf("Issuing failed: %v", err)
+	}
+	if token.Token != "a.b.c" || token.Subject != "dashboard" || len(token.Roles) != 1 || token.Roles[0] != "viewer" {
+		t.Errorf("Unexpected token %+v", token)
+	}
+	if request["ttl"] != "8h0m0s" {
+		t.Errorf("Unexpected request %v", request)
+	}
+
+	if _, err := issueJWT(server.Client(), server.URL+"/missing", "ops", []string{"admin"}, time.Hour); err == nil {
+		t.Error("Expected an error status to be reported")
+	}
+}
@@ -0,0 +1,126 @@
+// Command femctl is the operator's command line for a running fem-broker.
+//
+//	femctl top [flags]       live envelope rates, agent activity and queues
+//	femctl invite [flags]    mint a bootstrap token for agents to register with
+//	femctl drain [flags]     hand the broker's agents and state to a successor
+//	femctl jwt [flags]       issue a JWT granting admin, viewer or agent roles
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/fep-fem/protocol"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "top":
+		if err := runTop(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "femctl top: %v\n", err)
+			os.Exit(1)
+		}
+	case "invite":
+		if err := runInvite(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "femctl invite: %v\n", err)
+			os.Exit(1)
+		}
+	case "drain":
+		if err := runDrain(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "femctl drain: %v\n", err)
+			os.Exit(1)
+		}
+	case "jwt":
+		if err := runJWT(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "femctl jwt: %v\n", err)
+			os.Exit(1)
+		}
+	case "help", "-h", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "femctl: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: femctl <command> [flags]
+
+Commands:
+  top       Watch envelope rates, agent activity, errors and queue depths live
+  invite    Mint a bootstrap token admitting agents to a broker run with -invite-only
+  drain     Hand the broker's agents and state to a successor for a rolling upgrade
+  jwt       Issue a JWT for the admin API (admin or viewer role) or agent registration
+
+Run femctl <command> -h for the command's flags.
+`)
+}
+
+// connection holds the flags every command uses to reach the broker
+type connection struct {
+	broker      string
+	caFile      string
+	fingerprint string
+	insecure    bool
+	token       string
+}
+
+func (c *connection) register(flags *flag.FlagSet) {
+	flags.StringVar(&c.broker, "broker", "https://localhost:4433", "URL of the broker")
+	flags.StringVar(&c.caFile, "ca", "", "PEM file of the CA that signed the broker's certificate")
+	flags.StringVar(&c.fingerprint, "cert-fingerprint", "", "SHA-256 fingerprint of the broker's certificate to pin, as logged at startup and served at /identity")
+	flags.BoolVar(&c.insecure, "insecure", false, "Accept any certificate, such as the broker's generated self-signed one")
+	flags.StringVar(&c.token, "token", os.Getenv("FEMCTL_TOKEN"), "The broker's -admin-token, or a JWT granting the admin or viewer role (default $FEMCTL_TOKEN)")
+}
+
+// client returns an HTTP client trusting the broker as the flags say and
+// presenting the admin token
+func (c *connection) client() (*http.Client, error) {
+	if c.fingerprint != "" {
+		pins, err := protocol.NewBrokerPins(protocol.PinConfig{CertFingerprints: []string{c.fingerprint}})
+		if err != nil {
+			return nil, err
+		}
+		client := pins.HTTPClient()
+		client.Transport = &bearerTransport{token: c.token, next: client.Transport}
+		return client, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: c.insecure, MinVersion: tls.VersionTLS13}
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.caFile)
+		}
+	}
+	return &http.Client{Transport: &bearerTransport{token: c.token, next: &http.Transport{TLSClientConfig: config}}}, nil
+}
+
+// bearerTransport adds the admin token to each request
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token == "" {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Sort orders for the agent table
+const (
+	sortRate   = "rate"
+	sortErrors = "errors"
+	sortQueue  = "queue"
+	sortName   = "name"
+)
+
+// reconnectDelay is how long top waits before reopening a dropped stream
+const reconnectDelay = 2 * time.Second
+
+// snapshot mirrors the broker's MonitorSnapshot
+type snapshot struct {
+	At        time.Time        `json:"at"`
+	Started   time.Time        `json:"started"`
+	Envelopes int64            `json:"envelopes"`
+	Errors    int64            `json:"errors"`
+	Types     map[string]int64 `json:"types"`
+	Agents    []agentLine      `json:"agents"`
+	Queues    struct {
+		PendingToolCalls int `json:"pendingToolCalls"`
+		Broadcasts       int `json:"broadcasts"`
+		Streams          int `json:"streams"`
+		Connections      int `json:"connections"`
+	} `json:"queues"`
+	RateLimits struct {
+		Limited map[string]int64 `json:"limited"`
+		Senders int              `json:"senders"`
+	} `json:"rateLimits"`
+}
+
+// limited totals the envelopes turned away by rate limits
+func (s *snapshot) limited() int64 {
+	var total int64
+	for _, count := range s.RateLimits.Limited {
+		total += count
+	}
+	return total
+}
+
+type agentLine struct {
+	ID        string    `json:"id"`
+	Envelopes int64     `json:"envelopes"`
+	Errors    int64     `json:"errors"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Connected bool      `json:"connected"`
+	Stale     bool      `json:"stale"`
+	InFlight  int       `json:"inFlight"`
+	Queued    int       `json:"queued"`
+}
+
+// topOptions are the flags of femctl top
+type topOptions struct {
+	connection
+	interval time.Duration
+	sortBy   string
+	rows     int
+}
+
+func runTop(args []string) error {
+	var options topOptions
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	options.register(flags)
+	flags.DurationVar(&options.interval, "interval", time.Second, "How often the broker sends a snapshot")
+	flags.StringVar(&options.sortBy, "sort", sortRate, "Order agents by rate, errors, queue or name")
+	flags.IntVar(&options.rows, "rows", 20, "Agents shown (0 for all)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	switch options.sortBy {
+	case sortRate, sortErrors, sortQueue, sortName:
+	default:
+		return fmt.Errorf("unknown sort order %q", options.sortBy)
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Use the alternate screen so the shell is left as it was on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	var previous *snapshot
+	for {
+		err := streamSnapshots(ctx, client, options.broker, options.interval, func(current *snapshot) {
+			fmt.Print("\x1b[H\x1b[2J" + renderTop(options.broker, previous, current, options.sortBy, options.rows))
+			previous = current
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		fmt.Printf("\x1b[H\x1b[2J%s: %v; reconnecting in %v\n", options.broker, err, reconnectDelay)
+		previous = nil
+		select {
+		case <-time.After(reconnectDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// streamSnapshots reads /admin/monitor, calling fn with each snapshot until
+// the stream ends or ctx is done
+func streamSnapshots(ctx context.Context, client *http.Client, broker string, interval time.Duration, fn func(*snapshot)) error {
+	endpoint := strings.TrimSuffix(broker, "/") + "/admin/monitor?interval=" + url.QueryEscape(interval.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return readEvents(resp.Body, fn)
+}
+
+// readEvents parses snapshot events from a Server-Sent Events stream
+func readEvents(r io.Reader, fn func(*snapshot)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		data, found := strings.CutPrefix(scanner.Text(), "data: ")
+		if !found {
+			continue
+		}
+		var current snapshot
+		if err := json.Unmarshal([]byte(data), &current); err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		fn(&current)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// rate is the change of a running total per second between two snapshots
+func rate(before, after int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 || after < before {
+		return 0
+	}
+	return float64(after-before) / elapsed.Seconds()
+}
+
+// renderTop draws one screen. Rates are zero until a second snapshot
+// arrives.
+func renderTop(broker string, previous, current *snapshot, sortBy string, rows int) string {
+	if previous == nil {
+		previous = current
+	}
+	elapsed := current.At.Sub(previous.At)
+	prevAgents := make(map[string]agentLine, len(previous.Agents))
+	for _, agent := range previous.Agents {
+		prevAgents[agent.ID] = agent
+	}
+	prevTypes := previous.Types
+
+	connected := 0
+	for _, agent := range current.Agents {
+		if agent.Connected {
+			connected++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s  up %s  %.1f env/s  %.1f err/s  agents %d (%d connected)\n",
+		broker, current.At.Sub(current.Started).Truncate(time.Second),
+		rate(previous.Envelopes, current.Envelopes, elapsed), rate(previous.Errors, current.Errors, elapsed),
+		len(current.Agents), connected)
+	fmt.Fprintf(&out, "queues: %d pending tool calls, %d broadcasts, %d streams, %d connections\n",
+		current.Queues.PendingToolCalls, current.Queues.Broadcasts, current.Queues.Streams, current.Queues.Connections)
+	fmt.Fprintf(&out, "rate limited: %.1f/s, %d total, %d senders tracked\n\n",
+		rate(previous.limited(), current.limited(), elapsed), current.limited(), current.RateLimits.Senders)
+
+	table := tabwriter.NewWriter(&out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	types := make([]string, 0, len(current.Types))
+	for envType := range current.Types {
+		types = append(types, envType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		a, b := current.Types[types[i]]-prevTypes[types[i]], current.Types[types[j]]-prevTypes[types[j]]
+		if a != b {
+			return a > b
+		}
+		return types[i] < types[j]
+	})
+	fmt.Fprintln(table, "TYPE\tRATE/s\tTOTAL\t")
+	for _, envType := range types {
+		fmt.Fprintf(table, "%s\t%.1f\t%d\t\n", envType, rate(prevTypes[envType], current.Types[envType], elapsed), current.Types[envType])
+	}
+	table.Flush()
+	out.WriteString("\n")
+
+	type row struct {
+		agentLine
+		rate, errRate float64
+	}
+	agents := make([]row, 0, len(current.Agents))
+	for _, agent := range current.Agents {
+		before := prevAgents[agent.ID]
+		agents = append(agents, row{
+			agentLine: agent,
+			rate:      rate(before.Envelopes, agent.Envelopes, elapsed),
+			errRate:   rate(before.Errors, agent.Errors, elapsed),
+		})
+	}
+	sort.SliceStable(agents, func(i, j int) bool {
+		a, b := agents[i], agents[j]
+		switch sortBy {
+		case sortErrors:
+			if a.errRate != b.errRate {
+				return a.errRate > b.errRate
+			}
+			if a.Errors != b.Errors {
+				return a.Errors > b.Errors
+			}
+		case sortQueue:
+			if a.Queued+a.InFlight != b.Queued+b.InFlight {
+				return a.Queued+a.InFlight > b.Queued+b.InFlight
+			}
+		case sortRate:
+			if a.rate != b.rate {
+				return a.rate > b.rate
+			}
+		}
+		return a.ID < b.ID
+	})
+
+	table = tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "AGENT\tRATE/s\tERR/s\tTOTAL\tERRORS\tIN-FLIGHT\tQUEUED\tSTATE\tLAST SEEN")
+	for i, agent := range agents {
+		if rows > 0 && i == rows {
+			fmt.Fprintf(table, "... %d more\n", len(agents)-rows)
+			break
+		}
+		state := "offline"
+		switch {
+		case agent.Stale:
+			state = "stale"
+		case agent.Connected:
+			state = "connected"
+		}
+		lastSeen := "-"
+		if !agent.LastSeen.IsZero() {
+			lastSeen = current.At.Sub(agent.LastSeen).Truncate(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(table, "%s\t%.1f\t%.1f\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			agent.ID, agent.rate, agent.errRate, agent.Envelopes, agent.Errors, agent.InFlight, agent.Queued, state, lastSeen)
+	}
+	table.Flush()
+	return out.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadEvents(t *testing.T) {
+	stream := ": connected\n\n" +
+		"event: snapshot\ndata: {\"envelopes\":3,\"agents\":[{\"id\":\"agent-a\",\"envelopes\":3}]}\n\n" +
+		"event: snapshot\ndata: {\"envelopes\":7}\n\n"
+
+	var totals []int64
+	err := readEvents(strings.NewReader(stream), func(s *snapshot) { totals = append(totals, s.Envelopes) })
+	if err != io.EOF {
+		t.Errorf("Expected the stream to end with EOF, got %v", err)
+	}
+	if len(totals) != 2 || totals[0] != 3 || totals[1] != 7 {
+		t.Errorf("Unexpected snapshots %v", totals)
+	}
+}
+
+func TestRenderTop(t *testing.T) {
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	previous := &snapshot{
+		At: start, Started: start.Add(-time.Hour), Envelopes: 100, Errors: 4,
+		Types: map[string]int64{"toolCall": 60, "emitEvent": 40},
+		Agents: []agentLine{
+			{ID: "agent-busy", Envelopes: 50, Errors: 0},
+			{ID: "agent-failing", Envelopes: 50, Errors: 4},
+		},
+	}
+	current := &snapshot{
+		At: start.Add(2 * time.Second), Started: start.Add(-time.Hour), Envelopes: 120, Errors: 8,
+		Types: map[string]int64{"toolCall": 76, "emitEvent": 44},
+		Agents: []agentLine{
+			{ID: "agent-busy", Envelopes: 66, Connected: true, InFlight: 3, Queued: 9, LastSeen: start.Add(time.Second)},
+			{ID: "agent-failing", Envelopes: 54, Errors: 8, Stale: true},
+		},
+	}
+
+	current.RateLimits.Limited = map[string]int64{"toolCall": 6}
+
+	screen := renderTop("https://broker", previous, current, sortRate, 0)
+	if !strings.Contains(screen, "10.0 env/s") || !strings.Contains(screen, "2.0 err/s") || !strings.Contains(screen, "rate limited: 3.0/s, 6 total") {
+		t.Errorf("Expected broker-wide rates, got:\n%s", screen)
+	}
+	if strings.Index(screen, "toolCall") > strings.Index(screen, "emitEvent") {
+		t.Errorf("Expected the busiest type first, got:\n%s", screen)
+	}
+	if strings.Index(screen, "agent-busy") > strings.Index(screen, "agent-failing") {
+		t.Errorf("Expected the busiest agent first, got:\n%s", screen)
+	}
+	if !strings.Contains(screen, "connected") || !strings.Contains(screen, "stale") || !strings.Contains(screen, "1s ago") {
+		t.Errorf("Expected agent states, got:\n%s", screen)
+	}
+
+	screen = renderTop("https://broker", previous, current, sortErrors, 1)
+	if !strings.Contains(screen, "agent-failing") || strings.Contains(screen, "agent-busy") || !strings.Contains(screen, "... 1 more") {
+		t.Errorf("Expected only the failing agent, got:\n%s", screen)
+	}
+
+	// The first screen has no previous snapshot to take rates from
+	if screen := renderTop("https://broker", nil, current, sortRate, 0); !strings.Contains(screen, "0.0 env/s") {
+		t.Errorf("Expected no rates on the first screen, got:\n%s", screen)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/fep-fem/protocol"
+)
+
+// supportedCodecs lists the envelope content types the broker accepts,
+// advertised to clients on every response
+var supportedCodecs = strings.Join([]string{
+	protocol.ContentTypeJSON,
+	protocol.ContentTypeMsgPack,
+	protocol.ContentTypeCBOR,
+}, ", ")
+
+// requestCodec selects the codec for a request body. Unknown content types
+// fall back to JSON so existing clients that omit the header keep working.
+func requestCodec(r *http.Request) protocol.Codec {
+	if codec := protocol.CodecForContentType(r.Header.Get("Content-Type")); codec != nil {
+		return codec
+	}
+	return protocol.JSONCodec
+}
+
+// dispatchWithCodec dispatches an envelope and re-encodes the JSON response
+// with the given codec
+func (b *Broker) dispatchWithCodec(w http.ResponseWriter, envelope *protocol.GenericEnvelope, codec protocol.Codec) {
+	if codec == protocol.JSONCodec {
+		b.dispatchEnvelope(w, envelope)
+		return
+	}
+
+	recorder := newBufferedResponse()
+	b.dispatchEnvelope(recorder, envelope)
+
+	for key, values := range recorder.header {
+		w.Header()[key] = values
+	}
+
+	body := recorder.body.Bytes()
+	if recorder.status == http.StatusOK && strings.HasPrefix(recorder.header.Get("Content-Type"), protocol.ContentTypeJSON) {
+		if encoded, err := protocol.TranscodeFromJSON(codec, bytes.TrimSpace(body)); err == nil {
+			w.Header().Set("Content-Type", codec.ContentType())
+			body = encoded
+		}
+	}
+
+	w.WriteHeader(recorder.status)
+	w.Write(body)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressMinSize is the smallest body worth compressing. Most envelopes
+// are far smaller; registrations with large body definitions and bulky
+// tool results are not.
+const compressMinSize = 1024
+
+// errUnsupportedEncoding is returned for a Content-Encoding the broker
+// cannot decode
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// contentEncoding compresses and decompresses bodies for one
+// Content-Encoding
+type contentEncoding struct {
+	name      string
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) io.WriteCloser
+}
+
+// contentEncodings are the encodings the broker and MCPClient speak, most
+// preferred first. Builds with the zstd tag add zstd ahead of gzip.
+var contentEncodings = []contentEncoding{
+	{
+		name:      "gzip",
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		newWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	},
+}
+
+// acceptedEncodings lists the encodings for an Accept-Encoding header
+func acceptedEncodings() string {
+	names := make([]string, len(contentEncodings))
+	for i, encoding := range contentEncodings {
+		names[i] = encoding.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func findContentEncoding(name string) (contentEncoding, bool) {
+	for _, encoding := range contentEncodings {
+		if strings.EqualFold(encoding.name, name) {
+			return encoding, true
+		}
+	}
+	return contentEncoding{}, false
+}
+
+// decodedBody returns body with the Content-Encoding in header removed. A
+// single encoding is accepted; stacked encodings are not.
+func decodedBody(header http.Header, body io.Reader) (io.Reader, error) {
+	name := strings.TrimSpace(header.Get("Content-Encoding"))
+	if name == "" || strings.EqualFold(name, "identity") {
+		return body, nil
+	}
+	encoding, ok := findContentEncoding(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %q, accepted: %s", errUnsupportedEncoding, name, acceptedEncodings())
+	}
+	return encoding.newReader(body)
+}
+
+// negotiateEncoding picks the encoding to answer with: the most preferred
+// of ours that an Accept-Encoding header accepts
+func negotiateEncoding(accept string) (contentEncoding, bool) {
+	if accept == "" {
+		return contentEncoding{}, false
+	}
+
+	accepted := make(map[string]bool)
+	for _, item := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		accepted[name] = true
+		// An explicit q=0 refuses the encoding
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				accepted[name] = false
+			}
+		}
+	}
+
+	for _, encoding := range contentEncodings {
+		if ok, listed := accepted[encoding.name]; listed && ok || !listed && accepted["*"] {
+			return encoding, true
+		}
+	}
+	return contentEncoding{}, false
+}
+
+// compressBody compresses data with encoding
+func compressBody(encoding contentEncoding, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := encoding.newWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeEncodedResponse copies a buffered response to w, compressing its
+// body with encoding if it is large enough to be worth it
+func writeEncodedResponse(w http.ResponseWriter, recorder *bufferedResponse, encoding contentEncoding) {
+	for key, values := range recorder.header {
+		w.Header()[key] = values
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	body := recorder.body.Bytes()
+	if len(body) >= compressMinSize && recorder.header.Get("Content-Encoding") == "" {
+		if compressed, err := compressBody(encoding, body); err == nil && len(compressed) < len(body) {
+			w.Header().Set("Content-Encoding", encoding.name)
+			w.Header().Del("Content-Length")
+			body = compressed
+		}
+	}
+
+	w.WriteHeader(recorder.status)
+	w.Write(body)
+}
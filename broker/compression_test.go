@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	// A wildcard takes the preferred encoding, zstd in builds that have it
+	preferred, otherThanGzip := contentEncodings[0].name, ""
+	if preferred != "gzip" {
+		otherThanGzip = preferred
+	}
+	for accept, want := range map[string]string{
+		"":                  "",
+		"gzip":              "gzip",
+		"br, GZIP;q=0.5":    "gzip",
+		"gzip;q=0":          "",
+		"*":                 preferred,
+		"*, gzip;q=0":       otherThanGzip,
+		"identity, deflate": "",
+	} {
+		encoding, ok := negotiateEncoding(accept)
+		if ok != (want != "") || encoding.name != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", accept, encoding.name, want)
+		}
+	}
+}
+
+func TestBrokerCompressedEnvelopes(t *testing.T) {
+	broker := NewBroker()
+	tools := make([]protocol.MCPTool, 50)
+	for i := range tools {
+		tools[i] = protocol.MCPTool{Name: "math.op" + strings.Repeat("x", i), Description: "An arithmetic operation on two numbers"}
+	}
+	broker.mcpRegistry.RegisterAgent("math-agent", &MCPAgent{ID: "math-agent", Tools: tools, LastHeartbeat: time.Now()})
+
+	discover := func(encoding string, compress bool) *http.Request {
+		env := protocol.NewEnvelope(protocol.EnvelopeDiscoverTools, "client")
+		env.Body, _ = json.Marshal(protocol.DiscoverToolsBody{Query: protocol.ToolQuery{Capabilities: []string{"math.*"}}, RequestID: "req-1"})
+		data, _ := json.Marshal(env)
+		if compress {
+			data, _ = compressBody(contentEncodings[len(contentEncodings)-1], data)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+		req.Header.Set("Content-Type", protocol.ContentTypeJSON)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		return req
+	}
+
+	// A gzipped request is read, and the large response is gzipped back
+	recorder := httptest.NewRecorder()
+	broker.ServeHTTP(recorder, discover("gzip", true))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped 200, got %d %v", recorder.Code, recorder.Header())
+	}
+	if !strings.Contains(recorder.Header().Get("Accept-Encoding"), "gzip") {
+		t.Errorf("Expected the broker to advertise gzip, got %q", recorder.Header().Get("Accept-Encoding"))
+	}
+	reader, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("Response is not gzip: %v", err)
+	}
+	payload, _ := io.ReadAll(reader)
+	if !bytes.Contains(payload, []byte("math-agent")) {
+		t.Errorf("Unexpected response: %s", payload)
+	}
+
+	// Small responses are sent as they are
+	recorder = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	broker.ServeHTTP(recorder, req)
+	if recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected a small response uncompressed, got %v", recorder.Header())
+	}
+
+	// Encodings the broker does not know are refused
+	recorder = httptest.NewRecorder()
+	broker.ServeHTTP(recorder, discover("br", false))
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for an unknown encoding, got %d", recorder.Code)
+	}
+}
+
+func TestMCPClientCompression(t *testing.T) {
+	broker := NewBroker()
+	// Enough tools that discovery results come back compressed too
+	tools := make([]protocol.MCPTool, 30)
+	for i := range tools {
+		tools[i] = protocol.MCPTool{Name: "math.op" + strings.Repeat("x", i), Description: "An arithmetic operation on two numbers"}
+	}
+	broker.mcpRegistry.RegisterAgent("math-agent", &MCPAgent{ID: "math-agent", Tools: tools, LastHeartbeat: time.Now()})
+	var encodings []string
+	var compressedResponses int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		broker.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != "" {
+			compressedResponses++
+		}
+	}))
+	defer server.Close()
+
+	_, privKey, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{AgentID: "client", BrokerURL: server.URL, PrivateKey: privKey, TLSInsecure: true})
+
+	// The first request learns what the broker accepts; later large ones
+	// are compressed
+	capabilities := make([]string, 200)
+	for i := range capabilities {
+		capabilities[i] = "math.*"
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := client.FindToolsByCapability(capabilities); err != nil {
+			t.Fatalf("Discovery %d failed: %v", i, err)
+		}
+		client.RefreshCache()
+	}
+	if len(encodings) != 2 || encodings[0] != "" || encodings[1] != contentEncodings[0].name {
+		t.Errorf("Expected the second request compressed, got %q", encodings)
+	}
+	if compressedResponses != 2 {
+		t.Errorf("Expected both responses compressed, got %d", compressedResponses)
+	}
+
+	plain := NewMCPClient(MCPClientConfig{AgentID: "plain", BrokerURL: server.URL, PrivateKey: privKey, TLSInsecure: true, DisableCompression: true})
+	for i := 0; i < 2; i++ {
+		if _, err := plain.FindToolsByCapability(capabilities); err != nil {
+			t.Fatalf("Discovery failed: %v", err)
+		}
+		plain.RefreshCache()
+	}
+	if encodings[len(encodings)-1] != "" {
+		t.Errorf("Expected a client with compression disabled to send plain requests, got %q", encodings)
+	}
+}
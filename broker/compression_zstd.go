@@ -0,0 +1,29 @@
+//go:build zstd
+
+package main
+
+import (
+	"io"
+
+	"github.com/fep-fem/protocol"
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	zstdEncoding := contentEncoding{
+		name: "zstd",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			// A window no larger than an envelope bounds the decoder's memory
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(protocol.MaxEnvelopeSize))
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer) io.WriteCloser {
+			encoder, _ := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+			return encoder
+		},
+	}
+	contentEncodings = append([]contentEncoding{zstdEncoding}, contentEncodings...)
+}
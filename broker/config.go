@@ -0,0 +1,665 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvPrefix starts the environment variables that override the
+// configuration file, such as FEM_BROKER_STORAGE_DB for storage.db
+const configEnvPrefix = "FEM_BROKER_"
+
+// BrokerConfig is the layout of the broker's YAML configuration file. Each
+// setting has the same meaning as the flag in its flag tag. Flags given on
+// the command line override the environment, which overrides the file.
+type BrokerConfig struct {
+	Listen       string `yaml:"listen" flag:"listen"`
+	ListenUnix   string `yaml:"listen_unix" flag:"listen-unix"`
+	HTTP3Listen  string `yaml:"http3_listen" flag:"http3-listen"`
+	InsecureHTTP bool   `yaml:"insecure_http" flag:"insecure-http"`
+	BrokerID     string `yaml:"broker_id" flag:"broker-id"`
+	Advertise    string `yaml:"advertise" flag:"advertise"`
+
+	TLS struct {
+		Cert          string        `yaml:"cert" flag:"tls-cert"`
+		Key           string        `yaml:"key" flag:"tls-key"`
+		ClientAuth    string        `yaml:"client_auth" flag:"client-auth"`
+		ClientCA      string        `yaml:"client_ca" flag:"client-ca"`
+		WatchInterval time.Duration `yaml:"watch_interval" flag:"tls-watch-interval"`
+		CADir         string        `yaml:"ca_dir" flag:"ca-dir"`
+		CertValidity  time.Duration `yaml:"client_cert_validity" flag:"client-cert-validity"`
+	} `yaml:"tls"`
+
+	ACME struct {
+		Domains   []string `yaml:"domains" flag:"acme-domain"`
+		Email     string   `yaml:"email" flag:"acme-email"`
+		Cache     string   `yaml:"cache" flag:"acme-cache"`
+		Directory string   `yaml:"directory" flag:"acme-directory"`
+	} `yaml:"acme"`
+
+	Identity struct {
+		Key         string `yaml:"key" flag:"identity-key"`
+		PreviousKey string `yaml:"previous_key" flag:"previous-identity-key"`
+	} `yaml:"identity"`
+
+	Storage struct {
+		Backend   string `yaml:"backend" flag:"storage"`
+		DB        string `yaml:"db" flag:"db"`
+		SQLDriver string `yaml:"sql_driver" flag:"sql-driver"`
+
+		EncryptionKeys string `yaml:"encryption_keys" flag:"encryption-keys"`
+		ReplayCache    string `yaml:"replay_cache" flag:"replay-cache"`
+
+		Persistence map[string]string `yaml:"persistence" flag:"persistence"`
+	} `yaml:"storage"`
+
+	Raft struct {
+		ID     string            `yaml:"id" flag:"raft-id"`
+		Listen string            `yaml:"listen" flag:"raft-listen"`
+		Peers  map[string]string `yaml:"peers" flag:"raft-peers"`
+		Dir    string            `yaml:"dir" flag:"raft-dir"`
+		Token  string            `yaml:"token" flag:"raft-token"`
+		CA     string            `yaml:"ca" flag:"raft-ca"`
+		Cert   string            `yaml:"cert" flag:"raft-cert"`
+		Key    string            `yaml:"key" flag:"raft-key"`
+	} `yaml:"raft"`
+
+	Federation struct {
+		Peers           []string      `yaml:"peers" flag:"peers"`
+		GossipInterval  time.Duration `yaml:"gossip_interval" flag:"gossip-interval"`
+		Parent          string        `yaml:"parent" flag:"parent"`
+		CatalogInterval time.Duration `yaml:"catalog_interval" flag:"catalog-interval"`
+
+		Name         string            `yaml:"name" flag:"federation"`
+		TrustChain   string            `yaml:"trust_chain" flag:"trust-chain"`
+		TrustAnchors []string          `yaml:"trust_anchors" flag:"trust-anchors"`
+		PeerTrust    map[string]string `yaml:"peer_trust" flag:"peer-trust"`
+	} `yaml:"federation"`
+
+	Limits struct {
+		ToolTimeout      time.Duration     `yaml:"tool_timeout" flag:"tool-timeout"`
+		OrderingHoldback time.Duration     `yaml:"ordering_holdback" flag:"ordering-holdback"`
+		AgentTTL         time.Duration     `yaml:"agent_ttl" flag:"agent-ttl"`
+		BroadcastTTL     time.Duration     `yaml:"broadcast_ttl" flag:"broadcast-ttl"`
+		AckTimeout       time.Duration     `yaml:"ack_timeout" flag:"ack-timeout"`
+		OutboxTTL        time.Duration     `yaml:"outbox_ttl" flag:"outbox-ttl"`
+		OutboxPriorities map[string]string `yaml:"outbox_priorities" flag:"outbox-priorities"`
+		DedupWindow      time.Duration     `yaml:"dedup_window" flag:"dedup-window"`
+		MaxParamDepth    int               `yaml:"max_param_depth" flag:"max-param-depth"`
+		MaxParamArray    int               `yaml:"max_param_array" flag:"max-param-array"`
+		MaxParamKeys     int               `yaml:"max_param_keys" flag:"max-param-keys"`
+		MaxParamString   int               `yaml:"max_param_string" flag:"max-param-string"`
+		RateLimits       map[string]string `yaml:"rate_limits" flag:"rate-limits"`
+		RateWarnings     string            `yaml:"rate_limit_warnings" flag:"rate-limit-warnings"`
+		RateGrace        time.Duration     `yaml:"rate_limit_grace" flag:"rate-limit-grace"`
+	} `yaml:"limits"`
+
+	Metrics struct {
+		File            string        `yaml:"file" flag:"metrics-file"`
+		Interval        time.Duration `yaml:"interval" flag:"metrics-interval"`
+		Retention       string        `yaml:"retention" flag:"usage-retention"`
+		CompactInterval time.Duration `yaml:"compact_interval" flag:"compact-interval"`
+	} `yaml:"metrics"`
+
+	Ingest struct {
+		Token string `yaml:"token" flag:"ingest-token"`
+	} `yaml:"ingest"`
+
+	CloudEvents struct {
+		Sinks []string `yaml:"sinks" flag:"cloudevents-sinks"`
+		Mode  string   `yaml:"mode" flag:"cloudevents-mode"`
+	} `yaml:"cloudevents"`
+
+	Events struct {
+		Bridges []string `yaml:"bridges" flag:"event-bridges"`
+	} `yaml:"events"`
+
+	Tiers struct {
+		Limits      map[string]string `yaml:"limits" flag:"tier-limits"`
+		Assignments []string          `yaml:"assignments" flag:"tier-assignments"`
+	} `yaml:"tiers"`
+
+	Admin struct {
+		Token         string `yaml:"token" flag:"admin-token"`
+		TokenFile     string `yaml:"token_file" flag:"admin-token-file"`
+		ConfigHistory string `yaml:"config_history" flag:"config-history"`
+
+		JWT struct {
+			Keys         []string `yaml:"keys" flag:"jwt-keys"`
+			Issuer       string   `yaml:"issuer" flag:"jwt-issuer"`
+			Audience     string   `yaml:"audience" flag:"jwt-audience"`
+			Roles        []string `yaml:"roles" flag:"jwt-roles"`
+			Registration bool     `yaml:"registration" flag:"jwt-registration"`
+		} `yaml:"jwt"`
+	} `yaml:"admin"`
+
+	Admission struct {
+		Policy          string        `yaml:"policy" flag:"admission-policy"`
+		RequireKeyProof bool          `yaml:"require_key_proof" flag:"require-key-proof"`
+		SessionTTL      time.Duration `yaml:"session_ttl" flag:"session-ttl"`
+		RequireApproval bool          `yaml:"require_approval" flag:"require-approval"`
+		AutoApprove     []string      `yaml:"auto_approve" flag:"auto-approve"`
+		InviteOnly      bool          `yaml:"invite_only" flag:"invite-only"`
+		Grants          []string      `yaml:"capability_grants" flag:"capability-grants"`
+
+		Reputation map[string]string `yaml:"reputation" flag:"reputation"`
+	} `yaml:"admission"`
+
+	Audit struct {
+		File    string `yaml:"file" flag:"audit-file"`
+		MaxSize int64  `yaml:"max_size" flag:"audit-max-size"`
+		MaxBody int    `yaml:"max_body" flag:"audit-max-body"`
+	} `yaml:"audit"`
+
+	Logging struct {
+		File   string `yaml:"file" flag:"log-file"`
+		Level  string `yaml:"level" flag:"log-level"`
+		Format string `yaml:"format" flag:"log-format"`
+	} `yaml:"logging"`
+}
+
+// BrokerOptions are the broker's settings, from its flags, configuration
+// file and environment
+type BrokerOptions struct {
+	Listen              string
+	ListenUnix          string
+	HTTP3Listen         string
+	InsecureHTTP        bool
+	BrokerID            string
+	Advertise           string
+	TLSCert             string
+	TLSKey              string
+	ClientAuth          string
+	ClientCA            string
+	CADir               string
+	ClientCertValidity  time.Duration
+	TLSWatchInterval    time.Duration
+	ACMEDomains         string
+	ACMEEmail           string
+	ACMECache           string
+	ACMEDirectory       string
+	IdentityKey         string
+	PreviousIdentityKey string
+	StorageKind         string
+	DBPath              string
+	SQLDriver           string
+	EncryptionKeys      string
+	ReplayCache         string
+	Persistence         string
+	Raft                RaftConfig
+	RaftListen          string
+	RaftPeers           string
+	RaftCA              string
+	RaftCert            string
+	RaftKey             string
+	Peers               string
+	GossipInterval      time.Duration
+	Parent              string
+	CatalogInterval     time.Duration
+	Federation          string
+	TrustChain          string
+	TrustAnchors        string
+	PeerTrust           string
+	ToolTimeout         time.Duration
+	OrderingHoldback    time.Duration
+	BroadcastTTL        time.Duration
+	AckTimeout          time.Duration
+	OutboxTTL           time.Duration
+	OutboxPriorities    string
+	DedupWindow         time.Duration
+	AgentTTL            time.Duration
+	ParamLimits         ParamLimits
+	MetricsFile         string
+	MetricsInterval     time.Duration
+	UsageRetention      string
+	CompactInterval     time.Duration
+	IngestToken         string
+	AdminToken          string
+	AdminTokenFile      string
+	ConfigHistory       string
+	JWTKeys             string
+	JWTIssuer           string
+	JWTAudience         string
+	JWTRoles            string
+	JWTRegistration     bool
+	AdmissionPolicy     string
+	RequireKeyProof     bool
+	SessionTTL          time.Duration
+	RequireApproval     bool
+	AutoApprove         string
+	InviteOnly          bool
+	CapabilityGrants    string
+	Reputation          string
+	TierLimits          string
+	RateLimits          string
+	RateLimitWarnings   string
+	RateLimitGrace      time.Duration
+	TierAssignments     string
+	EventBridges        string
+	CloudEventsSinks    string
+	CloudEventsMode     string
+	AuditFile           string
+	AuditMaxSize        int64
+	AuditMaxBody        int
+	LogFile             string
+	LogLevel            string
+	LogFormat           string
+	ConfigPath          string
+	Doctor              bool
+	AgentManifest       string
+
+	flags *flag.FlagSet
+}
+
+// register declares the broker's flags on flags
+func (o *BrokerOptions) register(flags *flag.FlagSet) {
+	o.ParamLimits = defaultParamLimits
+	flags.StringVar(&o.Listen, "listen", ":4433", "Address to listen on")
+	flags.StringVar(&o.ListenUnix, "listen-unix", "", "Unix socket to also serve plain HTTP on, for a local reverse proxy or tests (none if empty)")
+	flags.StringVar(&o.HTTP3Listen, "http3-listen", "", "UDP address to serve HTTP/3 (QUIC) on, advertised with Alt-Svc; needs a build with -tags quic (disabled if empty)")
+	flags.BoolVar(&o.InsecureHTTP, "insecure-http", false, "Serve plain HTTP on -listen instead of TLS, for local development only")
+	flags.DurationVar(&o.ToolTimeout, "tool-timeout", defaultToolCallTimeout, "How long to wait for a tool result before failing the call")
+	flags.DurationVar(&o.OrderingHoldback, "ordering-holdback", defaultOrderingHoldback, "How long an ordered toolCall waits for the calls sequenced before it")
+	flags.DurationVar(&o.BroadcastTTL, "broadcast-ttl", defaultBroadcastTTL, "How long broadcasts are kept for recipients that are not connected, unless the broadcast sets its own TTL")
+	flags.DurationVar(&o.AckTimeout, "ack-timeout", defaultAckTimeout, "How long to wait for an agent's ack before pushing an envelope again, doubling with each attempt")
+	flags.DurationVar(&o.OutboxTTL, "outbox-ttl", defaultOutboxTTL, "How long envelopes pushed to agents that ack are pushed again until acked")
+	flags.StringVar(&o.OutboxPriorities, "outbox-priorities", "", "Which unacked envelopes a full outbox evicts first, lowest priority first, e.g. emitEvent=0,toolResult=3,revoke=never (over the defaults)")
+	flags.DurationVar(&o.DedupWindow, "dedup-window", defaultIdempotencyWindow, "How long the result of a tool call with an idempotency key is replayed to calls repeating the key")
+	flags.StringVar(&o.MetricsFile, "metrics-file", "", "File to persist usage snapshots to (in memory if empty)")
+	flags.DurationVar(&o.MetricsInterval, "metrics-interval", 5*time.Minute, "How often to snapshot usage metrics")
+	flags.StringVar(&o.UsageRetention, "usage-retention", defaultRetentionTiers.String(), "Ages after which usage snapshots are merged hourly, merged daily and dropped (raw=,hourly=,daily=)")
+	flags.DurationVar(&o.CompactInterval, "compact-interval", defaultCompactionInterval, "How often to compact persistent stores (0 disables)")
+	flags.StringVar(&o.IngestToken, "ingest-token", "", "Bearer token required by the /ingest/ webhook endpoints (open if empty)")
+	flags.StringVar(&o.AdminToken, "admin-token", "", "Bearer token required by the /admin/ endpoints (generated and written to -admin-token-file if empty and there are no -jwt-keys)")
+	flags.StringVar(&o.AdminTokenFile, "admin-token-file", "", "File a generated admin token is written to, readable by its owner only (a new file in the temporary directory if empty)")
+	flags.StringVar(&o.ConfigHistory, "config-history", "", "File keeping the signed history of configuration changes across restarts (kept in memory if empty)")
+	flags.StringVar(&o.JWTKeys, "jwt-keys", "", "Comma-separated files of keys trusted to sign JWTs for the /admin/ endpoints and registration: PEM public keys or certificates, or HMAC secrets (only broker-issued JWTs if empty)")
+	flags.StringVar(&o.JWTIssuer, "jwt-issuer", "", "iss claim required of JWTs signed with -jwt-keys (any if empty)")
+	flags.StringVar(&o.JWTAudience, "jwt-audience", "", "aud claim required of JWTs, and set in those the broker issues (any if empty)")
+	flags.StringVar(&o.JWTRoles, "jwt-roles", "", "Comma-separated rules granting roles (admin, viewer or agent) by JWT claim, besides its roles claim, e.g. groups=fem-ops:admin,groups=fem-*:viewer")
+	flags.BoolVar(&o.JWTRegistration, "jwt-registration", false, "Refuse agent registrations without a bearer JWT granting the agent role, whose subject covers the agent's ID")
+	flags.StringVar(&o.AdmissionPolicy, "admission-policy", "", "Rego policy file every envelope must pass before its handler runs, defining data.fem.admission; needs a build with -tags opa (none if empty)")
+	flags.BoolVar(&o.RequireKeyProof, "require-key-proof", false, "Hold back agent registrations until the agent signs a broker challenge with the key it registers")
+	flags.DurationVar(&o.SessionTTL, "session-ttl", defaultSessionTTL, "How long a session token lets an agent's envelopes on a connection skip signature checks after one was verified (0 disables)")
+	flags.BoolVar(&o.RequireApproval, "require-approval", false, "Quarantine new agents until an operator approves them through /admin/registrations or they present an invitation")
+	flags.StringVar(&o.AutoApprove, "auto-approve", "", "Comma-separated rules approving registrations without an operator, by agent ID or declared capability, e.g. agent=worker-*,capability=echo")
+	flags.BoolVar(&o.InviteOnly, "invite-only", false, "Refuse agent registrations without a bootstrap token minted by this broker (femctl invite), limited to the token's capabilities")
+	flags.StringVar(&o.CapabilityGrants, "capability-grants", "", "Comma-separated agent=capability grants letting agents hold the capabilities tools require, when they declare them, besides those of their bootstrap token; needs -require-approval or -invite-only, e.g. worker-*=file.read,ops-*=*")
+	flags.StringVar(&o.Reputation, "reputation", defaultReputationSettings.String(), "How agents' trust scores move with the outcome of their tool calls and decay toward neutral while idle, and when agents are quarantined and released (neutral=,decay=,reward=,penalty=,quarantine=,release=,probation=,recovery=)")
+	flags.StringVar(&o.RateLimits, "rate-limits", "", "Envelopes each agent, or each address for unregistered senders, may send per type, e.g. toolCall=20/s,*=100/s (unlimited if empty)")
+	flags.StringVar(&o.RateLimitWarnings, "rate-limit-warnings", defaultRateLimitWarnings, "Comma-separated percentages of a rate limit at which senders get a quota warning header, and agents a quota.warning event (none if empty)")
+	flags.DurationVar(&o.RateLimitGrace, "rate-limit-grace", 0, "How long a sender that runs out of its rate limit is still let through, with a warning, before it is refused (0 refuses at once)")
+	flags.StringVar(&o.TierLimits, "tier-limits", "", "Tool calls each caller may make per service tier, e.g. free=2/s,standard=600/m (unlimited if left out)")
+	flags.StringVar(&o.TierAssignments, "tier-assignments", "", "Comma-separated pattern=tier pairs putting tools, by name or capability, in the free, standard or premium tier; the first match wins")
+	flags.StringVar(&o.StorageKind, "storage", StorageMemory, "Storage backend for agents, tools, subscriptions and nonces (memory, bolt, sql, postgres, redis or raft)")
+	flags.StringVar(&o.DBPath, "db", "", "BoltDB file, SQL data source name, Postgres connection string or Redis URL for the storage backend")
+	flags.StringVar(&o.SQLDriver, "sql-driver", "pgx", "database/sql driver name for sql storage")
+	flags.StringVar(&o.Persistence, "persistence", "", "Where accepted envelopes are persisted, by type, e.g. toolCall=store:720h,revoke=store,renderInstruction=none,*=audit (audit journal for types left out)")
+	flags.StringVar(&o.ReplayCache, "replay-cache", "", "Redis (redis://host:port) or memcached (memcache://host:port,...) server recording nonces for replay protection, shared by replicas serving the same agents (the storage backend if empty)")
+	flags.StringVar(&o.EncryptionKeys, "encryption-keys", "", "File of per-namespace keys to encrypt stored agents, tools and subscriptions with (unencrypted if empty)")
+	flags.StringVar(&o.EventBridges, "event-bridges", "", "Comma-separated from>to=pattern bridges forwarding matching events from one namespace's agents to another's subscribers; without one, events stay in their namespace")
+	flags.StringVar(&o.CloudEventsSinks, "cloudevents-sinks", "", "Comma-separated URLs to export accepted events to as CloudEvents")
+	flags.StringVar(&o.CloudEventsMode, "cloudevents-mode", CloudEventsBinary, "CloudEvents content mode for export (binary or structured)")
+	flags.DurationVar(&o.AgentTTL, "agent-ttl", 0, "Mark agents stale after this long without a heartbeat, and evict them after three times as long (0 disables)")
+	flags.IntVar(&o.ParamLimits.MaxDepth, "max-param-depth", o.ParamLimits.MaxDepth, "Maximum nesting depth of toolCall parameters (0 for no limit)")
+	flags.IntVar(&o.ParamLimits.MaxArrayLength, "max-param-array", o.ParamLimits.MaxArrayLength, "Maximum elements in any toolCall parameter array (0 for no limit)")
+	flags.IntVar(&o.ParamLimits.MaxObjectKeys, "max-param-keys", o.ParamLimits.MaxObjectKeys, "Maximum keys in any toolCall parameter object (0 for no limit)")
+	flags.IntVar(&o.ParamLimits.MaxStringLength, "max-param-string", o.ParamLimits.MaxStringLength, "Maximum bytes in any toolCall parameter string (0 for no limit)")
+	flags.StringVar(&o.BrokerID, "broker-id", defaultBrokerID, "Identity this broker signs envelopes with; must be unique among federated brokers")
+	flags.StringVar(&o.Advertise, "advertise", "", "URL peer brokers use to reach this broker (defaults to https://localhost and the listen port)")
+	flags.StringVar(&o.Peers, "peers", "", "Comma-separated URLs of peer brokers to federate with")
+	flags.DurationVar(&o.GossipInterval, "gossip-interval", defaultGossipInterval, "How often to exchange registry digests with peer brokers (0 disables)")
+	flags.StringVar(&o.Parent, "parent", "", "URL of the parent broker to join as a child, publishing the catalog of tools below this broker to it")
+	flags.DurationVar(&o.CatalogInterval, "catalog-interval", defaultCatalogInterval, "How often a child broker sends its tool catalog to its parent")
+	flags.StringVar(&o.Federation, "federation", "", "Federation this broker belongs to, named with -trust-chain in its registrations with peers")
+	flags.StringVar(&o.TrustChain, "trust-chain", "", "JSON file of trust links from an anchor of -federation to this broker's identity key, presented to peers")
+	flags.StringVar(&o.TrustAnchors, "trust-anchors", "", "Comma-separated federation=key pairs of trusted root keys; peers must present a chain from an anchor of their federation (any signed peer if empty)")
+	flags.StringVar(&o.PeerTrust, "peer-trust", "", "Comma-separated broker=weight pairs, from 0 to 1, scaling the trust score of tool listings learned from each peer; 0 ignores a peer's listings and * sets the rest (1 if left out)")
+	flags.StringVar(&o.Raft.ID, "raft-id", "", "This node's ID in the raft cluster (defaults to -broker-id)")
+	flags.StringVar(&o.RaftListen, "raft-listen", ":4434", "Address raft storage serves its peers on")
+	flags.StringVar(&o.RaftPeers, "raft-peers", "", "Comma-separated id=url pairs naming the other nodes of the raft cluster")
+	flags.StringVar(&o.Raft.Dir, "raft-dir", "", "Directory raft storage keeps its log in (in memory if empty)")
+	flags.StringVar(&o.Raft.Token, "raft-token", "", "Shared secret raft nodes authenticate each other with (required with -storage raft)")
+	flags.StringVar(&o.RaftCert, "raft-cert", "", "PEM certificate chain the raft listener serves, which the other nodes must trust (required with -storage raft)")
+	flags.StringVar(&o.RaftKey, "raft-key", "", "PEM private key for -raft-cert")
+	flags.StringVar(&o.RaftCA, "raft-ca", "", "PEM certificates the other nodes' raft certificates must be issued by (the system's roots if empty)")
+	flags.StringVar(&o.ConfigPath, "config", "", "YAML configuration file; FEM_BROKER_* variables and command-line flags override it (default $FEM_BROKER_CONFIG)")
+	flags.StringVar(&o.TLSCert, "tls-cert", "", "PEM certificate chain to serve (a self-signed certificate is generated if empty)")
+	flags.StringVar(&o.TLSKey, "tls-key", "", "PEM private key for -tls-cert")
+	flags.DurationVar(&o.TLSWatchInterval, "tls-watch-interval", defaultCertWatchInterval, "How often to check -tls-cert and -tls-key for a renewed certificate (0 disables)")
+	flags.StringVar(&o.ACMEDomains, "acme-domain", "", "Comma-separated domains to get a certificate for from an ACME CA such as Let's Encrypt, instead of -tls-cert")
+	flags.StringVar(&o.ACMEEmail, "acme-email", "", "Contact email for the ACME account")
+	flags.StringVar(&o.ACMECache, "acme-cache", "", "Directory keeping the ACME account key and certificate across restarts")
+	flags.StringVar(&o.ACMEDirectory, "acme-directory", acme.LetsEncryptURL, "ACME directory URL, such as Let's Encrypt's staging directory for testing")
+	flags.StringVar(&o.ClientAuth, "client-auth", ClientAuthNone, "Client certificates agents present: none, request (verified and bound to the agent if presented) or require")
+	flags.StringVar(&o.ClientCA, "client-ca", "", "PEM certificates client certificates must be issued by, for -client-auth")
+	flags.StringVar(&o.CADir, "ca-dir", "", "Directory keeping the CA the broker issues agents client certificates from, created if missing (no CA if empty)")
+	flags.DurationVar(&o.ClientCertValidity, "client-cert-validity", defaultClientCertValidity, "How long client certificates issued from -ca-dir last")
+	flags.StringVar(&o.IdentityKey, "identity-key", "", "File holding the Ed25519 key the broker signs envelopes with, created if missing (a new key each start if empty)")
+	flags.StringVar(&o.PreviousIdentityKey, "previous-identity-key", "", "Identity key being rotated out; the broker publishes a transition signed with it so agents pinning it follow the rotation")
+	flags.StringVar(&o.AuditFile, "audit-file", "", "Append-only, hash-chained journal of accepted envelopes, those -persistence sends to the audit journal (disabled if empty)")
+	flags.Int64Var(&o.AuditMaxSize, "audit-max-size", defaultAuditMaxSize, "Bytes at which the audit journal is rotated")
+	flags.IntVar(&o.AuditMaxBody, "audit-max-body", defaultAuditMaxBody, "Largest envelope body recorded in the audit journal; larger bodies are recorded by hash")
+	flags.StringVar(&o.LogFile, "log-file", "", "File to append the log to (stdout if empty)")
+	flags.StringVar(&o.LogLevel, "log-level", "info", "Least severe log records written: debug, info, warn or error")
+	flags.StringVar(&o.LogFormat, "log-format", LogFormatText, "Log record format: text (key=value) or json")
+	flags.BoolVar(&o.Doctor, "doctor", false, "Check the configuration, certificate, storage, peers and clock, then exit instead of serving")
+	flags.StringVar(&o.AgentManifest, "agent-manifest", "", "Run the agent a YAML or JSON manifest declares instead of serving a broker")
+}
+
+// LoadBrokerOptions declares the broker's flags on flags, parses args, and
+// fills in settings the command line left out from the configuration file
+// and environ
+func LoadBrokerOptions(flags *flag.FlagSet, args, environ []string) (*BrokerOptions, error) {
+	options := &BrokerOptions{flags: flags}
+	options.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := options.ConfigPath
+	if path == "" {
+		path = configEnv(environ, configEnvPrefix+"CONFIG")
+	}
+	if err := ApplyConfig(flags, path, environ); err != nil {
+		return nil, err
+	}
+	options.ConfigPath = path
+
+	if options.Raft.ID == "" {
+		options.Raft.ID = options.BrokerID
+	}
+	return options, nil
+}
+
+// values returns every flag's value as text, by flag name
+func (o *BrokerOptions) values() map[string]string {
+	values := make(map[string]string)
+	o.flags.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values
+}
+
+// configEnv returns a variable from environ
+func configEnv(environ []string, name string) string {
+	for _, entry := range environ {
+		if key, value, found := strings.Cut(entry, "="); found && key == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// configSetting is one value taken from the file or the environment
+type configSetting struct {
+	key   string // Where the value came from, e.g. "storage.db" or "FEM_BROKER_STORAGE_DB"
+	flag  string
+	value string
+}
+
+// configValidators check values beyond what their flag's type accepts
+var configValidators = map[string]func(string) error{
+	"listen": func(value string) error {
+		_, _, err := net.SplitHostPort(value)
+		return err
+	},
+	"http3-listen": func(value string) error {
+		_, _, err := net.SplitHostPort(value)
+		return err
+	},
+	"advertise": checkBrokerURL,
+	"storage": func(value string) error {
+		switch value {
+		case StorageMemory, StorageBolt, StorageSQL, StoragePostgres, StorageRedis, StorageRaft:
+			return nil
+		}
+		return fmt.Errorf("unknown storage backend %q (want memory, bolt, sql, postgres, redis or raft)", value)
+	},
+	"peers": func(value string) error {
+		for _, peer := range parseSinkList(value) {
+			if err := checkBrokerURL(peer); err != nil {
+				return fmt.Errorf("%s: %w", peer, err)
+			}
+		}
+		return nil
+	},
+	"parent": checkBrokerURL,
+	"catalog-interval": func(value string) error {
+		interval, err := time.ParseDuration(value)
+		if err == nil && (interval <= 0 || interval >= childCatalogTTL) {
+			err = fmt.Errorf("must be more than 0 and less than %s, after which parents drop a catalog", childCatalogTTL)
+		}
+		return err
+	},
+	"ack-timeout": func(value string) error {
+		timeout, err := time.ParseDuration(value)
+		if err == nil && timeout <= 0 {
+			err = fmt.Errorf("must be more than 0")
+		}
+		return err
+	},
+	"dedup-window": func(value string) error {
+		window, err := time.ParseDuration(value)
+		if err == nil && window <= 0 {
+			err = fmt.Errorf("must be more than 0")
+		}
+		return err
+	},
+	"trust-anchors": func(value string) error {
+		_, err := ParseTrustAnchors(value)
+		return err
+	},
+	"peer-trust": func(value string) error {
+		_, err := ParsePeerTrust(value)
+		return err
+	},
+	"raft-peers": func(value string) error {
+		_, err := ParseRaftPeers(value)
+		return err
+	},
+	"usage-retention": func(value string) error {
+		_, err := ParseRetentionTiers(value)
+		return err
+	},
+	"client-auth": func(value string) error {
+		_, err := ParseClientAuth(value)
+		return err
+	},
+	"persistence": func(value string) error {
+		_, err := ParsePersistencePolicy(value)
+		return err
+	},
+	"rate-limits": func(value string) error {
+		_, err := ParseRateLimits(value)
+		return err
+	},
+	"rate-limit-warnings": func(value string) error {
+		_, err := ParseRateLimitWarnings(value)
+		return err
+	},
+	"outbox-priorities": func(value string) error {
+		_, err := ParseOutboxPriorities(value)
+		return err
+	},
+	"tier-limits": func(value string) error {
+		_, err := ParseTierLimits(value)
+		return err
+	},
+	"reputation": func(value string) error {
+		_, err := ParseReputationSettings(value)
+		return err
+	},
+	"event-bridges": func(value string) error {
+		_, err := ParseEventBridges(value)
+		return err
+	},
+	"tier-assignments": func(value string) error {
+		_, err := ParseTierAssignments(value)
+		return err
+	},
+	"jwt-keys": func(value string) error {
+		_, err := LoadJWTKeys(value)
+		return err
+	},
+	"jwt-roles": func(value string) error {
+		_, err := ParseRoleRules(value)
+		return err
+	},
+	"auto-approve": func(value string) error {
+		_, err := ParseApprovalRules(value)
+		return err
+	},
+	"capability-grants": func(value string) error {
+		_, err := ParseCapabilityGrants(value)
+		return err
+	},
+	"cloudevents-mode": func(value string) error {
+		return NewCloudEventsExporter("").Configure(nil, value)
+	},
+}
+
+// ApplyConfig sets the flags of flags from the configuration file at path,
+// if any, and from FEM_BROKER_* variables in environ. Flags already set on
+// the command line are left alone. Errors name the offending key.
+func ApplyConfig(flags *flag.FlagSet, path string, environ []string) error {
+	var settings []configSetting
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if settings, err = parseConfig(data); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	settings = append(settings, configFromEnv(environ)...)
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, setting := range settings {
+		if explicit[setting.flag] {
+			continue
+		}
+		if validate, exists := configValidators[setting.flag]; exists {
+			if err := validate(setting.value); err != nil {
+				return fmt.Errorf("%s: %w", setting.key, err)
+			}
+		}
+		if err := flags.Set(setting.flag, setting.value); err != nil {
+			return fmt.Errorf("%s: %w", setting.key, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig reads the settings given in a YAML file, in file order
+func parseConfig(data []byte) ([]configSetting, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	var settings []configSetting
+	err := walkConfig(document.Content[0], reflect.TypeOf(BrokerConfig{}), "", &settings)
+	return settings, err
+}
+
+// walkConfig collects the settings of a mapping node laid out as typ
+func walkConfig(node *yaml.Node, typ reflect.Type, prefix string, settings *[]configSetting) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: expected a mapping (line %d)", strings.TrimSuffix(prefix, "."), node.Line)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i].Value, node.Content[i+1]
+		key := prefix + name
+
+		field, found := configField(typ, name)
+		if !found {
+			return fmt.Errorf("%s: unknown key (line %d)", key, node.Content[i].Line)
+		}
+		if field.Type.Kind() == reflect.Struct {
+			if err := walkConfig(value, field.Type, key+".", settings); err != nil {
+				return err
+			}
+			continue
+		}
+
+		decoded := reflect.New(field.Type)
+		if err := value.Decode(decoded.Interface()); err != nil {
+			return fmt.Errorf("%s: %v", key, strings.TrimPrefix(err.Error(), "yaml: unmarshal errors:\n  "))
+		}
+		*settings = append(*settings, configSetting{key: key, flag: field.Tag.Get("flag"), value: configValue(decoded.Elem())})
+	}
+	return nil
+}
+
+// configField finds the field of typ for a YAML key
+func configField(typ reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		if field := typ.Field(i); field.Tag.Get("yaml") == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configValue formats a decoded value the way its flag parses it
+func configValue(value reflect.Value) string {
+	switch v := value.Interface().(type) {
+	case time.Duration:
+		return v.String()
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]string:
+		pairs := make([]string, 0, len(v))
+		for id, endpoint := range v {
+			pairs = append(pairs, id+"="+endpoint)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// configFromEnv reads the settings given as FEM_BROKER_* variables. Lists
+// are comma-separated, and raft peers are written id=url.
+func configFromEnv(environ []string) []configSetting {
+	values := make(map[string]string)
+	for _, entry := range environ {
+		if name, value, found := strings.Cut(entry, "="); found && strings.HasPrefix(name, configEnvPrefix) {
+			values[name] = value
+		}
+	}
+
+	var settings []configSetting
+	var walk func(typ reflect.Type, prefix string)
+	walk = func(typ reflect.Type, prefix string) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name := prefix + strings.ToUpper(field.Tag.Get("yaml"))
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type, name+"_")
+				continue
+			}
+			if value, exists := values[name]; exists {
+				settings = append(settings, configSetting{key: name, flag: field.Tag.Get("flag"), value: value})
+			}
+		}
+	}
+	walk(reflect.TypeOf(BrokerConfig{}), configEnvPrefix)
+	return settings
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// configActorReload is the actor of changes made by reloading the
+// configuration on SIGHUP
+const configActorReload = "reload"
+
+// maxConfigUpdate bounds the body of PATCH /admin/config
+const maxConfigUpdate = 64 << 10
+
+// configChangeable are the settings PATCH /admin/config may change: limits,
+// policies and the log level. Secrets, listeners, certificates, storage and
+// federation peers change only through the configuration file.
+var configChangeable = map[string]bool{
+	"tool-timeout":        true,
+	"ordering-holdback":   true,
+	"broadcast-ttl":       true,
+	"ack-timeout":         true,
+	"outbox-ttl":          true,
+	"outbox-priorities":   true,
+	"dedup-window":        true,
+	"max-param-depth":     true,
+	"max-param-array":     true,
+	"max-param-keys":      true,
+	"max-param-string":    true,
+	"rate-limits":         true,
+	"rate-limit-warnings": true,
+	"rate-limit-grace":    true,
+	"tier-limits":         true,
+	"tier-assignments":    true,
+	"admission-policy":    true,
+	"require-key-proof":   true,
+	"session-ttl":         true,
+	"require-approval":    true,
+	"auto-approve":        true,
+	"invite-only":         true,
+	"capability-grants":   true,
+	"reputation":          true,
+	"event-bridges":       true,
+	"persistence":         true,
+	"log-level":           true,
+}
+
+// configSecrets are the settings whose values the configuration API and
+// its history never show
+var configSecrets = map[string]bool{
+	"admin-token":  true,
+	"ingest-token": true,
+	"raft-token":   true,
+}
+
+var (
+	// ErrSettingNotChangeable is returned for updates to settings outside
+	// configChangeable
+	ErrSettingNotChangeable = errors.New("setting cannot be changed at runtime")
+	// ErrConfigVersionConflict is returned for updates made against a
+	// configuration version that is no longer current
+	ErrConfigVersionConflict = errors.New("configuration changed since the given version")
+)
+
+// displayedSetting returns a setting's value as the API shows it, with
+// secrets redacted
+func displayedSetting(name, value string) string {
+	if configSecrets[name] && value != "" {
+		return "<redacted>"
+	}
+	return value
+}
+
+// ConfigSetting is one setting as served by GET /admin/config
+type ConfigSetting struct {
+	Value      string `json:"value"`
+	Default    string `json:"default"`
+	Reloadable bool   `json:"reloadable"`           // Takes effect on reload, without a restart
+	Changeable bool   `json:"changeable"`           // Can be changed through PATCH /admin/config
+	Overridden bool   `json:"overridden,omitempty"` // Was changed through PATCH /admin/config
+}
+
+// ConfigView is the broker's effective configuration
+type ConfigView struct {
+	Version  int64                    `json:"version"`
+	Settings map[string]ConfigSetting `json:"settings"`
+}
+
+// ConfigUpdate is the body of PATCH /admin/config. Settings are given by
+// flag name, as strings, numbers or booleans; null drops an earlier change
+// made through the API, returning the setting to its configured value.
+type ConfigUpdate struct {
+	Settings map[string]interface{} `json:"settings"`
+	Reason   string                 `json:"reason,omitempty"`
+	Version  *int64                 `json:"version,omitempty"` // Refuse the update unless the configuration is at this version
+}
+
+// Effective returns the configuration in effect, by flag name
+func (r *Reloader) Effective() *ConfigView {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	view := &ConfigView{Version: r.history.Version(), Settings: make(map[string]ConfigSetting)}
+	r.current.flags.VisitAll(func(f *flag.Flag) {
+		_, overridden := r.overrides[f.Name]
+		view.Settings[f.Name] = ConfigSetting{
+			Value:      displayedSetting(f.Name, f.Value.String()),
+			Default:    displayedSetting(f.Name, f.DefValue),
+			Reloadable: reloadableSettings[f.Name],
+			Changeable: configChangeable[f.Name],
+			Overridden: overridden,
+		}
+	})
+	return view
+}
+
+// Update changes settings of configChangeable while the broker runs, on
+// behalf of actor. The changed settings are validated and applied as a
+// reload would, leaving everything else as it is, and stay in effect
+// across reloads until they are dropped or the broker restarts. An update
+// with any invalid setting changes nothing.
+func (r *Reloader) Update(update ConfigUpdate, actor string) (*ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if current := r.history.Version(); update.Version != nil && *update.Version != current {
+		return nil, fmt.Errorf("%w: now at version %d", ErrConfigVersionConflict, current)
+	}
+	if len(update.Settings) == 0 {
+		return nil, errors.New("no settings to change")
+	}
+
+	flags := flag.NewFlagSet("update", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	next := &BrokerOptions{flags: flags}
+	next.register(flags)
+	for name, value := range r.current.values() {
+		if err := flags.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	next.ConfigPath = r.current.ConfigPath
+
+	var configured map[string]string
+	overrides := make(map[string]string, len(r.overrides)+len(update.Settings))
+	for name, value := range r.overrides {
+		overrides[name] = value
+	}
+	names := make([]string, 0, len(update.Settings))
+	for name := range update.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !configChangeable[name] {
+			return nil, fmt.Errorf("%w: %s", ErrSettingNotChangeable, name)
+		}
+		var value string
+		switch setting := update.Settings[name].(type) {
+		case nil:
+			// Back to the value of the command line, file or environment
+			if configured == nil {
+				scratch := flag.NewFlagSet("configured", flag.ContinueOnError)
+				scratch.SetOutput(io.Discard)
+				options, err := LoadBrokerOptions(scratch, r.args, r.environ())
+				if err != nil {
+					return nil, err
+				}
+				configured = options.values()
+			}
+			value = configured[name]
+			delete(overrides, name)
+		case string:
+			value = setting
+		case float64:
+			value = strconv.FormatFloat(setting, 'f', -1, 64)
+		case bool:
+			value = strconv.FormatBool(setting)
+		default:
+			return nil, fmt.Errorf("%s: expected a string, number or boolean", name)
+		}
+		if validate, exists := configValidators[name]; exists {
+			if err := validate(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if err := flags.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if update.Settings[name] != nil {
+			overrides[name] = value
+		}
+	}
+
+	result, err := r.apply(next, actor, update.Reason)
+	if err != nil {
+		return nil, err
+	}
+	r.overrides = overrides
+	return result, nil
+}
+
+// ConfigSettingChange is one setting a configuration change changed
+type ConfigSettingChange struct {
+	Setting string `json:"setting"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// ConfigChange is a record in the configuration history. The broker signs
+// each record with its identity key, and each record includes the
+// signature of the one before it, so a record cannot be edited or removed
+// without breaking the history from that point on.
+type ConfigChange struct {
+	Version int64                 `json:"version"`
+	At      time.Time             `json:"at"`
+	Broker  string                `json:"broker"`
+	Actor   string                `json:"actor"` // Who made the change: "jwt:" and a JWT subject, "admin-token" or "reload"
+	Reason  string                `json:"reason,omitempty"`
+	Changes []ConfigSettingChange `json:"changes"`
+	Key     string                `json:"key"`  // Public key the record is signed with
+	Prev    string                `json:"prev"` // Signature of the previous record, empty for the first
+	Sig     string                `json:"sig"`
+}
+
+// signingBytes returns what the record's signature covers: its JSON
+// without the signature
+func (c ConfigChange) signingBytes() ([]byte, error) {
+	c.Sig = ""
+	return json.Marshal(c)
+}
+
+// ConfigHistory keeps the signed records of configuration changes, in
+// memory and, if it was opened with a file, appended to that file as
+// newline-delimited JSON
+type ConfigHistory struct {
+	records []ConfigChange
+	file    *os.File
+	mu      sync.Mutex
+}
+
+// NewConfigHistory creates a history kept in memory only
+func NewConfigHistory() *ConfigHistory {
+	return &ConfigHistory{}
+}
+
+// OpenConfigHistory opens the history kept in the file at path, continuing
+// from the records already in it
+func OpenConfigHistory(path string) (*ConfigHistory, error) {
+	h := &ConfigHistory{}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*maxConfigUpdate)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record ConfigChange
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt configuration history record %d: %w", len(h.records)+1, err)
+		}
+		h.records = append(h.records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	h.file = file
+	return h, nil
+}
+
+// Version returns the version of the last record, 0 before any change
+func (h *ConfigHistory) Version() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) == 0 {
+		return 0
+	}
+	return h.records[len(h.records)-1].Version
+}
+
+// Record signs and appends a change made by actor with the broker's
+// identity key
+func (h *ConfigHistory) Record(b *Broker, actor, reason string, changes []ConfigSettingChange) (*ConfigChange, error) {
+	b.mu.RLock()
+	key := b.privateKey
+	b.mu.RUnlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	record := ConfigChange{
+		Version: 1,
+		At:      time.Now().UTC(),
+		Broker:  b.id,
+		Actor:   actor,
+		Reason:  reason,
+		Changes: changes,
+		Key:     protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+	}
+	if len(h.records) > 0 {
+		last := h.records[len(h.records)-1]
+		record.Version, record.Prev = last.Version+1, last.Sig
+	}
+	data, err := record.signingBytes()
+	if err != nil {
+		return nil, err
+	}
+	record.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+
+	if h.file != nil {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := h.file.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+	}
+	h.records = append(h.records, record)
+	return &record, nil
+}
+
+// Records returns the changes, oldest first
+func (h *ConfigHistory) Records() []ConfigChange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]ConfigChange(nil), h.records...)
+}
+
+// Verify checks the signature of every record against the broker's
+// identity key, or a key it rotated from, and each record's link to the
+// one before it
+func (h *ConfigHistory) Verify(b *Broker) *AuditVerification {
+	keys := b.identityKeys()
+	result := &AuditVerification{Valid: true}
+	var prev ConfigChange
+	for i, record := range h.Records() {
+		if err := record.verify(keys); err != nil {
+			result.Error = err.Error()
+		} else if i > 0 && record.Prev != prev.Sig {
+			result.Error = "record does not follow the previous one"
+		} else if i > 0 && record.Version != prev.Version+1 {
+			result.Error = fmt.Sprintf("expected version %d", prev.Version+1)
+		}
+		if result.Error != "" {
+			result.Valid, result.BrokeAt = false, record.Version
+			return result
+		}
+		prev = record
+		result.Records++
+	}
+	return result
+}
+
+// verify checks the record's signature against the one of keys it names.
+// The key recorded alongside the signature is not trusted by itself, so a
+// record re-signed with another key fails.
+func (c ConfigChange) verify(keys []ed25519.PublicKey) error {
+	var key ed25519.PublicKey
+	for _, trusted := range keys {
+		if protocol.EncodePublicKey(trusted) == c.Key {
+			key = trusted
+			break
+		}
+	}
+	if key == nil {
+		return errors.New("record is not signed by the broker's key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(c.Sig)
+	if err != nil {
+		return fmt.Errorf("record signature encoding: %w", err)
+	}
+	data, err := c.signingBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return errors.New("record signature does not match its contents")
+	}
+	return nil
+}
+
+// Close closes the history file, if any
+func (h *ConfigHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// SetHistory records configuration changes in history
+func (r *Reloader) SetHistory(history *ConfigHistory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.history = history
+}
+
+// adminActor names who made an admin request: the subject of its JWT or
+// the admin token. It returns false for a request that authenticates as
+// neither, whose changes are refused rather than recorded anonymously.
+func (b *Broker) adminActor(r *http.Request) (string, bool) {
+	b.mu.RLock()
+	token := b.adminToken
+	b.mu.RUnlock()
+
+	presented := bearerToken(r)
+	if presented == "" {
+		return "", false
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+		return "admin-token", true
+	}
+	if identity, err := b.verifyJWT(presented, time.Now()); err == nil && identity.Subject != "" {
+		return "jwt:" + identity.Subject, true
+	}
+	return "", false
+}
+
+// handleConfig serves GET and PATCH /admin/config
+func (r *Reloader) handleConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPatch {
+		var update ConfigUpdate
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxConfigUpdate)).Decode(&update); err != nil {
+			http.Error(w, "Invalid configuration update", http.StatusBadRequest)
+			return
+		}
+		actor, authenticated := r.broker.adminActor(req)
+		if !authenticated {
+			http.Error(w, "Configuration changes require the admin token or a JWT with a subject", http.StatusUnauthorized)
+			return
+		}
+		if _, err := r.Update(update, actor); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrConfigVersionConflict) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Effective())
+}
+
+// handleConfigHistory serves GET /admin/config/history
+func (r *Reloader) handleConfigHistory(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	history := r.history
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history.Records())
+}
+
+// handleConfigHistoryVerify serves GET /admin/config/history/verify
+func (r *Reloader) handleConfigHistoryVerify(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	history := r.history
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history.Verify(r.broker))
+}
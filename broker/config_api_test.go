@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigUpdate(t *testing.T) {
+	path := writeConfig(t, "limits:\n  tool_timeout: 10s\n  max_param_depth: 4\n")
+	broker, reloader := startReloadable(t, []string{"-config", path})
+
+	result, err := reloader.Update(ConfigUpdate{
+		Settings: map[string]interface{}{"tool-timeout": "20s", "max-param-depth": float64(8), "invite-only": true},
+		Reason:   "incident 12",
+	}, "jwt:alice")
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if expected := []string{"invite-only", "max-param-depth", "tool-timeout"}; !reflect.DeepEqual(result.Applied, expected) || result.Version != 1 {
+		t.Errorf("Expected %v applied at version 1, got %v at %d", expected, result.Applied, result.Version)
+	}
+	if broker.pending.Timeout() != 20*time.Second || broker.paramLimits.MaxDepth != 8 || !broker.closed {
+		t.Errorf("Settings not swapped in: timeout %v, depth %d, invite-only %v", broker.pending.Timeout(), broker.paramLimits.MaxDepth, broker.closed)
+	}
+
+	// Runtime changes outlast reloads, and null returns to the file's value
+	if err := os.WriteFile(path, []byte("limits:\n  tool_timeout: 15s\n  max_param_depth: 6\n"), 0600); err != nil {
+		t.Fatalf("Failed to rewrite config: %v", err)
+	}
+	if _, err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if broker.pending.Timeout() != 20*time.Second || broker.paramLimits.MaxDepth != 8 {
+		t.Errorf("Expected the runtime changes to outlast the reload, got %v and %d", broker.pending.Timeout(), broker.paramLimits.MaxDepth)
+	}
+	if _, err := reloader.Update(ConfigUpdate{Settings: map[string]interface{}{"tool-timeout": nil}}, "jwt:alice"); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if broker.pending.Timeout() != 15*time.Second {
+		t.Errorf("Expected the timeout to return to the file's 15s, got %v", broker.pending.Timeout())
+	}
+	view := reloader.Effective()
+	if view.Settings["tool-timeout"].Overridden || !view.Settings["max-param-depth"].Overridden || view.Settings["max-param-depth"].Value != "8" {
+		t.Errorf("Unexpected settings: %+v, %+v", view.Settings["tool-timeout"], view.Settings["max-param-depth"])
+	}
+
+	// Nothing changes if any setting is refused
+	stale := int64(1)
+	for _, tc := range []struct {
+		update ConfigUpdate
+		err    error
+	}{
+		{ConfigUpdate{Settings: map[string]interface{}{"tool-timeout": "1m", "admin-token": "mine"}}, ErrSettingNotChangeable},
+		{ConfigUpdate{Settings: map[string]interface{}{"tool-timeout": "1m", "rate-limits": "toolCall=fast"}}, nil},
+		{ConfigUpdate{Settings: map[string]interface{}{"tool-timeout": "1m"}, Version: &stale}, ErrConfigVersionConflict},
+		{ConfigUpdate{}, nil},
+	} {
+		_, err := reloader.Update(tc.update, "jwt:alice")
+		if err == nil || (tc.err != nil && !errors.Is(err, tc.err)) {
+			t.Errorf("%+v: expected %v, got %v", tc.update, tc.err, err)
+		}
+	}
+	if broker.pending.Timeout() != 15*time.Second || reloader.Effective().Version != 2 {
+		t.Errorf("Expected refused updates to change nothing, got %v at version %d", broker.pending.Timeout(), reloader.Effective().Version)
+	}
+}
+
+func TestConfigHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config-history.jsonl")
+	history, err := OpenConfigHistory(path)
+	if err != nil {
+		t.Fatalf("OpenConfigHistory: %v", err)
+	}
+	broker := NewBroker()
+	history.Record(broker, "jwt:alice", "", []ConfigSettingChange{{Setting: "tool-timeout", From: "30s", To: "1m"}})
+	history.Record(broker, "reload", "", []ConfigSettingChange{{Setting: "log-level", From: "info", To: "debug"}})
+	history.Close()
+
+	history, err = OpenConfigHistory(path)
+	if err != nil {
+		t.Fatalf("OpenConfigHistory: %v", err)
+	}
+	defer history.Close()
+	change, err := history.Record(broker, "admin-token", "rollback", []ConfigSettingChange{{Setting: "log-level", From: "debug", To: "info"}})
+	if err != nil || change.Version != 3 {
+		t.Fatalf("Expected the reopened history to continue at version 3, got %+v, %v", change, err)
+	}
+	if result := history.Verify(broker); !result.Valid || result.Records != 3 {
+		t.Fatalf("Expected a valid history of 3 records, got %+v", result)
+	}
+
+	history.records[1].Actor = "jwt:mallory"
+	if result := history.Verify(broker); result.Valid || result.BrokeAt != 2 {
+		t.Errorf("Expected an edited record to break the history, got %+v", result)
+	}
+	history.records = append(history.records[:1], history.records[2:]...)
+	if result := history.Verify(broker); result.Valid || result.BrokeAt != 3 {
+		t.Errorf("Expected a removed record to break the history, got %+v", result)
+	}
+
+	// A history rewritten and re-signed with another key does not verify
+	forger := NewBroker()
+	forged := NewConfigHistory()
+	forged.Record(forger, "jwt:mallory", "", []ConfigSettingChange{{Setting: "tool-timeout", From: "30s", To: "1h"}})
+	if result := forged.Verify(broker); result.Valid || result.BrokeAt != 1 {
+		t.Errorf("Expected a record signed by another key to break the history, got %+v", result)
+	}
+	if result := forged.Verify(forger); !result.Valid {
+		t.Errorf("Expected the record to verify against its signer, got %+v", result)
+	}
+}
+
+func TestConfigAPI(t *testing.T) {
+	broker, reloader := startReloadable(t, []string{"-admin-token", "s3cret"})
+	broker.SetAdminToken("s3cret")
+
+	request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		broker.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodGet, "/admin/config", nil)
+	var view ConfigView
+	json.NewDecoder(w.Body).Decode(&view)
+	if w.Code != http.StatusOK || view.Settings["admin-token"].Value != "<redacted>" || !view.Settings["tool-timeout"].Changeable || view.Settings["listen"].Changeable {
+		t.Fatalf("Unexpected configuration (%d): %+v", w.Code, view.Settings["admin-token"])
+	}
+
+	w = request(http.MethodPatch, "/admin/config", ConfigUpdate{Settings: map[string]interface{}{"dedup-window": "1h"}, Reason: "longer retries", Version: &view.Version})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the update to be accepted, got %d: %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodPatch, "/admin/config", ConfigUpdate{Settings: map[string]interface{}{"dedup-window": "2h"}, Version: &view.Version}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a stale version to conflict, got %d", w.Code)
+	}
+	if w := request(http.MethodPatch, "/admin/config", ConfigUpdate{Settings: map[string]interface{}{"listen": ":9443"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a listener change to be refused, got %d", w.Code)
+	}
+
+	var records []ConfigChange
+	json.NewDecoder(request(http.MethodGet, "/admin/config/history", nil).Body).Decode(&records)
+	if len(records) != 1 || records[0].Actor != "admin-token" || records[0].Reason != "longer retries" || records[0].Changes[0] != (ConfigSettingChange{"dedup-window", "10m0s", "1h0m0s"}) {
+		t.Errorf("Unexpected history: %+v", records)
+	}
+	var verification AuditVerification
+	json.NewDecoder(request(http.MethodGet, "/admin/config/history/verify", nil).Body).Decode(&verification)
+	if !verification.Valid || verification.Records != 1 {
+		t.Errorf("Expected the history to verify, got %+v", verification)
+	}
+
+	// A JWT that grants the admin role but names nobody cannot change settings
+	anonymous, _, err := broker.IssueJWT("", []string{"admin"}, time.Minute)
+	if err != nil {
+		t.Fatalf("IssueJWT: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPatch, "/admin/config", strings.NewReader(`{"settings": {"dedup-window": "3h"}}`))
+	req.Header.Set("Authorization", "Bearer "+anonymous)
+	version := reloader.Effective().Version
+	w = httptest.NewRecorder()
+	broker.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "JWT with a subject") || reloader.Effective().Version != version {
+		t.Errorf("Expected an anonymous change to be refused, got %d at version %d", w.Code, reloader.Effective().Version)
+	}
+}
+
+func TestChangeableSettingsAreReloadable(t *testing.T) {
+	for name := range configChangeable {
+		if !reloadableSettings[name] {
+			t.Errorf("%s can be changed at runtime but is not reloadable", name)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadableSettings are the flags whose changes take effect on reload;
+// changes to any other flag wait for a restart
+var reloadableSettings = map[string]bool{
+	"tls-cert":            true,
+	"tls-key":             true,
+	"tool-timeout":        true,
+	"ordering-holdback":   true,
+	"broadcast-ttl":       true,
+	"ack-timeout":         true,
+	"outbox-ttl":          true,
+	"outbox-priorities":   true,
+	"dedup-window":        true,
+	"max-param-depth":     true,
+	"max-param-array":     true,
+	"max-param-keys":      true,
+	"max-param-string":    true,
+	"ingest-token":        true,
+	"admin-token":         true,
+	"jwt-keys":            true,
+	"jwt-issuer":          true,
+	"jwt-audience":        true,
+	"jwt-roles":           true,
+	"jwt-registration":    true,
+	"admission-policy":    true,
+	"require-key-proof":   true,
+	"session-ttl":         true,
+	"require-approval":    true,
+	"auto-approve":        true,
+	"invite-only":         true,
+	"capability-grants":   true,
+	"reputation":          true,
+	"rate-limits":         true,
+	"rate-limit-warnings": true,
+	"rate-limit-grace":    true,
+	"persistence":         true,
+	"tier-limits":         true,
+	"tier-assignments":    true,
+	"event-bridges":       true,
+	"cloudevents-sinks":   true,
+	"cloudevents-mode":    true,
+	"usage-retention":     true,
+	"peers":               true,
+	"trust-anchors":       true,
+	"peer-trust":          true,
+	"log-level":           true,
+}
+
+// ReloadResult reports what a reload changed
+type ReloadResult struct {
+	At              time.Time `json:"at"`
+	Applied         []string  `json:"applied"`                   // Settings now in effect
+	RestartRequired []string  `json:"restartRequired,omitempty"` // Changed settings that need a restart
+	Version         int64     `json:"version"`                   // Of the configuration now in effect
+}
+
+// Reloader re-reads the broker's command line, configuration file and
+// environment, and swaps in the settings that can change while the broker
+// runs. A reload with any invalid setting changes nothing.
+type Reloader struct {
+	broker    *Broker
+	args      []string
+	environ   func() []string
+	current   *BrokerOptions
+	overrides map[string]string // Settings changed through the admin API, kept across reloads
+	history   *ConfigHistory
+	mu        sync.Mutex
+}
+
+// NewReloader creates a reloader for a broker started with options parsed
+// from args
+func NewReloader(broker *Broker, options *BrokerOptions, args []string) *Reloader {
+	return &Reloader{
+		broker:    broker,
+		args:      args,
+		environ:   os.Environ,
+		current:   options,
+		overrides: make(map[string]string),
+		history:   NewConfigHistory(),
+	}
+}
+
+// Reload loads the configuration again and applies what changed
+func (r *Reloader) Reload() (*ReloadResult, error) {
+	return r.reload(configActorReload)
+}
+
+// reload loads the configuration again, with the settings changed through
+// the admin API on top, and applies what changed on behalf of actor
+func (r *Reloader) reload(actor string) (*ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	next, err := LoadBrokerOptions(flags, r.args, r.environ())
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range r.overrides {
+		if err := flags.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return r.apply(next, actor, "")
+}
+
+// apply validates next and swaps in the settings that differ from the
+// current ones, recording them in the history. Caller must hold the lock.
+func (r *Reloader) apply(next *BrokerOptions, actor, reason string) (*ReloadResult, error) {
+	flags := next.flags
+	result := &ReloadResult{At: time.Now(), Applied: []string{}}
+	before, after := r.current.values(), next.values()
+	changed := make(map[string]bool)
+	for name, value := range after {
+		if before[name] == value {
+			continue
+		}
+		if reloadableSettings[name] {
+			changed[name] = true
+			result.Applied = append(result.Applied, name)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+	sort.Strings(result.Applied)
+	sort.Strings(result.RestartRequired)
+
+	// Everything is validated before anything is swapped in. Certificate
+	// files are read again even if their names are unchanged, since they
+	// are usually renewed in place.
+	var cert tls.Certificate
+	var err error
+	reloadCert := next.TLSCert != "" || changed["tls-cert"] || changed["tls-key"]
+	if reloadCert {
+		if cert, err = loadCertificate(next.TLSCert, next.TLSKey); err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+	}
+	tiers, err := ParseRetentionTiers(next.UsageRetention)
+	if err != nil {
+		return nil, fmt.Errorf("usage-retention: %w", err)
+	}
+	if err := NewCloudEventsExporter("").Configure(nil, next.CloudEventsMode); err != nil {
+		return nil, fmt.Errorf("cloudevents-mode: %w", err)
+	}
+	rateLimits, err := ParseRateLimits(next.RateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("rate-limits: %w", err)
+	}
+	rateWarnings, err := ParseRateLimitWarnings(next.RateLimitWarnings)
+	if err != nil {
+		return nil, fmt.Errorf("rate-limit-warnings: %w", err)
+	}
+	outboxPriorities, err := ParseOutboxPriorities(next.OutboxPriorities)
+	if err != nil {
+		return nil, fmt.Errorf("outbox-priorities: %w", err)
+	}
+	persistence, err := ParsePersistencePolicy(next.Persistence)
+	if err != nil {
+		return nil, fmt.Errorf("persistence: %w", err)
+	}
+	if _, ok := r.broker.storage().(EnvelopeStorage); persistence.UsesStore() && !ok {
+		return nil, fmt.Errorf("persistence: storage cannot persist envelopes")
+	}
+	tierLimits, err := ParseTierLimits(next.TierLimits)
+	if err != nil {
+		return nil, fmt.Errorf("tier-limits: %w", err)
+	}
+	tierAssignments, err := ParseTierAssignments(next.TierAssignments)
+	if err != nil {
+		return nil, fmt.Errorf("tier-assignments: %w", err)
+	}
+	eventBridges, err := ParseEventBridges(next.EventBridges)
+	if err != nil {
+		return nil, fmt.Errorf("event-bridges: %w", err)
+	}
+	// Key files are read again even if their names are unchanged, so keys
+	// can be rotated in place
+	jwtSettings, err := LoadJWTSettings(next)
+	if err != nil {
+		return nil, err
+	}
+	approvalRules, err := ParseApprovalRules(next.AutoApprove)
+	if err != nil {
+		return nil, fmt.Errorf("auto-approve: %w", err)
+	}
+	capabilityGrants, err := ParseCapabilityGrants(next.CapabilityGrants)
+	if err == nil {
+		err = checkGrantsGated(capabilityGrants, next.RequireApproval, next.InviteOnly)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("capability-grants: %w", err)
+	}
+	reputation, err := ParseReputationSettings(next.Reputation)
+	if err != nil {
+		return nil, fmt.Errorf("reputation: %w", err)
+	}
+	anchors, err := ParseTrustAnchors(next.TrustAnchors)
+	if err != nil {
+		return nil, fmt.Errorf("trust-anchors: %w", err)
+	}
+	peerTrust, err := ParsePeerTrust(next.PeerTrust)
+	if err != nil {
+		return nil, fmt.Errorf("peer-trust: %w", err)
+	}
+	// The policy file is read again even if its name is unchanged, since
+	// it is usually edited in place
+	var admission AdmissionPolicy
+	if next.AdmissionPolicy != "" {
+		if admission, err = LoadAdmissionPolicy(next.AdmissionPolicy); err != nil {
+			return nil, fmt.Errorf("admission-policy: %w", err)
+		}
+	}
+	level, err := ParseLogLevel(next.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("log-level: %w", err)
+	}
+
+	b := r.broker
+	if reloadCert {
+		b.SetCertificate(cert)
+		b.certs.SetFiles(next.TLSCert, next.TLSKey)
+	}
+	b.pending.SetTimeout(next.ToolTimeout)
+	b.ordering.SetHoldback(next.OrderingHoldback)
+	b.broadcasts.SetTTL(next.BroadcastTTL)
+	b.outbox.SetTimeouts(next.AckTimeout, next.OutboxTTL)
+	b.outbox.SetPriorities(outboxPriorities)
+	b.idempotency.SetWindow(next.DedupWindow)
+	b.SetParamLimits(next.ParamLimits)
+	b.adapters.SetToken(next.IngestToken)
+	b.SetAdminToken(next.AdminToken)
+	b.SetJWTSettings(jwtSettings)
+	if err := b.ensureAdminToken(); err != nil {
+		slog.Error("Admin API left without a token", "error", err)
+	}
+	b.exporter.Configure(parseSinkList(next.CloudEventsSinks), next.CloudEventsMode)
+	b.compactor.SetTiers(tiers)
+	if changed["rate-limits"] {
+		b.limiter.SetLimits(rateLimits)
+	}
+	b.limiter.SetWarnings(rateWarnings, next.RateLimitGrace)
+	if changed["persistence"] {
+		b.SetPersistencePolicy(persistence)
+	}
+	if changed["tier-limits"] || changed["tier-assignments"] {
+		b.tiers.Configure(tierLimits, tierAssignments)
+	}
+	b.eventBridges.Set(eventBridges)
+	if changed["reputation"] {
+		b.reputation.SetSettings(reputation)
+	}
+	b.SetAdmissionPolicy(admission)
+	b.SetRequireKeyProof(next.RequireKeyProof)
+	if changed["session-ttl"] {
+		b.SetSessionTTL(next.SessionTTL)
+	}
+	b.SetRegistrationApproval(next.RequireApproval, approvalRules)
+	b.SetClosedRegistration(next.InviteOnly)
+	b.SetCapabilityGrants(capabilityGrants)
+	b.trust.SetAnchors(anchors)
+	b.trust.SetWeights(peerTrust)
+	logLevel.Set(level)
+	if changed["peers"] {
+		b.reconcilePeers(parseSinkList(r.current.Peers), parseSinkList(next.Peers))
+	}
+
+	// Settings waiting for a restart keep reporting as changed
+	for _, name := range result.RestartRequired {
+		flags.Set(name, before[name])
+	}
+	r.current = next
+
+	result.Version = r.history.Version()
+	if len(result.Applied) > 0 {
+		changes := make([]ConfigSettingChange, len(result.Applied))
+		for i, name := range result.Applied {
+			changes[i] = ConfigSettingChange{Setting: name, From: displayedSetting(name, before[name]), To: displayedSetting(name, after[name])}
+		}
+		change, err := r.history.Record(b, actor, reason, changes)
+		if err != nil {
+			slog.Error("Failed to record configuration change", "error", err)
+		} else {
+			result.Version = change.Version
+		}
+	}
+
+	if len(result.RestartRequired) > 0 {
+		slog.Info("Reloaded configuration", "applied", result.Applied, "restartRequired", result.RestartRequired)
+	} else {
+		slog.Info("Reloaded configuration", "applied", result.Applied)
+	}
+	return result, nil
+}
+
+// WatchSignals reloads on every SIGHUP until stop is closed
+func (r *Reloader) WatchSignals(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			if _, err := r.Reload(); err != nil {
+				slog.Error("Configuration reload failed, keeping the current settings", "error", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleReload serves POST /admin/reload
+func (r *Reloader) handleReload(w http.ResponseWriter, req *http.Request) {
+	actor, authenticated := r.broker.adminActor(req)
+	if !authenticated {
+		http.Error(w, "Reloads require the admin token or a JWT with a subject", http.StatusUnauthorized)
+		return
+	}
+	result, err := r.reload(actor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// SetReloader serves /admin/reload through reloader
+func (b *Broker) SetReloader(reloader *Reloader) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reloader = reloader
+}
+
+// SetCertificate replaces the certificate offered to new connections;
+// established connections keep the one they negotiated
+func (b *Broker) SetCertificate(cert tls.Certificate) {
+	b.certificate.Store(&cert)
+}
+
+// getCertificate offers the current certificate to TLS handshakes
+func (b *Broker) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := b.certificate.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate configured")
+	}
+	return cert, nil
+}
+
+// reconcilePeers joins peers newly added to the configuration and forgets
+// those removed from it
+func (b *Broker) reconcilePeers(before, after []string) {
+	listed := make(map[string]bool)
+	for _, peer := range before {
+		listed[peer] = true
+	}
+	for _, peer := range after {
+		if listed[peer] {
+			delete(listed, peer)
+			continue
+		}
+		go func(peer string) {
+			if err := b.JoinFederation(peer); err != nil {
+				slog.Warn("Failed to federate", "peer", peer, "error", err)
+			}
+		}(peer)
+	}
+	for peer := range listed {
+		if id, removed := b.peers.RemoveEndpoint(peer); removed {
+			slog.Info("Stopped federating", "broker", id, "peer", peer)
+		}
+	}
+}
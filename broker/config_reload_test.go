@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeCertificateFiles writes a certificate and key as PEM files
+func writeCertificateFiles(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+// startReloadable parses args as the broker would and sets up a reloader
+func startReloadable(t *testing.T, args []string) (*Broker, *Reloader) {
+	t.Helper()
+	flags := flag.NewFlagSet("broker", flag.ContinueOnError)
+	options, err := LoadBrokerOptions(flags, args, nil)
+	if err != nil {
+		t.Fatalf("Failed to load options: %v", err)
+	}
+
+	broker := NewBroker()
+	broker.pending.SetTimeout(options.ToolTimeout)
+	broker.SetParamLimits(options.ParamLimits)
+	broker.SetAdminToken(options.AdminToken)
+	broker.SetAdminTokenFile(filepath.Join(t.TempDir(), "admin-token"))
+	reloader := NewReloader(broker, options, args)
+	reloader.environ = func() []string { return nil }
+	broker.SetReloader(reloader)
+	return broker, reloader
+}
+
+func TestReloadAppliesChangedSettings(t *testing.T) {
+	path := writeConfig(t, "listen: \":8443\"\nlimits:\n  tool_timeout: 10s\n  max_param_depth: 4\n")
+	broker, reloader := startReloadable(t, []string{"-config", path})
+
+	if err := os.WriteFile(path, []byte("listen: \":9443\"\nlimits:\n  tool_timeout: 20s\n  max_param_depth: 8\ningest:\n  token: secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to rewrite config: %v", err)
+	}
+	result, err := reloader.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	if expected := []string{"ingest-token", "max-param-depth", "tool-timeout"}; !reflect.DeepEqual(result.Applied, expected) {
+		t.Errorf("Expected %v to be applied, got %v", expected, result.Applied)
+	}
+	if expected := []string{"listen"}; !reflect.DeepEqual(result.RestartRequired, expected) {
+		t.Errorf("Expected %v to need a restart, got %v", expected, result.RestartRequired)
+	}
+	if broker.pending.timeout != 20*time.Second || broker.paramLimits.MaxDepth != 8 || broker.adapters.token != "secret" {
+		t.Errorf("Settings not swapped in: timeout %v, depth %d, token %q", broker.pending.timeout, broker.paramLimits.MaxDepth, broker.adapters.token)
+	}
+
+	// An invalid file changes nothing
+	if err := os.WriteFile(path, []byte("limits:\n  tool_timeout: 30s\nmetrics:\n  retention: weekly=1h\n"), 0600); err != nil {
+		t.Fatalf("Failed to rewrite config: %v", err)
+	}
+	if _, err := reloader.Reload(); err == nil {
+		t.Error("Expected an invalid configuration to be rejected")
+	}
+	if broker.pending.timeout != 20*time.Second {
+		t.Errorf("Expected the timeout to stay 20s, got %v", broker.pending.timeout)
+	}
+}
+
+func TestReloadSwapsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "broker.crt"), filepath.Join(dir, "broker.key")
+	first := doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	writeCertificateFiles(t, first, certFile, keyFile)
+
+	broker, _ := startReloadable(t, []string{"-tls-cert", certFile, "-tls-key", keyFile, "-admin-token", testAdminToken})
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	broker.SetCertificate(cert)
+
+	// httptest's own certificate would take precedence over GetCertificate
+	server := httptest.NewUnstartedServer(broker)
+	server.Listener = tls.NewListener(server.Listener, &tls.Config{GetCertificate: broker.getCertificate})
+	server.Start()
+	defer server.Close()
+	url := "https://" + server.Listener.Addr().String()
+
+	served := func() []byte {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	if string(served()) != string(first.Certificate[0]) {
+		t.Fatal("Expected the first certificate to be served")
+	}
+
+	second := doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(48*time.Hour))
+	writeCertificateFiles(t, second, certFile, keyFile)
+
+	// The certificate is renewed in place under the same file names
+	client := &http.Client{Transport: adminTransport{base: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}}
+	resp, err := client.Post(url+"/admin/reload", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Reload request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Reload returned %d: %s", resp.StatusCode, body)
+	}
+	var result ReloadResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode reload result: %v", err)
+	}
+
+	if string(served()) != string(second.Certificate[0]) {
+		t.Error("Expected the rotated certificate to be served to new connections")
+	}
+}
+
+func TestReloadReconcilesPeers(t *testing.T) {
+	broker := NewBroker()
+	broker.peers.Add(&FederatedBroker{ID: "broker-old", Endpoint: "https://old.example.com"})
+	broker.peers.Add(&FederatedBroker{ID: "broker-kept", Endpoint: "https://kept.example.com"})
+
+	broker.reconcilePeers(
+		[]string{"https://old.example.com", "https://kept.example.com"},
+		[]string{"https://kept.example.com"},
+	)
+
+	if _, exists := broker.peers.Get("broker-old"); exists {
+		t.Error("Expected the removed peer to be forgotten")
+	}
+	if _, exists := broker.peers.Get("broker-kept"); !exists {
+		t.Error("Expected the kept peer to remain")
+	}
+}
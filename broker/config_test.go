@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configTestFlags declares a subset of the broker's flags
+type configTestFlags struct {
+	set         *flag.FlagSet
+	listen      string
+	storage     string
+	db          string
+	peers       string
+	raftPeers   string
+	toolTimeout time.Duration
+	maxDepth    int
+}
+
+func newConfigTestFlags() *configTestFlags {
+	f := &configTestFlags{set: flag.NewFlagSet("broker", flag.ContinueOnError)}
+	f.set.StringVar(&f.listen, "listen", ":4433", "")
+	f.set.StringVar(&f.storage, "storage", StorageMemory, "")
+	f.set.StringVar(&f.db, "db", "", "")
+	f.set.StringVar(&f.peers, "peers", "", "")
+	f.set.StringVar(&f.raftPeers, "raft-peers", "", "")
+	f.set.DurationVar(&f.toolTimeout, "tool-timeout", defaultToolCallTimeout, "")
+	f.set.IntVar(&f.maxDepth, "max-param-depth", 32, "")
+	return f
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "broker.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestApplyConfig(t *testing.T) {
+	path := writeConfig(t, `
+listen: ":8443"
+storage:
+  backend: bolt
+  db: /var/lib/fem/broker.db
+federation:
+  peers:
+    - https://broker-a.example.com:8443
+    - https://broker-b.example.com:8443
+raft:
+  peers:
+    node-c: https://node-c:4434
+    node-b: https://node-b:4434
+limits:
+  tool_timeout: 45s
+  max_param_depth: 8
+`)
+
+	flags := newConfigTestFlags()
+	// Command-line flags win over the environment, which wins over the file
+	if err := flags.set.Parse([]string{"-listen", ":9443"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	environ := []string{"FEM_BROKER_STORAGE_DB=/srv/fem.db", "FEM_BROKER_LISTEN=:7443", "UNRELATED=1"}
+	if err := ApplyConfig(flags.set, path, environ); err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+
+	if flags.listen != ":9443" {
+		t.Errorf("Expected the command line to win, got listen %q", flags.listen)
+	}
+	if flags.db != "/srv/fem.db" {
+		t.Errorf("Expected the environment to win over the file, got db %q", flags.db)
+	}
+	if flags.storage != StorageBolt || flags.toolTimeout != 45*time.Second || flags.maxDepth != 8 {
+		t.Errorf("Unexpected settings from the file: storage %q, timeout %v, depth %d", flags.storage, flags.toolTimeout, flags.maxDepth)
+	}
+	if flags.peers != "https://broker-a.example.com:8443,https://broker-b.example.com:8443" {
+		t.Errorf("Unexpected peers %q", flags.peers)
+	}
+	if flags.raftPeers != "node-b=https://node-b:4434,node-c=https://node-c:4434" {
+		t.Errorf("Unexpected raft peers %q", flags.raftPeers)
+	}
+}
+
+func TestApplyConfigNamesOffendingKey(t *testing.T) {
+	tests := []struct {
+		config  string
+		environ []string
+		key     string
+	}{
+		{config: "storage:\n  backend: etcd\n", key: "storage.backend"},
+		{config: "limits:\n  tool_timeout: soon\n", key: "limits.tool_timeout"},
+		{config: "limits:\n  max_param_depth: deep\n", key: "limits.max_param_depth"},
+		{config: "federation:\n  peers: [http://insecure.example.com]\n", key: "federation.peers"},
+		{config: "storage:\n  bakend: bolt\n", key: "storage.bakend"},
+		{config: "storage: bolt\n", key: "storage"},
+		{environ: []string{"FEM_BROKER_LIMITS_TOOL_TIMEOUT=forever"}, key: "FEM_BROKER_LIMITS_TOOL_TIMEOUT"},
+	}
+
+	for _, test := range tests {
+		path := ""
+		if test.config != "" {
+			path = writeConfig(t, test.config)
+		}
+		err := ApplyConfig(newConfigTestFlags().set, path, test.environ)
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", test.key)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.key+":") {
+			t.Errorf("Expected the error to name %s, got %v", test.key, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// ErrAgentNotConnected is returned when pushing to an agent without a live
+// connection
+var ErrAgentNotConnected = errors.New("agent has no live connection")
+
+// pushConn is a live agent connection the broker can push envelopes to
+type pushConn interface {
+	agent() string
+	write(data []byte) error
+	close()
+}
+
+// ConnectionHub tracks live agent connections (WebSocket or event stream)
+// for server-initiated delivery. Each agent has at most one connection.
+type ConnectionHub struct {
+	conns map[string]pushConn
+	mu    sync.RWMutex
+}
+
+// NewConnectionHub creates an empty connection hub
+func NewConnectionHub() *ConnectionHub {
+	return &ConnectionHub{conns: make(map[string]pushConn)}
+}
+
+// add registers a connection, returning any connection it replaces
+func (h *ConnectionHub) add(c pushConn) pushConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := h.conns[c.agent()]
+	h.conns[c.agent()] = c
+	return previous
+}
+
+// remove drops a connection if it is still the agent's current one,
+// reporting whether it was
+func (h *ConnectionHub) remove(c pushConn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[c.agent()] == c {
+		delete(h.conns, c.agent())
+		return true
+	}
+	return false
+}
+
+// IsConnected reports whether an agent holds a live connection
+func (h *ConnectionHub) IsConnected(agentID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, exists := h.conns[agentID]
+	return exists
+}
+
+// SendRaw pushes a serialized JSON envelope to a connected agent
+func (h *ConnectionHub) SendRaw(agentID string, data []byte) error {
+	h.mu.RLock()
+	c, exists := h.conns[agentID]
+	h.mu.RUnlock()
+	if !exists {
+		return ErrAgentNotConnected
+	}
+	return c.write(data)
+}
+
+// Send pushes an envelope to a connected agent
+func (h *ConnectionHub) Send(agentID string, envelope interface{}) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return h.SendRaw(agentID, data)
+}
+
+// Broadcast pushes an envelope to every connected agent except exclude and
+// returns the number of agents it was sent to
+func (h *ConnectionHub) Broadcast(envelope interface{}, exclude string) int {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		slog.Error("Failed to marshal broadcast envelope", "error", err)
+		return 0
+	}
+
+	h.mu.RLock()
+	targets := make([]pushConn, 0, len(h.conns))
+	for agentID, c := range h.conns {
+		if agentID != exclude {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	sent := 0
+	for _, c := range targets {
+		if err := c.write(data); err != nil {
+			slog.Warn("Failed to push envelope", "agent", c.agent(), "error", err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// ConnectedAgents returns the IDs of agents holding a live connection
+func (h *ConnectionHub) ConnectedAgents() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	agents := make([]string, 0, len(h.conns))
+	for agentID := range h.conns {
+		agents = append(agents, agentID)
+	}
+	return agents
+}
+
+// GetConnectionCount returns the number of live agent connections
+func (h *ConnectionHub) GetConnectionCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// deliveryReceipt returns the receipt for a call that asked for one: when
+// the broker received and delivered it and had its result, along with the
+// timing the provider reported in its result. Calls that did not ask get
+// none, and a provider's timing is not passed on to them. delivered is
+// zero for calls that were never delivered.
+func deliveryReceipt(call protocol.ToolCallBody, received, delivered time.Time, reported *protocol.DeliveryReceipt) *protocol.DeliveryReceipt {
+	if !call.Receipt {
+		return nil
+	}
+
+	receipt := &protocol.DeliveryReceipt{Received: received.UnixMilli(), Returned: time.Now().UnixMilli()}
+	if !delivered.IsZero() {
+		receipt.Delivered = delivered.UnixMilli()
+	}
+	if reported != nil {
+		receipt.Accepted = reported.Accepted
+		receipt.Started = reported.Started
+		receipt.Finished = reported.Finished
+	}
+	return receipt
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestToolCallDeliveryReceipt(t *testing.T) {
+	broker := NewBroker()
+	broker.SetBrokerID("broker-a")
+
+	// The worker accepts the call and posts its result, with its timing, later
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Params struct {
+				Meta map[string]string `json:"_meta"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		meta := request.Params.Meta
+
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			accepted := time.Now()
+			result := protocol.ToolResultBody{RequestID: meta["requestId"], Success: true, Result: meta["receipt"]}
+			result.Receipt = &protocol.DeliveryReceipt{
+				Accepted: accepted.UnixMilli(),
+				Started:  accepted.Add(10 * time.Millisecond).UnixMilli(),
+				Finished: accepted.Add(30 * time.Millisecond).UnixMilli(),
+			}
+			time.Sleep(20 * time.Millisecond)
+			broker.pending.Resolve("worker", result)
+		}()
+	}))
+	defer worker.Close()
+	broker.mcpRegistry.RegisterAgent("worker", &MCPAgent{
+		ID:          "worker",
+		MCPEndpoint: worker.URL,
+		Tools:       []protocol.MCPTool{{Name: "deep.think"}},
+	})
+
+	call := func(tool string, receipt bool) protocol.ToolResultBody {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+		env.Agent = "caller"
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: tool, RequestID: protocol.NewNonce(), Receipt: receipt})
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+		var response protocol.ToolResultEnvelope
+		json.Unmarshal(recorder.body.Bytes(), &response)
+		return response.Body
+	}
+
+	start := time.Now().UnixMilli()
+	result := call("deep.think", true)
+	receipt := result.Receipt
+	if !result.Success || result.Result != "true" || receipt == nil {
+		t.Fatalf("Expected a result with a receipt, got %+v", result)
+	}
+	if receipt.Received < start || receipt.Delivered < receipt.Received || receipt.Returned < receipt.Delivered+20 {
+		t.Errorf("Unexpected broker timestamps: %+v", receipt)
+	}
+	if receipt.Started-receipt.Accepted != 10 || receipt.Finished-receipt.Started != 20 {
+		t.Errorf("Expected the worker's timing passed on, got %+v", receipt)
+	}
+	if breakdown := receipt.Breakdown(0); breakdown.Execution != 20*time.Millisecond || breakdown.Queueing < 10*time.Millisecond {
+		t.Errorf("Unexpected breakdown: %+v", breakdown)
+	}
+
+	// The worker's timing is not passed to callers that did not ask
+	if result := call("deep.think", false); !result.Success || result.Receipt != nil {
+		t.Errorf("Expected no receipt, got %+v", result)
+	}
+
+	// The broker times its own tools
+	if result := call("broker-a/time", true); result.Receipt == nil || result.Receipt.Started == 0 || result.Receipt.Delivered != result.Receipt.Started {
+		t.Errorf("Expected a receipt for a built-in tool, got %+v", result.Receipt)
+	}
+}
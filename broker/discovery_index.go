@@ -0,0 +1,433 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// bitmap is a set of tool slots, stored as its non-zero 64-bit words in
+// order of their position. Sets of a few tools take a word or two however
+// large the index grows, and unions and intersections merge words rather
+// than visiting tools.
+type bitmap struct {
+	keys  []uint32 // Position of each word, in increasing order
+	words []uint64
+}
+
+// find returns the position of word key in b, and whether b holds it
+func (b *bitmap) find(key uint32) (int, bool) {
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+func (b *bitmap) add(slot uint32) {
+	key, bit := slot>>6, uint64(1)<<(slot&63)
+	// Slots are mostly handed out in increasing order
+	if n := len(b.keys); n == 0 || b.keys[n-1] < key {
+		b.keys = append(b.keys, key)
+		b.words = append(b.words, bit)
+		return
+	}
+	i, found := b.find(key)
+	if found {
+		b.words[i] |= bit
+		return
+	}
+	b.keys = append(b.keys, 0)
+	b.words = append(b.words, 0)
+	copy(b.keys[i+1:], b.keys[i:])
+	copy(b.words[i+1:], b.words[i:])
+	b.keys[i], b.words[i] = key, bit
+}
+
+func (b *bitmap) remove(slot uint32) {
+	i, found := b.find(slot >> 6)
+	if !found {
+		return
+	}
+	b.words[i] &^= uint64(1) << (slot & 63)
+	if b.words[i] == 0 {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+		b.words = append(b.words[:i], b.words[i+1:]...)
+	}
+}
+
+func (b *bitmap) contains(slot uint32) bool {
+	i, found := b.find(slot >> 6)
+	return found && b.words[i]&(uint64(1)<<(slot&63)) != 0
+}
+
+func (b *bitmap) empty() bool {
+	return len(b.keys) == 0
+}
+
+// clone returns a copy of b
+func (b *bitmap) clone() *bitmap {
+	return &bitmap{
+		keys:  append([]uint32(nil), b.keys...),
+		words: append([]uint64(nil), b.words...),
+	}
+}
+
+// count returns the number of slots in b
+func (b *bitmap) count() int {
+	total := 0
+	for _, word := range b.words {
+		total += bits.OnesCount64(word)
+	}
+	return total
+}
+
+// or returns the slots in b or o
+func (b *bitmap) or(o *bitmap) *bitmap {
+	result := &bitmap{
+		keys:  make([]uint32, 0, len(b.keys)+len(o.keys)),
+		words: make([]uint64, 0, len(b.words)+len(o.words)),
+	}
+	i, j := 0, 0
+	for i < len(b.keys) || j < len(o.keys) {
+		switch {
+		case j == len(o.keys) || (i < len(b.keys) && b.keys[i] < o.keys[j]):
+			result.keys, result.words = append(result.keys, b.keys[i]), append(result.words, b.words[i])
+			i++
+		case i == len(b.keys) || o.keys[j] < b.keys[i]:
+			result.keys, result.words = append(result.keys, o.keys[j]), append(result.words, o.words[j])
+			j++
+		default:
+			result.keys, result.words = append(result.keys, b.keys[i]), append(result.words, b.words[i]|o.words[j])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// and returns the slots in both b and o
+func (b *bitmap) and(o *bitmap) *bitmap {
+	result := &bitmap{}
+	i, j := 0, 0
+	for i < len(b.keys) && j < len(o.keys) {
+		switch {
+		case b.keys[i] < o.keys[j]:
+			i++
+		case o.keys[j] < b.keys[i]:
+			j++
+		default:
+			if word := b.words[i] & o.words[j]; word != 0 {
+				result.keys, result.words = append(result.keys, b.keys[i]), append(result.words, word)
+			}
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// andNot returns the slots in b that are not in o
+func (b *bitmap) andNot(o *bitmap) *bitmap {
+	result := &bitmap{
+		keys:  make([]uint32, 0, len(b.keys)),
+		words: make([]uint64, 0, len(b.words)),
+	}
+	j := 0
+	for i, key := range b.keys {
+		for j < len(o.keys) && o.keys[j] < key {
+			j++
+		}
+		word := b.words[i]
+		if j < len(o.keys) && o.keys[j] == key {
+			word &^= o.words[j]
+		}
+		if word != 0 {
+			result.keys, result.words = append(result.keys, key), append(result.words, word)
+		}
+	}
+	return result
+}
+
+// each calls fn with the slots of b in increasing order until fn returns
+// false
+func (b *bitmap) each(fn func(slot uint32) bool) {
+	for i, word := range b.words {
+		for word != 0 {
+			bit := uint32(bits.TrailingZeros64(word))
+			if !fn(b.keys[i]<<6 | bit) {
+				return
+			}
+			word &= word - 1
+		}
+	}
+}
+
+// nameNode is a node of the radix tree of tool names. A node stands for
+// the name spelled by the labels on the path to it, and holds the slots
+// offering that name and those offering any name it starts, so a prefix
+// pattern is answered by a single node whatever the number of names.
+type nameNode struct {
+	label    string // Edge from the parent; empty for the root
+	children map[byte]*nameNode
+	exact    *bitmap // Slots offering the node's name
+	subtree  *bitmap // Slots offering the node's name or one it starts
+}
+
+func newNameNode(label string) *nameNode {
+	return &nameNode{
+		label:    label,
+		children: make(map[byte]*nameNode),
+		exact:    &bitmap{},
+		subtree:  &bitmap{},
+	}
+}
+
+// commonPrefixLen returns the length of the longest prefix of a and b
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// insert adds slot under name, splitting the edge name leaves, if any
+func (n *nameNode) insert(name string, slot uint32) {
+	node := n
+	node.subtree.add(slot)
+	for name != "" {
+		child := node.children[name[0]]
+		if child == nil {
+			child = newNameNode(name)
+			node.children[name[0]] = child
+		} else if common := commonPrefixLen(name, child.label); common < len(child.label) {
+			split := newNameNode(child.label[:common])
+			split.subtree = child.subtree.clone()
+			child.label = child.label[common:]
+			split.children[child.label[0]] = child
+			node.children[name[0]] = split
+			child = split
+		}
+		child.subtree.add(slot)
+		name, node = name[len(child.label):], child
+	}
+	node.exact.add(slot)
+}
+
+// remove drops slot from under name. Nodes no tool offers a name under are
+// pruned, and those left with one child and no name of their own are
+// merged into it, so the tree only holds the names tools offer.
+func (n *nameNode) remove(name string, slot uint32) {
+	path := []*nameNode{n}
+	node := n
+	for name != "" {
+		child := node.children[name[0]]
+		if child == nil || !strings.HasPrefix(name, child.label) {
+			return
+		}
+		name, node = name[len(child.label):], child
+		path = append(path, node)
+	}
+	node.exact.remove(slot)
+	for _, node := range path {
+		node.subtree.remove(slot)
+	}
+
+	// The root stays whatever it holds
+	for i := len(path) - 1; i > 0; i-- {
+		node, parent := path[i], path[i-1]
+		switch {
+		case node.subtree.empty():
+			delete(parent.children, node.label[0])
+		case node.exact.empty() && len(node.children) == 1:
+			for _, child := range node.children {
+				child.label = node.label + child.label
+				parent.children[child.label[0]] = child
+			}
+		}
+	}
+}
+
+// matching returns the slots offering name, or, with prefix, any name
+// starting with it. It returns nil if there are none.
+func (n *nameNode) matching(name string, prefix bool) *bitmap {
+	node := n
+	for name != "" {
+		child := node.children[name[0]]
+		switch {
+		case child == nil:
+			return nil
+		case strings.HasPrefix(name, child.label):
+			name, node = name[len(child.label):], child
+		case prefix && strings.HasPrefix(child.label, name):
+			return child.subtree
+		default:
+			return nil
+		}
+	}
+	if prefix {
+		return node.subtree
+	}
+	return node.exact
+}
+
+// discoveryIndex indexes the registry's tools for discovery. Each tool
+// holds a slot, and the radix tree of tool names holds the slots offering
+// each name, so queries combine a few bitmaps rather than scanning every
+// tool. Callers hold the registry's lock.
+type discoveryIndex struct {
+	slots  []*RegisteredTool // By slot; nil for free slots
+	free   []uint32
+	slotOf map[string]uint32 // By tool key
+	names  *nameNode         // Root of the tree of tool names; its subtree holds every slot
+	envs   map[string]*bitmap
+	agents map[string]*bitmap
+	stale  *bitmap
+}
+
+func newDiscoveryIndex() *discoveryIndex {
+	return &discoveryIndex{
+		slotOf: make(map[string]uint32),
+		names:  newNameNode(""),
+		envs:   make(map[string]*bitmap),
+		agents: make(map[string]*bitmap),
+		stale:  &bitmap{},
+	}
+}
+
+// keyed returns the bitmap stored under key in m, creating it if needed
+func keyed(m map[string]*bitmap, key string) *bitmap {
+	set, exists := m[key]
+	if !exists {
+		set = &bitmap{}
+		m[key] = set
+	}
+	return set
+}
+
+// put indexes a tool under its key, replacing the tool indexed there before
+func (x *discoveryIndex) put(key string, tool *RegisteredTool) {
+	x.remove(key)
+
+	var slot uint32
+	if n := len(x.free); n > 0 {
+		slot, x.free = x.free[n-1], x.free[:n-1]
+		x.slots[slot] = tool
+	} else {
+		slot = uint32(len(x.slots))
+		x.slots = append(x.slots, tool)
+	}
+	x.slotOf[key] = slot
+
+	x.names.insert(tool.Tool.Name, slot)
+	keyed(x.envs, tool.EnvironmentType).add(slot)
+	keyed(x.agents, tool.AgentID).add(slot)
+	if tool.Stale {
+		x.stale.add(slot)
+	}
+}
+
+// remove drops the tool indexed under key, if any
+func (x *discoveryIndex) remove(key string) {
+	slot, exists := x.slotOf[key]
+	if !exists {
+		return
+	}
+	tool := x.slots[slot]
+
+	x.names.remove(tool.Tool.Name, slot)
+	for _, m := range []struct {
+		sets map[string]*bitmap
+		key  string
+	}{{x.envs, tool.EnvironmentType}, {x.agents, tool.AgentID}} {
+		if set, exists := m.sets[m.key]; exists {
+			if set.remove(slot); set.empty() {
+				delete(m.sets, m.key)
+			}
+		}
+	}
+	x.stale.remove(slot)
+
+	x.slots[slot] = nil
+	delete(x.slotOf, key)
+	x.free = append(x.free, slot)
+}
+
+// agentTools returns the tools of an agent
+func (x *discoveryIndex) agentTools(agentID string) []*RegisteredTool {
+	set, exists := x.agents[agentID]
+	if !exists {
+		return nil
+	}
+	tools := make([]*RegisteredTool, 0, set.count())
+	set.each(func(slot uint32) bool {
+		tools = append(tools, x.slots[slot])
+		return true
+	})
+	return tools
+}
+
+// setStale marks an agent's tools stale or live
+func (x *discoveryIndex) setStale(agentID string, stale bool) {
+	for _, tool := range x.agentTools(agentID) {
+		slot := x.slotOf[toolKey(tool.AgentID, tool.Tool.Name)]
+		tool.Stale = stale
+		if stale {
+			x.stale.add(slot)
+		} else {
+			x.stale.remove(slot)
+		}
+	}
+}
+
+// matching returns the slots of tools whose names match any of the
+// capability patterns, or of every tool if there are none
+func (x *discoveryIndex) matching(patterns []string) *bitmap {
+	if len(patterns) == 0 {
+		return x.names.subtree
+	}
+	result := &bitmap{}
+	for _, pattern := range patterns {
+		var set *bitmap
+		switch {
+		case pattern == "*":
+			return x.names.subtree
+		case strings.HasSuffix(pattern, "*"):
+			set = x.names.matching(strings.TrimSuffix(pattern, "*"), true)
+		default:
+			set = x.names.matching(pattern, false)
+		}
+		switch {
+		case set == nil:
+		case result.empty():
+			result = set
+		default:
+			result = result.or(set)
+		}
+	}
+	return result
+}
+
+// query returns the live tools matching the capability patterns in the
+// environment, if one is given, in slot order. keep filters the tools, and
+// at most limit are returned if limit is positive.
+func (x *discoveryIndex) query(patterns []string, environment string, keep func(*RegisteredTool) bool, limit int) []*RegisteredTool {
+	candidates := x.matching(patterns)
+	if !x.stale.empty() {
+		candidates = candidates.andNot(x.stale)
+	}
+	if environment != "" {
+		set, exists := x.envs[environment]
+		if !exists {
+			return nil
+		}
+		candidates = candidates.and(set)
+	}
+
+	var tools []*RegisteredTool
+	candidates.each(func(slot uint32) bool {
+		if tool := x.slots[slot]; keep(tool) {
+			tools = append(tools, tool)
+		}
+		return limit <= 0 || len(tools) < limit
+	})
+	return tools
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestBitmapOperations(t *testing.T) {
+	a, b := &bitmap{}, &bitmap{}
+	for _, slot := range []uint32{3, 64, 65, 1000, 2} {
+		a.add(slot)
+	}
+	for _, slot := range []uint32{2, 65, 4096} {
+		b.add(slot)
+	}
+
+	slots := func(set *bitmap) []uint32 {
+		var result []uint32
+		set.each(func(slot uint32) bool {
+			result = append(result, slot)
+			return true
+		})
+		return result
+	}
+	for _, tc := range []struct {
+		name string
+		set  *bitmap
+		want string
+	}{
+		{"a", a, "[2 3 64 65 1000]"},
+		{"or", a.or(b), "[2 3 64 65 1000 4096]"},
+		{"and", a.and(b), "[2 65]"},
+		{"andNot", a.andNot(b), "[3 64 1000]"},
+	} {
+		if got := fmt.Sprint(slots(tc.set)); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+
+	a.remove(64)
+	a.remove(1000)
+	a.remove(7)
+	if a.contains(64) || !a.contains(65) || a.count() != 3 {
+		t.Errorf("Expected [2 3 65] after removals, got %v", slots(a))
+	}
+}
+
+func TestDiscoveryIndexMatchesLinearScan(t *testing.T) {
+	registry := NewMCPRegistry()
+	for i := 0; i < 50; i++ {
+		registry.RegisterAgent(fmt.Sprintf("agent-%d", i), &MCPAgent{
+			EnvironmentType: []string{"dev", "prod"}[i%2],
+			Tools: []protocol.MCPTool{
+				{Name: fmt.Sprintf("file.op%d", i%7)},
+				{Name: fmt.Sprintf("math.op%d", i%5)},
+				{Name: "echo"},
+			},
+		})
+	}
+	registry.MarkAgentStale("agent-3")
+	registry.UnregisterAgent("agent-4")
+	registry.RevokeTools("agent-5", func(name string) bool { return name == "echo" }, func(string) bool { return false })
+	// Freed slots are reused by later tools
+	registry.RegisterAgent("late", &MCPAgent{EnvironmentType: "dev", Tools: []protocol.MCPTool{{Name: "file.late"}}})
+
+	keys := func(tools []*RegisteredTool) []string {
+		result := make([]string, 0, len(tools))
+		for _, tool := range tools {
+			result = append(result, toolKey(tool.AgentID, tool.Tool.Name))
+		}
+		sort.Strings(result)
+		return result
+	}
+	for _, query := range []protocol.ToolQuery{
+		{},
+		{Capabilities: []string{"*"}},
+		{Capabilities: []string{"file.*"}},
+		{Capabilities: []string{"file.op1", "math.*"}},
+		{Capabilities: []string{"echo"}, EnvironmentType: "prod"},
+		{Capabilities: []string{"file.*"}, EnvironmentType: "staging"},
+		{Capabilities: []string{"missing"}},
+	} {
+		var want []*RegisteredTool
+		for _, tool := range registry.tools {
+			if !tool.Stale && matchesQuery(tool, query) {
+				want = append(want, tool)
+			}
+		}
+		got := registry.index.query(query.Capabilities, query.EnvironmentType, func(*RegisteredTool) bool { return true }, 0)
+		if fmt.Sprint(keys(got)) != fmt.Sprint(keys(want)) {
+			t.Errorf("Query %+v: expected %v, got %v", query, keys(want), keys(got))
+		}
+	}
+
+	if tools := registry.AgentTools("agent-3"); len(tools) != 3 {
+		t.Errorf("Expected stale agent-3 to keep its 3 tools, got %d", len(tools))
+	}
+	registry.UpdateAgentHeartbeat("agent-3")
+	if got := registry.index.query([]string{"echo"}, "", func(tool *RegisteredTool) bool { return tool.AgentID == "agent-3" }, 0); len(got) != 1 {
+		t.Errorf("Expected agent-3 to be discoverable after its heartbeat, got %d tools", len(got))
+	}
+}
+
+func TestNameTreeReclaimsNames(t *testing.T) {
+	x := newDiscoveryIndex()
+	names := []string{"file.read", "file.readdir", "file", "fil", "file.write", "echo", ""}
+	for i, name := range names {
+		x.put(toolKey("agent", name), &RegisteredTool{AgentID: "agent", Tool: protocol.MCPTool{Name: name}})
+		if x.names.matching(name, false).count() != 1 {
+			t.Fatalf("Expected %q to be indexed after %d names", name, i+1)
+		}
+	}
+	for _, tc := range []struct {
+		prefix string
+		want   int
+	}{
+		{"file.read", 2}, {"file.", 3}, {"fil", 5}, {"e", 1}, {"files", 0}, {"", len(names)},
+	} {
+		if got := x.names.matching(tc.prefix, true); (got == nil && tc.want != 0) || (got != nil && got.count() != tc.want) {
+			t.Errorf("Expected %d names starting with %q", tc.want, tc.prefix)
+		}
+	}
+
+	x.remove(toolKey("agent", "file.read"))
+	if set := x.names.matching("file.read", false); set != nil && !set.empty() {
+		t.Error("Expected file.read to be gone")
+	}
+	if set := x.names.matching("file.readdir", false); set == nil || set.count() != 1 {
+		t.Error("Expected file.readdir to stay indexed")
+	}
+
+	// Once no tool offers a name, the tree no longer holds it
+	for _, name := range names {
+		x.remove(toolKey("agent", name))
+	}
+	if len(x.names.children) != 0 || !x.names.subtree.empty() || !x.names.exact.empty() {
+		t.Errorf("Expected an empty tree, got %d children", len(x.names.children))
+	}
+}
+
+func TestDiscoveryHonoursMaxResults(t *testing.T) {
+	registry := NewMCPRegistry()
+	for i := 0; i < 10; i++ {
+		registry.RegisterAgent(fmt.Sprintf("agent-%d", i), &MCPAgent{Tools: []protocol.MCPTool{{Name: "echo"}}})
+	}
+	discovered, _ := registry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"echo"}, MaxResults: 4})
+	if len(discovered) != 4 {
+		t.Errorf("Expected 4 results, got %d", len(discovered))
+	}
+}
+
+// matchesQuery is the check discovery made against every tool before the
+// index
+func matchesQuery(tool *RegisteredTool, query protocol.ToolQuery) bool {
+	if query.EnvironmentType != "" && tool.EnvironmentType != query.EnvironmentType {
+		return false
+	}
+	if len(query.Capabilities) == 0 {
+		return true
+	}
+	for _, pattern := range query.Capabilities {
+		if matchPattern(tool.Tool.Name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// benchmarkRegistry registers agents offering 200,000 tools in all: a few
+// shared tools each and many of their own
+func benchmarkRegistry(b *testing.B) *MCPRegistry {
+	b.Helper()
+	registry := NewMCPRegistry()
+	for i := 0; i < 2000; i++ {
+		tools := make([]protocol.MCPTool, 0, 100)
+		tools = append(tools, protocol.MCPTool{Name: "echo"}, protocol.MCPTool{Name: fmt.Sprintf("render.format%d", i%20)})
+		for j := len(tools); j < 100; j++ {
+			tools = append(tools, protocol.MCPTool{Name: fmt.Sprintf("agent%d.tool%d", i, j)})
+		}
+		registry.RegisterAgent(fmt.Sprintf("agent-%d", i), &MCPAgent{
+			EnvironmentType: []string{"dev", "prod"}[i%2],
+			Tools:           tools,
+		})
+	}
+	return registry
+}
+
+var benchmarkQueries = []protocol.ToolQuery{
+	{Capabilities: []string{"agent1234.tool50"}},
+	{Capabilities: []string{"render.*"}, EnvironmentType: "prod"},
+	{Capabilities: []string{"echo"}, MaxResults: 10},
+}
+
+func BenchmarkDiscoverTools(b *testing.B) {
+	registry := benchmarkRegistry(b)
+	for _, query := range benchmarkQueries {
+		b.Run(fmt.Sprint(query.Capabilities), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				registry.DiscoverToolsFor(query, "requester")
+			}
+		})
+	}
+}
+
+// BenchmarkDiscoverToolsLinearScan measures the scan over every tool that
+// discovery made before the index, for comparison
+func BenchmarkDiscoverToolsLinearScan(b *testing.B) {
+	registry := benchmarkRegistry(b)
+	for _, query := range benchmarkQueries {
+		b.Run(fmt.Sprint(query.Capabilities), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var matching []*RegisteredTool
+				for _, tool := range registry.tools {
+					if tool.Tool.DiscoverableBy("requester") && !tool.Stale && matchesQuery(tool, query) {
+						matching = append(matching, tool)
+					}
+				}
+				if query.MaxResults > 0 && len(matching) > query.MaxResults {
+					matching = matching[:query.MaxResults]
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+)
+
+// toolRoute is where the broker sends a tool call: the agent that will
+// answer it, that agent's MCP endpoint and the tool name to call there
+type toolRoute struct {
+	AgentID  string
+	Endpoint string
+	Tool     string
+}
+
+// routeToolCall resolves where a call to provider's tool is delivered.
+// Tools of an agent with a discovery proxy are relayed through the proxy,
+// which receives the qualified "agent/tool" name so it can forward the call
+// on. When the broker itself is the proxy, calls go straight to the agent.
+func (b *Broker) routeToolCall(provider *RegisteredTool) toolRoute {
+	if provider.Proxy == "" || provider.Proxy == b.id {
+		return toolRoute{AgentID: provider.AgentID, Endpoint: provider.MCPEndpoint, Tool: provider.Tool.Name}
+	}
+
+	route := toolRoute{AgentID: provider.Proxy, Tool: toolKey(provider.AgentID, provider.Tool.Name)}
+	if proxy, exists := b.mcpRegistry.GetAgent(provider.Proxy); exists {
+		route.Endpoint = proxy.MCPEndpoint
+	}
+	return route
+}
+
+// validateDiscoveryProxy checks that an agent's designated discovery proxy
+// is the broker or another registered agent
+func (b *Broker) validateDiscoveryProxy(agentID, proxy string) error {
+	if proxy == "" || proxy == b.id {
+		return nil
+	}
+	if proxy == agentID {
+		return fmt.Errorf("agent %s cannot be its own discovery proxy", agentID)
+	}
+
+	b.mu.RLock()
+	_, registered := b.agents[proxy]
+	b.mu.RUnlock()
+	if !registered {
+		return fmt.Errorf("discovery proxy %s is not registered", proxy)
+	}
+	return nil
+}
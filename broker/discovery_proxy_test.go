@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+// fakeMCPServer answers tools/call requests, reporting the tool names called.
+// The broker's background tools/list probes get an empty list.
+func fakeMCPServer(t *testing.T, calls chan<- string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Method string `json:"method"`
+			Params struct {
+				Name string `json:"name"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Method == "tools/list" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"result":  map[string]interface{}{"tools": []protocol.MCPTool{}},
+				"id":      1,
+			})
+			return
+		}
+		calls <- request.Params.Name
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"result":  map[string]interface{}{"celsius": 19.5},
+			"id":      1,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDiscoveryProxy(t *testing.T) {
+	broker := NewBroker()
+
+	register := func(agentID string, body protocol.RegisterAgentBody) *bufferedResponse {
+		env := &protocol.GenericEnvelope{
+			BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent},
+		}
+		env.Agent = agentID
+		env.Body, _ = json.Marshal(body)
+
+		recorder := newBufferedResponse()
+		broker.handleRegisterAgent(recorder, env)
+		return recorder
+	}
+
+	callTool := func(tool string) protocol.ToolResultBody {
+		env := &protocol.GenericEnvelope{
+			BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall},
+		}
+		env.Agent = "caller-agent"
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: tool})
+
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+
+		var result protocol.ToolResultEnvelope
+		if err := json.Unmarshal(recorder.body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to decode tool result: %v", err)
+		}
+		return result.Body
+	}
+
+	gatewayCalls := make(chan string, 1)
+	gateway := fakeMCPServer(t, gatewayCalls)
+	if recorder := register("gateway", protocol.RegisterAgentBody{MCPEndpoint: gateway.URL}); recorder.status != http.StatusOK {
+		t.Fatalf("Failed to register gateway: %d %s", recorder.status, recorder.body.String())
+	}
+
+	nodeTools := &protocol.BodyDefinition{Name: "sensor", MCPTools: []protocol.MCPTool{{Name: "sensor.read"}}}
+
+	// Unknown proxies are rejected
+	if recorder := register("iot-node", protocol.RegisterAgentBody{BodyDefinition: nodeTools, DiscoveryProxy: "missing"}); recorder.status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown proxy, got %d", recorder.status)
+	}
+
+	recorder := register("iot-node", protocol.RegisterAgentBody{
+		MCPEndpoint:    "https://iot-node.invalid/mcp",
+		BodyDefinition: nodeTools,
+		DiscoveryProxy: "gateway",
+	})
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Failed to register node: %d %s", recorder.status, recorder.body.String())
+	}
+
+	// Discovery lists the proxy's endpoint instead of the node's
+	tools, err := broker.mcpRegistry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"sensor.*"}})
+	if err != nil || len(tools) != 1 {
+		t.Fatalf("Expected 1 discovered agent, got %d (%v)", len(tools), err)
+	}
+	if tools[0].AgentID != "iot-node" || tools[0].MCPEndpoint != gateway.URL || tools[0].ProxiedBy != "gateway" {
+		t.Errorf("Unexpected discovered tool: %+v", tools[0])
+	}
+
+	// Calls are relayed through the proxy with the qualified tool name
+	result := callTool("sensor.read")
+	if !result.Success {
+		t.Fatalf("Expected relayed call to succeed, got %q", result.Error)
+	}
+	if name := <-gatewayCalls; name != "iot-node/sensor.read" {
+		t.Errorf("Expected proxy to receive iot-node/sensor.read, got %s", name)
+	}
+
+	// With the broker as proxy, the node's endpoint is hidden but calls go to it
+	nodeCalls := make(chan string, 1)
+	node := fakeMCPServer(t, nodeCalls)
+	recorder = register("iot-node", protocol.RegisterAgentBody{
+		MCPEndpoint:    node.URL,
+		BodyDefinition: nodeTools,
+		DiscoveryProxy: broker.id,
+	})
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Failed to register node: %d %s", recorder.status, recorder.body.String())
+	}
+
+	tools, _ = broker.mcpRegistry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"sensor.*"}})
+	if len(tools) != 1 || tools[0].MCPEndpoint != "" || tools[0].ProxiedBy != broker.id {
+		t.Errorf("Unexpected discovered tool: %+v", tools)
+	}
+
+	if result := callTool("sensor.read"); !result.Success {
+		t.Fatalf("Expected call through the broker to succeed, got %q", result.Error)
+	}
+	if name := <-nodeCalls; name != "sensor.read" {
+		t.Errorf("Expected node to receive sensor.read, got %s", name)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// Outcomes of a doctor check
+const (
+	DoctorOK   = "ok"
+	DoctorWarn = "warn"
+	DoctorFail = "fail"
+)
+
+const (
+	// doctorProbeTimeout bounds each network probe
+	doctorProbeTimeout = 5 * time.Second
+	// doctorCertWarning is how close to expiry a certificate draws a warning
+	doctorCertWarning = 30 * 24 * time.Hour
+	// doctorSkewWarning is the clock skew to a peer that draws a warning;
+	// past protocol.EventStreamMaxSkew signed requests are rejected
+	doctorSkewWarning = 30 * time.Second
+)
+
+// doctorEarliestClock is a date any working system clock is past
+var doctorEarliestClock = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// DoctorCheck is the outcome of one check, with what to do about a problem
+type DoctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Fix    string // Empty for passing checks
+}
+
+// DoctorConfig is the broker configuration the doctor checks, as given on
+// the command line
+type DoctorConfig struct {
+	Listen           string
+	Advertise        string
+	Peers            []string
+	Parent           string
+	StorageKind      string
+	DBPath           string
+	SQLDriver        string
+	ReplayCache      string
+	Raft             RaftConfig
+	RaftListen       string
+	RaftPeers        string
+	RaftCA           string
+	RaftCert         string
+	RaftKey          string
+	UsageRetention   string
+	CloudEventsSinks []string
+	CloudEventsMode  string
+	ToolTimeout      time.Duration
+	AgentTTL         time.Duration
+	Certificate      tls.Certificate
+	InsecureHTTP     bool
+}
+
+// Doctor checks a configuration before the broker goes live
+type Doctor struct {
+	config DoctorConfig
+	client *http.Client
+	now    func() time.Time
+	checks []DoctorCheck
+}
+
+// NewDoctor creates a doctor for config
+func NewDoctor(config DoctorConfig) *Doctor {
+	return &Doctor{
+		config: config,
+		client: &http.Client{
+			Timeout: doctorProbeTimeout,
+			Transport: &http.Transport{
+				// Certificates are checked separately, so an untrusted one is
+				// reported instead of hiding whether the peer is up
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+		now: time.Now,
+	}
+}
+
+// Run performs every check and returns their outcomes in order
+func (d *Doctor) Run() []DoctorCheck {
+	d.checks = nil
+	d.checkConfig()
+	d.checkClock()
+	d.checkListener("listen", d.config.Listen, "-listen")
+	if d.config.InsecureHTTP {
+		d.warn("certificate", "-insecure-http serves plain HTTP without TLS", "use TLS outside local development")
+	} else {
+		d.checkServingCertificate()
+	}
+	d.checkStorage()
+	if d.config.ReplayCache != "" {
+		d.checkReplayCache()
+	}
+	for _, peer := range d.config.Peers {
+		d.checkPeer(peer)
+	}
+	if d.config.Parent != "" {
+		d.checkPeer(d.config.Parent)
+	}
+	return d.checks
+}
+
+// Failed reports whether any check failed
+func (d *Doctor) Failed() bool {
+	for _, check := range d.checks {
+		if check.Status == DoctorFail {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteReport writes the outcomes one per line, problems followed by their
+// fix, and a summary
+func (d *Doctor) WriteReport(w io.Writer) {
+	counts := make(map[string]int)
+	for _, check := range d.checks {
+		counts[check.Status]++
+		fmt.Fprintf(w, "[%-4s] %s: %s\n", check.Status, check.Name, check.Detail)
+		if check.Fix != "" {
+			fmt.Fprintf(w, "       fix: %s\n", check.Fix)
+		}
+	}
+	fmt.Fprintf(w, "%d checks: %d ok, %d warnings, %d failures\n",
+		len(d.checks), counts[DoctorOK], counts[DoctorWarn], counts[DoctorFail])
+}
+
+func (d *Doctor) pass(name, detail string, args ...interface{}) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: DoctorOK, Detail: fmt.Sprintf(detail, args...)})
+}
+
+func (d *Doctor) warn(name, detail, fix string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: DoctorWarn, Detail: detail, Fix: fix})
+}
+
+func (d *Doctor) fail(name, detail, fix string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: DoctorFail, Detail: detail, Fix: fix})
+}
+
+// checkConfig validates settings that are otherwise only checked once the
+// broker is starting
+func (d *Doctor) checkConfig() {
+	config := d.config
+	valid := true
+
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		d.fail("config", fmt.Sprintf("-listen %q is not host:port: %v", config.Listen, err), "use an address such as :4433 or 0.0.0.0:4433")
+		valid = false
+	}
+	if config.Advertise != "" {
+		if err := checkBrokerURL(config.Advertise); err != nil {
+			d.fail("config", fmt.Sprintf("-advertise %q: %v", config.Advertise, err), "advertise the https:// URL peers reach this broker at")
+			valid = false
+		}
+	}
+	for _, peer := range config.Peers {
+		if err := checkBrokerURL(peer); err != nil {
+			d.fail("config", fmt.Sprintf("-peers entry %q: %v", peer, err), "list peers as comma-separated https:// URLs")
+			valid = false
+		}
+	}
+	if config.Parent != "" {
+		if err := checkBrokerURL(config.Parent); err != nil {
+			d.fail("config", fmt.Sprintf("-parent %q: %v", config.Parent, err), "give the https:// URL of the parent broker")
+			valid = false
+		}
+	}
+	if _, err := ParseRetentionTiers(config.UsageRetention); err != nil {
+		d.fail("config", fmt.Sprintf("-usage-retention: %v", err), "write tiers as raw=24h,hourly=168h,daily=720h")
+		valid = false
+	}
+	if err := NewCloudEventsExporter("").Configure(config.CloudEventsSinks, config.CloudEventsMode); err != nil {
+		d.fail("config", fmt.Sprintf("-cloudevents-mode: %v", err), "use binary or structured")
+		valid = false
+	}
+	for _, sink := range config.CloudEventsSinks {
+		if parsed, err := url.Parse(sink); err != nil || parsed.Host == "" {
+			d.fail("config", fmt.Sprintf("-cloudevents-sinks entry %q is not a URL", sink), "list sinks as comma-separated http(s):// URLs")
+			valid = false
+		}
+	}
+	if config.ToolTimeout <= 0 {
+		d.fail("config", fmt.Sprintf("-tool-timeout %v is not positive", config.ToolTimeout), "set a timeout such as 30s")
+		valid = false
+	}
+	if config.AgentTTL < 0 {
+		d.fail("config", fmt.Sprintf("-agent-ttl %v is negative", config.AgentTTL), "set a TTL such as 90s, or 0 to disable reaping")
+		valid = false
+	}
+
+	if valid {
+		d.pass("config", "flags are valid")
+	}
+}
+
+// checkBrokerURL checks a URL brokers are reached at
+func checkBrokerURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" {
+		return fmt.Errorf("brokers are reached over https, not %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+// checkClock catches system clocks that were never set; skew against peers
+// is checked with each peer
+func (d *Doctor) checkClock() {
+	now := d.now()
+	if now.Before(doctorEarliestClock) {
+		d.fail("clock", fmt.Sprintf("system clock reads %s", now.UTC().Format(time.RFC3339)),
+			"set the clock or enable NTP; signed envelopes and certificates depend on it")
+		return
+	}
+	d.pass("clock", "system clock reads %s", now.UTC().Format(time.RFC3339))
+}
+
+// checkListener checks that an address can be listened on
+func (d *Doctor) checkListener(name, address, flagName string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		d.fail(name, fmt.Sprintf("cannot listen on %s: %v", address, err),
+			fmt.Sprintf("stop the process holding the address, or change %s", flagName))
+		return
+	}
+	listener.Close()
+	d.pass(name, "%s is free", address)
+}
+
+// checkServingCertificate checks the certificate the broker will serve
+func (d *Doctor) checkServingCertificate() {
+	chain, err := parseChain(d.config.Certificate.Certificate)
+	if err != nil || len(chain) == 0 {
+		d.fail("certificate", fmt.Sprintf("cannot parse the broker certificate: %v", err), "provide a PEM certificate and matching key")
+		return
+	}
+	d.checkCertificate("certificate", chain, "")
+}
+
+// parseChain parses DER certificates, leaf first
+func parseChain(raw [][]byte) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// checkCertificate checks a chain's validity period, and whether it chains
+// to a trusted root for host
+func (d *Doctor) checkCertificate(name string, chain []*x509.Certificate, host string) {
+	leaf := chain[0]
+	now := d.now()
+	switch {
+	case now.After(leaf.NotAfter):
+		d.fail(name, fmt.Sprintf("%s expired on %s", describeCert(leaf), leaf.NotAfter.UTC().Format(time.RFC3339)), "renew the certificate")
+		return
+	case now.Before(leaf.NotBefore):
+		d.fail(name, fmt.Sprintf("%s is not valid until %s", describeCert(leaf), leaf.NotBefore.UTC().Format(time.RFC3339)),
+			"check the system clock, or reissue the certificate")
+		return
+	case leaf.NotAfter.Sub(now) < doctorCertWarning:
+		d.warn(name, fmt.Sprintf("%s expires on %s", describeCert(leaf), leaf.NotAfter.UTC().Format(time.RFC3339)), "renew the certificate")
+		return
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates, CurrentTime: now})
+	if err != nil {
+		d.warn(name, fmt.Sprintf("%s is not trusted: %v", describeCert(leaf), err),
+			"agents must skip verification or pin this certificate; use one from a trusted CA for production")
+		return
+	}
+	d.pass(name, "%s is trusted and valid until %s", describeCert(leaf), leaf.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// describeCert names a certificate in a report
+func describeCert(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return fmt.Sprintf("certificate %q", cert.Subject.CommonName)
+	}
+	if len(cert.DNSNames) > 0 {
+		return fmt.Sprintf("certificate for %s", cert.DNSNames[0])
+	}
+	return "certificate"
+}
+
+// checkStorage opens the storage backend and reads the registry back, as
+// the broker does on startup
+func (d *Doctor) checkStorage() {
+	config := d.config
+	if config.StorageKind == StorageRaft {
+		d.checkRaft()
+		return
+	}
+
+	started := d.now()
+	store, err := OpenStorage(config.StorageKind, config.DBPath, config.SQLDriver)
+	if err != nil {
+		d.fail("storage", fmt.Sprintf("cannot open %s storage: %v", config.StorageKind, err),
+			"check -storage and -db; a bolt file is locked while another broker has it open")
+		return
+	}
+	defer store.Close()
+
+	agents, err := store.LoadAgents()
+	if err != nil {
+		d.fail("storage", fmt.Sprintf("cannot read %s storage: %v", config.StorageKind, err), "check the backend's permissions and schema")
+		return
+	}
+	if _, err := store.RecordNonce("fem-doctor", fmt.Sprintf("doctor-%d", started.UnixNano()), started.Add(time.Minute)); err != nil {
+		d.fail("storage", fmt.Sprintf("cannot write to %s storage: %v", config.StorageKind, err), "check the backend's permissions")
+		return
+	}
+	d.pass("storage", "%s storage holds %d agents (%v)", config.StorageKind, len(agents), d.now().Sub(started).Round(time.Millisecond))
+}
+
+// checkReplayCache records a nonce in the shared replay cache
+func (d *Doctor) checkReplayCache() {
+	started := d.now()
+	cache, err := OpenReplayCache(d.config.ReplayCache)
+	if err != nil {
+		d.fail("replay cache", err.Error(), "check -replay-cache")
+		return
+	}
+	defer cache.Close()
+
+	if _, err := cache.RecordNonce("fem-doctor", fmt.Sprintf("doctor-%d", started.UnixNano()), started.Add(time.Minute)); err != nil {
+		d.fail("replay cache", fmt.Sprintf("cannot record nonces: %v", err), "check that every replica can reach the -replay-cache servers")
+		return
+	}
+	d.pass("replay cache", "nonces recorded in %s (%v)", d.config.ReplayCache, d.now().Sub(started).Round(time.Millisecond))
+}
+
+// checkRaft checks the raft node's directory, listener and peers without
+// joining the cluster
+func (d *Doctor) checkRaft() {
+	config := d.config
+	peers, err := ParseRaftPeers(config.RaftPeers)
+	if err != nil {
+		d.fail("raft", err.Error(), "list peers as id=https://host:port pairs")
+		return
+	}
+	if config.Raft.ID == "" {
+		d.fail("raft", "no raft node ID", "set -raft-id or -broker-id")
+		return
+	}
+	if config.Raft.Token == "" {
+		d.fail("raft", "no raft token", "set the same -raft-token on every node")
+		return
+	}
+	_, roots, err := LoadRaftTLS(config.RaftCA, config.RaftCert, config.RaftKey)
+	if err != nil {
+		d.fail("raft", fmt.Sprintf("cannot load raft certificates: %v", err), "give -raft-cert and -raft-key, issued by the -raft-ca every node trusts")
+		return
+	}
+	if _, self := peers[config.Raft.ID]; self {
+		d.fail("raft", fmt.Sprintf("-raft-peers lists this node (%s)", config.Raft.ID), "list only the other nodes")
+	}
+	if len(peers)%2 == 1 {
+		d.warn("raft", fmt.Sprintf("cluster of %d nodes", len(peers)+1), "use an odd number of nodes; an even one tolerates no more failures than one node fewer")
+	}
+
+	if config.Raft.Dir != "" {
+		probe, err := os.CreateTemp(config.Raft.Dir, ".doctor-*")
+		if err != nil {
+			d.fail("raft", fmt.Sprintf("cannot write to -raft-dir: %v", err), "create the directory and give the broker write access")
+		} else {
+			probe.Close()
+			os.Remove(probe.Name())
+			d.pass("raft", "%s is writable", filepath.Clean(config.Raft.Dir))
+		}
+	}
+	d.checkListener("raft", config.RaftListen, "-raft-listen")
+
+	// Peers are probed the way the node reaches them, trusting -raft-ca
+	client := &http.Client{
+		Timeout:   doctorProbeTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	for id, endpoint := range peers {
+		name := "raft peer " + id
+		request, err := http.NewRequest(http.MethodGet, endpoint+"/raft/status", nil)
+		if err != nil {
+			d.fail(name, err.Error(), "check the peer's URL in -raft-peers")
+			continue
+		}
+		request.Header.Set("Authorization", "Bearer "+config.Raft.Token)
+		resp, err := client.Do(request)
+		var untrusted *tls.CertificateVerificationError
+		if errors.As(err, &untrusted) {
+			d.fail(name, fmt.Sprintf("untrusted certificate: %v", err), "issue every node's -raft-cert from the -raft-ca, for the host -raft-peers names")
+			continue
+		}
+		if err != nil {
+			d.warn(name, fmt.Sprintf("unreachable: %v", err), "start the node, or check the network between nodes; a majority must be up to elect a leader")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			d.fail(name, "rejected the raft token", "set the same -raft-token on every node")
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			d.fail(name, fmt.Sprintf("status %d from %s", resp.StatusCode, endpoint), "check the URL points at the node's -raft-listen address")
+			continue
+		}
+		d.pass(name, "reachable at %s", endpoint)
+	}
+}
+
+// checkPeer probes a federation peer's health, certificate and clock
+func (d *Doctor) checkPeer(peer string) {
+	name := "peer " + peer
+	if checkBrokerURL(peer) != nil {
+		return // Reported with the configuration
+	}
+
+	sent := d.now()
+	resp, err := d.client.Get(peer + "/health")
+	if err != nil {
+		d.fail(name, fmt.Sprintf("unreachable: %v", err), "start the peer, or check the URL and firewall")
+		return
+	}
+	resp.Body.Close()
+	received := d.now()
+
+	if resp.StatusCode != http.StatusOK {
+		d.fail(name, fmt.Sprintf("health check returned status %d", resp.StatusCode), "check the URL points at a FEM broker")
+		return
+	}
+	d.pass(name, "healthy (%v)", received.Sub(sent).Round(time.Millisecond))
+
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		parsed, _ := url.Parse(peer)
+		d.checkCertificate(name+" certificate", resp.TLS.PeerCertificates, parsed.Hostname())
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// The Date header has one-second resolution, so allow for that and the
+	// round trip
+	skew := date.Sub(sent.Add(received.Sub(sent) / 2)).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	switch {
+	case skew > protocol.EventStreamMaxSkew:
+		d.fail(name+" clock", fmt.Sprintf("clock differs by %v", skew), "enable NTP on both brokers; signed requests are rejected past "+protocol.EventStreamMaxSkew.String())
+	case skew > doctorSkewWarning:
+		d.warn(name+" clock", fmt.Sprintf("clock differs by %v", skew), "enable NTP on both brokers")
+	default:
+		d.pass(name+" clock", "clock differs by %v", skew)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doctorTestCert creates a self-signed certificate valid between notBefore
+// and notAfter
+func doctorTestCert(t *testing.T, notBefore, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "doctor-test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// doctorStatuses maps each check's name to its status
+func doctorStatuses(checks []DoctorCheck) map[string]string {
+	statuses := make(map[string]string)
+	for _, check := range checks {
+		if statuses[check.Name] != DoctorFail {
+			statuses[check.Name] = check.Status
+		}
+	}
+	return statuses
+}
+
+func healthyDoctorConfig(t *testing.T) DoctorConfig {
+	return DoctorConfig{
+		Listen:          "127.0.0.1:0",
+		StorageKind:     StorageMemory,
+		UsageRetention:  defaultRetentionTiers.String(),
+		CloudEventsMode: CloudEventsBinary,
+		ToolTimeout:     defaultToolCallTimeout,
+		Certificate:     doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(365*24*time.Hour)),
+	}
+}
+
+func TestDoctorHealthyConfig(t *testing.T) {
+	peer := httptest.NewTLSServer(NewBroker())
+	defer peer.Close()
+
+	config := healthyDoctorConfig(t)
+	config.Peers = []string{peer.URL}
+	doctor := NewDoctor(config)
+	checks := doctor.Run()
+
+	statuses := doctorStatuses(checks)
+	for _, name := range []string{"config", "clock", "listen", "storage", "peer " + peer.URL, "peer " + peer.URL + " clock"} {
+		if statuses[name] != DoctorOK {
+			t.Errorf("Expected %s to pass, got %q", name, statuses[name])
+		}
+	}
+	// Self-signed certificates work, but are worth a warning
+	if statuses["certificate"] != DoctorWarn {
+		t.Errorf("Expected a warning for the self-signed certificate, got %q", statuses["certificate"])
+	}
+	if doctor.Failed() {
+		var report bytes.Buffer
+		doctor.WriteReport(&report)
+		t.Errorf("Expected no failures:\n%s", report.String())
+	}
+}
+
+func TestDoctorReportsProblems(t *testing.T) {
+	config := healthyDoctorConfig(t)
+	config.Advertise = "http://broker.example.com"
+	config.UsageRetention = "weekly=1h"
+	config.StorageKind = "etcd"
+	config.Peers = []string{"https://127.0.0.1:1"}
+	config.Certificate = doctorTestCert(t, time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+
+	doctor := NewDoctor(config)
+	statuses := doctorStatuses(doctor.Run())
+	for _, name := range []string{"config", "certificate", "storage", "peer https://127.0.0.1:1"} {
+		if statuses[name] != DoctorFail {
+			t.Errorf("Expected %s to fail, got %q", name, statuses[name])
+		}
+	}
+	if !doctor.Failed() {
+		t.Error("Expected the doctor to report failures")
+	}
+
+	var report bytes.Buffer
+	doctor.WriteReport(&report)
+	for _, expected := range []string{"-advertise", "-usage-retention", "expired", "fix: "} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("Expected the report to mention %q:\n%s", expected, report.String())
+		}
+	}
+}
+
+func TestDoctorClockAndExpiry(t *testing.T) {
+	config := healthyDoctorConfig(t)
+	config.Certificate = doctorTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(7*24*time.Hour))
+
+	doctor := NewDoctor(config)
+	statuses := doctorStatuses(doctor.Run())
+	if statuses["certificate"] != DoctorWarn {
+		t.Errorf("Expected a warning for a certificate expiring within a week, got %q", statuses["certificate"])
+	}
+
+	doctor.now = func() time.Time { return time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC) }
+	statuses = doctorStatuses(doctor.Run())
+	if statuses["clock"] != DoctorFail {
+		t.Errorf("Expected an unset clock to fail, got %q", statuses["clock"])
+	}
+}
+
+func TestDoctorRaft(t *testing.T) {
+	nodes := raftCluster(t, 2, 0)
+
+	config := healthyDoctorConfig(t)
+	config.StorageKind = StorageRaft
+	config.Raft = RaftConfig{ID: "node-new", Dir: t.TempDir(), Token: "wrong-secret"}
+	config.RaftListen = "127.0.0.1:0"
+	config.RaftPeers = "node-0=" + nodes[0].server.URL
+	config.RaftCA, config.RaftCert, config.RaftKey = raftTestTLSFiles(t)
+
+	statuses := doctorStatuses(NewDoctor(config).Run())
+	if statuses["raft"] != DoctorOK {
+		t.Errorf("Expected the raft directory and listener to pass, got %q", statuses["raft"])
+	}
+	if statuses["raft peer node-0"] != DoctorFail {
+		t.Errorf("Expected a token mismatch to fail, got %q", statuses["raft peer node-0"])
+	}
+
+	config.Raft.Token = "cluster-secret"
+	statuses = doctorStatuses(NewDoctor(config).Run())
+	if statuses["raft peer node-0"] != DoctorOK {
+		t.Errorf("Expected the raft peer to pass, got %q", statuses["raft peer node-0"])
+	}
+
+	config.RaftCA = ""
+	statuses = doctorStatuses(NewDoctor(config).Run())
+	if statuses["raft peer node-0"] != DoctorFail {
+		t.Errorf("Expected an untrusted peer certificate to fail, got %q", statuses["raft peer node-0"])
+	}
+
+	config.Raft.Token = ""
+	statuses = doctorStatuses(NewDoctor(config).Run())
+	if statuses["raft"] != DoctorFail {
+		t.Errorf("Expected a node without a raft token to fail, got %q", statuses["raft"])
+	}
+}
+
+func TestDoctorInsecureHTTP(t *testing.T) {
+	config := healthyDoctorConfig(t)
+	config.Certificate = tls.Certificate{}
+	config.InsecureHTTP = true
+	doctor := NewDoctor(config)
+
+	// Plain HTTP needs no certificate, but is flagged
+	if status := doctorStatuses(doctor.Run())["certificate"]; status != DoctorWarn {
+		t.Errorf("Expected a certificate warning, got %q", status)
+	}
+	if doctor.Failed() {
+		t.Error("Expected plain HTTP without a certificate to pass")
+	}
+}
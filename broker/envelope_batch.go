@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/fep-fem/protocol"
+)
+
+// handleBatch handles the envelopes of a batch in order, each as if it had
+// arrived alone over the batch's connection, and answers with the outcome
+// of each. Once the batch's signature is verified, its session vouches for
+// the envelopes it carries.
+func (b *Broker) handleBatch(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.BatchBody
+	if err := env.GetBodyAs(&body); err != nil || len(body.Envelopes) == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Envelopes) > protocol.MaxBatchSize {
+		b.replyError(w, env, http.StatusRequestEntityTooLarge, protocol.ErrorTooLarge,
+			fmt.Sprintf("Batch of %d envelopes exceeds the limit of %d", len(body.Envelopes), protocol.MaxBatchSize))
+		return
+	}
+
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	if !registered {
+		http.Error(w, fmt.Sprintf("Agent %s is not registered", env.Agent), http.StatusNotFound)
+		return
+	}
+	if agent.PubKey != nil {
+		if err := b.verifySender(w, env, agent.PubKey); err != nil {
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+			return
+		}
+	}
+
+	response := protocol.BatchResponse{Status: "processed", Results: make([]protocol.BatchResult, 0, len(body.Envelopes))}
+	for index, raw := range body.Envelopes {
+		result := b.dispatchBatched(index, raw, env)
+		response.Processed++
+		if result.Status != http.StatusOK {
+			response.Failed++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// dispatchBatched parses and dispatches one envelope of a batch
+func (b *Broker) dispatchBatched(index int, raw json.RawMessage, batch *protocol.GenericEnvelope) protocol.BatchResult {
+	result := protocol.BatchResult{Index: index}
+
+	envelope, err := protocol.ParseEnvelope(raw)
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result
+	}
+	result.Type = envelope.Type
+	switch {
+	case envelope.Agent != batch.Agent:
+		result.Status = http.StatusForbidden
+		result.Error = "envelope agent does not match the batch"
+		return result
+	case envelope.Type == protocol.EnvelopeBatch:
+		result.Status = http.StatusBadRequest
+		result.Error = "batches cannot be nested"
+		return result
+	}
+	envelope.Hops = batch.Hops
+	envelope.RemoteAddr = batch.RemoteAddr
+	envelope.ClientCert = batch.ClientCert
+	envelope.Session = batch.Session
+	envelope.Bearer = batch.Bearer
+
+	recorder := newBufferedResponse()
+	b.dispatchEnvelope(recorder, envelope)
+	b.recordEnvelope(envelope, len(raw), recorder.body.Len(), recorder.status)
+
+	result.Status = recorder.status
+	result.Response, result.Error = splitReply(recorder.status, recorder.body.Bytes())
+	return result
+}
+
+// SendBatch signs envelopes of this agent and sends them in one batch,
+// returning the outcome of each in order. Tool calls in a batch are
+// answered in their result, so a batch returns once its calls have.
+func (c *MCPClient) SendBatch(envelopes ...protocol.SignableEnvelope) ([]protocol.BatchResult, error) {
+	batch := protocol.NewBatch(c.agentID)
+	for _, envelope := range envelopes {
+		if err := protocol.SignEnvelope(envelope, c.signer); err != nil {
+			return nil, fmt.Errorf("failed to sign envelope: %w", err)
+		}
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal envelope: %w", err)
+		}
+		batch.Body.Envelopes = append(batch.Body.Envelopes, data)
+	}
+	if err := protocol.SignEnvelope(batch, c.signer); err != nil {
+		return nil, fmt.Errorf("failed to sign batch: %w", err)
+	}
+
+	payload, err := c.sendRequestRaw(batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send batch: %w", err)
+	}
+	var response protocol.BatchResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return response.Results, nil
+}
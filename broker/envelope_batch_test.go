@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestSendBatch(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	_, key, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "agent-a",
+		BrokerURL:   server.URL,
+		PrivateKey:  key,
+		TLSInsecure: true,
+	})
+	pubKey := key.Public().(ed25519.PublicKey)
+	if err := client.Register(protocol.RegisterAgentBody{PubKey: protocol.EncodePublicKey(pubKey)}); err != nil {
+		t.Fatalf("Registration failed: %v", err)
+	}
+
+	event := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "agent-a")
+	event.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "batch.test"})
+	heartbeat := protocol.NewAgentHeartbeat("agent-a", "ok")
+	results, err := client.SendBatch(
+		heartbeat,
+		event,
+		heartbeat,                                 // Replayed
+		protocol.NewAgentHeartbeat("agent-b", ""), // Another agent's
+		protocol.NewBatch("agent-a"),              // Nested
+	)
+	if err != nil {
+		t.Fatalf("Sending the batch failed: %v", err)
+	}
+
+	want := []int{http.StatusOK, http.StatusOK, http.StatusConflict, http.StatusForbidden, http.StatusBadRequest}
+	if len(results) != len(want) {
+		t.Fatalf("Expected %d results, got %+v", len(want), results)
+	}
+	for i, result := range results {
+		if result.Index != i || result.Status != want[i] {
+			t.Errorf("Envelope %d: expected %d, got %+v", i, want[i], result)
+		}
+	}
+	var emitted map[string]interface{}
+	if json.Unmarshal(results[1].Response, &emitted); emitted["status"] != "emitted" || results[1].Type != protocol.EnvelopeEmitEvent {
+		t.Errorf("Expected the event's response, got %s", results[1].Response)
+	}
+	var replayed protocol.ErrorEnvelope
+	if json.Unmarshal(results[2].Response, &replayed); replayed.Body.Code != protocol.ErrorReplayed {
+		t.Errorf("Expected the replay answered with an error envelope, got %s", results[2].Response)
+	}
+}
+
+func TestBatchRefused(t *testing.T) {
+	broker := NewBroker()
+	pubKey, key, _ := protocol.GenerateKeyPair()
+	_, otherKey, _ := protocol.GenerateKeyPair()
+	registerWithKey(broker, "agent-a", pubKey, "", "")
+
+	send := func(batch *protocol.BatchEnvelope, signer ed25519.PrivateKey) int {
+		batch.Sign(signer)
+		data, _ := json.Marshal(batch)
+		env, _ := protocol.ParseEnvelope(data)
+		recorder := newBufferedResponse()
+		broker.dispatchEnvelope(recorder, env)
+		return recorder.status
+	}
+
+	heartbeat := protocol.NewAgentHeartbeat("agent-a", "ok")
+	heartbeat.Sign(key)
+	data, _ := json.Marshal(heartbeat)
+	if status := send(protocol.NewBatch("agent-a", data), otherKey); status != http.StatusUnauthorized {
+		t.Errorf("Expected a batch with a bad signature to be refused, got %d", status)
+	}
+	if status := send(protocol.NewBatch("agent-a"), key); status != http.StatusBadRequest {
+		t.Errorf("Expected an empty batch to be refused, got %d", status)
+	}
+	large := protocol.NewBatch("agent-a")
+	for len(large.Body.Envelopes) <= protocol.MaxBatchSize {
+		large.Body.Envelopes = append(large.Body.Envelopes, data)
+	}
+	if status := send(large, key); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a batch over the limit to be refused, got %d", status)
+	}
+
+	client := NewMCPClient(MCPClientConfig{AgentID: "agent-a", BrokerURL: "https://127.0.0.1:1", PrivateKey: key})
+	var unreachable *deliveryError
+	if _, err := client.SendBatch(protocol.NewAgentHeartbeat("agent-a", "ok")); !errors.As(err, &unreachable) {
+		t.Errorf("Expected an unreachable broker to fail the batch, got %v", err)
+	}
+}
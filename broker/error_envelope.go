@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fep-fem/protocol"
+)
+
+// replyError answers a failed envelope with a signed error envelope. A
+// Retry-After header already set on w is carried in the body as well. env
+// may be nil when the request could not be parsed.
+func (b *Broker) replyError(w http.ResponseWriter, env *protocol.GenericEnvelope, status int, code, message string) {
+	b.replyErrorDetails(w, env, status, code, message, nil)
+}
+
+// replyErrorDetails is replyError with details for the error body
+func (b *Broker) replyErrorDetails(w http.ResponseWriter, env *protocol.GenericEnvelope, status int, code, message string, details map[string]interface{}) {
+	body := protocol.ErrorBody{
+		Code:      code,
+		Message:   message,
+		Retryable: protocol.RetryableStatus(status),
+		Details:   details,
+	}
+	if env != nil {
+		body.CorrelationID = env.Nonce
+	}
+	if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil {
+		body.RetryAfterMs = int64(seconds) * 1000
+	}
+
+	reply := protocol.NewError(b.id, body)
+	if err := reply.Sign(b.privateKey); err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", protocol.ContentTypeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// errorEnvelopeWriter turns the plain-text errors handlers write with
+// http.Error into error envelopes, coded by their status. Responses that are
+// already JSON pass through untouched.
+type errorEnvelopeWriter struct {
+	http.ResponseWriter
+	broker   *Broker
+	envelope *protocol.GenericEnvelope
+	status   int // Error status held back until its message is written
+	message  bytes.Buffer
+}
+
+func (w *errorEnvelopeWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorEnvelopeWriter) Write(data []byte) (int, error) {
+	if w.status != 0 {
+		return w.message.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// finish sends the error envelope for a held back error
+func (w *errorEnvelopeWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+	w.Header().Del("X-Content-Type-Options")
+	message := strings.TrimSpace(w.message.String())
+	w.broker.replyError(w.ResponseWriter, w.envelope, w.status, protocol.ErrorCodeForStatus(w.status), message)
+}
+
+// splitReply separates a handler's buffered response into the JSON to
+// relay and, for failures, the error message, for transports that carry
+// both in one frame
+func splitReply(status int, body []byte) (json.RawMessage, string) {
+	body = bytes.TrimSpace(body)
+	if status == http.StatusOK {
+		if json.Valid(body) {
+			return body, ""
+		}
+		return nil, ""
+	}
+	var reply protocol.ErrorEnvelope
+	if err := json.Unmarshal(body, &reply); err == nil && reply.Type == protocol.EnvelopeError {
+		return body, reply.Body.Message
+	}
+	return nil, string(body)
+}
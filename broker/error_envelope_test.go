@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestBrokerAnswersWithErrorEnvelopes(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+	brokerKey := broker.privateKey.Public().(ed25519.PublicKey)
+
+	post := func(data []byte) (int, *protocol.ErrorEnvelope) {
+		resp, err := server.Client().Post(server.URL, protocol.ContentTypeJSON, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		parsed, err := protocol.ParseEnvelope(body)
+		if err != nil {
+			t.Fatalf("Expected an error envelope, got %q", body)
+		}
+		if err := parsed.Verify(brokerKey); err != nil {
+			t.Errorf("Expected the error envelope to be signed by the broker: %v", err)
+		}
+		typed, _ := parsed.ParseTypedEnvelope()
+		reply, _ := typed.(*protocol.ErrorEnvelope)
+		return resp.StatusCode, reply
+	}
+
+	unknown := protocol.NewEnvelope("teleport", "sensor-agent")
+	unknownData, _ := json.Marshal(unknown)
+	invalidBody := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "sensor-agent")
+	invalidBody.Body = json.RawMessage(`"not an event"`)
+	invalidData, _ := json.Marshal(invalidBody)
+	refused := protocol.NewEnvelope(protocol.EnvelopeRegisterBroker, "sensor-agent")
+	refused.Body, _ = json.Marshal(protocol.RegisterBrokerBody{BrokerID: "other-broker", Endpoint: "https://other-broker:8443"})
+	refusedData, _ := json.Marshal(refused)
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		status  int
+		code    string
+		nonce   string
+		message string
+	}{
+		{"malformed", []byte("{"), http.StatusBadRequest, protocol.ErrorInvalidEnvelope, "", ""},
+		{"unknown type", unknownData, http.StatusBadRequest, protocol.ErrorUnknownType, unknown.Nonce, "Unknown envelope type"},
+		{"invalid body", invalidData, http.StatusBadRequest, protocol.ErrorInvalidEnvelope, invalidBody.Nonce, "invalid emitEvent body: body must be an object, not a string"},
+		{"handler error", refusedData, http.StatusBadRequest, protocol.ErrorBadRequest, refused.Nonce, "brokerId must match the envelope agent"},
+	} {
+		status, reply := post(tc.data)
+		if status != tc.status || reply == nil || reply.Body.Code != tc.code || reply.Body.CorrelationID != tc.nonce || reply.Body.Retryable {
+			t.Errorf("%s: unexpected %d reply %+v", tc.name, status, reply)
+			continue
+		}
+		if tc.message != "" && reply.Body.Message != tc.message {
+			t.Errorf("%s: expected message %q, got %q", tc.name, tc.message, reply.Body.Message)
+		}
+	}
+
+	// SDK clients see the code through the error they return
+	_, key, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{AgentID: "sensor-agent", BrokerURL: server.URL, PrivateKey: key, TLSInsecure: true})
+	event := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "sensor-agent")
+	event.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "sensor.temperature"})
+	data, _ := json.Marshal(event)
+	if _, err := client.sendData(data); err != nil {
+		t.Fatalf("Sending the event failed: %v", err)
+	}
+	_, err := client.sendData(data)
+	var remote *protocol.RemoteError
+	if !errors.As(err, &remote) || remote.Code != protocol.ErrorReplayed || remote.CorrelationID != event.Nonce || remote.Status != http.StatusConflict {
+		t.Errorf("Expected a replay to be reported as REPLAYED, got %v", err)
+	}
+}
+
+func TestBrokerNamesTheFieldsOfInvalidBodies(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	call := protocol.NewEnvelope(protocol.EnvelopeToolCall, "caller-agent")
+	call.Body = json.RawMessage(`{"parameters": 5, "variants": ["v1", 2]}`)
+	data, _ := json.Marshal(call)
+	resp, err := server.Client().Post(server.URL, protocol.ContentTypeJSON, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", resp.StatusCode)
+	}
+
+	var reply protocol.ErrorEnvelope
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("Failed to decode the error envelope: %v", err)
+	}
+	fields, _ := reply.Body.Details["fields"].([]interface{})
+	want := map[string]string{
+		"tool":        "is required",
+		"parameters":  "must be an object or null, not an integer",
+		"variants[1]": "must be a string, not an integer",
+	}
+	if reply.Body.Code != protocol.ErrorInvalidEnvelope || len(fields) != len(want) {
+		t.Fatalf("Expected %d field errors, got %+v", len(want), reply.Body)
+	}
+	for _, field := range fields {
+		field, _ := field.(map[string]interface{})
+		name, _ := field["field"].(string)
+		if want[name] != field["message"] {
+			t.Errorf("Unexpected field error %v", field)
+		}
+	}
+}
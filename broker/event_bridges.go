@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fep-fem/protocol"
+)
+
+// EventBridge forwards events matching Pattern from the agents of one
+// namespace to the subscribers of another
+type EventBridge struct {
+	From    string
+	To      string
+	Pattern string
+}
+
+// ParseEventBridges parses bridges written as
+// "acme>globex=order.*,globex>acme=invoice.paid". A bridge runs one way;
+// two namespaces exchanging events need one in each direction.
+func ParseEventBridges(spec string) ([]EventBridge, error) {
+	var bridges []EventBridge
+	for _, field := range parseSinkList(spec) {
+		route, pattern, found := strings.Cut(field, "=")
+		from, to, arrow := strings.Cut(route, ">")
+		if !found || !arrow || pattern == "" {
+			return nil, fmt.Errorf("invalid event bridge %q, expected from>to=pattern", field)
+		}
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid event bridge %q, both namespaces are needed", field)
+		}
+		if from == to {
+			return nil, fmt.Errorf("event bridge %q joins namespace %s to itself", field, from)
+		}
+		bridges = append(bridges, EventBridge{From: from, To: to, Pattern: strings.TrimSpace(pattern)})
+	}
+	return bridges, nil
+}
+
+// EventBridges keeps each namespace's events among its own agents, except
+// where a bridge forwards them to another namespace
+type EventBridges struct {
+	bridges []EventBridge
+	mu      sync.RWMutex
+}
+
+// NewEventBridges creates a table without bridges, so no event leaves its
+// namespace
+func NewEventBridges() *EventBridges {
+	return &EventBridges{}
+}
+
+// Set replaces the bridges
+func (e *EventBridges) Set(bridges []EventBridge) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bridges = bridges
+}
+
+// Reaches reports whether an event emitted in namespace from may be
+// delivered to subscribers in namespace to. Events without a namespace,
+// such as those the broker raises itself, reach every namespace.
+func (e *EventBridges) Reaches(from, to, event string) bool {
+	if from == "" || from == to {
+		return true
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, bridge := range e.bridges {
+		if bridge.From == from && bridge.To == to && matchPattern(event, bridge.Pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventNamespace verifies an event's emitter and returns the namespace the
+// event is scoped to. Only events signed by this broker or a peer, such as
+// ingested ones, have none; an agent's events stay in its own namespace,
+// whether it was verified or is anonymous.
+func (b *Broker) eventNamespace(w http.ResponseWriter, env *protocol.GenericEnvelope) (string, error) {
+	if env.Agent == b.id {
+		if err := env.Verify(b.privateKey.Public().(ed25519.PublicKey)); err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+	if peer, isPeer := b.peers.Get(env.Agent); isPeer {
+		pubKey, err := protocol.DecodePublicKey(peer.PublicKey)
+		if err == nil {
+			err = env.Verify(pubKey)
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+	if _, err := b.verifyCaller(w, env); err != nil {
+		return "", err
+	}
+	return agentNamespace(env.Agent), nil
+}
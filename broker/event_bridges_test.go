@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestParseEventBridges(t *testing.T) {
+	bridges, err := ParseEventBridges("acme>globex=order.*, globex>acme=invoice.paid")
+	if err != nil {
+		t.Fatalf("ParseEventBridges: %v", err)
+	}
+	want := []EventBridge{{From: "acme", To: "globex", Pattern: "order.*"}, {From: "globex", To: "acme", Pattern: "invoice.paid"}}
+	if len(bridges) != len(want) {
+		t.Fatalf("Expected %d bridges, got %+v", len(want), bridges)
+	}
+	for i := range want {
+		if bridges[i] != want[i] {
+			t.Errorf("Bridge %d: expected %+v, got %+v", i, want[i], bridges[i])
+		}
+	}
+
+	for _, spec := range []string{"acme=order.*", "acme>globex", ">globex=order.*", "acme>acme=order.*"} {
+		if _, err := ParseEventBridges(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestEventBridgesReaches(t *testing.T) {
+	bridges := NewEventBridges()
+	bridges.Set([]EventBridge{{From: "acme", To: "globex", Pattern: "order.*"}})
+
+	tests := []struct {
+		from, to, event string
+		expected        bool
+	}{
+		{"acme", "acme", "anything", true},
+		{"", "globex", "anything", true},
+		{"acme", "globex", "order.shipped", true},
+		{"acme", "globex", "invoice.paid", false},
+		{"globex", "acme", "order.shipped", false},
+		{"acme", "initech", "order.shipped", false},
+	}
+	for _, tt := range tests {
+		if got := bridges.Reaches(tt.from, tt.to, tt.event); got != tt.expected {
+			t.Errorf("Reaches(%s, %s, %s): expected %v, got %v", tt.from, tt.to, tt.event, tt.expected, got)
+		}
+	}
+}
+
+func TestPublishEventScopedToNamespace(t *testing.T) {
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer subscriber.Close()
+
+	broker := NewBroker()
+	broker.subscriptions.Subscribe("acme.dashboard", subscriber.URL, []string{"*"})
+	broker.subscriptions.Subscribe("globex.dashboard", subscriber.URL, []string{"*"})
+
+	emit := func(agent, event string, key ed25519.PrivateKey) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeEmitEvent}}
+		env.Agent = agent
+		env.Body, _ = json.Marshal(protocol.EmitEventBody{Event: event})
+		if key != nil {
+			protocol.SignEnvelope(env, key)
+		}
+		recorder := newBufferedResponse()
+		broker.handleEmitEvent(recorder, env)
+		return recorder
+	}
+	publishAs := func(agent, event string, key ed25519.PrivateKey) int {
+		var response struct {
+			Subscribers int `json:"subscribers"`
+		}
+		json.Unmarshal(emit(agent, event, key).body.Bytes(), &response)
+		return response.Subscribers
+	}
+	publish := func(agent, event string) int {
+		return publishAs(agent, event, nil)
+	}
+
+	if got := publish("acme.shop", "order.shipped"); got != 1 {
+		t.Errorf("Expected an unbridged event to reach only its namespace, got %d subscribers", got)
+	}
+
+	broker.eventBridges.Set([]EventBridge{{From: "acme", To: "globex", Pattern: "order.*"}})
+	if got := publish("acme.shop", "order.shipped"); got != 2 {
+		t.Errorf("Expected a bridged event to reach both namespaces, got %d subscribers", got)
+	}
+	if got := publish("acme.shop", "invoice.paid"); got != 1 {
+		t.Errorf("Expected the bridge to forward only matching events, got %d subscribers", got)
+	}
+	if got := publish("globex.shop", "order.shipped"); got != 1 {
+		t.Errorf("Expected the bridge to run one way, got %d subscribers", got)
+	}
+
+	// Events the broker raises itself are not scoped...
+	if got := publishAs(broker.id, "webhook.received", broker.privateKey); got != 2 {
+		t.Errorf("Expected a broker event to reach every namespace, got %d subscribers", got)
+	}
+
+	// ...but claiming to be the broker, or a peer, takes its signature
+	peerKey, _, _ := protocol.GenerateKeyPair()
+	broker.peers.Add(&FederatedBroker{ID: "broker-b", PublicKey: protocol.EncodePublicKey(peerKey)})
+	for _, impostor := range []string{broker.id, "broker-b"} {
+		if recorder := emit(impostor, "order.shipped", nil); recorder.status != http.StatusUnauthorized {
+			t.Errorf("Expected an unsigned event as %s to be refused with 401, got %d", impostor, recorder.status)
+		}
+	}
+}
+
+func TestBroadcastScopedToNamespace(t *testing.T) {
+	broker := NewBroker()
+	for _, id := range []string{"acme.shop", "acme.worker", "globex.worker"} {
+		broker.agents[id] = &Agent{ID: id, Capabilities: []string{"orders"}}
+	}
+
+	body := protocol.BroadcastBody{Recipients: []string{"globex.worker"}, Capability: "orders", Event: "order.shipped"}
+	recipients, unknown := broker.broadcastRecipients("acme.shop", body)
+	if len(recipients) != 1 || recipients[0] != "acme.worker" || len(unknown) != 1 {
+		t.Errorf("Expected only acme.worker to be reached, got %v (unknown %v)", recipients, unknown)
+	}
+
+	broker.eventBridges.Set([]EventBridge{{From: "acme", To: "globex", Pattern: "order.*"}})
+	if recipients, _ := broker.broadcastRecipients("acme.shop", body); len(recipients) != 2 {
+		t.Errorf("Expected the bridge to carry the broadcast to globex, got %v", recipients)
+	}
+}
@@ -45,6 +45,8 @@ type FederatedBroker struct {
 	ResponseTime     time.Duration
 	ToolCount        int
 	LoadScore        float64
+	Role             string // peerRoleParent or peerRoleChild in a broker hierarchy, empty for mesh peers
+	Federation       string // Federation the peer's trust chain belongs to, if it presented one
 }
 
 // BrokerStatus represents the status of a federated broker
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultPeerWeight is the weight of tool metadata from peers the policy
+// does not name
+const defaultPeerWeight = 1.0
+
+// FederationTrust decides which brokers may peer with this one and how much
+// weight the tool metadata learned from each peer carries. With no trust
+// anchors, any broker that signs its registration may peer.
+type FederationTrust struct {
+	anchors    map[string][]string  // Trusted root keys by federation
+	federation string               // Federation this broker belongs to
+	chain      []protocol.TrustLink // This broker's chain to an anchor of federation
+	weights    map[string]float64   // By peer broker ID, "*" for peers left out
+	mu         sync.RWMutex
+}
+
+// NewFederationTrust creates a policy trusting every peer fully
+func NewFederationTrust() *FederationTrust {
+	return &FederationTrust{
+		anchors: make(map[string][]string),
+		weights: make(map[string]float64),
+	}
+}
+
+// ParseTrustAnchors parses trusted root keys written as
+// "federation=base64key,...". A federation may be given several keys.
+func ParseTrustAnchors(spec string) (map[string][]string, error) {
+	anchors := make(map[string][]string)
+	for _, field := range parseSinkList(spec) {
+		federation, key, found := strings.Cut(field, "=")
+		if !found || federation == "" {
+			return nil, fmt.Errorf("invalid trust anchor %q, expected federation=key", field)
+		}
+		if _, err := protocol.DecodePublicKey(key); err != nil {
+			return nil, fmt.Errorf("invalid trust anchor for %s: %w", federation, err)
+		}
+		anchors[federation] = append(anchors[federation], key)
+	}
+	return anchors, nil
+}
+
+// ParsePeerTrust parses the weights of peers' tool metadata written as
+// "broker-b=0.5,broker-c=0,*=1". Weights run from 0, which ignores the
+// peer's listings, to 1; "*" sets the weight of peers left out.
+func ParsePeerTrust(spec string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, field := range parseSinkList(spec) {
+		broker, value, found := strings.Cut(field, "=")
+		if !found || broker == "" {
+			return nil, fmt.Errorf("invalid peer trust %q, expected broker=weight", field)
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil || weight < 0 || weight > 1 {
+			return nil, fmt.Errorf("invalid weight %q for %s, expected a number from 0 to 1", value, broker)
+		}
+		weights[broker] = weight
+	}
+	return weights, nil
+}
+
+// LoadTrustChain reads a broker's trust chain, a JSON array of links from
+// an anchor to the broker's key
+func LoadTrustChain(path string) ([]protocol.TrustLink, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var chain []protocol.TrustLink
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, fmt.Errorf("invalid trust chain %s: %w", path, err)
+	}
+	return chain, nil
+}
+
+// SetAnchors replaces the trusted root keys, by federation
+func (t *FederationTrust) SetAnchors(anchors map[string][]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.anchors = anchors
+}
+
+// SetWeights replaces the weights of peers' tool metadata
+func (t *FederationTrust) SetWeights(weights map[string]float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.weights = weights
+}
+
+// SetMembership sets the federation this broker belongs to and the chain it
+// presents to peers
+func (t *FederationTrust) SetMembership(federation string, chain []protocol.TrustLink) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.federation = federation
+	t.chain = chain
+}
+
+// Membership returns the federation this broker belongs to and its chain
+func (t *FederationTrust) Membership() (string, []protocol.TrustLink) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.federation, t.chain
+}
+
+// Verify checks a broker's registration against the trust anchors. Once any
+// anchors are configured, the broker must name a federation with anchors
+// and present a chain from one of them to its key.
+func (t *FederationTrust) Verify(peer protocol.RegisterBrokerBody, now time.Time) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.anchors) == 0 {
+		return nil
+	}
+	anchors, exists := t.anchors[peer.Federation]
+	if !exists {
+		return fmt.Errorf("%w: no trust anchors for federation %q", protocol.ErrUntrustedBroker, peer.Federation)
+	}
+	return protocol.VerifyTrustChain(peer.TrustChain, anchors, peer.Federation, peer.BrokerID, peer.PubKey, now)
+}
+
+// Weight returns the weight of the tool metadata learned from a broker
+func (t *FederationTrust) Weight(broker string) float64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if weight, exists := t.weights[broker]; exists {
+		return weight
+	}
+	if weight, exists := t.weights["*"]; exists {
+		return weight
+	}
+	return defaultPeerWeight
+}
+
+// Weigh scales the trust score of listings learned from peers by each
+// peer's weight, dropping the listings of peers weighted 0. Listings are
+// attributed to the broker the agent is registered with.
+func (t *FederationTrust) Weigh(tools []protocol.DiscoveredTool) []protocol.DiscoveredTool {
+	weighed := tools[:0]
+	for _, tool := range tools {
+		weight := t.Weight(tool.Broker)
+		if weight == 0 {
+			continue
+		}
+		tool.Metadata.TrustScore *= weight
+		weighed = append(weighed, tool)
+	}
+	return weighed
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestParseFederationTrust(t *testing.T) {
+	anchorPub, _, _ := protocol.GenerateKeyPair()
+	key := protocol.EncodePublicKey(anchorPub)
+	anchors, err := ParseTrustAnchors("acme=" + key + ",globex=" + key)
+	if err != nil {
+		t.Fatalf("Failed to parse anchors: %v", err)
+	}
+	if len(anchors["acme"]) != 1 || len(anchors["globex"]) != 1 {
+		t.Errorf("Unexpected anchors %v", anchors)
+	}
+	for _, spec := range []string{"acme", "=" + key, "acme=not-a-key"} {
+		if _, err := ParseTrustAnchors(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+
+	weights, err := ParsePeerTrust("broker-b=0.5,broker-c=0,*=0.8")
+	if err != nil {
+		t.Fatalf("Failed to parse peer trust: %v", err)
+	}
+	if weights["broker-b"] != 0.5 || weights["broker-c"] != 0 || weights["*"] != 0.8 {
+		t.Errorf("Unexpected weights %v", weights)
+	}
+	for _, spec := range []string{"broker-b", "broker-b=2", "broker-b=-1", "=0.5", "broker-b=high"} {
+		if _, err := ParsePeerTrust(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestFederationTrustWeigh(t *testing.T) {
+	trust := NewFederationTrust()
+	weights, _ := ParsePeerTrust("broker-b=0.5,broker-c=0")
+	trust.SetWeights(weights)
+
+	tools := trust.Weigh([]protocol.DiscoveredTool{
+		{AgentID: "agent-b", Broker: "broker-b", Metadata: protocol.ToolMetadata{TrustScore: 0.8}},
+		{AgentID: "agent-c", Broker: "broker-c", Metadata: protocol.ToolMetadata{TrustScore: 0.8}},
+		{AgentID: "agent-d", Broker: "broker-d", Metadata: protocol.ToolMetadata{TrustScore: 0.8}},
+	})
+	if len(tools) != 2 || tools[0].AgentID != "agent-b" || tools[1].AgentID != "agent-d" {
+		t.Fatalf("Expected broker-c's listing to be dropped, got %+v", tools)
+	}
+	if tools[0].Metadata.TrustScore != 0.4 || tools[1].Metadata.TrustScore != 0.8 {
+		t.Errorf("Expected trust scores scaled by peer weight, got %v and %v", tools[0].Metadata.TrustScore, tools[1].Metadata.TrustScore)
+	}
+}
+
+func TestFederationTrustAnchors(t *testing.T) {
+	anchorPub, anchorKey, _ := protocol.GenerateKeyPair()
+
+	start := func(id string) *Broker {
+		broker := NewBroker()
+		broker.SetBrokerID(id)
+		server := httptest.NewTLSServer(broker)
+		t.Cleanup(server.Close)
+		broker.SetFederationEndpoint(server.URL)
+		return broker
+	}
+	brokerA := start("broker-a")
+	brokerA.trust.SetAnchors(map[string][]string{"acme": {protocol.EncodePublicKey(anchorPub)}})
+	endpointA := brokerA.endpoint
+
+	// A broker without a chain is refused once anchors are configured
+	stranger := start("broker-c")
+	if err := stranger.JoinFederation(endpointA); err == nil {
+		t.Error("Expected a broker without a trust chain to be refused")
+	}
+	if _, exists := brokerA.peers.Get("broker-c"); exists {
+		t.Error("Expected the untrusted broker not to be added")
+	}
+
+	// A chain from the anchor to the broker's key is accepted
+	brokerB := start("broker-b")
+	link, err := protocol.NewTrustLink("acme", anchorKey, brokerB.privateKey.Public().(ed25519.PublicKey), "broker-b", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to issue trust link: %v", err)
+	}
+	brokerB.trust.SetMembership("acme", []protocol.TrustLink{*link})
+	if err := brokerB.JoinFederation(endpointA); err != nil {
+		t.Fatalf("Expected the trusted broker to federate, got %v", err)
+	}
+	if peer, exists := brokerA.peers.Get("broker-b"); !exists || peer.Federation != "acme" {
+		t.Errorf("Expected broker-b to be added as a member of acme, got %+v", peer)
+	}
+
+	// The same chain does not vouch for another broker
+	stranger.trust.SetMembership("acme", []protocol.TrustLink{*link})
+	if err := stranger.JoinFederation(endpointA); err == nil {
+		t.Error("Expected a borrowed trust chain to be refused")
+	}
+}
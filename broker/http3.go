@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// altSvcMaxAge is how long clients may remember the HTTP/3 endpoint
+const altSvcMaxAge = 24 * time.Hour
+
+// serveHTTP3 serves handler over HTTP/3 (QUIC) on a UDP address. It is set
+// by builds with the quic tag, which link quic-go; other builds cannot
+// serve HTTP/3.
+var serveHTTP3 func(addr string, handler http.Handler, tlsConfig *tls.Config) error
+
+// altSvc advertises the HTTP/3 endpoint at addr in every response, so
+// clients that speak HTTP/3 move their later requests to it
+func altSvc(addr string, next http.Handler) (http.Handler, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	value := fmt.Sprintf(`h3=":%s"; ma=%d`, port, int(altSvcMaxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", value)
+		next.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,21 @@
+//go:build quic
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func init() {
+	serveHTTP3 = func(addr string, handler http.Handler, tlsConfig *tls.Config) error {
+		server := &http3.Server{
+			Addr:      addr,
+			Handler:   handler,
+			TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		}
+		return server.ListenAndServe()
+	}
+}
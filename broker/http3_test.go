@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAltSvc(t *testing.T) {
+	handler, err := altSvc(":4433", NewBroker())
+	if err != nil {
+		t.Fatalf("Failed to wrap handler: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the broker to answer, got %d", recorder.Code)
+	}
+	if got, want := recorder.Header().Get("Alt-Svc"), `h3=":4433"; ma=86400`; got != want {
+		t.Errorf("Expected Alt-Svc %q, got %q", want, got)
+	}
+
+	if _, err := altSvc("4433", NewBroker()); err == nil {
+		t.Error("Expected an address without a port to be refused")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// defaultIdempotencyWindow is how long the result of a call with an
+	// idempotency key is replayed to calls repeating the key
+	defaultIdempotencyWindow = 10 * time.Minute
+	// maxIdempotentCalls bounds the calls remembered by key; calls past it
+	// run without deduplication
+	maxIdempotentCalls = 4096
+)
+
+// ErrIdempotencyMismatch is returned when a key is repeated for a call to
+// another tool or with other parameters
+var ErrIdempotencyMismatch = errors.New("idempotency key was used for a different call")
+
+// IdempotentCall is a tool call made with an idempotency key. Calls
+// repeating the key wait for it and get its result.
+type IdempotentCall struct {
+	Key         string
+	Caller      string
+	Fingerprint string // Hash of the tool and parameters
+	CreatedAt   time.Time
+	ExpiresAt   time.Time // Zero until the call completes
+
+	done   chan struct{}
+	result protocol.ToolResultBody
+}
+
+// IdempotencyCache deduplicates tool calls by the caller's idempotency key,
+// so a call retried after a lost response runs the tool once. Keys are
+// scoped to the caller: one agent cannot read another's results.
+type IdempotencyCache struct {
+	calls  map[string]*IdempotentCall // By caller and key
+	window time.Duration
+	mu     sync.Mutex
+}
+
+// NewIdempotencyCache creates a cache replaying results for window
+func NewIdempotencyCache(window time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		calls:  make(map[string]*IdempotentCall),
+		window: window,
+	}
+}
+
+// SetWindow changes how long newly completed calls are replayed
+func (c *IdempotencyCache) SetWindow(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window = window
+}
+
+// toolCallFingerprint hashes what a key stands for: the tool and its
+// parameters, whose map keys encoding/json sorts
+func toolCallFingerprint(body protocol.ToolCallBody) string {
+	parameters, _ := json.Marshal(body.Parameters)
+	sum := sha256.Sum256(append([]byte(body.Tool+"\x00"), parameters...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Begin claims a caller's key for a call. It returns whether the call is
+// the first with the key, which must then run and be completed or
+// abandoned; otherwise the returned call is the earlier one, to wait for.
+// A nil call means the cache is full and the call runs undeduplicated.
+func (c *IdempotencyCache) Begin(caller, key, fingerprint string, now time.Time) (*IdempotentCall, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := caller + "\x00" + key
+	if call, exists := c.calls[id]; exists {
+		if !call.expired(now) {
+			if call.Fingerprint != fingerprint {
+				return nil, false, ErrIdempotencyMismatch
+			}
+			return call, false, nil
+		}
+		delete(c.calls, id)
+	}
+
+	if len(c.calls) >= maxIdempotentCalls {
+		c.prune(now)
+		if len(c.calls) >= maxIdempotentCalls {
+			slog.Warn("Idempotency cache full, running call without deduplication", "caller", caller, "key", key)
+			return nil, true, nil
+		}
+	}
+	call := &IdempotentCall{
+		Key:         key,
+		Caller:      caller,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		done:        make(chan struct{}),
+	}
+	c.calls[id] = call
+	return call, true, nil
+}
+
+// Complete records the result of a call, replayed to calls repeating its
+// key until the window passes
+func (c *IdempotencyCache) Complete(call *IdempotentCall, result protocol.ToolResultBody) {
+	if call == nil {
+		return
+	}
+	c.mu.Lock()
+	call.result = result
+	call.ExpiresAt = time.Now().Add(c.window)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// Abandon forgets a call that never reached the tool, so a retry runs it.
+// Calls already waiting on it get its failure.
+func (c *IdempotencyCache) Abandon(call *IdempotentCall, result protocol.ToolResultBody) {
+	if call == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.calls[call.Caller+"\x00"+call.Key] == call {
+		delete(c.calls, call.Caller+"\x00"+call.Key)
+	}
+	call.result = result
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// Wait blocks until an earlier call completes, for at most timeout,
+// returning its result and whether it completed
+func (c *IdempotencyCache) Wait(call *IdempotentCall, timeout time.Duration) (protocol.ToolResultBody, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.done:
+	case <-timer.C:
+		return protocol.ToolResultBody{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return call.result, true
+}
+
+// Len returns the number of calls remembered
+func (c *IdempotencyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.calls)
+}
+
+// prune drops the calls whose window has passed
+func (c *IdempotencyCache) prune(now time.Time) {
+	for id, call := range c.calls {
+		if call.expired(now) {
+			delete(c.calls, id)
+		}
+	}
+}
+
+// expired reports whether a completed call's window has passed
+func (call *IdempotentCall) expired(now time.Time) bool {
+	return !call.ExpiresAt.IsZero() && now.After(call.ExpiresAt)
+}
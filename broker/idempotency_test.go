@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	cache := NewIdempotencyCache(time.Minute)
+	now := time.Now()
+	fingerprint := toolCallFingerprint(protocol.ToolCallBody{Tool: "charge", Parameters: map[string]interface{}{"cents": 500}})
+
+	call, first, err := cache.Begin("caller", "k1", fingerprint, now)
+	if err != nil || !first {
+		t.Fatalf("Expected the first call to run, got %v %v", first, err)
+	}
+	if _, first, _ := cache.Begin("caller", "k1", fingerprint, now); first {
+		t.Error("Expected a repeat of a running call to wait for it")
+	}
+	if _, first, _ := cache.Begin("other", "k1", fingerprint, now); !first {
+		t.Error("Expected keys to be scoped to their caller")
+	}
+	other := toolCallFingerprint(protocol.ToolCallBody{Tool: "charge", Parameters: map[string]interface{}{"cents": 900}})
+	if _, _, err := cache.Begin("caller", "k1", other, now); err != ErrIdempotencyMismatch {
+		t.Errorf("Expected reusing a key for other parameters to be refused, got %v", err)
+	}
+
+	cache.Complete(call, protocol.ToolResultBody{Success: true, Result: "charged"})
+	repeat, first, _ := cache.Begin("caller", "k1", fingerprint, now)
+	if result, completed := cache.Wait(repeat, time.Second); first || !completed || result.Result != "charged" {
+		t.Errorf("Expected the result replayed, got %+v (first %v)", result, first)
+	}
+	if _, first, _ := cache.Begin("caller", "k1", fingerprint, time.Now().Add(2*time.Minute)); !first {
+		t.Error("Expected the key to run again once its window passed")
+	}
+
+	// An abandoned call never ran, so its key is free for a retry
+	abandoned, _, _ := cache.Begin("caller", "k2", fingerprint, now)
+	cache.Abandon(abandoned, protocol.ToolResultBody{Error: "unreachable"})
+	if _, first, _ := cache.Begin("caller", "k2", fingerprint, now); !first {
+		t.Error("Expected an abandoned key to run again")
+	}
+}
+
+func TestIdempotentToolCalls(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": map[string]interface{}{"charge": n}, "id": 1})
+	}))
+	defer endpoint.Close()
+
+	broker := NewBroker()
+	broker.mcpRegistry.RegisterAgent("payments", &MCPAgent{
+		ID:            "payments",
+		MCPEndpoint:   endpoint.URL,
+		Tools:         []protocol.MCPTool{{Name: "charge"}},
+		LastHeartbeat: time.Now(),
+	})
+	call := func(key string, cents int) (int, protocol.ToolResultBody) {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+		env.Agent = "shop"
+		env.Nonce = protocol.NewNonce()
+		env.TS = time.Now().UnixMilli()
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{
+			Tool:           "charge",
+			Parameters:     map[string]interface{}{"cents": cents},
+			RequestID:      protocol.NewNonce(),
+			IdempotencyKey: key,
+		})
+		recorder := newBufferedResponse()
+		broker.dispatchEnvelope(recorder, env)
+		var result protocol.ToolResultEnvelope
+		json.Unmarshal(recorder.body.Bytes(), &result)
+		return recorder.status, result.Body
+	}
+
+	// A retry arriving while the first call runs waits for its result
+	results := make([]protocol.ToolResultBody, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, results[i] = call("order-1", 500)
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&calls) != 1 || !results[0].Success || !results[1].Success || results[0].Replayed == results[1].Replayed {
+		t.Fatalf("Expected one charge with the retry replayed, got %d charges and %+v", calls, results)
+	}
+
+	if _, result := call("order-1", 500); !result.Replayed || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("Expected a later retry to be replayed, got %+v after %d charges", result, calls)
+	}
+	if status, _ := call("order-1", 900); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected the key reused for another charge to be refused, got %d", status)
+	}
+	if _, result := call("order-2", 500); result.Replayed || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("Expected a new key to charge again, got %+v after %d charges", result, calls)
+	}
+	if _, result := call("", 500); result.Replayed || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("Expected a call without a key to run, got %+v after %d charges", result, calls)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fep-fem/protocol"
+)
+
+// maxIngestBodySize bounds the size of a webhook request body
+const maxIngestBodySize = 1 << 20
+
+// ErrUnknownAdapter is returned when no adapter is registered under a name
+var ErrUnknownAdapter = errors.New("unknown ingest adapter")
+
+// IngestAdapter converts an external webhook request into FEM events.
+// Adapters only translate formats; the broker signs and publishes the
+// resulting emitEvent envelopes.
+type IngestAdapter interface {
+	Name() string
+	Convert(r *http.Request, body []byte) ([]protocol.EmitEventBody, error)
+}
+
+// AdapterRegistry holds the ingest adapters served under /ingest/{name}
+type AdapterRegistry struct {
+	adapters map[string]IngestAdapter
+	token    string
+	mu       sync.RWMutex
+}
+
+// NewAdapterRegistry creates a registry with the built-in webhook and
+// CloudEvents adapters
+func NewAdapterRegistry() *AdapterRegistry {
+	registry := &AdapterRegistry{
+		adapters: make(map[string]IngestAdapter),
+	}
+	registry.Register(&WebhookAdapter{})
+	registry.Register(&CloudEventsAdapter{})
+	return registry
+}
+
+// Register adds or replaces an adapter
+func (ar *AdapterRegistry) Register(adapter IngestAdapter) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.adapters[adapter.Name()] = adapter
+}
+
+// Get returns the adapter registered under name
+func (ar *AdapterRegistry) Get(name string) (IngestAdapter, error) {
+	ar.mu.RLock()
+	defer ar.mu.RUnlock()
+
+	adapter, exists := ar.adapters[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAdapter, name)
+	}
+	return adapter, nil
+}
+
+// Names returns the registered adapter names in sorted order
+func (ar *AdapterRegistry) Names() []string {
+	ar.mu.RLock()
+	defer ar.mu.RUnlock()
+
+	names := make([]string, 0, len(ar.adapters))
+	for name := range ar.adapters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetToken requires ingest requests to carry "Authorization: Bearer <token>".
+// An empty token disables the check.
+func (ar *AdapterRegistry) SetToken(token string) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.token = token
+}
+
+// Authorized reports whether the request carries the configured token
+func (ar *AdapterRegistry) Authorized(r *http.Request) bool {
+	ar.mu.RLock()
+	token := ar.token
+	ar.mu.RUnlock()
+
+	if token == "" {
+		return true
+	}
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// WebhookAdapter accepts generic JSON webhooks. The event name comes from
+// the "event" query parameter or the X-Event-Type header, and the decoded
+// JSON body becomes the event payload.
+type WebhookAdapter struct{}
+
+// Name returns the adapter name
+func (a *WebhookAdapter) Name() string {
+	return "webhook"
+}
+
+// Convert maps a JSON webhook to a single event
+func (a *WebhookAdapter) Convert(r *http.Request, body []byte) ([]protocol.EmitEventBody, error) {
+	event := r.URL.Query().Get("event")
+	if event == "" {
+		event = r.Header.Get("X-Event-Type")
+	}
+	if event == "" {
+		return nil, fmt.Errorf("missing event name (use ?event= or X-Event-Type)")
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	// Non-object bodies are wrapped so the payload is always an object
+	payload, ok := data.(map[string]interface{})
+	if !ok {
+		payload = map[string]interface{}{"data": data}
+	}
+
+	return []protocol.EmitEventBody{{Event: event, Payload: payload}}, nil
+}
+
+// CloudEventsAdapter accepts CloudEvents 1.0 over HTTP in structured
+// (application/cloudevents+json), batched (application/cloudevents-batch+json)
+// and binary (ce-* headers) content modes. The CloudEvents type becomes the
+// event name; the remaining attributes and data become the payload.
+type CloudEventsAdapter struct{}
+
+// Name returns the adapter name
+func (a *CloudEventsAdapter) Name() string {
+	return "cloudevents"
+}
+
+// Convert maps one or more CloudEvents to events
+func (a *CloudEventsAdapter) Convert(r *http.Request, body []byte) ([]protocol.EmitEventBody, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var cloudEvents []map[string]interface{}
+	switch mediaType {
+	case "application/cloudevents+json":
+		var ce map[string]interface{}
+		if err := json.Unmarshal(body, &ce); err != nil {
+			return nil, fmt.Errorf("invalid CloudEvent: %w", err)
+		}
+		cloudEvents = append(cloudEvents, ce)
+	case "application/cloudevents-batch+json":
+		if err := json.Unmarshal(body, &cloudEvents); err != nil {
+			return nil, fmt.Errorf("invalid CloudEvents batch: %w", err)
+		}
+	default:
+		ce, err := binaryCloudEvent(r, body, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		cloudEvents = append(cloudEvents, ce)
+	}
+
+	events := make([]protocol.EmitEventBody, 0, len(cloudEvents))
+	for i, ce := range cloudEvents {
+		for _, attr := range []string{"specversion", "id", "source", "type"} {
+			if value, _ := ce[attr].(string); value == "" {
+				return nil, fmt.Errorf("CloudEvent %d missing required attribute %q", i, attr)
+			}
+		}
+
+		event := ce["type"].(string)
+		payload := make(map[string]interface{}, len(ce))
+		for key, value := range ce {
+			if key != "type" {
+				payload[key] = value
+			}
+		}
+		events = append(events, protocol.EmitEventBody{Event: event, Payload: payload})
+	}
+	return events, nil
+}
+
+// binaryCloudEvent rebuilds a CloudEvent from ce-* headers and a raw body
+func binaryCloudEvent(r *http.Request, body []byte, mediaType string) (map[string]interface{}, error) {
+	ce := make(map[string]interface{})
+	for key, values := range r.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "ce-") && len(values) > 0 {
+			ce[strings.TrimPrefix(lower, "ce-")] = values[0]
+		}
+	}
+	if len(ce) == 0 {
+		return nil, fmt.Errorf("request is not a CloudEvent (no ce-* headers)")
+	}
+
+	if len(body) > 0 {
+		ce["datacontenttype"] = r.Header.Get("Content-Type")
+		var data interface{}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			if err := json.Unmarshal(body, &data); err != nil {
+				return nil, fmt.Errorf("invalid JSON data: %w", err)
+			}
+			ce["data"] = data
+		} else {
+			ce["data"] = string(body)
+		}
+	}
+	return ce, nil
+}
+
+// handleAdapterIngest serves POST /ingest/{adapter}, converting the request
+// with the named adapter and publishing each resulting event as an
+// emitEvent envelope signed by the broker
+func (b *Broker) handleAdapterIngest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !b.adapters.Authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	adapter, err := b.adapters.Get(strings.TrimPrefix(r.URL.Path, "/ingest/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIngestBodySize+1))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxIngestBodySize {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	events, err := adapter.Convert(r, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to convert %s request: %v", adapter.Name(), err), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		env, err := b.signedEvent(event)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to sign event: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		slog.Debug("Ingested event", "event", event.Event, "adapter", adapter.Name())
+		results = append(results, map[string]interface{}{
+			"event":       event.Event,
+			"nonce":       env.Nonce,
+			"subscribers": b.publishEventIn("", env, event),
+		})
+	}
+
+	response := map[string]interface{}{
+		"status":  "emitted",
+		"adapter": adapter.Name(),
+		"events":  results,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// signedEvent builds an emitEvent envelope originated and signed by the broker
+func (b *Broker) signedEvent(body protocol.EmitEventBody) (*protocol.GenericEnvelope, error) {
+	event := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, b.id)
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	event.Body = raw
+	if err := event.Sign(b.privateKey); err != nil {
+		return nil, err
+	}
+
+	return &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: event.Type, CommonHeaders: event.CommonHeaders},
+		Body:         event.Body,
+	}, nil
+}
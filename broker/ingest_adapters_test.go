@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestWebhookAdapter(t *testing.T) {
+	adapter := &WebhookAdapter{}
+
+	req := httptest.NewRequest(http.MethodPost, "/ingest/webhook?event=build.finished", nil)
+	events, err := adapter.Convert(req, []byte(`{"status":"green","build":42}`))
+	if err != nil {
+		t.Fatalf("Failed to convert webhook: %v", err)
+	}
+	if len(events) != 1 || events[0].Event != "build.finished" || events[0].Payload["status"] != "green" {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	// The header is used when no query parameter is given, and non-object
+	// bodies are wrapped
+	req = httptest.NewRequest(http.MethodPost, "/ingest/webhook", nil)
+	req.Header.Set("X-Event-Type", "metrics.batch")
+	events, err = adapter.Convert(req, []byte(`[1,2,3]`))
+	if err != nil {
+		t.Fatalf("Failed to convert webhook: %v", err)
+	}
+	if events[0].Event != "metrics.batch" || len(events[0].Payload["data"].([]interface{})) != 3 {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/ingest/webhook", nil)
+	if _, err := adapter.Convert(req, []byte(`{}`)); err == nil {
+		t.Error("Expected webhook without an event name to be rejected")
+	}
+}
+
+func TestCloudEventsAdapter(t *testing.T) {
+	adapter := &CloudEventsAdapter{}
+
+	// Structured mode
+	req := httptest.NewRequest(http.MethodPost, "/ingest/cloudevents", nil)
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	events, err := adapter.Convert(req, []byte(`{"specversion":"1.0","id":"e-1","source":"/orders","type":"order.created","data":{"total":10}}`))
+	if err != nil {
+		t.Fatalf("Failed to convert structured CloudEvent: %v", err)
+	}
+	if events[0].Event != "order.created" || events[0].Payload["source"] != "/orders" {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+	if _, exists := events[0].Payload["type"]; exists {
+		t.Error("Expected type attribute to be moved to the event name")
+	}
+
+	// Batched mode
+	req.Header.Set("Content-Type", "application/cloudevents-batch+json")
+	events, err = adapter.Convert(req, []byte(`[
+		{"specversion":"1.0","id":"e-1","source":"/orders","type":"order.created"},
+		{"specversion":"1.0","id":"e-2","source":"/orders","type":"order.paid"}
+	]`))
+	if err != nil {
+		t.Fatalf("Failed to convert CloudEvents batch: %v", err)
+	}
+	if len(events) != 2 || events[1].Event != "order.paid" {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	// Binary mode
+	req = httptest.NewRequest(http.MethodPost, "/ingest/cloudevents", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Ce-Specversion", "1.0")
+	req.Header.Set("Ce-Id", "e-3")
+	req.Header.Set("Ce-Source", "/inventory")
+	req.Header.Set("Ce-Type", "stock.low")
+	events, err = adapter.Convert(req, []byte(`{"sku":"A-1"}`))
+	if err != nil {
+		t.Fatalf("Failed to convert binary CloudEvent: %v", err)
+	}
+	data := events[0].Payload["data"].(map[string]interface{})
+	if events[0].Event != "stock.low" || data["sku"] != "A-1" {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	// Required attributes are enforced
+	req.Header.Del("Ce-Id")
+	if _, err := adapter.Convert(req, []byte(`{}`)); err == nil {
+		t.Error("Expected CloudEvent without an id to be rejected")
+	}
+}
+
+func TestBrokerAdapterIngest(t *testing.T) {
+	received := make(chan protocol.Envelope, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env protocol.Envelope
+		if err := json.NewDecoder(r.Body).Decode(&env); err == nil {
+			received <- env
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer subscriber.Close()
+
+	broker := NewBroker()
+	broker.adapters.SetToken("secret")
+	broker.subscriptions.Subscribe("listener-agent", subscriber.URL, []string{"deploy.*"})
+
+	ingest := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"service":"api"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		broker.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := ingest("/ingest/webhook?event=deploy.done", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without token, got %d", w.Code)
+	}
+	if w := ingest("/ingest/unknown", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown adapter, got %d", w.Code)
+	}
+
+	w := ingest("/ingest/webhook?event=deploy.done", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case env := <-received:
+		if env.Type != protocol.EnvelopeEmitEvent || env.Agent != broker.id {
+			t.Errorf("Unexpected delivered envelope: %s from %s", env.Type, env.Agent)
+		}
+		if err := env.Verify(broker.privateKey.Public().(ed25519.PublicKey)); err != nil {
+			t.Errorf("Failed to verify broker signature: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for ingested event")
+	}
+}
+
+func TestAdapterRegistry(t *testing.T) {
+	registry := NewAdapterRegistry()
+
+	names := registry.Names()
+	if len(names) != 2 || names[0] != "cloudevents" || names[1] != "webhook" {
+		t.Errorf("Unexpected built-in adapters: %v", names)
+	}
+
+	if _, err := registry.Get("missing"); !errors.Is(err, ErrUnknownAdapter) {
+		t.Errorf("Expected ErrUnknownAdapter, got %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Roles a JWT may grant, from its roles claim or the -jwt-roles rules
+const (
+	RoleAdmin  = "admin"  // Every /admin/ endpoint
+	RoleViewer = "viewer" // The /admin/ endpoints answering GET
+	RoleAgent  = "agent"  // Agent registration, under -jwt-registration
+)
+
+// defaultJWTTTL is how long a JWT issued by the broker lasts unless the
+// operator sets its own
+const defaultJWTTTL = time.Hour
+
+// minHMACSecret is the shortest HMAC secret accepted in -jwt-keys
+const minHMACSecret = 32
+
+// jwtMethods are the signing algorithms accepted. Each key only verifies
+// the algorithms of its own type, so a public key cannot be passed off as
+// an HMAC secret.
+var jwtMethods = []string{
+	"EdDSA",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"HS256", "HS384", "HS512",
+}
+
+// ErrJWTRequired is returned for registrations without a JWT granting the
+// agent role when -jwt-registration is set
+var ErrJWTRequired = errors.New("registration requires a bearer JWT granting the agent role")
+
+// RoleRule grants a role to JWTs whose claim holds a value matching a
+// pattern
+type RoleRule struct {
+	Claim   string
+	Pattern string // Matched like capability patterns, e.g. "fem-*"
+	Role    string
+}
+
+// ParseRoleRules parses rules written as
+// "groups=fem-ops:admin,scope=fem.read:viewer". A claim holding a list of
+// strings matches if any of them does.
+func ParseRoleRules(spec string) ([]RoleRule, error) {
+	var rules []RoleRule
+	for _, field := range parseSinkList(spec) {
+		match, role, found := strings.Cut(field, ":")
+		claim, pattern, matched := strings.Cut(match, "=")
+		if !found || !matched || claim == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid JWT role rule %q, expected claim=value:role", field)
+		}
+		if role != RoleAdmin && role != RoleViewer && role != RoleAgent {
+			return nil, fmt.Errorf("unknown role %q (want admin, viewer or agent)", role)
+		}
+		rules = append(rules, RoleRule{Claim: claim, Pattern: pattern, Role: role})
+	}
+	return rules, nil
+}
+
+// LoadJWTKeys reads the comma-separated files of keys external issuers
+// sign JWTs with. A file holding a PEM public key or certificate (RSA,
+// ECDSA or Ed25519) verifies tokens signed with its private key; any other
+// file is an HMAC secret.
+func LoadJWTKeys(paths string) ([]interface{}, error) {
+	var keys []interface{}
+	for _, path := range parseSinkList(paths) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseJWTKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseJWTKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) < minHMACSecret {
+			return nil, fmt.Errorf("HMAC secret is shorter than %d bytes", minHMACSecret)
+		}
+		return secret, nil
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q, expected a public key or certificate", block.Type)
+}
+
+// JWTSettings are the JWTs the broker accepts besides those it issues
+// itself, and what they are accepted for
+type JWTSettings struct {
+	Keys         []interface{} // Keys external issuers sign with, from LoadJWTKeys
+	Issuer       string        // iss required of externally issued tokens, if set
+	Audience     string        // aud required of every token, if set
+	Roles        []RoleRule    // Roles granted by claims besides roles
+	Registration bool          // Agent registrations must carry a token granting RoleAgent
+}
+
+// LoadJWTSettings reads the JWT settings of the broker's options
+func LoadJWTSettings(options *BrokerOptions) (JWTSettings, error) {
+	keys, err := LoadJWTKeys(options.JWTKeys)
+	if err != nil {
+		return JWTSettings{}, fmt.Errorf("jwt-keys: %w", err)
+	}
+	rules, err := ParseRoleRules(options.JWTRoles)
+	if err != nil {
+		return JWTSettings{}, fmt.Errorf("jwt-roles: %w", err)
+	}
+	return JWTSettings{
+		Keys:         keys,
+		Issuer:       options.JWTIssuer,
+		Audience:     options.JWTAudience,
+		Roles:        rules,
+		Registration: options.JWTRegistration,
+	}, nil
+}
+
+// SetJWTSettings changes the JWTs the broker accepts
+func (b *Broker) SetJWTSettings(settings JWTSettings) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jwt = settings
+}
+
+// JWTIdentity is who a verified JWT speaks for
+type JWTIdentity struct {
+	Subject string
+	Issuer  string
+	Roles   map[string]bool
+}
+
+// claimStrings returns a claim holding a string or a list of strings
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// roles returns the roles a token's claims grant: those named in its roles
+// claim, and those of every rule its claims match
+func (settings JWTSettings) roles(claims jwt.MapClaims) map[string]bool {
+	roles := make(map[string]bool)
+	for _, role := range claimStrings(claims, "roles") {
+		roles[role] = true
+	}
+	for _, rule := range settings.Roles {
+		for _, value := range claimStrings(claims, rule.Claim) {
+			if matchPattern(value, rule.Pattern) {
+				roles[rule.Role] = true
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// verifyJWT checks a JWT's signature, expiry, issuer and audience, and
+// returns who it speaks for. Tokens issued by this broker are verified
+// with its identity key, others with the -jwt-keys.
+func (b *Broker) verifyJWT(raw string, now time.Time) (*JWTIdentity, error) {
+	b.mu.RLock()
+	settings := b.jwt
+	b.mu.RUnlock()
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	}
+	if settings.Audience != "" {
+		options = append(options, jwt.WithAudience(settings.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		issuer, _ := token.Claims.GetIssuer()
+		switch {
+		case issuer == b.id:
+			if token.Method != jwt.SigningMethodEdDSA {
+				return nil, fmt.Errorf("tokens issued by %s are signed with EdDSA", b.id)
+			}
+			return b.privateKey.Public().(ed25519.PublicKey), nil
+		case len(settings.Keys) == 0:
+			return nil, fmt.Errorf("token issued by %q, which is not trusted", issuer)
+		case settings.Issuer != "" && issuer != settings.Issuer:
+			return nil, fmt.Errorf("token issued by %q, not %q", issuer, settings.Issuer)
+		}
+		keys := make([]jwt.VerificationKey, len(settings.Keys))
+		for i, key := range settings.Keys {
+			keys[i] = key
+		}
+		return jwt.VerificationKeySet{Keys: keys}, nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &JWTIdentity{Roles: settings.roles(claims)}
+	identity.Subject, _ = claims.GetSubject()
+	identity.Issuer, _ = claims.GetIssuer()
+	return identity, nil
+}
+
+// jwtAuthEnabled reports whether the broker trusts externally issued JWTs
+func (b *Broker) jwtAuthEnabled() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.jwt.Keys) > 0
+}
+
+// adminJWTAuthorized reports whether a JWT grants the request: the admin
+// role allows every /admin/ request, the viewer role those made with GET
+func (b *Broker) adminJWTAuthorized(r *http.Request, raw string) bool {
+	identity, err := b.verifyJWT(raw, time.Now())
+	if err != nil {
+		slog.Debug("Admin JWT refused", "path", r.URL.Path, "error", err)
+		return false
+	}
+	return identity.Roles[RoleAdmin] || (identity.Roles[RoleViewer] && r.Method == http.MethodGet)
+}
+
+// IssueJWT creates a JWT signed with the broker's identity key granting
+// subject the roles for ttl
+func (b *Broker) IssueJWT(subject string, roles []string, ttl time.Duration) (string, time.Time, error) {
+	b.mu.RLock()
+	audience := b.jwt.Audience
+	b.mu.RUnlock()
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(ttl)
+	claims := jwt.MapClaims{
+		"iss":   b.id,
+		"sub":   subject,
+		"iat":   now.Unix(),
+		"exp":   expires.Unix(),
+		"jti":   base64.RawURLEncoding.EncodeToString(random),
+		"roles": roles,
+	}
+	if audience != "" {
+		claims["aud"] = audience
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(b.privateKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, time.Unix(expires.Unix(), 0), nil
+}
+
+// admitJWTRegistration refuses registrations without a bearer JWT granting
+// the agent role, or whose subject does not cover the agent, when the
+// broker requires one
+func (b *Broker) admitJWTRegistration(w http.ResponseWriter, env *protocol.GenericEnvelope) bool {
+	b.mu.RLock()
+	required := b.jwt.Registration
+	b.mu.RUnlock()
+	if !required {
+		return true
+	}
+
+	err := ErrJWTRequired
+	if env.Bearer != "" {
+		var identity *JWTIdentity
+		if identity, err = b.verifyJWT(env.Bearer, time.Now()); err == nil {
+			switch {
+			case !identity.Roles[RoleAgent]:
+				err = ErrJWTRequired
+			case identity.Subject != "" && !matchPattern(env.Agent, identity.Subject):
+				err = fmt.Errorf("JWT for %s does not cover agent %s", identity.Subject, env.Agent)
+			}
+		}
+	}
+	if err != nil {
+		slog.Warn("Registration refused", "agent", env.Agent, "error", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleAdminIssueJWT issues a JWT from a JSON body of the form
+// {"subject": "ops-alice", "roles": ["viewer"], "ttl": "8h"}. For the
+// agent role the subject is the pattern of agent IDs the token admits. The
+// TTL defaults to an hour.
+func (b *Broker) handleAdminIssueJWT(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Subject string   `json:"subject"`
+		Roles   []string `json:"roles"`
+		TTL     string   `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Subject == "" || len(request.Roles) == 0 {
+		http.Error(w, "A subject and roles are required", http.StatusBadRequest)
+		return
+	}
+	for _, role := range request.Roles {
+		if role != RoleAdmin && role != RoleViewer && role != RoleAgent {
+			http.Error(w, fmt.Sprintf("Unknown role %q", role), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := defaultJWTTTL
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid token TTL", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	token, expires, err := b.IssueJWT(request.Subject, request.Roles, ttl)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("JWT issued", "subject", request.Subject, "roles", request.Roles, "expires", expires)
+	writeAdminJSON(w, map[string]interface{}{
+		"token":   token,
+		"subject": request.Subject,
+		"roles":   request.Roles,
+		"expires": expires.UTC(),
+	})
+}
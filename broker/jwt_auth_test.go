@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func adminRequest(t *testing.T, server *httptest.Server, method, path, bearer, body string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminJWTRoles(t *testing.T) {
+	broker := NewBroker()
+	broker.SetAdminToken("secret")
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	issue := func(request string) string {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/admin/jwt", strings.NewReader(request))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := server.Client().Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Issuing %s failed: %v %v", request, err, resp)
+		}
+		defer resp.Body.Close()
+		var issued struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(resp.Body).Decode(&issued)
+		return issued.Token
+	}
+	viewer := issue(`{"subject": "dashboard", "roles": ["viewer"]}`)
+	admin := issue(`{"subject": "ops", "roles": ["admin"], "ttl": "10m"}`)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		bearer string
+		want   int
+	}{
+		{"viewer reads", http.MethodGet, "/admin/agents", viewer, http.StatusOK},
+		{"viewer writes", http.MethodPost, "/admin/tokens", viewer, http.StatusUnauthorized},
+		{"admin writes", http.MethodPost, "/admin/tokens", admin, http.StatusOK},
+		{"forged", http.MethodGet, "/admin/agents", admin[:len(admin)-4] + "AAAA", http.StatusUnauthorized},
+		{"none", http.MethodGet, "/admin/agents", "", http.StatusUnauthorized},
+	} {
+		if status := adminRequest(t, server, tc.method, tc.path, tc.bearer, ""); status != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, status)
+		}
+	}
+
+	if _, err := broker.verifyJWT(admin, time.Now().Add(time.Hour)); err == nil {
+		t.Error("Expected an expired token to be refused")
+	}
+	// Tokens issued by another broker are not trusted
+	other := NewBroker()
+	other.id = "broker-z"
+	foreign, _, _ := other.IssueJWT("ops", []string{RoleAdmin}, time.Hour)
+	if status := adminRequest(t, server, http.MethodGet, "/admin/agents", foreign, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected a token from another broker to be refused, got %d", status)
+	}
+}
+
+func TestExternalJWTRoleMapping(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "hmac.key")
+	secret := strings.Repeat("s", minHMACSecret)
+	os.WriteFile(secretFile, []byte(secret+"\n"), 0o600)
+	idpPub, idpKey, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKIXPublicKey(idpPub)
+	pemFile := filepath.Join(dir, "idp.pem")
+	os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	keys, err := LoadJWTKeys(secretFile + "," + pemFile)
+	if err != nil {
+		t.Fatalf("Loading keys failed: %v", err)
+	}
+	rules, _ := ParseRoleRules("groups=fem-ops:admin,groups=fem-*:viewer")
+	broker := NewBroker()
+	broker.SetJWTSettings(JWTSettings{Keys: keys, Issuer: "https://idp.example", Audience: "fem", Roles: rules})
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		base := jwt.MapClaims{"iss": "https://idp.example", "aud": "fem", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+		for name, value := range claims {
+			base[name] = value
+		}
+		signed, err := jwt.NewWithClaims(method, base).SignedString(key)
+		if err != nil {
+			t.Fatalf("Signing failed: %v", err)
+		}
+		return signed
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  string // Roles granted, or "refused"
+	}{
+		{"hmac admin group", sign(jwt.SigningMethodHS256, []byte(secret), jwt.MapClaims{"groups": []string{"staff", "fem-ops"}}), "admin viewer"},
+		{"eddsa viewer group", sign(jwt.SigningMethodEdDSA, idpKey, jwt.MapClaims{"groups": "fem-readers"}), "viewer"},
+		{"roles claim", sign(jwt.SigningMethodEdDSA, idpKey, jwt.MapClaims{"roles": []string{"agent"}}), "agent"},
+		{"wrong issuer", sign(jwt.SigningMethodHS256, []byte(secret), jwt.MapClaims{"iss": "https://other.example"}), "refused"},
+		{"wrong audience", sign(jwt.SigningMethodHS256, []byte(secret), jwt.MapClaims{"aud": "other"}), "refused"},
+		{"no expiry", sign(jwt.SigningMethodHS256, []byte(secret), jwt.MapClaims{"exp": nil}), "refused"},
+		{"unknown key", sign(jwt.SigningMethodHS256, []byte(strings.Repeat("x", minHMACSecret)), nil), "refused"},
+	} {
+		identity, err := broker.verifyJWT(tc.token, time.Now())
+		got := "refused"
+		if err == nil {
+			var roles []string
+			for _, role := range []string{RoleAdmin, RoleAgent, RoleViewer} {
+				if identity.Roles[role] {
+					roles = append(roles, role)
+				}
+			}
+			got = strings.Join(roles, " ")
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %q, got %q (%v)", tc.name, tc.want, got, err)
+		}
+	}
+}
+
+func TestJWTRegistration(t *testing.T) {
+	broker := NewBroker()
+	broker.SetJWTSettings(JWTSettings{Registration: true})
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	register := func(agentID, bearer string) error {
+		_, key, _ := protocol.GenerateKeyPair()
+		client := NewMCPClient(MCPClientConfig{AgentID: agentID, BrokerURL: server.URL, PrivateKey: key, TLSInsecure: true, BearerToken: bearer})
+		return client.Register(protocol.RegisterAgentBody{PubKey: protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)), Capabilities: []string{"echo"}})
+	}
+	workers, _, _ := broker.IssueJWT("worker-*", []string{RoleAgent}, time.Hour)
+	viewer, _, _ := broker.IssueJWT("worker-*", []string{RoleViewer}, time.Hour)
+
+	if err := register("worker-1", ""); err == nil {
+		t.Error("Expected a registration without a JWT to be refused")
+	}
+	if err := register("worker-1", viewer); err == nil {
+		t.Error("Expected a JWT without the agent role to be refused")
+	}
+	if err := register("guest", workers); err == nil {
+		t.Error("Expected a JWT for worker-* not to admit guest")
+	}
+	if err := register("worker-1", workers); err != nil {
+		t.Errorf("Expected the JWT to admit worker-1, got %v", err)
+	}
+}
+
+func TestParseRoleRules(t *testing.T) {
+	rules, err := ParseRoleRules("groups=fem-ops:admin, scope=fem.read:viewer")
+	if err != nil || len(rules) != 2 || rules[1] != (RoleRule{Claim: "scope", Pattern: "fem.read", Role: RoleViewer}) {
+		t.Errorf("Unexpected rules %+v (%v)", rules, err)
+	}
+	for _, spec := range []string{"groups=fem-ops", "groups:admin", "groups=fem-ops:root"} {
+		if _, err := ParseRoleRules(spec); err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// keyChallengeTTL bounds how long an agent has to answer a challenge
+const keyChallengeTTL = time.Minute
+
+// keyChallengeSize is the number of random bytes in a challenge
+const keyChallengeSize = 32
+
+// ErrNoChallenge is returned for key proofs answering no outstanding challenge
+var ErrNoChallenge = errors.New("no outstanding challenge for this agent and key; register again for a new one")
+
+// keyChallenge is a challenge issued to an agent registering a key
+type keyChallenge struct {
+	agent   string
+	pubKey  string
+	expires time.Time
+}
+
+// KeyChallenges holds the challenges issued to registering agents, by
+// challenge. A challenge is answered once, by the agent and key it was
+// issued for; issuing another, for any agent or key, leaves it in place.
+type KeyChallenges struct {
+	challenges map[string]*keyChallenge
+	mu         sync.Mutex
+}
+
+// NewKeyChallenges creates an empty challenge table
+func NewKeyChallenges() *KeyChallenges {
+	return &KeyChallenges{
+		challenges: make(map[string]*keyChallenge),
+	}
+}
+
+// Issue creates a challenge for an agent registering pubKey
+func (kc *KeyChallenges) Issue(agent, pubKey string, now time.Time) (protocol.RegistrationChallenge, error) {
+	random := make([]byte, keyChallengeSize)
+	if _, err := rand.Read(random); err != nil {
+		return protocol.RegistrationChallenge{}, err
+	}
+	challenge := base64.StdEncoding.EncodeToString(random)
+	issued := &keyChallenge{
+		agent:   agent,
+		pubKey:  pubKey,
+		expires: now.Add(keyChallengeTTL),
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	for id, outstanding := range kc.challenges {
+		if !now.Before(outstanding.expires) {
+			delete(kc.challenges, id)
+		}
+	}
+	kc.challenges[challenge] = issued
+
+	return protocol.RegistrationChallenge{
+		Status:    protocol.StatusChallenge,
+		Agent:     agent,
+		Challenge: challenge,
+		Expires:   issued.expires.UnixMilli(),
+	}, nil
+}
+
+// Answer checks an agent's signature of an outstanding challenge, which
+// must have been issued to the same agent for the same key. The challenge
+// is used up either way.
+func (kc *KeyChallenges) Answer(agent, pubKey, challenge, sig string, key protocol.PublicKey, now time.Time) error {
+	kc.mu.Lock()
+	outstanding, exists := kc.challenges[challenge]
+	delete(kc.challenges, challenge)
+	kc.mu.Unlock()
+
+	if !exists || outstanding.agent != agent || outstanding.pubKey != pubKey || !now.Before(outstanding.expires) {
+		return ErrNoChallenge
+	}
+	return protocol.VerifyKeyProof(agent, challenge, sig, key)
+}
+
+// SetRequireKeyProof sets whether registrations must prove key ownership
+func (b *Broker) SetRequireKeyProof(required bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keyProof = required
+}
+
+// proveKeyOwnership holds back registrations until the agent has signed a
+// challenge with the key it registers, when the broker requires it. A
+// registration without a proof is answered with a fresh challenge.
+func (b *Broker) proveKeyOwnership(w http.ResponseWriter, env *protocol.GenericEnvelope, body protocol.RegisterAgentBody, pubKey protocol.PublicKey) bool {
+	b.mu.RLock()
+	required := b.keyProof
+	b.mu.RUnlock()
+	if !required {
+		return true
+	}
+	if pubKey == nil {
+		http.Error(w, "Registration needs a usable public key", http.StatusBadRequest)
+		return false
+	}
+
+	if body.ChallengeSig == "" {
+		challenge, err := b.keyChallenges.Issue(env.Agent, body.PubKey, time.Now())
+		if err != nil {
+			http.Error(w, "Failed to issue challenge", http.StatusInternalServerError)
+			return false
+		}
+		slog.Debug("Registration challenged", "agent", env.Agent)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challenge)
+		return false
+	}
+
+	if err := b.keyChallenges.Answer(env.Agent, body.PubKey, body.Challenge, body.ChallengeSig, pubKey, time.Now()); err != nil {
+		slog.Warn("Key proof rejected", "agent", env.Agent, "error", err)
+		http.Error(w, "Key proof rejected: "+err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// keyProven reports whether a registration shows it holds the key it
+// registers, by the key proof the broker required or by its signature
+func (b *Broker) keyProven(env *protocol.GenericEnvelope, pubKey protocol.PublicKey) bool {
+	if pubKey == nil {
+		return false
+	}
+	b.mu.RLock()
+	required := b.keyProof
+	b.mu.RUnlock()
+	return required || env.VerifyKey(pubKey) == nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func registerWithKey(broker *Broker, agent string, pubKey ed25519.PublicKey, challenge, sig string) *bufferedResponse {
+	env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+	env.Agent = agent
+	env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+		PubKey:       protocol.EncodePublicKey(pubKey),
+		Capabilities: []string{"echo"},
+		Challenge:    challenge,
+		ChallengeSig: sig,
+	})
+	recorder := newBufferedResponse()
+	broker.handleRegisterAgent(recorder, env)
+	return recorder
+}
+
+func TestRegistrationKeyProof(t *testing.T) {
+	broker := NewBroker()
+	broker.SetRequireKeyProof(true)
+	pubKey, key, _ := protocol.GenerateKeyPair()
+	_, otherKey, _ := protocol.GenerateKeyPair()
+
+	// The first registration is held back with a challenge
+	recorder := registerWithKey(broker, "agent-a", pubKey, "", "")
+	var challenge protocol.RegistrationChallenge
+	json.Unmarshal(recorder.body.Bytes(), &challenge)
+	if recorder.status != http.StatusOK || challenge.Status != protocol.StatusChallenge || challenge.Challenge == "" {
+		t.Fatalf("Expected a challenge, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if _, registered := broker.agents["agent-a"]; registered {
+		t.Fatal("Expected the registration to wait for the key proof")
+	}
+
+	// A proof signed with another key is rejected and uses up the challenge
+	forged := protocol.SignKeyProof("agent-a", challenge.Challenge, otherKey)
+	if recorder := registerWithKey(broker, "agent-a", pubKey, challenge.Challenge, forged); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected a forged proof to be rejected with 401, got %d", recorder.status)
+	}
+	proof := protocol.SignKeyProof("agent-a", challenge.Challenge, key)
+	if recorder := registerWithKey(broker, "agent-a", pubKey, challenge.Challenge, proof); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected a used challenge to be rejected with 401, got %d", recorder.status)
+	}
+
+	recorder = registerWithKey(broker, "agent-a", pubKey, "", "")
+	json.Unmarshal(recorder.body.Bytes(), &challenge)
+
+	// A proof made for another agent's name does not verify
+	stolen := protocol.SignKeyProof("agent-b", challenge.Challenge, key)
+	if recorder := registerWithKey(broker, "agent-a", pubKey, challenge.Challenge, stolen); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected a proof for another agent to be rejected with 401, got %d", recorder.status)
+	}
+
+	recorder = registerWithKey(broker, "agent-a", pubKey, "", "")
+	json.Unmarshal(recorder.body.Bytes(), &challenge)
+	proof = protocol.SignKeyProof("agent-a", challenge.Challenge, key)
+	if recorder := registerWithKey(broker, "agent-a", pubKey, challenge.Challenge, proof); recorder.status != http.StatusOK {
+		t.Fatalf("Expected the proven registration to succeed, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if agent, registered := broker.agents["agent-a"]; !registered || !agent.PubKey.Equal(pubKey) {
+		t.Error("Expected agent-a to be registered with its key")
+	}
+}
+
+func TestKeyChallengeBoundToKeyAndExpiry(t *testing.T) {
+	challenges := NewKeyChallenges()
+	pubKey, key, _ := protocol.GenerateKeyPair()
+	otherPub, _, _ := protocol.GenerateKeyPair()
+	now := time.Now()
+
+	issued, _ := challenges.Issue("agent-a", protocol.EncodePublicKey(otherPub), now)
+	proof := protocol.SignKeyProof("agent-a", issued.Challenge, key)
+	if err := challenges.Answer("agent-a", protocol.EncodePublicKey(pubKey), issued.Challenge, proof, pubKey, now); err != ErrNoChallenge {
+		t.Errorf("Expected a challenge issued for another key to be refused, got %v", err)
+	}
+
+	issued, _ = challenges.Issue("agent-a", protocol.EncodePublicKey(pubKey), now)
+	proof = protocol.SignKeyProof("agent-a", issued.Challenge, key)
+	if err := challenges.Answer("agent-a", protocol.EncodePublicKey(pubKey), issued.Challenge, proof, pubKey, now.Add(2*keyChallengeTTL)); err != ErrNoChallenge {
+		t.Errorf("Expected an expired challenge to be refused, got %v", err)
+	}
+
+	// Challenges issued to others, even for the same agent and key, leave
+	// an outstanding one in place
+	issued, _ = challenges.Issue("agent-a", protocol.EncodePublicKey(pubKey), now)
+	challenges.Issue("agent-a", protocol.EncodePublicKey(pubKey), now)
+	challenges.Issue("agent-a", protocol.EncodePublicKey(otherPub), now)
+	proof = protocol.SignKeyProof("agent-a", issued.Challenge, key)
+	if err := challenges.Answer("agent-b", protocol.EncodePublicKey(pubKey), issued.Challenge, proof, pubKey, now); err != ErrNoChallenge {
+		t.Errorf("Expected a challenge answered by another agent to be refused, got %v", err)
+	}
+	issued, _ = challenges.Issue("agent-a", protocol.EncodePublicKey(pubKey), now)
+	challenges.Issue("agent-a", protocol.EncodePublicKey(pubKey), now)
+	proof = protocol.SignKeyProof("agent-a", issued.Challenge, key)
+	if err := challenges.Answer("agent-a", protocol.EncodePublicKey(pubKey), issued.Challenge, proof, pubKey, now); err != nil {
+		t.Errorf("Expected the challenge to outlast newer ones, got %v", err)
+	}
+}
+
+func TestMCPClientAnswersKeyChallenge(t *testing.T) {
+	broker := NewBroker()
+	broker.SetRequireKeyProof(true)
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	_, key, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "agent-a",
+		BrokerURL:   server.URL,
+		PrivateKey:  key,
+		TLSInsecure: true,
+	})
+	pubKey := key.Public().(ed25519.PublicKey)
+	if err := client.Register(protocol.RegisterAgentBody{PubKey: protocol.EncodePublicKey(pubKey)}); err != nil {
+		t.Fatalf("Registration failed: %v", err)
+	}
+	if _, registered := broker.agents["agent-a"]; !registered {
+		t.Error("Expected the client to complete the key proof")
+	}
+}
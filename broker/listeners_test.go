@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.sock")
+
+	// A socket left behind by a broker that is gone is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", path, err)
+	}
+	server := &http.Server{Handler: NewBroker()}
+	go server.Serve(listener)
+	defer server.Close()
+
+	if info, _ := os.Stat(path); info.Mode().Perm() != unixSocketMode {
+		t.Errorf("Expected socket mode %o, got %o", unixSocketMode, info.Mode().Perm())
+	}
+
+	// The broker answers plain HTTP over the socket
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://broker/health")
+	if err != nil {
+		t.Fatalf("Health check over the socket failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("Expected a healthy broker, got %d %q", resp.StatusCode, body)
+	}
+
+	// A socket being served is left alone, as is anything else at the path
+	if _, err := listenUnix(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Expected a socket in use to be refused, got %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "broker.sock")
+	os.WriteFile(file, nil, 0600)
+	if _, err := listenUnix(file); err == nil {
+		t.Error("Expected a regular file to be refused")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log output formats
+const (
+	LogFormatText = "text" // key=value pairs, one record per line
+	LogFormatJSON = "json" // One JSON object per line, for log collectors
+)
+
+// logLevel is the minimum level logged. It is shared by every handler so
+// a reload can change it while the broker runs.
+var logLevel = new(slog.LevelVar)
+
+// ParseLogLevel parses debug, info, warn or error
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+	}
+	return level, nil
+}
+
+// NewLogger creates a logger writing records of at least logLevel to w in
+// format
+func NewLogger(w io.Writer, format string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case LogFormatText, "":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+}
+
+// SetupLogging makes the default logger write to w in format at level.
+// Anything still logged through the log package goes to the same handler.
+func SetupLogging(w io.Writer, format, level string) error {
+	parsed, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logger, err := NewLogger(w, format)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(parsed)
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+	return nil
+}
+
+// fatal logs an error and exits, for failures the broker cannot start with
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
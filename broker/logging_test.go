@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerJSONAndLevel(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogFormatJSON)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	level, err := ParseLogLevel("warn")
+	if err != nil {
+		t.Fatalf("Failed to parse level: %v", err)
+	}
+	logLevel.Set(level)
+
+	logger.Info("Registered agent", "agent", "agent-a")
+	logger.Warn("Tool call failed", "agent", "agent-a", "requestId", "req-1")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected only the warning to be logged, got %q", buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Expected a JSON record, got %q", lines[0])
+	}
+	if record["msg"] != "Tool call failed" || record["requestId"] != "req-1" || record["level"] != "WARN" {
+		t.Errorf("Unexpected record %v", record)
+	}
+
+	// Lowering the level applies to loggers already created
+	logLevel.Set(slog.LevelDebug)
+	logger.Debug("Handled envelope")
+	if !strings.Contains(buf.String(), "Handled envelope") {
+		t.Error("Expected debug records once the level is lowered")
+	}
+}
+
+func TestLoggingConfigRejected(t *testing.T) {
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+	if _, err := NewLogger(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -8,26 +9,95 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fep-fem/protocol"
+	"golang.org/x/crypto/acme"
 )
 
+// defaultBrokerID identifies the broker on envelopes it originates
+const defaultBrokerID = "fem-broker"
+
+// defaultToolCallTimeout bounds how long a caller waits for a tool result
+const defaultToolCallTimeout = 30 * time.Second
+
 // Broker represents the FEM broker server
 type Broker struct {
-	agents      map[string]*Agent
-	mu          sync.RWMutex
-	tlsConfig   *tls.Config
-	mcpRegistry *MCPRegistry
+	agents        map[string]*Agent
+	mu            sync.RWMutex
+	tlsConfig     *tls.Config
+	mcpRegistry   *MCPRegistry
+	subscriptions *SubscriptionManager
+	toolClient    *MCPToolClient
+	pending       *PendingRequestTable
+	idempotency   *IdempotencyCache
+	ordering      *OrderedDelivery
+	streams       *StreamTable
+	peers         *PeerBrokers
+	gossip        *RegistryGossip
+	hierarchy     *BrokerHierarchy
+	trust         *FederationTrust
+	admission     AdmissionPolicy // Decides which envelopes are accepted, if set
+	hooks         BrokerHooks     // Callbacks set by a program embedding the broker
+	keyChallenges *KeyChallenges
+	keyProof      bool // Registrations must sign a challenge with their key
+	closed        bool // Registrations must carry a bootstrap token
+	sessions      *SessionTable
+	approvals     *RegistrationApprovals
+	revocations   map[string]*Revocation
+	grants        []CapabilityGrant // Capabilities the operator lets agents hold
+	usage         *UsageTracker
+	compactor     *Compactor
+	hub           *ConnectionHub
+	outbox        *Outbox
+	broadcasts    *BroadcastTable
+	drain         *DrainStatus       // Set once the broker starts draining into a successor
+	handoffs      *HandedOffRequests // Tool calls handed over by drained peers
+	adapters      *AdapterRegistry
+	renderers     *RenderRegistry
+	store         Storage
+	replay        ReplayCache // Shared nonce cache, if set; otherwise store records nonces
+	exporter      *CloudEventsExporter
+	agentTTL      time.Duration
+	paramLimits   ParamLimits
+	endpoint      string // URL peer brokers use to reach this broker
+	parent        string // URL of the parent broker, if this broker is a child
+	reloader      *Reloader
+	audit         *AuditJournal
+	persistence   PersistencePolicy // Where accepted envelopes are persisted, by type
+	monitor       *Monitor
+	adminToken    string // Bearer token required by /admin/
+	autoToken     string // Admin token generated when none is configured
+	tokenFile     string // Where a generated admin token is written
+	jwt           JWTSettings
+	tiers         *ServiceTiers
+	limiter       *RateLimiter
+	schemas       *SchemaRegistry
+	variants      *VariantNegotiations
+	eventBridges  *EventBridges
+	reputation    *Reputation
+	clientAuth    tls.ClientAuthType    // Whether envelopes are checked against client certificates
+	ca            *CertificateAuthority // Issues agents client certificates, if enabled
+	certificate   atomic.Pointer[tls.Certificate]
+	certs         *CertWatcher // Reloads certificate when its files change
+
+	// Broker identity used to sign envelopes it originates
+	id          string
+	privateKey  ed25519.PrivateKey
+	transitions []protocol.KeyTransition // Signed rotations to privateKey, published for pinning agents
 }
 
 // Agent represents a registered agent
@@ -35,103 +105,953 @@ type Agent struct {
 	ID           string
 	Capabilities []string
 	Endpoint     string
+	PubKey       protocol.PublicKey
 	RegisteredAt time.Time
+	LastSeen     time.Time // Last registration or heartbeat
+	Stale        bool      `json:"-"`
+	InFlight     int       `json:"-"` // Tool calls running, as of the last heartbeat
+	Queued       int       `json:"-"` // Tool calls waiting for a slot, as of the last heartbeat
+
+	// CertFingerprint is the client certificate the agent registered over;
+	// its later envelopes must arrive over the same certificate
+	CertFingerprint string
+
+	// Granted holds the capability patterns of the bootstrap token the
+	// agent registered with, which bound its later registrations
+	Granted []string
+
+	// Acks is set for agents that ack pushed envelopes, which the broker
+	// then pushes again until acked
+	Acks bool
+
+	// EncKey is the base64 X25519 key callers seal tool parameters to
+	EncKey string
+}
+
+// storedAgent is an Agent as storage holds it, with its public key encoded
+// as registrations carry it. Ed25519 keys encode as they did when PubKey
+// was a byte slice, so agents stored before other algorithms still load.
+type storedAgent struct {
+	*agentFields
+	PubKey string `json:",omitempty"`
+}
+
+// agentFields is Agent without its JSON methods
+type agentFields Agent
+
+// MarshalJSON encodes the agent with its public key in base64
+func (a Agent) MarshalJSON() ([]byte, error) {
+	stored := storedAgent{agentFields: (*agentFields)(&a)}
+	if a.PubKey != nil {
+		encoded, err := protocol.FormatPublicKey(a.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		stored.PubKey = encoded
+	}
+	return json.Marshal(stored)
+}
+
+// UnmarshalJSON decodes an agent encoded by MarshalJSON
+func (a *Agent) UnmarshalJSON(data []byte) error {
+	stored := storedAgent{agentFields: (*agentFields)(a)}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	a.PubKey = nil
+	if stored.PubKey != "" {
+		key, err := protocol.ParsePublicKey(stored.PubKey)
+		if err != nil {
+			return err
+		}
+		a.PubKey = key
+	}
+	return nil
 }
 
 func main() {
-	var listen string
-	flag.StringVar(&listen, "listen", ":4433", "Address to listen on")
-	flag.Parse()
+	options, err := LoadBrokerOptions(flag.CommandLine, os.Args[1:], os.Environ())
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
 
-	broker := NewBroker()
+	var output io.Writer = os.Stdout
+	if options.LogFile != "" {
+		file, err := os.OpenFile(options.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			fatal("Failed to open log file", "error", err)
+		}
+		defer file.Close()
+		output = file
+	}
+	if err := SetupLogging(output, options.LogFormat, options.LogLevel); err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
 
-	// Generate self-signed certificate
-	cert, err := generateSelfSignedCert()
+	if options.AgentManifest != "" {
+		if err := RunAgentManifest(options.AgentManifest); err != nil {
+			fatal("Agent failed", "error", err)
+		}
+		return
+	}
+
+	// Plain HTTP needs no certificate, so none is generated
+	var cert tls.Certificate
+	if options.InsecureHTTP {
+		switch {
+		case options.TLSCert != "" || options.ACMEDomains != "" || options.CADir != "":
+			fatal("-insecure-http cannot be used with -tls-cert, -acme-domain or -ca-dir")
+		case options.ClientAuth != ClientAuthNone && options.ClientAuth != "":
+			fatal("-insecure-http cannot be used with -client-auth")
+		case options.HTTP3Listen != "":
+			fatal("-insecure-http cannot be used with -http3-listen, which needs TLS")
+		}
+	} else if cert, err = loadCertificate(options.TLSCert, options.TLSKey); err != nil {
+		fatal("Failed to load certificate", "error", err)
+	}
+
+	if options.Doctor {
+		checks := NewDoctor(DoctorConfig{
+			Listen:           options.Listen,
+			Advertise:        options.Advertise,
+			Peers:            parseSinkList(options.Peers),
+			Parent:           options.Parent,
+			StorageKind:      options.StorageKind,
+			DBPath:           options.DBPath,
+			SQLDriver:        options.SQLDriver,
+			ReplayCache:      options.ReplayCache,
+			Raft:             options.Raft,
+			RaftListen:       options.RaftListen,
+			RaftPeers:        options.RaftPeers,
+			RaftCA:           options.RaftCA,
+			RaftCert:         options.RaftCert,
+			RaftKey:          options.RaftKey,
+			UsageRetention:   options.UsageRetention,
+			CloudEventsSinks: parseSinkList(options.CloudEventsSinks),
+			CloudEventsMode:  options.CloudEventsMode,
+			ToolTimeout:      options.ToolTimeout,
+			AgentTTL:         options.AgentTTL,
+			Certificate:      cert,
+			InsecureHTTP:     options.InsecureHTTP,
+		})
+		checks.Run()
+		checks.WriteReport(os.Stdout)
+		if checks.Failed() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	broker := NewBroker()
+	broker.SetBrokerID(options.BrokerID)
+	identityKey, err := LoadIdentityKey(options.IdentityKey)
+	if err != nil {
+		fatal("Failed to load identity key", "error", err)
+	}
+	var previousKey ed25519.PrivateKey
+	if options.PreviousIdentityKey != "" {
+		if _, err := os.Stat(options.PreviousIdentityKey); err != nil {
+			fatal("Failed to load previous identity key", "error", err)
+		}
+		if previousKey, err = LoadIdentityKey(options.PreviousIdentityKey); err != nil {
+			fatal("Failed to load previous identity key", "error", err)
+		}
+	}
+	if err := broker.SetIdentity(identityKey, previousKey); err != nil {
+		fatal("Failed to sign identity key transition", "error", err)
+	}
+	advertise := options.Advertise
+	if advertise == "" {
+		scheme := "https"
+		if options.InsecureHTTP {
+			scheme = "http"
+		}
+		advertise = scheme + "://localhost" + options.Listen[strings.LastIndex(options.Listen, ":"):]
+	}
+	broker.SetFederationEndpoint(advertise)
+	if options.CADir != "" {
+		ca, err := LoadOrCreateCA(options.CADir, options.BrokerID, options.ClientCertValidity)
+		if err != nil {
+			fatal("Failed to load CA", "error", err)
+		}
+		broker.SetCA(ca)
+		// Without certificate files the CA issues the serving certificate,
+		// so agents trusting the CA can verify the broker too
+		if options.TLSCert == "" {
+			hosts := []string{"localhost", "127.0.0.1"}
+			if parsed, err := url.Parse(advertise); err == nil && !containsString(hosts, parsed.Hostname()) {
+				hosts = append(hosts, parsed.Hostname())
+			}
+			if cert, err = ca.ServerCertificate(hosts); err != nil {
+				fatal("Failed to issue serving certificate", "error", err)
+			}
+		}
+	}
+	broker.pending.SetTimeout(options.ToolTimeout)
+	broker.idempotency.SetWindow(options.DedupWindow)
+	broker.ordering.SetHoldback(options.OrderingHoldback)
+	broker.broadcasts.SetTTL(options.BroadcastTTL)
+	broker.outbox.SetTimeouts(options.AckTimeout, options.OutboxTTL)
+	broker.SetParamLimits(options.ParamLimits)
+	broker.adapters.SetToken(options.IngestToken)
+	broker.SetAdminToken(options.AdminToken)
+	broker.SetAdminTokenFile(options.AdminTokenFile)
+	jwtSettings, err := LoadJWTSettings(options)
+	if err != nil {
+		fatal("Invalid JWT configuration", "error", err)
+	}
+	broker.SetJWTSettings(jwtSettings)
+	if err := broker.ensureAdminToken(); err != nil {
+		fatal("Failed to secure the admin API", "error", err)
+	}
+	if err := broker.exporter.Configure(parseSinkList(options.CloudEventsSinks), options.CloudEventsMode); err != nil {
+		fatal("Invalid CloudEvents export configuration", "error", err)
+	}
+	var cipher *RecordCipher
+	if options.EncryptionKeys != "" {
+		secrets, err := OpenFileSecrets(options.EncryptionKeys)
+		if err != nil {
+			fatal("Failed to load encryption keys", "error", err)
+		}
+		cipher = NewRecordCipher(secrets)
+	}
+	var store Storage
+	if options.StorageKind == StorageRaft {
+		if options.Raft.Peers, err = ParseRaftPeers(options.RaftPeers); err != nil {
+			fatal("Invalid raft peers", "error", err)
+		}
+		if options.Raft.Certificate, options.Raft.RootCAs, err = LoadRaftTLS(options.RaftCA, options.RaftCert, options.RaftKey); err != nil {
+			fatal("Failed to load raft certificates", "error", err)
+		}
+		store, err = OpenRaftStore(options.Raft, options.RaftListen, cipher)
+	} else {
+		store, err = OpenStorage(options.StorageKind, options.DBPath, options.SQLDriver)
+	}
+	if err != nil {
+		fatal("Failed to open storage", "storage", options.StorageKind, "error", err)
+	}
+	if cipher != nil && options.StorageKind != StorageRaft {
+		encrypted, ok := store.(EncryptedStorage)
+		if !ok {
+			fatal("Storage does not support -encryption-keys", "storage", options.StorageKind)
+		}
+		encrypted.SetCipher(cipher)
+	}
+	defer store.Close()
+	if options.AuditFile != "" {
+		journal, err := OpenAuditJournal(options.AuditFile, options.AuditMaxSize, options.AuditMaxBody)
+		if err != nil {
+			fatal("Failed to open audit journal", "error", err)
+		}
+		defer journal.Close()
+		broker.SetAuditJournal(journal)
+	}
+	persistence, err := ParsePersistencePolicy(options.Persistence)
+	if err != nil {
+		fatal("Invalid persistence policy", "error", err)
+	}
+	if _, ok := store.(EnvelopeStorage); persistence.UsesStore() && !ok {
+		fatal("Storage cannot persist envelopes for -persistence", "storage", options.StorageKind)
+	}
+	broker.SetPersistencePolicy(persistence)
+	if err := broker.SetStore(store); err != nil {
+		fatal("Failed to restore storage", "storage", options.StorageKind, "error", err)
+	}
+	if options.ReplayCache != "" {
+		cache, err := OpenReplayCache(options.ReplayCache)
+		if err != nil {
+			fatal("Failed to open replay cache", "error", err)
+		}
+		defer cache.Close()
+		broker.SetReplayCache(cache)
+	}
+	go broker.PruneNonces(time.Minute, nil)
+	go broker.limiter.Run(time.Minute, nil)
+	go broker.broadcasts.Run(time.Minute, nil)
+	go broker.outbox.Run(time.Second, nil)
+	if options.AgentTTL > 0 {
+		broker.SetAgentTTL(options.AgentTTL)
+		go broker.ReapAgents(options.AgentTTL/2, nil)
+	}
+	if options.MetricsFile != "" {
+		broker.usage.SetStore(NewFileUsageStore(options.MetricsFile))
+	}
+	tiers, err := ParseRetentionTiers(options.UsageRetention)
+	if err != nil {
+		fatal("Invalid usage retention", "error", err)
+	}
+	broker.compactor.SetTiers(tiers)
+	tierLimits, err := ParseTierLimits(options.TierLimits)
+	if err != nil {
+		fatal("Invalid service tier limits", "error", err)
+	}
+	tierAssignments, err := ParseTierAssignments(options.TierAssignments)
+	if err != nil {
+		fatal("Invalid service tier assignments", "error", err)
+	}
+	broker.tiers.Configure(tierLimits, tierAssignments)
+	eventBridges, err := ParseEventBridges(options.EventBridges)
+	if err != nil {
+		fatal("Invalid event bridges", "error", err)
+	}
+	broker.eventBridges.Set(eventBridges)
+	reputation, err := ParseReputationSettings(options.Reputation)
+	if err != nil {
+		fatal("Invalid reputation settings", "error", err)
+	}
+	broker.reputation.SetSettings(reputation)
+	rateLimits, err := ParseRateLimits(options.RateLimits)
+	if err != nil {
+		fatal("Invalid rate limits", "error", err)
+	}
+	broker.limiter.SetLimits(rateLimits)
+	rateWarnings, err := ParseRateLimitWarnings(options.RateLimitWarnings)
+	if err != nil {
+		fatal("Invalid rate limit warnings", "error", err)
+	}
+	broker.limiter.SetWarnings(rateWarnings, options.RateLimitGrace)
+	outboxPriorities, err := ParseOutboxPriorities(options.OutboxPriorities)
+	if err != nil {
+		fatal("Invalid outbox priorities", "error", err)
+	}
+	broker.outbox.SetPriorities(outboxPriorities)
+	go broker.usage.Run(options.MetricsInterval, nil)
+	if options.CompactInterval > 0 {
+		go broker.RunCompaction(options.CompactInterval, nil)
+	}
+	trustAnchors, err := ParseTrustAnchors(options.TrustAnchors)
+	if err != nil {
+		fatal("Invalid trust anchors", "error", err)
+	}
+	broker.trust.SetAnchors(trustAnchors)
+	peerTrust, err := ParsePeerTrust(options.PeerTrust)
 	if err != nil {
-		log.Fatalf("Failed to generate certificate: %v", err)
+		fatal("Invalid peer trust", "error", err)
+	}
+	broker.trust.SetWeights(peerTrust)
+	var trustChain []protocol.TrustLink
+	if options.TrustChain != "" {
+		if options.Federation == "" {
+			fatal("-trust-chain needs -federation")
+		}
+		if trustChain, err = LoadTrustChain(options.TrustChain); err != nil {
+			fatal("Failed to load trust chain", "error", err)
+		}
+	}
+	broker.trust.SetMembership(options.Federation, trustChain)
+	broker.SetRequireKeyProof(options.RequireKeyProof)
+	broker.SetSessionTTL(options.SessionTTL)
+	approvalRules, err := ParseApprovalRules(options.AutoApprove)
+	if err != nil {
+		fatal("Invalid auto-approve rules", "error", err)
+	}
+	broker.SetRegistrationApproval(options.RequireApproval, approvalRules)
+	broker.SetClosedRegistration(options.InviteOnly)
+	capabilityGrants, err := ParseCapabilityGrants(options.CapabilityGrants)
+	if err != nil {
+		fatal("Invalid capability grants", "error", err)
+	}
+	if err := checkGrantsGated(capabilityGrants, options.RequireApproval, options.InviteOnly); err != nil {
+		fatal("Invalid capability grants", "error", err)
+	}
+	broker.SetCapabilityGrants(capabilityGrants)
+	if options.AdmissionPolicy != "" {
+		policy, err := LoadAdmissionPolicy(options.AdmissionPolicy)
+		if err != nil {
+			fatal("Failed to load admission policy", "error", err)
+		}
+		broker.SetAdmissionPolicy(policy)
+	}
+	for _, peer := range parseSinkList(options.Peers) {
+		go func(peer string) {
+			if err := broker.JoinFederation(peer); err != nil {
+				slog.Warn("Failed to federate", "peer", peer, "error", err)
+			}
+		}(peer)
+	}
+	if options.GossipInterval > 0 {
+		go broker.GossipRegistry(options.GossipInterval, nil)
+	}
+	if options.Parent != "" {
+		if options.CatalogInterval <= 0 {
+			fatal("-catalog-interval must be positive for a child broker")
+		}
+		broker.SetParent(options.Parent)
+		go broker.PublishCatalog(options.CatalogInterval, nil)
 	}
 
+	reloader := NewReloader(broker, options, os.Args[1:])
+	if options.ConfigHistory != "" {
+		history, err := OpenConfigHistory(options.ConfigHistory)
+		if err != nil {
+			fatal("Failed to open configuration history", "error", err)
+		}
+		defer history.Close()
+		reloader.SetHistory(history)
+	}
+	broker.SetReloader(reloader)
+	go reloader.WatchSignals(nil)
+
+	broker.SetCertificate(cert)
+	broker.certs.SetFiles(options.TLSCert, options.TLSKey)
+	if options.TLSWatchInterval > 0 {
+		go broker.certs.Run(options.TLSWatchInterval, nil)
+	}
+	identity := broker.Identity()
+	slog.Info("Broker identity", "pubkey", identity.PubKey, "certFingerprint", identity.CertFingerprint)
 	broker.tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS13,
+		GetCertificate: broker.getCertificate,
+		MinVersion:     tls.VersionTLS13,
+	}
+	clientAuth, err := ParseClientAuth(options.ClientAuth)
+	if err != nil {
+		fatal("Invalid client auth mode", "error", err)
+	}
+	if clientAuth != tls.NoClientCert {
+		pool := x509.NewCertPool()
+		switch {
+		case options.ClientCA != "":
+			if pool, err = LoadClientCAs(options.ClientCA); err != nil {
+				fatal("Failed to load client CAs", "error", err)
+			}
+		case options.CADir == "":
+			fatal("-client-auth needs -client-ca or -ca-dir")
+		}
+		// Certificates the broker issued itself are accepted too
+		if options.CADir != "" {
+			pool.AppendCertsFromPEM(broker.ca.CertificatePEM())
+		}
+		broker.tlsConfig.ClientAuth = clientAuth
+		broker.tlsConfig.ClientCAs = pool
+		broker.SetClientAuth(clientAuth)
+	}
+	if options.ACMEDomains != "" {
+		if options.TLSCert != "" {
+			fatal("-acme-domain and -tls-cert cannot be used together")
+		}
+		manager, err := NewACMEManager(broker, ACMEConfig{
+			Domains:      parseSinkList(options.ACMEDomains),
+			Email:        options.ACMEEmail,
+			CacheDir:     options.ACMECache,
+			DirectoryURL: options.ACMEDirectory,
+		})
+		if err != nil {
+			fatal("Invalid ACME configuration", "error", err)
+		}
+		// Until the first certificate is issued, the self-signed one is served
+		manager.LoadCached()
+		broker.tlsConfig.GetCertificate = manager.GetCertificate
+		broker.tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		go manager.Run(nil)
+	}
+
+	// A local reverse proxy or tests may reach the broker over a Unix socket
+	if options.ListenUnix != "" {
+		listener, err := listenUnix(options.ListenUnix)
+		if err != nil {
+			fatal("Failed to listen on Unix socket", "path", options.ListenUnix, "error", err)
+		}
+		slog.Info("Serving plain HTTP on Unix socket", "path", options.ListenUnix)
+		go func() {
+			fatal("Unix socket listener stopped", "error", (&http.Server{Handler: broker}).Serve(listener))
+		}()
+	}
+
+	if options.InsecureHTTP {
+		slog.Warn("Serving plain HTTP without TLS; use only for local development", "listen", options.Listen)
+		server := &http.Server{Addr: options.Listen, Handler: broker}
+		fatal("Broker stopped", "error", server.ListenAndServe())
+	}
+
+	// Clients able to use HTTP/3 are pointed at the QUIC listener
+	var handler http.Handler = broker
+	if options.HTTP3Listen != "" {
+		if serveHTTP3 == nil {
+			fatal("-http3-listen needs a broker built with -tags quic")
+		}
+		if handler, err = altSvc(options.HTTP3Listen, broker); err != nil {
+			fatal("Invalid -http3-listen", "error", err)
+		}
+		slog.Info("Serving HTTP/3", "listen", options.HTTP3Listen)
+		go func() {
+			fatal("HTTP/3 listener stopped", "error", serveHTTP3(options.HTTP3Listen, broker, broker.tlsConfig))
+		}()
 	}
 
 	// Create HTTPS server
 	server := &http.Server{
-		Addr:      listen,
-		Handler:   broker,
+		Addr:      options.Listen,
+		Handler:   handler,
 		TLSConfig: broker.tlsConfig,
 	}
 
-	log.Printf("FEM Broker starting on %s", listen)
-	log.Fatal(server.ListenAndServeTLS("", ""))
+	slog.Info("FEM Broker starting", "listen", options.Listen)
+	fatal("Broker stopped", "error", server.ListenAndServeTLS("", ""))
 }
 
 // NewBroker creates a new broker instance
 func NewBroker() *Broker {
-	return &Broker{
-		agents:      make(map[string]*Agent),
-		mcpRegistry: NewMCPRegistry(),
+	_, privateKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate broker key pair: %v", err))
 	}
+
+	hub := NewConnectionHub()
+	outbox := NewOutbox(hub)
+	subscriptions := NewSubscriptionManager()
+	subscriptions.SetPusher(outbox)
+
+	broker := &Broker{
+		agents:        make(map[string]*Agent),
+		mcpRegistry:   NewMCPRegistry(),
+		subscriptions: subscriptions,
+		toolClient:    NewMCPToolClient(),
+		pending:       NewPendingRequestTable(defaultToolCallTimeout),
+		idempotency:   NewIdempotencyCache(defaultIdempotencyWindow),
+		ordering:      NewOrderedDelivery(defaultOrderingHoldback),
+		streams:       NewStreamTable(),
+		peers:         NewPeerBrokers(),
+		gossip:        NewRegistryGossip(),
+		hierarchy:     NewBrokerHierarchy(),
+		trust:         NewFederationTrust(),
+		keyChallenges: NewKeyChallenges(),
+		sessions:      NewSessionTable(defaultSessionTTL),
+		approvals:     NewRegistrationApprovals(),
+		revocations:   make(map[string]*Revocation),
+		usage:         NewUsageTracker(NewMemoryUsageStore()),
+		monitor:       NewMonitor(),
+		tiers:         NewServiceTiers(),
+		limiter:       NewRateLimiter(),
+		schemas:       NewSchemaRegistry(),
+		variants:      NewVariantNegotiations(),
+		eventBridges:  NewEventBridges(),
+		reputation:    NewReputation(),
+		compactor:     NewCompactor(defaultRetentionTiers),
+		hub:           hub,
+		outbox:        outbox,
+		broadcasts:    NewBroadcastTable(outbox),
+		handoffs:      NewHandedOffRequests(),
+		adapters:      NewAdapterRegistry(),
+		renderers:     NewRenderRegistry(),
+		exporter:      NewCloudEventsExporter(defaultBrokerID),
+		store:         NewMemoryStore(),
+		paramLimits:   defaultParamLimits,
+		id:            defaultBrokerID,
+		privateKey:    privateKey,
+	}
+	broker.certs = NewCertWatcher(broker)
+	outbox.acks = broker.agentAcks
+	return broker
 }
 
 // ServeHTTP implements the http.Handler interface
 func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(protocol.HeaderCodecs, supportedCodecs)
+	w.Header().Set("Accept-Encoding", acceptedEncodings())
+
 	// Health check endpoint
 	if r.URL.Path == "/health" && r.Method == http.MethodGet {
+		// A draining broker drops out of load balancers and failover
+		if b.draining() != nil {
+			http.Error(w, "Draining", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 		return
 	}
-	
+
+	// Operator endpoints, behind the admin token
+	if strings.HasPrefix(r.URL.Path, "/admin/") && !b.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Reload of the configuration file, as on SIGHUP
+	if r.URL.Path == "/admin/reload" && r.Method == http.MethodPost {
+		b.mu.RLock()
+		reloader := b.reloader
+		b.mu.RUnlock()
+		if reloader == nil {
+			http.Error(w, "Configuration reload is not enabled", http.StatusNotFound)
+			return
+		}
+		reloader.handleReload(w, r)
+		return
+	}
+
+	// Effective configuration, runtime changes and their signed history
+	if strings.HasPrefix(r.URL.Path, "/admin/config") {
+		b.mu.RLock()
+		reloader := b.reloader
+		b.mu.RUnlock()
+		switch {
+		case reloader == nil:
+			http.Error(w, "Configuration API is not enabled", http.StatusNotFound)
+		case r.URL.Path == "/admin/config" && (r.Method == http.MethodGet || r.Method == http.MethodPatch):
+			reloader.handleConfig(w, r)
+		case r.URL.Path == "/admin/config/history" && r.Method == http.MethodGet:
+			reloader.handleConfigHistory(w, r)
+		case r.URL.Path == "/admin/config/history/verify" && r.Method == http.MethodGet:
+			reloader.handleConfigHistoryVerify(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	// Per-agent usage summaries
+	if r.URL.Path == "/admin/reports/usage" && r.Method == http.MethodGet {
+		b.handleUsageReport(w, r)
+		return
+	}
+
+	// Space used by each subsystem, and the last compaction
+	if r.URL.Path == "/admin/storage" && r.Method == http.MethodGet {
+		b.handleStorageReport(w, r)
+		return
+	}
+
+	// Live envelope rates, agent activity and queue depths for femctl top
+	if r.URL.Path == "/admin/monitor" && r.Method == http.MethodGet {
+		b.handleMonitorStream(w, r)
+		return
+	}
+
+	// Audit journal of accepted envelopes, and a check of its hash chain
+	if r.URL.Path == "/admin/audit" && r.Method == http.MethodGet {
+		b.handleAuditQuery(w, r)
+		return
+	}
+	if r.URL.Path == "/admin/audit/verify" && r.Method == http.MethodGet {
+		b.handleAuditVerify(w, r)
+		return
+	}
+
+	// Envelopes persisted in the storage backend by the persistence policy
+	if r.URL.Path == "/admin/envelopes" && r.Method == http.MethodGet {
+		b.handleStoredEnvelopes(w, r)
+		return
+	}
+
+	// Registry listings: agents, their tools and subscriptions, and peers
+	if r.URL.Path == "/admin/agents" && r.Method == http.MethodGet {
+		b.handleAdminAgents(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/agents/") && r.Method == http.MethodGet {
+		b.handleAdminAgent(w, r)
+		return
+	}
+	if r.URL.Path == "/admin/tools" && r.Method == http.MethodGet {
+		b.handleAdminTools(w, r)
+		return
+	}
+	if r.URL.Path == "/admin/brokers" && r.Method == http.MethodGet {
+		b.handleAdminBrokers(w, r)
+		return
+	}
+
+	// Registrations waiting for approval, and invitations that skip it
+	if r.URL.Path == "/admin/registrations" && r.Method == http.MethodGet {
+		b.handleAdminRegistrations(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/registrations/") && r.Method == http.MethodPost {
+		b.handleAdminRegistrationAction(w, r)
+		return
+	}
+	if r.URL.Path == "/admin/invitations" && r.Method == http.MethodPost {
+		b.handleAdminInvite(w, r)
+		return
+	}
+
+	// Capabilities and tools revoked from agents, kept across registrations
+	if r.URL.Path == "/admin/revocations" && r.Method == http.MethodGet {
+		b.handleAdminRevocations(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/revocations/") && r.Method == http.MethodDelete {
+		b.handleAdminLiftRevocation(w, r)
+		return
+	}
+
+	// Signed bootstrap tokens for brokers closed to registration
+	if r.URL.Path == "/admin/tokens" && r.Method == http.MethodPost {
+		b.handleAdminMintToken(w, r)
+		return
+	}
+
+	// JWTs for operators, dashboards and agents
+	if r.URL.Path == "/admin/jwt" && r.Method == http.MethodPost {
+		b.handleAdminIssueJWT(w, r)
+		return
+	}
+
+	// Draining into a successor broker for a rolling upgrade
+	if r.URL.Path == "/admin/drain" && (r.Method == http.MethodGet || r.Method == http.MethodPost) {
+		b.handleAdminDrain(w, r)
+		return
+	}
+
+	// Versions kept of a tool's input and output schemas
+	if strings.HasPrefix(r.URL.Path, "/admin/schemas/") && r.Method == http.MethodGet {
+		b.handleSchemaVersions(w, r)
+		return
+	}
+
+	// Which parameter variants callers of a tool agreed on with it
+	if strings.HasPrefix(r.URL.Path, "/admin/variants/") && r.Method == http.MethodGet {
+		b.handleVariantStats(w, r)
+		return
+	}
+
+	// Agents' trust scores and quarantines
+	if r.URL.Path == "/admin/reputation" && r.Method == http.MethodGet {
+		b.handleReputation(w, r)
+		return
+	}
+
+	// Identity key and certificate agents pin the broker by
+	if r.URL.Path == "/identity" && r.Method == http.MethodGet {
+		b.handleIdentity(w, r)
+		return
+	}
+
+	// Certificate of the CA issuing agents their client certificates
+	if r.URL.Path == "/ca.crt" && r.Method == http.MethodGet {
+		b.handleCACertificate(w, r)
+		return
+	}
+
+	// Delivery of a broadcast to each of its recipients
+	if strings.HasPrefix(r.URL.Path, "/broadcasts/") && r.Method == http.MethodGet {
+		b.handleBroadcastStatus(w, r)
+		return
+	}
+
+	// Catalog of public tools with their docs and examples
+	if r.URL.Path == "/tools" && r.Method == http.MethodGet {
+		b.handleToolCatalog(w, r)
+		return
+	}
+
+	// Server-Sent Events stream of envelopes for an agent
+	if r.URL.Path == "/events" && r.Method == http.MethodGet {
+		b.handleEventStream(w, r)
+		return
+	}
+
+	// Persistent WebSocket transport
+	if r.URL.Path == "/ws" && r.Method == http.MethodGet {
+		b.handleWebSocket(w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Read body
-	body, err := io.ReadAll(r.Body)
+	// Streaming ingestion endpoint
+	if r.URL.Path == "/stream" {
+		b.handleStreamIngest(w, r)
+		return
+	}
+
+	// Webhook adapters for systems without an SDK
+	if strings.HasPrefix(r.URL.Path, "/ingest/") {
+		b.handleAdapterIngest(w, r)
+		return
+	}
+
+	// Read body, decompressed, no further than the largest envelope
+	reader, err := decodedBody(r.Header, r.Body)
+	if errors.Is(err, errUnsupportedEncoding) {
+		b.replyError(w, nil, http.StatusUnsupportedMediaType, protocol.ErrorBadRequest, err.Error())
+		return
+	}
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(io.LimitReader(reader, protocol.MaxEnvelopeSize+1))
+	}
 	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		b.replyError(w, nil, http.StatusBadRequest, protocol.ErrorBadRequest, "Failed to read body")
 		return
 	}
 	defer r.Body.Close()
+	if len(body) > protocol.MaxEnvelopeSize {
+		b.replyError(w, nil, http.StatusRequestEntityTooLarge, protocol.ErrorTooLarge, protocol.ErrEnvelopeTooLarge.Error())
+		return
+	}
 
 	// Parse envelope
-	envelope, err := protocol.ParseEnvelope(body)
+	codec := requestCodec(r)
+	envelope, err := protocol.ParseEnvelopeWithCodec(body, codec)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid envelope: %v", err), http.StatusBadRequest)
+		b.replyError(w, nil, http.StatusBadRequest, protocol.ErrorInvalidEnvelope, fmt.Sprintf("Invalid envelope: %v", err))
 		return
 	}
+	envelope.Hops = requestHops(r)
+	envelope.RemoteAddr = r.RemoteAddr
+	envelope.ClientCert = clientCertificate(r)
+	envelope.Session = r.Header.Get(protocol.HeaderSession)
+	envelope.Bearer = bearerToken(r)
+
+	// Large responses are compressed for clients that accept it
+	counter := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	if encoding, ok := negotiateEncoding(r.Header.Get("Accept-Encoding")); ok {
+		recorder := newBufferedResponse()
+		b.dispatchWithCodec(recorder, envelope, codec)
+		writeEncodedResponse(counter, recorder, encoding)
+	} else {
+		b.dispatchWithCodec(counter, envelope, codec)
+	}
+	b.recordEnvelope(envelope, len(body), counter.bytes, counter.status)
+}
 
-	// Log the received envelope
-	log.Printf("Received %s envelope from %s", envelope.Type, envelope.Agent)
-
-	// Process based on envelope type
+// dispatchEnvelope routes a parsed envelope to its handler
+func (b *Broker) dispatchEnvelope(w http.ResponseWriter, envelope *protocol.GenericEnvelope) {
+	started := time.Now()
+	defer func() {
+		slog.Debug("Handled envelope", "type", envelope.Type, "agent", envelope.Agent,
+			"nonce", envelope.Nonce, "latency", time.Since(started))
+	}()
+
+	// Failures are answered with error envelopes SDKs can act on
+	replies := &errorEnvelopeWriter{ResponseWriter: w, broker: b, envelope: envelope}
+	defer replies.finish()
+	w = replies
+
+	// Select the handler based on envelope type
+	var handle func(http.ResponseWriter, *protocol.GenericEnvelope)
 	switch envelope.Type {
 	case protocol.EnvelopeRegisterAgent:
-		b.handleRegisterAgent(w, envelope)
+		handle = b.handleRegisterAgent
 	case protocol.EnvelopeRegisterBroker:
-		b.handleRegisterBroker(w, envelope)
+		handle = b.handleRegisterBroker
 	case protocol.EnvelopeEmitEvent:
-		b.handleEmitEvent(w, envelope)
+		handle = b.handleEmitEvent
 	case protocol.EnvelopeRenderInstruction:
-		b.handleRenderInstruction(w, envelope)
+		handle = b.handleRenderInstruction
 	case protocol.EnvelopeToolCall:
-		b.handleToolCall(w, envelope)
+		handle = b.handleToolCall
 	case protocol.EnvelopeToolResult:
-		b.handleToolResult(w, envelope)
+		handle = b.handleToolResult
+	case protocol.EnvelopeToolResultChunk:
+		handle = b.handleToolResultChunk
 	case protocol.EnvelopeRevoke:
-		b.handleRevoke(w, envelope)
+		handle = b.handleRevoke
 	// MCP Integration envelope types
 	case protocol.EnvelopeDiscoverTools:
-		b.handleDiscoverTools(w, envelope)
+		handle = b.handleDiscoverTools
 	case protocol.EnvelopeEmbodimentUpdate:
-		b.handleEmbodimentUpdate(w, envelope)
+		handle = b.handleEmbodimentUpdate
+	// Event subscription envelope types
+	case protocol.EnvelopeSubscribe:
+		handle = b.handleSubscribe
+	case protocol.EnvelopeUnsubscribe:
+		handle = b.handleUnsubscribe
+	// Liveness envelope types
+	case protocol.EnvelopePing:
+		handle = b.handlePing
+	case protocol.EnvelopeAgentHeartbeat:
+		handle = b.handleAgentHeartbeat
+	// Lifecycle envelope types
+	case protocol.EnvelopeDeregisterAgent:
+		handle = b.handleDeregisterAgent
+	// Streaming tool envelope types
+	case protocol.EnvelopeStreamOpen:
+		handle = b.handleStreamOpen
+	case protocol.EnvelopeStreamData:
+		handle = b.handleStreamData
+	case protocol.EnvelopeStreamWindow:
+		handle = b.handleStreamWindow
+	case protocol.EnvelopeStreamClose:
+		handle = b.handleStreamClose
+	// Federation envelope types
+	case protocol.EnvelopeRegistryDigest:
+		handle = b.handleRegistryDigest
+	case protocol.EnvelopeCatalogSummary:
+		handle = b.handleCatalogSummary
+	// Fleet envelope types
+	case protocol.EnvelopeBroadcast:
+		handle = b.handleBroadcast
+	// Upgrade envelope types
+	case protocol.EnvelopeStateHandoff:
+		handle = b.handleStateHandoff
+	// Delivery envelope types
+	case protocol.EnvelopeAck:
+		handle = b.handleAck
+	case protocol.EnvelopeBatch:
+		handle = b.handleBatch
 	default:
-		http.Error(w, "Unknown envelope type", http.StatusBadRequest)
+		b.replyError(w, envelope, http.StatusBadRequest, protocol.ErrorUnknownType, "Unknown envelope type")
 		return
 	}
+
+	// A draining broker sends new work to its successor
+	if !b.admitDraining(w, envelope) {
+		return
+	}
+
+	// Envelopes must come over the client certificate of the agent they claim
+	if err := b.checkClientCert(envelope); err != nil {
+		b.replyError(w, envelope, http.StatusForbidden, protocol.ErrorCertificateMismatch, err.Error())
+		return
+	}
+
+	// Senders over their allowance are told when to come back
+	if !b.allowEnvelope(w, envelope) {
+		return
+	}
+
+	// Envelopes must carry a nonce, and be recent enough for it to be
+	// remembered until they are too old to be accepted
+	if envelope.Nonce == "" {
+		b.replyError(w, envelope, http.StatusBadRequest, protocol.ErrorInvalidEnvelope, "Envelope has no nonce")
+		return
+	}
+	if err := checkClockSkew(envelope.TS, time.Now()); err != nil {
+		b.replyError(w, envelope, http.StatusBadRequest, protocol.ErrorStale, err.Error())
+		return
+	}
+
+	// Reject envelopes whose nonce has already been seen, or cannot be
+	// recorded
+	fresh, err := b.checkReplay(envelope.Agent, envelope.Nonce)
+	if err != nil {
+		b.replyError(w, envelope, http.StatusServiceUnavailable, protocol.ErrorUnavailable, "Replay protection is unavailable")
+		return
+	}
+	if !fresh {
+		b.replyError(w, envelope, http.StatusConflict, protocol.ErrorReplayed, "Replayed envelope")
+		return
+	}
+
+	// Operators' admission rules see the envelope before its handler does
+	if !b.admitEnvelope(w, envelope) {
+		return
+	}
+
+	// Bodies must match their type's schema; the sender is told which
+	// fields do not
+	var invalid *protocol.ValidationError
+	if err := envelope.Validate(); errors.As(err, &invalid) {
+		b.replyErrorDetails(w, envelope, http.StatusBadRequest, protocol.ErrorInvalidEnvelope, err.Error(), map[string]interface{}{"fields": invalid.Fields})
+		return
+	}
+
+	b.persistEnvelope(envelope)
+
+	// Fields from older protocol versions still work, but the sender is told
+	if notices := envelope.SchemaNotices(); len(notices) > 0 {
+		slog.Warn("Envelope uses old fields", "type", envelope.Type, "agent", envelope.Agent, "notices", notices)
+		w.Header().Set(protocol.HeaderDeprecated, strings.Join(notices, "; "))
+	}
+
+	handle(w, envelope)
 }
 
 // handleRegisterAgent processes agent registration
@@ -143,23 +1063,133 @@ func (b *Broker) handleRegisterAgent(w http.ResponseWriter, env *protocol.Generi
 		return
 	}
 
+	if body.BodyDefinition != nil {
+		if err := validateTools(body.BodyDefinition.MCPTools); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := b.validateDiscoveryProxy(env.Agent, body.DiscoveryProxy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.EncKey != "" {
+		if _, err := protocol.ParseEncryptionKey(body.EncKey); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Keep the agent's key so later envelopes can be verified
+	pubKey, err := protocol.ParsePublicKey(body.PubKey)
+	if err != nil {
+		slog.Warn("Agent registered without a usable public key", "agent", env.Agent, "error", err)
+		pubKey = nil
+	}
+
+	// An agent registered with a key is only registered again by its
+	// holder. A registration of another key not signed by the one on
+	// record, as from an agent that lost it, waits for an operator.
+	b.mu.RLock()
+	current, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	keyChange := false
+	if registered && current.PubKey != nil {
+		if err := b.verifySender(w, env, current.PubKey); err != nil {
+			if pubKey == nil || current.PubKey.Equal(pubKey) {
+				slog.Warn("Re-registration refused", "agent", env.Agent, "error", err)
+				b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+				return
+			}
+			keyChange = true
+		}
+	}
+
+	// The registration becomes active only once the key is proven
+	if !b.proveKeyOwnership(w, env, body, pubKey) {
+		return
+	}
+
+	if keyChange {
+		if !b.keyProven(env, pubKey) {
+			slog.Warn("Key change refused", "agent", env.Agent)
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, "A new key must be registered in an envelope signed with it")
+			return
+		}
+		b.holdRegistration(w, env, body, pubKey)
+		slog.Warn("Key change waiting for approval", "agent", env.Agent)
+		return
+	}
+
+	// Registrations may need a JWT from the operator's identity provider
+	if !b.admitJWTRegistration(w, env) {
+		return
+	}
+
+	// A broker closed to registration admits only agents with a token
+	if !b.admitBootstrap(w, env, body, pubKey) {
+		return
+	}
+
+	// New agents may wait for an operator's approval
+	if !b.approveRegistration(w, env, body, pubKey) {
+		return
+	}
+
+	b.activateRegistration(w, env, body, pubKey)
+}
+
+// activateRegistration registers an agent whose registration has passed
+// every check
+func (b *Broker) activateRegistration(w http.ResponseWriter, env *protocol.GenericEnvelope, body protocol.RegisterAgentBody, pubKey protocol.PublicKey) {
+	// Agents asking for a client certificate are bound to the one issued
+	fingerprint := clientCertFingerprint(env)
+	var issued *issuedClientCert
+	if body.CSR != "" {
+		var status int
+		var err error
+		issued, status, err = b.issueClientCert(env, pubKey, body.CSR)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		fingerprint = issued.fingerprint
+	}
+
+	// Sessions verified against a previous registration's key end with it
+	b.revokeSessions(env.Agent)
+	granted := b.grantedCapabilities(env.Agent, body)
+
 	// Existing agent registration
 	b.mu.Lock()
 	b.agents[env.Agent] = &Agent{
-		ID:           env.Agent,
-		Capabilities: body.Capabilities,
-		Endpoint:     body.MCPEndpoint, // Use MCP endpoint if provided, fallback handled below
-		RegisteredAt: time.Now(),
+		ID:              env.Agent,
+		Capabilities:    body.Capabilities,
+		Endpoint:        body.MCPEndpoint, // Use MCP endpoint if provided, fallback handled below
+		PubKey:          pubKey,
+		RegisteredAt:    time.Now(),
+		LastSeen:        time.Now(),
+		CertFingerprint: fingerprint,
+		Granted:         granted,
+		Acks:            body.Acks,
+		EncKey:          body.EncKey,
 	}
 	b.mu.Unlock()
 
-	// New MCP registration if MCP endpoint provided
-	if body.MCPEndpoint != "" {
+	// What was revoked from the agent stays revoked, from its capabilities
+	// here and from its MCP tools once indexed
+	b.applyRevocation(env.Agent)
+
+	// New MCP registration if MCP endpoint or tools provided; agents on a
+	// WebSocket can serve tools without an MCP endpoint
+	if body.MCPEndpoint != "" || body.BodyDefinition != nil {
 		mcpAgent := &MCPAgent{
 			ID:              env.Agent,
 			MCPEndpoint:     body.MCPEndpoint,
 			BodyDefinition:  body.BodyDefinition,
 			EnvironmentType: body.EnvironmentType,
+			DiscoveryProxy:  body.DiscoveryProxy,
 			LastHeartbeat:   time.Now(),
 		}
 
@@ -169,134 +1199,370 @@ func (b *Broker) handleRegisterAgent(w http.ResponseWriter, env *protocol.Generi
 		}
 
 		if err := b.mcpRegistry.RegisterAgent(env.Agent, mcpAgent); err != nil {
-			log.Printf("Failed to register MCP agent: %v", err)
+			slog.Error("Failed to register MCP agent", "agent", env.Agent, "error", err)
 		} else {
-			log.Printf("Registered MCP agent %s with endpoint %s", env.Agent, body.MCPEndpoint)
+			b.applyRevocation(env.Agent)
+			slog.Info("Registered MCP agent", "agent", env.Agent, "endpoint", body.MCPEndpoint)
+			b.announceTools(env.Agent)
+			b.recordSchemas(env.Agent, mcpAgent.Tools)
+		}
+
+		// Agents that leave their tools to MCP introspection are probed
+		// for them in the background
+		if len(mcpAgent.Tools) == 0 && body.MCPEndpoint != "" {
+			go b.probeMCPTools(env.Agent, body.MCPEndpoint)
 		}
 	}
 
-	log.Printf("Registered agent %s with capabilities %v", env.Agent, body.Capabilities)
+	suggested := []string{}
+	if body.BodyDefinition != nil {
+		suggested = b.reconcileCapabilities(env.Agent, body.BodyDefinition.MCPTools)
+	}
+
+	b.persistAgent(env.Agent)
+	slog.Info("Registered agent", "agent", env.Agent, "capabilities", body.Capabilities)
+	if hook := b.currentHooks().OnAgentRegistered; hook != nil {
+		event := AgentRegisteredEvent{
+			AgentID:         env.Agent,
+			Capabilities:    body.Capabilities,
+			MCPEndpoint:     body.MCPEndpoint,
+			EnvironmentType: body.EnvironmentType,
+			RegisteredAt:    time.Now(),
+		}
+		if body.BodyDefinition != nil {
+			for _, tool := range body.BodyDefinition.MCPTools {
+				event.Tools = append(event.Tools, tool.Name)
+			}
+		}
+		hook(event)
+	}
 
 	response := map[string]interface{}{
 		"status": "registered",
 		"agent":  env.Agent,
 	}
+	if len(suggested) > 0 {
+		response["suggestedCapabilities"] = suggested
+	}
+	if issued != nil {
+		response["clientCert"] = issued.certPEM
+		response["caCert"] = issued.caPEM
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleRegisterBroker processes broker registration
-func (b *Broker) handleRegisterBroker(w http.ResponseWriter, env *protocol.GenericEnvelope) {
-	var body struct {
-		Endpoint   string                 `json:"endpoint"`
-		Embodiment map[string]interface{} `json:"embodiment,omitempty"`
-	}
+// handleEmitEvent processes event emissions
+func (b *Broker) handleEmitEvent(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.EmitEventBody
 
-	if err := json.Unmarshal(env.Body, &body); err != nil {
+	if err := env.GetBodyAs(&body); err != nil || body.Event == "" {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Broker registration from %s at %s", env.Agent, body.Endpoint)
+	// Events reach other namespaces only if their emitter is proven
+	namespace, err := b.eventNamespace(w, env)
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+
+	slog.Debug("Event emitted", "event", body.Event, "agent", env.Agent, "payload", body.Payload)
+
+	delivered := b.publishEventIn(namespace, env, body)
+	peers := b.forwardEvent(env, body.Event)
 
 	response := map[string]interface{}{
-		"status": "registered",
-		"broker": env.Agent,
+		"status":      "emitted",
+		"event":       body.Event,
+		"subscribers": delivered,
+		"peers":       peers,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleEmitEvent processes event emissions
-func (b *Broker) handleEmitEvent(w http.ResponseWriter, env *protocol.GenericEnvelope) {
-	var body struct {
-		EventType string                 `json:"eventType"`
-		Data      map[string]interface{} `json:"data"`
-	}
+// publishEventIn fans an accepted event out to subscribers and export
+// sinks, returning the number of subscribers it was dispatched to. The
+// event is scoped to namespace: only subscribers in that namespace, or in
+// one a bridge forwards the event to, receive it. Events the broker raises
+// have no namespace and reach every one.
+func (b *Broker) publishEventIn(namespace string, env *protocol.GenericEnvelope, body protocol.EmitEventBody) int {
+	b.exporter.Export(env, body)
+	return b.subscriptions.Publish(env, body.Event, func(sub Subscription) bool {
+		return b.eventBridges.Reaches(namespace, agentNamespace(sub.AgentID), body.Event)
+	})
+}
 
-	if err := json.Unmarshal(env.Body, &body); err != nil {
+// handleToolCall routes a tool call to an agent offering the tool and
+// replies with a toolResult envelope correlated by request ID
+func (b *Broker) handleToolCall(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	received := time.Now()
+	var body protocol.ToolCallBody
+	if err := env.GetBodyAs(&body); err != nil {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Event %s from %s: %v", body.EventType, env.Agent, body.Data)
+	slog.Debug("Tool call", "tool", body.Tool, "agent", env.Agent, "requestId", body.RequestID)
 
-	// In a real implementation, this would fan out to subscribers
-	response := map[string]interface{}{
-		"status": "emitted",
-		"event":  body.EventType,
+	// Capabilities are only held by callers proven to be the agent
+	verified, err := b.verifyCaller(w, env)
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// handleRenderInstruction processes render instructions
-func (b *Broker) handleRenderInstruction(w http.ResponseWriter, env *protocol.GenericEnvelope) {
-	var body struct {
-		Instruction string                 `json:"instruction"`
-		Context     map[string]interface{} `json:"context,omitempty"`
+	b.mu.RLock()
+	limits := b.paramLimits
+	b.mu.RUnlock()
+	if err := limits.Check(body.Parameters); err != nil {
+		http.Error(w, fmt.Sprintf("Parameters rejected: %v", err), http.StatusBadRequest)
+		return
+	}
+	if body.Deadline > 0 && time.Now().UnixMilli() >= body.Deadline {
+		b.replyError(w, env, http.StatusGatewayTimeout, protocol.ErrorTimeout, "The tool call's deadline has passed")
+		return
 	}
 
-	if err := json.Unmarshal(env.Body, &body); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
+	// Private tools' allowlists only admit verified callers
+	caller := ""
+	if verified {
+		caller = env.Agent
+	}
+	providers := b.mcpRegistry.FindToolProviders(body.Tool, caller)
+	if builtin, ok := b.findBuiltinTool(body.Tool, len(providers) > 0); ok {
+		b.callBuiltinTool(w, env.Agent, body, builtin, received)
 		return
 	}
+	if len(providers) == 0 {
+		// A peer broker may have an agent offering the tool
+		delivered := time.Now()
+		result, peer, forwarded := b.forwardToolCall(env, body.Tool)
+		if !forwarded {
+			http.Error(w, fmt.Sprintf("No agent offers tool %s", body.Tool), http.StatusNotFound)
+			return
+		}
+		if hook := b.currentHooks().OnToolCallRouted; hook != nil {
+			hook(ToolCallRoutedEvent{RequestID: body.RequestID, Caller: env.Agent, Tool: body.Tool, Peer: peer})
+		}
+		result.Receipt = deliveryReceipt(body, received, delivered, result.Receipt)
+		b.writeToolResult(w, result)
+		return
+	}
+	authorized := b.authorizedProviders(env.Agent, verified, providers)
+	if len(authorized) == 0 {
+		b.writePermissionDenied(w, env.Agent, body, providers)
+		return
+	}
+	compatible := variantProviders(authorized, body.Variants)
+	if len(compatible) == 0 {
+		b.writeNoCommonVariant(w, env.Agent, body, authorized)
+		return
+	}
+	provider := b.leastBusyProvider(compatible)
+	body.Variant = ""
+	if variant, ok := negotiateVariant(provider.Tool, body.Variants); ok {
+		body.Variant = variant
+		b.variants.RecordSelected(provider.AgentID, provider.Tool.Name, env.Agent, variant)
+	}
+	route := b.routeToolCall(provider)
 
-	log.Printf("Render instruction from %s: %s", env.Agent, body.Instruction)
+	// Callers are held to the rate limit of the tool's service tier
+	tier := b.toolTier(provider)
+	if allowed, retryAfter := b.tiers.Allow(env.Agent, tier); !allowed {
+		w.Header().Set("Retry-After", retryAfterHeader(retryAfter))
+		http.Error(w, fmt.Sprintf("Rate limit of the %s tier exceeded for tool %s", tier.Name, body.Tool), http.StatusTooManyRequests)
+		return
+	}
+	body.Priority = tier.Priority
+	b.schemas.RecordCall(provider.AgentID, provider.Tool.Name, env.Agent)
 
-	response := map[string]interface{}{
-		"status": "rendered",
+	if body.RequestID == "" {
+		body.RequestID = protocol.NewNonce()
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	// A call repeating an idempotency key gets the first call's result
+	// instead of running the tool again
+	var idempotent *IdempotentCall
+	if body.IdempotencyKey != "" {
+		call, first, err := b.idempotency.Begin(env.Agent, body.IdempotencyKey, toolCallFingerprint(body), time.Now())
+		if err != nil {
+			b.replyError(w, env, http.StatusUnprocessableEntity, protocol.ErrorConflict, err.Error())
+			return
+		}
+		if !first {
+			result, completed := b.idempotency.Wait(call, b.pending.Timeout())
+			if !completed {
+				b.replyError(w, env, http.StatusConflict, protocol.ErrorConflict, fmt.Sprintf("A call with idempotency key %s is still running", body.IdempotencyKey))
+				return
+			}
+			slog.Debug("Replaying tool result", "requestId", body.RequestID, "idempotencyKey", body.IdempotencyKey)
+			result.RequestID = body.RequestID
+			result.Replayed = true
+			result.Receipt = deliveryReceipt(body, received, time.Time{}, nil)
+			b.writeToolResult(w, result)
+			return
+		}
+		idempotent = call
+	}
 
-// handleToolCall processes tool calls
-func (b *Broker) handleToolCall(w http.ResponseWriter, env *protocol.GenericEnvelope) {
-	var body struct {
-		Tool       string                 `json:"tool"`
-		Parameters map[string]interface{} `json:"parameters"`
+	// Ordered calls wait for the sender's earlier calls to the same agent
+	if body.Seq > 0 {
+		if err := b.ordering.Acquire(env.Agent, provider.AgentID, body.Seq); err != nil {
+			b.idempotency.Abandon(idempotent, protocol.ToolResultBody{Error: err.Error()})
+			http.Error(w, fmt.Sprintf("Sequence %d rejected: %v", body.Seq, err), orderingStatus(err))
+			return
+		}
 	}
 
-	if err := json.Unmarshal(env.Body, &body); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
+	pending, err := b.pending.Track(body.RequestID, env.Agent, route.AgentID, provider.Tool.Name)
+	if err != nil {
+		b.releaseSequence(env.Agent, provider.AgentID, body.Seq, false)
+		b.idempotency.Abandon(idempotent, protocol.ToolResultBody{Error: err.Error()})
+		http.Error(w, fmt.Sprintf("Request %s is already pending", body.RequestID), http.StatusConflict)
 		return
 	}
+	if body.Deadline > 0 {
+		b.pending.SetDeadline(pending, time.UnixMilli(body.Deadline))
+	}
+	// A caller asking for a streamed result gets its chunks over its live
+	// connection as the agent sends them
+	if body.StreamResult && b.hub.IsConnected(env.Agent) {
+		b.pending.RelayChunks(body.RequestID)
+	}
+	if hook := b.currentHooks().OnToolCallRouted; hook != nil {
+		event := ToolCallRoutedEvent{RequestID: body.RequestID, Caller: env.Agent, Tool: provider.Tool.Name, Provider: provider.AgentID}
+		if route.AgentID != provider.AgentID {
+			event.Via = route.AgentID
+		}
+		hook(event)
+	}
+
+	// Agents holding a connection get the call pushed and answer with a
+	// toolResult envelope; others are called on their MCP endpoint
+	var result protocol.ToolResultBody
+	var output interface{}
+	var delivered bool
+	deliveredAt := time.Now()
+	if b.hub.IsConnected(route.AgentID) {
+		err = b.pushToolCall(route.AgentID, route.Tool, body)
+		if err == nil {
+			delivered = true
+			err = ErrToolCallAccepted
+		}
+	} else if route.Endpoint == "" {
+		err = fmt.Errorf("agent %s has no MCP endpoint or WebSocket connection", route.AgentID)
+	} else {
+		output, err = b.deliverToolCall(route, provider.Tool, body)
+		delivered = !isDeliveryFailure(err)
+	}
+	b.releaseSequence(env.Agent, provider.AgentID, body.Seq, delivered)
+	switch {
+	case err == ErrToolCallAccepted:
+		// The agent will post a toolResult envelope for this request
+		slog.Debug("Tool call accepted, awaiting result", "requestId", body.RequestID, "provider", route.AgentID)
+		result = b.pending.Wait(pending)
+		b.grantAttachment(env.Agent, &result)
+	case err != nil:
+		b.pending.Cancel(body.RequestID)
+		slog.Warn("Tool call failed", "tool", provider.Tool.Name, "provider", provider.AgentID, "requestId", body.RequestID, "error", err)
+		result = protocol.ToolResultBody{RequestID: body.RequestID, Error: err.Error()}
+	default:
+		b.pending.Cancel(body.RequestID)
+		result = protocol.ToolResultBody{RequestID: body.RequestID, Success: true, Result: output}
+	}
+	result.Variant = body.Variant
+	if !delivered {
+		deliveredAt = time.Time{}
+	}
+	result.Receipt = deliveryReceipt(body, received, deliveredAt, result.Receipt)
+	// A call that never reached the agent may be retried; any other
+	// outcome is what the key's later calls get
+	if delivered || err == nil {
+		b.idempotency.Complete(idempotent, result)
+	} else {
+		b.idempotency.Abandon(idempotent, result)
+	}
+	b.usage.RecordToolCall(env.Agent, provider.AgentID, tier.Name, result.Success)
+	b.reputation.Record(provider.AgentID, result.Success)
+	b.writeToolResult(w, result)
+}
 
-	log.Printf("Tool call %s from %s", body.Tool, env.Agent)
+// writeToolResult answers a toolCall with a toolResult signed by the broker
+func (b *Broker) writeToolResult(w http.ResponseWriter, result protocol.ToolResultBody) {
+	b.writeToolResultStatus(w, http.StatusOK, result)
+}
 
-	// In a real implementation, this would route to the appropriate tool handler
-	response := map[string]interface{}{
-		"status": "processing",
-		"tool":   body.Tool,
+// writeToolResultStatus answers a toolCall with a toolResult signed by the
+// broker and the given HTTP status
+func (b *Broker) writeToolResultStatus(w http.ResponseWriter, status int, result protocol.ToolResultBody) {
+	response := &protocol.ToolResultEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{
+			Type: protocol.EnvelopeToolResult,
+			CommonHeaders: protocol.CommonHeaders{
+				Agent: b.id,
+				TS:    time.Now().UnixMilli(),
+				Nonce: protocol.NewNonce(),
+			},
+		},
+		Body: result,
+	}
+
+	if err := response.Sign(b.privateKey); err != nil {
+		http.Error(w, "Failed to sign tool result", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleToolResult processes tool results
+// handleToolResult matches an asynchronous tool result to its pending call
 func (b *Broker) handleToolResult(w http.ResponseWriter, env *protocol.GenericEnvelope) {
-	var body struct {
-		Tool   string      `json:"tool"`
-		Result interface{} `json:"result"`
-		Error  string      `json:"error,omitempty"`
+	var body protocol.ToolResultBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Attachment != nil {
+		if err := b.verifyAttachmentClaim(env.Agent, body.Attachment); err != nil {
+			http.Error(w, "Invalid attachment: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
+	// Only the broker grants access to attachments
+	body.AttachmentGrant = nil
 
-	if err := json.Unmarshal(env.Body, &body); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
+	// The result resolves the call only if it comes from the provider
+	if !b.verifyProvider(w, env) {
+		return
+	}
+	req, err := b.pending.Resolve(env.Agent, body)
+	switch err {
+	case nil:
+	case ErrUnexpectedResponder:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		// The call may have been made on a broker that drained into this one
+		if b.relayHandedOffResult(w, env, body.RequestID) {
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	log.Printf("Tool result for %s from %s", body.Tool, env.Agent)
+	slog.Debug("Tool result delivered", "requestId", body.RequestID, "agent", env.Agent, "caller", req.Caller)
 
 	response := map[string]interface{}{
-		"status": "received",
-		"tool":   body.Tool,
+		"status":    "delivered",
+		"requestId": body.RequestID,
+		"caller":    req.Caller,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -305,21 +1571,31 @@ func (b *Broker) handleToolResult(w http.ResponseWriter, env *protocol.GenericEn
 
 // handleRevoke processes revocation
 func (b *Broker) handleRevoke(w http.ResponseWriter, env *protocol.GenericEnvelope) {
-	var body struct {
-		Target string `json:"target"`
-		Reason string `json:"reason"`
-	}
+	var body protocol.RevokeBody
 
 	if err := json.Unmarshal(env.Body, &body); err != nil {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
+	if !b.authorizeRevoker(w, env) {
+		return
+	}
+	if body.Capability != "" || body.Tool != "" {
+		b.handleCapabilityRevoke(w, body)
+		return
+	}
 
 	b.mu.Lock()
 	delete(b.agents, body.Target)
 	b.mu.Unlock()
 
-	log.Printf("Revoked %s for reason: %s", body.Target, body.Reason)
+	b.subscriptions.RemoveAgent(body.Target)
+	b.revokeSessions(body.Target)
+
+	slog.Info("Revoked", "target", body.Target, "reason", body.Reason)
+	if hook := b.currentHooks().OnRevocation; hook != nil {
+		hook(RevocationEvent{Target: body.Target, Reason: body.Reason})
+	}
 
 	response := map[string]interface{}{
 		"status": "revoked",
@@ -338,15 +1614,29 @@ func (b *Broker) handleDiscoverTools(w http.ResponseWriter, env *protocol.Generi
 		return
 	}
 
-	log.Printf("Tool discovery request from %s: %+v", env.Agent, discoverBody.Query)
+	slog.Debug("Tool discovery", "agent", env.Agent, "query", discoverBody.Query)
 
-	discoveredTools, err := b.mcpRegistry.DiscoverTools(discoverBody.Query)
+	// Private tools are only shown to the verified agents they allow
+	verified, err := b.verifyCaller(w, env)
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+	requester := ""
+	if verified {
+		requester = env.Agent
+	}
+	discoveredTools, err := b.mcpRegistry.DiscoverToolsFor(discoverBody.Query, requester)
 	if err != nil {
 		http.Error(w, "Discovery failed", http.StatusInternalServerError)
 		return
 	}
+	discoveredTools = b.withReputation(b.withEncryptionKeys(discoveredTools))
+	if discoverBody.Query.Federated {
+		discoveredTools = b.discoverFederated(env, discoverBody.Query, discoveredTools)
+	}
 
-	log.Printf("Found %d tools matching query", len(discoveredTools))
+	slog.Debug("Tool discovery matched", "agent", env.Agent, "tools", len(discoveredTools))
 
 	response := map[string]interface{}{
 		"status":       "success",
@@ -360,7 +1650,8 @@ func (b *Broker) handleDiscoverTools(w http.ResponseWriter, env *protocol.Generi
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleEmbodimentUpdate processes agent embodiment changes
+// handleEmbodimentUpdate processes agent embodiment changes, signed by the
+// agent if it registered with a key
 func (b *Broker) handleEmbodimentUpdate(w http.ResponseWriter, env *protocol.GenericEnvelope) {
 	var updateBody protocol.EmbodimentUpdateBody
 	if err := env.GetBodyAs(&updateBody); err != nil {
@@ -368,7 +1659,17 @@ func (b *Broker) handleEmbodimentUpdate(w http.ResponseWriter, env *protocol.Gen
 		return
 	}
 
-	log.Printf("Embodiment update from %s: environment=%s", env.Agent, updateBody.EnvironmentType)
+	if err := validateTools(updateBody.BodyDefinition.MCPTools); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Only the agent may move its endpoint or change its tools
+	if _, err := b.verifyCaller(w, env); err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+
+	slog.Debug("Embodiment update", "agent", env.Agent, "environment", updateBody.EnvironmentType)
 
 	// Update MCP registry with new embodiment
 	if agent, exists := b.mcpRegistry.GetAgent(env.Agent); exists {
@@ -380,8 +1681,12 @@ func (b *Broker) handleEmbodimentUpdate(w http.ResponseWriter, env *protocol.Gen
 
 		// Re-register to update tool index
 		b.mcpRegistry.RegisterAgent(env.Agent, agent)
+		b.applyRevocation(env.Agent)
 
-		log.Printf("Updated embodiment for agent %s", env.Agent)
+		b.persistAgent(env.Agent)
+		slog.Info("Updated embodiment", "agent", env.Agent)
+		b.announceTools(env.Agent)
+		b.recordSchemas(env.Agent, agent.Tools)
 	}
 
 	response := map[string]interface{}{
@@ -393,6 +1698,144 @@ func (b *Broker) handleEmbodimentUpdate(w http.ResponseWriter, env *protocol.Gen
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleSubscribe registers event subscriptions for the sending agent,
+// which must be registered and, if it has a key, prove it
+func (b *Broker) handleSubscribe(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.SubscribeBody
+	if err := env.GetBodyAs(&body); err != nil || len(body.Events) == 0 {
+		http.Error(w, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	var registeredEndpoint string
+	var pubKey protocol.PublicKey
+	if registered {
+		registeredEndpoint, pubKey = agent.Endpoint, agent.PubKey
+	}
+	b.mu.RUnlock()
+	if !registered {
+		b.replyError(w, env, http.StatusForbidden, protocol.ErrorForbidden, fmt.Sprintf("Agent %s must be registered to subscribe", env.Agent))
+		return
+	}
+	if pubKey != nil {
+		if err := b.verifySender(w, env, pubKey); err != nil {
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+			return
+		}
+	}
+	// Events are only posted to the agent's own origin, so a subscription
+	// cannot point the broker's requests at other hosts
+	if body.Endpoint != "" && !sameOrigin(body.Endpoint, registeredEndpoint) {
+		http.Error(w, "Subscription endpoint must be on the agent's registered endpoint's origin", http.StatusBadRequest)
+		return
+	}
+
+	// Fall back to the agent's registered endpoint for delivery
+	endpoint := body.Endpoint
+	if endpoint == "" {
+		if existing, ok := b.subscriptions.GetSubscription(env.Agent); ok {
+			endpoint = existing.Endpoint
+		}
+	}
+	if endpoint == "" {
+		endpoint = registeredEndpoint
+	}
+	if endpoint == "" && !b.hub.IsConnected(env.Agent) {
+		http.Error(w, "No delivery endpoint for subscription", http.StatusBadRequest)
+		return
+	}
+
+	sub := b.subscriptions.Subscribe(env.Agent, endpoint, body.Events)
+	b.persistSubscription(env.Agent)
+
+	slog.Info("Agent subscribed", "agent", env.Agent, "events", body.Events)
+
+	response := map[string]interface{}{
+		"status":   "subscribed",
+		"agent":    env.Agent,
+		"events":   sub.Patterns,
+		"endpoint": sub.Endpoint,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleUnsubscribe removes event subscriptions for the sending agent
+func (b *Broker) handleUnsubscribe(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.UnsubscribeBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if _, err := b.verifyCaller(w, env); err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+
+	b.subscriptions.Unsubscribe(env.Agent, body.Events)
+	b.persistSubscription(env.Agent)
+
+	slog.Info("Agent unsubscribed", "agent", env.Agent, "events", body.Events)
+
+	response := map[string]interface{}{
+		"status": "unsubscribed",
+		"agent":  env.Agent,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handlePing answers a ping with a signed pong. Pings from registered agents
+// with a known key must carry a valid signature.
+func (b *Broker) handlePing(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.PingBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+
+	verified := false
+	if registered && agent.PubKey != nil {
+		if err := b.verifySender(w, env, agent.PubKey); err != nil {
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+			return
+		}
+		verified = true
+	}
+
+	pong := protocol.NewPong(b.id, &protocol.PingEnvelope{BaseEnvelope: env.BaseEnvelope, Body: body})
+	pong.Body.SignatureVerified = verified
+	pong.Body.PubKey = protocol.EncodePublicKey(b.privateKey.Public().(ed25519.PublicKey))
+
+	if err := pong.Sign(b.privateKey); err != nil {
+		http.Error(w, "Failed to sign pong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pong)
+}
+
+// loadCertificate loads the certificate to serve from PEM files, or
+// generates a self-signed one if none are given
+func loadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return generateSelfSignedCert()
+	}
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
 // generateSelfSignedCert generates a self-signed certificate for TLS
 func generateSelfSignedCert() (tls.Certificate, error) {
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -426,7 +1869,6 @@ func generateSelfSignedCert() (tls.Certificate, error) {
 }
 
 func init() {
-	// Set up logging
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	log.SetOutput(os.Stdout)
+	// Log to stdout until the configuration chooses otherwise
+	SetupLogging(os.Stdout, LogFormatText, "info")
 }
\ No newline at end of file
@@ -5,8 +5,12 @@ import (
 	"crypto/ed25519"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,7 +21,7 @@ import (
 type MCPClient struct {
 	agentID     string
 	brokerURL   string
-	privateKey  ed25519.PrivateKey
+	signer      protocol.Signer
 	httpClient  *http.Client
 	
 	// Tool discovery cache
@@ -28,6 +32,40 @@ type MCPClient struct {
 	// Request management
 	requestID   int64
 	requestMutex sync.Mutex
+
+	// Wire codec, upgraded to MessagePack once the broker advertises it
+	codec      protocol.Codec
+	codecMutex sync.RWMutex
+	jsonOnly   bool
+	preferCBOR bool
+
+	// Encoding large requests are compressed with, once the broker
+	// advertises one in Accept-Encoding
+	encoding   *contentEncoding
+	noCompress bool
+
+	// Session token the broker issued after verifying the client's signature
+	session      string
+	sessionMutex sync.Mutex
+
+	// JWT sent as the Authorization header, if set
+	bearer string
+
+	// Brokers in order of preference; brokerURL is the one in use
+	brokerURLs   []string
+	brokerMutex  sync.RWMutex
+	registration *protocol.RegisterAgentBody
+	onFailover   func(brokerURL string)
+
+	// Ordered delivery: the last sequence number used for each recipient
+	ordered       bool
+	sequences     map[string]uint64
+	sequenceMutex sync.Mutex
+
+	// Offline mode: envelopes sent while no broker is reachable
+	journal      *envelopeJournal
+	journalTTL   time.Duration
+	journalMutex sync.Mutex
 }
 
 // CachedToolResult stores discovered tools with expiration
@@ -42,9 +80,46 @@ type MCPClientConfig struct {
 	AgentID        string
 	BrokerURL      string
 	PrivateKey     ed25519.PrivateKey
+	// Signer, if set, signs instead of PrivateKey, for keys held in a KMS
+	// or HSM such as a protocol.VaultTransitSigner
+	Signer         protocol.Signer
 	CacheExpiry    time.Duration
 	RequestTimeout time.Duration
 	TLSInsecure    bool
+	// DisableMsgPack keeps the client on JSON even if the broker supports MessagePack
+	DisableMsgPack bool
+	// PreferCBOR upgrades the client to CBOR rather than MessagePack when
+	// the broker supports it
+	PreferCBOR bool
+	// DisableCompression stops the client compressing large requests and
+	// asking for compressed responses
+	DisableCompression bool
+	// FailoverURLs are brokers to fail over to, in order, when BrokerURL
+	// cannot be reached
+	FailoverURLs []string
+	// OnFailover is called after the client has switched to another broker,
+	// on failover or when its broker drains into a successor, and repeated
+	// its registration there, to re-establish other state such as event
+	// streams
+	OnFailover func(brokerURL string)
+	// Ordered numbers tool calls to each agent so the broker delivers them
+	// in the order they were made. Calls that leave the agent to the broker
+	// are not ordered.
+	Ordered bool
+	// JournalDir, if set, is where envelopes given to Send are journaled
+	// while no broker can be reached, to be replayed in order once one can
+	JournalDir string
+	// JournalTTL is how long a journaled envelope stays worth delivering
+	// unless Send is given another TTL (default 24h)
+	JournalTTL time.Duration
+	// BearerToken, if set, is sent as "Authorization: Bearer" with every
+	// request, for brokers run with -jwt-registration
+	BearerToken string
+	// HTTPClient, if set, is used instead of a client of the client's own,
+	// sharing its connections with the other clients using it, such as
+	// those of an AgentHost. TLSInsecure and RequestTimeout are then
+	// ignored.
+	HTTPClient *http.Client
 }
 
 // NewMCPClient creates a new MCP client instance
@@ -55,22 +130,47 @@ func NewMCPClient(config MCPClientConfig) *MCPClient {
 	if config.RequestTimeout == 0 {
 		config.RequestTimeout = 30 * time.Second
 	}
+	if config.JournalTTL == 0 {
+		config.JournalTTL = defaultJournalTTL
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		transport := &http.Transport{}
+		if config.TLSInsecure {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		httpClient = &http.Client{Transport: transport, Timeout: config.RequestTimeout}
+	}
 
-	transport := &http.Transport{}
-	if config.TLSInsecure {
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	var signer protocol.Signer = config.PrivateKey
+	if config.Signer != nil {
+		signer = config.Signer
+	}
+
+	var journal *envelopeJournal
+	if config.JournalDir != "" {
+		journal = newEnvelopeJournal(config.JournalDir)
 	}
 
 	return &MCPClient{
 		agentID:     config.AgentID,
 		brokerURL:   config.BrokerURL,
-		privateKey:  config.PrivateKey,
+		signer:      signer,
 		toolCache:   make(map[string]*CachedToolResult),
 		cacheExpiry: config.CacheExpiry,
-		httpClient: &http.Client{
-			Transport: transport,
-			Timeout:   config.RequestTimeout,
-		},
+		codec:       protocol.JSONCodec,
+		jsonOnly:    config.DisableMsgPack,
+		preferCBOR:  config.PreferCBOR,
+		noCompress:  config.DisableCompression,
+		brokerURLs:  append([]string{config.BrokerURL}, config.FailoverURLs...),
+		onFailover:  config.OnFailover,
+		ordered:     config.Ordered,
+		sequences:   make(map[string]uint64),
+		journal:     journal,
+		journalTTL:  config.JournalTTL,
+		bearer:      config.BearerToken,
+		httpClient:  httpClient,
 	}
 }
 
@@ -92,7 +192,7 @@ func (c *MCPClient) DiscoverTools(query protocol.ToolQuery) ([]protocol.Discover
 			CommonHeaders: protocol.CommonHeaders{
 				Agent: c.agentID,
 				TS:    time.Now().UnixMilli(),
-				Nonce: c.generateNonce(),
+				Nonce: protocol.NewNonce(),
 			},
 		},
 		Body: protocol.DiscoverToolsBody{
@@ -102,7 +202,7 @@ func (c *MCPClient) DiscoverTools(query protocol.ToolQuery) ([]protocol.Discover
 	}
 
 	// Sign the envelope
-	if err := envelope.Sign(c.privateKey); err != nil {
+	if err := protocol.SignEnvelope(envelope, c.signer); err != nil {
 		return nil, fmt.Errorf("failed to sign discovery request: %w", err)
 	}
 
@@ -161,45 +261,265 @@ func (c *MCPClient) FindToolsInEnvironment(environmentType string, maxResults in
 	return c.DiscoverTools(query)
 }
 
-// CallTool invokes a specific MCP tool through its agent
+// CallTool invokes a specific MCP tool through its agent. If discovery
+// returned the tool as idempotent with a retry policy, failed deliveries to
+// the broker are retried under the same request ID as the policy allows,
+// and with it as idempotency key, so the broker runs the tool once.
 func (c *MCPClient) CallTool(agentID, toolName string, parameters map[string]interface{}) (interface{}, error) {
+	return c.CallToolIdempotent(agentID, toolName, "", parameters)
+}
+
+// CallToolIdempotent invokes a tool with an idempotency key. The broker
+// runs the tool once per key and answers calls repeating the key, such as
+// retries after a lost response or a restart, with the first call's result
+// for as long as it keeps it (-dedup-window). The key must name one call:
+// reusing it with other parameters is refused.
+func (c *MCPClient) CallToolIdempotent(agentID, toolName, key string, parameters map[string]interface{}) (interface{}, error) {
 	requestID := c.generateRequestID()
+	// Retries keep the sequence number, so the broker still delivers in order
+	seq := c.nextSequence(agentID)
+
+	attempts := 1
+	tool, known := c.cachedTool(agentID, toolName)
+	if known {
+		attempts = tool.DeliveryAttempts()
+	}
+	if key == "" && attempts > 1 {
+		key = requestID
+	}
+
+	call := protocol.NewToolCall(c.agentID).
+		Tool(fmt.Sprintf("%s/%s", agentID, toolName)).
+		Params(parameters).
+		RequestID(requestID).
+		Seq(seq).
+		IdempotencyKey(key).
+		SignWith(c.signer)
+
+	var response map[string]interface{}
+	for attempt := 1; ; attempt++ {
+		// Each attempt is a fresh envelope, since the broker rejects
+		// repeated nonces
+		envelope, err := call.Build()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build tool call: %w", err)
+		}
+
+		// Send request to broker
+		response, err = c.sendRequest(envelope)
+		if err == nil {
+			break
+		}
+		if attempt >= attempts || !isDeliveryFailure(err) {
+			return nil, fmt.Errorf("failed to send tool call: %w", err)
+		}
+		time.Sleep(tool.Retry.Backoff(attempt))
+	}
+
+	// The broker replies with a toolResult envelope for our request
+	if response["type"] != string(protocol.EnvelopeToolResult) {
+		return nil, fmt.Errorf("unexpected tool call response: %v", response)
+	}
+
+	body, ok := response["body"].(map[string]interface{})
+	if !ok || body["requestId"] != requestID {
+		return nil, fmt.Errorf("tool result does not match request %s", requestID)
+	}
+
+	if success, _ := body["success"].(bool); !success {
+		return nil, fmt.Errorf("tool call failed: %v", body["error"])
+	}
+	if _, attached := body["attachment"]; attached {
+		return c.fetchAttachment(body)
+	}
+
+	return body["result"], nil
+}
+
+// fetchAttachment fetches a result the agent serves directly, using the
+// grant the broker issued with it
+func (c *MCPClient) fetchAttachment(body map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var result protocol.ToolResultBody
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid tool result: %w", err)
+	}
+	if result.AttachmentGrant == nil {
+		return nil, fmt.Errorf("tool result attachment %s came without a grant", result.Attachment.ID)
+	}
+	return protocol.FetchAttachment(c.httpClient, result.Attachment, result.AttachmentGrant)
+}
+
+// cachedTool looks up a tool in unexpired discovery results
+func (c *MCPClient) cachedTool(agentID, toolName string) (protocol.MCPTool, bool) {
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+
+	for _, cached := range c.toolCache {
+		if time.Since(cached.Timestamp) > c.cacheExpiry {
+			continue
+		}
+		for _, discovered := range cached.Tools {
+			if discovered.AgentID != agentID {
+				continue
+			}
+			for _, tool := range discovered.MCPTools {
+				if tool.Name == toolName {
+					return tool, true
+				}
+			}
+		}
+	}
+	return protocol.MCPTool{}, false
+}
+
+// Ping sends a signed ping to the broker and returns the round-trip time.
+// The pong must answer this ping and carry a valid broker signature.
+func (c *MCPClient) Ping() (time.Duration, error) {
+	ping := protocol.NewPing(c.agentID, "")
+	if err := protocol.SignEnvelope(ping, c.signer); err != nil {
+		return 0, fmt.Errorf("failed to sign ping: %w", err)
+	}
+
+	start := time.Now()
+	payload, err := c.sendRequestRaw(ping)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send ping: %w", err)
+	}
+	rtt := time.Since(start)
+
+	pong, err := protocol.ParseEnvelope(payload)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode pong: %w", err)
+	}
+
+	var body protocol.PongBody
+	if pong.Type != protocol.EnvelopePong || pong.GetBodyAs(&body) != nil {
+		return 0, fmt.Errorf("unexpected ping response: %s", payload)
+	}
+	if body.PingNonce != ping.Nonce {
+		return 0, fmt.Errorf("pong answers ping %s, expected %s", body.PingNonce, ping.Nonce)
+	}
+
+	brokerKey, err := protocol.DecodePublicKey(body.PubKey)
+	if err != nil {
+		return 0, fmt.Errorf("pong carries no usable broker key: %w", err)
+	}
+	if err := pong.Verify(brokerKey); err != nil {
+		return 0, fmt.Errorf("pong signature invalid: %w", err)
+	}
+
+	return rtt, nil
+}
+
+// Heartbeat tells the broker this agent is still alive, returning the
+// broker's agent TTL (zero if the broker does not evict silent agents).
+// Send heartbeats well within the TTL, for example every TTL/3.
+func (c *MCPClient) Heartbeat(status string) (time.Duration, error) {
+	heartbeat := protocol.NewAgentHeartbeat(c.agentID, status)
+	if err := protocol.SignEnvelope(heartbeat, c.signer); err != nil {
+		return 0, fmt.Errorf("failed to sign heartbeat: %w", err)
+	}
 
-	// Create tool call envelope
-	envelope := &protocol.ToolCallEnvelope{
+	response, err := c.sendRequest(heartbeat)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send heartbeat: %w", err)
+	}
+
+	ttlMs, _ := response["ttlMs"].(float64)
+	return time.Duration(ttlMs) * time.Millisecond, nil
+}
+
+// Deregister tells the broker this agent is leaving so its tools and
+// subscriptions are removed immediately instead of after eviction
+func (c *MCPClient) Deregister(reason string) error {
+	deregister := protocol.NewDeregisterAgent(c.agentID, reason)
+	if err := protocol.SignEnvelope(deregister, c.signer); err != nil {
+		return fmt.Errorf("failed to sign deregistration: %w", err)
+	}
+
+	if _, err := c.sendRequest(deregister); err != nil {
+		return fmt.Errorf("failed to deregister: %w", err)
+	}
+
+	c.RefreshCache()
+	return nil
+}
+
+// Ack confirms receipt of envelopes the broker pushed over this agent's
+// connection, by nonce. Agents registered with acks must ack what they
+// receive, or the broker pushes it again.
+func (c *MCPClient) Ack(nonces ...string) error {
+	ack := protocol.NewAck(c.agentID, nonces...)
+	if err := protocol.SignEnvelope(ack, c.signer); err != nil {
+		return fmt.Errorf("failed to sign ack: %w", err)
+	}
+
+	if _, err := c.sendRequest(ack); err != nil {
+		return fmt.Errorf("failed to send ack: %w", err)
+	}
+	return nil
+}
+
+// Render sends a render instruction and returns the rendered artifacts.
+// renderer names the agent to render with, or is empty to let the broker
+// choose.
+func (c *MCPClient) Render(instruction string, parameters map[string]interface{}, renderer string) (*protocol.RenderResultBody, error) {
+	envelope := &protocol.RenderInstructionEnvelope{
 		BaseEnvelope: protocol.BaseEnvelope{
-			Type: protocol.EnvelopeToolCall,
+			Type: protocol.EnvelopeRenderInstruction,
 			CommonHeaders: protocol.CommonHeaders{
 				Agent: c.agentID,
 				TS:    time.Now().UnixMilli(),
-				Nonce: c.generateNonce(),
+				Nonce: protocol.NewNonce(),
 			},
 		},
-		Body: protocol.ToolCallBody{
-			Tool:       fmt.Sprintf("%s/%s", agentID, toolName),
-			Parameters: parameters,
-			RequestID:  requestID,
+		Body: protocol.RenderInstructionBody{
+			Instruction: instruction,
+			Parameters:  parameters,
+			RequestID:   c.generateRequestID(),
+			Renderer:    renderer,
 		},
 	}
-
-	// Sign the envelope
-	if err := envelope.Sign(c.privateKey); err != nil {
-		return nil, fmt.Errorf("failed to sign tool call: %w", err)
+	if err := protocol.SignEnvelope(envelope, c.signer); err != nil {
+		return nil, fmt.Errorf("failed to sign render instruction: %w", err)
 	}
 
-	// Send request to broker
-	response, err := c.sendRequest(envelope)
+	data, err := c.sendRequestRaw(envelope)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send tool call: %w", err)
+		return nil, fmt.Errorf("failed to render %s: %w", instruction, err)
 	}
-
-	// Check for success
-	if status, ok := response["status"].(string); ok && status == "processing" {
-		// In a real implementation, this would poll for results or use webhooks
-		return response, nil
+	var result protocol.RenderResultBody
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid render result: %w", err)
 	}
+	return &result, nil
+}
 
-	return nil, fmt.Errorf("tool call failed: %v", response)
+// EventStreamRequest returns a signed request for the broker's Server-Sent
+// Events stream of envelopes addressed to this agent. The broker accepts
+// each signature once and for protocol.EventStreamMaxSkew, so build a fresh
+// request for each connection.
+func (c *MCPClient) EventStreamRequest() (*http.Request, error) {
+	streamURL, err := url.Parse(c.currentBroker())
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+	streamURL.Path = strings.TrimSuffix(streamURL.Path, "/") + "/events"
+	header, err := protocol.SignEventStreamRequestWith(c.agentID, c.signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign event stream request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, streamURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event stream request: %w", err)
+	}
+	req.Header = header
+	req.Header.Set("Accept", "text/event-stream")
+	return req, nil
 }
 
 // GetAvailableAgents returns a list of all agents that have MCP tools
@@ -216,31 +536,232 @@ func (c *MCPClient) RefreshCache() {
 
 // sendRequest sends an envelope to the broker and returns the response
 func (c *MCPClient) sendRequest(envelope interface{}) (map[string]interface{}, error) {
+	return decodeResponse(c.sendRequestRaw(envelope))
+}
+
+// decodeResponse parses a JSON response body, passing on a send error
+func decodeResponse(payload []byte, err error) (map[string]interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse response
+	var response map[string]interface{}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return response, nil
+}
+
+// sendRequestRaw sends an envelope to the broker and returns the JSON
+// response body unparsed
+func (c *MCPClient) sendRequestRaw(envelope interface{}) ([]byte, error) {
 	// Marshal envelope
 	data, err := json.Marshal(envelope)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
+	return c.sendData(data)
+}
+
+// sendData sends a marshaled envelope to the broker, failing over if it
+// cannot be reached
+func (c *MCPClient) sendData(data []byte) ([]byte, error) {
+	brokerURL := c.currentBroker()
+	payload, err := c.post(brokerURL, data)
+	var draining *brokerDrainingError
+	switch {
+	case errors.Is(err, errBrokerUnreachable):
+		if next, failoverErr := c.failover(brokerURL); failoverErr == nil {
+			payload, err = c.post(next, data)
+		}
+	case errors.As(err, &draining):
+		if next, redirectErr := c.redirect(brokerURL, draining.successor); redirectErr == nil {
+			payload, err = c.post(next, data)
+		}
+	}
+	return payload, err
+}
+
+// maxErrorReply bounds the error envelope read from a failed response
+const maxErrorReply = 64 << 10
+
+// brokerStatusError is a response from the broker other than 200 OK. It
+// unwraps to the *protocol.RemoteError the broker answered with.
+type brokerStatusError struct {
+	status int
+	remote *protocol.RemoteError
+}
+
+func (e *brokerStatusError) Error() string {
+	if e.remote == nil || e.remote.Message == "" {
+		return fmt.Sprintf("broker returned status %d", e.status)
+	}
+	return fmt.Sprintf("broker returned status %d: %s: %s", e.status, e.remote.Code, e.remote.Message)
+}
+
+func (e *brokerStatusError) Unwrap() error {
+	if e.remote == nil {
+		return nil
+	}
+	return e.remote
+}
+
+// post sends a JSON envelope to a broker in the negotiated codec and returns
+// the JSON response body
+func (c *MCPClient) post(brokerURL string, data []byte) ([]byte, error) {
+	var err error
+
+	// Encode with the negotiated codec
+	codec := c.currentCodec()
+	if codec != protocol.JSONCodec {
+		if data, err = protocol.TranscodeFromJSON(codec, data); err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	// Compress large requests, such as registrations with big body
+	// definitions, once the broker has said it accepts compression
+	encoding := c.currentEncoding()
+	compressed := false
+	if encoding != nil && len(data) >= compressMinSize {
+		if data, err = compressBody(*encoding, data); err != nil {
+			return nil, fmt.Errorf("failed to compress request: %w", err)
+		}
+		compressed = true
+	}
 
 	// Send HTTP POST request
-	resp, err := c.httpClient.Post(c.brokerURL, "application/json", bytes.NewReader(data))
+	req, err := http.NewRequest(http.MethodPost, brokerURL, bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("failed to send HTTP request: %w", err)
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", codec.ContentType())
+	if compressed {
+		req.Header.Set("Content-Encoding", encoding.name)
+	}
+	if !c.noCompress {
+		// Set explicitly, so the transport leaves decoding to us
+		req.Header.Set("Accept-Encoding", acceptedEncodings())
+	}
+	if session := c.currentSession(); session != "" {
+		req.Header.Set(protocol.HeaderSession, session)
+	}
+	if c.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearer)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, &deliveryError{fmt.Errorf("failed to send HTTP request: %w: %w", errBrokerUnreachable, err)}
 	}
 	defer resp.Body.Close()
 
+	c.negotiateCodec(resp.Header.Get(protocol.HeaderCodecs))
+	c.negotiateCompression(resp.Header.Get("Accept-Encoding"))
+	respBody, err := decodedBody(resp.Header, resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if session := resp.Header.Get(protocol.HeaderSession); session != "" {
+		c.sessionMutex.Lock()
+		c.session = session
+		c.sessionMutex.Unlock()
+	}
+
+	// A draining broker names the broker to move to
+	if successor := resp.Header.Get(protocol.HeaderSuccessor); successor != "" && resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, &brokerDrainingError{successor}
+	}
+
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("broker returned status %d", resp.StatusCode)
+		body, _ := io.ReadAll(io.LimitReader(respBody, maxErrorReply))
+		err := &brokerStatusError{resp.StatusCode, protocol.ParseRemoteError(resp.StatusCode, body)}
+		if retryableStatus(resp.StatusCode) {
+			return nil, &deliveryError{err}
+		}
+		return nil, err
 	}
 
-	// Parse response
-	var response map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	// Read response, transcoding MessagePack or CBOR back to JSON
+	payload, err := io.ReadAll(respBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if codec := protocol.CodecForContentType(resp.Header.Get("Content-Type")); codec != nil && codec != protocol.JSONCodec {
+		if payload, err = protocol.TranscodeToJSON(codec, payload); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
 	}
 
-	return response, nil
+	return payload, nil
+}
+
+// currentCodec returns the codec used for requests to the broker
+func (c *MCPClient) currentCodec() protocol.Codec {
+	c.codecMutex.RLock()
+	defer c.codecMutex.RUnlock()
+	return c.codec
+}
+
+// currentEncoding returns the encoding large requests are compressed
+// with, or nil to send them as they are
+func (c *MCPClient) currentEncoding() *contentEncoding {
+	c.codecMutex.RLock()
+	defer c.codecMutex.RUnlock()
+	return c.encoding
+}
+
+// negotiateCompression picks the encoding to compress requests with from
+// the broker's Accept-Encoding
+func (c *MCPClient) negotiateCompression(accepted string) {
+	if c.noCompress || accepted == "" {
+		return
+	}
+
+	var encoding *contentEncoding
+	if chosen, ok := negotiateEncoding(accepted); ok {
+		encoding = &chosen
+	}
+	c.codecMutex.Lock()
+	c.encoding = encoding
+	c.codecMutex.Unlock()
+}
+
+// currentSession returns the session token sent with requests. A token
+// the broker no longer accepts only costs a full signature check, after
+// which the broker issues a new one.
+func (c *MCPClient) currentSession() string {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	return c.session
+}
+
+// negotiateCodec switches to MessagePack, or CBOR if preferred, when the
+// broker advertises support
+func (c *MCPClient) negotiateCodec(advertised string) {
+	if c.jsonOnly || advertised == "" {
+		return
+	}
+
+	supported := make(map[protocol.Codec]bool)
+	for _, contentType := range strings.Split(advertised, ",") {
+		supported[protocol.CodecForContentType(strings.TrimSpace(contentType))] = true
+	}
+
+	codec := protocol.JSONCodec
+	switch {
+	case c.preferCBOR && supported[protocol.CBORCodec]:
+		codec = protocol.CBORCodec
+	case supported[protocol.MsgPackCodec]:
+		codec = protocol.MsgPackCodec
+	}
+
+	c.codecMutex.Lock()
+	c.codec = codec
+	c.codecMutex.Unlock()
 }
 
 // Cache management methods
@@ -251,6 +772,9 @@ func (c *MCPClient) buildCacheKey(query protocol.ToolQuery) string {
 		query.EnvironmentType, 
 		query.Capabilities, 
 		query.MaxResults)
+	if query.Federated {
+		key += ",federated"
+	}
 	return key
 }
 
@@ -291,8 +815,16 @@ func (c *MCPClient) generateRequestID() string {
 	return fmt.Sprintf("%s-req-%d", c.agentID, c.requestID)
 }
 
-func (c *MCPClient) generateNonce() string {
-	return fmt.Sprintf("%s-%d", c.agentID, time.Now().UnixNano())
+// nextSequence returns the next ordered-delivery sequence number for calls
+// to agentID, or 0 when calls are not ordered
+func (c *MCPClient) nextSequence(agentID string) uint64 {
+	if !c.ordered || agentID == "" {
+		return 0
+	}
+	c.sequenceMutex.Lock()
+	defer c.sequenceMutex.Unlock()
+	c.sequences[agentID]++
+	return c.sequences[agentID]
 }
 
 // GetCacheStats returns statistics about the tool cache
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// errBrokerUnreachable marks requests that never reached the broker, which
+// are the ones worth failing over for
+var errBrokerUnreachable = errors.New("broker unreachable")
+
+// brokerHealthTimeout bounds each health check made while failing over
+const brokerHealthTimeout = 2 * time.Second
+
+// currentBroker returns the URL of the broker in use
+func (c *MCPClient) currentBroker() string {
+	c.brokerMutex.RLock()
+	defer c.brokerMutex.RUnlock()
+	return c.brokerURL
+}
+
+// Register registers the agent with the broker. The registration is
+// remembered and repeated on any broker the client fails over to. A broker
+// holding the registration for approval returns
+// protocol.ErrRegistrationPending; the registration takes effect once an
+// operator approves it.
+func (c *MCPClient) Register(body protocol.RegisterAgentBody) error {
+	err := c.register(c.currentBroker(), body)
+	if err != nil && !errors.Is(err, protocol.ErrRegistrationPending) {
+		return err
+	}
+
+	c.brokerMutex.Lock()
+	c.registration = &body
+	c.brokerMutex.Unlock()
+	return err
+}
+
+// register sends a fresh registerAgent envelope to one broker. A broker
+// that challenges the registration is sent it again with the challenge
+// signed by the agent's key. A registration waiting for an operator's
+// approval returns protocol.ErrRegistrationPending.
+func (c *MCPClient) register(brokerURL string, body protocol.RegisterAgentBody) error {
+	payload, err := c.sendRegistration(brokerURL, body)
+	if err != nil {
+		return err
+	}
+
+	var challenge protocol.RegistrationChallenge
+	json.Unmarshal(payload, &challenge)
+	if challenge.Status == protocol.StatusChallenge {
+		body.Challenge = challenge.Challenge
+		if body.ChallengeSig, err = protocol.SignKeyProofWith(c.agentID, challenge.Challenge, c.signer); err != nil {
+			return fmt.Errorf("failed to sign key proof: %w", err)
+		}
+		if payload, err = c.sendRegistration(brokerURL, body); err != nil {
+			return err
+		}
+		challenge = protocol.RegistrationChallenge{}
+		json.Unmarshal(payload, &challenge)
+	}
+	if challenge.Status == protocol.StatusPendingApproval {
+		return protocol.ErrRegistrationPending
+	}
+	return nil
+}
+
+// sendRegistration sends one registerAgent envelope and returns the
+// broker's response
+func (c *MCPClient) sendRegistration(brokerURL string, body protocol.RegisterAgentBody) ([]byte, error) {
+	registration := &protocol.RegisterAgentEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{
+			Type: protocol.EnvelopeRegisterAgent,
+			CommonHeaders: protocol.CommonHeaders{
+				Agent: c.agentID,
+				TS:    time.Now().UnixMilli(),
+				Nonce: protocol.NewNonce(),
+			},
+		},
+		Body: body,
+	}
+	if err := protocol.SignEnvelope(registration, c.signer); err != nil {
+		return nil, fmt.Errorf("failed to sign registration: %w", err)
+	}
+
+	data, err := json.Marshal(registration)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := c.post(brokerURL, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register with %s: %w", brokerURL, err)
+	}
+	return payload, nil
+}
+
+// failover switches from the unreachable broker failed to the first other
+// broker, in order of preference, that passes a health check and accepts
+// the agent's registration. It returns the broker now in use.
+func (c *MCPClient) failover(failed string) (string, error) {
+	c.brokerMutex.RLock()
+	current := c.brokerURL
+	candidates := append([]string(nil), c.brokerURLs...)
+	registration := c.registration
+	c.brokerMutex.RUnlock()
+
+	// Another request may already have failed over
+	if current != failed {
+		return current, nil
+	}
+
+	for _, candidate := range candidates {
+		if candidate == failed || !c.brokerHealthy(candidate) {
+			continue
+		}
+		if err := c.switchBroker(candidate, registration); err != nil {
+			slog.Warn("Failover failed", "broker", candidate, "error", err)
+			continue
+		}
+
+		slog.Warn("Broker unreachable, failed over", "failed", failed, "broker", candidate)
+		if c.onFailover != nil {
+			c.onFailover(candidate)
+		}
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("no healthy broker to fail over to from %s", failed)
+}
+
+// brokerDrainingError is a draining broker's refusal of an envelope, naming
+// the broker to move to
+type brokerDrainingError struct {
+	successor string
+}
+
+func (e *brokerDrainingError) Error() string {
+	return fmt.Sprintf("broker is draining; its successor is %s", e.successor)
+}
+
+// redirect moves from the draining broker to the successor it named,
+// repeating the agent's registration there. The successor becomes the
+// preferred broker. It returns the broker now in use.
+func (c *MCPClient) redirect(draining, successor string) (string, error) {
+	c.brokerMutex.RLock()
+	current := c.brokerURL
+	registration := c.registration
+	c.brokerMutex.RUnlock()
+
+	// Another request may already have moved
+	if current != draining {
+		return current, nil
+	}
+	if err := c.switchBroker(successor, registration); err != nil {
+		slog.Warn("Failed to move to successor broker", "draining", draining, "successor", successor, "error", err)
+		return "", err
+	}
+
+	c.brokerMutex.Lock()
+	urls := []string{successor}
+	for _, brokerURL := range c.brokerURLs {
+		if brokerURL != successor {
+			urls = append(urls, brokerURL)
+		}
+	}
+	c.brokerURLs = urls
+	c.brokerMutex.Unlock()
+
+	slog.Info("Broker draining, moved to successor", "draining", draining, "broker", successor)
+	if c.onFailover != nil {
+		c.onFailover(successor)
+	}
+	return successor, nil
+}
+
+// switchBroker makes brokerURL the broker in use, registering there first
+// if the agent has registered
+func (c *MCPClient) switchBroker(brokerURL string, registration *protocol.RegisterAgentBody) error {
+	// The new broker may not speak the codec negotiated with the old one
+	c.codecMutex.Lock()
+	c.codec = protocol.JSONCodec
+	c.codecMutex.Unlock()
+
+	if registration != nil {
+		if err := c.register(brokerURL, *registration); err != nil {
+			return err
+		}
+	}
+
+	c.brokerMutex.Lock()
+	c.brokerURL = brokerURL
+	c.brokerMutex.Unlock()
+	return nil
+}
+
+// brokerHealthy reports whether a broker answers its health check
+func (c *MCPClient) brokerHealthy(brokerURL string) bool {
+	healthURL, err := url.Parse(brokerURL)
+	if err != nil {
+		return false
+	}
+	healthURL.Path = strings.TrimSuffix(healthURL.Path, "/") + "/health"
+
+	client := *c.httpClient
+	client.Timeout = brokerHealthTimeout
+	resp, err := client.Get(healthURL.String())
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestMCPClientFailover(t *testing.T) {
+	primary := NewBroker()
+	primaryServer := httptest.NewTLSServer(primary)
+	defer primaryServer.Close()
+
+	backup := NewBroker()
+	backupServer := httptest.NewTLSServer(backup)
+	defer backupServer.Close()
+
+	// Unreachable, so skipped by the health check
+	downServer := httptest.NewTLSServer(NewBroker())
+	downServer.Close()
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	var failedOver []string
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:      "roaming-agent",
+		BrokerURL:    primaryServer.URL,
+		FailoverURLs: []string{downServer.URL, backupServer.URL},
+		PrivateKey:   privKey,
+		TLSInsecure:  true,
+		OnFailover:   func(brokerURL string) { failedOver = append(failedOver, brokerURL) },
+	})
+
+	err = client.Register(protocol.RegisterAgentBody{
+		PubKey:       protocol.EncodePublicKey(pubKey),
+		Capabilities: []string{"roaming"},
+	})
+	if err != nil {
+		t.Fatalf("Registration failed: %v", err)
+	}
+	if _, exists := primary.agents["roaming-agent"]; !exists {
+		t.Fatal("Expected agent to be registered with the primary broker")
+	}
+
+	primaryServer.Close()
+
+	// The heartbeat fails over and the registration is repeated on the backup
+	if _, err := client.Heartbeat("ok"); err != nil {
+		t.Fatalf("Heartbeat after losing the primary failed: %v", err)
+	}
+	if client.currentBroker() != backupServer.URL {
+		t.Errorf("Expected client to use %s, got %s", backupServer.URL, client.currentBroker())
+	}
+	if _, exists := backup.agents["roaming-agent"]; !exists {
+		t.Error("Expected agent to be registered with the backup broker")
+	}
+	if len(failedOver) != 1 || failedOver[0] != backupServer.URL {
+		t.Errorf("Expected one failover to %s, got %v", backupServer.URL, failedOver)
+	}
+
+	// With every broker gone, requests fail
+	backupServer.Close()
+	if _, err := client.Heartbeat("ok"); err == nil {
+		t.Error("Expected heartbeat to fail with no broker reachable")
+	}
+}
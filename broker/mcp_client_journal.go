@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultJournalTTL is how long a journaled envelope stays worth delivering
+// when neither the client nor the sender sets a TTL
+const defaultJournalTTL = 24 * time.Hour
+
+// journalFile is the file holding the journal within its directory
+const journalFile = "outbox.jsonl"
+
+// ErrJournaled is returned by Send when no broker could be reached and the
+// envelope was journaled for delivery once one can be
+var ErrJournaled = errors.New("broker unreachable; envelope journaled")
+
+// journalEntry is one envelope awaiting delivery, stored as a line of JSON
+type journalEntry struct {
+	Type     protocol.EnvelopeType `json:"type"`
+	Key      string                `json:"key"`
+	Queued   time.Time             `json:"queued"`
+	Expires  time.Time             `json:"expires"`
+	Envelope json.RawMessage       `json:"envelope"`
+}
+
+// envelopeJournal keeps envelopes a client could not deliver in an
+// append-only file, in the order they were sent, so they survive a restart
+// of the agent. The client's journalMutex guards it.
+type envelopeJournal struct {
+	path    string
+	entries []journalEntry
+	loaded  bool
+}
+
+// newEnvelopeJournal creates a journal kept in dir. Nothing is read or
+// written until the journal is first used.
+func newEnvelopeJournal(dir string) *envelopeJournal {
+	return &envelopeJournal{path: filepath.Join(dir, journalFile)}
+}
+
+// load reads the entries left by an earlier run, once. A line that cannot
+// be decoded, such as one cut short by a crash, is skipped.
+func (j *envelopeJournal) load() error {
+	if j.loaded {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		j.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("Skipping unreadable journal entry", "path", j.path, "error", err)
+			continue
+		}
+		j.entries = append(j.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	j.loaded = true
+	return nil
+}
+
+// holds reports whether an entry with key is awaiting delivery
+func (j *envelopeJournal) holds(key string) bool {
+	for _, entry := range j.entries {
+		if entry.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// append adds an entry to the end of the journal, syncing it to disk
+func (j *envelopeJournal) append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+// rewrite replaces the journal with the given entries
+func (j *envelopeJournal) rewrite(entries []journalEntry) error {
+	if len(entries) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		j.entries = nil
+		return nil
+	}
+
+	temp := j.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err = encoder.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, j.path); err != nil {
+		return err
+	}
+	j.entries = entries
+	return nil
+}
+
+// Send delivers a signed envelope to the broker, returning the response. If
+// the client has a journal and no broker can be reached, the envelope is
+// journaled and ErrJournaled returned; journaled envelopes are replayed in
+// order before anything else is sent. A journaled envelope is dropped once
+// ttl has passed (zero for the client's JournalTTL). Envelopes sharing an
+// idempotency key are journaled once; an empty key uses the envelope's nonce.
+//
+// Send suits envelopes that need no answer to be useful later, such as
+// events; a tool call replayed after its caller gave up only wastes work.
+func (c *MCPClient) Send(envelope interface{}, ttl time.Duration, key string) (map[string]interface{}, error) {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	if c.journal == nil {
+		return decodeResponse(c.sendData(data))
+	}
+
+	c.journalMutex.Lock()
+	defer c.journalMutex.Unlock()
+
+	if err := c.journal.load(); err != nil {
+		return nil, fmt.Errorf("failed to load journal: %w", err)
+	}
+	if len(c.journal.entries) > 0 {
+		c.flushJournal()
+	}
+	if len(c.journal.entries) == 0 {
+		payload, err := c.sendData(data)
+		if !errors.Is(err, errBrokerUnreachable) {
+			return decodeResponse(payload, err)
+		}
+	}
+
+	var headers protocol.BaseEnvelope
+	if err := json.Unmarshal(data, &headers); err != nil {
+		return nil, fmt.Errorf("failed to read envelope headers: %w", err)
+	}
+	if key == "" {
+		key = headers.Nonce
+	}
+	if c.journal.holds(key) {
+		return nil, ErrJournaled
+	}
+	if ttl <= 0 {
+		ttl = c.journalTTL
+	}
+	now := time.Now()
+	entry := journalEntry{
+		Type:     headers.Type,
+		Key:      key,
+		Queued:   now,
+		Expires:  now.Add(ttl),
+		Envelope: data,
+	}
+	if err := c.journal.append(entry); err != nil {
+		return nil, fmt.Errorf("broker unreachable and journaling failed: %w", err)
+	}
+	slog.Debug("Journaled envelope", "type", entry.Type, "key", key)
+	return nil, ErrJournaled
+}
+
+// EmitEvent emits an event through Send, so events raised while the broker
+// is unreachable are delivered once it is back
+func (c *MCPClient) EmitEvent(event string, payload map[string]interface{}) error {
+	envelope := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, c.agentID)
+	body, err := json.Marshal(protocol.EmitEventBody{Event: event, Payload: payload})
+	if err != nil {
+		return err
+	}
+	envelope.Body = body
+	if err := protocol.SignEnvelope(envelope, c.signer); err != nil {
+		return fmt.Errorf("failed to sign event: %w", err)
+	}
+	_, err = c.Send(envelope, 0, "")
+	return err
+}
+
+// JournalLength returns the number of envelopes awaiting delivery
+func (c *MCPClient) JournalLength() (int, error) {
+	if c.journal == nil {
+		return 0, nil
+	}
+	c.journalMutex.Lock()
+	defer c.journalMutex.Unlock()
+	if err := c.journal.load(); err != nil {
+		return 0, err
+	}
+	return len(c.journal.entries), nil
+}
+
+// FlushJournal replays journaled envelopes in order, returning how many the
+// broker accepted. It stops at the first that cannot be delivered yet.
+func (c *MCPClient) FlushJournal() (int, error) {
+	if c.journal == nil {
+		return 0, nil
+	}
+	c.journalMutex.Lock()
+	defer c.journalMutex.Unlock()
+	if err := c.journal.load(); err != nil {
+		return 0, fmt.Errorf("failed to load journal: %w", err)
+	}
+	return c.flushJournal()
+}
+
+// ReplayJournal flushes the journal on each interval until stop is closed,
+// so journaled envelopes are delivered soon after the broker is back even
+// if nothing new is sent
+func (c *MCPClient) ReplayJournal(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.FlushJournal(); err != nil {
+				slog.Debug("Journal not flushed", "error", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// restamp sets a journaled envelope's ts to now and signs it again,
+// keeping its nonce
+func (c *MCPClient) restamp(data []byte) ([]byte, error) {
+	envelope, err := protocol.ParseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	envelope.TS = time.Now().UnixMilli()
+	if envelope.Sig != "" {
+		if err := protocol.SignEnvelope(envelope, c.signer); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(envelope)
+}
+
+// flushJournal replays the journal with journalMutex held. Expired entries
+// are dropped, as are entries the broker refuses outright. An entry the
+// broker has already seen, whose response was lost, counts as delivered.
+// Replay stops at an entry the broker cannot take yet, keeping it and
+// those after it.
+func (c *MCPClient) flushJournal() (int, error) {
+	entries := c.journal.entries
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	delivered := 0
+	var stopErr error
+	var next int
+	for next = 0; next < len(entries); next++ {
+		entry := entries[next]
+		if !entry.Expires.After(now) {
+			slog.Info("Dropping expired journaled envelope", "type", entry.Type, "key", entry.Key, "queued", entry.Queued)
+			continue
+		}
+
+		// Brokers refuse envelopes stamped too long ago; the nonce still
+		// marks an envelope the broker has already seen
+		data, err := c.restamp(entry.Envelope)
+		if err != nil {
+			slog.Warn("Dropping journaled envelope that cannot be signed again", "type", entry.Type, "key", entry.Key, "error", err)
+			continue
+		}
+		_, err = c.sendData(data)
+		var status *brokerStatusError
+		switch {
+		case err == nil:
+			delivered++
+		case errors.As(err, &status) && status.status == http.StatusConflict:
+			delivered++
+		case isDeliveryFailure(err):
+			stopErr = err
+		default:
+			slog.Warn("Dropping journaled envelope the broker refused", "type", entry.Type, "key", entry.Key, "error", err)
+		}
+		if stopErr != nil {
+			break
+		}
+	}
+
+	if err := c.journal.rewrite(entries[next:]); err != nil {
+		return delivered, fmt.Errorf("failed to rewrite journal: %w", err)
+	}
+	return delivered, stopErr
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestMCPClientJournal(t *testing.T) {
+	// Records the events the broker accepts, in order
+	var events []string
+	broker := NewBroker()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		recorder := newBufferedResponse()
+		broker.ServeHTTP(recorder, r)
+		var env protocol.GenericEnvelope
+		var body protocol.EmitEventBody
+		if json.Unmarshal(data, &env) == nil && env.GetBodyAs(&body) == nil && recorder.status == http.StatusOK {
+			events = append(events, body.Event)
+		}
+		w.WriteHeader(recorder.status)
+		w.Write(recorder.body.Bytes())
+	}))
+	defer server.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	dir := t.TempDir()
+	_, privKey, _ := protocol.GenerateKeyPair()
+	config := MCPClientConfig{
+		AgentID:    "field-agent",
+		BrokerURL:  down.URL,
+		PrivateKey: privKey,
+		JournalDir: dir,
+	}
+	client := NewMCPClient(config)
+
+	for _, event := range []string{"reading.1", "reading.2"} {
+		if err := client.EmitEvent(event, nil); !errors.Is(err, ErrJournaled) {
+			t.Fatalf("Expected %s to be journaled, got %v", event, err)
+		}
+	}
+
+	// Envelopes sharing an idempotency key are journaled once
+	for i := 0; i < 2; i++ {
+		envelope := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "field-agent")
+		envelope.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "reading.3"})
+		envelope.Sign(privKey)
+		if _, err := client.Send(envelope, 0, "reading-3"); !errors.Is(err, ErrJournaled) {
+			t.Fatalf("Expected the envelope to be journaled, got %v", err)
+		}
+	}
+
+	// An envelope whose TTL passes before the broker is back is dropped
+	expiring := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "field-agent")
+	expiring.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "stale"})
+	expiring.Sign(privKey)
+	if _, err := client.Send(expiring, time.Millisecond, ""); !errors.Is(err, ErrJournaled) {
+		t.Fatalf("Expected the envelope to be journaled, got %v", err)
+	}
+
+	// The journal outlives the client
+	restarted := NewMCPClient(config)
+	if length, err := restarted.JournalLength(); err != nil || length != 4 {
+		t.Fatalf("Expected 4 journaled envelopes after a restart, got %d (%v)", length, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// On reconnection the journal is replayed in order before new envelopes
+	restarted.brokerURL = server.URL
+	if err := restarted.EmitEvent("reading.4", nil); err != nil {
+		t.Fatalf("Expected the event to be delivered, got %v", err)
+	}
+	want := []string{"reading.1", "reading.2", "reading.3", "reading.4"}
+	if len(events) != len(want) {
+		t.Fatalf("Expected events %v, got %v", want, events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Expected events %v, got %v", want, events)
+			break
+		}
+	}
+	if length, _ := restarted.JournalLength(); length != 0 {
+		t.Errorf("Expected an empty journal, got %d entries", length)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the journal file to be removed once flushed, got %v", err)
+	}
+}
+
+func TestMCPClientJournalReplayedEnvelope(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	pubKey, privKey, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:    "field-agent",
+		BrokerURL:  server.URL,
+		PrivateKey: privKey,
+		JournalDir: t.TempDir(),
+	})
+
+	// An envelope whose response was lost is journaled, but the broker has
+	// already seen it, so replaying it counts as delivered
+	envelope := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "field-agent")
+	envelope.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "reading.1"})
+	envelope.Sign(privKey)
+	if _, err := client.Send(envelope, 0, ""); err != nil {
+		t.Fatalf("Expected the event to be delivered, got %v", err)
+	}
+	data, _ := json.Marshal(envelope)
+	client.journal.load()
+	client.journal.append(journalEntry{Type: envelope.Type, Key: envelope.Nonce, Expires: time.Now().Add(time.Hour), Envelope: data})
+
+	// A journaled envelope the broker refuses is dropped rather than retried
+	refused := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "field-agent")
+	refused.Body, _ = json.Marshal(protocol.EmitEventBody{})
+	refused.Sign(privKey)
+	data, _ = json.Marshal(refused)
+	client.journal.append(journalEntry{Type: refused.Type, Key: refused.Nonce, Expires: time.Now().Add(time.Hour), Envelope: data})
+
+	// An envelope journaled long ago is stamped and signed again, keeping
+	// its nonce, so the broker does not refuse it as stale
+	stale := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "field-agent")
+	stale.TS = time.Now().Add(-time.Hour).UnixMilli()
+	stale.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "reading.2"})
+	stale.Sign(privKey)
+	data, _ = json.Marshal(stale)
+	client.journal.append(journalEntry{Type: stale.Type, Key: stale.Nonce, Expires: time.Now().Add(time.Hour), Envelope: data})
+	restamped, err := client.restamp(data)
+	if err != nil {
+		t.Fatalf("restamp: %v", err)
+	}
+	if env, _ := protocol.ParseEnvelope(restamped); env.Nonce != stale.Nonce || checkClockSkew(env.TS, time.Now()) != nil || env.VerifyKey(pubKey) != nil {
+		t.Errorf("Expected a fresh, signed envelope with the same nonce, got %s", restamped)
+	}
+
+	delivered, err := client.FlushJournal()
+	if err != nil || delivered != 2 {
+		t.Errorf("Expected 2 envelopes delivered, got %d (%v)", delivered, err)
+	}
+	if length, _ := client.JournalLength(); length != 0 {
+		t.Errorf("Expected an empty journal, got %d entries", length)
+	}
+}
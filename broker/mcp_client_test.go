@@ -1,7 +1,15 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -110,6 +118,14 @@ func TestMCPClientCacheKey(t *testing.T) {
 			},
 			expected: "env:,caps:[],max:0",
 		},
+		{
+			name: "Federated query",
+			query: protocol.ToolQuery{
+				Capabilities: []string{"math.*"},
+				Federated:    true,
+			},
+			expected: "env:,caps:[math.*],max:0,federated",
+		},
 	}
 
 	for _, tt := range tests {
@@ -364,8 +380,31 @@ func TestMCPClientCacheRefresh(t *testing.T) {
 }
 
 func TestMCPClientToolCallFormat(t *testing.T) {
-	// Create test broker that logs tool calls
+	// Fake agent MCP server that adds two numbers
+	var received map[string]interface{}
+	mcpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+		params := received["params"].(map[string]interface{})
+		args := params["arguments"].(map[string]interface{})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"result":  map[string]interface{}{"sum": args["a"].(float64) + args["b"].(float64)},
+			"id":      received["id"],
+		})
+	}))
+	defer mcpServer.Close()
+
 	broker := NewBroker()
+	broker.mcpRegistry.RegisterAgent("math-agent", &MCPAgent{
+		ID:              "math-agent",
+		MCPEndpoint:     mcpServer.URL,
+		EnvironmentType: "test",
+		Tools:           []protocol.MCPTool{{Name: "add", Description: "Add two numbers"}},
+		LastHeartbeat:   time.Now(),
+	})
 	server := httptest.NewTLSServer(broker)
 	defer server.Close()
 
@@ -381,30 +420,319 @@ func TestMCPClientToolCallFormat(t *testing.T) {
 		TLSInsecure: true,
 	})
 
-	// Test tool call (will fail but we're testing the format)
 	parameters := map[string]interface{}{
 		"a": 5,
 		"b": 3,
 	}
 
 	result, err := client.CallTool("math-agent", "add", parameters)
-	
-	// We expect this to return a "processing" status from our broker
 	if err != nil {
 		t.Fatalf("Tool call failed: %v", err)
 	}
 
-	// Check result format
-	if result == nil {
-		t.Fatal("Expected result, got nil")
+	// Check the call was forwarded as an MCP tools/call request
+	if received["method"] != "tools/call" {
+		t.Errorf("Expected method 'tools/call', got %v", received["method"])
+	}
+	if params := received["params"].(map[string]interface{}); params["name"] != "add" {
+		t.Errorf("Expected tool name 'add', got %v", params["name"])
 	}
 
 	resultMap, ok := result.(map[string]interface{})
 	if !ok {
-		t.Fatal("Expected result to be a map")
+		t.Fatalf("Expected result to be a map, got %T", result)
+	}
+
+	if sum, ok := resultMap["sum"].(float64); !ok || sum != 8 {
+		t.Errorf("Expected sum 8, got %v", resultMap["sum"])
+	}
+
+	// Unknown tools are rejected by the broker
+	if _, err := client.CallTool("math-agent", "subtract", parameters); err == nil {
+		t.Error("Expected error for unknown tool")
+	}
+}
+
+func TestBrokerToolCallErrorResult(t *testing.T) {
+	mcpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"error":   map[string]interface{}{"code": -32603, "message": "division by zero"},
+			"id":      1,
+		})
+	}))
+	defer mcpServer.Close()
+
+	broker := NewBroker()
+	broker.mcpRegistry.RegisterAgent("math-agent", &MCPAgent{
+		ID:          "math-agent",
+		MCPEndpoint: mcpServer.URL,
+		Tools:       []protocol.MCPTool{{Name: "math.divide"}},
+	})
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall},
+	}
+	env.Agent = "caller-agent"
+	env.Body, _ = json.Marshal(protocol.ToolCallBody{
+		Tool:       "math.divide",
+		Parameters: map[string]interface{}{"a": 1, "b": 0},
+		RequestID:  "req-42",
+	})
+
+	recorder := newBufferedResponse()
+	broker.handleToolCall(recorder, env)
+
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+
+	var result protocol.ToolResultEnvelope
+	if err := json.Unmarshal(recorder.body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode tool result: %v", err)
+	}
+
+	if result.Type != protocol.EnvelopeToolResult || result.Agent != broker.id {
+		t.Errorf("Unexpected envelope headers: %s from %s", result.Type, result.Agent)
+	}
+	if result.Body.RequestID != "req-42" || result.Body.Success {
+		t.Errorf("Unexpected tool result body: %+v", result.Body)
+	}
+	if !strings.Contains(result.Body.Error, "division by zero") {
+		t.Errorf("Expected MCP error to be reported, got %q", result.Body.Error)
+	}
+}
+
+func TestMCPClientCodecNegotiation(t *testing.T) {
+	broker := NewBroker()
+	broker.mcpRegistry.RegisterAgent("math-agent", &MCPAgent{
+		ID:              "math-agent",
+		MCPEndpoint:     "http://localhost:8080",
+		EnvironmentType: "test",
+		Tools:           []protocol.MCPTool{{Name: "math.add", Description: "Add two numbers"}},
+		LastHeartbeat:   time.Now(),
+	})
+
+	var contentTypes []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		broker.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	_, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
 	}
 
-	if status, ok := resultMap["status"].(string); !ok || status != "processing" {
-		t.Errorf("Expected status 'processing', got %v", resultMap["status"])
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "client-test",
+		BrokerURL:   server.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+
+	if client.currentCodec() != protocol.JSONCodec {
+		t.Fatal("Expected client to start with JSON")
 	}
-}
\ No newline at end of file
+
+	for i := 0; i < 2; i++ {
+		tools, err := client.FindToolsByCapability([]string{"math.*"})
+		if err != nil {
+			t.Fatalf("Discovery %d failed: %v", i, err)
+		}
+		if len(tools) != 1 || tools[0].MCPTools[0].Name != "math.add" {
+			t.Errorf("Unexpected discovery result %d: %+v", i, tools)
+		}
+		client.RefreshCache()
+	}
+
+	if len(contentTypes) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(contentTypes))
+	}
+	if contentTypes[0] != protocol.ContentTypeJSON || contentTypes[1] != protocol.ContentTypeMsgPack {
+		t.Errorf("Expected JSON then MessagePack requests, got %v", contentTypes)
+	}
+
+	jsonClient := NewMCPClient(MCPClientConfig{
+		AgentID:        "client-json",
+		BrokerURL:      server.URL,
+		PrivateKey:     privKey,
+		TLSInsecure:    true,
+		DisableMsgPack: true,
+	})
+	if _, err := jsonClient.FindToolsByCapability([]string{"math.*"}); err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	if jsonClient.currentCodec() != protocol.JSONCodec {
+		t.Error("Expected client with DisableMsgPack to stay on JSON")
+	}
+
+	cborClient := NewMCPClient(MCPClientConfig{
+		AgentID:     "client-cbor",
+		BrokerURL:   server.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+		PreferCBOR:  true,
+	})
+	for i := 0; i < 2; i++ {
+		tools, err := cborClient.FindToolsByCapability([]string{"math.*"})
+		if err != nil {
+			t.Fatalf("CBOR discovery %d failed: %v", i, err)
+		}
+		if len(tools) != 1 || tools[0].MCPTools[0].Name != "math.add" {
+			t.Errorf("Unexpected CBOR discovery result %d: %+v", i, tools)
+		}
+		cborClient.RefreshCache()
+	}
+	if last := contentTypes[len(contentTypes)-1]; last != protocol.ContentTypeCBOR {
+		t.Errorf("Expected client preferring CBOR to send CBOR, got %s", last)
+	}
+}
+
+func TestMCPClientPing(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "ping-agent",
+		BrokerURL:   server.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+
+	// Unregistered agents get an unverified pong
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	broker.agents["ping-agent"] = &Agent{ID: "ping-agent", PubKey: pubKey, RegisteredAt: time.Now()}
+
+	// The second ping travels as MessagePack once the codec is negotiated
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatalf("Ping from registered agent failed: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("Expected positive round-trip time, got %v", rtt)
+	}
+
+	// A ping signed with the wrong key is rejected
+	_, otherKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	impostor := NewMCPClient(MCPClientConfig{
+		AgentID:     "ping-agent",
+		BrokerURL:   server.URL,
+		PrivateKey:  otherKey,
+		TLSInsecure: true,
+	})
+	if _, err := impostor.Ping(); err == nil {
+		t.Error("Expected ping with wrong signature to fail")
+	}
+}
+
+func TestMCPClientSigner(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	pubKey, privKey, _ := protocol.GenerateKeyPair()
+	broker.agents["kms-agent"] = &Agent{ID: "kms-agent", PubKey: pubKey, RegisteredAt: time.Now()}
+
+	// The client never holds the key, only a way to have it sign
+	var signed int
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:   "kms-agent",
+		BrokerURL: server.URL,
+		Signer: &protocol.RemoteSigner{PublicKey: pubKey, SignFunc: func(message []byte, _ crypto.SignerOpts) ([]byte, error) {
+			signed++
+			return ed25519.Sign(privKey, message), nil
+		}},
+		TLSInsecure: true,
+	})
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Ping signed by the remote key failed: %v", err)
+	}
+	if _, err := client.EventStreamRequest(); err != nil || signed != 2 {
+		t.Errorf("Expected the event stream request signed remotely, got %v after %d signatures", err, signed)
+	}
+}
+
+func TestMCPClientP256Agent(t *testing.T) {
+	broker := NewBroker()
+	broker.SetRequireKeyProof(true)
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	// A hardware-backed key, as a Secure Enclave or TPM would hold
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pubKey, _ := protocol.FormatPublicKey(&key.PublicKey)
+	client := NewMCPClient(MCPClientConfig{AgentID: "enclave-agent", BrokerURL: server.URL, Signer: key, TLSInsecure: true})
+
+	if err := client.Register(protocol.RegisterAgentBody{PubKey: pubKey, Capabilities: []string{"sensor.read"}}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	agent, registered := broker.agents["enclave-agent"]
+	if !registered || !agent.PubKey.Equal(&key.PublicKey) {
+		t.Fatalf("Expected the agent registered with its P-256 key, got %+v", agent)
+	}
+	if _, err := client.Ping(); err != nil {
+		t.Errorf("Ping signed with ES256 failed: %v", err)
+	}
+
+	// The key survives storage
+	data, _ := json.Marshal(agent)
+	var stored Agent
+	if err := json.Unmarshal(data, &stored); err != nil || !stored.PubKey.Equal(&key.PublicKey) {
+		t.Errorf("Expected the key to round-trip through storage, got %v", err)
+	}
+}
+
+func TestBrokerPingEcho(t *testing.T) {
+	broker := NewBroker()
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	broker.agents["echo-agent"] = &Agent{ID: "echo-agent", PubKey: pubKey}
+
+	ping := protocol.NewPing("echo-agent", "payload-123")
+	if err := ping.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign ping: %v", err)
+	}
+	data, _ := json.Marshal(ping)
+	env, err := protocol.ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse ping: %v", err)
+	}
+
+	recorder := newBufferedResponse()
+	broker.dispatchEnvelope(recorder, env)
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+
+	var pong protocol.PongEnvelope
+	if err := json.Unmarshal(recorder.body.Bytes(), &pong); err != nil {
+		t.Fatalf("Failed to decode pong: %v", err)
+	}
+
+	if pong.Type != protocol.EnvelopePong || pong.Agent != broker.id {
+		t.Errorf("Unexpected pong headers: %s from %s", pong.Type, pong.Agent)
+	}
+	if pong.Body.PingNonce != ping.Nonce || pong.Body.PingTS != ping.TS || pong.Body.Payload != "payload-123" {
+		t.Errorf("Pong does not echo ping: %+v", pong.Body)
+	}
+	if !pong.Body.SignatureVerified {
+		t.Error("Expected ping signature to be verified")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 type MCPRegistry struct {
 	tools  map[string]*RegisteredTool
 	agents map[string]*MCPAgent
+	index  *discoveryIndex
 	mu     sync.RWMutex
 }
 
@@ -21,8 +23,10 @@ type RegisteredTool struct {
 	Tool            protocol.MCPTool
 	MCPEndpoint     string
 	EnvironmentType string
+	Proxy           string // Discovery proxy relaying calls to the agent
 	RegisteredAt    time.Time
 	LastSeen        time.Time
+	Stale           bool `json:"-"` // Agent missed its heartbeats; hidden from discovery
 }
 
 // MCPAgent represents an agent with MCP capabilities
@@ -32,6 +36,7 @@ type MCPAgent struct {
 	BodyDefinition  *protocol.BodyDefinition
 	EnvironmentType string
 	Tools           []protocol.MCPTool
+	DiscoveryProxy  string
 	LastHeartbeat   time.Time
 }
 
@@ -40,6 +45,7 @@ func NewMCPRegistry() *MCPRegistry {
 	return &MCPRegistry{
 		tools:  make(map[string]*RegisteredTool),
 		agents: make(map[string]*MCPAgent),
+		index:  newDiscoveryIndex(),
 	}
 }
 
@@ -52,15 +58,17 @@ func (r *MCPRegistry) RegisterAgent(agentID string, agent *MCPAgent) error {
 
 	// Index all tools for discovery
 	for _, tool := range agent.Tools {
-		toolKey := fmt.Sprintf("%s/%s", agentID, tool.Name)
-		r.tools[toolKey] = &RegisteredTool{
+		key := toolKey(agentID, tool.Name)
+		r.tools[key] = &RegisteredTool{
 			AgentID:         agentID,
 			Tool:            tool,
 			MCPEndpoint:     agent.MCPEndpoint,
 			EnvironmentType: agent.EnvironmentType,
+			Proxy:           agent.DiscoveryProxy,
 			RegisteredAt:    time.Now(),
 			LastSeen:        time.Now(),
 		}
+		r.index.put(key, r.tools[key])
 	}
 
 	return nil
@@ -86,6 +94,24 @@ func (r *MCPRegistry) ListTools() []*RegisteredTool {
 	return tools
 }
 
+// AgentTools returns the indexed tools offered by an agent
+func (r *MCPRegistry) AgentTools(agentID string) []*RegisteredTool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.index.agentTools(agentID)
+}
+
+// RestoreTool puts a previously indexed tool back into the index,
+// keeping its original registration time
+func (r *MCPRegistry) RestoreTool(tool *RegisteredTool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := toolKey(tool.AgentID, tool.Tool.Name)
+	r.tools[key] = tool
+	r.index.put(key, tool)
+}
+
 // UnregisterAgent removes an agent and all its tools
 func (r *MCPRegistry) UnregisterAgent(agentID string) {
 	r.mu.Lock()
@@ -95,94 +121,152 @@ func (r *MCPRegistry) UnregisterAgent(agentID string) {
 	delete(r.agents, agentID)
 
 	// Remove all tools for this agent
-	for toolKey, tool := range r.tools {
-		if tool.AgentID == agentID {
-			delete(r.tools, toolKey)
+	for _, tool := range r.index.agentTools(agentID) {
+		key := toolKey(agentID, tool.Tool.Name)
+		delete(r.tools, key)
+		r.index.remove(key)
+	}
+}
+
+// RevokeTools removes an agent's tools whose names match, and the
+// capabilities of its body definition that match, from its registration
+// and the discovery index. It returns the names of the tools removed.
+func (r *MCPRegistry) RevokeTools(agentID string, matchTool, matchCapability func(name string) bool) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return nil
+	}
+
+	// The agent is replaced rather than changed, since callers of GetAgent
+	// may be reading it
+	updated := *agent
+	updated.Tools = nil
+	var revoked []string
+	for _, tool := range agent.Tools {
+		if matchTool(tool.Name) {
+			revoked = append(revoked, tool.Name)
+			key := toolKey(agentID, tool.Name)
+			delete(r.tools, key)
+			r.index.remove(key)
+			continue
 		}
+		updated.Tools = append(updated.Tools, tool)
 	}
+	if agent.BodyDefinition != nil {
+		body := *agent.BodyDefinition
+		body.MCPTools, body.Capabilities = nil, nil
+		for _, tool := range agent.BodyDefinition.MCPTools {
+			if !matchTool(tool.Name) {
+				body.MCPTools = append(body.MCPTools, tool)
+			}
+		}
+		for _, capability := range agent.BodyDefinition.Capabilities {
+			if !matchCapability(capability) {
+				body.Capabilities = append(body.Capabilities, capability)
+			}
+		}
+		updated.BodyDefinition = &body
+	}
+	r.agents[agentID] = &updated
+	return revoked
 }
 
 // DiscoverTools finds tools matching the given query
 func (r *MCPRegistry) DiscoverTools(query protocol.ToolQuery) ([]protocol.DiscoveredTool, error) {
+	return r.DiscoverToolsFor(query, "")
+}
+
+// DiscoverToolsFor finds tools matching the query that the requesting agent
+// is allowed to see. Agents always see their own tools. requester is empty
+// unless it was verified.
+func (r *MCPRegistry) DiscoverToolsFor(query protocol.ToolQuery, requester string) ([]protocol.DiscoveredTool, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	// Simple matching logic - will be enhanced in later phases
-	var matchingTools []*RegisteredTool
-
-	for _, tool := range r.tools {
-		// Match capabilities
-		if r.matchesCapabilities(tool, query.Capabilities) {
-			// Filter by environment if specified
-			if query.EnvironmentType == "" || tool.EnvironmentType == query.EnvironmentType {
-				matchingTools = append(matchingTools, tool)
-			}
-		}
+	// The index narrows the tools down by capability, environment and
+	// staleness; visibility depends on the requester and is checked per tool
+	visible := func(tool *RegisteredTool) bool {
+		return (requester != "" && tool.AgentID == requester) || tool.Tool.DiscoverableBy(requester)
 	}
+	matchingTools := r.index.query(query.Capabilities, query.EnvironmentType, visible, query.MaxResults)
 
-	// Apply max results limit
-	if query.MaxResults > 0 && len(matchingTools) > query.MaxResults {
-		matchingTools = matchingTools[:query.MaxResults]
+	if len(matchingTools) == 0 {
+		return nil, nil
 	}
 
-	// Group tools by agent
-	agentTools := make(map[string][]protocol.MCPTool)
-	agentInfo := make(map[string]*RegisteredTool)
-
-	for _, tool := range matchingTools {
-		agentTools[tool.AgentID] = append(agentTools[tool.AgentID], tool.Tool)
-		agentInfo[tool.AgentID] = tool // Store agent info
-	}
+	// Group tools by agent, in the order of each agent's first match
+	discovered := make([]protocol.DiscoveredTool, 0, len(matchingTools))
+	byAgent := make(map[string]int, len(matchingTools))
+	for _, info := range matchingTools {
+		i, seen := byAgent[info.AgentID]
+		if !seen {
+			i = len(discovered)
+			byAgent[info.AgentID] = i
+			discovered = append(discovered, protocol.DiscoveredTool{
+				AgentID:         info.AgentID,
+				MCPEndpoint:     r.listedEndpoint(info.MCPEndpoint, info.Proxy),
+				EnvironmentType: info.EnvironmentType,
+				Metadata: protocol.ToolMetadata{
+					LastSeen:            info.LastSeen.UnixMilli(),
+					AverageResponseTime: 150, // Placeholder
+					TrustScore:          0.95, // Placeholder
+				},
+				ProxiedBy: info.Proxy,
+			})
+		}
 
-	// Build discovery response
-	var discovered []protocol.DiscoveredTool
-	for agentID, tools := range agentTools {
-		info := agentInfo[agentID]
-		discovered = append(discovered, protocol.DiscoveredTool{
-			AgentID:         agentID,
-			MCPEndpoint:     info.MCPEndpoint,
-			Capabilities:    r.extractCapabilities(tools),
-			EnvironmentType: info.EnvironmentType,
-			MCPTools:        tools,
-			Metadata: protocol.ToolMetadata{
-				LastSeen:            info.LastSeen.UnixMilli(),
-				AverageResponseTime: 150, // Placeholder
-				TrustScore:          0.95, // Placeholder
-			},
-		})
+		// Allowlists are not disclosed through discovery
+		listed := info.Tool
+		listed.AllowedAgents = nil
+		discovered[i].MCPTools = append(discovered[i].MCPTools, listed)
+		discovered[i].Capabilities = append(discovered[i].Capabilities, listed.Name)
 	}
 
 	return discovered, nil
 }
 
-// matchesCapabilities checks if a tool matches any of the capability patterns
-func (r *MCPRegistry) matchesCapabilities(tool *RegisteredTool, capabilities []string) bool {
-	if len(capabilities) == 0 {
-		return true // No filter means match all
-	}
+// ListedEndpoint returns the MCP endpoint disclosed for an agent's tools
+func (r *MCPRegistry) ListedEndpoint(agent *MCPAgent) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.listedEndpoint(agent.MCPEndpoint, agent.DiscoveryProxy)
+}
 
-	toolName := tool.Tool.Name
-	for _, cap := range capabilities {
-		if r.matchCapability(toolName, cap) {
-			return true
-		}
+// listedEndpoint returns the endpoint disclosed through discovery. Proxied
+// agents are reached through their proxy's endpoint, or only through the
+// broker when the proxy is not an MCP agent; their own endpoint is never
+// listed. Caller must hold the read lock.
+func (r *MCPRegistry) listedEndpoint(endpoint, proxy string) string {
+	if proxy == "" {
+		return endpoint
+	}
+	if proxyAgent, exists := r.agents[proxy]; exists {
+		return proxyAgent.MCPEndpoint
 	}
-	return false
+	return ""
 }
 
 // matchCapability performs pattern matching for a single capability
 func (r *MCPRegistry) matchCapability(toolName, pattern string) bool {
-	// Simple pattern matching - supports wildcards like "file.*"
+	return matchPattern(toolName, pattern)
+}
+
+// matchPattern matches a dotted name against a pattern that may end in a
+// wildcard, such as "file.*"
+func matchPattern(name, pattern string) bool {
 	if pattern == "*" {
 		return true
 	}
 
 	if len(pattern) > 0 && pattern[len(pattern)-1] == '*' {
 		prefix := pattern[:len(pattern)-1]
-		return len(toolName) >= len(prefix) && toolName[:len(prefix)] == prefix
+		return len(name) >= len(prefix) && name[:len(prefix)] == prefix
 	}
 
-	return toolName == pattern
+	return name == pattern
 }
 
 // extractCapabilities extracts capability names from tools
@@ -194,6 +278,70 @@ func (r *MCPRegistry) extractCapabilities(tools []protocol.MCPTool) []string {
 	return capabilities
 }
 
+// FindToolProviders returns the registered tools matching a tool reference
+// that the caller may invoke, ordered by agent ID. The reference is either
+// "agentID/toolName", which targets a single agent, or a bare tool name
+// offered by any agent. caller is empty unless it was verified, so private
+// tools are only found for the agents their allowlist names.
+func (r *MCPRegistry) FindToolProviders(ref, caller string) []*RegisteredTool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	callable := func(tool *RegisteredTool) bool {
+		return (caller != "" && tool.AgentID == caller) || tool.Tool.CallableBy(caller)
+	}
+
+	if tool, exists := r.tools[ref]; exists {
+		if !callable(tool) {
+			return nil
+		}
+		return []*RegisteredTool{tool}
+	}
+
+	var providers []*RegisteredTool
+	for _, tool := range r.tools {
+		if tool.Tool.Name == ref && callable(tool) {
+			providers = append(providers, tool)
+		}
+	}
+
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].AgentID < providers[j].AgentID
+	})
+	return providers
+}
+
+// Limits on tool documentation, which is repeated in every discovery result
+const (
+	maxToolDocsSize = 16 << 10
+	maxToolExamples = 10
+)
+
+// validateTools checks the visibility settings, documentation size, retry
+// policy and variants of a tool list
+func validateTools(tools []protocol.MCPTool) error {
+	for _, tool := range tools {
+		if !tool.Visibility.Valid() {
+			return fmt.Errorf("tool %s has unknown visibility %q", tool.Name, tool.Visibility)
+		}
+		if len(tool.Docs) > maxToolDocsSize {
+			return fmt.Errorf("tool %s docs exceed %d bytes", tool.Name, maxToolDocsSize)
+		}
+		if len(tool.Examples) > maxToolExamples {
+			return fmt.Errorf("tool %s has more than %d examples", tool.Name, maxToolExamples)
+		}
+		if tool.Retry != nil {
+			if err := tool.Retry.Validate(); err != nil {
+				return fmt.Errorf("tool %s has an invalid retry policy: %w", tool.Name, err)
+			}
+		}
+		if err := validateVariants(tool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // UpdateAgentHeartbeat updates the last seen time for an agent
 func (r *MCPRegistry) UpdateAgentHeartbeat(agentID string) {
 	r.mu.Lock()
@@ -203,14 +351,22 @@ func (r *MCPRegistry) UpdateAgentHeartbeat(agentID string) {
 		agent.LastHeartbeat = time.Now()
 
 		// Update tool last seen times
-		for _, tool := range r.tools {
-			if tool.AgentID == agentID {
-				tool.LastSeen = time.Now()
-			}
+		for _, tool := range r.index.agentTools(agentID) {
+			tool.LastSeen = time.Now()
 		}
+		r.index.setStale(agentID, false)
 	}
 }
 
+// MarkAgentStale hides an agent's tools from discovery until its next
+// heartbeat
+func (r *MCPRegistry) MarkAgentStale(agentID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.index.setStale(agentID, true)
+}
+
 // GetToolCount returns the total number of registered tools
 func (r *MCPRegistry) GetToolCount() int {
 	r.mu.RLock()
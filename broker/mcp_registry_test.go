@@ -331,4 +331,86 @@ func TestMCPRegistryHeartbeat(t *testing.T) {
 	if !retrievedAgent.LastHeartbeat.After(oldHeartbeat) {
 		t.Error("Heartbeat should have been updated")
 	}
-}
\ No newline at end of file
+}
+func TestMCPRegistryToolVisibility(t *testing.T) {
+	registry := NewMCPRegistry()
+
+	registry.RegisterAgent("owner-agent", &MCPAgent{
+		ID:              "owner-agent",
+		MCPEndpoint:     "http://localhost:8080",
+		EnvironmentType: "test",
+		Tools: []protocol.MCPTool{
+			{Name: "data.public", Description: "Public tool"},
+			{Name: "data.unlisted", Description: "Unlisted tool", Visibility: protocol.ToolVisibilityUnlisted},
+			{Name: "data.private", Description: "Private tool", Visibility: protocol.ToolVisibilityPrivate, AllowedAgents: []string{"trusted-agent"}},
+		},
+		LastHeartbeat: time.Now(),
+	})
+
+	visibleTools := func(requester string) map[string]protocol.MCPTool {
+		discovered, err := registry.DiscoverToolsFor(protocol.ToolQuery{Capabilities: []string{"data.*"}}, requester)
+		if err != nil {
+			t.Fatalf("Discovery failed: %v", err)
+		}
+		tools := make(map[string]protocol.MCPTool)
+		for _, agent := range discovered {
+			for _, tool := range agent.MCPTools {
+				tools[tool.Name] = tool
+			}
+		}
+		return tools
+	}
+
+	tests := []struct {
+		requester string
+		visible   []string
+	}{
+		{"stranger-agent", []string{"data.public"}},
+		{"trusted-agent", []string{"data.public", "data.private"}},
+		{"owner-agent", []string{"data.public", "data.unlisted", "data.private"}},
+		{"", []string{"data.public"}},
+	}
+
+	for _, tt := range tests {
+		tools := visibleTools(tt.requester)
+		if len(tools) != len(tt.visible) {
+			t.Errorf("Requester %q: expected tools %v, got %v", tt.requester, tt.visible, tools)
+			continue
+		}
+		for _, name := range tt.visible {
+			tool, ok := tools[name]
+			if !ok {
+				t.Errorf("Requester %q: expected to see %s", tt.requester, name)
+			}
+			if len(tool.AllowedAgents) != 0 {
+				t.Errorf("Requester %q: allowlist of %s leaked through discovery", tt.requester, name)
+			}
+		}
+	}
+
+	calls := []struct {
+		ref      string
+		caller   string
+		callable bool
+	}{
+		{"data.public", "stranger-agent", true},
+		{"data.unlisted", "stranger-agent", true},
+		{"owner-agent/data.unlisted", "stranger-agent", true},
+		{"data.private", "stranger-agent", false},
+		{"owner-agent/data.private", "stranger-agent", false},
+		{"data.private", "trusted-agent", true},
+		{"data.private", "owner-agent", true},
+		{"data.private", "", false},
+	}
+
+	for _, tt := range calls {
+		providers := registry.FindToolProviders(tt.ref, tt.caller)
+		if got := len(providers) > 0; got != tt.callable {
+			t.Errorf("FindToolProviders(%s, %s): expected callable=%v, got %v", tt.ref, tt.caller, tt.callable, got)
+		}
+	}
+
+	if err := validateTools([]protocol.MCPTool{{Name: "bad", Visibility: "secret"}}); err == nil {
+		t.Error("Expected unknown visibility to be rejected")
+	}
+}
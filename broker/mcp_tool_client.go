@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// maxToolListSize bounds the tools/list responses read from agent endpoints
+const maxToolListSize = 4 << 20
+
+// ErrToolCallAccepted is returned when an agent accepts a tool call for
+// asynchronous execution; the result arrives later as a toolResult envelope
+var ErrToolCallAccepted = errors.New("tool call accepted for asynchronous execution")
+
+// deliveryError marks a request that never reached the tool, or that its
+// endpoint turned away with a 5xx or 429 status. Only delivery failures are
+// retried; errors returned by the tool itself are final.
+type deliveryError struct {
+	err error
+}
+
+func (e *deliveryError) Error() string { return e.err.Error() }
+func (e *deliveryError) Unwrap() error { return e.err }
+
+// isDeliveryFailure reports whether err is, or wraps, a delivery failure
+func isDeliveryFailure(err error) bool {
+	var delivery *deliveryError
+	return errors.As(err, &delivery)
+}
+
+// retryableStatus reports whether an HTTP status means the request may
+// succeed if delivered again
+func retryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// MCPToolClient invokes tools on agent MCP endpoints using JSON-RPC over HTTP
+type MCPToolClient struct {
+	httpClient *http.Client
+	nextID     int64
+}
+
+// mcpRequest is a JSON-RPC 2.0 request sent to an agent MCP endpoint
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  mcpToolCallArgs `json:"params"`
+	ID      int64           `json:"id"`
+}
+
+type mcpToolCallArgs struct {
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments"`
+	Meta      map[string]string      `json:"_meta,omitempty"`
+}
+
+// mcpResponse is a JSON-RPC 2.0 response returned by an agent MCP endpoint
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+	ID      int64           `json:"id"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *mcpError) Error() string {
+	return fmt.Sprintf("MCP error %d: %s", e.Code, e.Message)
+}
+
+// NewMCPToolClient creates a client for calling agent MCP endpoints
+func NewMCPToolClient() *MCPToolClient {
+	return &MCPToolClient{
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+// toolCallMeta is the _meta of a tools/call request for a FEM tool call:
+// its request ID, so agents that reply with 202 Accepted can post a
+// matching toolResult later, the parameter variant negotiated for it, its
+// sealed parameters, as JSON, if any, and whether its caller asked for a
+// delivery receipt, which the toolResult may add timing to
+func toolCallMeta(body protocol.ToolCallBody) map[string]string {
+	meta := make(map[string]string)
+	if body.RequestID != "" {
+		meta["requestId"] = body.RequestID
+	}
+	if body.Variant != "" {
+		meta["variant"] = body.Variant
+	}
+	if body.Enc != nil {
+		sealed, _ := json.Marshal(body.Enc)
+		meta["enc"] = string(sealed)
+	}
+	if body.Receipt {
+		meta["receipt"] = "true"
+	}
+	return meta
+}
+
+// CallTool sends a tools/call request to an MCP endpoint and returns the
+// tool's result, passing meta as the request's _meta
+func (c *MCPToolClient) CallTool(endpoint, name string, meta map[string]string, arguments map[string]interface{}) (interface{}, error) {
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+
+	request := mcpRequest{
+		JSONRPC: "2.0",
+		Method:  "tools/call",
+		Params: mcpToolCallArgs{
+			Name:      name,
+			Arguments: arguments,
+		},
+		ID: atomic.AddInt64(&c.nextID, 1),
+	}
+	if len(meta) > 0 {
+		request.Params.Meta = meta
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal MCP request: %w", err)
+	}
+
+	resp, err := c.httpClient.Post(endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, &deliveryError{fmt.Errorf("failed to reach MCP endpoint: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MCP response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusAccepted {
+		return nil, ErrToolCallAccepted
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("MCP endpoint returned status %d: %s", resp.StatusCode, bytes.TrimSpace(payload))
+		if retryableStatus(resp.StatusCode) {
+			return nil, &deliveryError{err}
+		}
+		return nil, err
+	}
+
+	var response mcpResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, fmt.Errorf("invalid MCP response: %w", err)
+	}
+
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	var result interface{}
+	if len(response.Result) > 0 {
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return nil, fmt.Errorf("invalid MCP result: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// ListTools sends a tools/list request to an MCP endpoint and returns the
+// tools it offers
+func (c *MCPToolClient) ListTools(endpoint string) ([]protocol.MCPTool, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "tools/list",
+		"params":  map[string]interface{}{},
+		"id":      atomic.AddInt64(&c.nextID, 1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal MCP request: %w", err)
+	}
+
+	resp, err := c.httpClient.Post(endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach MCP endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, maxToolListSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MCP response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MCP endpoint returned status %d: %s", resp.StatusCode, bytes.TrimSpace(payload))
+	}
+
+	var response mcpResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, fmt.Errorf("invalid MCP response: %w", err)
+	}
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	var result struct {
+		Tools []protocol.MCPTool `json:"tools"`
+	}
+	if err := json.Unmarshal(response.Result, &result); err != nil {
+		return nil, fmt.Errorf("invalid MCP result: %w", err)
+	}
+	return result.Tools, nil
+}
@@ -0,0 +1,36 @@
+-- Registered agents, MCP registrations and the tool index. Records are
+-- stored as JSONB; keys are duplicated into columns for lookups.
+CREATE TABLE IF NOT EXISTS fem_agents (
+    id TEXT PRIMARY KEY,
+    data JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS fem_mcp_agents (
+    id TEXT PRIMARY KEY,
+    data JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS fem_tools (
+    agent_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    data JSONB NOT NULL,
+    PRIMARY KEY (agent_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS fem_subscriptions (
+    agent_id TEXT PRIMARY KEY,
+    data JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Seen nonces for replay protection; expires_at is Unix milliseconds
+CREATE TABLE IF NOT EXISTS fem_nonces (
+    agent_id TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    expires_at BIGINT NOT NULL,
+    PRIMARY KEY (agent_id, nonce)
+);
+
+CREATE INDEX IF NOT EXISTS fem_nonces_expires_at_idx ON fem_nonces (expires_at);
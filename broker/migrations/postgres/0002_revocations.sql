@@ -0,0 +1,7 @@
+-- Capabilities and tools revoked from agents, which registering again
+-- does not restore
+CREATE TABLE IF NOT EXISTS fem_revocations (
+    agent_id TEXT PRIMARY KEY,
+    data JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultOrderingHoldback is how long an ordered envelope is held back
+// waiting for the envelopes sequenced before it
+const defaultOrderingHoldback = 10 * time.Second
+
+// maxHeldPerPair bounds the envelopes held back for one pair at once
+const maxHeldPerPair = 64
+
+// orderedPairTTL is how long an idle pair's sequence is remembered. Senders
+// silent for longer start again from sequence 1.
+const orderedPairTTL = 10 * time.Minute
+
+var (
+	// ErrSequenceDelivered is returned for an envelope whose sequence was
+	// already delivered, or given up on as a gap
+	ErrSequenceDelivered = errors.New("sequence number already delivered")
+	// ErrHoldbackFull is returned when too many envelopes of a pair are
+	// waiting on earlier ones
+	ErrHoldbackFull = errors.New("too many envelopes held back for this recipient")
+)
+
+// orderingStatus maps an ordering error to its HTTP status
+func orderingStatus(err error) int {
+	if err == ErrHoldbackFull {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusConflict
+}
+
+// orderedPairKey identifies a (sender, recipient) pair
+type orderedPairKey struct {
+	sender    string
+	recipient string
+}
+
+// orderedPair is the delivery state of one pair
+type orderedPair struct {
+	next     uint64        // Next sequence number to deliver
+	busy     bool          // next is being delivered
+	held     int           // Envelopes waiting for their turn
+	changed  chan struct{} // Closed and replaced whenever next or busy change
+	lastUsed time.Time
+}
+
+// OrderedDelivery sequences envelopes sent in ordered mode, so that each
+// (sender, recipient) pair is delivered in the order the sender numbered
+// its envelopes. An envelope arriving early is held back until those
+// before it are delivered. A sequence whose delivery fails may be retried;
+// one not retried within the holdback is given up on, so the pair is not
+// blocked for good.
+type OrderedDelivery struct {
+	pairs    map[orderedPairKey]*orderedPair
+	holdback time.Duration
+	mu       sync.Mutex
+}
+
+// NewOrderedDelivery creates a sequencer holding envelopes back for at most
+// holdback
+func NewOrderedDelivery(holdback time.Duration) *OrderedDelivery {
+	return &OrderedDelivery{
+		pairs:    make(map[orderedPairKey]*orderedPair),
+		holdback: holdback,
+	}
+}
+
+// SetHoldback changes how long envelopes are held back for a gap
+func (o *OrderedDelivery) SetHoldback(holdback time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.holdback = holdback
+}
+
+// Acquire waits until envelope seq of the pair is next to be delivered, and
+// reserves its delivery. Every successful Acquire must be followed by a
+// Release.
+func (o *OrderedDelivery) Acquire(sender, recipient string, seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	o.prune(now)
+	key := orderedPairKey{sender, recipient}
+	pair, exists := o.pairs[key]
+	if !exists {
+		pair = &orderedPair{next: 1, changed: make(chan struct{})}
+		o.pairs[key] = pair
+	}
+	pair.lastUsed = now
+
+	timeout := time.NewTimer(o.holdback)
+	defer timeout.Stop()
+	expired := false
+
+	for {
+		if seq < pair.next {
+			return ErrSequenceDelivered
+		}
+		if expired && seq > pair.next && !pair.busy {
+			slog.Warn("Gave up on sequence", "from", pair.next, "to", seq-1, "sender", sender, "recipient", recipient)
+			pair.next = seq
+		}
+		if seq == pair.next && !pair.busy {
+			pair.busy = true
+			return nil
+		}
+		if pair.held >= maxHeldPerPair {
+			return ErrHoldbackFull
+		}
+
+		changed := pair.changed
+		pair.held++
+		o.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout.C:
+			expired = true
+		}
+		o.mu.Lock()
+		pair.held--
+		pair.lastUsed = time.Now()
+	}
+}
+
+// Release ends the delivery of envelope seq reserved by Acquire. Delivered
+// sequences let the next one through; otherwise seq may be retried.
+func (o *OrderedDelivery) Release(sender, recipient string, seq uint64, delivered bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	pair, exists := o.pairs[orderedPairKey{sender, recipient}]
+	if !exists || !pair.busy || pair.next != seq {
+		return
+	}
+	pair.busy = false
+	if delivered {
+		pair.next++
+	}
+	pair.lastUsed = time.Now()
+	close(pair.changed)
+	pair.changed = make(chan struct{})
+}
+
+// GetPairCount returns the number of pairs with sequencing state
+func (o *OrderedDelivery) GetPairCount() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pairs)
+}
+
+// prune forgets idle pairs. Caller must hold the lock.
+func (o *OrderedDelivery) prune(now time.Time) {
+	for key, pair := range o.pairs {
+		if !pair.busy && pair.held == 0 && now.Sub(pair.lastUsed) > orderedPairTTL {
+			delete(o.pairs, key)
+		}
+	}
+}
+
+// releaseSequence releases an ordered toolCall's sequence, if it has one
+func (b *Broker) releaseSequence(sender, recipient string, seq uint64, delivered bool) {
+	if seq > 0 {
+		b.ordering.Release(sender, recipient, seq, delivered)
+	}
+}
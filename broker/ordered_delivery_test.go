@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestOrderedDeliverySequencing(t *testing.T) {
+	ordering := NewOrderedDelivery(time.Second)
+
+	// An early envelope waits for the one before it
+	acquired := make(chan error, 1)
+	go func() { acquired <- ordering.Acquire("sender", "recipient", 2) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Expected sequence 2 to be held back, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := ordering.Acquire("sender", "recipient", 1); err != nil {
+		t.Fatalf("Acquire 1 failed: %v", err)
+	}
+	ordering.Release("sender", "recipient", 1, true)
+	if err := <-acquired; err != nil {
+		t.Fatalf("Acquire 2 failed: %v", err)
+	}
+
+	// A failed delivery may be retried under the same sequence
+	ordering.Release("sender", "recipient", 2, false)
+	if err := ordering.Acquire("sender", "recipient", 2); err != nil {
+		t.Fatalf("Retry of 2 failed: %v", err)
+	}
+	ordering.Release("sender", "recipient", 2, true)
+	if err := ordering.Acquire("sender", "recipient", 2); err != ErrSequenceDelivered {
+		t.Errorf("Expected a delivered sequence to be rejected, got %v", err)
+	}
+
+	// Other pairs are sequenced independently
+	if err := ordering.Acquire("sender", "other", 1); err != nil {
+		t.Fatalf("Acquire on another pair failed: %v", err)
+	}
+	ordering.Release("sender", "other", 1, true)
+}
+
+func TestOrderedDeliveryGivesUpOnGaps(t *testing.T) {
+	ordering := NewOrderedDelivery(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := ordering.Acquire("sender", "recipient", 3); err != nil {
+		t.Fatalf("Expected sequence 3 to be delivered after the holdback, got %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Expected sequence 3 to be held back, waited %v", waited)
+	}
+	ordering.Release("sender", "recipient", 3, true)
+
+	if err := ordering.Acquire("sender", "recipient", 1); err != ErrSequenceDelivered {
+		t.Errorf("Expected a late envelope for a skipped sequence to be rejected, got %v", err)
+	}
+}
+
+func TestOrderedToolCalls(t *testing.T) {
+	broker := NewBroker()
+
+	calls := make(chan string, 2)
+	agentServer := fakeMCPServer(t, calls)
+	broker.mcpRegistry.RegisterAgent("log-agent", &MCPAgent{
+		ID:            "log-agent",
+		MCPEndpoint:   agentServer.URL,
+		Tools:         []protocol.MCPTool{{Name: "log.first"}, {Name: "log.second"}},
+		LastHeartbeat: time.Now(),
+	})
+
+	call := func(tool string, seq uint64) *bufferedResponse {
+		env := &protocol.GenericEnvelope{
+			BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall},
+		}
+		env.Agent = "writer-agent"
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: "log-agent/" + tool, Seq: seq})
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+		return recorder
+	}
+
+	// The second call arrives first but is delivered second
+	second := make(chan *bufferedResponse, 1)
+	go func() { second <- call("log.second", 2) }()
+	time.Sleep(50 * time.Millisecond)
+
+	if recorder := call("log.first", 1); recorder.status != http.StatusOK {
+		t.Fatalf("First call failed: %d %s", recorder.status, recorder.body.String())
+	}
+	if recorder := <-second; recorder.status != http.StatusOK {
+		t.Fatalf("Second call failed: %d %s", recorder.status, recorder.body.String())
+	}
+	if first, next := <-calls, <-calls; first != "log.first" || next != "log.second" {
+		t.Errorf("Expected log.first then log.second, got %s then %s", first, next)
+	}
+
+	if recorder := call("log.first", 1); recorder.status != http.StatusConflict {
+		t.Errorf("Expected status 409 for a repeated sequence, got %d", recorder.status)
+	}
+}
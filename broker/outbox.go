@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// defaultAckTimeout is how long the outbox waits for an ack before
+	// pushing an envelope again. The wait doubles with each attempt.
+	defaultAckTimeout = 10 * time.Second
+	// maxAckBackoff caps the wait between pushes of one envelope
+	maxAckBackoff = 5 * time.Minute
+	// defaultOutboxTTL is how long unacked envelopes are pushed again
+	defaultOutboxTTL = 10 * time.Minute
+	// maxOutboxPerAgent bounds the unacked envelopes kept for one agent;
+	// past it one is evicted by priority
+	maxOutboxPerAgent = 1024
+	// evictNever is the priority of envelopes an outbox never evicts
+	evictNever = math.MaxInt
+	// outboxRevoke is the eviction class of capability.revoked events
+	outboxRevoke = "revoke"
+)
+
+// defaultOutboxPriorities rank what a full outbox keeps: stale events go
+// before tool traffic, and revocation notices are never dropped. "*"
+// covers the envelope types not listed.
+var defaultOutboxPriorities = map[string]int{
+	string(protocol.EnvelopeEmitEvent):       0,
+	string(protocol.EnvelopeBroadcast):       1,
+	string(protocol.EnvelopeToolCall):        2,
+	string(protocol.EnvelopeToolResult):      2,
+	string(protocol.EnvelopeToolResultChunk): 2,
+	outboxRevoke:                             evictNever,
+	"*":                                      1,
+}
+
+// ParseOutboxPriorities parses a comma-separated list of class=priority,
+// such as emitEvent=0,toolResult=3,revoke=never, over the defaults. A class
+// is an envelope type, "revoke" for capability.revoked events, or "*" for
+// the rest; envelopes of lower priority are evicted first.
+func ParseOutboxPriorities(spec string) (map[string]int, error) {
+	priorities := make(map[string]int, len(defaultOutboxPriorities))
+	for class, priority := range defaultOutboxPriorities {
+		priorities[class] = priority
+	}
+	for _, field := range parseSinkList(spec) {
+		class, value, found := strings.Cut(field, "=")
+		if !found || class == "" {
+			return nil, fmt.Errorf("invalid outbox priority %q, expected class=priority", field)
+		}
+		if value == "never" {
+			priorities[class] = evictNever
+			continue
+		}
+		priority, err := strconv.Atoi(value)
+		if err != nil || priority < 0 {
+			return nil, fmt.Errorf("invalid %s outbox priority %q, expected a number or never", class, value)
+		}
+		priorities[class] = priority
+	}
+	return priorities, nil
+}
+
+// outboxEntry is a pushed envelope awaiting the recipient's ack
+type outboxEntry struct {
+	nonce    string
+	class    string // Envelope type, or outboxRevoke, for eviction
+	data     []byte
+	attempts int
+	due      time.Time // When to push it again
+	expires  time.Time
+}
+
+// Outbox gives envelopes pushed to agents that ack at-least-once delivery.
+// It wraps the connection hub: envelopes for agents registered with acks
+// are kept until acked, pushed again when the ack is late and when the
+// agent reconnects, and dropped when they expire. Envelopes for other
+// agents are pushed once, as before. An agent's outbox holds at most
+// maxOutboxPerAgent envelopes; past that, expired ones are evicted first,
+// then those of the lowest priority, oldest first.
+type Outbox struct {
+	pusher     EnvelopePusher
+	acks       func(agentID string) bool // Whether an agent acks; none do if nil
+	entries    map[string][]*outboxEntry // Unacked envelopes by agent, oldest first
+	priorities map[string]int
+	evicted    map[string]map[string]int64 // Evictions by agent, then class
+	evictions  map[string]int64            // Evictions by class since the broker started
+	ackTimeout time.Duration
+	ttl        time.Duration
+	mu         sync.Mutex
+}
+
+// OutboxPressure is how close an agent's outbox is to its limit
+type OutboxPressure struct {
+	Pending int              `json:"pending"`
+	Limit   int              `json:"limit"`
+	Evicted map[string]int64 `json:"evicted,omitempty"` // By class, since the agent registered
+}
+
+// OutboxStats are the unacked envelopes across all agents, and those
+// evicted by class since the broker started
+type OutboxStats struct {
+	Pending int              `json:"pending"`
+	Evicted map[string]int64 `json:"evicted"`
+}
+
+// NewOutbox creates an outbox pushing through pusher
+func NewOutbox(pusher EnvelopePusher) *Outbox {
+	return &Outbox{
+		pusher:     pusher,
+		entries:    make(map[string][]*outboxEntry),
+		priorities: defaultOutboxPriorities,
+		evicted:    make(map[string]map[string]int64),
+		evictions:  make(map[string]int64),
+		ackTimeout: defaultAckTimeout,
+		ttl:        defaultOutboxTTL,
+	}
+}
+
+// SetTimeouts sets how long to wait for an ack before pushing again, and
+// how long to keep pushing an unacked envelope
+func (o *Outbox) SetTimeouts(ackTimeout, ttl time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ackTimeout = ackTimeout
+	o.ttl = ttl
+}
+
+// SetPriorities sets the eviction priority of each class of envelope, as
+// returned by ParseOutboxPriorities
+func (o *Outbox) SetPriorities(priorities map[string]int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.priorities = priorities
+}
+
+// IsConnected reports whether an agent holds a live connection
+func (o *Outbox) IsConnected(agentID string) bool {
+	return o.pusher.IsConnected(agentID)
+}
+
+// SendRaw pushes a serialized JSON envelope to a connected agent, keeping it
+// until acked if the agent acks
+func (o *Outbox) SendRaw(agentID string, data []byte) error {
+	o.mu.Lock()
+	ttl := o.ttl
+	o.mu.Unlock()
+	return o.sendBefore(agentID, data, time.Now().Add(ttl))
+}
+
+// Send pushes an envelope to a connected agent, keeping it until acked if
+// the agent acks
+func (o *Outbox) Send(agentID string, envelope interface{}) error {
+	return o.SendBefore(agentID, envelope, time.Time{})
+}
+
+// SendBefore pushes an envelope that is of no use after expires, such as a
+// tool call whose caller stops waiting. A zero expires uses the outbox TTL.
+func (o *Outbox) SendBefore(agentID string, envelope interface{}, expires time.Time) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if expires.IsZero() {
+		return o.SendRaw(agentID, data)
+	}
+	return o.sendBefore(agentID, data, expires)
+}
+
+func (o *Outbox) sendBefore(agentID string, data []byte, expires time.Time) error {
+	if o.acks == nil || !o.acks(agentID) {
+		return o.pusher.SendRaw(agentID, data)
+	}
+
+	var headers struct {
+		protocol.BaseEnvelope
+		Body struct {
+			Event string `json:"event"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(data, &headers); err != nil || headers.Nonce == "" {
+		return fmt.Errorf("envelope for %s has no nonce to ack", agentID)
+	}
+	entry := &outboxEntry{nonce: headers.Nonce, class: string(headers.Type), data: data, expires: expires}
+	if headers.Type == protocol.EnvelopeEmitEvent && headers.Body.Event == protocol.EventCapabilityRevoked {
+		entry.class = outboxRevoke
+	}
+
+	// Tracked before the push, so an ack racing it is not lost
+	o.mu.Lock()
+	now := time.Now()
+	entry.attempts = 1
+	entry.due = now.Add(o.ackTimeout)
+	queue := append(o.entries[agentID], entry)
+	if len(queue) > maxOutboxPerAgent {
+		queue = o.evict(agentID, queue, now)
+	}
+	o.entries[agentID] = queue
+	o.mu.Unlock()
+
+	// A failed push is reported to the caller, which handles it as it
+	// would without acks, rather than being pushed again later
+	if err := o.pusher.SendRaw(agentID, data); err != nil {
+		o.Ack(agentID, []string{entry.nonce})
+		return err
+	}
+	return nil
+}
+
+// evict drops one envelope from a full queue: the first expired, or else
+// the oldest of the lowest priority. A queue holding only envelopes that
+// are never evicted is left over the limit. Caller must hold o.mu.
+func (o *Outbox) evict(agentID string, queue []*outboxEntry, now time.Time) []*outboxEntry {
+	victim, lowest := -1, evictNever
+	for i, entry := range queue {
+		if now.After(entry.expires) {
+			victim = i
+			break
+		}
+		if priority := o.priority(entry.class); priority < lowest {
+			victim, lowest = i, priority
+		}
+	}
+	if victim < 0 {
+		slog.Warn("Outbox full of envelopes that are never evicted", "agent", agentID, "pending", len(queue))
+		return queue
+	}
+
+	entry := queue[victim]
+	slog.Warn("Outbox full, evicting unacked envelope", "agent", agentID, "nonce", entry.nonce, "class", entry.class)
+	if o.evicted[agentID] == nil {
+		o.evicted[agentID] = make(map[string]int64)
+	}
+	o.evicted[agentID][entry.class]++
+	o.evictions[entry.class]++
+	return append(queue[:victim], queue[victim+1:]...)
+}
+
+// priority returns the eviction priority of a class of envelope. Caller
+// must hold o.mu.
+func (o *Outbox) priority(class string) int {
+	if priority, ok := o.priorities[class]; ok {
+		return priority
+	}
+	return o.priorities["*"]
+}
+
+// Ack drops the envelopes an agent acked, returning how many were unacked
+func (o *Outbox) Ack(agentID string, nonces []string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	acked := make(map[string]bool, len(nonces))
+	for _, nonce := range nonces {
+		acked[nonce] = true
+	}
+	queue := o.entries[agentID]
+	kept := queue[:0]
+	for _, entry := range queue {
+		if !acked[entry.nonce] {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(queue) - len(kept)
+	if len(kept) == 0 {
+		delete(o.entries, agentID)
+	} else {
+		o.entries[agentID] = kept
+	}
+	return removed
+}
+
+// Deliver pushes the unacked envelopes of an agent that just connected, in
+// the order they were first sent
+func (o *Outbox) Deliver(agentID string) {
+	o.push(agentID, time.Now(), true)
+}
+
+// Redeliver pushes the envelopes whose ack is overdue to connected agents
+// and drops the expired ones, returning how many of each
+func (o *Outbox) Redeliver(now time.Time) (redelivered, expired int) {
+	o.mu.Lock()
+	agents := make([]string, 0, len(o.entries))
+	for agentID, queue := range o.entries {
+		kept := queue[:0]
+		for _, entry := range queue {
+			if now.After(entry.expires) {
+				expired++
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		if len(kept) == 0 {
+			delete(o.entries, agentID)
+			continue
+		}
+		o.entries[agentID] = kept
+		agents = append(agents, agentID)
+	}
+	o.mu.Unlock()
+
+	for _, agentID := range agents {
+		if o.pusher.IsConnected(agentID) {
+			redelivered += o.push(agentID, now, false)
+		}
+	}
+	return redelivered, expired
+}
+
+// push sends an agent's unacked envelopes again, only those overdue unless
+// all is set, returning how many were pushed
+func (o *Outbox) push(agentID string, now time.Time, all bool) int {
+	o.mu.Lock()
+	var due []*outboxEntry
+	for _, entry := range o.entries[agentID] {
+		if (all || !now.Before(entry.due)) && now.Before(entry.expires) {
+			backoff := o.ackTimeout << entry.attempts
+			if backoff <= 0 || backoff > maxAckBackoff {
+				backoff = maxAckBackoff
+			}
+			entry.attempts++
+			entry.due = now.Add(backoff)
+			due = append(due, entry)
+		}
+	}
+	o.mu.Unlock()
+
+	pushed := 0
+	for _, entry := range due {
+		if err := o.pusher.SendRaw(agentID, entry.data); err != nil {
+			slog.Warn("Failed to push unacked envelope", "agent", agentID, "nonce", entry.nonce, "error", err)
+			break
+		}
+		pushed++
+	}
+	return pushed
+}
+
+// Pending returns the number of envelopes an agent has not acked
+func (o *Outbox) Pending(agentID string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries[agentID])
+}
+
+// Pressure reports how full an agent's outbox is and what it evicted
+func (o *Outbox) Pressure(agentID string) OutboxPressure {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pressure := OutboxPressure{Pending: len(o.entries[agentID]), Limit: maxOutboxPerAgent}
+	if evicted := o.evicted[agentID]; len(evicted) > 0 {
+		pressure.Evicted = make(map[string]int64, len(evicted))
+		for class, count := range evicted {
+			pressure.Evicted[class] = count
+		}
+	}
+	return pressure
+}
+
+// Stats totals the unacked and evicted envelopes of every agent
+func (o *Outbox) Stats() OutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stats := OutboxStats{Evicted: make(map[string]int64, len(o.evictions))}
+	for _, queue := range o.entries {
+		stats.Pending += len(queue)
+	}
+	for class, count := range o.evictions {
+		stats.Evicted[class] = count
+	}
+	return stats
+}
+
+// Forget drops the envelopes owed to an agent that left the broker
+func (o *Outbox) Forget(agentID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.entries, agentID)
+	delete(o.evicted, agentID)
+}
+
+// Run pushes overdue envelopes again every interval until stop is closed
+func (o *Outbox) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, expired := o.Redeliver(time.Now()); expired > 0 {
+				slog.Info("Expired unacked envelopes", "count", expired)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// agentAcks reports whether an agent registered to ack pushed envelopes
+func (b *Broker) agentAcks(agentID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	agent, registered := b.agents[agentID]
+	return registered && agent.Acks
+}
+
+// handleAck drops the pushed envelopes an agent acked from its outbox
+func (b *Broker) handleAck(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.AckBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	if !registered {
+		http.Error(w, fmt.Sprintf("Agent %s is not registered", env.Agent), http.StatusNotFound)
+		return
+	}
+	if agent.PubKey != nil {
+		if err := b.verifySender(w, env, agent.PubKey); err != nil {
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+			return
+		}
+	}
+
+	acked := b.outbox.Ack(env.Agent, body.Nonces)
+	response := map[string]interface{}{
+		"status":  "acked",
+		"acked":   acked,
+		"pending": b.outbox.Pending(env.Agent),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
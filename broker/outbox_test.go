@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestOutboxRedeliversUntilAcked(t *testing.T) {
+	pusher := newFakePusher()
+	pusher.connected["acking"] = true
+	pusher.connected["legacy"] = true
+	outbox := NewOutbox(pusher)
+	outbox.acks = func(agentID string) bool { return agentID == "acking" }
+
+	event := func() *protocol.Envelope { return protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "sensor") }
+	first, second := event(), event()
+	for _, env := range []*protocol.Envelope{first, second} {
+		if err := outbox.Send("acking", env); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	outbox.Send("legacy", event())
+	if outbox.Pending("acking") != 2 || outbox.Pending("legacy") != 0 {
+		t.Fatalf("Expected only the acking agent's envelopes to be kept, got %d and %d", outbox.Pending("acking"), outbox.Pending("legacy"))
+	}
+
+	// Nothing is pushed again before the ack is due
+	now := time.Now()
+	if redelivered, _ := outbox.Redeliver(now); redelivered != 0 {
+		t.Errorf("Expected no redelivery before the ack timeout, got %d", redelivered)
+	}
+	if acked := outbox.Ack("acking", []string{first.Nonce, "unknown"}); acked != 1 {
+		t.Errorf("Expected one envelope acked, got %d", acked)
+	}
+	if redelivered, _ := outbox.Redeliver(now.Add(defaultAckTimeout)); redelivered != 1 {
+		t.Errorf("Expected the unacked envelope to be pushed again, got %d", redelivered)
+	}
+	// The wait doubles after each attempt
+	if redelivered, _ := outbox.Redeliver(now.Add(2 * defaultAckTimeout)); redelivered != 0 {
+		t.Errorf("Expected the backoff to double, got %d redelivered", redelivered)
+	}
+	received := pusher.received["acking"]
+	var headers protocol.CommonHeaders
+	json.Unmarshal(received[len(received)-1], &headers)
+	if len(received) != 3 || headers.Nonce != second.Nonce {
+		t.Errorf("Expected the second envelope to be pushed again, got %d pushes", len(received))
+	}
+
+	// Agents reconnecting get everything unacked; expired envelopes go
+	pusher.connected["acking"] = false
+	outbox.Deliver("acking")
+	pusher.connected["acking"] = true
+	outbox.Deliver("acking")
+	if len(pusher.received["acking"]) != 4 {
+		t.Errorf("Expected the unacked envelope to be pushed on reconnect, got %d pushes", len(pusher.received["acking"]))
+	}
+	if _, expired := outbox.Redeliver(now.Add(defaultOutboxTTL + time.Second)); expired != 1 || outbox.Pending("acking") != 0 {
+		t.Errorf("Expected the envelope to expire, %d expired and %d pending", expired, outbox.Pending("acking"))
+	}
+
+	// Failed pushes are left to the sender
+	pusher.failing["acking"] = true
+	if err := outbox.Send("acking", event()); err == nil || outbox.Pending("acking") != 0 {
+		t.Errorf("Expected a failed push to be reported and not kept, got %v", err)
+	}
+}
+
+func TestOutboxEvictsByPriority(t *testing.T) {
+	pusher := newFakePusher()
+	pusher.connected["camera"] = true
+	outbox := NewOutbox(pusher)
+	outbox.acks = func(string) bool { return true }
+
+	send := func(envType protocol.EnvelopeType, event string) string {
+		nonce := protocol.NewNonce()
+		env := map[string]interface{}{"type": envType, "agent": "broker", "nonce": nonce, "body": map[string]string{"event": event}}
+		if err := outbox.Send("camera", env); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		return nonce
+	}
+	pending := func() map[string]bool {
+		outbox.mu.Lock()
+		defer outbox.mu.Unlock()
+		nonces := make(map[string]bool)
+		for _, entry := range outbox.entries["camera"] {
+			nonces[entry.nonce] = true
+		}
+		return nonces
+	}
+
+	revoked := send(protocol.EnvelopeEmitEvent, protocol.EventCapabilityRevoked)
+	call := send(protocol.EnvelopeToolCall, "")
+	oldest := send(protocol.EnvelopeEmitEvent, "motion.detected")
+	for outbox.Pending("camera") < maxOutboxPerAgent {
+		send(protocol.EnvelopeEmitEvent, "motion.detected")
+	}
+
+	// Stale events go before tool traffic and revocations
+	send(protocol.EnvelopeToolResult, "")
+	if kept := pending(); len(kept) != maxOutboxPerAgent || kept[oldest] || !kept[call] || !kept[revoked] {
+		t.Errorf("Expected the oldest event evicted, %d pending", len(kept))
+	}
+
+	// Expired envelopes go first, whatever their priority
+	outbox.mu.Lock()
+	outbox.entries["camera"][1].expires = time.Now().Add(-time.Second)
+	outbox.mu.Unlock()
+	send(protocol.EnvelopeEmitEvent, "motion.detected")
+	if kept := pending(); kept[call] || !kept[revoked] {
+		t.Error("Expected the expired tool call evicted")
+	}
+
+	// With events ranked above tool results, a tool result goes instead
+	priorities, err := ParseOutboxPriorities("emitEvent=5,toolResult=0")
+	if err != nil {
+		t.Fatalf("Failed to parse priorities: %v", err)
+	}
+	outbox.SetPriorities(priorities)
+	send(protocol.EnvelopeEmitEvent, "motion.detected")
+	pressure := outbox.Pressure("camera")
+	if pressure.Pending != maxOutboxPerAgent || pressure.Limit != maxOutboxPerAgent {
+		t.Errorf("Expected a full outbox, got %+v", pressure)
+	}
+	if pressure.Evicted["emitEvent"] != 1 || pressure.Evicted["toolCall"] != 1 || pressure.Evicted["toolResult"] != 1 {
+		t.Errorf("Expected one eviction of each class, got %v", pressure.Evicted)
+	}
+
+	// Envelopes that are never evicted may overfill the outbox
+	priorities, _ = ParseOutboxPriorities("emitEvent=never")
+	outbox.SetPriorities(priorities)
+	send(protocol.EnvelopeEmitEvent, "motion.detected")
+	if count := outbox.Pending("camera"); count != maxOutboxPerAgent+1 || !pending()[revoked] {
+		t.Errorf("Expected nothing evicted, %d pending", count)
+	}
+	if stats := outbox.Stats(); stats.Pending != maxOutboxPerAgent+1 || stats.Evicted["emitEvent"] != 1 {
+		t.Errorf("Expected the totals to count the outbox, got %+v", stats)
+	}
+
+	// Forgetting the agent clears its pressure but not the totals
+	outbox.Forget("camera")
+	if pressure := outbox.Pressure("camera"); pressure.Pending != 0 || pressure.Evicted != nil || outbox.Stats().Evicted["toolCall"] != 1 {
+		t.Errorf("Expected the agent's outbox forgotten, got %+v", pressure)
+	}
+
+	for _, spec := range []string{"emitEvent", "emitEvent=-1", "toolCall=always"} {
+		if _, err := ParseOutboxPriorities(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestWebSocketAckedDelivery(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	listener := dialTestAgent(t, server, "ws-listener")
+	nonce := listener.send(listener.id, protocol.EnvelopeRegisterAgent, protocol.RegisterAgentBody{
+		PubKey:       protocol.EncodePublicKey(listener.pubKey),
+		Capabilities: []string{"test"},
+		Acks:         true,
+	})
+	if reply := listener.reply(nonce); reply["status"] != float64(http.StatusOK) {
+		t.Fatalf("Registration failed: %v", reply)
+	}
+	nonce = listener.send(listener.id, protocol.EnvelopeSubscribe, protocol.SubscribeBody{Events: []string{"job.*"}})
+	listener.reply(nonce)
+
+	emitter := dialTestAgent(t, server, "ws-emitter")
+	emitter.register()
+	emitted := emitter.send(emitter.id, protocol.EnvelopeEmitEvent, protocol.EmitEventBody{Event: "job.done"})
+
+	if event := listener.pushed(protocol.EnvelopeEmitEvent); event["nonce"] != emitted {
+		t.Fatalf("Unexpected event %v", event)
+	}
+	if broker.outbox.Pending(listener.id) != 1 {
+		t.Fatalf("Expected the event to await an ack")
+	}
+
+	// Unacked, the event comes again with the same nonce
+	broker.outbox.Redeliver(time.Now().Add(defaultAckTimeout))
+	if event := listener.pushed(protocol.EnvelopeEmitEvent); event["nonce"] != emitted {
+		t.Fatalf("Expected the event to be pushed again, got %v", event)
+	}
+
+	nonce = listener.send(listener.id, protocol.EnvelopeAck, protocol.AckBody{Nonces: []string{emitted}})
+	if reply := listener.reply(nonce); reply["status"] != float64(http.StatusOK) {
+		t.Fatalf("Ack failed: %v", reply)
+	}
+	if broker.outbox.Pending(listener.id) != 0 {
+		t.Error("Expected the ack to clear the event")
+	}
+}
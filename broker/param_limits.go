@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ParamLimits bounds the shape of toolCall parameters so pathological
+// payloads are rejected at the broker instead of reaching agents' schema
+// validators. A zero limit is unlimited.
+type ParamLimits struct {
+	MaxDepth        int // Nesting depth of objects and arrays
+	MaxArrayLength  int // Elements in any one array
+	MaxObjectKeys   int // Members of any one object
+	MaxStringLength int // Bytes in any one string or object key
+}
+
+// defaultParamLimits are generous enough for real tool calls
+var defaultParamLimits = ParamLimits{
+	MaxDepth:        32,
+	MaxArrayLength:  10000,
+	MaxObjectKeys:   1000,
+	MaxStringLength: 1 << 20,
+}
+
+// SetParamLimits replaces the limits applied to toolCall parameters
+func (b *Broker) SetParamLimits(limits ParamLimits) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paramLimits = limits
+}
+
+// Check reports the first place where params exceed the limits
+func (l ParamLimits) Check(params map[string]interface{}) error {
+	return l.check("parameters", params, 1)
+}
+
+func (l ParamLimits) check(path string, value interface{}, depth int) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if l.MaxDepth > 0 && depth > l.MaxDepth {
+			return fmt.Errorf("%s: nesting exceeds depth %d", path, l.MaxDepth)
+		}
+		if l.MaxObjectKeys > 0 && len(v) > l.MaxObjectKeys {
+			return fmt.Errorf("%s: object has %d keys, limit %d", path, len(v), l.MaxObjectKeys)
+		}
+		for key, member := range v {
+			if l.MaxStringLength > 0 && len(key) > l.MaxStringLength {
+				return fmt.Errorf("%s: key of %d bytes exceeds limit %d", path, len(key), l.MaxStringLength)
+			}
+			if err := l.check(path+"."+key, member, depth+1); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if l.MaxDepth > 0 && depth > l.MaxDepth {
+			return fmt.Errorf("%s: nesting exceeds depth %d", path, l.MaxDepth)
+		}
+		if l.MaxArrayLength > 0 && len(v) > l.MaxArrayLength {
+			return fmt.Errorf("%s: array has %d elements, limit %d", path, len(v), l.MaxArrayLength)
+		}
+		for i, element := range v {
+			if err := l.check(path+"["+strconv.Itoa(i)+"]", element, depth+1); err != nil {
+				return err
+			}
+		}
+	case string:
+		if l.MaxStringLength > 0 && len(v) > l.MaxStringLength {
+			return fmt.Errorf("%s: string of %d bytes exceeds limit %d", path, len(v), l.MaxStringLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestParamLimitsCheck(t *testing.T) {
+	limits := ParamLimits{MaxDepth: 3, MaxArrayLength: 4, MaxObjectKeys: 3, MaxStringLength: 8}
+
+	decode := func(data string) map[string]interface{} {
+		var params map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &params); err != nil {
+			t.Fatalf("Invalid test JSON %s: %v", data, err)
+		}
+		return params
+	}
+
+	tests := []struct {
+		name   string
+		params string
+		errAt  string // Expected path in the error, empty if accepted
+	}{
+		{"within limits", `{"a": [1, 2, {"b": "short"}], "c": "ok"}`, ""},
+		{"too deep", `{"a": {"b": {"c": {"d": 1}}}}`, "parameters.a.b.c"},
+		{"deep arrays", `{"a": [[[1]]]}`, "parameters.a[0][0]"},
+		{"long array", `{"a": [1, 2, 3, 4, 5]}`, "parameters.a"},
+		{"many keys", `{"a": 1, "b": 2, "c": 3, "d": 4}`, "parameters"},
+		{"long string", `{"a": ["fine", "far too long"]}`, "parameters.a[1]"},
+		{"long key", `{"averyverylongkey": 1}`, "parameters"},
+	}
+
+	for _, tt := range tests {
+		err := limits.Check(decode(tt.params))
+		switch {
+		case tt.errAt == "" && err != nil:
+			t.Errorf("%s: expected parameters to be accepted, got %v", tt.name, err)
+		case tt.errAt != "" && err == nil:
+			t.Errorf("%s: expected parameters to be rejected", tt.name)
+		case tt.errAt != "" && !strings.HasPrefix(err.Error(), tt.errAt+":"):
+			t.Errorf("%s: expected error at %s, got %v", tt.name, tt.errAt, err)
+		}
+	}
+
+	if err := (ParamLimits{}).Check(decode(`{"a": [[[[[["` + strings.Repeat("x", 1000) + `"]]]]]]}`)); err != nil {
+		t.Errorf("Expected zero limits to accept anything, got %v", err)
+	}
+}
+
+func TestBrokerRejectsOversizedParameters(t *testing.T) {
+	broker := NewBroker()
+	broker.SetParamLimits(ParamLimits{MaxArrayLength: 2})
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall},
+	}
+	env.Agent = "caller-agent"
+	env.Body, _ = json.Marshal(protocol.ToolCallBody{
+		Tool:       "math.sum",
+		Parameters: map[string]interface{}{"values": []interface{}{1, 2, 3}},
+	})
+
+	recorder := newBufferedResponse()
+	broker.handleToolCall(recorder, env)
+	if recorder.status != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if !strings.Contains(recorder.body.String(), "parameters.values") {
+		t.Errorf("Expected error to name the offending parameter, got %s", recorder.body.String())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+var (
+	// ErrDuplicateRequest is returned when a request ID is already outstanding
+	ErrDuplicateRequest = errors.New("request ID already pending")
+	// ErrUnknownRequest is returned for results that match no outstanding request
+	ErrUnknownRequest = errors.New("no pending request with that ID")
+	// ErrUnexpectedResponder is returned when a result comes from an agent
+	// other than the one the call was routed to
+	ErrUnexpectedResponder = errors.New("result sent by an agent other than the call target")
+	// ErrChunkOutOfOrder is returned for a relayed result chunk that is not
+	// the next one
+	ErrChunkOutOfOrder = errors.New("result chunk out of order")
+)
+
+// PendingRequest is an outstanding toolCall awaiting its toolResult
+type PendingRequest struct {
+	RequestID string
+	Caller    string
+	Target    string
+	Tool      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	result  chan protocol.ToolResultBody
+	relay   bool                      // Result chunks are relayed to the caller as they arrive
+	relayed uint64                    // Chunks relayed so far
+	chunks  *protocol.ResultAssembler // Chunks held until the result is complete
+}
+
+// PendingRequestTable correlates inbound toolResult envelopes with the
+// toolCall that produced them
+type PendingRequestTable struct {
+	requests map[string]*PendingRequest
+	timeout  time.Duration
+	mu       sync.Mutex
+}
+
+// NewPendingRequestTable creates a table whose requests expire after timeout
+func NewPendingRequestTable(timeout time.Duration) *PendingRequestTable {
+	return &PendingRequestTable{
+		requests: make(map[string]*PendingRequest),
+		timeout:  timeout,
+	}
+}
+
+// SetTimeout changes the expiry applied to newly tracked requests
+func (t *PendingRequestTable) SetTimeout(timeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeout = timeout
+}
+
+// Timeout returns the expiry applied to newly tracked requests
+func (t *PendingRequestTable) Timeout() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timeout
+}
+
+// Track records an outstanding request routed from caller to target
+func (t *PendingRequestTable) Track(requestID, caller, target, tool string) (*PendingRequest, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.requests[requestID]; exists {
+		return nil, ErrDuplicateRequest
+	}
+
+	now := time.Now()
+	req := &PendingRequest{
+		RequestID: requestID,
+		Caller:    caller,
+		Target:    target,
+		Tool:      tool,
+		CreatedAt: now,
+		ExpiresAt: now.Add(t.timeout),
+		result:    make(chan protocol.ToolResultBody, 1),
+	}
+	t.requests[requestID] = req
+	return req, nil
+}
+
+// SetDeadline brings a request's expiry forward to the caller's deadline,
+// if that comes first
+func (t *PendingRequestTable) SetDeadline(req *PendingRequest, deadline time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if deadline.Before(req.ExpiresAt) {
+		req.ExpiresAt = deadline
+	}
+}
+
+// Resolve delivers a result from the given agent to the waiting caller
+func (t *PendingRequestTable) Resolve(agentID string, result protocol.ToolResultBody) (*PendingRequest, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, exists := t.requests[result.RequestID]
+	if !exists {
+		return nil, ErrUnknownRequest
+	}
+	if req.Target != agentID {
+		return nil, ErrUnexpectedResponder
+	}
+
+	delete(t.requests, result.RequestID)
+	req.result <- result
+	return req, nil
+}
+
+// RelayChunks marks a request whose result chunks are relayed to its caller
+// as they arrive, instead of reassembled into one result
+func (t *PendingRequestTable) RelayChunks(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if req, exists := t.requests[requestID]; exists {
+		req.relay = true
+	}
+}
+
+// Chunk accounts for a result chunk from the given agent, reporting whether
+// the chunk is to be relayed to the caller. Relayed chunks must arrive in
+// order. Others are reassembled, up to maxBytes: the request is resolved
+// with the whole result once it is complete, or failed once it grows too
+// large.
+func (t *PendingRequestTable) Chunk(agentID string, chunk protocol.ToolResultChunkBody, maxBytes int64) (*PendingRequest, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, exists := t.requests[chunk.RequestID]
+	if !exists {
+		return nil, false, ErrUnknownRequest
+	}
+	if req.Target != agentID {
+		return nil, false, ErrUnexpectedResponder
+	}
+	if req.relay {
+		if chunk.Seq != req.relayed+1 {
+			return req, true, ErrChunkOutOfOrder
+		}
+		req.relayed++
+		return req, true, nil
+	}
+
+	if req.chunks == nil {
+		req.chunks = protocol.NewResultAssembler(chunk.RequestID, maxBytes)
+	}
+	complete, err := req.chunks.Add(chunk)
+	switch {
+	case errors.Is(err, protocol.ErrResultTooLarge):
+		delete(t.requests, chunk.RequestID)
+		req.result <- protocol.ToolResultBody{
+			RequestID: chunk.RequestID,
+			Error:     fmt.Sprintf("result exceeds %d bytes; call with streamResult over a live connection to receive it", maxBytes),
+		}
+	case err == nil && complete:
+		delete(t.requests, chunk.RequestID)
+		req.result <- req.chunks.Result()
+	}
+	return req, false, err
+}
+
+// Wait blocks until the request is resolved or expires. Expired requests are
+// removed and reported as a failed result with a timeout error.
+func (t *PendingRequestTable) Wait(req *PendingRequest) protocol.ToolResultBody {
+	timer := time.NewTimer(time.Until(req.ExpiresAt))
+	defer timer.Stop()
+
+	select {
+	case result := <-req.result:
+		return result
+	case <-timer.C:
+	}
+
+	t.mu.Lock()
+	if t.requests[req.RequestID] == req {
+		delete(t.requests, req.RequestID)
+	}
+	t.mu.Unlock()
+
+	// The result may have arrived while the timer fired
+	select {
+	case result := <-req.result:
+		return result
+	default:
+	}
+
+	return protocol.ToolResultBody{
+		RequestID: req.RequestID,
+		Success:   false,
+		Error:     "tool call timed out",
+	}
+}
+
+// Cancel drops a request without waiting for its result
+func (t *PendingRequestTable) Cancel(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.requests, requestID)
+}
+
+// Outstanding returns the requests still awaiting results, for handing
+// over to a successor broker
+func (t *PendingRequestTable) Outstanding() []protocol.HandoffRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	outstanding := make([]protocol.HandoffRequest, 0, len(t.requests))
+	for _, req := range t.requests {
+		outstanding = append(outstanding, protocol.HandoffRequest{
+			RequestID: req.RequestID,
+			Caller:    req.Caller,
+			Target:    req.Target,
+			Tool:      req.Tool,
+			Expires:   req.ExpiresAt.UnixMilli(),
+		})
+	}
+	return outstanding
+}
+
+// GetPendingCount returns the number of outstanding requests
+func (t *PendingRequestTable) GetPendingCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.requests)
+}
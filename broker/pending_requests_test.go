@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestPendingRequestTable(t *testing.T) {
+	table := NewPendingRequestTable(time.Second)
+
+	req, err := table.Track("req-1", "caller", "worker", "math.add")
+	if err != nil {
+		t.Fatalf("Failed to track request: %v", err)
+	}
+
+	if _, err := table.Track("req-1", "caller", "worker", "math.add"); err != ErrDuplicateRequest {
+		t.Errorf("Expected ErrDuplicateRequest, got %v", err)
+	}
+
+	if _, err := table.Resolve("impostor", protocol.ToolResultBody{RequestID: "req-1"}); err != ErrUnexpectedResponder {
+		t.Errorf("Expected ErrUnexpectedResponder, got %v", err)
+	}
+
+	if _, err := table.Resolve("worker", protocol.ToolResultBody{RequestID: "req-unknown"}); err != ErrUnknownRequest {
+		t.Errorf("Expected ErrUnknownRequest, got %v", err)
+	}
+
+	resolved, err := table.Resolve("worker", protocol.ToolResultBody{RequestID: "req-1", Success: true, Result: 8})
+	if err != nil {
+		t.Fatalf("Failed to resolve request: %v", err)
+	}
+	if resolved.Caller != "caller" {
+		t.Errorf("Expected caller 'caller', got %s", resolved.Caller)
+	}
+
+	result := table.Wait(req)
+	if !result.Success || result.Result != 8 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	if table.GetPendingCount() != 0 {
+		t.Errorf("Expected no pending requests, got %d", table.GetPendingCount())
+	}
+}
+
+func TestPendingRequestTimeout(t *testing.T) {
+	table := NewPendingRequestTable(20 * time.Millisecond)
+
+	req, err := table.Track("req-slow", "caller", "worker", "slow.tool")
+	if err != nil {
+		t.Fatalf("Failed to track request: %v", err)
+	}
+
+	result := table.Wait(req)
+	if result.Success || result.RequestID != "req-slow" || result.Error == "" {
+		t.Errorf("Expected timeout error result, got %+v", result)
+	}
+
+	if table.GetPendingCount() != 0 {
+		t.Errorf("Expected expired request to be removed, got %d pending", table.GetPendingCount())
+	}
+
+	// Late results are rejected once the request has expired
+	if _, err := table.Resolve("worker", protocol.ToolResultBody{RequestID: "req-slow"}); err != ErrUnknownRequest {
+		t.Errorf("Expected ErrUnknownRequest for late result, got %v", err)
+	}
+}
+
+func TestToolCallDeadline(t *testing.T) {
+	// A deadline only ever brings the expiry forward
+	table := NewPendingRequestTable(time.Minute)
+	req, _ := table.Track("req-1", "caller", "worker", "slow.tool")
+	table.SetDeadline(req, time.Now().Add(time.Hour))
+	if time.Until(req.ExpiresAt) > time.Minute {
+		t.Errorf("Expected a later deadline to be ignored, expires in %v", time.Until(req.ExpiresAt))
+	}
+
+	broker := NewBroker()
+	accepted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer accepted.Close()
+	broker.mcpRegistry.RegisterAgent("worker", &MCPAgent{
+		ID:          "worker",
+		MCPEndpoint: accepted.URL,
+		Tools:       []protocol.MCPTool{{Name: "deep.think"}},
+	})
+	call := func(deadline time.Time) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+		env.Agent = "caller"
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: "deep.think", RequestID: protocol.NewNonce(), Deadline: deadline.UnixMilli()})
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+		return recorder
+	}
+
+	// The broker stops waiting at the caller's deadline
+	start := time.Now()
+	recorder := call(start.Add(100 * time.Millisecond))
+	var result protocol.ToolResultEnvelope
+	json.Unmarshal(recorder.body.Bytes(), &result)
+	if result.Body.Success || result.Body.Error != "tool call timed out" || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the call to time out at its deadline, got %+v after %v", result.Body, time.Since(start))
+	}
+
+	// A call past its deadline is not routed at all
+	if recorder := call(time.Now().Add(-time.Second)); recorder.status != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 for a call past its deadline, got %d: %s", recorder.status, recorder.body.String())
+	}
+}
+
+func TestBrokerAsyncToolResult(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	// The worker signs its envelopes with the key it registered
+	workerKey, workerPrivKey, _ := ed25519.GenerateKey(nil)
+	broker.agents["worker"] = &Agent{ID: "worker", PubKey: workerKey}
+	post := func(envType protocol.EnvelopeType, agent string, body interface{}) (int, []byte) {
+		env := protocol.NewEnvelope(envType, agent)
+		env.Body, _ = json.Marshal(body)
+		if agent == "worker" {
+			protocol.SignEnvelope(env, workerPrivKey)
+		}
+		data, _ := json.Marshal(env)
+
+		resp, err := client.Post(server.URL+"/", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		payload, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, payload
+	}
+
+	// The worker accepts the call and posts its result back to the broker
+	mcpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Params struct {
+				Meta map[string]string `json:"_meta"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		requestID := request.Params.Meta["requestId"]
+
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			if status, payload := post(protocol.EnvelopeToolResult, "impostor", protocol.ToolResultBody{RequestID: requestID, Success: true}); status != http.StatusForbidden {
+				t.Errorf("Expected impostor result to be rejected, got %d: %s", status, payload)
+			}
+			if status, payload := post(protocol.EnvelopeToolResult, "worker", protocol.ToolResultBody{
+				RequestID: requestID,
+				Success:   true,
+				Result:    map[string]interface{}{"answer": 42},
+			}); status != http.StatusOK {
+				t.Errorf("Expected result to be delivered, got %d: %s", status, payload)
+			}
+		}()
+	}))
+	defer mcpServer.Close()
+
+	broker.mcpRegistry.RegisterAgent("worker", &MCPAgent{
+		ID:          "worker",
+		MCPEndpoint: mcpServer.URL,
+		Tools:       []protocol.MCPTool{{Name: "deep.think"}},
+	})
+
+	status, payload := post(protocol.EnvelopeToolCall, "caller", protocol.ToolCallBody{
+		Tool:      "deep.think",
+		RequestID: "req-async",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, payload)
+	}
+
+	var result protocol.ToolResultEnvelope
+	if err := json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("Failed to decode tool result: %v", err)
+	}
+
+	if result.Body.RequestID != "req-async" || !result.Body.Success {
+		t.Errorf("Unexpected tool result: %+v", result.Body)
+	}
+	if answer, _ := result.Body.Result.(map[string]interface{}); answer["answer"] != float64(42) {
+		t.Errorf("Expected answer 42, got %v", result.Body.Result)
+	}
+
+	if broker.pending.GetPendingCount() != 0 {
+		t.Errorf("Expected no pending requests, got %d", broker.pending.GetPendingCount())
+	}
+}
+
+func TestToolResultRequiresProvider(t *testing.T) {
+	broker := NewBroker()
+	workerKey, workerPrivKey, _ := ed25519.GenerateKey(nil)
+	_, otherPrivKey, _ := ed25519.GenerateKey(nil)
+	broker.agents["worker"] = &Agent{ID: "worker", PubKey: workerKey}
+	if _, err := broker.pending.Track("req-1", "caller", "worker", "deep.think"); err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+
+	result := func(agent string, signer ed25519.PrivateKey) int {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolResult}}
+		env.Agent = agent
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.ToolResultBody{RequestID: "req-1", Success: true})
+		if signer != nil {
+			protocol.SignEnvelope(env, signer)
+		}
+		recorder := newBufferedResponse()
+		broker.handleToolResult(recorder, env)
+		return recorder.status
+	}
+
+	// Results in the provider's name must be signed with its key
+	if status := result("worker", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned result to be refused, got %d", status)
+	}
+	if status := result("worker", otherPrivKey); status != http.StatusUnauthorized {
+		t.Errorf("Expected a result signed with another key to be refused, got %d", status)
+	}
+	if status := result("ghost", otherPrivKey); status != http.StatusForbidden {
+		t.Errorf("Expected a result from an unregistered agent to be refused, got %d", status)
+	}
+	if broker.pending.GetPendingCount() != 1 {
+		t.Fatal("Expected refused results to leave the call pending")
+	}
+	if status := result("worker", workerPrivKey); status != http.StatusOK {
+		t.Errorf("Expected the provider's result to be delivered, got %d", status)
+	}
+}
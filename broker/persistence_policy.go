@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultEnvelopeRetention is how long envelopes persisted in the storage
+// backend are kept when their rule gives no retention
+const defaultEnvelopeRetention = 30 * 24 * time.Hour
+
+// Where a persistence rule keeps accepted envelopes
+const (
+	PersistAudit = "audit" // The audit journal, if enabled; kept until rotated away
+	PersistStore = "store" // The storage backend, pruned after the rule's retention
+	PersistNone  = "none"  // Not persisted
+)
+
+// persistDefault is the policy key of the rule for types not listed
+const persistDefault = "*"
+
+// PersistenceRule says where envelopes of one type are persisted and, in
+// the storage backend, for how long
+type PersistenceRule struct {
+	Store     string
+	Retention time.Duration
+}
+
+// String formats the rule as it is written in a policy
+func (r PersistenceRule) String() string {
+	if r.Store == PersistStore && r.Retention != defaultEnvelopeRetention {
+		return r.Store + ":" + r.Retention.String()
+	}
+	return r.Store
+}
+
+// PersistencePolicy maps envelope types, or "*" for the rest, to the rule
+// for persisting them. Types no rule covers go to the audit journal, as
+// every envelope did before policies.
+type PersistencePolicy map[protocol.EnvelopeType]PersistenceRule
+
+// ParsePersistencePolicy parses comma-separated type=store[:retention]
+// rules, such as toolCall=store:720h,revoke=store,renderInstruction=none,*=audit
+func ParsePersistencePolicy(spec string) (PersistencePolicy, error) {
+	policy := make(PersistencePolicy)
+	for _, field := range parseSinkList(spec) {
+		envType, value, found := strings.Cut(field, "=")
+		if !found || envType == "" {
+			return nil, fmt.Errorf("invalid persistence rule %q, expected type=store[:retention]", field)
+		}
+		store, retention, hasRetention := strings.Cut(value, ":")
+		rule := PersistenceRule{Store: store}
+		switch store {
+		case PersistStore:
+			rule.Retention = defaultEnvelopeRetention
+			if hasRetention {
+				duration, err := time.ParseDuration(retention)
+				if err != nil || duration <= 0 {
+					return nil, fmt.Errorf("invalid %s retention %q, expected a positive duration", envType, retention)
+				}
+				rule.Retention = duration
+			}
+		case PersistAudit, PersistNone:
+			if hasRetention {
+				return nil, fmt.Errorf("invalid %s rule %q: only the store keeps envelopes for a retention", envType, value)
+			}
+		default:
+			return nil, fmt.Errorf("invalid %s rule %q, expected audit, store or none", envType, value)
+		}
+		policy[protocol.EnvelopeType(envType)] = rule
+	}
+	return policy, nil
+}
+
+// Rule returns the rule for an envelope type
+func (p PersistencePolicy) Rule(envType protocol.EnvelopeType) PersistenceRule {
+	if rule, exists := p[envType]; exists {
+		return rule
+	}
+	if rule, exists := p[persistDefault]; exists {
+		return rule
+	}
+	return PersistenceRule{Store: PersistAudit}
+}
+
+// UsesStore reports whether any rule persists envelopes in the storage
+// backend
+func (p PersistencePolicy) UsesStore() bool {
+	for _, rule := range p {
+		if rule.Store == PersistStore {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the policy as ParsePersistencePolicy reads it
+func (p PersistencePolicy) String() string {
+	rules := make([]string, 0, len(p))
+	for envType, rule := range p {
+		rules = append(rules, string(envType)+"="+rule.String())
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ",")
+}
+
+// StoredEnvelope is an accepted envelope kept in the storage backend
+type StoredEnvelope struct {
+	Type     protocol.EnvelopeType `json:"type"`
+	Agent    string                `json:"agent"`
+	Nonce    string                `json:"nonce"`
+	At       time.Time             `json:"at"`      // When the broker accepted the envelope
+	Expires  time.Time             `json:"expires"` // When it is pruned
+	Envelope json.RawMessage       `json:"envelope"`
+}
+
+// SetPersistencePolicy sets where accepted envelopes are persisted, by type
+func (b *Broker) SetPersistencePolicy(policy PersistencePolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.persistence = policy
+}
+
+// persistEnvelope persists an accepted envelope as the policy says.
+// Failures are logged; the envelope is still handled.
+func (b *Broker) persistEnvelope(env *protocol.GenericEnvelope) {
+	b.mu.RLock()
+	rule := b.persistence.Rule(env.Type)
+	store := b.store
+	b.mu.RUnlock()
+
+	switch rule.Store {
+	case PersistAudit:
+		b.recordAudit(env)
+	case PersistStore:
+		envelopes, ok := store.(EnvelopeStorage)
+		if !ok {
+			slog.Error("Storage cannot persist envelopes", "type", env.Type)
+			return
+		}
+		data, err := json.Marshal(env)
+		if err == nil {
+			now := time.Now()
+			err = envelopes.SaveEnvelope(StoredEnvelope{
+				Type:     env.Type,
+				Agent:    env.Agent,
+				Nonce:    env.Nonce,
+				At:       now,
+				Expires:  now.Add(rule.Retention),
+				Envelope: data,
+			})
+		}
+		if err != nil {
+			slog.Error("Failed to persist envelope", "type", env.Type, "agent", env.Agent, "nonce", env.Nonce, "error", err)
+		}
+	}
+}
+
+// handleStoredEnvelopes serves GET /admin/envelopes?type=, the envelopes
+// persisted in the storage backend in the order they were accepted
+func (b *Broker) handleStoredEnvelopes(w http.ResponseWriter, r *http.Request) {
+	envelopes, ok := b.storage().(EnvelopeStorage)
+	if !ok {
+		http.Error(w, "Storage does not persist envelopes", http.StatusNotFound)
+		return
+	}
+	stored, err := envelopes.LoadEnvelopes(protocol.EnvelopeType(r.URL.Query().Get("type")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if stored == nil {
+		stored = []StoredEnvelope{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestParsePersistencePolicy(t *testing.T) {
+	policy, err := ParsePersistencePolicy("toolCall=store:48h, revoke=store, renderInstruction=none, *=audit")
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	if rule := policy.Rule(protocol.EnvelopeToolCall); rule.Store != PersistStore || rule.Retention != 48*time.Hour {
+		t.Errorf("Unexpected toolCall rule: %+v", rule)
+	}
+	if rule := policy.Rule(protocol.EnvelopeRevoke); rule.Retention != defaultEnvelopeRetention {
+		t.Errorf("Expected the default retention for revoke, got %+v", rule)
+	}
+	if rule := policy.Rule(protocol.EnvelopeRenderInstruction); rule.Store != PersistNone {
+		t.Errorf("Unexpected renderInstruction rule: %+v", rule)
+	}
+	if !policy.UsesStore() {
+		t.Error("Expected the policy to use the store")
+	}
+	if got, want := policy.String(), "*=audit,renderInstruction=none,revoke=store,toolCall=store:48h0m0s"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// Types no rule covers go to the audit journal
+	if rule := (PersistencePolicy(nil)).Rule(protocol.EnvelopeEmitEvent); rule.Store != PersistAudit {
+		t.Errorf("Expected the audit journal by default, got %+v", rule)
+	}
+
+	for _, spec := range []string{"toolCall", "toolCall=disk", "toolCall=store:forever", "toolCall=store:-1h", "revoke=audit:1h", "=store"} {
+		if _, err := ParsePersistencePolicy(spec); err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+}
+
+// testEnvelopeStorage exercises the behaviour every EnvelopeStorage
+// implementation must share
+func testEnvelopeStorage(t *testing.T, store EnvelopeStorage) {
+	t.Helper()
+
+	now := time.Now()
+	for i, envType := range []protocol.EnvelopeType{protocol.EnvelopeToolCall, protocol.EnvelopeRevoke, protocol.EnvelopeToolCall} {
+		err := store.SaveEnvelope(StoredEnvelope{
+			Type:     envType,
+			Agent:    "agent-a",
+			Nonce:    protocol.NewNonce(),
+			At:       now.Add(time.Duration(i) * time.Millisecond),
+			Expires:  now.Add(time.Duration(i+1) * time.Hour),
+			Envelope: json.RawMessage(`{"seq":` + string(rune('0'+i)) + `}`),
+		})
+		if err != nil {
+			t.Fatalf("Failed to save envelope: %v", err)
+		}
+	}
+
+	calls, err := store.LoadEnvelopes(protocol.EnvelopeToolCall)
+	if err != nil || len(calls) != 2 || string(calls[0].Envelope) != `{"seq":0}` || string(calls[1].Envelope) != `{"seq":2}` {
+		t.Fatalf("Expected 2 toolCalls in order, got %+v (%v)", calls, err)
+	}
+	if all, _ := store.LoadEnvelopes(""); len(all) != 3 {
+		t.Errorf("Expected 3 envelopes, got %d", len(all))
+	}
+
+	if err := store.PruneEnvelopes(now.Add(90 * time.Minute)); err != nil {
+		t.Fatalf("Failed to prune envelopes: %v", err)
+	}
+	if all, _ := store.LoadEnvelopes(""); len(all) != 2 || all[0].Type != protocol.EnvelopeRevoke {
+		t.Errorf("Expected the expired envelope to be pruned, got %+v", all)
+	}
+}
+
+func TestMemoryStoreEnvelopes(t *testing.T) {
+	testEnvelopeStorage(t, NewMemoryStore())
+}
+
+func TestBoltStoreEnvelopes(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "broker.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	testEnvelopeStorage(t, store)
+}
+
+func TestBrokerPersistenceRouting(t *testing.T) {
+	broker := NewBroker()
+	store := NewMemoryStore()
+	if err := broker.SetStore(store); err != nil {
+		t.Fatalf("Failed to set store: %v", err)
+	}
+	journal, err := OpenAuditJournal(filepath.Join(t.TempDir(), "audit.jsonl"), 0, defaultAuditMaxBody)
+	if err != nil {
+		t.Fatalf("Failed to open audit journal: %v", err)
+	}
+	defer journal.Close()
+	broker.SetAuditJournal(journal)
+
+	policy, _ := ParsePersistencePolicy("toolCall=store:1h,renderInstruction=none")
+	broker.SetPersistencePolicy(policy)
+
+	broker.persistEnvelope(auditEnvelope("agent-a", protocol.EnvelopeToolCall, `{"tool":"math.add"}`))
+	broker.persistEnvelope(auditEnvelope("agent-a", protocol.EnvelopeRenderInstruction, `{}`))
+	broker.persistEnvelope(auditEnvelope("agent-a", protocol.EnvelopeEmitEvent, `{"event":"tick"}`))
+
+	stored, _ := store.LoadEnvelopes("")
+	if len(stored) != 1 || stored[0].Type != protocol.EnvelopeToolCall || stored[0].Expires.Sub(stored[0].At) != time.Hour {
+		t.Errorf("Expected only the toolCall in the store, kept for an hour, got %+v", stored)
+	}
+	records, _ := journal.Query(AuditQuery{})
+	if len(records) != 1 || records[0].Type != protocol.EnvelopeEmitEvent {
+		t.Errorf("Expected only the event in the audit journal, got %+v", records)
+	}
+
+	// Stored envelopes are listed for operators
+	broker.SetAdminToken(testAdminToken)
+	request := httptest.NewRequest(http.MethodGet, "/admin/envelopes?type=toolCall", nil)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	recorder := httptest.NewRecorder()
+	broker.ServeHTTP(recorder, request)
+	var listed []StoredEnvelope
+	if err := json.Unmarshal(recorder.Body.Bytes(), &listed); err != nil || len(listed) != 1 {
+		t.Errorf("Expected 1 stored toolCall, got %s", recorder.Body)
+	}
+	var env protocol.GenericEnvelope
+	if len(listed) == 1 && (json.Unmarshal(listed[0].Envelope, &env) != nil || env.Nonce != stored[0].Nonce) {
+		t.Errorf("Expected the stored envelope to be the one accepted, got %s", listed[0].Envelope)
+	}
+}
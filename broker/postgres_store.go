@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresMigrations holds the schema migrations applied by PostgresStore,
+// named <version>_<description>.sql and applied in version order
+//
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// postgresTimeout bounds each storage operation
+const postgresTimeout = 10 * time.Second
+
+// postgresMigrationLock is the advisory lock key held while migrating, so
+// brokers starting together against one database apply migrations once
+const postgresMigrationLock = 0x66656d
+
+// migration is one embedded schema change
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations reads the migrations in dir, sorted by version. Versions
+// must be unique.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a version number", entry.Name())
+		}
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, entry.Name(), version)
+		}
+		seen[version] = entry.Name()
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{Version: version, Name: name, SQL: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// PostgresStore persists broker state in PostgreSQL through pgx. Several
+// brokers may share one database: registrations made on any of them are
+// restored by all, and nonce checks are atomic across instances.
+type PostgresStore struct {
+	pool   *pgxpool.Pool
+	cipher *RecordCipher
+}
+
+// OpenPostgresStore connects to dsn and applies any pending migrations
+func OpenPostgresStore(dsn string) (*PostgresStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	store := &PostgresStore{pool: pool}
+	if err := store.migrate(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// migrate applies embedded migrations not yet recorded in
+// fem_schema_migrations, each in its own transaction
+func (s *PostgresStore) migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", postgresMigrationLock); err != nil {
+		return fmt.Errorf("failed to lock schema: %w", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", postgresMigrationLock)
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS fem_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := conn.Query(ctx, "SELECT version FROM fem_schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.SQL); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO fem_schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the connection pool
+func (s *PostgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+func (s *PostgresStore) opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), postgresTimeout)
+}
+
+// SetCipher encrypts records saved from now on; records already stored
+// stay readable
+func (s *PostgresStore) SetCipher(c *RecordCipher) {
+	s.cipher = c
+}
+
+// SaveAgent stores an agent, its MCP registration and its tools
+func (s *PostgresStore) SaveAgent(agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	agentData, err := s.cipher.seal(agent.ID, agent)
+	if err != nil {
+		return err
+	}
+
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `INSERT INTO fem_agents (id, data) VALUES ($1, $2)
+			ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, updated_at = now()`, agent.ID, string(agentData)); err != nil {
+			return err
+		}
+
+		if mcpAgent == nil {
+			if _, err := tx.Exec(ctx, "DELETE FROM fem_mcp_agents WHERE id = $1", agent.ID); err != nil {
+				return err
+			}
+		} else {
+			data, err := s.cipher.seal(agent.ID, mcpAgent)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `INSERT INTO fem_mcp_agents (id, data) VALUES ($1, $2)
+				ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, updated_at = now()`, agent.ID, string(data)); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(ctx, "DELETE FROM fem_tools WHERE agent_id = $1", agent.ID); err != nil {
+			return err
+		}
+		for _, tool := range tools {
+			data, err := s.cipher.seal(tool.AgentID, tool)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, "INSERT INTO fem_tools (agent_id, name, data) VALUES ($1, $2, $3)", tool.AgentID, tool.Tool.Name, string(data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteAgent removes an agent, its MCP registration and its tools
+func (s *PostgresStore) DeleteAgent(agentID string) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM fem_agents WHERE id = $1",
+			"DELETE FROM fem_mcp_agents WHERE id = $1",
+			"DELETE FROM fem_tools WHERE agent_id = $1",
+		} {
+			if _, err := tx.Exec(ctx, query, agentID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadJSON decodes every data column returned by query, in order
+func (s *PostgresStore) loadJSON(query string, decode func(data []byte) error) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		if err := decode([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LoadAgents returns all stored agents
+func (s *PostgresStore) LoadAgents() ([]*Agent, error) {
+	var agents []*Agent
+	err := s.loadJSON("SELECT data::text FROM fem_agents ORDER BY id", func(data []byte) error {
+		var agent Agent
+		if err := s.cipher.open(data, &agent); err != nil {
+			return fmt.Errorf("corrupt agent record: %w", err)
+		}
+		agents = append(agents, &agent)
+		return nil
+	})
+	return agents, err
+}
+
+// LoadMCPAgents returns all stored MCP registrations
+func (s *PostgresStore) LoadMCPAgents() ([]*MCPAgent, error) {
+	var agents []*MCPAgent
+	err := s.loadJSON("SELECT data::text FROM fem_mcp_agents ORDER BY id", func(data []byte) error {
+		var agent MCPAgent
+		if err := s.cipher.open(data, &agent); err != nil {
+			return fmt.Errorf("corrupt MCP agent record: %w", err)
+		}
+		agents = append(agents, &agent)
+		return nil
+	})
+	return agents, err
+}
+
+// LoadTools returns all stored tool index entries
+func (s *PostgresStore) LoadTools() ([]*RegisteredTool, error) {
+	var tools []*RegisteredTool
+	err := s.loadJSON("SELECT data::text FROM fem_tools ORDER BY agent_id, name", func(data []byte) error {
+		var tool RegisteredTool
+		if err := s.cipher.open(data, &tool); err != nil {
+			return fmt.Errorf("corrupt tool record: %w", err)
+		}
+		tools = append(tools, &tool)
+		return nil
+	})
+	return tools, err
+}
+
+// SaveSubscription stores an agent's subscription
+func (s *PostgresStore) SaveSubscription(sub Subscription) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	data, err := s.cipher.seal(sub.AgentID, sub)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `INSERT INTO fem_subscriptions (agent_id, data) VALUES ($1, $2)
+		ON CONFLICT (agent_id) DO UPDATE SET data = EXCLUDED.data, updated_at = now()`, sub.AgentID, string(data))
+	return err
+}
+
+// DeleteSubscription removes an agent's subscription
+func (s *PostgresStore) DeleteSubscription(agentID string) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, "DELETE FROM fem_subscriptions WHERE agent_id = $1", agentID)
+	return err
+}
+
+// LoadSubscriptions returns all stored subscriptions ordered by agent
+func (s *PostgresStore) LoadSubscriptions() ([]Subscription, error) {
+	var subs []Subscription
+	err := s.loadJSON("SELECT data::text FROM fem_subscriptions ORDER BY agent_id", func(data []byte) error {
+		var sub Subscription
+		if err := s.cipher.open(data, &sub); err != nil {
+			return fmt.Errorf("corrupt subscription record: %w", err)
+		}
+		subs = append(subs, sub)
+		return nil
+	})
+	return subs, err
+}
+
+// SaveRevocation stores what was revoked from an agent
+func (s *PostgresStore) SaveRevocation(revocation Revocation) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	data, err := s.cipher.seal(revocation.AgentID, revocation)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `INSERT INTO fem_revocations (agent_id, data) VALUES ($1, $2)
+		ON CONFLICT (agent_id) DO UPDATE SET data = EXCLUDED.data, updated_at = now()`, revocation.AgentID, string(data))
+	return err
+}
+
+// DeleteRevocation forgets what was revoked from an agent
+func (s *PostgresStore) DeleteRevocation(agentID string) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, "DELETE FROM fem_revocations WHERE agent_id = $1", agentID)
+	return err
+}
+
+// LoadRevocations returns all stored revocations ordered by agent
+func (s *PostgresStore) LoadRevocations() ([]Revocation, error) {
+	var revocations []Revocation
+	err := s.loadJSON("SELECT data::text FROM fem_revocations ORDER BY agent_id", func(data []byte) error {
+		var revocation Revocation
+		if err := s.cipher.open(data, &revocation); err != nil {
+			return fmt.Errorf("corrupt revocation record: %w", err)
+		}
+		revocations = append(revocations, revocation)
+		return nil
+	})
+	return revocations, err
+}
+
+// RecordNonce remembers a nonce, reporting whether it is new. A single
+// upsert either inserts the nonce or takes over an expired row, so brokers
+// sharing the database never both accept the same nonce.
+func (s *PostgresStore) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, `INSERT INTO fem_nonces (agent_id, nonce, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (agent_id, nonce) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE fem_nonces.expires_at <= $4`,
+		agentID, nonce, expiresAt.UnixMilli(), time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PruneNonces forgets expired nonces
+func (s *PostgresStore) PruneNonces(before time.Time) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, "DELETE FROM fem_nonces WHERE expires_at < $1", before.UnixMilli())
+	return err
+}
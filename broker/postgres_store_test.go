@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("Failed to load embedded migrations: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 || migrations[0].Name != "0001_initial" {
+		t.Fatalf("Unexpected embedded migrations: %+v", migrations)
+	}
+
+	fsys := fstest.MapFS{
+		"m/0010_later.sql":  {Data: []byte("SELECT 10")},
+		"m/0002_second.sql": {Data: []byte("SELECT 2")},
+		"m/README.md":       {Data: []byte("ignored")},
+	}
+	migrations, err = loadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 2 || migrations[1].Version != 10 || migrations[1].SQL != "SELECT 10" {
+		t.Errorf("Expected migrations in version order, got %+v", migrations)
+	}
+
+	fsys["m/0002_duplicate.sql"] = &fstest.MapFile{Data: []byte("SELECT 2")}
+	if _, err := loadMigrations(fsys, "m"); err == nil {
+		t.Error("Expected duplicate versions to be rejected")
+	}
+
+	if _, err := loadMigrations(fstest.MapFS{"m/initial.sql": {}}, "m"); err == nil {
+		t.Error("Expected unversioned migration to be rejected")
+	}
+}
+
+// TestPostgresStore runs against the database in FEM_TEST_POSTGRES_DSN
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("FEM_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("FEM_TEST_POSTGRES_DSN not set")
+	}
+
+	store, err := OpenPostgresStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	for _, table := range []string{"fem_agents", "fem_mcp_agents", "fem_tools", "fem_subscriptions", "fem_nonces"} {
+		if _, err := store.pool.Exec(context.Background(), "DELETE FROM "+table); err != nil {
+			t.Fatalf("Failed to clear %s: %v", table, err)
+		}
+	}
+
+	testStorage(t, store)
+
+	// Reopening applies no migrations twice
+	again, err := OpenPostgresStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	again.Close()
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// Raft defaults. Followers that hear nothing from a leader for an
+// election timeout start an election.
+const (
+	defaultRaftElectionTimeout = time.Second
+	// defaultRaftSnapshotThreshold is how many entries the log may gain
+	// before it is compacted into a snapshot, and how many a snapshot
+	// leaves behind for followers that are slightly behind
+	defaultRaftSnapshotThreshold = 1024
+	// raftProposeTimeout bounds how long a proposal waits to be committed
+	raftProposeTimeout = 5 * time.Second
+	// raftSnapshotsRetained is how many snapshots a node keeps on disk
+	raftSnapshotsRetained = 2
+	// raftMaxPool is how many connections a node keeps open to each peer
+	raftMaxPool = 3
+)
+
+var (
+	// ErrNoRaftLeader is returned for proposals while no leader is known
+	ErrNoRaftLeader = errors.New("no raft leader")
+	// ErrRaftLeadershipLost is returned for proposals overwritten by a new
+	// leader before they were committed
+	ErrRaftLeadershipLost = errors.New("raft leadership lost before commit")
+	// ErrRaftStopped is returned for proposals to a stopped node
+	ErrRaftStopped = errors.New("raft node stopped")
+)
+
+// RaftConfig configures one node of a raft cluster
+type RaftConfig struct {
+	ID    string            // Unique among the cluster's nodes
+	Peers map[string]string // The other nodes, by ID, as base URLs of their raft endpoints
+	Dir   string            // Where the node's log and snapshots are kept; in memory if empty
+	Token string            // Shared secret nodes present to each other
+
+	// Certificate is served to the other nodes, which only trust it if it
+	// chains to their RootCAs (the system's roots if nil)
+	Certificate *tls.Certificate
+	RootCAs     *x509.CertPool
+
+	ElectionTimeout   time.Duration
+	SnapshotThreshold int
+}
+
+// RaftStateMachine is what a raft node replicates
+type RaftStateMachine interface {
+	// Apply applies a committed command
+	Apply(command json.RawMessage)
+	// Snapshot returns the state after every applied command
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot
+	Restore(snapshot []byte) error
+}
+
+// raftFSM adapts a RaftStateMachine to the raft library
+type raftFSM struct {
+	machine RaftStateMachine
+}
+
+func (f raftFSM) Apply(entry *raft.Log) interface{} {
+	f.machine.Apply(entry.Data)
+	return nil
+}
+
+func (f raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	data, err := f.machine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return raftFSMSnapshot(data), nil
+}
+
+func (f raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	data, err := io.ReadAll(snapshot)
+	if err != nil {
+		return err
+	}
+	return f.machine.Restore(data)
+}
+
+// raftFSMSnapshot is the state machine as of one log index
+type raftFSMSnapshot []byte
+
+func (s raftFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftFSMSnapshot) Release() {}
+
+// RaftNode is one member of a raft cluster replicating a state machine,
+// built on hashicorp/raft. Commands are proposed to the leader, which
+// followers forward to, and are applied on every node in log order once a
+// majority has stored them. Nodes reach each other over the HTTPS endpoint
+// the node serves: raft traffic runs over connections upgraded at
+// /raft/stream, and forwarded proposals are posted to /raft/propose. A
+// node only talks to peers whose certificate it trusts, and only answers
+// requests bearing the cluster token.
+type RaftNode struct {
+	config  RaftConfig
+	fsm     raftFSM
+	logs    raft.LogStore
+	stable  raft.StableStore
+	snaps   raft.SnapshotStore
+	bolt    *raftboltdb.BoltStore // Backs logs and stable when the node has a directory
+	streams *raftStreamLayer
+	client  *http.Client
+	logger  hclog.Logger
+
+	mu      sync.Mutex
+	raft    *raft.Raft
+	stopped bool
+}
+
+// NewRaftNode creates a node applying committed commands to machine,
+// opening its log and snapshots in config.Dir if it has one. The node
+// takes part in the cluster once started.
+func NewRaftNode(config RaftConfig, machine RaftStateMachine) (*RaftNode, error) {
+	if config.ID == "" {
+		return nil, fmt.Errorf("raft node requires an ID")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("raft node requires a cluster token")
+	}
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = defaultRaftElectionTimeout
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = defaultRaftSnapshotThreshold
+	}
+
+	n := &RaftNode{
+		config: config,
+		fsm:    raftFSM{machine: machine},
+		client: &http.Client{
+			Timeout: raftProposeTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: config.RootCAs},
+			},
+		},
+		logger: hclog.FromStandardLogger(slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn), &hclog.LoggerOptions{
+			Name:  "raft",
+			Level: hclog.Warn,
+		}),
+	}
+	n.streams = newRaftStreamLayer(n)
+
+	if config.Dir == "" {
+		store := raft.NewInmemStore()
+		n.logs, n.stable, n.snaps = store, store, raft.NewInmemSnapshotStore()
+		return n, nil
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	bolt, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(config.Dir, "raft-"+config.ID+".db")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(config.Dir, raftSnapshotsRetained, n.logger)
+	if err != nil {
+		bolt.Close()
+		return nil, fmt.Errorf("failed to open raft snapshots: %w", err)
+	}
+	n.bolt, n.logs, n.stable, n.snaps = bolt, bolt, bolt, snaps
+	return n, nil
+}
+
+// SetPeers replaces the other nodes of the cluster. It must be called
+// before Start.
+func (n *RaftNode) SetPeers(peers map[string]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.config.Peers = peers
+}
+
+// Start begins taking part in elections and replication. A node without
+// state bootstraps the cluster of itself and its peers; every node is
+// given the same peers, so they agree on the cluster.
+func (n *RaftNode) Start() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return ErrRaftStopped
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(n.config.ID)
+	config.HeartbeatTimeout = n.config.ElectionTimeout
+	config.ElectionTimeout = n.config.ElectionTimeout
+	config.LeaderLeaseTimeout = n.config.ElectionTimeout / 2
+	config.SnapshotThreshold = uint64(n.config.SnapshotThreshold)
+	config.TrailingLogs = uint64(n.config.SnapshotThreshold)
+	config.Logger = n.logger
+
+	transport := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		ServerAddressProvider: raftPeerAddresses{n},
+		Logger:                n.logger,
+		Stream:                n.streams,
+		MaxPool:               raftMaxPool,
+		Timeout:               n.config.ElectionTimeout,
+	})
+
+	existing, err := raft.HasExistingState(n.logs, n.stable, n.snaps)
+	if err != nil {
+		return err
+	}
+	if !existing {
+		servers := []raft.Server{{ID: config.LocalID, Address: transport.LocalAddr()}}
+		for id, endpoint := range n.config.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(endpoint)})
+		}
+		if err := raft.BootstrapCluster(config, n.logs, n.stable, n.snaps, transport, raft.Configuration{Servers: servers}); err != nil {
+			return fmt.Errorf("failed to bootstrap raft cluster: %w", err)
+		}
+	}
+
+	node, err := raft.NewRaft(config, n.fsm, n.logs, n.stable, n.snaps, transport)
+	if err != nil {
+		return err
+	}
+	n.raft = node
+	return nil
+}
+
+// Stop leaves the cluster. Pending proposals fail with ErrRaftStopped.
+func (n *RaftNode) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	node := n.raft
+	n.mu.Unlock()
+
+	// Raft's goroutines take the lock to look up peers as they stop
+	if node != nil {
+		if err := node.Shutdown().Error(); err != nil {
+			slog.Error("Raft node failed to shut down", "node", n.config.ID, "error", err)
+		}
+	}
+	n.streams.Close()
+	if n.bolt != nil {
+		n.bolt.Close()
+	}
+}
+
+// node returns the running raft node, or nil before it starts or after it
+// stops
+func (n *RaftNode) node() *raft.Raft {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil
+	}
+	return n.raft
+}
+
+// Leader returns the ID of the current leader, if one is known
+func (n *RaftNode) Leader() string {
+	node := n.node()
+	if node == nil {
+		return ""
+	}
+	_, id := node.LeaderWithID()
+	return string(id)
+}
+
+// IsLeader reports whether this node is the leader
+func (n *RaftNode) IsLeader() bool {
+	node := n.node()
+	return node != nil && node.State() == raft.Leader
+}
+
+// Status describes the node for operators
+func (n *RaftNode) Status() map[string]interface{} {
+	n.mu.Lock()
+	status := map[string]interface{}{
+		"id":    n.config.ID,
+		"role":  "stopped",
+		"peers": len(n.config.Peers),
+	}
+	n.mu.Unlock()
+	node := n.node()
+	if node == nil {
+		return status
+	}
+	term, _ := strconv.ParseUint(node.Stats()["term"], 10, 64)
+	status["role"] = strings.ToLower(node.State().String())
+	status["term"] = term
+	status["leader"] = n.Leader()
+	status["commitIndex"] = node.CommitIndex()
+	status["lastApplied"] = node.AppliedIndex()
+	status["lastIndex"] = node.LastIndex()
+	return status
+}
+
+// Propose replicates a command and returns once it is committed and
+// applied. Followers forward the proposal to the leader, waiting for an
+// election in progress to elect one.
+func (n *RaftNode) Propose(command json.RawMessage) error {
+	deadline := time.Now().Add(raftProposeTimeout)
+	for {
+		node := n.node()
+		if node == nil {
+			return ErrRaftStopped
+		}
+		if node.State() == raft.Leader {
+			err := node.Apply(command, raftProposeTimeout).Error()
+			switch {
+			case errors.Is(err, raft.ErrRaftShutdown):
+				return ErrRaftStopped
+			case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost):
+				return ErrRaftLeadershipLost
+			}
+			return err
+		}
+
+		leader := n.Leader()
+		n.mu.Lock()
+		endpoint := n.config.Peers[leader]
+		n.mu.Unlock()
+		if endpoint != "" {
+			return n.forwardProposal(endpoint, command)
+		}
+		if time.Now().After(deadline) {
+			return ErrNoRaftLeader
+		}
+		time.Sleep(n.config.ElectionTimeout / 10)
+	}
+}
+
+// forwardProposal hands a proposal to the leader
+func (n *RaftNode) forwardProposal(endpoint string, command json.RawMessage) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/raft/propose", bytes.NewReader(command))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+n.config.Token)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("raft leader answered the proposal with %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// ServeHTTP serves the node's raft connections at /raft/stream, proposals
+// forwarded by followers at /raft/propose, and its status at /raft/status
+func (n *RaftNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(n.config.Token)) != 1 {
+		http.Error(w, "Invalid cluster token", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/raft/status" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.Status())
+	case r.URL.Path == "/raft/stream" && r.Method == http.MethodGet:
+		n.streams.accept(w, r)
+	case r.URL.Path == "/raft/propose" && r.Method == http.MethodPost:
+		var command json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid raft proposal: %v", err), http.StatusBadRequest)
+			return
+		}
+		// Proposals are only forwarded once, to whoever this node thinks leads
+		if !n.IsLeader() {
+			http.Error(w, ErrNoRaftLeader.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err := n.Propose(command); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "committed"})
+	case strings.HasPrefix(r.URL.Path, "/raft/"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// raftPeerAddresses resolves the endpoints of peers by ID from the node's
+// configuration, so a peer moved to another URL is reached there even
+// though the cluster was bootstrapped with its old one
+type raftPeerAddresses struct {
+	n *RaftNode
+}
+
+func (p raftPeerAddresses) ServerAddr(id raft.ServerID) (raft.ServerAddress, error) {
+	p.n.mu.Lock()
+	defer p.n.mu.Unlock()
+	endpoint, exists := p.n.config.Peers[string(id)]
+	if !exists {
+		return "", fmt.Errorf("unknown raft peer %s", id)
+	}
+	return raft.ServerAddress(endpoint), nil
+}
+
+// raftUpgrade is the protocol raft connections are upgraded to
+const raftUpgrade = "fem-raft"
+
+// raftStreamLayer carries raft's connections over the nodes' HTTPS
+// endpoints. A node dials a peer by asking its /raft/stream to upgrade the
+// connection, presenting the cluster token; the peer hands the upgraded
+// connection to raft as an accepted one.
+type raftStreamLayer struct {
+	n        *RaftNode
+	accepted chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newRaftStreamLayer(n *RaftNode) *raftStreamLayer {
+	return &raftStreamLayer{
+		n:        n,
+		accepted: make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+}
+
+// accept upgrades a request to /raft/stream and hands the connection to
+// raft
+func (s *raftStreamLayer) accept(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), raftUpgrade) {
+		http.Error(w, "Expected an upgrade to "+raftUpgrade, http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		slog.Warn("Raft connection upgrade failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", raftUpgrade); err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case s.accepted <- &bufferedConn{Conn: conn, reader: buffered.Reader}:
+	case <-s.closed:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection a peer upgraded
+func (s *raftStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case <-s.closed:
+		return nil, ErrRaftStopped
+	}
+}
+
+// Close stops accepting connections
+func (s *raftStreamLayer) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+// Addr names the node; peers are reached through the endpoints they are
+// configured with
+func (s *raftStreamLayer) Addr() net.Addr {
+	return raftNodeAddr(s.n.config.ID)
+}
+
+// Dial opens a raft connection to the peer whose endpoint is address
+func (s *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	endpoint, err := url.Parse(string(address))
+	if err != nil {
+		return nil, fmt.Errorf("invalid raft peer endpoint %q: %w", address, err)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", endpoint.Host, &tls.Config{
+		RootCAs:    s.n.config.RootCAs,
+		NextProtos: []string{"http/1.1"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, strings.TrimSuffix(endpoint.String(), "/")+"/raft/stream", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", raftUpgrade)
+	req.Header.Set("Authorization", "Bearer "+s.n.config.Token)
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(reader, req)
+	}
+	if err == nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("raft peer refused the connection with %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// raftNodeAddr is a node's address as raft sees it: its ID
+type raftNodeAddr string
+
+func (a raftNodeAddr) Network() string { return raftUpgrade }
+func (a raftNodeAddr) String() string  { return string(a) }
+
+// bufferedConn is a connection whose first bytes were read into a buffer
+// while it was upgraded
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry mutations replicated through raft
+const (
+	raftOpSaveAgent          = "saveAgent"
+	raftOpDeleteAgent        = "deleteAgent"
+	raftOpSaveSubscription   = "saveSubscription"
+	raftOpDeleteSubscription = "deleteSubscription"
+	raftOpSaveRevocation     = "saveRevocation"
+	raftOpDeleteRevocation   = "deleteRevocation"
+)
+
+// raftCommand is one registry mutation in the raft log
+type raftCommand struct {
+	Op           string            `json:"op"`
+	Origin       string            `json:"origin"` // Node that proposed the change
+	Agent        *Agent            `json:"agent,omitempty"`
+	MCPAgent     *MCPAgent         `json:"mcpAgent,omitempty"`
+	Tools        []*RegisteredTool `json:"tools,omitempty"`
+	AgentID      string            `json:"agentId,omitempty"`
+	Subscription *Subscription     `json:"subscription,omitempty"`
+	Revocation   *Revocation       `json:"revocation,omitempty"`
+}
+
+// agentID returns the agent a command changes
+func (c raftCommand) agentID() string {
+	switch {
+	case c.Agent != nil:
+		return c.Agent.ID
+	case c.Subscription != nil:
+		return c.Subscription.AgentID
+	case c.Revocation != nil:
+		return c.Revocation.AgentID
+	}
+	return c.AgentID
+}
+
+// raftSnapshot is the replicated state at one point of the log
+type raftSnapshot struct {
+	Agents        []*Agent          `json:"agents"`
+	MCPAgents     []*MCPAgent       `json:"mcpAgents"`
+	Tools         []*RegisteredTool `json:"tools"`
+	Subscriptions []Subscription    `json:"subscriptions"`
+	Revocations   []Revocation      `json:"revocations,omitempty"`
+
+	// Sealed holds the state as encrypted saveAgent, saveSubscription and
+	// saveRevocation commands, one per agent, instead of the fields above
+	// when records are encrypted
+	Sealed []json.RawMessage `json:"sealed,omitempty"`
+}
+
+// RaftStore is a SharedStorage whose agents, tools and subscriptions are
+// replicated to every broker of a cluster through raft, so all of them see
+// one consistent registry. Writes are committed by the leader, which the
+// cluster elects again if it fails. Nonces are recorded per broker.
+type RaftStore struct {
+	node   *RaftNode
+	state  *MemoryStore
+	nonces *MemoryStore
+	server *http.Server
+	cipher *RecordCipher
+
+	onChange func(agentID string)
+	watchMu  sync.RWMutex
+}
+
+// NewRaftStore creates the store and its raft node without starting them.
+// If cipher is not nil, log entries and snapshots are encrypted with it.
+func NewRaftStore(config RaftConfig, cipher *RecordCipher) (*RaftStore, error) {
+	store := &RaftStore{
+		state:  NewMemoryStore(),
+		nonces: NewMemoryStore(),
+		cipher: cipher,
+	}
+	node, err := NewRaftNode(config, store)
+	if err != nil {
+		return nil, err
+	}
+	store.node = node
+	return store, nil
+}
+
+// OpenRaftStore starts a raft node serving its peers over HTTPS on listen.
+// The node must have a cluster token and a certificate its peers trust.
+func OpenRaftStore(config RaftConfig, listen string, cipher *RecordCipher) (*RaftStore, error) {
+	if config.Certificate == nil {
+		return nil, fmt.Errorf("raft storage requires a certificate its peers trust")
+	}
+	if len(config.Peers) == 0 {
+		slog.Warn("Raft node has no peers; running a single-node cluster", "node", config.ID)
+	}
+	store, err := NewRaftStore(config, cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	store.server = &http.Server{
+		Addr:    listen,
+		Handler: store.node,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*config.Certificate},
+			MinVersion:   tls.VersionTLS13,
+		},
+	}
+	go func() {
+		if err := store.server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			slog.Error("Raft listener failed", "listen", listen, "error", err)
+		}
+	}()
+
+	if err := store.node.Start(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	slog.Info("Raft node listening", "node", config.ID, "listen", listen, "peers", len(config.Peers))
+	return store, nil
+}
+
+// LoadRaftTLS reads the certificate a raft node serves and, if caFile is
+// not empty, the CA its peers' certificates must chain to
+func LoadRaftTLS(caFile, certFile, keyFile string) (*tls.Certificate, *x509.CertPool, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, nil, fmt.Errorf("-raft-cert and -raft-key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if caFile == "" {
+		return &cert, nil, nil
+	}
+	roots, err := LoadClientCAs(caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cert, roots, nil
+}
+
+// ParseRaftPeers parses peers written as "id=url,id=url"
+func ParseRaftPeers(spec string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, field := range parseSinkList(spec) {
+		id, endpoint, found := strings.Cut(field, "=")
+		if !found || id == "" || endpoint == "" {
+			return nil, fmt.Errorf("invalid raft peer %q, expected id=url", field)
+		}
+		peers[id] = endpoint
+	}
+	return peers, nil
+}
+
+// propose replicates a mutation, returning once the cluster committed it
+func (s *RaftStore) propose(command raftCommand) error {
+	command.Origin = s.node.config.ID
+	data, err := s.cipher.seal(command.agentID(), command)
+	if err != nil {
+		return err
+	}
+	return s.node.Propose(data)
+}
+
+// Apply applies a committed mutation to the local copy of the registry,
+// reporting agents changed through other brokers to the watcher
+func (s *RaftStore) Apply(data json.RawMessage) {
+	var command raftCommand
+	if err := s.cipher.open(data, &command); err != nil {
+		slog.Warn("Skipping invalid raft command", "error", err)
+		return
+	}
+	s.apply(command)
+}
+
+// apply makes one decoded mutation
+func (s *RaftStore) apply(command raftCommand) {
+	var changed string
+	switch command.Op {
+	case raftOpSaveAgent:
+		if command.Agent == nil {
+			return
+		}
+		s.state.SaveAgent(command.Agent, command.MCPAgent, command.Tools)
+		changed = command.Agent.ID
+	case raftOpDeleteAgent:
+		s.state.DeleteAgent(command.AgentID)
+		changed = command.AgentID
+	case raftOpSaveSubscription:
+		if command.Subscription != nil {
+			s.state.SaveSubscription(*command.Subscription)
+		}
+	case raftOpDeleteSubscription:
+		s.state.DeleteSubscription(command.AgentID)
+	case raftOpSaveRevocation:
+		if command.Revocation != nil {
+			s.state.SaveRevocation(*command.Revocation)
+		}
+	case raftOpDeleteRevocation:
+		s.state.DeleteRevocation(command.AgentID)
+	default:
+		slog.Warn("Skipping unknown raft command", "op", command.Op)
+	}
+
+	if changed != "" && command.Origin != s.node.config.ID {
+		s.notify(changed)
+	}
+}
+
+// Snapshot captures the replicated state
+func (s *RaftStore) Snapshot() ([]byte, error) {
+	var snapshot raftSnapshot
+	snapshot.Agents, _ = s.state.LoadAgents()
+	snapshot.Subscriptions, _ = s.state.LoadSubscriptions()
+	snapshot.Revocations, _ = s.state.LoadRevocations()
+	if s.cipher == nil {
+		snapshot.MCPAgents, _ = s.state.LoadMCPAgents()
+		snapshot.Tools, _ = s.state.LoadTools()
+		return json.Marshal(snapshot)
+	}
+
+	// Each agent is sealed on its own, under its namespace's key
+	var commands []raftCommand
+	for _, agent := range snapshot.Agents {
+		_, mcpAgent, tools, _ := s.LoadAgent(agent.ID)
+		commands = append(commands, raftCommand{Op: raftOpSaveAgent, Agent: agent, MCPAgent: mcpAgent, Tools: tools})
+	}
+	for i := range snapshot.Subscriptions {
+		commands = append(commands, raftCommand{Op: raftOpSaveSubscription, Subscription: &snapshot.Subscriptions[i]})
+	}
+	for i := range snapshot.Revocations {
+		commands = append(commands, raftCommand{Op: raftOpSaveRevocation, Revocation: &snapshot.Revocations[i]})
+	}
+	sealed := raftSnapshot{Sealed: make([]json.RawMessage, 0, len(commands))}
+	for _, command := range commands {
+		data, err := s.cipher.seal(command.agentID(), command)
+		if err != nil {
+			return nil, err
+		}
+		sealed.Sealed = append(sealed.Sealed, data)
+	}
+	return json.Marshal(sealed)
+}
+
+// Restore replaces the replicated state with a snapshot, reporting every
+// agent that was or is now stored to the watcher
+func (s *RaftStore) Restore(data []byte) error {
+	var snapshot raftSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	state := NewMemoryStore()
+	for _, data := range snapshot.Sealed {
+		var command raftCommand
+		if err := s.cipher.open(data, &command); err != nil {
+			return err
+		}
+		if command.Agent != nil {
+			state.SaveAgent(command.Agent, command.MCPAgent, command.Tools)
+		}
+		if command.Subscription != nil {
+			state.SaveSubscription(*command.Subscription)
+		}
+		if command.Revocation != nil {
+			state.SaveRevocation(*command.Revocation)
+		}
+	}
+	for _, agent := range snapshot.Agents {
+		state.agents[agent.ID] = agent
+	}
+	for _, agent := range snapshot.MCPAgents {
+		state.mcpAgents[agent.ID] = agent
+	}
+	for _, tool := range snapshot.Tools {
+		state.tools[toolKey(tool.AgentID, tool.Tool.Name)] = tool
+	}
+	for _, sub := range snapshot.Subscriptions {
+		state.subscriptions[sub.AgentID] = sub
+	}
+	for _, revocation := range snapshot.Revocations {
+		state.revocations[revocation.AgentID] = revocation
+	}
+
+	affected := make(map[string]bool)
+	s.state.mu.Lock()
+	for agentID := range s.state.agents {
+		affected[agentID] = true
+	}
+	s.state.agents = state.agents
+	s.state.mcpAgents = state.mcpAgents
+	s.state.tools = state.tools
+	s.state.subscriptions = state.subscriptions
+	s.state.revocations = state.revocations
+	for agentID := range s.state.agents {
+		affected[agentID] = true
+	}
+	s.state.mu.Unlock()
+
+	for agentID := range affected {
+		s.notify(agentID)
+	}
+	return nil
+}
+
+// notify reports a changed agent to the watcher, if there is one
+func (s *RaftStore) notify(agentID string) {
+	s.watchMu.RLock()
+	onChange := s.onChange
+	s.watchMu.RUnlock()
+	if onChange != nil {
+		onChange(agentID)
+	}
+}
+
+// SaveAgent replicates an agent with its MCP registration and tools
+func (s *RaftStore) SaveAgent(agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool) error {
+	return s.propose(raftCommand{Op: raftOpSaveAgent, Agent: agent, MCPAgent: mcpAgent, Tools: tools})
+}
+
+// DeleteAgent replicates the removal of an agent
+func (s *RaftStore) DeleteAgent(agentID string) error {
+	return s.propose(raftCommand{Op: raftOpDeleteAgent, AgentID: agentID})
+}
+
+// LoadAgents returns the agents applied on this broker
+func (s *RaftStore) LoadAgents() ([]*Agent, error) {
+	return s.state.LoadAgents()
+}
+
+// LoadMCPAgents returns the MCP registrations applied on this broker
+func (s *RaftStore) LoadMCPAgents() ([]*MCPAgent, error) {
+	return s.state.LoadMCPAgents()
+}
+
+// LoadTools returns the tool index entries applied on this broker
+func (s *RaftStore) LoadTools() ([]*RegisteredTool, error) {
+	return s.state.LoadTools()
+}
+
+// LoadAgent returns one agent as applied on this broker
+func (s *RaftStore) LoadAgent(agentID string) (*Agent, *MCPAgent, []*RegisteredTool, error) {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+
+	agent, exists := s.state.agents[agentID]
+	if !exists {
+		return nil, nil, nil, nil
+	}
+	var tools []*RegisteredTool
+	for key, tool := range s.state.tools {
+		if strings.HasPrefix(key, agentID+"/") {
+			tools = append(tools, tool)
+		}
+	}
+	return agent, s.state.mcpAgents[agentID], tools, nil
+}
+
+// WatchRegistry calls onChange for agents changed through other brokers
+// until the store is closed
+func (s *RaftStore) WatchRegistry(onChange func(agentID string)) error {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	s.onChange = onChange
+	return nil
+}
+
+// SaveSubscription replicates an agent's subscription
+func (s *RaftStore) SaveSubscription(sub Subscription) error {
+	return s.propose(raftCommand{Op: raftOpSaveSubscription, Subscription: &sub})
+}
+
+// DeleteSubscription replicates the removal of an agent's subscription
+func (s *RaftStore) DeleteSubscription(agentID string) error {
+	return s.propose(raftCommand{Op: raftOpDeleteSubscription, AgentID: agentID})
+}
+
+// LoadSubscriptions returns the subscriptions applied on this broker
+func (s *RaftStore) LoadSubscriptions() ([]Subscription, error) {
+	return s.state.LoadSubscriptions()
+}
+
+// SaveRevocation replicates what was revoked from an agent
+func (s *RaftStore) SaveRevocation(revocation Revocation) error {
+	return s.propose(raftCommand{Op: raftOpSaveRevocation, Revocation: &revocation})
+}
+
+// DeleteRevocation replicates the lifting of an agent's revocations
+func (s *RaftStore) DeleteRevocation(agentID string) error {
+	return s.propose(raftCommand{Op: raftOpDeleteRevocation, AgentID: agentID})
+}
+
+// LoadRevocations returns the revocations applied on this broker
+func (s *RaftStore) LoadRevocations() ([]Revocation, error) {
+	return s.state.LoadRevocations()
+}
+
+// RecordNonce remembers a nonce on this broker only; replicating every
+// envelope's nonce would put the log on the path of every request
+func (s *RaftStore) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	return s.nonces.RecordNonce(agentID, nonce, expiresAt)
+}
+
+// PruneNonces forgets expired nonces
+func (s *RaftStore) PruneNonces(before time.Time) error {
+	return s.nonces.PruneNonces(before)
+}
+
+// Close leaves the cluster and stops serving raft RPCs
+func (s *RaftStore) Close() error {
+	s.node.Stop()
+	if s.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	"github.com/hashicorp/raft"
+)
+
+// raftTestNode is a cluster member whose raft endpoint can be cut off
+type raftTestNode struct {
+	store   *RaftStore
+	server  *httptest.Server
+	blocked atomic.Bool
+
+	mu    sync.Mutex
+	conns []net.Conn // Raft connections peers opened to the node
+}
+
+func (n *raftTestNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if n.blocked.Load() {
+		http.Error(w, "partitioned", http.StatusServiceUnavailable)
+		return
+	}
+	n.store.node.ServeHTTP(&raftTestWriter{ResponseWriter: w, node: n}, r)
+}
+
+// partition cuts the node off from its peers' connections until it is
+// reconnected
+func (n *raftTestNode) partition() {
+	n.blocked.Store(true)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.conns = nil
+}
+
+// raftTestWriter records the connections the node upgrades
+type raftTestWriter struct {
+	http.ResponseWriter
+	node *raftTestNode
+}
+
+func (w *raftTestWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buffered, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		w.node.mu.Lock()
+		w.node.conns = append(w.node.conns, conn)
+		w.node.mu.Unlock()
+	}
+	return conn, buffered, err
+}
+
+// raftCluster starts size nodes with fast timings
+func raftCluster(t *testing.T, size int, snapshotThreshold int) []*raftTestNode {
+	t.Helper()
+
+	nodes := make([]*raftTestNode, size)
+	for i := range nodes {
+		store, err := NewRaftStore(RaftConfig{
+			ID:                fmt.Sprintf("node-%d", i),
+			Token:             "cluster-secret",
+			RootCAs:           raftTestRoots(),
+			ElectionTimeout:   150 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+		}, nil)
+		if err != nil {
+			t.Fatalf("Failed to create raft store: %v", err)
+		}
+		nodes[i] = &raftTestNode{store: store}
+		nodes[i].server = httptest.NewTLSServer(nodes[i])
+	}
+
+	for i, node := range nodes {
+		peers := make(map[string]string)
+		for j, peer := range nodes {
+			if i != j {
+				peers[peer.store.node.config.ID] = peer.server.URL
+			}
+		}
+		node.store.node.SetPeers(peers)
+		if err := node.store.node.Start(); err != nil {
+			t.Fatalf("Failed to start raft node: %v", err)
+		}
+	}
+
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.store.Close()
+			node.server.Close()
+		}
+	})
+	return nodes
+}
+
+// raftTestRoots trusts the certificate httptest's TLS servers present
+func raftTestRoots() *x509.CertPool {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return roots
+}
+
+// raftTestTLSFiles writes httptest's certificate and key as a node's
+// -raft-cert and -raft-key, and the certificate as -raft-ca
+func raftTestTLSFiles(t *testing.T) (caFile, certFile, keyFile string) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	key, err := x509.MarshalPKCS8PrivateKey(server.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "raft.crt"), filepath.Join(dir, "raft.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	return certFile, certFile, keyFile
+}
+
+// waitForRaft polls condition until it holds or a few seconds pass
+func waitForRaft(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// awaitRaftLeader waits for exactly one of the reachable nodes to lead
+func awaitRaftLeader(t *testing.T, nodes []*raftTestNode) *raftTestNode {
+	t.Helper()
+	var leader *raftTestNode
+	waitForRaft(t, "a leader", func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if node.blocked.Load() || !node.store.node.IsLeader() {
+				continue
+			}
+			if leader != nil {
+				return false
+			}
+			leader = node
+		}
+		return leader != nil
+	})
+	return leader
+}
+
+func TestRaftStoreReplicates(t *testing.T) {
+	nodes := raftCluster(t, 3, 0)
+	leader := awaitRaftLeader(t, nodes)
+
+	var follower *raftTestNode
+	for _, node := range nodes {
+		if node != leader {
+			follower = node
+			break
+		}
+	}
+
+	changed := make(chan string, 4)
+	leader.store.WatchRegistry(func(agentID string) { changed <- agentID })
+
+	// Followers forward writes to the leader
+	agent := &Agent{ID: "agent-a", Capabilities: []string{"code.execute"}}
+	tools := []*RegisteredTool{{AgentID: "agent-a", Tool: protocol.MCPTool{Name: "code.run"}}}
+	if err := follower.store.SaveAgent(agent, &MCPAgent{ID: "agent-a"}, tools); err != nil {
+		t.Fatalf("SaveAgent through a follower failed: %v", err)
+	}
+	for _, node := range nodes {
+		waitForRaft(t, "the agent to replicate", func() bool {
+			stored, mcpAgent, tools, _ := node.store.LoadAgent("agent-a")
+			return stored != nil && mcpAgent != nil && len(tools) == 1
+		})
+	}
+
+	select {
+	case agentID := <-changed:
+		if agentID != "agent-a" {
+			t.Errorf("Expected a change to agent-a, got %s", agentID)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the leader to report the follower's change")
+	}
+
+	if err := leader.store.SaveSubscription(Subscription{AgentID: "agent-a", Patterns: []string{"code.*"}}); err != nil {
+		t.Fatalf("SaveSubscription failed: %v", err)
+	}
+	if err := leader.store.DeleteAgent("agent-a"); err != nil {
+		t.Fatalf("DeleteAgent failed: %v", err)
+	}
+	for _, node := range nodes {
+		waitForRaft(t, "the removal to replicate", func() bool {
+			stored, _, _, _ := node.store.LoadAgent("agent-a")
+			subs, _ := node.store.LoadSubscriptions()
+			return stored == nil && len(subs) == 1
+		})
+	}
+}
+
+func TestRaftLeaderFailover(t *testing.T) {
+	nodes := raftCluster(t, 3, 0)
+	leader := awaitRaftLeader(t, nodes)
+
+	if err := leader.store.SaveAgent(&Agent{ID: "before"}, nil, nil); err != nil {
+		t.Fatalf("SaveAgent failed: %v", err)
+	}
+
+	// Cut the leader off; the others elect a new one and keep accepting writes
+	leader.partition()
+	leader.store.node.Stop()
+
+	next := awaitRaftLeader(t, nodes)
+	if next == leader {
+		t.Fatal("Expected a new leader")
+	}
+	if err := next.store.SaveAgent(&Agent{ID: "after"}, nil, nil); err != nil {
+		t.Fatalf("SaveAgent after failover failed: %v", err)
+	}
+	for _, node := range nodes {
+		if node == leader {
+			continue
+		}
+		waitForRaft(t, "both agents on the survivors", func() bool {
+			agents, _ := node.store.LoadAgents()
+			return len(agents) == 2
+		})
+	}
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	nodes := raftCluster(t, 3, 4)
+	leader := awaitRaftLeader(t, nodes)
+
+	var lagging *raftTestNode
+	for _, node := range nodes {
+		if node != leader {
+			lagging = node
+			break
+		}
+	}
+	lagging.partition()
+
+	for i := 0; i < 10; i++ {
+		if err := leader.store.SaveAgent(&Agent{ID: fmt.Sprintf("agent-%d", i)}, nil, nil); err != nil {
+			t.Fatalf("SaveAgent %d failed: %v", i, err)
+		}
+	}
+	if err := leader.store.node.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	// The leader compacted its log, so the node catches up from a snapshot
+	changed := make(chan string, 16)
+	lagging.store.WatchRegistry(func(agentID string) { changed <- agentID })
+	lagging.blocked.Store(false)
+	waitForRaft(t, "the lagging node to catch up", func() bool {
+		agents, _ := lagging.store.LoadAgents()
+		return len(agents) == 10
+	})
+	if len(changed) == 0 {
+		t.Error("Expected the restored agents to be reported")
+	}
+}
+
+func TestRaftStorePersists(t *testing.T) {
+	config := RaftConfig{
+		ID:              "solo",
+		Token:           "cluster-secret",
+		Dir:             t.TempDir(),
+		ElectionTimeout: 50 * time.Millisecond,
+	}
+
+	store, err := NewRaftStore(config, nil)
+	if err != nil {
+		t.Fatalf("Failed to create raft store: %v", err)
+	}
+	if err := store.node.Start(); err != nil {
+		t.Fatalf("Failed to start raft node: %v", err)
+	}
+	waitForRaft(t, "a single node to lead", store.node.IsLeader)
+	if err := store.SaveAgent(&Agent{ID: "agent-a"}, nil, nil); err != nil {
+		t.Fatalf("SaveAgent failed: %v", err)
+	}
+	store.Close()
+
+	reopened, err := NewRaftStore(config, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen raft store: %v", err)
+	}
+	if err := reopened.node.Start(); err != nil {
+		t.Fatalf("Failed to restart raft node: %v", err)
+	}
+	defer reopened.Close()
+	waitForRaft(t, "the log to be applied again", func() bool {
+		agent, _, _, _ := reopened.LoadAgent("agent-a")
+		return agent != nil
+	})
+}
+
+func TestRaftStreamRequiresToken(t *testing.T) {
+	store, err := NewRaftStore(RaftConfig{ID: "node-a", Token: "cluster-secret", RootCAs: raftTestRoots()}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create raft store: %v", err)
+	}
+	defer store.Close()
+	node := store.node
+	server := httptest.NewTLSServer(node)
+	defer server.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := node.streams.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	for _, tc := range []struct {
+		token string
+		roots *x509.CertPool
+		ok    bool
+	}{
+		{"guess", raftTestRoots(), false},
+		{"cluster-secret", nil, false}, // The node's certificate is not trusted
+		{"cluster-secret", raftTestRoots(), true},
+	} {
+		peer, _ := NewRaftStore(RaftConfig{ID: "node-b", Token: tc.token, RootCAs: tc.roots}, nil)
+		conn, err := peer.node.streams.Dial(raft.ServerAddress(server.URL), time.Second)
+		if (err == nil) != tc.ok {
+			t.Errorf("Token %q, trusted %v: expected the connection to succeed %v, got %v", tc.token, tc.roots != nil, tc.ok, err)
+		}
+		if conn != nil {
+			conn.Write([]byte("ping"))
+			conn.Close()
+		}
+	}
+
+	select {
+	case conn := <-accepted:
+		buffer := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "ping" {
+			t.Errorf("Expected the upgraded connection to carry the peer's bytes, got %q, %v", buffer, err)
+		}
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Error("Expected the upgraded connection to be accepted")
+	}
+}
+
+func TestRaftRequiresTokenAndCertificate(t *testing.T) {
+	if _, err := NewRaftStore(RaftConfig{ID: "node-a"}, nil); err == nil {
+		t.Error("Expected a node without a cluster token to be refused")
+	}
+	if _, err := OpenRaftStore(RaftConfig{ID: "node-a", Token: "cluster-secret"}, "127.0.0.1:0", nil); err == nil {
+		t.Error("Expected a node without a certificate to be refused")
+	}
+
+	caFile, certFile, keyFile := raftTestTLSFiles(t)
+	if _, _, err := LoadRaftTLS("", "", ""); err == nil {
+		t.Error("Expected -raft-cert and -raft-key to be required")
+	}
+	cert, roots, err := LoadRaftTLS(caFile, certFile, keyFile)
+	if err != nil || cert == nil || roots == nil {
+		t.Fatalf("Failed to load raft certificates: %v", err)
+	}
+}
+
+func TestParseRaftPeers(t *testing.T) {
+	peers, err := ParseRaftPeers("b=https://b:9443, c=https://c:9443")
+	if err != nil {
+		t.Fatalf("Failed to parse peers: %v", err)
+	}
+	if len(peers) != 2 || peers["b"] != "https://b:9443" || peers["c"] != "https://c:9443" {
+		t.Errorf("Unexpected peers: %v", peers)
+	}
+	if _, err := ParseRaftPeers("https://b:9443"); err == nil {
+		t.Error("Expected a peer without an ID to be rejected")
+	}
+}
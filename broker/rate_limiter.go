@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// anyEnvelopeType is the -rate-limits key for types without a limit of their own
+const anyEnvelopeType = "*"
+
+// defaultRateLimitWarnings are the shares of a rate limit, in percent, at
+// which senders are warned
+const defaultRateLimitWarnings = "80,95"
+
+// tokenBucket holds the calls a caller has left
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(burst), updated: now}
+}
+
+// take refills the bucket at rate per second up to burst, then takes one
+// call from it. When none is left it returns false and how long until one is.
+func (t *tokenBucket) take(rate float64, burst int, now time.Time) (bool, time.Duration) {
+	t.tokens = math.Min(float64(burst), t.tokens+now.Sub(t.updated).Seconds()*rate)
+	t.updated = now
+	if t.tokens < 1 {
+		return false, time.Duration((1 - t.tokens) / rate * float64(time.Second))
+	}
+	t.tokens--
+	return true, 0
+}
+
+// full reports whether the bucket has refilled by now
+func (t *tokenBucket) full(rate float64, burst int, now time.Time) bool {
+	return t.tokens+now.Sub(t.updated).Seconds()*rate >= float64(burst)
+}
+
+// RateLimit is the rate at which one sender may send one envelope type
+type RateLimit struct {
+	Rate  float64 // Envelopes per second
+	Burst int     // Envelopes that may be sent at once before Rate applies
+}
+
+// ParseRateLimits parses per-sender limits by envelope type, written as
+// "toolCall=20/s,emitEvent=600/m,*=50/s". "*" covers the types not listed;
+// without it they are unlimited.
+func ParseRateLimits(spec string) (map[protocol.EnvelopeType]RateLimit, error) {
+	limits := make(map[protocol.EnvelopeType]RateLimit)
+	for _, field := range parseSinkList(spec) {
+		envType, value, found := strings.Cut(field, "=")
+		if !found || envType == "" {
+			return nil, fmt.Errorf("invalid rate limit %q, expected type=envelopes/unit", field)
+		}
+		rate, err := parseCallRate(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rate limit %q: %w", envType, value, err)
+		}
+		if rate == 0 {
+			continue
+		}
+		limits[protocol.EnvelopeType(envType)] = RateLimit{Rate: rate, Burst: int(math.Max(1, math.Ceil(rate)))}
+	}
+	return limits, nil
+}
+
+// ParseRateLimitWarnings parses the shares of a rate limit at which
+// senders are warned, written as percentages such as "80,95"
+func ParseRateLimitWarnings(spec string) ([]float64, error) {
+	var warnings []float64
+	for _, field := range parseSinkList(spec) {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("invalid warning threshold %q, expected a percentage between 0 and 100", field)
+		}
+		warnings = append(warnings, percent/100)
+	}
+	sort.Float64s(warnings)
+	return warnings, nil
+}
+
+// RateLimitStats counts the envelopes the limiter let through and turned
+// away, by type
+type RateLimitStats struct {
+	Allowed map[string]int64 `json:"allowed"`
+	Limited map[string]int64 `json:"limited"`
+	Graced  map[string]int64 `json:"graced,omitempty"` // Let through over the limit during a grace period, also counted as allowed
+	Senders int              `json:"senders"`          // Agents and addresses being tracked
+}
+
+// RateDecision is the limiter's answer for one envelope
+type RateDecision struct {
+	Allowed    bool
+	RetryAfter time.Duration // With Allowed false, how long until the sender has allowance again
+	Used       float64       // Share of the sender's allowance used, from 0 to 1
+	Warning    float64       // The warning threshold the envelope crossed, or 1 if it began a grace period; 0 if neither
+	Grace      time.Duration // Left of the grace period the envelope was let through in, over the limit
+}
+
+// warned reports whether the sender should be told it is near its limit
+func (d RateDecision) warned(warnings []float64) bool {
+	return d.Grace > 0 || (len(warnings) > 0 && d.Used >= warnings[0])
+}
+
+// limitedBucket is a sender's allowance for one type, with the warnings
+// it has been sent and its grace period
+type limitedBucket struct {
+	*tokenBucket
+	warned     int       // Warning thresholds crossed since the sender was last below the first
+	graceUntil time.Time // End of the grace period begun when the allowance ran out
+}
+
+// RateLimiter holds each sender to a rate per envelope type. Registered
+// agents are limited by agent ID; other traffic by the address it comes
+// from, so unregistered senders cannot dodge the limit by making up IDs.
+//
+// Senders are warned as their use crosses each warning threshold. With a
+// grace period, a sender that runs out is let through for that long
+// before it is turned away, once until its use falls back below the first
+// threshold.
+type RateLimiter struct {
+	limits   map[protocol.EnvelopeType]RateLimit
+	warnings []float64                                           // Shares of the limit senders are warned at, ascending
+	grace    time.Duration                                       // How long a sender may go over its limit
+	buckets  map[string]map[protocol.EnvelopeType]*limitedBucket // By sender, then type
+	allowed  map[string]int64
+	limited  map[string]int64
+	graced   map[string]int64
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+// NewRateLimiter creates a limiter with no limits
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits:  make(map[protocol.EnvelopeType]RateLimit),
+		buckets: make(map[string]map[protocol.EnvelopeType]*limitedBucket),
+		allowed: make(map[string]int64),
+		limited: make(map[string]int64),
+		graced:  make(map[string]int64),
+		now:     time.Now,
+	}
+}
+
+// SetWarnings sets the shares of the limit at which senders are warned and
+// how long they may go over it
+func (l *RateLimiter) SetWarnings(warnings []float64, grace time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = warnings
+	l.grace = grace
+}
+
+// SetLimits replaces the limits. Senders' buckets start over.
+func (l *RateLimiter) SetLimits(limits map[protocol.EnvelopeType]RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.buckets = make(map[string]map[protocol.EnvelopeType]*limitedBucket)
+}
+
+// limit returns the limit on an envelope type, if any. Caller must hold l.mu.
+func (l *RateLimiter) limit(envType protocol.EnvelopeType) (RateLimit, protocol.EnvelopeType, bool) {
+	if limit, exists := l.limits[envType]; exists {
+		return limit, envType, true
+	}
+	limit, exists := l.limits[anyEnvelopeType]
+	return limit, anyEnvelopeType, exists
+}
+
+// Allow takes one envelope of envType from sender's allowance. When none
+// is left it returns false and how long until one is.
+func (l *RateLimiter) Allow(sender string, envType protocol.EnvelopeType) (bool, time.Duration) {
+	decision := l.Check(sender, envType)
+	return decision.Allowed, decision.RetryAfter
+}
+
+// Check takes one envelope of envType from sender's allowance, and says
+// how much of it is used and whether the sender is to be warned
+func (l *RateLimiter) Check(sender string, envType protocol.EnvelopeType) RateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, key, limited := l.limit(envType)
+	if !limited {
+		return RateDecision{Allowed: true}
+	}
+
+	now := l.now()
+	senderBuckets, exists := l.buckets[sender]
+	if !exists {
+		senderBuckets = make(map[protocol.EnvelopeType]*limitedBucket)
+		l.buckets[sender] = senderBuckets
+	}
+	bucket, exists := senderBuckets[key]
+	if !exists {
+		bucket = &limitedBucket{tokenBucket: newTokenBucket(limit.Burst, now)}
+		senderBuckets[key] = bucket
+	}
+
+	var decision RateDecision
+	decision.Allowed, decision.RetryAfter = bucket.take(limit.Rate, limit.Burst, now)
+	decision.Used = math.Max(0, 1-bucket.tokens/float64(limit.Burst))
+	if !decision.Allowed {
+		decision.Used = 1
+		if bucket.graceUntil.IsZero() && l.grace > 0 {
+			bucket.graceUntil = now.Add(l.grace)
+			decision.Warning = 1
+		}
+		if now.Before(bucket.graceUntil) {
+			decision.Allowed, decision.RetryAfter = true, 0
+			decision.Grace = bucket.graceUntil.Sub(now)
+			l.graced[string(envType)]++
+		}
+	}
+
+	// Each threshold is announced once on the way up; a sender back below
+	// the first, or below half its limit without thresholds, may be warned
+	// and given grace again
+	crossed := sort.SearchFloat64s(l.warnings, decision.Used+1e-9)
+	if crossed > bucket.warned && decision.Warning == 0 {
+		decision.Warning = l.warnings[crossed-1]
+	}
+	bucket.warned = crossed
+	recovered := 0.5
+	if len(l.warnings) > 0 {
+		recovered = l.warnings[0]
+	}
+	if decision.Used < recovered {
+		bucket.graceUntil = time.Time{}
+	}
+
+	if decision.Allowed {
+		l.allowed[string(envType)]++
+	} else {
+		l.limited[string(envType)]++
+	}
+	return decision
+}
+
+// Prune forgets senders whose buckets have all refilled, since a new
+// bucket starts full
+func (l *RateLimiter) Prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for sender, senderBuckets := range l.buckets {
+		idle := true
+		for key, bucket := range senderBuckets {
+			limit := l.limits[key]
+			if !bucket.full(limit.Rate, limit.Burst, now) {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(l.buckets, sender)
+		}
+	}
+}
+
+// Run prunes idle senders every interval until stop is closed
+func (l *RateLimiter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Prune()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stats returns the counts since the broker started
+func (l *RateLimiter) Stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := RateLimitStats{
+		Allowed: make(map[string]int64, len(l.allowed)),
+		Limited: make(map[string]int64, len(l.limited)),
+		Graced:  make(map[string]int64, len(l.graced)),
+		Senders: len(l.buckets),
+	}
+	for envType, count := range l.graced {
+		stats.Graced[envType] = count
+	}
+	for envType, count := range l.allowed {
+		stats.Allowed[envType] = count
+	}
+	for envType, count := range l.limited {
+		stats.Limited[envType] = count
+	}
+	return stats
+}
+
+// rateLimitSender names who an envelope counts against: its agent if
+// registered, otherwise the host it came from
+func (b *Broker) rateLimitSender(envelope *protocol.GenericEnvelope) string {
+	b.mu.RLock()
+	_, registered := b.agents[envelope.Agent]
+	b.mu.RUnlock()
+
+	if registered || envelope.RemoteAddr == "" {
+		return "agent:" + envelope.Agent
+	}
+	host, _, err := net.SplitHostPort(envelope.RemoteAddr)
+	if err != nil {
+		host = envelope.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// allowEnvelope applies the rate limits, answering 429 with Retry-After
+// when the sender has used up its allowance. Senders near their limit get
+// HeaderQuotaWarning on the response, and registered agents a
+// quota.warning event as they cross each threshold.
+func (b *Broker) allowEnvelope(w http.ResponseWriter, envelope *protocol.GenericEnvelope) bool {
+	sender := b.rateLimitSender(envelope)
+	decision := b.limiter.Check(sender, envelope.Type)
+	if decision.warned(b.limiter.Warnings()) {
+		w.Header().Set(protocol.HeaderQuotaWarning, quotaWarningHeader(envelope.Type, decision))
+	}
+	if decision.Warning > 0 && strings.HasPrefix(sender, "agent:") {
+		b.sendQuotaWarning(envelope.Agent, envelope.Type, decision)
+	}
+	if decision.Allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", retryAfterHeader(decision.RetryAfter))
+	b.replyError(w, envelope, http.StatusTooManyRequests, protocol.ErrorRateLimited, fmt.Sprintf("Rate limit for %s envelopes exceeded", envelope.Type))
+	return false
+}
+
+// Warnings returns the shares of the limit at which senders are warned
+func (l *RateLimiter) Warnings() []float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.warnings
+}
+
+// quotaWarningHeader formats a decision as a HeaderQuotaWarning value
+func quotaWarningHeader(envType protocol.EnvelopeType, decision RateDecision) string {
+	value := fmt.Sprintf("type=%s; used=%d", envType, int(math.Round(decision.Used*100)))
+	if decision.Grace > 0 {
+		value += "; grace=" + retryAfterHeader(decision.Grace)
+	}
+	return value
+}
+
+// sendQuotaWarning sends an agent a quota.warning event. An agent not
+// connected receives it when it next connects, as with a broadcast.
+func (b *Broker) sendQuotaWarning(agentID string, envType protocol.EnvelopeType, decision RateDecision) {
+	event := protocol.EmitEventBody{
+		Event: protocol.EventQuotaWarning,
+		Payload: map[string]interface{}{
+			"type":      string(envType),
+			"used":      int(math.Round(decision.Used * 100)),
+			"threshold": int(math.Round(decision.Warning * 100)),
+			"graceMs":   decision.Grace.Milliseconds(),
+		},
+	}
+	slog.Info("Agent near its rate limit", "agent", agentID, "type", envType, "used", event.Payload["used"], "graceMs", event.Payload["graceMs"])
+	notice, err := b.signedEvent(event)
+	if err != nil {
+		slog.Error("Failed to sign quota warning", "agent", agentID, "error", err)
+		return
+	}
+	data, err := json.Marshal(notice)
+	if err != nil {
+		slog.Error("Failed to encode quota warning", "agent", agentID, "error", err)
+		return
+	}
+	b.broadcasts.Send(b.id, event.Event, data, []string{agentID}, 0)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("toolCall=20/s,emitEvent=600/m,ping=unlimited,*=5/s")
+	if err != nil {
+		t.Fatalf("Failed to parse limits: %v", err)
+	}
+	if limits[protocol.EnvelopeToolCall].Rate != 20 || limits[protocol.EnvelopeEmitEvent].Rate != 10 || limits[anyEnvelopeType].Burst != 5 {
+		t.Errorf("Unexpected limits %+v", limits)
+	}
+	if _, exists := limits[protocol.EnvelopePing]; exists {
+		t.Error("Expected an unlimited type to have no limit")
+	}
+	for _, spec := range []string{"toolCall", "=5/s", "toolCall=fast"} {
+		if _, err := ParseRateLimits(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter()
+	limits, _ := ParseRateLimits("toolCall=2/s,*=1/s")
+	limiter.SetLimits(limits)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("agent:a", protocol.EnvelopeToolCall); !allowed {
+			t.Fatalf("Expected tool call %d within the burst", i)
+		}
+	}
+	if allowed, wait := limiter.Allow("agent:a", protocol.EnvelopeToolCall); allowed || wait != 500*time.Millisecond {
+		t.Errorf("Expected the third tool call to wait 500ms, got %v %v", allowed, wait)
+	}
+
+	// Other types and other senders have allowances of their own
+	if allowed, _ := limiter.Allow("agent:a", protocol.EnvelopePing); !allowed {
+		t.Error("Expected a ping to be allowed")
+	}
+	if allowed, _ := limiter.Allow("agent:b", protocol.EnvelopeToolCall); !allowed {
+		t.Error("Expected another agent's tool call to be allowed")
+	}
+
+	stats := limiter.Stats()
+	if stats.Allowed[string(protocol.EnvelopeToolCall)] != 3 || stats.Limited[string(protocol.EnvelopeToolCall)] != 1 || stats.Senders != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Senders are forgotten once their allowances have refilled
+	now = now.Add(time.Second)
+	limiter.Prune()
+	if stats := limiter.Stats(); stats.Senders != 0 {
+		t.Errorf("Expected idle senders to be pruned, got %d", stats.Senders)
+	}
+}
+
+func TestBrokerRateLimitsEnvelopes(t *testing.T) {
+	broker := NewBroker()
+	limits, _ := ParseRateLimits("ping=1/m")
+	broker.limiter.SetLimits(limits)
+	broker.agents["agent-a"] = &Agent{ID: "agent-a"}
+
+	send := func(agent, remoteAddr string) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopePing}}
+		env.Agent, env.Nonce, env.RemoteAddr = agent, protocol.NewNonce(), remoteAddr
+		env.TS = time.Now().UnixMilli()
+		env.Body = json.RawMessage(`{}`)
+		recorder := newBufferedResponse()
+		broker.dispatchEnvelope(recorder, env)
+		return recorder
+	}
+
+	if recorder := send("agent-a", "10.0.0.1:5000"); recorder.status == http.StatusTooManyRequests {
+		t.Fatal("Expected the first ping to be allowed")
+	}
+	recorder := send("agent-a", "10.0.0.2:5000")
+	if recorder.status != http.StatusTooManyRequests || recorder.header.Get("Retry-After") != "60" {
+		t.Errorf("Expected a registered agent to be limited by ID from any address, got %d %q", recorder.status, recorder.header.Get("Retry-After"))
+	}
+
+	// Unregistered senders are limited by address, whatever ID they claim
+	if recorder := send("made-up-1", "10.0.0.9:5000"); recorder.status == http.StatusTooManyRequests {
+		t.Fatal("Expected the first unregistered ping to be allowed")
+	}
+	if recorder := send("made-up-2", "10.0.0.9:6000"); recorder.status != http.StatusTooManyRequests {
+		t.Errorf("Expected the address to be limited, got %d", recorder.status)
+	}
+
+	if snapshot := broker.MonitorSnapshot(); snapshot.Limiter.Limited[string(protocol.EnvelopePing)] != 2 {
+		t.Errorf("Expected the monitor to report limited envelopes, got %+v", snapshot.Limiter)
+	}
+}
+
+func TestRateLimiterWarningsAndGrace(t *testing.T) {
+	limiter := NewRateLimiter()
+	limiter.SetLimits(map[protocol.EnvelopeType]RateLimit{protocol.EnvelopeToolCall: {Rate: 1.0 / 60, Burst: 10}})
+	warnings, _ := ParseRateLimitWarnings("95,80%")
+	limiter.SetWarnings(warnings, 2*time.Second)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	var warned []float64
+	for i := 0; i < 10; i++ {
+		decision := limiter.Check("agent:a", protocol.EnvelopeToolCall)
+		if !decision.Allowed || decision.Grace != 0 {
+			t.Fatalf("Expected tool call %d within the limit, got %+v", i, decision)
+		}
+		if decision.Warning > 0 {
+			warned = append(warned, decision.Warning)
+		}
+	}
+	if len(warned) != 2 || warned[0] != 0.8 || warned[1] != 0.95 {
+		t.Errorf("Expected a warning at 80%% and 95%%, got %v", warned)
+	}
+
+	// Over the limit, the grace period lets calls through for a while
+	if decision := limiter.Check("agent:a", protocol.EnvelopeToolCall); !decision.Allowed || decision.Warning != 1 || decision.Grace != 2*time.Second {
+		t.Errorf("Expected the grace period to begin, got %+v", decision)
+	}
+	now = now.Add(time.Second)
+	if decision := limiter.Check("agent:a", protocol.EnvelopeToolCall); !decision.Allowed || decision.Warning != 0 || decision.Grace != time.Second {
+		t.Errorf("Expected the call let through in grace, got %+v", decision)
+	}
+	now = now.Add(1500 * time.Millisecond)
+	if decision := limiter.Check("agent:a", protocol.EnvelopeToolCall); decision.Allowed || decision.Grace != 0 {
+		t.Errorf("Expected the call refused once the grace period ended, got %+v", decision)
+	}
+	if stats := limiter.Stats(); stats.Graced[string(protocol.EnvelopeToolCall)] != 2 {
+		t.Errorf("Expected the graced calls counted, got %+v", stats)
+	}
+
+	if _, err := ParseRateLimitWarnings("80,150"); err == nil {
+		t.Error("Expected a threshold over 100% rejected")
+	}
+}
+
+func TestBrokerSendsQuotaWarnings(t *testing.T) {
+	broker := NewBroker()
+	broker.limiter.SetLimits(map[protocol.EnvelopeType]RateLimit{protocol.EnvelopePing: {Rate: 1.0 / 60, Burst: 2}})
+	warnings, _ := ParseRateLimitWarnings(defaultRateLimitWarnings)
+	broker.limiter.SetWarnings(warnings, 0)
+	broker.agents["agent-a"] = &Agent{ID: "agent-a"}
+	pusher := newFakePusher()
+	pusher.connected["agent-a"] = true
+	broker.broadcasts = NewBroadcastTable(pusher)
+
+	send := func() *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopePing}}
+		env.Agent, env.Nonce = "agent-a", protocol.NewNonce()
+		env.TS = time.Now().UnixMilli()
+		env.Body = json.RawMessage(`{}`)
+		recorder := newBufferedResponse()
+		broker.dispatchEnvelope(recorder, env)
+		return recorder
+	}
+
+	if recorder := send(); recorder.header.Get(protocol.HeaderQuotaWarning) != "" {
+		t.Errorf("Expected no warning at half the limit, got %q", recorder.header.Get(protocol.HeaderQuotaWarning))
+	}
+	if recorder := send(); recorder.status == http.StatusTooManyRequests || recorder.header.Get(protocol.HeaderQuotaWarning) != "type=ping; used=100" {
+		t.Errorf("Expected a warning with the last ping allowed, got %d %q", recorder.status, recorder.header.Get(protocol.HeaderQuotaWarning))
+	}
+
+	received := pusher.received["agent-a"]
+	if len(received) != 1 {
+		t.Fatalf("Expected one quota warning event, got %d envelopes", len(received))
+	}
+	notice, _ := protocol.ParseEnvelope(received[0])
+	var event protocol.EmitEventBody
+	notice.GetBodyAs(&event)
+	if event.Event != protocol.EventQuotaWarning || event.Payload["type"] != "ping" || event.Payload["threshold"] != float64(95) {
+		t.Errorf("Unexpected quota warning %+v", event)
+	}
+}
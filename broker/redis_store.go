@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds each storage operation
+const redisTimeout = 5 * time.Second
+
+// redisPrefix namespaces every key the broker writes
+const redisPrefix = "fem:"
+
+// Redis keys. Agents, MCP registrations, tools, subscriptions and
+// revocations are hashes keyed by agent ID holding JSON records; an agent's
+// tools are stored together as one JSON array. Nonces are plain keys that
+// Redis expires.
+const (
+	redisAgentsKey        = redisPrefix + "agents"
+	redisMCPAgentsKey     = redisPrefix + "mcp_agents"
+	redisToolsKey         = redisPrefix + "tools"
+	redisSubscriptionsKey = redisPrefix + "subscriptions"
+	redisRevocationsKey   = redisPrefix + "revocations"
+	redisNoncePrefix      = redisPrefix + "nonce:"
+	redisRegistryChannel  = redisPrefix + "registry"
+)
+
+// registryChange is published on redisRegistryChannel whenever an agent is
+// saved or deleted, so other brokers can refresh their cached copy
+type registryChange struct {
+	Origin string `json:"origin"`
+	Agent  string `json:"agent"`
+}
+
+// RedisStore keeps broker state in Redis so replicas behind a load balancer
+// share one registry. Each change is announced over pub/sub; replicas
+// watching the registry reload the changed agent.
+type RedisStore struct {
+	client   *redis.Client
+	instance string
+	pubsub   *redis.PubSub
+	cipher   *RecordCipher
+}
+
+// OpenRedisStore connects to the Redis server at url
+// (redis://[user:password@]host:port/db)
+func OpenRedisStore(url string) (*RedisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+
+	return NewRedisStore(redis.NewClient(options))
+}
+
+// NewRedisStore wraps a connected client
+func NewRedisStore(client *redis.Client) (*RedisStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStore{client: client, instance: hex.EncodeToString(id)}, nil
+}
+
+// Close stops watching the registry and closes the client
+func (s *RedisStore) Close() error {
+	if s.pubsub != nil {
+		s.pubsub.Close()
+	}
+	return s.client.Close()
+}
+
+func (s *RedisStore) opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
+
+// SetCipher encrypts records saved from now on; records already stored
+// stay readable
+func (s *RedisStore) SetCipher(c *RecordCipher) {
+	s.cipher = c
+}
+
+// announce tells other brokers that an agent changed
+func (s *RedisStore) announce(ctx context.Context, pipe redis.Pipeliner, agentID string) {
+	data, _ := json.Marshal(registryChange{Origin: s.instance, Agent: agentID})
+	pipe.Publish(ctx, redisRegistryChannel, data)
+}
+
+// SaveAgent stores an agent, its MCP registration and its tools
+func (s *RedisStore) SaveAgent(agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool) error {
+	agentData, err := s.cipher.seal(agent.ID, agent)
+	if err != nil {
+		return err
+	}
+	if tools == nil {
+		tools = []*RegisteredTool{}
+	}
+	toolsData, err := s.cipher.seal(agent.ID, tools)
+	if err != nil {
+		return err
+	}
+	var mcpData []byte
+	if mcpAgent != nil {
+		if mcpData, err = s.cipher.seal(agent.ID, mcpAgent); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisAgentsKey, agent.ID, agentData)
+		if mcpData != nil {
+			pipe.HSet(ctx, redisMCPAgentsKey, agent.ID, mcpData)
+		} else {
+			pipe.HDel(ctx, redisMCPAgentsKey, agent.ID)
+		}
+		pipe.HSet(ctx, redisToolsKey, agent.ID, toolsData)
+		s.announce(ctx, pipe, agent.ID)
+		return nil
+	})
+	return err
+}
+
+// DeleteAgent removes an agent, its MCP registration and its tools
+func (s *RedisStore) DeleteAgent(agentID string) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redisAgentsKey, agentID)
+		pipe.HDel(ctx, redisMCPAgentsKey, agentID)
+		pipe.HDel(ctx, redisToolsKey, agentID)
+		s.announce(ctx, pipe, agentID)
+		return nil
+	})
+	return err
+}
+
+// loadHash decodes every value in a hash, in key order
+func (s *RedisStore) loadHash(key string, decode func(data []byte) error) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	values, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := decode([]byte(values[id])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadAgents returns all stored agents
+func (s *RedisStore) LoadAgents() ([]*Agent, error) {
+	var agents []*Agent
+	err := s.loadHash(redisAgentsKey, func(data []byte) error {
+		var agent Agent
+		if err := s.cipher.open(data, &agent); err != nil {
+			return fmt.Errorf("corrupt agent record: %w", err)
+		}
+		agents = append(agents, &agent)
+		return nil
+	})
+	return agents, err
+}
+
+// LoadMCPAgents returns all stored MCP registrations
+func (s *RedisStore) LoadMCPAgents() ([]*MCPAgent, error) {
+	var agents []*MCPAgent
+	err := s.loadHash(redisMCPAgentsKey, func(data []byte) error {
+		var agent MCPAgent
+		if err := s.cipher.open(data, &agent); err != nil {
+			return fmt.Errorf("corrupt MCP agent record: %w", err)
+		}
+		agents = append(agents, &agent)
+		return nil
+	})
+	return agents, err
+}
+
+// LoadTools returns all stored tool index entries
+func (s *RedisStore) LoadTools() ([]*RegisteredTool, error) {
+	var tools []*RegisteredTool
+	err := s.loadHash(redisToolsKey, func(data []byte) error {
+		var agentTools []*RegisteredTool
+		if err := s.cipher.open(data, &agentTools); err != nil {
+			return fmt.Errorf("corrupt tool record: %w", err)
+		}
+		tools = append(tools, agentTools...)
+		return nil
+	})
+	return tools, err
+}
+
+// LoadAgent returns one stored agent with its MCP registration and tools.
+// agent is nil if it is not stored.
+func (s *RedisStore) LoadAgent(agentID string) (*Agent, *MCPAgent, []*RegisteredTool, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	pipe := s.client.Pipeline()
+	agentCmd := pipe.HGet(ctx, redisAgentsKey, agentID)
+	mcpCmd := pipe.HGet(ctx, redisMCPAgentsKey, agentID)
+	toolsCmd := pipe.HGet(ctx, redisToolsKey, agentID)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, nil, nil, err
+	}
+
+	data, err := agentCmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil, nil, nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	var agent Agent
+	if err := s.cipher.open(data, &agent); err != nil {
+		return nil, nil, nil, fmt.Errorf("corrupt agent record: %w", err)
+	}
+
+	var mcpAgent *MCPAgent
+	if data, err := mcpCmd.Bytes(); err == nil {
+		mcpAgent = &MCPAgent{}
+		if err := s.cipher.open(data, mcpAgent); err != nil {
+			return nil, nil, nil, fmt.Errorf("corrupt MCP agent record: %w", err)
+		}
+	}
+
+	var tools []*RegisteredTool
+	if data, err := toolsCmd.Bytes(); err == nil {
+		if err := s.cipher.open(data, &tools); err != nil {
+			return nil, nil, nil, fmt.Errorf("corrupt tool record: %w", err)
+		}
+	}
+	return &agent, mcpAgent, tools, nil
+}
+
+// WatchRegistry calls onChange with the ID of every agent saved or deleted
+// by another broker, until the store is closed
+func (s *RedisStore) WatchRegistry(onChange func(agentID string)) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	pubsub := s.client.Subscribe(context.Background(), redisRegistryChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to registry changes: %w", err)
+	}
+	s.pubsub = pubsub
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var change registryChange
+			if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+				slog.Warn("Ignoring malformed registry change", "error", err)
+				continue
+			}
+			if change.Origin != s.instance {
+				onChange(change.Agent)
+			}
+		}
+	}()
+	return nil
+}
+
+// SaveSubscription stores an agent's subscription
+func (s *RedisStore) SaveSubscription(sub Subscription) error {
+	data, err := s.cipher.seal(sub.AgentID, sub)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.opContext()
+	defer cancel()
+	return s.client.HSet(ctx, redisSubscriptionsKey, sub.AgentID, data).Err()
+}
+
+// DeleteSubscription removes an agent's subscription
+func (s *RedisStore) DeleteSubscription(agentID string) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	return s.client.HDel(ctx, redisSubscriptionsKey, agentID).Err()
+}
+
+// LoadSubscriptions returns all stored subscriptions ordered by agent
+func (s *RedisStore) LoadSubscriptions() ([]Subscription, error) {
+	var subs []Subscription
+	err := s.loadHash(redisSubscriptionsKey, func(data []byte) error {
+		var sub Subscription
+		if err := s.cipher.open(data, &sub); err != nil {
+			return fmt.Errorf("corrupt subscription record: %w", err)
+		}
+		subs = append(subs, sub)
+		return nil
+	})
+	return subs, err
+}
+
+// SaveRevocation stores what was revoked from an agent
+func (s *RedisStore) SaveRevocation(revocation Revocation) error {
+	data, err := s.cipher.seal(revocation.AgentID, revocation)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.opContext()
+	defer cancel()
+	return s.client.HSet(ctx, redisRevocationsKey, revocation.AgentID, data).Err()
+}
+
+// DeleteRevocation forgets what was revoked from an agent
+func (s *RedisStore) DeleteRevocation(agentID string) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	return s.client.HDel(ctx, redisRevocationsKey, agentID).Err()
+}
+
+// LoadRevocations returns all stored revocations ordered by agent
+func (s *RedisStore) LoadRevocations() ([]Revocation, error) {
+	var revocations []Revocation
+	err := s.loadHash(redisRevocationsKey, func(data []byte) error {
+		var revocation Revocation
+		if err := s.cipher.open(data, &revocation); err != nil {
+			return fmt.Errorf("corrupt revocation record: %w", err)
+		}
+		revocations = append(revocations, revocation)
+		return nil
+	})
+	return revocations, err
+}
+
+// RecordNonce remembers a nonce, reporting whether it is new
+func (s *RedisStore) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	return recordRedisNonce(s.client, agentID, nonce, expiresAt)
+}
+
+// PruneNonces is a no-op; Redis expires nonce keys itself
+func (s *RedisStore) PruneNonces(before time.Time) error {
+	return nil
+}
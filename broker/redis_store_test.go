@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/fep-fem/protocol"
+)
+
+func openTestRedisStore(t *testing.T, server *miniredis.Miniredis) *RedisStore {
+	t.Helper()
+
+	store, err := OpenRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRedisStore(t *testing.T) {
+	testStorage(t, openTestRedisStore(t, miniredis.RunT(t)))
+}
+
+func TestRedisStoreSharesRegistry(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	brokerA := NewBroker()
+	if err := brokerA.SetStore(openTestRedisStore(t, server)); err != nil {
+		t.Fatalf("Failed to attach store: %v", err)
+	}
+	brokerB := NewBroker()
+	if err := brokerB.SetStore(openTestRedisStore(t, server)); err != nil {
+		t.Fatalf("Failed to attach store: %v", err)
+	}
+
+	register := func(tools ...string) {
+		definition := &protocol.BodyDefinition{Name: "calculator"}
+		for _, name := range tools {
+			definition.MCPTools = append(definition.MCPTools, protocol.MCPTool{Name: name})
+		}
+
+		env := &protocol.GenericEnvelope{
+			BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent},
+		}
+		env.Agent = "shared-agent"
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+			MCPEndpoint:    "https://shared-agent/mcp",
+			BodyDefinition: definition,
+		})
+
+		recorder := newBufferedResponse()
+		brokerA.handleRegisterAgent(recorder, env)
+		if recorder.status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+		}
+	}
+
+	// waitForTools polls broker B until its registry holds the expected tools
+	waitForTools := func(expected int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for brokerB.mcpRegistry.GetToolCount() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected broker B to see %d tools, got %d", expected, brokerB.mcpRegistry.GetToolCount())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A registration on broker A becomes visible on broker B
+	register("math.add", "math.multiply")
+	waitForTools(2)
+
+	tools, _ := brokerB.mcpRegistry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"math.*"}})
+	if len(tools) != 1 || tools[0].AgentID != "shared-agent" {
+		t.Errorf("Unexpected tools discovered on broker B: %+v", tools)
+	}
+
+	// Re-registering with more tools refreshes broker B's cached copy
+	register("math.add", "math.multiply", "math.divide")
+	waitForTools(3)
+
+	brokerB.mu.RLock()
+	_, exists := brokerB.agents["shared-agent"]
+	brokerB.mu.RUnlock()
+	if !exists {
+		t.Error("Expected agent to be cached on broker B")
+	}
+}
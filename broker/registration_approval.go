@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultInvitationTTL is how long an invitation lasts unless the operator
+// sets its own
+const defaultInvitationTTL = 24 * time.Hour
+
+// invitationTokenSize is the number of random bytes in an invitation token
+const invitationTokenSize = 24
+
+// Kinds of auto-approve rule
+const (
+	ApproveByAgent      = "agent"
+	ApproveByCapability = "capability"
+)
+
+// ApprovalRule approves registrations without an operator, by agent ID or
+// by a declared capability
+type ApprovalRule struct {
+	Kind    string // ApproveByAgent or ApproveByCapability
+	Pattern string // Matched like capability patterns, e.g. "worker-*"
+}
+
+// ParseApprovalRules parses rules written as
+// "agent=worker-*,capability=echo". A registration matching any rule is
+// approved.
+func ParseApprovalRules(spec string) ([]ApprovalRule, error) {
+	var rules []ApprovalRule
+	for _, field := range parseSinkList(spec) {
+		kind, pattern, found := strings.Cut(field, "=")
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("invalid auto-approve rule %q, expected agent=pattern or capability=pattern", field)
+		}
+		if kind != ApproveByAgent && kind != ApproveByCapability {
+			return nil, fmt.Errorf("unknown auto-approve rule kind %q (want agent or capability)", kind)
+		}
+		rules = append(rules, ApprovalRule{Kind: kind, Pattern: pattern})
+	}
+	return rules, nil
+}
+
+// PendingRegistration is a registration waiting for an operator, as listed
+// by /admin/registrations
+type PendingRegistration struct {
+	Agent        string    `json:"agent"`
+	PubKey       string    `json:"pubkey"`
+	Capabilities []string  `json:"capabilities"`
+	MCPEndpoint  string    `json:"mcpEndpoint,omitempty"`
+	RemoteAddr   string    `json:"remoteAddr,omitempty"`
+	RequestedAt  time.Time `json:"requestedAt"`
+
+	env    *protocol.GenericEnvelope
+	body   protocol.RegisterAgentBody
+	pubKey protocol.PublicKey
+}
+
+// Invitation lets an agent matching its pattern register without waiting
+// for approval, once
+type Invitation struct {
+	Token   string    `json:"token"`
+	Agent   string    `json:"agent"` // Agent ID pattern the invitation is for
+	Expires time.Time `json:"expires"`
+}
+
+// RegistrationApprovals quarantines new agents until an operator approves
+// them, they present an invitation, or an auto-approve rule matches. An
+// approval covers the agent and key it was given for, so the agent can
+// register again without another one.
+type RegistrationApprovals struct {
+	required    bool
+	rules       []ApprovalRule
+	pending     map[string]*PendingRegistration
+	approved    map[string]string      // Agent ID to the approved public key
+	invitations map[string]*Invitation // By token
+	mu          sync.Mutex
+}
+
+// NewRegistrationApprovals creates a table that approves every registration
+// until approval is required
+func NewRegistrationApprovals() *RegistrationApprovals {
+	return &RegistrationApprovals{
+		pending:     make(map[string]*PendingRegistration),
+		approved:    make(map[string]string),
+		invitations: make(map[string]*Invitation),
+	}
+}
+
+// Configure sets whether approval is required and the rules that approve
+// registrations automatically. Registrations already pending stay pending.
+func (ra *RegistrationApprovals) Configure(required bool, rules []ApprovalRule) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.required = required
+	ra.rules = rules
+}
+
+// Check reports whether a registration may take effect: approval is not
+// required, the agent was approved with the same key, or a rule matches.
+// pubKey is empty for registrations that have not shown they hold the key.
+func (ra *RegistrationApprovals) Check(agent, pubKey string, capabilities []string) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if !ra.required {
+		return true
+	}
+	if approved, exists := ra.approved[agent]; exists && pubKey != "" && approved == pubKey {
+		return true
+	}
+	for _, rule := range ra.rules {
+		switch rule.Kind {
+		case ApproveByAgent:
+			if matchPattern(agent, rule.Pattern) {
+				return true
+			}
+		case ApproveByCapability:
+			for _, capability := range capabilities {
+				if matchPattern(capability, rule.Pattern) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Hold quarantines a registration until it is approved or rejected,
+// replacing any earlier one from the same agent
+func (ra *RegistrationApprovals) Hold(registration *PendingRegistration) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.pending[registration.Agent] = registration
+}
+
+// Pending lists the registrations waiting for approval, oldest first
+func (ra *RegistrationApprovals) Pending() []PendingRegistration {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	pending := make([]PendingRegistration, 0, len(ra.pending))
+	for _, registration := range ra.pending {
+		pending = append(pending, *registration)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].RequestedAt.Before(pending[j].RequestedAt)
+	})
+	return pending
+}
+
+// Approve takes an agent's pending registration out of quarantine and
+// approves its key
+func (ra *RegistrationApprovals) Approve(agent string) (*PendingRegistration, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	registration, exists := ra.pending[agent]
+	if !exists {
+		return nil, false
+	}
+	delete(ra.pending, agent)
+	ra.approved[agent] = registration.PubKey
+	return registration, true
+}
+
+// Reject drops an agent's pending registration and any approval it had
+func (ra *RegistrationApprovals) Reject(agent string) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	_, exists := ra.pending[agent]
+	delete(ra.pending, agent)
+	delete(ra.approved, agent)
+	return exists
+}
+
+// Invite creates an invitation for agents matching pattern
+func (ra *RegistrationApprovals) Invite(pattern string, ttl time.Duration, now time.Time) (Invitation, error) {
+	random := make([]byte, invitationTokenSize)
+	if _, err := rand.Read(random); err != nil {
+		return Invitation{}, err
+	}
+	invitation := &Invitation{
+		Token:   base64.RawURLEncoding.EncodeToString(random),
+		Agent:   pattern,
+		Expires: now.Add(ttl),
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for token, outstanding := range ra.invitations {
+		if !now.Before(outstanding.Expires) {
+			delete(ra.invitations, token)
+		}
+	}
+	ra.invitations[invitation.Token] = invitation
+	return *invitation, nil
+}
+
+// Redeem uses up an invitation for agent and approves the key it
+// registers. It returns false if the invitation does not exist, has
+// expired or is for other agents.
+func (ra *RegistrationApprovals) Redeem(token, agent, pubKey string, now time.Time) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	invitation, exists := ra.invitations[token]
+	if !exists || !now.Before(invitation.Expires) || !matchPattern(agent, invitation.Agent) {
+		return false
+	}
+	delete(ra.invitations, token)
+	delete(ra.pending, agent)
+	ra.approved[agent] = pubKey
+	return true
+}
+
+// SetRegistrationApproval sets whether new agents wait for an operator's
+// approval, and the rules that approve them automatically
+func (b *Broker) SetRegistrationApproval(required bool, rules []ApprovalRule) {
+	b.approvals.Configure(required, rules)
+}
+
+// approveRegistration quarantines a registration that is not yet approved,
+// answering it as pending. Agents already registered with the same key keep
+// their registration. A key's approval only counts for registrations
+// showing they hold it.
+func (b *Broker) approveRegistration(w http.ResponseWriter, env *protocol.GenericEnvelope, body protocol.RegisterAgentBody, pubKey protocol.PublicKey) bool {
+	approvedKey := ""
+	if b.keyProven(env, pubKey) {
+		approvedKey = body.PubKey
+		b.mu.RLock()
+		agent, registered := b.agents[env.Agent]
+		b.mu.RUnlock()
+		if registered && agent.PubKey.Equal(pubKey) {
+			return true
+		}
+	}
+	if b.approvals.Check(env.Agent, approvedKey, body.Capabilities) {
+		return true
+	}
+
+	if body.Invitation != "" {
+		if !b.approvals.Redeem(body.Invitation, env.Agent, body.PubKey, time.Now()) {
+			slog.Warn("Invitation refused", "agent", env.Agent)
+			http.Error(w, "Invitation is unknown, expired or for another agent", http.StatusForbidden)
+			return false
+		}
+		slog.Info("Registration approved by invitation", "agent", env.Agent)
+		return true
+	}
+
+	b.holdRegistration(w, env, body, pubKey)
+	slog.Info("Registration waiting for approval", "agent", env.Agent)
+	return false
+}
+
+// holdRegistration quarantines a registration until an operator approves
+// it, answering it as pending
+func (b *Broker) holdRegistration(w http.ResponseWriter, env *protocol.GenericEnvelope, body protocol.RegisterAgentBody, pubKey protocol.PublicKey) {
+	b.approvals.Hold(&PendingRegistration{
+		Agent:        env.Agent,
+		PubKey:       body.PubKey,
+		Capabilities: body.Capabilities,
+		MCPEndpoint:  body.MCPEndpoint,
+		RemoteAddr:   env.RemoteAddr,
+		RequestedAt:  time.Now(),
+		env:          env,
+		body:         body,
+		pubKey:       pubKey,
+	})
+
+	response := map[string]interface{}{
+		"status": protocol.StatusPendingApproval,
+		"agent":  env.Agent,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleAdminRegistrations lists the registrations waiting for approval
+func (b *Broker) handleAdminRegistrations(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, b.approvals.Pending())
+}
+
+// handleAdminRegistrationAction approves or rejects a pending registration
+// at /admin/registrations/{agent}/approve or /reject. An approved
+// registration takes effect at once, answered as the agent's own would be.
+func (b *Broker) handleAdminRegistrationAction(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/registrations/")
+	agentID, action, found := strings.Cut(rest, "/")
+	if !found || agentID == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "approve":
+		registration, exists := b.approvals.Approve(agentID)
+		if !exists {
+			http.Error(w, fmt.Sprintf("No registration pending for agent %s", agentID), http.StatusNotFound)
+			return
+		}
+		slog.Info("Registration approved", "agent", agentID)
+		b.activateRegistration(w, registration.env, registration.body, registration.pubKey)
+	case "reject":
+		if !b.approvals.Reject(agentID) {
+			http.Error(w, fmt.Sprintf("No registration pending for agent %s", agentID), http.StatusNotFound)
+			return
+		}
+		slog.Info("Registration rejected", "agent", agentID)
+		writeAdminJSON(w, map[string]string{"status": "rejected", "agent": agentID})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAdminInvite creates an invitation from a JSON body of the form
+// {"agent": "worker-*", "ttl": "1h"}. The agent pattern defaults to any
+// agent, the TTL to a day.
+func (b *Broker) handleAdminInvite(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Agent string `json:"agent"`
+		TTL   string `json:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid invitation request", http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Agent == "" {
+		request.Agent = "*"
+	}
+	ttl := defaultInvitationTTL
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid invitation TTL", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	invitation, err := b.approvals.Invite(request.Agent, ttl, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Invitation created", "agent", invitation.Agent, "expires", invitation.Expires)
+	writeAdminJSON(w, invitation)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func approvalClient(server *httptest.Server, agentID string) (*MCPClient, protocol.RegisterAgentBody) {
+	_, key, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     agentID,
+		BrokerURL:   server.URL,
+		PrivateKey:  key,
+		TLSInsecure: true,
+	})
+	body := protocol.RegisterAgentBody{
+		PubKey:       protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Capabilities: []string{"echo"},
+	}
+	return client, body
+}
+
+func adminPost(t *testing.T, server *httptest.Server, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var response map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return resp.StatusCode, response
+}
+
+func TestRegistrationApprovalWorkflow(t *testing.T) {
+	broker := NewBroker()
+	broker.SetRegistrationApproval(true, nil)
+	broker.SetAdminToken(testAdminToken)
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	client, body := approvalClient(server, "agent-a")
+	if err := client.Register(body); !errors.Is(err, protocol.ErrRegistrationPending) {
+		t.Fatalf("Expected the registration to wait for approval, got %v", err)
+	}
+	if _, registered := broker.agents["agent-a"]; registered {
+		t.Fatal("Expected agent-a to be quarantined")
+	}
+
+	resp, err := adminClient(broker, server).Get(server.URL + "/admin/registrations")
+	if err != nil {
+		t.Fatalf("Listing registrations failed: %v", err)
+	}
+	var pending []PendingRegistration
+	json.NewDecoder(resp.Body).Decode(&pending)
+	resp.Body.Close()
+	if len(pending) != 1 || pending[0].Agent != "agent-a" || pending[0].PubKey != body.PubKey {
+		t.Fatalf("Expected agent-a to be pending, got %+v", pending)
+	}
+
+	status, response := adminPost(t, server, "/admin/registrations/agent-a/approve", "")
+	if status != http.StatusOK || response["status"] != "registered" {
+		t.Fatalf("Expected approval to register agent-a, got %d %v", status, response)
+	}
+	if _, registered := broker.agents["agent-a"]; !registered {
+		t.Error("Expected agent-a to be registered once approved")
+	}
+
+	// The approval covers later registrations with the same key
+	if err := client.Register(body); err != nil {
+		t.Errorf("Expected the approved agent to register again, got %v", err)
+	}
+
+	other, otherBody := approvalClient(server, "agent-b")
+	other.Register(otherBody)
+	if status, _ := adminPost(t, server, "/admin/registrations/agent-b/reject", ""); status != http.StatusOK {
+		t.Errorf("Expected agent-b to be rejected, got %d", status)
+	}
+	if status, _ := adminPost(t, server, "/admin/registrations/agent-b/approve", ""); status != http.StatusNotFound {
+		t.Errorf("Expected a rejected registration to be gone, got %d", status)
+	}
+}
+
+func TestApprovedKeyNeedsItsHolder(t *testing.T) {
+	broker := NewBroker()
+	broker.SetRegistrationApproval(true, nil)
+	broker.SetAdminToken(testAdminToken)
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	client, body := approvalClient(server, "agent-a")
+	client.Register(body)
+	if status, _ := adminPost(t, server, "/admin/registrations/agent-a/approve", ""); status != http.StatusOK {
+		t.Fatalf("Expected agent-a to be approved, got %d", status)
+	}
+
+	// Presenting the approved key without its signature gets nothing
+	hijack := func() *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+		env.Agent = "agent-a"
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+			PubKey:       body.PubKey,
+			Capabilities: []string{"echo"},
+			MCPEndpoint:  "https://attacker.example/mcp",
+		})
+		recorder := newBufferedResponse()
+		broker.handleRegisterAgent(recorder, env)
+		return recorder
+	}
+	if recorder := hijack(); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned re-registration to be refused with 401, got %d", recorder.status)
+	}
+	if _, exists := broker.mcpRegistry.GetAgent("agent-a"); exists {
+		t.Error("Expected the refused registration not to add an MCP endpoint")
+	}
+
+	broker.removeAgent("agent-a")
+	if recorder := hijack(); !strings.Contains(recorder.body.String(), protocol.StatusPendingApproval) {
+		t.Errorf("Expected an unsigned registration with the approved key to wait for approval, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if _, registered := broker.agents["agent-a"]; registered {
+		t.Error("Expected agent-a to stay unregistered")
+	}
+}
+
+func TestKeyChangeWaitsForOperator(t *testing.T) {
+	broker := NewBroker()
+	broker.SetAdminToken(testAdminToken)
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	_, oldKey, _ := protocol.GenerateKeyPair()
+	_, newKey, _ := protocol.GenerateKeyPair()
+	register := func(key, signer ed25519.PrivateKey) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+		env.Agent = "agent-a"
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+			PubKey:       protocol.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+			Capabilities: []string{"echo"},
+		})
+		if signer != nil {
+			protocol.SignEnvelope(env, signer)
+		}
+		recorder := newBufferedResponse()
+		broker.handleRegisterAgent(recorder, env)
+		return recorder
+	}
+	if recorder := register(oldKey, oldKey); recorder.status != http.StatusOK {
+		t.Fatalf("Expected agent-a to register, got %d", recorder.status)
+	}
+
+	// A new key must at least be signed with itself
+	if recorder := register(newKey, nil); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned key change to be refused, got %d", recorder.status)
+	}
+	// Signed only with the new key, the change waits for an operator
+	if recorder := register(newKey, newKey); !strings.Contains(recorder.body.String(), protocol.StatusPendingApproval) {
+		t.Fatalf("Expected the key change to wait for approval, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if !broker.agents["agent-a"].PubKey.Equal(oldKey.Public()) {
+		t.Fatal("Expected agent-a to keep its key until the change is approved")
+	}
+	if status, _ := adminPost(t, server, "/admin/registrations/agent-a/approve", ""); status != http.StatusOK {
+		t.Fatalf("Expected the key change to be approved, got %d", status)
+	}
+	if !broker.agents["agent-a"].PubKey.Equal(newKey.Public()) {
+		t.Fatal("Expected the approved key to replace the old one")
+	}
+
+	// Signed with the key on record, a change takes effect at once
+	if recorder := register(oldKey, newKey); recorder.status != http.StatusOK || !broker.agents["agent-a"].PubKey.Equal(oldKey.Public()) {
+		t.Errorf("Expected a key change signed with the current key to take effect, got %d", recorder.status)
+	}
+}
+
+func TestRegistrationAutoApproveAndInvitations(t *testing.T) {
+	rules, err := ParseApprovalRules("agent=worker-*,capability=render.*")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	broker := NewBroker()
+	broker.SetRegistrationApproval(true, rules)
+	broker.SetAdminToken(testAdminToken)
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	worker, body := approvalClient(server, "worker-1")
+	if err := worker.Register(body); err != nil {
+		t.Errorf("Expected worker-1 to be approved by its ID, got %v", err)
+	}
+	renderer, body := approvalClient(server, "svg")
+	body.Capabilities = []string{"render.svg"}
+	if err := renderer.Register(body); err != nil {
+		t.Errorf("Expected svg to be approved by its capability, got %v", err)
+	}
+
+	status, invitation := adminPost(t, server, "/admin/invitations", `{"agent": "guest-*", "ttl": "1h"}`)
+	token, _ := invitation["token"].(string)
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("Expected an invitation, got %d %v", status, invitation)
+	}
+
+	guest, body := approvalClient(server, "guest-1")
+	body.Invitation = token
+	if err := guest.Register(body); err != nil {
+		t.Errorf("Expected the invitation to approve guest-1, got %v", err)
+	}
+
+	// Invitations are used up by the first agent presenting them
+	second, body := approvalClient(server, "guest-2")
+	body.Invitation = token
+	var statusErr *brokerStatusError
+	if err := second.Register(body); !errors.As(err, &statusErr) || statusErr.status != http.StatusForbidden {
+		t.Errorf("Expected a used invitation to be refused with 403, got %v", err)
+	}
+}
+
+func TestParseApprovalRulesRejectsUnknownKinds(t *testing.T) {
+	for _, spec := range []string{"worker-*", "agent=", "tool=echo"} {
+		if _, err := ParseApprovalRules(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
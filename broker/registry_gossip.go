@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultGossipInterval is how often the registry is exchanged with peers
+const defaultGossipInterval = 30 * time.Second
+
+// gossipTombstoneTTL is how long the removal of an agent is remembered, and
+// so how long peers have to learn of it before it is forgotten
+const gossipTombstoneTTL = 10 * time.Minute
+
+// RegistryGossip holds the registry entries exchanged with peer brokers: the
+// versioned listings of this broker's own agents, and the entries learned
+// from peers, which keep their origin broker's versions.
+type RegistryGossip struct {
+	local  map[string]*gossipListing
+	remote map[string]map[string]protocol.RegistryEntry // By origin broker, then agent ID
+	mu     sync.Mutex
+}
+
+// gossipListing is a local entry with the content it was versioned for
+type gossipListing struct {
+	entry   protocol.RegistryEntry
+	content string
+}
+
+// NewRegistryGossip creates an empty gossip state
+func NewRegistryGossip() *RegistryGossip {
+	return &RegistryGossip{
+		local:  make(map[string]*gossipListing),
+		remote: make(map[string]map[string]protocol.RegistryEntry),
+	}
+}
+
+// Refresh versions the local listings as of now. Agents whose listing
+// changed get a new version and agents that are gone leave a tombstone;
+// tombstones older than gossipTombstoneTTL are dropped.
+func (g *RegistryGossip) Refresh(origin string, listings []protocol.DiscoveredTool, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	version := now.UnixMilli()
+	present := make(map[string]bool, len(listings))
+	for _, listing := range listings {
+		listing := listing
+		present[listing.AgentID] = true
+
+		// Heartbeats alone are not a change worth gossiping
+		unstamped := listing
+		unstamped.Metadata = protocol.ToolMetadata{}
+		content, _ := json.Marshal(unstamped)
+
+		existing, known := g.local[listing.AgentID]
+		if known && !existing.entry.Removed && existing.content == string(content) && existing.entry.Broker == origin {
+			continue
+		}
+		if known && existing.entry.Version >= version {
+			version = existing.entry.Version + 1
+		}
+		g.local[listing.AgentID] = &gossipListing{
+			entry:   protocol.RegistryEntry{Broker: origin, AgentID: listing.AgentID, Version: version, Tool: &listing},
+			content: string(content),
+		}
+	}
+
+	for agentID, existing := range g.local {
+		switch {
+		case present[agentID]:
+		case !existing.entry.Removed:
+			g.local[agentID] = &gossipListing{entry: protocol.RegistryEntry{
+				Broker:  origin,
+				AgentID: agentID,
+				Version: max(version, existing.entry.Version+1),
+				Removed: true,
+			}}
+		case now.Sub(time.UnixMilli(existing.entry.Version)) > gossipTombstoneTTL:
+			delete(g.local, agentID)
+		}
+	}
+
+	for broker, entries := range g.remote {
+		for agentID, entry := range entries {
+			if entry.Removed && now.Sub(time.UnixMilli(entry.Version)) > gossipTombstoneTTL {
+				delete(entries, agentID)
+			}
+		}
+		if len(entries) == 0 {
+			delete(g.remote, broker)
+		}
+	}
+}
+
+// Versions returns the version of every known entry, for a digest
+func (g *RegistryGossip) Versions() map[string]map[string]int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	versions := make(map[string]map[string]int64)
+	for _, entry := range g.entries() {
+		if versions[entry.Broker] == nil {
+			versions[entry.Broker] = make(map[string]int64)
+		}
+		versions[entry.Broker][entry.AgentID] = entry.Version
+	}
+	return versions
+}
+
+// Delta returns the entries newer than the versions a peer sent. Removals
+// of agents the peer never knew are left out.
+func (g *RegistryGossip) Delta(versions map[string]map[string]int64) []protocol.RegistryEntry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delta := make([]protocol.RegistryEntry, 0)
+	for _, entry := range g.entries() {
+		known, exists := versions[entry.Broker][entry.AgentID]
+		if entry.Version <= known || (entry.Removed && !exists) {
+			continue
+		}
+		delta = append(delta, entry)
+	}
+	return delta
+}
+
+// Merge applies entries pulled from a peer, ignoring any about this broker's
+// own agents and any older than the entry already known. It returns how
+// many entries were applied.
+func (g *RegistryGossip) Merge(self string, entries []protocol.RegistryEntry) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	applied := 0
+	for _, entry := range entries {
+		if entry.Broker == "" || entry.Broker == self || entry.AgentID == "" {
+			continue
+		}
+		if !entry.Removed && entry.Tool == nil {
+			continue
+		}
+		if known, exists := g.remote[entry.Broker][entry.AgentID]; exists && known.Version >= entry.Version {
+			continue
+		}
+		if g.remote[entry.Broker] == nil {
+			g.remote[entry.Broker] = make(map[string]protocol.RegistryEntry)
+		}
+		g.remote[entry.Broker][entry.AgentID] = entry
+		applied++
+	}
+	return applied
+}
+
+// Discover returns the learned listings matching a discovery query, leaving
+// out agents registered with the brokers in skip. Only the matching tools
+// of each agent are listed.
+func (g *RegistryGossip) Discover(query protocol.ToolQuery, skip map[string]bool) []protocol.DiscoveredTool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	brokers := make([]string, 0, len(g.remote))
+	for broker := range g.remote {
+		if !skip[broker] {
+			brokers = append(brokers, broker)
+		}
+	}
+	sort.Strings(brokers)
+
+	var discovered []protocol.DiscoveredTool
+	for _, broker := range brokers {
+		agentIDs := make([]string, 0, len(g.remote[broker]))
+		for agentID := range g.remote[broker] {
+			agentIDs = append(agentIDs, agentID)
+		}
+		sort.Strings(agentIDs)
+
+		for _, agentID := range agentIDs {
+			entry := g.remote[broker][agentID]
+			if entry.Removed {
+				continue
+			}
+			if query.EnvironmentType != "" && entry.Tool.EnvironmentType != query.EnvironmentType {
+				continue
+			}
+
+			listing := *entry.Tool
+			listing.Broker = broker
+			listing.MCPTools = nil
+			listing.Capabilities = nil
+			for _, tool := range entry.Tool.MCPTools {
+				if matchesAnyPattern(tool.Name, query.Capabilities) {
+					listing.MCPTools = append(listing.MCPTools, tool)
+					listing.Capabilities = append(listing.Capabilities, tool.Name)
+				}
+			}
+			if len(listing.MCPTools) > 0 {
+				discovered = append(discovered, listing)
+			}
+		}
+	}
+	return discovered
+}
+
+// entries returns every local and learned entry. Caller must hold the lock.
+func (g *RegistryGossip) entries() []protocol.RegistryEntry {
+	entries := make([]protocol.RegistryEntry, 0, len(g.local))
+	for _, listing := range g.local {
+		entries = append(entries, listing.entry)
+	}
+	for _, learned := range g.remote {
+		for _, entry := range learned {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// matchesAnyPattern reports whether name matches one of the capability
+// patterns, or there are none
+func matchesAnyPattern(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchPattern(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshGossip versions the current public listings of this broker's agents
+func (b *Broker) refreshGossip() {
+	listings, err := b.mcpRegistry.DiscoverTools(protocol.ToolQuery{})
+	if err != nil {
+		slog.Error("Failed to list agents for gossip", "error", err)
+		return
+	}
+	b.gossip.Refresh(b.id, listings, time.Now())
+}
+
+// GossipRegistry exchanges registry digests with every peer on each
+// interval until stop is closed
+func (b *Broker) GossipRegistry(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.gossipRound()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// gossipRound pulls registry deltas from each peer in turn
+func (b *Broker) gossipRound() {
+	for _, peer := range b.peers.List() {
+		if err := b.gossipWith(peer); err != nil {
+			slog.Warn("Registry gossip failed", "broker", peer.ID, "error", err)
+		}
+	}
+}
+
+// gossipWith sends a peer the digest of the known registry and merges the
+// signed delta it answers with
+func (b *Broker) gossipWith(peer *FederatedBroker) error {
+	b.refreshGossip()
+
+	digest := protocol.NewRegistryDigest(b.id, b.gossip.Versions())
+	if err := digest.Sign(b.privateKey); err != nil {
+		return fmt.Errorf("failed to sign digest: %w", err)
+	}
+	generic := &protocol.GenericEnvelope{BaseEnvelope: digest.BaseEnvelope}
+	generic.Body, _ = json.Marshal(digest.Body)
+
+	status, body, err := b.peers.forward(peer, generic)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("peer answered with status %d", status)
+	}
+
+	delta, err := protocol.ParseEnvelope(body)
+	if err != nil || delta.Type != protocol.EnvelopeRegistryDelta || delta.Agent != peer.ID {
+		return fmt.Errorf("peer sent an invalid registry delta")
+	}
+	pubKey, err := protocol.DecodePublicKey(peer.PublicKey)
+	if err == nil {
+		err = delta.Verify(pubKey)
+	}
+	if err != nil {
+		return fmt.Errorf("rejected registry delta: %w", err)
+	}
+
+	var deltaBody protocol.RegistryDeltaBody
+	if err := delta.GetBodyAs(&deltaBody); err != nil {
+		return fmt.Errorf("invalid registry delta: %w", err)
+	}
+	if applied := b.gossip.Merge(b.id, deltaBody.Entries); applied > 0 {
+		slog.Info("Learned registry entries", "broker", peer.ID, "entries", applied)
+	}
+	return nil
+}
+
+// handleRegistryDigest answers a peer's digest with the registry entries it
+// is missing, in a registryDelta signed by this broker
+func (b *Broker) handleRegistryDigest(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.RegistryDigestBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	peer, exists := b.peers.Get(env.Agent)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Broker %s is not a peer", env.Agent), http.StatusNotFound)
+		return
+	}
+	pubKey, err := protocol.DecodePublicKey(peer.PublicKey)
+	if err == nil {
+		err = env.Verify(pubKey)
+	}
+	if err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return
+	}
+
+	b.refreshGossip()
+	response := protocol.NewRegistryDelta(b.id, b.gossip.Delta(body.Versions))
+	if err := response.Sign(b.privateKey); err != nil {
+		http.Error(w, "Failed to sign registry delta", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
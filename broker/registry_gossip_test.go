@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestRegistryGossipVersions(t *testing.T) {
+	gossip := NewRegistryGossip()
+	now := time.UnixMilli(1700000000000)
+
+	listing := protocol.DiscoveredTool{AgentID: "weather-agent", MCPTools: []protocol.MCPTool{{Name: "weather.read"}}}
+	gossip.Refresh("broker-a", []protocol.DiscoveredTool{listing}, now)
+	first := gossip.Versions()["broker-a"]["weather-agent"]
+
+	// Heartbeats alone do not bump the version
+	listing.Metadata.LastSeen = now.Add(time.Minute).UnixMilli()
+	gossip.Refresh("broker-a", []protocol.DiscoveredTool{listing}, now.Add(time.Minute))
+	if version := gossip.Versions()["broker-a"]["weather-agent"]; version != first {
+		t.Errorf("Expected version %d to survive a heartbeat, got %d", first, version)
+	}
+
+	listing.MCPTools = append(listing.MCPTools, protocol.MCPTool{Name: "weather.forecast"})
+	gossip.Refresh("broker-a", []protocol.DiscoveredTool{listing}, now.Add(2*time.Minute))
+	if version := gossip.Versions()["broker-a"]["weather-agent"]; version <= first {
+		t.Errorf("Expected a changed listing to get a newer version than %d, got %d", first, version)
+	}
+
+	// Removals are gossiped as tombstones, then forgotten
+	gossip.Refresh("broker-a", nil, now.Add(3*time.Minute))
+	delta := gossip.Delta(map[string]map[string]int64{"broker-a": {"weather-agent": first}})
+	if len(delta) != 1 || !delta[0].Removed {
+		t.Errorf("Expected a tombstone for the removed agent, got %+v", delta)
+	}
+	if delta := gossip.Delta(nil); len(delta) != 0 {
+		t.Errorf("Expected tombstones to be withheld from peers that never knew the agent, got %+v", delta)
+	}
+	gossip.Refresh("broker-a", nil, now.Add(3*time.Minute+gossipTombstoneTTL+time.Second))
+	if versions := gossip.Versions(); len(versions) != 0 {
+		t.Errorf("Expected expired tombstones to be dropped, got %v", versions)
+	}
+
+	// Learned entries only move forward, and never describe our own agents
+	entry := protocol.RegistryEntry{Broker: "broker-b", AgentID: "map-agent", Version: 5, Tool: &protocol.DiscoveredTool{AgentID: "map-agent"}}
+	stale := entry
+	stale.Version = 4
+	own := entry
+	own.Broker = "broker-a"
+	if applied := gossip.Merge("broker-a", []protocol.RegistryEntry{entry, stale, own}); applied != 1 {
+		t.Errorf("Expected 1 entry applied, got %d", applied)
+	}
+}
+
+func TestRegistryGossipDiscovery(t *testing.T) {
+	brokerA, serverA, brokerB, serverB := federatedPair(t)
+
+	register := func(agentID, tool string) {
+		brokerB.mcpRegistry.RegisterAgent(agentID, &MCPAgent{
+			ID:            agentID,
+			MCPEndpoint:   "https://" + agentID + "/mcp",
+			Tools:         []protocol.MCPTool{{Name: tool}},
+			LastHeartbeat: time.Now(),
+		})
+	}
+	register("weather-agent", "weather.read")
+	register("map-agent", "map.render")
+
+	peerB, _ := brokerA.peers.Get("broker-b")
+	if err := brokerA.gossipWith(peerB); err != nil {
+		t.Fatalf("Gossip failed: %v", err)
+	}
+	if versions := brokerA.gossip.Versions()["broker-b"]; len(versions) != 2 {
+		t.Fatalf("Expected broker-a to learn 2 agents of broker-b, got %v", versions)
+	}
+
+	brokerB.mcpRegistry.UnregisterAgent("map-agent")
+	if err := brokerA.gossipWith(peerB); err != nil {
+		t.Fatalf("Gossip failed: %v", err)
+	}
+
+	// Discovery still finds broker-b's agents while it is down
+	serverB.Close()
+
+	_, privKey, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "caller-agent",
+		BrokerURL:   serverA.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+	tools, err := client.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"weather.*", "map.*"}, Federated: true})
+	if err != nil {
+		t.Fatalf("Federated discovery failed: %v", err)
+	}
+	if len(tools) != 1 || tools[0].AgentID != "weather-agent" || tools[0].Broker != "broker-b" {
+		t.Errorf("Expected only weather-agent from broker-b's gossiped registry, got %+v", tools)
+	}
+
+	// Digests are only answered for peers
+	_, strangerKey, _ := protocol.GenerateKeyPair()
+	digest := protocol.NewRegistryDigest("broker-c", nil)
+	digest.Sign(strangerKey)
+	generic := &protocol.GenericEnvelope{BaseEnvelope: digest.BaseEnvelope, Body: []byte(`{"versions":{}}`)}
+	recorder := newBufferedResponse()
+	brokerA.handleRegistryDigest(recorder, generic)
+	if recorder.status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a digest from a stranger, got %d: %s", recorder.status, recorder.body.String())
+	}
+}
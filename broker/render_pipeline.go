@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// ErrNoRenderer is returned when nothing can render an instruction
+var ErrNoRenderer = errors.New("no renderer for instruction")
+
+// Renderer turns a render instruction into artifacts
+type Renderer interface {
+	Render(ctx context.Context, caller string, body protocol.RenderInstructionBody) ([]protocol.RenderArtifact, error)
+}
+
+// RendererFunc lets an ordinary function serve as a renderer
+type RendererFunc func(ctx context.Context, caller string, body protocol.RenderInstructionBody) ([]protocol.RenderArtifact, error)
+
+// Render calls f
+func (f RendererFunc) Render(ctx context.Context, caller string, body protocol.RenderInstructionBody) ([]protocol.RenderArtifact, error) {
+	return f(ctx, caller, body)
+}
+
+// RenderRegistry holds the renderers run inside the broker, by instruction.
+// Instructions without one are routed to agents advertising the render
+// capability for them.
+type RenderRegistry struct {
+	renderers map[string]Renderer
+	mu        sync.RWMutex
+}
+
+// NewRenderRegistry creates an empty registry
+func NewRenderRegistry() *RenderRegistry {
+	return &RenderRegistry{
+		renderers: make(map[string]Renderer),
+	}
+}
+
+// Register sets the renderer for an instruction, replacing any before it
+func (rr *RenderRegistry) Register(instruction string, renderer Renderer) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.renderers[instruction] = renderer
+}
+
+// Get returns the renderer registered for an instruction
+func (rr *RenderRegistry) Get(instruction string) (Renderer, bool) {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	renderer, exists := rr.renderers[instruction]
+	return renderer, exists
+}
+
+// Instructions lists the instructions with a registered renderer
+func (rr *RenderRegistry) Instructions() []string {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	instructions := make([]string, 0, len(rr.renderers))
+	for instruction := range rr.renderers {
+		instructions = append(instructions, instruction)
+	}
+	sort.Strings(instructions)
+	return instructions
+}
+
+// renderAgents returns the live agents advertising the capability to render
+// an instruction, least busy first
+func (b *Broker) renderAgents(instruction string) []*Agent {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var agents []*Agent
+	for _, agent := range b.agents {
+		if !agent.Stale && holdsCapability(agent.Capabilities, protocol.RenderCapability(instruction)) {
+			agents = append(agents, agent)
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Queued != agents[j].Queued {
+			return agents[i].Queued < agents[j].Queued
+		}
+		return agents[i].ID < agents[j].ID
+	})
+	return agents
+}
+
+// renderer picks what renders an instruction: the agent the caller named,
+// else the broker's own renderer, else the least busy agent that can
+func (b *Broker) renderer(body protocol.RenderInstructionBody) (Renderer, string, error) {
+	agents := b.renderAgents(body.Instruction)
+	if body.Renderer != "" {
+		for _, agent := range agents {
+			if agent.ID == body.Renderer {
+				return b.agentRenderer(agent.ID), agent.ID, nil
+			}
+		}
+		return nil, "", fmt.Errorf("%w %s: agent %s does not advertise %s", ErrNoRenderer, body.Instruction,
+			body.Renderer, protocol.RenderCapability(body.Instruction))
+	}
+	if renderer, exists := b.renderers.Get(body.Instruction); exists {
+		return renderer, b.id, nil
+	}
+	if len(agents) == 0 {
+		return nil, "", fmt.Errorf("%w %s", ErrNoRenderer, body.Instruction)
+	}
+	return b.agentRenderer(agents[0].ID), agents[0].ID, nil
+}
+
+// agentRenderer renders with an agent. Agents holding a connection get the
+// renderInstruction pushed and answer with a toolResult envelope for its
+// request ID; others are sent a tools/call for the render capability on
+// their MCP endpoint. Either way the result holds the artifacts.
+func (b *Broker) agentRenderer(agentID string) Renderer {
+	return RendererFunc(func(ctx context.Context, caller string, body protocol.RenderInstructionBody) ([]protocol.RenderArtifact, error) {
+		tool := protocol.RenderCapability(body.Instruction)
+		pending, err := b.pending.Track(body.RequestID, caller, agentID, tool)
+		if err != nil {
+			return nil, fmt.Errorf("request %s is already pending", body.RequestID)
+		}
+
+		var output interface{}
+		if b.hub.IsConnected(agentID) {
+			err = b.pushRenderInstruction(agentID, body)
+			if err == nil {
+				err = ErrToolCallAccepted
+			}
+		} else if mcpAgent, exists := b.mcpRegistry.GetAgent(agentID); exists && mcpAgent.MCPEndpoint != "" {
+			output, err = b.toolClient.CallTool(mcpAgent.MCPEndpoint, tool, toolCallMeta(protocol.ToolCallBody{RequestID: body.RequestID}), body.Parameters)
+		} else {
+			err = fmt.Errorf("agent %s has no MCP endpoint or WebSocket connection", agentID)
+		}
+
+		switch {
+		case err == ErrToolCallAccepted:
+			result := b.pending.Wait(pending)
+			if !result.Success {
+				return nil, fmt.Errorf("agent %s failed to render: %s", agentID, result.Error)
+			}
+			output = result.Result
+		case err != nil:
+			b.pending.Cancel(body.RequestID)
+			return nil, err
+		default:
+			b.pending.Cancel(body.RequestID)
+		}
+		return decodeRenderArtifacts(output)
+	})
+}
+
+// pushRenderInstruction sends a renderInstruction, signed by the broker, to
+// an agent holding a connection
+func (b *Broker) pushRenderInstruction(agentID string, body protocol.RenderInstructionBody) error {
+	instruction := &protocol.RenderInstructionEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{
+			Type: protocol.EnvelopeRenderInstruction,
+			CommonHeaders: protocol.CommonHeaders{
+				Agent: b.id,
+				TS:    time.Now().UnixMilli(),
+				Nonce: protocol.NewNonce(),
+			},
+		},
+		Body: body,
+	}
+	if err := instruction.Sign(b.privateKey); err != nil {
+		return err
+	}
+	return b.hub.Send(agentID, instruction)
+}
+
+// decodeRenderArtifacts reads the artifacts from an agent's render result
+func decodeRenderArtifacts(output interface{}) ([]protocol.RenderArtifact, error) {
+	data, err := json.Marshal(output)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Artifacts []protocol.RenderArtifact `json:"artifacts"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid render result: %w", err)
+	}
+	return result.Artifacts, nil
+}
+
+// handleRenderInstruction renders an instruction with the broker's renderer
+// for it or an agent advertising its render capability, and answers with
+// the rendered artifacts
+func (b *Broker) handleRenderInstruction(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.RenderInstructionBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Instruction == "" {
+		http.Error(w, "Missing instruction", http.StatusBadRequest)
+		return
+	}
+	if body.RequestID == "" {
+		body.RequestID = protocol.NewNonce()
+	}
+
+	b.mu.RLock()
+	limits := b.paramLimits
+	b.mu.RUnlock()
+	if err := limits.Check(body.Parameters); err != nil {
+		http.Error(w, fmt.Sprintf("Parameters rejected: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	renderer, rendererID, err := b.renderer(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	slog.Debug("Render instruction", "agent", env.Agent, "instruction", body.Instruction, "renderer", rendererID, "requestId", body.RequestID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.pending.Timeout())
+	defer cancel()
+	artifacts, err := renderer.Render(ctx, env.Agent, body)
+	if err != nil {
+		slog.Warn("Render failed", "instruction", body.Instruction, "renderer", rendererID, "requestId", body.RequestID, "error", err)
+		http.Error(w, fmt.Sprintf("Render failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	if artifacts == nil {
+		artifacts = []protocol.RenderArtifact{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(protocol.RenderResultBody{
+		Status:      "rendered",
+		RequestID:   body.RequestID,
+		Instruction: body.Instruction,
+		Renderer:    rendererID,
+		Artifacts:   artifacts,
+	})
+}
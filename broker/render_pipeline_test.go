@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func renderInstruction(broker *Broker, body protocol.RenderInstructionBody) (*bufferedResponse, protocol.RenderResultBody) {
+	env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRenderInstruction}}
+	env.Agent = "caller"
+	env.Body, _ = json.Marshal(body)
+	recorder := newBufferedResponse()
+	broker.handleRenderInstruction(recorder, env)
+
+	var result protocol.RenderResultBody
+	json.Unmarshal(recorder.body.Bytes(), &result)
+	return recorder, result
+}
+
+func TestRenderWithRegisteredRenderer(t *testing.T) {
+	broker := NewBroker()
+	broker.renderers.Register("text", RendererFunc(func(ctx context.Context, caller string, body protocol.RenderInstructionBody) ([]protocol.RenderArtifact, error) {
+		text, _ := body.Parameters["text"].(string)
+		return []protocol.RenderArtifact{{Name: "out.txt", ContentType: "text/plain", Data: text, Size: int64(len(text))}}, nil
+	}))
+
+	recorder, result := renderInstruction(broker, protocol.RenderInstructionBody{
+		Instruction: "text",
+		Parameters:  map[string]interface{}{"text": "aGVsbG8="},
+	})
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected the instruction to render, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if result.Renderer != broker.id || result.RequestID == "" || len(result.Artifacts) != 1 || result.Artifacts[0].Data != "aGVsbG8=" {
+		t.Errorf("Unexpected render result %+v", result)
+	}
+
+	recorder, _ = renderInstruction(broker, protocol.RenderInstructionBody{Instruction: "chart"})
+	if recorder.status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an instruction nothing renders, got %d", recorder.status)
+	}
+}
+
+func TestRenderRoutedToAgent(t *testing.T) {
+	broker := NewBroker()
+	calls := make(chan string, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Params struct {
+				Name string `json:"name"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		calls <- request.Params.Name
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"result": map[string]interface{}{
+				"artifacts": []map[string]interface{}{{"name": "chart.png", "url": "https://charts.example/chart.png"}},
+			},
+			"id": 1,
+		})
+	}))
+	defer endpoint.Close()
+
+	broker.agents["chart-agent"] = &Agent{ID: "chart-agent", Capabilities: []string{"render.*"}}
+	broker.agents["busy-agent"] = &Agent{ID: "busy-agent", Capabilities: []string{"render.chart"}, Queued: 5}
+	broker.agents["other-agent"] = &Agent{ID: "other-agent", Capabilities: []string{"render.table"}}
+	broker.mcpRegistry.RegisterAgent("chart-agent", &MCPAgent{ID: "chart-agent", MCPEndpoint: endpoint.URL, LastHeartbeat: time.Now()})
+
+	recorder, result := renderInstruction(broker, protocol.RenderInstructionBody{Instruction: "chart"})
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected the instruction to render, got %d: %s", recorder.status, recorder.body.String())
+	}
+	if tool := <-calls; tool != "render.chart" {
+		t.Errorf("Expected a render.chart call, got %s", tool)
+	}
+	if result.Renderer != "chart-agent" || len(result.Artifacts) != 1 || result.Artifacts[0].URL != "https://charts.example/chart.png" {
+		t.Errorf("Unexpected render result %+v", result)
+	}
+
+	// A renderer the caller names must advertise the instruction
+	recorder, _ = renderInstruction(broker, protocol.RenderInstructionBody{Instruction: "chart", Renderer: "other-agent"})
+	if recorder.status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a renderer without render.chart, got %d", recorder.status)
+	}
+
+	// An agent that cannot be reached fails the render
+	recorder, _ = renderInstruction(broker, protocol.RenderInstructionBody{Instruction: "chart", Renderer: "busy-agent"})
+	if recorder.status != http.StatusBadGateway {
+		t.Errorf("Expected 502 for an unreachable renderer, got %d", recorder.status)
+	}
+	if broker.pending.GetPendingCount() != 0 {
+		t.Error("Expected failed renders to leave no pending requests")
+	}
+}
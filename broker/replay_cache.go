@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// memcacheTimeout bounds each memcached operation, dial included
+	memcacheTimeout = time.Second
+	// memcacheIdleConns is how many connections are kept open per server
+	memcacheIdleConns = 4
+	// memcacheMaxRelative is the longest expiry memcached takes as seconds
+	// from now; longer ones must be given as a Unix time
+	memcacheMaxRelative = 30 * 24 * time.Hour
+)
+
+// ReplayCache remembers the nonces of accepted envelopes so a replayed one
+// is refused. Every Storage is one; a cache shared by several brokers keeps
+// replay protection correct when replicas behind a load balancer serve the
+// same agents, whatever storage each keeps its registry in.
+type ReplayCache interface {
+	// RecordNonce remembers a nonce until expiresAt, returning false if it
+	// was already recorded and has not expired. Recording must be atomic
+	// across the brokers sharing the cache.
+	RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error)
+	// PruneNonces forgets nonces that expired before the given time
+	PruneNonces(before time.Time) error
+	Close() error
+}
+
+// OpenReplayCache connects to the shared replay cache at url: a Redis
+// server (redis:// or rediss://) or memcached servers
+// (memcache://host:port[,host:port...])
+func OpenReplayCache(url string) (ReplayCache, error) {
+	switch {
+	case strings.HasPrefix(url, "redis://"), strings.HasPrefix(url, "rediss://"):
+		options, err := redis.ParseURL(url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis URL: %w", err)
+		}
+		return NewRedisReplayCache(redis.NewClient(options))
+	case strings.HasPrefix(url, "memcache://"):
+		var servers []string
+		for _, server := range strings.Split(strings.TrimPrefix(url, "memcache://"), ",") {
+			if server = strings.TrimSpace(server); server == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "11211")
+			}
+			servers = append(servers, server)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("memcache URL %q names no servers", url)
+		}
+		return NewMemcacheReplayCache(servers...), nil
+	default:
+		return nil, fmt.Errorf("unsupported replay cache URL %q (want redis://, rediss:// or memcache://)", url)
+	}
+}
+
+// replayCache returns the cache nonces are recorded in: the shared cache if
+// one is set, otherwise the storage backend
+func (b *Broker) replayCache() ReplayCache {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.replay != nil {
+		return b.replay
+	}
+	return b.store
+}
+
+// SetReplayCache records nonces in cache instead of the storage backend, or
+// in the storage backend again if cache is nil
+func (b *Broker) SetReplayCache(cache ReplayCache) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replay = cache
+}
+
+// RedisReplayCache records nonces in Redis with SET NX, under the same keys
+// as RedisStore, so brokers may mix the two over one server
+type RedisReplayCache struct {
+	client *redis.Client
+}
+
+// NewRedisReplayCache wraps a connected client
+func NewRedisReplayCache(client *redis.Client) (*RedisReplayCache, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return &RedisReplayCache{client: client}, nil
+}
+
+// RecordNonce remembers a nonce, reporting whether it is new
+func (c *RedisReplayCache) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	return recordRedisNonce(c.client, agentID, nonce, expiresAt)
+}
+
+// PruneNonces is a no-op; Redis expires nonce keys itself
+func (c *RedisReplayCache) PruneNonces(before time.Time) error {
+	return nil
+}
+
+// Close disconnects from Redis
+func (c *RedisReplayCache) Close() error {
+	return c.client.Close()
+}
+
+// recordRedisNonce sets a nonce's key unless it exists. SET NX is atomic,
+// so replicas never both accept the same nonce.
+func recordRedisNonce(client *redis.Client, agentID, nonce string, expiresAt time.Time) (bool, error) {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return client.SetNX(ctx, redisNoncePrefix+agentID+":"+nonce, 1, ttl).Result()
+}
+
+// MemcacheReplayCache records nonces in memcached with add, which stores a
+// key only if it is absent. Keys are spread over the servers by hash, so
+// every broker sharing the cache must list the same servers in the same
+// order.
+type MemcacheReplayCache struct {
+	servers []string
+	idle    map[string]chan *memcacheConn
+}
+
+// memcacheConn is a connection to one memcached server
+type memcacheConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewMemcacheReplayCache creates a cache over the memcached servers at the
+// given addresses. Connections are opened as needed.
+func NewMemcacheReplayCache(servers ...string) *MemcacheReplayCache {
+	idle := make(map[string]chan *memcacheConn, len(servers))
+	for _, server := range servers {
+		idle[server] = make(chan *memcacheConn, memcacheIdleConns)
+	}
+	return &MemcacheReplayCache{servers: servers, idle: idle}
+}
+
+// RecordNonce remembers a nonce, reporting whether it is new
+func (c *MemcacheReplayCache) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return true, nil
+	}
+	exptime := int64((ttl + time.Second - 1) / time.Second)
+	if ttl > memcacheMaxRelative {
+		exptime = expiresAt.Unix()
+	}
+
+	// Keys are hashed: memcached keys are short and may not hold spaces
+	sum := sha256.Sum256([]byte(agentID + "\x00" + nonce))
+	key := redisNoncePrefix + hex.EncodeToString(sum[:])
+	server := c.servers[crc32.ChecksumIEEE([]byte(key))%uint32(len(c.servers))]
+
+	conn, err := c.conn(server)
+	if err != nil {
+		return false, err
+	}
+	conn.SetDeadline(time.Now().Add(memcacheTimeout))
+	if _, err := fmt.Fprintf(conn, "add %s 0 %d 1\r\n1\r\n", key, exptime); err != nil {
+		conn.Close()
+		return false, fmt.Errorf("memcached %s: %w", server, err)
+	}
+	reply, err := conn.reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return false, fmt.Errorf("memcached %s: %w", server, err)
+	}
+	c.release(server, conn)
+
+	switch reply = strings.TrimSpace(reply); reply {
+	case "STORED":
+		return true, nil
+	case "NOT_STORED":
+		return false, nil
+	default:
+		return false, fmt.Errorf("memcached %s: %s", server, reply)
+	}
+}
+
+// PruneNonces is a no-op; memcached expires nonce keys itself
+func (c *MemcacheReplayCache) PruneNonces(before time.Time) error {
+	return nil
+}
+
+// Close closes the idle connections
+func (c *MemcacheReplayCache) Close() error {
+	for _, idle := range c.idle {
+	drain:
+		for {
+			select {
+			case conn := <-idle:
+				conn.Close()
+			default:
+				break drain
+			}
+		}
+	}
+	return nil
+}
+
+// conn returns an idle connection to server, or dials a new one
+func (c *MemcacheReplayCache) conn(server string) (*memcacheConn, error) {
+	select {
+	case conn := <-c.idle[server]:
+		return conn, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", server, memcacheTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach memcached %s: %w", server, err)
+	}
+	return &memcacheConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// release keeps a healthy connection for reuse, or closes it if enough
+// are idle
+func (c *MemcacheReplayCache) release(server string, conn *memcacheConn) {
+	conn.SetDeadline(time.Time{})
+	select {
+	case c.idle[server] <- conn:
+	default:
+		conn.Close()
+	}
+}
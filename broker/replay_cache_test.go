@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/fep-fem/protocol"
+)
+
+// fakeMemcached serves the add command from a map, for testing
+func fakeMemcached(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	keys := map[string]bool{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					if len(fields) != 5 || fields[0] != "add" {
+						conn.Write([]byte("ERROR\r\n"))
+						continue
+					}
+					reader.ReadString('\n') // Data block
+
+					mu.Lock()
+					stored := !keys[fields[1]]
+					keys[fields[1]] = true
+					mu.Unlock()
+					if stored {
+						conn.Write([]byte("STORED\r\n"))
+					} else {
+						conn.Write([]byte("NOT_STORED\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestReplayCache(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	caches := map[string]string{
+		"redis":    "redis://" + redisServer.Addr(),
+		"memcache": "memcache://" + fakeMemcached(t) + "," + fakeMemcached(t),
+	}
+	for name, url := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache, err := OpenReplayCache(url)
+			if err != nil {
+				t.Fatalf("Failed to open cache: %v", err)
+			}
+			defer cache.Close()
+
+			expires := time.Now().Add(time.Minute)
+			for i := 0; i < 3; i++ {
+				if fresh, err := cache.RecordNonce("agent-a", "n-1", expires); err != nil || fresh != (i == 0) {
+					t.Fatalf("Recording nonce %d: got %v (%v)", i, fresh, err)
+				}
+			}
+			if fresh, _ := cache.RecordNonce("agent-b", "n-1", expires); !fresh {
+				t.Error("Expected nonces to be scoped to their agent")
+			}
+			if fresh, _ := cache.RecordNonce("agent-a", "n-2", time.Now().Add(-time.Second)); !fresh {
+				t.Error("Expected an expired nonce to be fresh")
+			}
+		})
+	}
+
+	// The Redis cache and a Redis store see each other's nonces
+	store := openTestRedisStore(t, redisServer)
+	if fresh, _ := store.RecordNonce("agent-a", "n-1", time.Now().Add(time.Minute)); fresh {
+		t.Error("Expected the store to see the cache's nonce")
+	}
+
+	for _, url := range []string{"memcache://", "postgres://db/fem", "redis://" + redisServer.Addr() + "/x"} {
+		if _, err := OpenReplayCache(url); err == nil {
+			t.Errorf("Expected %q to be refused", url)
+		}
+	}
+}
+
+func TestSharedReplayCache(t *testing.T) {
+	cache := NewMemcacheReplayCache(fakeMemcached(t))
+	defer cache.Close()
+
+	pubKey, key, _ := protocol.GenerateKeyPair()
+	heartbeat := protocol.NewAgentHeartbeat("agent-a", "ok")
+	heartbeat.Sign(key)
+	data, _ := json.Marshal(heartbeat)
+
+	// Replicas with their own storage refuse an envelope either has accepted
+	for i, want := range []int{http.StatusOK, http.StatusConflict} {
+		broker := NewBroker()
+		broker.SetReplayCache(cache)
+		registerWithKey(broker, "agent-a", pubKey, "", "")
+
+		env, _ := protocol.ParseEnvelope(data)
+		recorder := newBufferedResponse()
+		broker.dispatchEnvelope(recorder, env)
+		if recorder.status != want {
+			t.Errorf("Replica %d: expected %d, got %d: %s", i, want, recorder.status, recorder.body.String())
+		}
+	}
+
+	// An envelope whose nonce cannot be recorded is refused, not let through
+	broker := NewBroker()
+	broker.SetReplayCache(NewMemcacheReplayCache("127.0.0.1:1"))
+	registerWithKey(broker, "agent-a", pubKey, "", "")
+	heartbeat = protocol.NewAgentHeartbeat("agent-a", "ok")
+	heartbeat.Sign(key)
+	data, _ = json.Marshal(heartbeat)
+	env, _ := protocol.ParseEnvelope(data)
+	recorder := newBufferedResponse()
+	broker.dispatchEnvelope(recorder, env)
+	if recorder.status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while the replay cache is down, got %d: %s", recorder.status, recorder.body.String())
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// attachmentGrantTTL bounds how long a caller may fetch an attachment for,
+// unless the attachment expires sooner
+const attachmentGrantTTL = 10 * time.Minute
+
+// verifyAttachmentClaim checks the attachment on a toolResult before it is
+// delivered: the claim must be signed by the responding agent's registered
+// key and not yet expired. The claim is then kept in the audit trail with
+// the toolResult envelope carrying it.
+func (b *Broker) verifyAttachmentClaim(responder string, claim *protocol.AttachmentClaim) error {
+	if claim.Agent != responder {
+		return fmt.Errorf("attachment is claimed by %s, not %s", claim.Agent, responder)
+	}
+	b.mu.RLock()
+	agent, registered := b.agents[responder]
+	b.mu.RUnlock()
+	if !registered || agent.PubKey == nil {
+		return fmt.Errorf("agent %s has no registered key to verify its attachment", responder)
+	}
+	if err := claim.Verify(agent.PubKey); err != nil {
+		return err
+	}
+	if time.Now().UnixMilli() >= claim.Expires {
+		return fmt.Errorf("attachment %s has %w", claim.ID, protocol.ErrExpired)
+	}
+	return nil
+}
+
+// grantAttachment authorizes the caller of a tool to fetch the attachment
+// on its result directly from the agent serving it
+func (b *Broker) grantAttachment(caller string, result *protocol.ToolResultBody) {
+	if result.Attachment == nil {
+		return
+	}
+	expires := time.Now().Add(attachmentGrantTTL)
+	if claimed := time.UnixMilli(result.Attachment.Expires); claimed.Before(expires) {
+		expires = claimed
+	}
+
+	grant, err := protocol.NewAttachmentGrant(b.id, b.privateKey, result.Attachment, caller, expires)
+	if err != nil {
+		slog.Error("Failed to grant attachment", "attachment", result.Attachment.ID, "error", err)
+		return
+	}
+	result.AttachmentGrant = grant
+	slog.Info("Attachment granted", "requestId", result.RequestID, "attachment", grant.Attachment,
+		"agent", grant.Agent, "caller", caller, "size", result.Attachment.Size, "digest", grant.Digest)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestResultAttachmentGrant(t *testing.T) {
+	broker := NewBroker()
+	agentPub, agentKey, _ := protocol.GenerateKeyPair()
+	broker.agents["agent-a"] = &Agent{ID: "agent-a", PubKey: agentPub}
+	brokerPub := broker.privateKey.Public().(ed25519.PublicKey)
+
+	server := protocol.NewAttachmentServer("agent-a", agentKey, "https://agent-a.example/attachments", brokerPub)
+	claim, _ := server.Add([]byte("a very large result"), "text/plain", time.Minute)
+	if err := broker.verifyAttachmentClaim("agent-a", claim); err != nil {
+		t.Fatalf("Expected the claim to verify, got %v", err)
+	}
+	if err := broker.verifyAttachmentClaim("agent-b", claim); err == nil {
+		t.Error("Expected a claim relayed by another agent to be rejected")
+	}
+	tampered := *claim
+	tampered.Size = 1
+	if err := broker.verifyAttachmentClaim("agent-a", &tampered); err == nil {
+		t.Error("Expected a tampered claim to be rejected")
+	}
+
+	result := protocol.ToolResultBody{RequestID: "req-1", Success: true, Attachment: claim}
+	broker.grantAttachment("caller", &result)
+	grant := result.AttachmentGrant
+	if grant == nil {
+		t.Fatal("Expected a grant for the attachment")
+	}
+	if err := grant.Verify(brokerPub); err != nil {
+		t.Errorf("Expected the grant to be signed by the broker, got %v", err)
+	}
+	if grant.Requester != "caller" || grant.Attachment != claim.ID || grant.Digest != claim.Digest {
+		t.Errorf("Unexpected grant %+v", grant)
+	}
+	if grant.Expires > claim.Expires {
+		t.Error("Expected the grant to end when the attachment does")
+	}
+}
+
+func TestToolResultRejectsForgedAttachment(t *testing.T) {
+	broker := NewBroker()
+	agentPub, _, _ := protocol.GenerateKeyPair()
+	_, strangerKey, _ := protocol.GenerateKeyPair()
+	broker.agents["agent-a"] = &Agent{ID: "agent-a", PubKey: agentPub}
+
+	server := protocol.NewAttachmentServer("agent-a", strangerKey, "https://agent-a.example/attachments", agentPub)
+	claim, _ := server.Add([]byte("payload"), "", time.Minute)
+
+	env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolResult}}
+	env.Agent = "agent-a"
+	env.Body, _ = json.Marshal(protocol.ToolResultBody{RequestID: "req-1", Success: true, Attachment: claim})
+	recorder := newBufferedResponse()
+	broker.handleToolResult(recorder, env)
+	if recorder.status != http.StatusBadRequest {
+		t.Errorf("Expected a forged attachment to be rejected with 400, got %d", recorder.status)
+	}
+}
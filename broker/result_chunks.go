@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/fep-fem/protocol"
+)
+
+// handleToolResultChunk takes one chunk of a tool result sent in pieces. A
+// caller that asked for streamResult and holds a live connection gets each
+// chunk, still signed by the agent, as it arrives, and the final chunk ends
+// its call. For other callers the broker reassembles the chunks and answers
+// the call with the whole result, which must then fit in an envelope.
+func (b *Broker) handleToolResultChunk(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.ToolResultChunkBody
+	if err := env.GetBodyAs(&body); err != nil || body.RequestID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !b.verifyProvider(w, env) {
+		return
+	}
+
+	req, relay, err := b.pending.Chunk(env.Agent, body, protocol.MaxEnvelopeSize)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrUnexpectedResponder):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, ErrUnknownRequest):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, protocol.ErrResultTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("Chunk %d rejected: %v", body.Seq, err), http.StatusConflict)
+		return
+	}
+
+	if relay {
+		if err := b.relayStreamFrame(req.Caller, env); err != nil {
+			b.pending.Resolve(env.Agent, protocol.ToolResultBody{
+				RequestID: body.RequestID,
+				Error:     fmt.Sprintf("caller disconnected while the result was streamed: %v", err),
+			})
+			http.Error(w, fmt.Sprintf("Caller %s is no longer connected", req.Caller), http.StatusGone)
+			return
+		}
+		if body.Final {
+			b.pending.Resolve(env.Agent, protocol.ToolResultBody{
+				RequestID: body.RequestID,
+				Success:   body.Error == "",
+				Error:     body.Error,
+				Chunks:    body.Seq,
+			})
+		}
+	}
+	slog.Debug("Tool result chunk accepted", "requestId", body.RequestID, "seq", body.Seq, "final", body.Final, "relayed", relay)
+
+	response := map[string]interface{}{
+		"status":    "accepted",
+		"requestId": body.RequestID,
+		"seq":       body.Seq,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// SendResultChunks answers a pushed tool call with data as toolResultChunk
+// envelopes of at most chunkSize bytes, or protocol.DefaultResultChunkSize
+// if chunkSize is zero
+func (c *MCPClient) SendResultChunks(requestID string, data []byte, chunkSize int) error {
+	for _, chunk := range protocol.SplitToolResult(requestID, data, chunkSize) {
+		envelope := protocol.NewToolResultChunk(c.agentID, chunk)
+		if err := protocol.SignEnvelope(envelope, c.signer); err != nil {
+			return fmt.Errorf("failed to sign chunk: %w", err)
+		}
+		if _, err := c.sendRequest(envelope); err != nil {
+			return fmt.Errorf("failed to send chunk %d: %w", chunk.Seq, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestToolResultChunks(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	reporter := dialTestAgent(t, server, "report-agent")
+	reporter.register(protocol.MCPTool{Name: "report.fetch"})
+	reader := dialTestAgent(t, server, "reader-agent")
+	reader.register()
+
+	status := func(reply map[string]interface{}) float64 {
+		return reply["status"].(float64)
+	}
+	sendChunk := func(agent *wsTestAgent, chunk protocol.ToolResultChunkBody) float64 {
+		return status(agent.reply(agent.send(agent.id, protocol.EnvelopeToolResultChunk, chunk)))
+	}
+	resultBody := func(reply map[string]interface{}) map[string]interface{} {
+		return reply["response"].(map[string]interface{})["body"].(map[string]interface{})
+	}
+
+	// A caller asking for a streamed result gets each chunk as it is sent
+	callNonce := reader.send("reader-agent", protocol.EnvelopeToolCall, protocol.ToolCallBody{
+		Tool:         "report.fetch",
+		RequestID:    "req-stream",
+		StreamResult: true,
+	})
+	if call := reporter.pushed(protocol.EnvelopeToolCall); call["body"].(map[string]interface{})["streamResult"] != true {
+		t.Fatalf("Expected the agent to see streamResult, got %v", call)
+	}
+
+	var streamed string
+	readChunk := func(seq int) {
+		t.Helper()
+		chunk := reader.pushed(protocol.EnvelopeToolResultChunk)
+		body := chunk["body"].(map[string]interface{})
+		if chunk["agent"] != "report-agent" || body["seq"] != float64(seq) {
+			t.Fatalf("Unexpected chunk %v", chunk)
+		}
+		data, _ := base64.StdEncoding.DecodeString(body["data"].(string))
+		streamed += string(data)
+	}
+	if status := sendChunk(reporter, protocol.ToolResultChunkBody{RequestID: "req-stream", Seq: 1, Data: []byte("part one,")}); status != http.StatusOK {
+		t.Fatalf("Chunk 1 refused with %v", status)
+	}
+	readChunk(1)
+	if status := sendChunk(reporter, protocol.ToolResultChunkBody{RequestID: "req-stream", Seq: 3, Data: []byte("skipped")}); status != http.StatusConflict {
+		t.Errorf("Expected a chunk out of order refused, got %v", status)
+	}
+	if status := sendChunk(reader, protocol.ToolResultChunkBody{RequestID: "req-stream", Seq: 2}); status != http.StatusForbidden {
+		t.Errorf("Expected a chunk from the caller refused, got %v", status)
+	}
+	if status := sendChunk(reporter, protocol.ToolResultChunkBody{RequestID: "req-stream", Seq: 2, Final: true, Data: []byte(" part two")}); status != http.StatusOK {
+		t.Fatalf("Chunk 2 refused with %v", status)
+	}
+
+	readChunk(2)
+	if streamed != "part one, part two" {
+		t.Errorf("Unexpected streamed result %q", streamed)
+	}
+	if body := resultBody(reader.reply(callNonce)); body["success"] != true || body["chunks"] != float64(2) {
+		t.Errorf("Expected the call to end with the final chunk, got %v", body)
+	}
+
+	// Other callers get the result reassembled
+	callNonce = reader.send("reader-agent", protocol.EnvelopeToolCall, protocol.ToolCallBody{Tool: "report.fetch", RequestID: "req-whole"})
+	reporter.pushed(protocol.EnvelopeToolCall)
+	client := NewMCPClient(MCPClientConfig{AgentID: "report-agent", BrokerURL: server.URL, PrivateKey: reporter.privKey, TLSInsecure: true})
+	if err := client.SendResultChunks("req-whole", []byte("a result in small pieces"), 4); err != nil {
+		t.Fatalf("Sending chunks failed: %v", err)
+	}
+	if body := resultBody(reader.reply(callNonce)); body["result"] != "a result in small pieces" || body["chunks"] != nil {
+		t.Errorf("Expected the reassembled result, got %v", body)
+	}
+
+	if status := sendChunk(reporter, protocol.ToolResultChunkBody{RequestID: "req-whole", Seq: 7}); status != http.StatusNotFound {
+		t.Errorf("Expected a chunk of a finished call refused, got %v", status)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	// defaultSchemaCallerWindow is how recently an agent must have called a
+	// tool to be told its schema changed
+	defaultSchemaCallerWindow = 24 * time.Hour
+	// maxSchemaVersions bounds the versions kept per tool, oldest dropped first
+	maxSchemaVersions = 20
+)
+
+// SchemaVersion is one version of a tool's input and output schemas
+type SchemaVersion struct {
+	Version      int                    `json:"version"`
+	Hash         string                 `json:"hash"` // SHA-256 of the schemas, keys sorted
+	InputSchema  map[string]interface{} `json:"inputSchema,omitempty"`
+	OutputSchema map[string]interface{} `json:"outputSchema,omitempty"`
+	RegisteredAt time.Time              `json:"registeredAt"`
+	Breaking     []string               `json:"breaking,omitempty"` // How it breaks callers of the version before
+}
+
+// SchemaChange is an incompatible change to a tool's schemas
+type SchemaChange struct {
+	Agent    string
+	Tool     string
+	Previous int
+	Version  int
+	Breaking []string
+}
+
+// SchemaRegistry keeps versioned copies of the schemas of every tool
+// agents register, and which agents recently called each tool
+type SchemaRegistry struct {
+	versions map[string][]SchemaVersion      // By toolKey, oldest first
+	callers  map[string]map[string]time.Time // By toolKey, then caller, the time of its last call
+	window   time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+// NewSchemaRegistry creates an empty schema registry
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		versions: make(map[string][]SchemaVersion),
+		callers:  make(map[string]map[string]time.Time),
+		window:   defaultSchemaCallerWindow,
+		now:      time.Now,
+	}
+}
+
+// Record stores a tool's schemas as a new version if they differ from the
+// last registered. It returns the change if the new version breaks callers
+// of the old one.
+func (s *SchemaRegistry) Record(agentID string, tool protocol.MCPTool) *SchemaChange {
+	hash := schemaHash(tool)
+	key := toolKey(agentID, tool.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.versions[key]
+	version := SchemaVersion{
+		Version:      1,
+		Hash:         hash,
+		InputSchema:  tool.InputSchema,
+		OutputSchema: tool.OutputSchema,
+		RegisteredAt: s.now(),
+	}
+	var previous *SchemaVersion
+	if len(versions) > 0 {
+		previous = &versions[len(versions)-1]
+		if previous.Hash == hash {
+			return nil
+		}
+		version.Version = previous.Version + 1
+		version.Breaking = append(inputSchemaBreaks(previous.InputSchema, tool.InputSchema),
+			outputSchemaBreaks(previous.OutputSchema, tool.OutputSchema)...)
+	}
+	versions = append(versions, version)
+	if len(versions) > maxSchemaVersions {
+		versions = versions[len(versions)-maxSchemaVersions:]
+	}
+	s.versions[key] = versions
+
+	if previous == nil || len(version.Breaking) == 0 {
+		return nil
+	}
+	return &SchemaChange{
+		Agent:    agentID,
+		Tool:     tool.Name,
+		Previous: version.Version - 1,
+		Version:  version.Version,
+		Breaking: version.Breaking,
+	}
+}
+
+// Versions returns the versions kept for a tool, oldest first
+func (s *SchemaRegistry) Versions(agentID, tool string) []SchemaVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SchemaVersion(nil), s.versions[toolKey(agentID, tool)]...)
+}
+
+// RecordCall notes that caller called an agent's tool
+func (s *SchemaRegistry) RecordCall(agentID, tool, caller string) {
+	key := toolKey(agentID, tool)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	callers, exists := s.callers[key]
+	if !exists {
+		callers = make(map[string]time.Time)
+		s.callers[key] = callers
+	}
+	callers[caller] = s.now()
+}
+
+// Callers returns the agents that called a tool within the caller window,
+// in name order, dropping those that have not called it since
+func (s *SchemaRegistry) Callers(agentID, tool string) []string {
+	key := toolKey(agentID, tool)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := s.now().Add(-s.window)
+	var recent []string
+	for caller, last := range s.callers[key] {
+		if last.Before(cutoff) {
+			delete(s.callers[key], caller)
+			continue
+		}
+		recent = append(recent, caller)
+	}
+	if len(s.callers[key]) == 0 {
+		delete(s.callers, key)
+	}
+	sort.Strings(recent)
+	return recent
+}
+
+// schemaHash fingerprints a tool's schemas. Maps marshal with sorted keys,
+// so equal schemas hash alike whatever order the agent sent them in.
+func schemaHash(tool protocol.MCPTool) string {
+	data, _ := json.Marshal([]map[string]interface{}{tool.InputSchema, tool.OutputSchema})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// inputSchemaBreaks lists the changes to a tool's input schema that calls
+// valid against the old schema may fail: parameters removed, retyped or
+// newly required
+func inputSchemaBreaks(old, new map[string]interface{}) []string {
+	var breaks []string
+	if change := typeChange(old, new); change != "" {
+		breaks = append(breaks, "input "+change)
+	}
+	oldProperties, newProperties := schemaProperties(old), schemaProperties(new)
+	for _, name := range sortedKeys(oldProperties) {
+		property, exists := newProperties[name]
+		if !exists {
+			breaks = append(breaks, fmt.Sprintf("parameter %s was removed", name))
+			continue
+		}
+		if change := typeChange(oldProperties[name], property); change != "" {
+			breaks = append(breaks, fmt.Sprintf("parameter %s %s", name, change))
+		}
+	}
+	wasRequired := schemaRequired(old)
+	for _, name := range sortedSet(schemaRequired(new)) {
+		if !wasRequired[name] {
+			breaks = append(breaks, fmt.Sprintf("parameter %s is now required", name))
+		}
+	}
+	return breaks
+}
+
+// outputSchemaBreaks lists the changes to a tool's output schema that
+// callers reading the old result may trip over: fields removed, retyped or
+// no longer always present
+func outputSchemaBreaks(old, new map[string]interface{}) []string {
+	var breaks []string
+	if change := typeChange(old, new); change != "" {
+		breaks = append(breaks, "output "+change)
+	}
+	oldProperties, newProperties := schemaProperties(old), schemaProperties(new)
+	for _, name := range sortedKeys(oldProperties) {
+		property, exists := newProperties[name]
+		if !exists {
+			breaks = append(breaks, fmt.Sprintf("result field %s was removed", name))
+			continue
+		}
+		if change := typeChange(oldProperties[name], property); change != "" {
+			breaks = append(breaks, fmt.Sprintf("result field %s %s", name, change))
+		}
+	}
+	isRequired := schemaRequired(new)
+	for _, name := range sortedSet(schemaRequired(old)) {
+		if _, exists := newProperties[name]; exists && !isRequired[name] {
+			breaks = append(breaks, fmt.Sprintf("result field %s is no longer always present", name))
+		}
+	}
+	return breaks
+}
+
+// typeChange describes a change to a schema's declared type, or returns ""
+// if neither declares one or they agree
+func typeChange(old, new interface{}) string {
+	oldType, newType := schemaType(old), schemaType(new)
+	if oldType == "" || newType == "" || oldType == newType {
+		return ""
+	}
+	return fmt.Sprintf("changed type from %s to %s", oldType, newType)
+}
+
+func schemaType(schema interface{}) string {
+	fields, _ := schema.(map[string]interface{})
+	if declared, exists := fields["type"]; exists {
+		return fmt.Sprint(declared)
+	}
+	return ""
+}
+
+func schemaProperties(schema map[string]interface{}) map[string]interface{} {
+	properties, _ := schema["properties"].(map[string]interface{})
+	return properties
+}
+
+func schemaRequired(schema map[string]interface{}) map[string]bool {
+	required := make(map[string]bool)
+	names, _ := schema["required"].([]interface{})
+	for _, name := range names {
+		if name, ok := name.(string); ok {
+			required[name] = true
+		}
+	}
+	return required
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// recordSchemas versions the schemas of the tools an agent registered,
+// telling the recent callers of any tool that changed incompatibly
+func (b *Broker) recordSchemas(agentID string, tools []protocol.MCPTool) {
+	for _, tool := range tools {
+		change := b.schemas.Record(agentID, tool)
+		if change == nil {
+			continue
+		}
+		slog.Warn("Tool schema changed incompatibly", "agent", agentID, "tool", tool.Name,
+			"version", change.Version, "breaking", change.Breaking)
+		b.notifySchemaChange(change)
+	}
+}
+
+// notifySchemaChange sends a tool.schemaChanged event to the agents that
+// recently called the tool. Those not connected receive it when they next
+// connect, as with a broadcast.
+func (b *Broker) notifySchemaChange(change *SchemaChange) {
+	callers := b.schemas.Callers(change.Agent, change.Tool)
+	if len(callers) == 0 {
+		return
+	}
+
+	event := protocol.EmitEventBody{
+		Event: protocol.EventToolSchemaChanged,
+		Payload: map[string]interface{}{
+			"agent":           change.Agent,
+			"tool":            change.Tool,
+			"version":         change.Version,
+			"previousVersion": change.Previous,
+			"breaking":        change.Breaking,
+		},
+	}
+	notice, err := b.signedEvent(event)
+	if err != nil {
+		slog.Error("Failed to sign schema change event", "agent", change.Agent, "tool", change.Tool, "error", err)
+		return
+	}
+	data, err := json.Marshal(notice)
+	if err != nil {
+		slog.Error("Failed to encode schema change event", "agent", change.Agent, "tool", change.Tool, "error", err)
+		return
+	}
+	b.broadcasts.Send(b.id, event.Event, data, callers, 0)
+}
+
+// handleSchemaVersions serves GET /admin/schemas/{agent}/{tool}, the
+// versions kept of a tool's schemas
+func (b *Broker) handleSchemaVersions(w http.ResponseWriter, r *http.Request) {
+	agentID, tool, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/schemas/"), "/")
+	versions := b.schemas.Versions(agentID, tool)
+	if !found || len(versions) == 0 {
+		http.Error(w, "Unknown tool", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, versions)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// objectSchema builds a JSON schema with the given property types
+func objectSchema(types map[string]string, required ...string) map[string]interface{} {
+	properties := make(map[string]interface{}, len(types))
+	for name, typ := range types {
+		properties[name] = map[string]interface{}{"type": typ}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		names := make([]interface{}, len(required))
+		for i, name := range required {
+			names[i] = name
+		}
+		schema["required"] = names
+	}
+	return schema
+}
+
+func TestSchemaRegistryVersions(t *testing.T) {
+	schemas := NewSchemaRegistry()
+	tool := protocol.MCPTool{
+		Name:         "file.read",
+		InputSchema:  objectSchema(map[string]string{"path": "string", "offset": "integer"}, "path"),
+		OutputSchema: objectSchema(map[string]string{"content": "string", "size": "integer"}, "content", "size"),
+	}
+	if change := schemas.Record("agent-a", tool); change != nil {
+		t.Errorf("Expected the first version not to be a change, got %+v", change)
+	}
+	if change := schemas.Record("agent-a", tool); change != nil || len(schemas.Versions("agent-a", "file.read")) != 1 {
+		t.Error("Expected re-registering the same schemas to keep one version")
+	}
+
+	// Optional parameters and extra result fields are compatible
+	compatible := tool
+	compatible.InputSchema = objectSchema(map[string]string{"path": "string", "offset": "integer", "limit": "integer"}, "path")
+	compatible.OutputSchema = objectSchema(map[string]string{"content": "string", "size": "integer", "mtime": "string"}, "content", "size")
+	if change := schemas.Record("agent-a", compatible); change != nil {
+		t.Errorf("Expected a compatible change not to be reported, got %+v", change)
+	}
+
+	breaking := compatible
+	breaking.InputSchema = objectSchema(map[string]string{"path": "string", "offset": "string", "encoding": "string"}, "path", "encoding")
+	breaking.OutputSchema = objectSchema(map[string]string{"content": "string", "size": "integer"}, "content")
+	change := schemas.Record("agent-a", breaking)
+	if change == nil {
+		t.Fatal("Expected the breaking change to be reported")
+	}
+	expected := []string{
+		"parameter limit was removed",
+		"parameter offset changed type from integer to string",
+		"parameter encoding is now required",
+		"result field mtime was removed",
+		"result field size is no longer always present",
+	}
+	if change.Previous != 2 || change.Version != 3 || !reflect.DeepEqual(change.Breaking, expected) {
+		t.Errorf("Unexpected change %+v", change)
+	}
+	if versions := schemas.Versions("agent-a", "file.read"); len(versions) != 3 || !reflect.DeepEqual(versions[2].Breaking, expected) {
+		t.Errorf("Expected three versions, the last with its breaks, got %+v", versions)
+	}
+}
+
+func TestSchemaRegistryCallers(t *testing.T) {
+	schemas := NewSchemaRegistry()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	schemas.now = func() time.Time { return now }
+
+	schemas.RecordCall("agent-a", "file.read", "caller-old")
+	now = now.Add(20 * time.Hour)
+	schemas.RecordCall("agent-a", "file.read", "caller-b")
+	schemas.RecordCall("agent-a", "file.read", "caller-a")
+	schemas.RecordCall("agent-b", "file.read", "caller-c")
+	now = now.Add(5 * time.Hour)
+
+	if callers := schemas.Callers("agent-a", "file.read"); !reflect.DeepEqual(callers, []string{"caller-a", "caller-b"}) {
+		t.Errorf("Expected the two recent callers, got %v", callers)
+	}
+}
+
+func TestBreakingSchemaChangeNotifiesCallers(t *testing.T) {
+	broker := NewBroker()
+	pusher := newFakePusher()
+	pusher.connected["caller-agent"] = true
+	broker.broadcasts = NewBroadcastTable(pusher)
+
+	register := func(schema map[string]interface{}) {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent}}
+		env.Agent = "file-agent"
+		env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+			Capabilities: []string{"file.read"},
+			BodyDefinition: &protocol.BodyDefinition{
+				Name:     "files",
+				MCPTools: []protocol.MCPTool{{Name: "file.read", InputSchema: schema}},
+			},
+		})
+		recorder := newBufferedResponse()
+		broker.handleRegisterAgent(recorder, env)
+		if recorder.status != http.StatusOK {
+			t.Fatalf("Failed to register: %d %s", recorder.status, recorder.body.String())
+		}
+	}
+	register(objectSchema(map[string]string{"path": "string"}, "path"))
+
+	call := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+	call.Agent = "caller-agent"
+	call.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: "file.read", Parameters: map[string]interface{}{"path": "/tmp/a"}})
+	broker.handleToolCall(newBufferedResponse(), call)
+
+	register(objectSchema(map[string]string{"file": "string"}, "file"))
+
+	received := pusher.received["caller-agent"]
+	if len(received) != 1 {
+		t.Fatalf("Expected the caller to be told of the change, got %d envelopes", len(received))
+	}
+	notice, err := protocol.ParseEnvelope(received[0])
+	if err != nil {
+		t.Fatalf("Failed to parse notice: %v", err)
+	}
+	var event protocol.EmitEventBody
+	notice.GetBodyAs(&event)
+	if event.Event != protocol.EventToolSchemaChanged || event.Payload["tool"] != "file.read" || event.Payload["version"] != float64(2) {
+		t.Errorf("Unexpected notice %+v", event)
+	}
+
+	recorder := newBufferedResponse()
+	broker.SetAdminToken(testAdminToken)
+	request, _ := http.NewRequest(http.MethodGet, "/admin/schemas/file-agent/file.read", nil)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	broker.ServeHTTP(recorder, request)
+	var versions []SchemaVersion
+	json.Unmarshal(recorder.body.Bytes(), &versions)
+	if recorder.status != http.StatusOK || len(versions) != 2 {
+		t.Errorf("Expected two versions from the admin API, got %d %s", recorder.status, recorder.body.String())
+	}
+}
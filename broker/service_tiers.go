@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service tiers a broker run as a shared service sells its tools under
+const (
+	TierFree     = "free"
+	TierStandard = "standard"
+	TierPremium  = "premium"
+)
+
+// ServiceTier is the service level tool calls are routed and metered at
+type ServiceTier struct {
+	Name     string
+	Rate     float64 // Calls per second each caller may make to the tier's tools; 0 for no limit
+	Burst    int     // Calls a caller may make at once before Rate applies
+	Priority int     // Carried on the toolCall; agents run higher priorities first
+}
+
+// defaultServiceTiers are unlimited until -tier-limits says otherwise.
+// Tools assigned to no tier are standard.
+var defaultServiceTiers = map[string]ServiceTier{
+	TierFree:     {Name: TierFree, Priority: -1},
+	TierStandard: {Name: TierStandard, Priority: 0},
+	TierPremium:  {Name: TierPremium, Priority: 1},
+}
+
+// TierAssignment puts the tools matching Pattern, by tool name or by a
+// capability of the agent offering them, in Tier
+type TierAssignment struct {
+	Pattern string
+	Tier    string
+}
+
+// ParseTierLimits parses per-caller rate limits written as
+// "free=2/s,standard=600/m,premium=unlimited". Tiers left out are unlimited.
+func ParseTierLimits(spec string) (map[string]ServiceTier, error) {
+	tiers := make(map[string]ServiceTier, len(defaultServiceTiers))
+	for name, tier := range defaultServiceTiers {
+		tiers[name] = tier
+	}
+	for _, field := range parseSinkList(spec) {
+		name, value, found := strings.Cut(field, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid tier limit %q, expected tier=calls/unit", field)
+		}
+		tier, exists := tiers[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown service tier %q (want free, standard or premium)", name)
+		}
+		rate, err := parseCallRate(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tier limit %q: %w", name, value, err)
+		}
+		tier.Rate = rate
+		tier.Burst = int(math.Max(1, math.Ceil(rate)))
+		tiers[name] = tier
+	}
+	return tiers, nil
+}
+
+// parseCallRate reads "unlimited", or a number of calls per "s", "m" or "h"
+func parseCallRate(value string) (float64, error) {
+	if value == "unlimited" {
+		return 0, nil
+	}
+	count, unit, found := strings.Cut(value, "/")
+	if !found {
+		return 0, fmt.Errorf("expected calls/unit or unlimited")
+	}
+	calls, err := strconv.ParseFloat(count, 64)
+	if err != nil || calls <= 0 {
+		return 0, fmt.Errorf("expected a positive number of calls")
+	}
+	switch unit {
+	case "s":
+		return calls, nil
+	case "m":
+		return calls / 60, nil
+	case "h":
+		return calls / 3600, nil
+	}
+	return 0, fmt.Errorf("unknown unit %q (want s, m or h)", unit)
+}
+
+// ParseTierAssignments parses assignments written as
+// "gpu.*=premium,code.execute=premium,echo=free". The first matching
+// assignment decides a tool's tier.
+func ParseTierAssignments(spec string) ([]TierAssignment, error) {
+	var assignments []TierAssignment
+	for _, field := range parseSinkList(spec) {
+		pattern, tier, found := strings.Cut(field, "=")
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("invalid tier assignment %q, expected pattern=tier", field)
+		}
+		if _, exists := defaultServiceTiers[tier]; !exists {
+			return nil, fmt.Errorf("unknown service tier %q (want free, standard or premium)", tier)
+		}
+		assignments = append(assignments, TierAssignment{Pattern: pattern, Tier: tier})
+	}
+	return assignments, nil
+}
+
+// ServiceTiers classifies tools into tiers and holds each caller to the
+// rate limit of the tiers it calls into
+type ServiceTiers struct {
+	tiers       map[string]ServiceTier
+	assignments []TierAssignment
+	buckets     map[string]map[string]*tokenBucket // By caller, then tier
+	now         func() time.Time
+	mu          sync.Mutex
+}
+
+// NewServiceTiers creates a table with every tier unlimited and every
+// tool standard
+func NewServiceTiers() *ServiceTiers {
+	tiers, _ := ParseTierLimits("")
+	return &ServiceTiers{
+		tiers:   tiers,
+		buckets: make(map[string]map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Configure replaces the tier limits and assignments. Callers' buckets
+// start over, so a tightened limit applies at once.
+func (t *ServiceTiers) Configure(tiers map[string]ServiceTier, assignments []TierAssignment) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tiers = tiers
+	t.assignments = assignments
+	t.buckets = make(map[string]map[string]*tokenBucket)
+}
+
+// Classify returns the tier of a tool offered by an agent with the given
+// capabilities
+func (t *ServiceTiers) Classify(tool string, capabilities []string) ServiceTier {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, assignment := range t.assignments {
+		if matchPattern(tool, assignment.Pattern) {
+			return t.tiers[assignment.Tier]
+		}
+		for _, capability := range capabilities {
+			if matchPattern(capability, assignment.Pattern) {
+				return t.tiers[assignment.Tier]
+			}
+		}
+	}
+	return t.tiers[TierStandard]
+}
+
+// Allow takes one call from caller's allowance in tier. When none is
+// left it returns false and how long until one is.
+func (t *ServiceTiers) Allow(caller string, tier ServiceTier) (bool, time.Duration) {
+	if tier.Rate <= 0 {
+		return true, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	callerBuckets, exists := t.buckets[caller]
+	if !exists {
+		callerBuckets = make(map[string]*tokenBucket)
+		t.buckets[caller] = callerBuckets
+	}
+	bucket, exists := callerBuckets[tier.Name]
+	if !exists {
+		bucket = newTokenBucket(tier.Burst, now)
+		callerBuckets[tier.Name] = bucket
+	}
+	return bucket.take(tier.Rate, tier.Burst, now)
+}
+
+// retryAfterHeader formats a wait as a Retry-After value, in whole seconds
+func retryAfterHeader(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// Forget drops the allowances of an agent that left the broker
+func (t *ServiceTiers) Forget(caller string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.buckets, caller)
+}
+
+// toolTier returns the tier of a tool an agent offers
+func (b *Broker) toolTier(provider *RegisteredTool) ServiceTier {
+	b.mu.RLock()
+	var capabilities []string
+	if agent, exists := b.agents[provider.AgentID]; exists {
+		capabilities = agent.Capabilities
+	}
+	b.mu.RUnlock()
+	return b.tiers.Classify(provider.Tool.Name, capabilities)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestParseTierSpecs(t *testing.T) {
+	tiers, err := ParseTierLimits("free=2/s,standard=600/m")
+	if err != nil {
+		t.Fatalf("Failed to parse limits: %v", err)
+	}
+	if tiers[TierFree].Rate != 2 || tiers[TierFree].Burst != 2 || tiers[TierStandard].Rate != 10 || tiers[TierPremium].Rate != 0 {
+		t.Errorf("Unexpected tiers %+v", tiers)
+	}
+	for _, spec := range []string{"gold=1/s", "free=2", "free=0/s", "free=2/d"} {
+		if _, err := ParseTierLimits(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+
+	if _, err := ParseTierAssignments("gpu.*=premium,echo=free"); err != nil {
+		t.Errorf("Failed to parse assignments: %v", err)
+	}
+	for _, spec := range []string{"gpu.*", "gpu.*=gold", "=free"} {
+		if _, err := ParseTierAssignments(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestServiceTiersClassifyAndAllow(t *testing.T) {
+	tiers := NewServiceTiers()
+	limits, _ := ParseTierLimits("free=1/s")
+	assignments, _ := ParseTierAssignments("gpu.*=premium,code.execute=premium,echo=free")
+	tiers.Configure(limits, assignments)
+
+	if tier := tiers.Classify("gpu.render", nil); tier.Name != TierPremium || tier.Priority != 1 {
+		t.Errorf("Expected gpu.render to be premium, got %+v", tier)
+	}
+	if tier := tiers.Classify("shell.run", []string{"code.execute"}); tier.Name != TierPremium {
+		t.Errorf("Expected a code.execute agent's tools to be premium, got %+v", tier)
+	}
+	if tier := tiers.Classify("file.read", []string{"file.read"}); tier.Name != TierStandard {
+		t.Errorf("Expected unassigned tools to be standard, got %+v", tier)
+	}
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tiers.now = func() time.Time { return now }
+	free := tiers.Classify("echo", nil)
+	if allowed, _ := tiers.Allow("agent-a", free); !allowed {
+		t.Fatal("Expected the first call to be allowed")
+	}
+	if allowed, wait := tiers.Allow("agent-a", free); allowed || wait != time.Second {
+		t.Errorf("Expected the second call to wait a second, got %v %v", allowed, wait)
+	}
+	if allowed, _ := tiers.Allow("agent-b", free); !allowed {
+		t.Error("Expected each caller to have its own allowance")
+	}
+	now = now.Add(time.Second)
+	if allowed, _ := tiers.Allow("agent-a", free); !allowed {
+		t.Error("Expected the allowance to refill")
+	}
+	for i := 0; i < 10; i++ {
+		if allowed, _ := tiers.Allow("agent-a", tiers.Classify("gpu.render", nil)); !allowed {
+			t.Fatal("Expected the unlimited premium tier to allow every call")
+		}
+	}
+}
+
+func TestToolCallRateLimitedByTier(t *testing.T) {
+	broker := NewBroker()
+	limits, _ := ParseTierLimits("free=1/h")
+	assignments, _ := ParseTierAssignments("echo=free")
+	broker.tiers.Configure(limits, assignments)
+	broker.mcpRegistry.RegisterAgent("echo-agent", &MCPAgent{
+		ID:            "echo-agent",
+		Tools:         []protocol.MCPTool{{Name: "echo"}},
+		LastHeartbeat: time.Now(),
+	})
+
+	call := func() *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+		env.Agent = "caller-agent"
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: "echo"})
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+		return recorder
+	}
+
+	// The first call is routed and metered as free, though the agent has
+	// no endpoint to take it
+	if recorder := call(); recorder.status != http.StatusOK {
+		t.Fatalf("Expected the first call to be routed, got %d", recorder.status)
+	}
+	report, _ := broker.usage.Report("daily", time.Now())
+	if len(report.Agents) == 0 || report.Agents[0].TierCalls[TierFree] != 1 {
+		t.Errorf("Expected the call metered under the free tier, got %+v", report.Agents)
+	}
+
+	recorder := call()
+	if recorder.status != http.StatusTooManyRequests || recorder.header.Get("Retry-After") == "" {
+		t.Errorf("Expected the second call to be rate limited, got %d", recorder.status)
+	}
+}
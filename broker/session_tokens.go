@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultSessionTTL bounds how long a session token stands in for
+// signature checks before the agent is verified again
+const defaultSessionTTL = 5 * time.Minute
+
+// sessionTokenSize is the number of random bytes in a session token
+const sessionTokenSize = 32
+
+// agentSession is an agent verified over one connection
+type agentSession struct {
+	agent   string
+	conn    string // Remote address of the connection the session is bound to
+	expires time.Time
+}
+
+// SessionTable holds the session tokens issued to agents once their
+// signature has been verified over a connection. A token is only accepted
+// from the agent it was issued to, over the same connection, until it
+// expires or the agent's sessions are revoked.
+type SessionTable struct {
+	sessions map[string]*agentSession
+	ttl      time.Duration
+	mu       sync.Mutex
+}
+
+// NewSessionTable creates an empty session table issuing tokens valid for
+// ttl; a ttl of 0 disables sessions
+func NewSessionTable(ttl time.Duration) *SessionTable {
+	return &SessionTable{
+		sessions: make(map[string]*agentSession),
+		ttl:      ttl,
+	}
+}
+
+// SetTTL changes how long new tokens are valid; 0 disables sessions and
+// drops the tokens already issued
+func (st *SessionTable) SetTTL(ttl time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.ttl = ttl
+	if ttl <= 0 {
+		st.sessions = make(map[string]*agentSession)
+	}
+}
+
+// Issue creates a session token for an agent verified over conn. It
+// returns false if sessions are disabled or the connection is unknown.
+func (st *SessionTable) Issue(agent, conn string, now time.Time) (string, bool) {
+	if conn == "" {
+		return "", false
+	}
+	random := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", false
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ttl <= 0 {
+		return "", false
+	}
+	for issued, session := range st.sessions {
+		if !now.Before(session.expires) {
+			delete(st.sessions, issued)
+		}
+	}
+	st.sessions[token] = &agentSession{agent: agent, conn: conn, expires: now.Add(st.ttl)}
+	return token, true
+}
+
+// Valid reports whether token was issued to agent over conn and is still
+// in force
+func (st *SessionTable) Valid(token, agent, conn string, now time.Time) bool {
+	if token == "" {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	session, exists := st.sessions[token]
+	if !exists {
+		return false
+	}
+	if !now.Before(session.expires) {
+		delete(st.sessions, token)
+		return false
+	}
+	return session.agent == agent && session.conn == conn
+}
+
+// Revoke invalidates one session token
+func (st *SessionTable) Revoke(token string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, token)
+}
+
+// RevokeAgent invalidates every session of an agent, so its next envelope
+// on any connection has its signature verified against its current key. It
+// returns the number of sessions revoked.
+func (st *SessionTable) RevokeAgent(agent string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	revoked := 0
+	for token, session := range st.sessions {
+		if session.agent == agent {
+			delete(st.sessions, token)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// SetSessionTTL sets how long session tokens stand in for signature
+// checks; 0 disables sessions
+func (b *Broker) SetSessionTTL(ttl time.Duration) {
+	b.sessions.SetTTL(ttl)
+}
+
+// revokeSessions invalidates an agent's sessions when its identity changes
+// or is revoked
+func (b *Broker) revokeSessions(agent string) {
+	if revoked := b.sessions.RevokeAgent(agent); revoked > 0 {
+		slog.Debug("Sessions revoked", "agent", agent, "sessions", revoked)
+	}
+}
+
+// verifySender checks an envelope's signature against the sender's key,
+// unless the envelope carries a session token issued to the sender over the
+// same connection. An envelope whose signature was verified is answered
+// with a session token for the connection.
+func (b *Broker) verifySender(w http.ResponseWriter, env *protocol.GenericEnvelope, pubKey protocol.PublicKey) error {
+	now := time.Now()
+	if b.sessions.Valid(env.Session, env.Agent, env.RemoteAddr, now) {
+		return nil
+	}
+	if err := env.VerifyKey(pubKey); err != nil {
+		return err
+	}
+	if token, issued := b.sessions.Issue(env.Agent, env.RemoteAddr, now); issued {
+		env.Session = token
+		w.Header().Set(protocol.HeaderSession, token)
+	}
+	return nil
+}
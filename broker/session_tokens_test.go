@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func heartbeatFrom(t *testing.T, broker *Broker, agent string, key ed25519.PrivateKey, conn, session string) *bufferedResponse {
+	t.Helper()
+	heartbeat := protocol.NewAgentHeartbeat(agent, "ok")
+	heartbeat.Sign(key)
+	data, _ := json.Marshal(heartbeat)
+	env, err := protocol.ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse heartbeat: %v", err)
+	}
+	env.RemoteAddr = conn
+	env.Session = session
+
+	recorder := newBufferedResponse()
+	broker.handleAgentHeartbeat(recorder, env)
+	return recorder
+}
+
+func TestSessionTokenStandsInForSignature(t *testing.T) {
+	broker := NewBroker()
+	pubKey, key, _ := protocol.GenerateKeyPair()
+	_, otherKey, _ := protocol.GenerateKeyPair()
+	registerWithKey(broker, "agent-a", pubKey, "", "")
+	registerWithKey(broker, "agent-b", pubKey, "", "")
+
+	// A verified envelope is answered with a session for its connection
+	recorder := heartbeatFrom(t, broker, "agent-a", key, "10.0.0.1:4000", "")
+	session := recorder.header.Get(protocol.HeaderSession)
+	if recorder.status != http.StatusOK || session == "" {
+		t.Fatalf("Expected a session token, got %d %q", recorder.status, session)
+	}
+
+	// Later envelopes with the token are not verified again...
+	if recorder := heartbeatFrom(t, broker, "agent-a", otherKey, "10.0.0.1:4000", session); recorder.status != http.StatusOK {
+		t.Errorf("Expected the session to stand in for the signature, got %d", recorder.status)
+	}
+
+	// ...but only for the same agent over the same connection
+	if recorder := heartbeatFrom(t, broker, "agent-a", otherKey, "10.0.0.2:4000", session); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected the session to be refused on another connection, got %d", recorder.status)
+	}
+	if recorder := heartbeatFrom(t, broker, "agent-b", otherKey, "10.0.0.1:4000", session); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected the session to be refused for another agent, got %d", recorder.status)
+	}
+
+	// Registering again revokes the agent's sessions
+	registerWithToken(broker, "agent-a", key, []string{"echo"}, "")
+	if recorder := heartbeatFrom(t, broker, "agent-a", otherKey, "10.0.0.1:4000", session); recorder.status != http.StatusUnauthorized {
+		t.Errorf("Expected re-registration to revoke the session, got %d", recorder.status)
+	}
+}
+
+func TestSessionTableExpiryAndRevocation(t *testing.T) {
+	sessions := NewSessionTable(time.Minute)
+	now := time.Now()
+
+	token, issued := sessions.Issue("agent-a", "10.0.0.1:4000", now)
+	if !issued || !sessions.Valid(token, "agent-a", "10.0.0.1:4000", now) {
+		t.Fatal("Expected the issued session to be valid")
+	}
+	if sessions.Valid(token, "agent-a", "10.0.0.1:4000", now.Add(2*time.Minute)) {
+		t.Error("Expected the session to expire")
+	}
+
+	token, _ = sessions.Issue("agent-a", "10.0.0.1:4000", now)
+	if revoked := sessions.RevokeAgent("agent-a"); revoked != 1 || sessions.Valid(token, "agent-a", "10.0.0.1:4000", now) {
+		t.Errorf("Expected the agent's session to be revoked, revoked %d", revoked)
+	}
+
+	if _, issued := sessions.Issue("agent-a", "", now); issued {
+		t.Error("Expected no session without a connection")
+	}
+	sessions.SetTTL(0)
+	if _, issued := sessions.Issue("agent-a", "10.0.0.1:4000", now); issued {
+		t.Error("Expected no session once sessions are disabled")
+	}
+}
+
+func TestMCPClientReusesSession(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	_, key, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{
+		AgentID:     "agent-a",
+		BrokerURL:   server.URL,
+		PrivateKey:  key,
+		TLSInsecure: true,
+	})
+	pubKey := key.Public().(ed25519.PublicKey)
+	if err := client.Register(protocol.RegisterAgentBody{PubKey: protocol.EncodePublicKey(pubKey)}); err != nil {
+		t.Fatalf("Registration failed: %v", err)
+	}
+	if _, err := client.Heartbeat("ok"); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	session := client.currentSession()
+	if session == "" {
+		t.Fatal("Expected the client to keep the broker's session token")
+	}
+
+	// The deregistration rides on the session; afterwards it is revoked
+	if err := client.Deregister("done"); err != nil {
+		t.Fatalf("Deregistration failed: %v", err)
+	}
+	if revoked := broker.sessions.RevokeAgent("agent-a"); revoked != 0 {
+		t.Errorf("Expected deregistration to revoke the agent's sessions, %d left", revoked)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	"github.com/fep-fem/protocol/simagent"
+)
+
+func TestSimulatedFleetDiscoveryAndRouting(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	fleet, err := simagent.Spawn(3, simagent.Config{
+		Broker:       server.URL,
+		Client:       server.Client(),
+		Prefix:       "worker",
+		Capabilities: []string{"echo"},
+		Tools: []simagent.Tool{
+			{MCPTool: protocol.MCPTool{Name: "echo"}, Latency: 5 * time.Millisecond},
+			{MCPTool: protocol.MCPTool{Name: "flaky"}, FailureRate: 1},
+			{MCPTool: protocol.MCPTool{Name: "slow"}, Async: true, Latency: 10 * time.Millisecond},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to spawn fleet: %v", err)
+	}
+	defer fleet.Close()
+
+	caller, err := simagent.New("caller", simagent.Config{Broker: server.URL, Client: server.Client()})
+	if err != nil {
+		t.Fatalf("Failed to start caller: %v", err)
+	}
+	defer caller.Close()
+	if err := caller.Register(); err != nil {
+		t.Fatalf("Failed to register caller: %v", err)
+	}
+
+	tools, err := caller.Discover(protocol.ToolQuery{Capabilities: []string{"echo"}})
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	if len(tools) != 3 {
+		t.Errorf("Expected 3 agents offering echo, got %d", len(tools))
+	}
+
+	for i := 0; i < 6; i++ {
+		result, err := caller.CallTool("echo", map[string]interface{}{"i": i})
+		if err != nil || !result.Success {
+			t.Fatalf("Expected echo to succeed, got %+v, %v", result, err)
+		}
+	}
+	if calls := fleet.Calls("echo"); calls != 6 {
+		t.Errorf("Expected 6 echo calls to reach the fleet, got %d", calls)
+	}
+
+	result, err := caller.CallTool("flaky", nil)
+	if err != nil || result.Success || result.Error == "" {
+		t.Errorf("Expected flaky to fail with an error, got %+v, %v", result, err)
+	}
+
+	// Asynchronous results come back as toolResult envelopes
+	result, err = caller.CallTool("slow", map[string]interface{}{"n": 1})
+	if err != nil || !result.Success {
+		t.Errorf("Expected slow to succeed asynchronously, got %+v, %v", result, err)
+	}
+
+	// Agents that leave are no longer discovered
+	if err := fleet.Get("worker-1").Deregister(); err != nil {
+		t.Fatalf("Failed to deregister: %v", err)
+	}
+	tools, _ = caller.Discover(protocol.ToolQuery{Capabilities: []string{"echo"}})
+	if len(tools) != 2 {
+		t.Errorf("Expected 2 agents offering echo after one left, got %d", len(tools))
+	}
+}
+
+func TestSimulatedFleetAcrossFederation(t *testing.T) {
+	_, serverA, _, serverB := federatedPair(t)
+
+	fleet, err := simagent.Spawn(2, simagent.Config{
+		Broker:       serverB.URL,
+		Client:       serverB.Client(),
+		Capabilities: []string{"weather"},
+		Tools:        []simagent.Tool{{MCPTool: protocol.MCPTool{Name: "weather.read"}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to spawn fleet: %v", err)
+	}
+	defer fleet.Close()
+
+	// A caller on broker-a reaches agents registered only on broker-b
+	caller, _ := simagent.New("caller", simagent.Config{Broker: serverA.URL, Client: serverA.Client()})
+	defer caller.Close()
+	if err := caller.Register(); err != nil {
+		t.Fatalf("Failed to register caller: %v", err)
+	}
+	result, err := caller.CallTool("weather.read", map[string]interface{}{"city": "Oslo"})
+	if err != nil || !result.Success {
+		t.Fatalf("Expected the call to be forwarded to broker-b, got %+v, %v", result, err)
+	}
+	if fleet.Calls("weather.read") != 1 {
+		t.Errorf("Expected one call to reach the fleet, got %d", fleet.Calls("weather.read"))
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Registers the "pgx" database/sql driver
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// sqlSchema creates the tables used by SQLStore. Records are stored as JSON
+// so the schema stays portable across database/sql drivers.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS fem_agents (id VARCHAR(255) PRIMARY KEY, data TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS fem_mcp_agents (id VARCHAR(255) PRIMARY KEY, data TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS fem_tools (agent_id VARCHAR(255) NOT NULL, name VARCHAR(255) NOT NULL, data TEXT NOT NULL, PRIMARY KEY (agent_id, name))`,
+	`CREATE TABLE IF NOT EXISTS fem_subscriptions (agent_id VARCHAR(255) PRIMARY KEY, data TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS fem_nonces (agent_id VARCHAR(255) NOT NULL, nonce VARCHAR(255) NOT NULL, expires_at BIGINT NOT NULL, PRIMARY KEY (agent_id, nonce))`,
+	`CREATE TABLE IF NOT EXISTS fem_revocations (agent_id VARCHAR(255) PRIMARY KEY, data TEXT NOT NULL)`,
+}
+
+// SQLStore persists broker state through database/sql. The driver must be
+// linked into the binary; drivers named postgres or pgx use $n placeholders,
+// all others use ?.
+type SQLStore struct {
+	db      *sql.DB
+	dollars bool
+	cipher  *RecordCipher
+}
+
+// OpenSQLStore connects with the named driver and creates the schema
+func OpenSQLStore(driver, dsn string) (*SQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", driver, err)
+	}
+
+	store, err := NewSQLStore(db, driver == "postgres" || strings.HasPrefix(driver, "pgx"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewSQLStore wraps an open database, creating the schema if needed
+func NewSQLStore(db *sql.DB, dollarPlaceholders bool) (*SQLStore, error) {
+	store := &SQLStore{db: db, dollars: dollarPlaceholders}
+	for _, statement := range sqlSchema {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+	return store, nil
+}
+
+// Close closes the database
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind rewrites ? placeholders for drivers that expect $1, $2, ...
+func (s *SQLStore) rebind(query string) string {
+	if !s.dollars {
+		return query
+	}
+
+	var rebound strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+	return rebound.String()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLStore) exec(e execer, query string, args ...interface{}) error {
+	_, err := e.Exec(s.rebind(query), args...)
+	return err
+}
+
+// SetCipher encrypts records saved from now on; records already stored
+// stay readable
+func (s *SQLStore) SetCipher(c *RecordCipher) {
+	s.cipher = c
+}
+
+// replaceJSON deletes and re-inserts the JSON record of an agent, which
+// works on every SQL dialect without relying on upsert syntax
+func (s *SQLStore) replaceJSON(e execer, table, keyColumn, key string, value interface{}) error {
+	data, err := s.cipher.seal(key, value)
+	if err != nil {
+		return err
+	}
+	if err := s.exec(e, "DELETE FROM "+table+" WHERE "+keyColumn+" = ?", key); err != nil {
+		return err
+	}
+	return s.exec(e, "INSERT INTO "+table+" ("+keyColumn+", data) VALUES (?, ?)", key, string(data))
+}
+
+// withTx runs fn in a transaction, committing if it succeeds
+func (s *SQLStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveAgent stores an agent, its MCP registration and its tools
+func (s *SQLStore) SaveAgent(agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if err := s.deleteAgent(tx, agent.ID); err != nil {
+			return err
+		}
+		if err := s.replaceJSON(tx, "fem_agents", "id", agent.ID, agent); err != nil {
+			return err
+		}
+		if mcpAgent != nil {
+			if err := s.replaceJSON(tx, "fem_mcp_agents", "id", agent.ID, mcpAgent); err != nil {
+				return err
+			}
+		}
+		for _, tool := range tools {
+			data, err := s.cipher.seal(tool.AgentID, tool)
+			if err != nil {
+				return err
+			}
+			if err := s.exec(tx, "INSERT INTO fem_tools (agent_id, name, data) VALUES (?, ?, ?)", tool.AgentID, tool.Tool.Name, string(data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteAgent removes an agent, its MCP registration and its tools
+func (s *SQLStore) DeleteAgent(agentID string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		return s.deleteAgent(tx, agentID)
+	})
+}
+
+func (s *SQLStore) deleteAgent(e execer, agentID string) error {
+	if err := s.exec(e, "DELETE FROM fem_agents WHERE id = ?", agentID); err != nil {
+		return err
+	}
+	if err := s.exec(e, "DELETE FROM fem_mcp_agents WHERE id = ?", agentID); err != nil {
+		return err
+	}
+	return s.exec(e, "DELETE FROM fem_tools WHERE agent_id = ?", agentID)
+}
+
+// loadJSON decodes every data column returned by query, in order
+func (s *SQLStore) loadJSON(query string, decode func(data []byte) error) error {
+	rows, err := s.db.Query(s.rebind(query))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		if err := decode([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LoadAgents returns all stored agents
+func (s *SQLStore) LoadAgents() ([]*Agent, error) {
+	var agents []*Agent
+	err := s.loadJSON("SELECT data FROM fem_agents ORDER BY id", func(data []byte) error {
+		var agent Agent
+		if err := s.cipher.open(data, &agent); err != nil {
+			return fmt.Errorf("corrupt agent record: %w", err)
+		}
+		agents = append(agents, &agent)
+		return nil
+	})
+	return agents, err
+}
+
+// LoadMCPAgents returns all stored MCP registrations
+func (s *SQLStore) LoadMCPAgents() ([]*MCPAgent, error) {
+	var agents []*MCPAgent
+	err := s.loadJSON("SELECT data FROM fem_mcp_agents ORDER BY id", func(data []byte) error {
+		var agent MCPAgent
+		if err := s.cipher.open(data, &agent); err != nil {
+			return fmt.Errorf("corrupt MCP agent record: %w", err)
+		}
+		agents = append(agents, &agent)
+		return nil
+	})
+	return agents, err
+}
+
+// LoadTools returns all stored tool index entries
+func (s *SQLStore) LoadTools() ([]*RegisteredTool, error) {
+	var tools []*RegisteredTool
+	err := s.loadJSON("SELECT data FROM fem_tools ORDER BY agent_id, name", func(data []byte) error {
+		var tool RegisteredTool
+		if err := s.cipher.open(data, &tool); err != nil {
+			return fmt.Errorf("corrupt tool record: %w", err)
+		}
+		tools = append(tools, &tool)
+		return nil
+	})
+	return tools, err
+}
+
+// SaveSubscription stores an agent's subscription
+func (s *SQLStore) SaveSubscription(sub Subscription) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		return s.replaceJSON(tx, "fem_subscriptions", "agent_id", sub.AgentID, sub)
+	})
+}
+
+// DeleteSubscription removes an agent's subscription
+func (s *SQLStore) DeleteSubscription(agentID string) error {
+	return s.exec(s.db, "DELETE FROM fem_subscriptions WHERE agent_id = ?", agentID)
+}
+
+// LoadSubscriptions returns all stored subscriptions ordered by agent
+func (s *SQLStore) LoadSubscriptions() ([]Subscription, error) {
+	var subs []Subscription
+	err := s.loadJSON("SELECT data FROM fem_subscriptions ORDER BY agent_id", func(data []byte) error {
+		var sub Subscription
+		if err := s.cipher.open(data, &sub); err != nil {
+			return fmt.Errorf("corrupt subscription record: %w", err)
+		}
+		subs = append(subs, sub)
+		return nil
+	})
+	return subs, err
+}
+
+// SaveRevocation stores what was revoked from an agent
+func (s *SQLStore) SaveRevocation(revocation Revocation) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		return s.replaceJSON(tx, "fem_revocations", "agent_id", revocation.AgentID, revocation)
+	})
+}
+
+// DeleteRevocation forgets what was revoked from an agent
+func (s *SQLStore) DeleteRevocation(agentID string) error {
+	return s.exec(s.db, "DELETE FROM fem_revocations WHERE agent_id = ?", agentID)
+}
+
+// LoadRevocations returns all stored revocations ordered by agent
+func (s *SQLStore) LoadRevocations() ([]Revocation, error) {
+	var revocations []Revocation
+	err := s.loadJSON("SELECT data FROM fem_revocations ORDER BY agent_id", func(data []byte) error {
+		var revocation Revocation
+		if err := s.cipher.open(data, &revocation); err != nil {
+			return fmt.Errorf("corrupt revocation record: %w", err)
+		}
+		revocations = append(revocations, revocation)
+		return nil
+	})
+	return revocations, err
+}
+
+// RecordNonce remembers a nonce, reporting whether it is new. The primary
+// key makes concurrent inserts of the same nonce from several brokers fail,
+// so a failed insert of a nonce that now exists is reported as a replay.
+func (s *SQLStore) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	now := time.Now().UnixMilli()
+	if err := s.exec(s.db, "DELETE FROM fem_nonces WHERE agent_id = ? AND nonce = ? AND expires_at <= ?", agentID, nonce, now); err != nil {
+		return false, err
+	}
+
+	err := s.exec(s.db, "INSERT INTO fem_nonces (agent_id, nonce, expires_at) VALUES (?, ?, ?)", agentID, nonce, expiresAt.UnixMilli())
+	if err == nil {
+		return true, nil
+	}
+
+	var count int
+	row := s.db.QueryRow(s.rebind("SELECT COUNT(*) FROM fem_nonces WHERE agent_id = ? AND nonce = ?"), agentID, nonce)
+	if scanErr := row.Scan(&count); scanErr != nil || count == 0 {
+		return false, err
+	}
+	return false, nil
+}
+
+// PruneNonces forgets expired nonces
+func (s *SQLStore) PruneNonces(before time.Time) error {
+	return s.exec(s.db, "DELETE FROM fem_nonces WHERE expires_at < ?", before.UnixMilli())
+}
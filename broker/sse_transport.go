@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+const (
+	sseBufferSize        = 64
+	sseKeepAliveInterval = 25 * time.Second
+)
+
+var errStreamClosed = errors.New("event stream closed")
+
+// sseConn is an agent's Server-Sent Events stream. Pushed envelopes are
+// buffered and written by the request goroutine serving the stream.
+type sseConn struct {
+	agentID   string
+	frames    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSSEConn(agentID string) *sseConn {
+	return &sseConn{
+		agentID: agentID,
+		frames:  make(chan []byte, sseBufferSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *sseConn) agent() string {
+	return c.agentID
+}
+
+func (c *sseConn) write(data []byte) error {
+	select {
+	case <-c.done:
+		return errStreamClosed
+	default:
+	}
+
+	select {
+	case c.frames <- data:
+		return nil
+	default:
+		return fmt.Errorf("event stream buffer full for %s", c.agentID)
+	}
+}
+
+func (c *sseConn) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// handleEventStream serves GET /events, streaming envelopes destined for
+// the agent as Server-Sent Events. The request's headers must be signed with
+// the agent's registered key (see protocol.SignEventStreamRequest), under a
+// nonce not seen before, so a captured request cannot be replayed to take
+// over the agent's stream. Agents reply to pushed envelopes, such as tool
+// calls, with regular POSTs.
+func (b *Broker) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	agentID := r.Header.Get(protocol.HeaderEventStreamAgent)
+
+	b.mu.RLock()
+	agent, registered := b.agents[agentID]
+	b.mu.RUnlock()
+	if !registered || agent.PubKey == nil {
+		http.Error(w, "Unknown agent", http.StatusUnauthorized)
+		return
+	}
+	if err := protocol.VerifyEventStreamRequest(r.Header, agent.PubKey); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid event stream request: %v", err), http.StatusUnauthorized)
+		return
+	}
+	fresh, err := b.checkReplay(agentID, "events:"+r.Header.Get(protocol.HeaderEventStreamNonce))
+	if err != nil {
+		http.Error(w, "Replay protection is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !fresh {
+		http.Error(w, "Replayed event stream request", http.StatusConflict)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Only a freshly signed request gets this far, so only the agent itself
+	// can replace its live stream
+	c := newSSEConn(agentID)
+	if previous := b.hub.add(c); previous != nil {
+		previous.close()
+	}
+	defer func() {
+		if b.hub.remove(c) {
+			b.closeAgentStreams(agentID)
+		}
+		c.close()
+		slog.Info("Event stream closed", "agent", agentID)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	slog.Info("Event stream opened", "agent", agentID)
+	go b.broadcasts.Deliver(agentID)
+	go b.outbox.Deliver(agentID)
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case data := <-c.frames:
+			// Marshaled envelopes are single-line JSON
+			if _, err := fmt.Fprintf(w, "event: envelope\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
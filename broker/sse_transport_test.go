@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestEventStreamDelivery(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	// Envelopes from sse-agent are signed with its key
+	post := func(envType protocol.EnvelopeType, agent string, body interface{}) (int, []byte) {
+		env := protocol.NewEnvelope(envType, agent)
+		env.Body, _ = json.Marshal(body)
+		if agent == "sse-agent" {
+			protocol.SignEnvelope(env, privKey)
+		}
+		data, _ := json.Marshal(env)
+
+		resp, err := client.Post(server.URL+"/", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		payload, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, payload
+	}
+
+	status, payload := post(protocol.EnvelopeRegisterAgent, "sse-agent", protocol.RegisterAgentBody{
+		PubKey:         protocol.EncodePublicKey(pubKey),
+		Capabilities:   []string{"report"},
+		BodyDefinition: &protocol.BodyDefinition{Name: "sse-body", MCPTools: []protocol.MCPTool{{Name: "report.build"}}},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Registration failed with %d: %s", status, payload)
+	}
+
+	// Unsigned stream requests are rejected
+	resp, err := client.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for unsigned request, got %d", resp.StatusCode)
+	}
+
+	sdk := NewMCPClient(MCPClientConfig{
+		AgentID:     "sse-agent",
+		BrokerURL:   server.URL,
+		PrivateKey:  privKey,
+		TLSInsecure: true,
+	})
+	req, err := sdk.EventStreamRequest()
+	if err != nil {
+		t.Fatalf("Failed to build event stream request: %v", err)
+	}
+	captured := req.Header.Clone()
+
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected event stream response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	envelopes := make(chan protocol.Envelope, 4)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var env protocol.Envelope
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &env); err == nil {
+				envelopes <- env
+			}
+		}
+	}()
+
+	next := func() protocol.Envelope {
+		select {
+		case env := <-envelopes:
+			return env
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for streamed envelope")
+			return protocol.Envelope{}
+		}
+	}
+
+	// Wait for the stream to be registered before relying on it
+	deadline := time.Now().Add(2 * time.Second)
+	for !broker.hub.IsConnected("sse-agent") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A replayed request neither opens a stream nor takes over the live one
+	replay, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	replay.Header = captured
+	if resp, err := client.Do(replay); err != nil {
+		t.Fatalf("Failed to replay event stream request: %v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected status 409 for a replayed request, got %d", resp.StatusCode)
+		}
+	}
+
+	// Subscriptions need no HTTP endpoint while the stream is open
+	if status, payload := post(protocol.EnvelopeSubscribe, "sse-agent", protocol.SubscribeBody{Events: []string{"report.*"}}); status != http.StatusOK {
+		t.Fatalf("Subscribe failed with %d: %s", status, payload)
+	}
+	post(protocol.EnvelopeEmitEvent, "other-agent", protocol.EmitEventBody{Event: "report.requested"})
+
+	if env := next(); env.Type != protocol.EnvelopeEmitEvent || env.Agent != "other-agent" {
+		t.Errorf("Unexpected streamed envelope: %s from %s", env.Type, env.Agent)
+	}
+
+	// Tool calls are streamed and answered with a regular POST
+	results := make(chan []byte, 1)
+	go func() {
+		_, payload := post(protocol.EnvelopeToolCall, "other-agent", protocol.ToolCallBody{Tool: "report.build", RequestID: "sse-req-1"})
+		results <- payload
+	}()
+
+	call := next()
+	var callBody protocol.ToolCallBody
+	if err := json.Unmarshal(call.Body, &callBody); err != nil || call.Type != protocol.EnvelopeToolCall || callBody.RequestID != "sse-req-1" {
+		t.Fatalf("Unexpected streamed tool call: %s %s", call.Type, call.Body)
+	}
+
+	if status, payload := post(protocol.EnvelopeToolResult, "sse-agent", protocol.ToolResultBody{RequestID: "sse-req-1", Success: true, Result: "done"}); status != http.StatusOK {
+		t.Fatalf("Tool result failed with %d: %s", status, payload)
+	}
+
+	var result protocol.ToolResultEnvelope
+	if err := json.Unmarshal(<-results, &result); err != nil {
+		t.Fatalf("Failed to decode tool result: %v", err)
+	}
+	if !result.Body.Success || result.Body.Result != "done" {
+		t.Errorf("Unexpected tool result: %+v", result.Body)
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// nonceRetention is how long a seen nonce is remembered for replay protection
+const nonceRetention = 10 * time.Minute
+
+// maxClockSkew is how far an envelope's ts may be from the broker's clock.
+// An envelope can be accepted for up to twice the skew after its nonce was
+// first seen, which fits in nonceRetention, so it cannot be replayed once
+// its nonce is forgotten.
+const maxClockSkew = nonceRetention / 2
+
+// Storage persists broker state: registered agents, MCP registrations and
+// their tool index, event subscriptions and seen nonces. Implementations
+// must be safe for concurrent use.
+type Storage interface {
+	// SaveAgent stores an agent together with its MCP registration and
+	// indexed tools, replacing anything previously stored for the agent.
+	// mcpAgent may be nil for agents without MCP tools.
+	SaveAgent(agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool) error
+	DeleteAgent(agentID string) error
+	LoadAgents() ([]*Agent, error)
+	LoadMCPAgents() ([]*MCPAgent, error)
+	LoadTools() ([]*RegisteredTool, error)
+
+	SaveSubscription(sub Subscription) error
+	DeleteSubscription(agentID string) error
+	LoadSubscriptions() ([]Subscription, error)
+
+	// SaveRevocation stores what was revoked from an agent, which outlives
+	// the agent's registration
+	SaveRevocation(revocation Revocation) error
+	DeleteRevocation(agentID string) error
+	LoadRevocations() ([]Revocation, error)
+
+	// RecordNonce remembers a nonce until expiresAt, returning false if it
+	// was already recorded and has not expired
+	RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error)
+	// PruneNonces forgets nonces that expired before the given time
+	PruneNonces(before time.Time) error
+
+	Close() error
+}
+
+// SharedStorage is implemented by backends that several brokers use at
+// once. WatchRegistry reports agents saved or deleted through other
+// brokers, which are then reloaded with LoadAgent.
+type SharedStorage interface {
+	Storage
+
+	// LoadAgent returns one stored agent with its MCP registration and
+	// tools; agent is nil if the agent is not stored
+	LoadAgent(agentID string) (agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool, err error)
+	// WatchRegistry calls onChange for agents changed by other brokers
+	// until the store is closed
+	WatchRegistry(onChange func(agentID string)) error
+}
+
+// SizedStorage is implemented by backends that can report the space they
+// take on disk
+type SizedStorage interface {
+	Storage
+
+	// SpaceUsage returns the bytes the store occupies, and how many of them
+	// hold no live data and will be reused
+	SpaceUsage() (size, free int64, err error)
+}
+
+// EncryptedStorage is implemented by backends that can encrypt the records
+// they persist with per-namespace keys. Records written before a cipher
+// was set stay readable and are encrypted when next saved.
+type EncryptedStorage interface {
+	Storage
+
+	SetCipher(cipher *RecordCipher)
+}
+
+// EnvelopeStorage is implemented by backends that can keep accepted
+// envelopes, for persistence rules that name the store
+type EnvelopeStorage interface {
+	Storage
+
+	SaveEnvelope(envelope StoredEnvelope) error
+	// LoadEnvelopes returns the stored envelopes of a type, or of every
+	// type if envType is empty, in the order they were accepted
+	LoadEnvelopes(envType protocol.EnvelopeType) ([]StoredEnvelope, error)
+	// PruneEnvelopes removes envelopes that expired before the given time
+	PruneEnvelopes(before time.Time) error
+}
+
+// Storage backends selectable with -storage
+const (
+	StorageMemory   = "memory"
+	StorageBolt     = "bolt"
+	StorageSQL      = "sql"
+	StoragePostgres = "postgres"
+	StorageRedis    = "redis"
+	StorageRaft     = "raft" // Configured with the -raft-* flags, see OpenRaftStore
+)
+
+// OpenStorage opens a storage backend by kind. For bolt, location is the
+// database file; for sql, it is the data source name passed to driver; for
+// postgres, it is a connection string; for redis, it is a redis:// URL.
+func OpenStorage(kind, location, driver string) (Storage, error) {
+	switch kind {
+	case "", StorageMemory:
+		return NewMemoryStore(), nil
+	case StorageBolt:
+		if location == "" {
+			return nil, fmt.Errorf("bolt storage requires a database file")
+		}
+		return OpenBoltStore(location)
+	case StorageSQL:
+		if location == "" {
+			return nil, fmt.Errorf("sql storage requires a data source name")
+		}
+		return OpenSQLStore(driver, location)
+	case StoragePostgres:
+		if location == "" {
+			return nil, fmt.Errorf("postgres storage requires a connection string")
+		}
+		return OpenPostgresStore(location)
+	case StorageRedis:
+		if location == "" {
+			return nil, fmt.Errorf("redis storage requires a server URL")
+		}
+		return OpenRedisStore(location)
+	case StorageRaft:
+		return nil, fmt.Errorf("raft storage is opened with OpenRaftStore")
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (want memory, bolt, sql, postgres, redis or raft)", kind)
+	}
+}
+
+// MemoryStore keeps broker state in memory. State is lost on restart.
+type MemoryStore struct {
+	agents        map[string]*Agent
+	mcpAgents     map[string]*MCPAgent
+	tools         map[string]*RegisteredTool
+	subscriptions map[string]Subscription
+	revocations   map[string]Revocation
+	nonces        map[string]time.Time
+	envelopes     []StoredEnvelope
+	mu            sync.RWMutex
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		agents:        make(map[string]*Agent),
+		mcpAgents:     make(map[string]*MCPAgent),
+		tools:         make(map[string]*RegisteredTool),
+		subscriptions: make(map[string]Subscription),
+		revocations:   make(map[string]Revocation),
+		nonces:        make(map[string]time.Time),
+	}
+}
+
+// SaveAgent stores an agent, its MCP registration and its tools
+func (s *MemoryStore) SaveAgent(agent *Agent, mcpAgent *MCPAgent, tools []*RegisteredTool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteAgentLocked(agent.ID)
+	s.agents[agent.ID] = agent
+	if mcpAgent != nil {
+		s.mcpAgents[agent.ID] = mcpAgent
+	}
+	for _, tool := range tools {
+		s.tools[toolKey(tool.AgentID, tool.Tool.Name)] = tool
+	}
+	return nil
+}
+
+// DeleteAgent removes an agent, its MCP registration and its tools
+func (s *MemoryStore) DeleteAgent(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteAgentLocked(agentID)
+	return nil
+}
+
+func (s *MemoryStore) deleteAgentLocked(agentID string) {
+	delete(s.agents, agentID)
+	delete(s.mcpAgents, agentID)
+	for key := range s.tools {
+		if strings.HasPrefix(key, agentID+"/") {
+			delete(s.tools, key)
+		}
+	}
+}
+
+// LoadAgents returns all stored agents
+func (s *MemoryStore) LoadAgents() ([]*Agent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agents := make([]*Agent, 0, len(s.agents))
+	for _, agent := range s.agents {
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
+
+// LoadMCPAgents returns all stored MCP registrations
+func (s *MemoryStore) LoadMCPAgents() ([]*MCPAgent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agents := make([]*MCPAgent, 0, len(s.mcpAgents))
+	for _, agent := range s.mcpAgents {
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
+
+// LoadTools returns all stored tool index entries
+func (s *MemoryStore) LoadTools() ([]*RegisteredTool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tools := make([]*RegisteredTool, 0, len(s.tools))
+	for _, tool := range s.tools {
+		tools = append(tools, tool)
+	}
+	return tools, nil
+}
+
+// SaveSubscription stores an agent's subscription
+func (s *MemoryStore) SaveSubscription(sub Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub.Patterns = append([]string(nil), sub.Patterns...)
+	s.subscriptions[sub.AgentID] = sub
+	return nil
+}
+
+// DeleteSubscription removes an agent's subscription
+func (s *MemoryStore) DeleteSubscription(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscriptions, agentID)
+	return nil
+}
+
+// LoadSubscriptions returns all stored subscriptions ordered by agent
+func (s *MemoryStore) LoadSubscriptions() ([]Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subs := make([]Subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].AgentID < subs[j].AgentID })
+	return subs, nil
+}
+
+// SaveRevocation stores what was revoked from an agent
+func (s *MemoryStore) SaveRevocation(revocation Revocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revocation.Capabilities = append([]string(nil), revocation.Capabilities...)
+	revocation.Tools = append([]string(nil), revocation.Tools...)
+	s.revocations[revocation.AgentID] = revocation
+	return nil
+}
+
+// DeleteRevocation forgets what was revoked from an agent
+func (s *MemoryStore) DeleteRevocation(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.revocations, agentID)
+	return nil
+}
+
+// LoadRevocations returns all stored revocations ordered by agent
+func (s *MemoryStore) LoadRevocations() ([]Revocation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	revocations := make([]Revocation, 0, len(s.revocations))
+	for _, revocation := range s.revocations {
+		revocations = append(revocations, revocation)
+	}
+	sort.Slice(revocations, func(i, j int) bool { return revocations[i].AgentID < revocations[j].AgentID })
+	return revocations, nil
+}
+
+// RecordNonce remembers a nonce, reporting whether it is new
+func (s *MemoryStore) RecordNonce(agentID, nonce string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := agentID + "/" + nonce
+	if expiry, seen := s.nonces[key]; seen && time.Now().Before(expiry) {
+		return false, nil
+	}
+	s.nonces[key] = expiresAt
+	return true, nil
+}
+
+// PruneNonces forgets expired nonces
+func (s *MemoryStore) PruneNonces(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, expiry := range s.nonces {
+		if expiry.Before(before) {
+			delete(s.nonces, key)
+		}
+	}
+	return nil
+}
+
+// SaveEnvelope keeps an accepted envelope
+func (s *MemoryStore) SaveEnvelope(envelope StoredEnvelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.envelopes = append(s.envelopes, envelope)
+	return nil
+}
+
+// LoadEnvelopes returns the kept envelopes of a type in the order saved
+func (s *MemoryStore) LoadEnvelopes(envType protocol.EnvelopeType) ([]StoredEnvelope, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var envelopes []StoredEnvelope
+	for _, envelope := range s.envelopes {
+		if envType == "" || envelope.Type == envType {
+			envelopes = append(envelopes, envelope)
+		}
+	}
+	return envelopes, nil
+}
+
+// PruneEnvelopes removes expired envelopes
+func (s *MemoryStore) PruneEnvelopes(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.envelopes[:0]
+	for _, envelope := range s.envelopes {
+		if !envelope.Expires.Before(before) {
+			kept = append(kept, envelope)
+		}
+	}
+	s.envelopes = kept
+	return nil
+}
+
+// Close is a no-op for the in-memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// SetStore attaches a storage backend and restores the agents, MCP
+// registrations, tool index, subscriptions and revocations it holds
+func (b *Broker) SetStore(store Storage) error {
+	agents, err := store.LoadAgents()
+	if err != nil {
+		return err
+	}
+	mcpAgents, err := store.LoadMCPAgents()
+	if err != nil {
+		return err
+	}
+	tools, err := store.LoadTools()
+	if err != nil {
+		return err
+	}
+	subs, err := store.LoadSubscriptions()
+	if err != nil {
+		return err
+	}
+	revocations, err := store.LoadRevocations()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.store = store
+	for i := range revocations {
+		b.revocations[revocations[i].AgentID] = &revocations[i]
+	}
+	for _, agent := range agents {
+		// Restored agents get a full TTL to send their first heartbeat
+		agent.LastSeen = time.Now()
+		b.agents[agent.ID] = agent
+	}
+	b.mu.Unlock()
+
+	for _, agent := range mcpAgents {
+		b.mcpRegistry.RegisterAgent(agent.ID, agent)
+		b.recordSchemas(agent.ID, agent.Tools)
+	}
+	for _, tool := range tools {
+		b.mcpRegistry.RestoreTool(tool)
+	}
+	for _, sub := range subs {
+		b.subscriptions.Restore(sub)
+	}
+
+	if shared, ok := store.(SharedStorage); ok {
+		if err := shared.WatchRegistry(func(agentID string) { b.refreshAgent(shared, agentID) }); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Restored registry from storage", "agents", len(agents), "mcpAgents", len(mcpAgents),
+		"tools", len(tools), "subscriptions", len(subs), "revocations", len(revocations))
+	return nil
+}
+
+// storage returns the broker's storage backend
+func (b *Broker) storage() Storage {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.store
+}
+
+// refreshAgent replaces the cached registry entries for an agent with the
+// stored ones after another broker changed them
+func (b *Broker) refreshAgent(store SharedStorage, agentID string) {
+	agent, mcpAgent, tools, err := store.LoadAgent(agentID)
+	if err != nil {
+		slog.Error("Failed to refresh agent", "agent", agentID, "error", err)
+		return
+	}
+
+	// Revocations made or lifted through other brokers are saved before
+	// the agent
+	revocations, err := store.LoadRevocations()
+	if err != nil {
+		slog.Error("Failed to refresh revocations", "agent", agentID, "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	if agent == nil {
+		delete(b.agents, agentID)
+	} else {
+		b.agents[agentID] = agent
+	}
+	delete(b.revocations, agentID)
+	for i := range revocations {
+		if revocations[i].AgentID == agentID {
+			b.revocations[agentID] = &revocations[i]
+		}
+	}
+	b.mu.Unlock()
+	b.revokeSessions(agentID)
+
+	b.mcpRegistry.UnregisterAgent(agentID)
+	if mcpAgent != nil {
+		b.mcpRegistry.RegisterAgent(agentID, mcpAgent)
+		b.recordSchemas(agentID, mcpAgent.Tools)
+	}
+	for _, tool := range tools {
+		b.mcpRegistry.RestoreTool(tool)
+	}
+}
+
+// persistAgent writes an agent's current registration to storage. Failures
+// are logged; the in-memory state stays authoritative.
+func (b *Broker) persistAgent(agentID string) {
+	b.mu.RLock()
+	store := b.store
+	agent, exists := b.agents[agentID]
+	var snapshot Agent
+	if exists {
+		snapshot = *agent
+	}
+	b.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	mcpAgent, _ := b.mcpRegistry.GetAgent(agentID)
+	if err := store.SaveAgent(&snapshot, mcpAgent, b.mcpRegistry.AgentTools(agentID)); err != nil {
+		slog.Error("Failed to persist agent", "agent", agentID, "error", err)
+	}
+}
+
+// persistSubscription writes an agent's current subscription to storage,
+// deleting it once no patterns remain
+func (b *Broker) persistSubscription(agentID string) {
+	var err error
+	if sub, exists := b.subscriptions.GetSubscription(agentID); exists {
+		err = b.storage().SaveSubscription(sub)
+	} else {
+		err = b.storage().DeleteSubscription(agentID)
+	}
+	if err != nil {
+		slog.Error("Failed to persist subscription", "agent", agentID, "error", err)
+	}
+}
+
+// checkClockSkew returns an error if an envelope's ts is more than
+// maxClockSkew from now
+func checkClockSkew(ts int64, now time.Time) error {
+	skew := now.Sub(time.UnixMilli(ts))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("envelope ts is %v from the broker's clock, more than the %v allowed", skew.Round(time.Second), maxClockSkew)
+	}
+	return nil
+}
+
+// checkReplay records an envelope's nonce, reporting whether the envelope
+// is new. An error means the nonce could not be recorded, and the envelope
+// must be refused, since it cannot be told apart from a replay.
+func (b *Broker) checkReplay(agentID, nonce string) (bool, error) {
+	fresh, err := b.replayCache().RecordNonce(agentID, nonce, time.Now().Add(nonceRetention))
+	if err != nil {
+		slog.Error("Failed to record nonce", "agent", agentID, "error", err)
+		return false, err
+	}
+	return fresh, nil
+}
+
+// PruneNonces periodically forgets expired nonces, and removes persisted
+// envelopes past their retention, until stop is closed
+func (b *Broker) PruneNonces(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			store := b.storage()
+			if err := b.replayCache().PruneNonces(time.Now()); err != nil {
+				slog.Error("Failed to prune nonces", "error", err)
+			}
+			if envelopes, ok := store.(EnvelopeStorage); ok {
+				if err := envelopes.PruneEnvelopes(time.Now()); err != nil {
+					slog.Error("Failed to prune envelopes", "error", err)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCompactionInterval is how often the broker compacts its stores
+const defaultCompactionInterval = time.Hour
+
+// RetentionTiers sets how usage snapshots are thinned out as they age.
+// Snapshots younger than Raw are kept as taken; older ones are merged into
+// one snapshot per hour, then past Hourly into one per day, and past Daily
+// they are dropped. Merging keeps every counter, so reports over whole
+// days are unchanged.
+type RetentionTiers struct {
+	Raw    time.Duration
+	Hourly time.Duration
+	Daily  time.Duration
+}
+
+// defaultRetentionTiers keeps a day of raw snapshots and enough daily ones
+// for weekly reports over the last month
+var defaultRetentionTiers = RetentionTiers{
+	Raw:    24 * time.Hour,
+	Hourly: 7 * 24 * time.Hour,
+	Daily:  usageRetention,
+}
+
+// ParseRetentionTiers parses tiers written as "raw=24h,hourly=168h,daily=840h".
+// Tiers left out keep their defaults.
+func ParseRetentionTiers(spec string) (RetentionTiers, error) {
+	tiers := defaultRetentionTiers
+	for _, field := range parseSinkList(spec) {
+		name, value, found := strings.Cut(field, "=")
+		if !found {
+			return tiers, fmt.Errorf("invalid retention tier %q, expected name=duration", field)
+		}
+		age, err := time.ParseDuration(value)
+		if err != nil || age <= 0 {
+			return tiers, fmt.Errorf("invalid %s retention %q", name, value)
+		}
+		switch name {
+		case "raw":
+			tiers.Raw = age
+		case "hourly":
+			tiers.Hourly = age
+		case "daily":
+			tiers.Daily = age
+		default:
+			return tiers, fmt.Errorf("unknown retention tier %q", name)
+		}
+	}
+	if tiers.Raw > tiers.Hourly || tiers.Hourly > tiers.Daily {
+		return tiers, fmt.Errorf("retention tiers must not shrink: raw %v, hourly %v, daily %v", tiers.Raw, tiers.Hourly, tiers.Daily)
+	}
+	return tiers, nil
+}
+
+// String formats the tiers as ParseRetentionTiers reads them
+func (t RetentionTiers) String() string {
+	return fmt.Sprintf("raw=%v,hourly=%v,daily=%v", t.Raw, t.Hourly, t.Daily)
+}
+
+// compactSnapshots applies the retention tiers to snapshots as of now,
+// returning the result ordered by end time. The input is not modified.
+func compactSnapshots(snapshots []UsageSnapshot, tiers RetentionTiers, now time.Time) []UsageSnapshot {
+	type bucket struct {
+		tier  time.Duration
+		start time.Time
+	}
+
+	var kept []UsageSnapshot
+	merged := make(map[bucket]*UsageSnapshot)
+	for _, snapshot := range snapshots {
+		age := now.Sub(snapshot.End)
+		var key bucket
+		switch {
+		case age >= tiers.Daily:
+			continue
+		case age >= tiers.Hourly:
+			key = bucket{24 * time.Hour, snapshot.End.UTC().Truncate(24 * time.Hour)}
+		case age >= tiers.Raw:
+			key = bucket{time.Hour, snapshot.End.UTC().Truncate(time.Hour)}
+		default:
+			kept = append(kept, snapshot)
+			continue
+		}
+
+		into, exists := merged[key]
+		if !exists {
+			into = &UsageSnapshot{Start: snapshot.Start, End: snapshot.End, Agents: make(map[string]*AgentUsage)}
+			merged[key] = into
+		}
+		if snapshot.Start.Before(into.Start) {
+			into.Start = snapshot.Start
+		}
+		if snapshot.End.After(into.End) {
+			into.End = snapshot.End
+		}
+		for agentID, usage := range snapshot.Agents {
+			total, exists := into.Agents[agentID]
+			if !exists {
+				total = &AgentUsage{AgentID: agentID}
+				into.Agents[agentID] = total
+			}
+			total.add(*usage)
+		}
+	}
+
+	for _, snapshot := range merged {
+		kept = append(kept, *snapshot)
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].End.Before(kept[j].End) })
+	return kept
+}
+
+// snapshotBytes is the size of snapshots encoded one per line
+func snapshotBytes(snapshots []UsageSnapshot) int64 {
+	var size int64
+	for _, snapshot := range snapshots {
+		data, _ := json.Marshal(snapshot)
+		size += int64(len(data)) + 1
+	}
+	return size
+}
+
+// Compact applies the retention tiers to the stored snapshots
+func (s *MemoryUsageStore) Compact(tiers RetentionTiers, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots = compactSnapshots(s.snapshots, tiers, now)
+	return nil
+}
+
+// Size returns the number of snapshots held and their encoded size
+func (s *MemoryUsageStore) Size() (int, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.snapshots), snapshotBytes(s.snapshots), nil
+}
+
+// Compact rewrites the file with the retention tiers applied. The new file
+// replaces the old one only once it is completely written.
+func (s *FileUsageStore) Compact(tiers RetentionTiers, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.load()
+	if err != nil || snapshots == nil {
+		return err
+	}
+	compacted := compactSnapshots(snapshots, tiers, now)
+
+	temp := s.path + ".compact"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, snapshot := range compacted {
+		if err = encoder.Encode(snapshot); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, s.path)
+}
+
+// Size returns the number of snapshots in the file and the file's size
+func (s *FileUsageStore) Size() (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.load()
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(snapshots), info.Size(), nil
+}
+
+// Compact applies the retention tiers to the snapshot store
+func (t *UsageTracker) Compact(tiers RetentionTiers, now time.Time) error {
+	t.mu.Lock()
+	store := t.store
+	t.mu.Unlock()
+	return store.Compact(tiers, now)
+}
+
+// Size returns the number of stored snapshots and the bytes they take
+func (t *UsageTracker) Size() (int, int64, error) {
+	t.mu.Lock()
+	store := t.store
+	t.mu.Unlock()
+	return store.Size()
+}
+
+// SubsystemUsage is the space one part of the broker takes
+type SubsystemUsage struct {
+	Name      string `json:"name"`
+	Entries   int64  `json:"entries"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	FreeBytes int64  `json:"freeBytes,omitempty"` // Allocated but reusable
+}
+
+// CompactionRun records the outcome of one compaction
+type CompactionRun struct {
+	At             time.Time `json:"at"`
+	DurationMs     int64     `json:"durationMs"`
+	EntriesRemoved int64     `json:"entriesRemoved"`
+	BytesReclaimed int64     `json:"bytesReclaimed"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// StorageReport is served by /admin/storage
+type StorageReport struct {
+	Subsystems     []SubsystemUsage `json:"subsystems"`
+	Retention      string           `json:"retention"`
+	LastCompaction *CompactionRun   `json:"lastCompaction,omitempty"`
+}
+
+// Compactor holds the retention settings and the last compaction run
+type Compactor struct {
+	tiers RetentionTiers
+	last  *CompactionRun
+	mu    sync.Mutex
+}
+
+// NewCompactor creates a compactor applying tiers
+func NewCompactor(tiers RetentionTiers) *Compactor {
+	return &Compactor{tiers: tiers}
+}
+
+// SetTiers replaces the retention tiers
+func (c *Compactor) SetTiers(tiers RetentionTiers) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tiers = tiers
+}
+
+// CompactStores applies the retention tiers to the usage snapshots as of
+// now and records the run for the storage report
+func (b *Broker) CompactStores(now time.Time) *CompactionRun {
+	b.compactor.mu.Lock()
+	tiers := b.compactor.tiers
+	b.compactor.mu.Unlock()
+
+	started := time.Now()
+	run := &CompactionRun{At: now}
+	entriesBefore, bytesBefore, err := b.usage.Size()
+	if err == nil {
+		err = b.usage.Compact(tiers, now)
+	}
+	if err == nil {
+		var entriesAfter int
+		var bytesAfter int64
+		entriesAfter, bytesAfter, err = b.usage.Size()
+		run.EntriesRemoved = int64(entriesBefore - entriesAfter)
+		run.BytesReclaimed = bytesBefore - bytesAfter
+	}
+	if err != nil {
+		run.Error = err.Error()
+		slog.Error("Failed to compact usage snapshots", "error", err)
+	} else if run.EntriesRemoved > 0 {
+		slog.Info("Compacted usage snapshots", "removed", run.EntriesRemoved, "bytesReclaimed", run.BytesReclaimed)
+	}
+	run.DurationMs = time.Since(started).Milliseconds()
+
+	b.compactor.mu.Lock()
+	b.compactor.last = run
+	b.compactor.mu.Unlock()
+	return run
+}
+
+// RunCompaction compacts the broker's stores on every interval until stop
+// is closed
+func (b *Broker) RunCompaction(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.CompactStores(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// storageReport measures the space each subsystem takes
+func (b *Broker) storageReport() (*StorageReport, error) {
+	snapshots, snapshotSize, err := b.usage.Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure usage snapshots: %w", err)
+	}
+
+	subsystems := []SubsystemUsage{
+		{Name: "usage", Entries: int64(snapshots), Bytes: snapshotSize},
+		{Name: "agents", Entries: int64(b.mcpRegistry.GetAgentCount())},
+		{Name: "tools", Entries: int64(b.mcpRegistry.GetToolCount())},
+		{Name: "subscriptions", Entries: int64(b.subscriptions.GetSubscriptionCount())},
+	}
+	if sized, ok := b.storage().(SizedStorage); ok {
+		size, free, err := sized.SpaceUsage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure storage: %w", err)
+		}
+		subsystems = append(subsystems, SubsystemUsage{Name: "storage", Bytes: size, FreeBytes: free})
+	}
+
+	b.compactor.mu.Lock()
+	defer b.compactor.mu.Unlock()
+	return &StorageReport{
+		Subsystems:     subsystems,
+		Retention:      b.compactor.tiers.String(),
+		LastCompaction: b.compactor.last,
+	}, nil
+}
+
+// handleStorageReport serves GET /admin/storage
+func (b *Broker) handleStorageReport(w http.ResponseWriter, r *http.Request) {
+	report, err := b.storageReport()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionTiers(t *testing.T) {
+	tiers, err := ParseRetentionTiers("raw=1h,daily=720h")
+	if err != nil {
+		t.Fatalf("Failed to parse tiers: %v", err)
+	}
+	if tiers.Raw != time.Hour || tiers.Hourly != defaultRetentionTiers.Hourly || tiers.Daily != 720*time.Hour {
+		t.Errorf("Unexpected tiers: %+v", tiers)
+	}
+
+	if parsed, err := ParseRetentionTiers(tiers.String()); err != nil || parsed != tiers {
+		t.Errorf("Expected %v to round-trip, got %+v (%v)", tiers, parsed, err)
+	}
+
+	for _, spec := range []string{"raw", "raw=soon", "weekly=1h", "raw=200h,hourly=100h"} {
+		if _, err := ParseRetentionTiers(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestUsageCompaction(t *testing.T) {
+	now := time.Date(2025, 6, 20, 12, 0, 0, 0, time.UTC)
+	tiers := RetentionTiers{Raw: 24 * time.Hour, Hourly: 7 * 24 * time.Hour, Daily: 30 * 24 * time.Hour}
+
+	store := NewFileUsageStore(filepath.Join(t.TempDir(), "usage.jsonl"))
+	appendAt := func(end time.Time, envelopes int64) {
+		store.Append(UsageSnapshot{
+			Start:  end.Add(-5 * time.Minute),
+			End:    end,
+			Agents: map[string]*AgentUsage{"agent-a": {AgentID: "agent-a", Envelopes: envelopes}},
+		})
+	}
+
+	// Recent snapshots are kept as taken
+	appendAt(now.Add(-10*time.Minute), 1)
+	appendAt(now.Add(-5*time.Minute), 1)
+	// Two days old: merged into one hourly snapshot
+	twoDays := now.Add(-48 * time.Hour)
+	appendAt(twoDays.Add(5*time.Minute), 2)
+	appendAt(twoDays.Add(10*time.Minute), 3)
+	// Ten days old: merged into one daily snapshot
+	tenDays := now.Add(-240 * time.Hour)
+	appendAt(tenDays.Add(-3*time.Hour), 4)
+	appendAt(tenDays.Add(-1*time.Hour), 5)
+	// Past the daily tier: dropped
+	appendAt(now.Add(-40*24*time.Hour), 6)
+
+	report := func(day time.Time) int64 {
+		tracker := NewUsageTracker(store)
+		usage, err := tracker.Report("daily", day)
+		if err != nil {
+			t.Fatalf("Failed to build report: %v", err)
+		}
+		if len(usage.Agents) == 0 {
+			return 0
+		}
+		return usage.Agents[0].Envelopes
+	}
+	tenDaysBefore := report(tenDays)
+
+	if err := store.Compact(tiers, now); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	count, _, err := store.Size()
+	if err != nil {
+		t.Fatalf("Failed to size store: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("Expected 2 raw, 1 hourly and 1 daily snapshot, got %d", count)
+	}
+
+	// Merged snapshots keep every counter
+	if after := report(tenDays); after != tenDaysBefore || after != 9 {
+		t.Errorf("Expected the daily report to keep 9 envelopes (was %d), got %d", tenDaysBefore, after)
+	}
+	if after := report(twoDays); after != 5 {
+		t.Errorf("Expected 5 envelopes two days ago, got %d", after)
+	}
+
+	// Compaction is idempotent
+	store.Compact(tiers, now)
+	if again, _, _ := store.Size(); again != count {
+		t.Errorf("Expected a second compaction to change nothing, got %d snapshots", again)
+	}
+}
+
+func TestStorageReport(t *testing.T) {
+	broker := NewBroker()
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "broker.db"))
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %v", err)
+	}
+	defer store.Close()
+	broker.SetStore(store)
+
+	broker.usage.RecordEnvelope("agent-a", 10, 10, http.StatusOK)
+	broker.usage.Snapshot()
+	broker.CompactStores(time.Now())
+
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	resp, err := adminClient(broker, server).Get(server.URL + "/admin/storage")
+	if err != nil {
+		t.Fatalf("Failed to fetch storage report: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var report StorageReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode storage report: %v", err)
+	}
+
+	subsystems := make(map[string]SubsystemUsage)
+	for _, subsystem := range report.Subsystems {
+		subsystems[subsystem.Name] = subsystem
+	}
+	if usage := subsystems["usage"]; usage.Entries != 1 || usage.Bytes == 0 {
+		t.Errorf("Unexpected usage subsystem: %+v", usage)
+	}
+	if storage, ok := subsystems["storage"]; !ok || storage.Bytes == 0 {
+		t.Errorf("Expected the bolt store's size to be reported, got %+v", report.Subsystems)
+	}
+	if report.LastCompaction == nil || report.LastCompaction.Error != "" {
+		t.Errorf("Expected the last compaction to be reported, got %+v", report.LastCompaction)
+	}
+	if report.Retention != defaultRetentionTiers.String() {
+		t.Errorf("Unexpected retention %q", report.Retention)
+	}
+}
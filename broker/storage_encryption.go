@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// defaultNamespace holds agents whose IDs carry no namespace prefix
+const defaultNamespace = "default"
+
+// sealedRecordVersion marks records encrypted by RecordCipher
+const sealedRecordVersion = "v1"
+
+// agentNamespace returns the tenant namespace of an agent: the part of its
+// ID before the first ".", or defaultNamespace if there is none
+func agentNamespace(agentID string) string {
+	if i := strings.Index(agentID, "."); i > 0 {
+		return agentID[:i]
+	}
+	return defaultNamespace
+}
+
+// SecretsProvider supplies the key each namespace's persisted records are
+// encrypted with
+type SecretsProvider interface {
+	// NamespaceKey returns the 32-byte key for namespace
+	NamespaceKey(namespace string) ([]byte, error)
+}
+
+// FileSecrets reads namespace keys from a file with one "namespace key"
+// pair per line, keys base64 encoded. A "*" entry is a master key from
+// which the keys of unlisted namespaces are derived. Blank lines and lines
+// starting with "#" are ignored.
+type FileSecrets struct {
+	keys   map[string][]byte
+	master []byte
+}
+
+// OpenFileSecrets loads the key file at path
+func OpenFileSecrets(path string) (*FileSecrets, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	secrets := &FileSecrets{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"namespace key\"", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key must be 32 bytes, base64 encoded", path, line)
+		}
+		if fields[0] == "*" {
+			secrets.master = key
+		} else {
+			secrets.keys[fields[0]] = key
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// NamespaceKey returns the listed key for namespace, or one derived from
+// the master key
+func (s *FileSecrets) NamespaceKey(namespace string) ([]byte, error) {
+	if key, ok := s.keys[namespace]; ok {
+		return key, nil
+	}
+	if s.master == nil {
+		return nil, fmt.Errorf("no key for namespace %q", namespace)
+	}
+	mac := hmac.New(sha256.New, s.master)
+	mac.Write([]byte("fem-broker namespace " + namespace))
+	return mac.Sum(nil), nil
+}
+
+// sealedRecord is the stored form of an encrypted record. It is itself a
+// JSON object, so it fits columns that require JSON.
+type sealedRecord struct {
+	Sealed    string `json:"sealed"`
+	Namespace string `json:"namespace"`
+	Nonce     []byte `json:"nonce"`
+	Data      []byte `json:"data"`
+}
+
+// RecordCipher encrypts persisted registry records with AES-256-GCM under
+// their namespace's key, so one tenant's key does not expose another's
+// agents, tools or subscriptions. A nil RecordCipher stores plain JSON.
+type RecordCipher struct {
+	secrets SecretsProvider
+	aeads   map[string]cipher.AEAD
+	mu      sync.Mutex
+}
+
+// NewRecordCipher creates a cipher taking keys from secrets
+func NewRecordCipher(secrets SecretsProvider) *RecordCipher {
+	return &RecordCipher{secrets: secrets, aeads: make(map[string]cipher.AEAD)}
+}
+
+// aead returns the cipher for namespace, looking its key up once
+func (c *RecordCipher) aead(namespace string) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aead, ok := c.aeads[namespace]; ok {
+		return aead, nil
+	}
+	key, err := c.secrets.NamespaceKey(namespace)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad key for namespace %q: %w", namespace, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[namespace] = aead
+	return aead, nil
+}
+
+// seal encodes value as JSON and encrypts it for the namespace of agentID
+func (c *RecordCipher) seal(agentID string, value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil || c == nil {
+		return data, err
+	}
+
+	namespace := agentNamespace(agentID)
+	aead, err := c.aead(namespace)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedRecord{
+		Sealed:    sealedRecordVersion,
+		Namespace: namespace,
+		Nonce:     nonce,
+		Data:      aead.Seal(nil, nonce, data, []byte(namespace)),
+	})
+}
+
+// open decrypts a record written by seal into value. Plain JSON records,
+// written before encryption was enabled, are decoded as they are.
+func (c *RecordCipher) open(data []byte, value interface{}) error {
+	var sealed sealedRecord
+	if len(data) > 0 && data[0] == '{' {
+		json.Unmarshal(data, &sealed)
+	}
+	if sealed.Sealed == "" {
+		return json.Unmarshal(data, value)
+	}
+	if sealed.Sealed != sealedRecordVersion {
+		return fmt.Errorf("unknown record encryption %q", sealed.Sealed)
+	}
+	if c == nil {
+		return fmt.Errorf("record is encrypted for namespace %q but no keys are configured", sealed.Namespace)
+	}
+
+	aead, err := c.aead(sealed.Namespace)
+	if err != nil {
+		return err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return fmt.Errorf("bad nonce for namespace %q", sealed.Namespace)
+	}
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Data, []byte(sealed.Namespace))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt record for namespace %q: %w", sealed.Namespace, err)
+	}
+	return json.Unmarshal(plain, value)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testSecrets hands out fixed keys by namespace
+type testSecrets map[string][]byte
+
+func (s testSecrets) NamespaceKey(namespace string) ([]byte, error) {
+	if key, ok := s[namespace]; ok {
+		return key, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func testKey(fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, 32)
+}
+
+// rawBoltRecords returns every value stored in bolt's registry buckets
+func rawBoltRecords(t *testing.T, store *BoltStore) []byte {
+	t.Helper()
+	var raw []byte
+	store.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltAgentsBucket, boltMCPAgentsBucket, boltToolsBucket, boltSubsBucket} {
+			tx.Bucket(name).ForEach(func(k, v []byte) error {
+				raw = append(raw, v...)
+				return nil
+			})
+		}
+		return nil
+	})
+	return raw
+}
+
+func TestBoltStoreEncryptsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	// Written before encryption was enabled
+	if err := store.SaveAgent(&Agent{ID: "legacy-agent"}, nil, nil); err != nil {
+		t.Fatalf("SaveAgent failed: %v", err)
+	}
+
+	store.SetCipher(NewRecordCipher(testSecrets{"acme": testKey(1), defaultNamespace: testKey(2)}))
+	mcpAgent := &MCPAgent{ID: "acme.coder", BodyDefinition: &protocol.BodyDefinition{Name: "secret-topology"}}
+	tools := []*RegisteredTool{{AgentID: "acme.coder", Tool: protocol.MCPTool{Name: "repo.clone"}}}
+	if err := store.SaveAgent(&Agent{ID: "acme.coder", Endpoint: "https://coder.acme.internal"}, mcpAgent, tools); err != nil {
+		t.Fatalf("SaveAgent failed: %v", err)
+	}
+	if err := store.SaveSubscription(Subscription{AgentID: "acme.coder", Patterns: []string{"repo.*"}}); err != nil {
+		t.Fatalf("SaveSubscription failed: %v", err)
+	}
+
+	raw := rawBoltRecords(t, store)
+	for _, secret := range []string{"acme.internal", "secret-topology", "repo.clone", "repo.*"} {
+		if bytes.Contains(raw, []byte(secret)) {
+			t.Errorf("Expected %q to be encrypted at rest", secret)
+		}
+	}
+	store.Close()
+
+	// Another tenant's key cannot read acme's records
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	store.SetCipher(NewRecordCipher(testSecrets{"acme": testKey(3), defaultNamespace: testKey(2)}))
+	if _, err := store.LoadAgents(); err == nil {
+		t.Error("Expected the wrong key to be rejected")
+	}
+
+	store.SetCipher(NewRecordCipher(testSecrets{"acme": testKey(1)}))
+	agents, err := store.LoadAgents()
+	if err != nil {
+		t.Fatalf("LoadAgents failed: %v", err)
+	}
+	if len(agents) != 2 {
+		t.Fatalf("Expected the encrypted and the legacy agent, got %d", len(agents))
+	}
+	loadedTools, err := store.LoadTools()
+	if err != nil || len(loadedTools) != 1 || loadedTools[0].Tool.Name != "repo.clone" {
+		t.Errorf("Expected the tool to be decrypted, got %v (%v)", loadedTools, err)
+	}
+	subs, err := store.LoadSubscriptions()
+	if err != nil || len(subs) != 1 || subs[0].Patterns[0] != "repo.*" {
+		t.Errorf("Expected the subscription to be decrypted, got %v (%v)", subs, err)
+	}
+
+	// Without keys, encrypted records are an error rather than garbage
+	store.SetCipher(nil)
+	if _, err := store.LoadAgents(); err == nil || !strings.Contains(err.Error(), "no keys") {
+		t.Errorf("Expected a missing key error, got %v", err)
+	}
+}
+
+func TestFileSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# tenant keys\n" +
+		"acme " + base64.StdEncoding.EncodeToString(testKey(1)) + "\n\n" +
+		"* " + base64.StdEncoding.EncodeToString(testKey(9)) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write keys: %v", err)
+	}
+
+	secrets, err := OpenFileSecrets(path)
+	if err != nil {
+		t.Fatalf("OpenFileSecrets failed: %v", err)
+	}
+	if key, _ := secrets.NamespaceKey("acme"); !bytes.Equal(key, testKey(1)) {
+		t.Error("Expected the listed key for acme")
+	}
+	globex, _ := secrets.NamespaceKey("globex")
+	initech, _ := secrets.NamespaceKey("initech")
+	if len(globex) != 32 || bytes.Equal(globex, initech) || bytes.Equal(globex, testKey(9)) {
+		t.Error("Expected distinct keys derived from the master key")
+	}
+
+	if err := os.WriteFile(path, []byte("acme c2hvcnQ=\n"), 0600); err != nil {
+		t.Fatalf("Failed to write keys: %v", err)
+	}
+	if _, err := OpenFileSecrets(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("Expected a short key to be rejected with its line, got %v", err)
+	}
+}
+
+func TestRaftStoreEncryptsLogAndSnapshots(t *testing.T) {
+	config := RaftConfig{
+		ID:                "solo",
+		Token:             "cluster-secret",
+		Dir:               t.TempDir(),
+		ElectionTimeout:   50 * time.Millisecond,
+		SnapshotThreshold: 2,
+	}
+	cipher := NewRecordCipher(testSecrets{"acme": testKey(1)})
+
+	store, err := NewRaftStore(config, cipher)
+	if err != nil {
+		t.Fatalf("Failed to create raft store: %v", err)
+	}
+	if err := store.node.Start(); err != nil {
+		t.Fatalf("Failed to start raft node: %v", err)
+	}
+	waitForRaft(t, "a single node to lead", store.node.IsLeader)
+	for i, id := range []string{"acme.one", "acme.two", "acme.three"} {
+		if err := store.SaveAgent(&Agent{ID: id, Endpoint: "https://" + id + ".internal"}, nil, nil); err != nil {
+			t.Fatalf("SaveAgent failed: %v", err)
+		}
+		if i == 1 {
+			if err := store.node.raft.Snapshot().Error(); err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+		}
+	}
+	store.Close()
+
+	snapshots := 0
+	filepath.WalkDir(config.Dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if entry.Name() == "state.bin" {
+			snapshots++
+		}
+		data, _ := os.ReadFile(path)
+		if bytes.Contains(data, []byte(".internal")) {
+			t.Errorf("Expected %s to hold no plaintext records", path)
+		}
+		return nil
+	})
+	if snapshots == 0 {
+		t.Error("Expected a snapshot to be written")
+	}
+
+	reopened, err := NewRaftStore(config, cipher)
+	if err != nil {
+		t.Fatalf("Failed to reopen raft store: %v", err)
+	}
+	if err := reopened.node.Start(); err != nil {
+		t.Fatalf("Failed to restart raft node: %v", err)
+	}
+	defer reopened.Close()
+	waitForRaft(t, "the snapshot and log to be restored", func() bool {
+		agents, _ := reopened.LoadAgents()
+		return len(agents) == 3
+	})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// testStorage exercises the behaviour every Storage implementation must share
+func testStorage(t *testing.T, store Storage) {
+	t.Helper()
+
+	agent := &Agent{ID: "agent-a", Capabilities: []string{"math"}, Endpoint: "https://agent-a/mcp", RegisteredAt: time.Now()}
+	mcpAgent := &MCPAgent{ID: "agent-a", MCPEndpoint: "https://agent-a/mcp", Tools: []protocol.MCPTool{{Name: "math.add"}}}
+	tools := []*RegisteredTool{{AgentID: "agent-a", Tool: protocol.MCPTool{Name: "math.add"}, MCPEndpoint: "https://agent-a/mcp"}}
+
+	if err := store.SaveAgent(agent, mcpAgent, tools); err != nil {
+		t.Fatalf("Failed to save agent: %v", err)
+	}
+	if err := store.SaveAgent(&Agent{ID: "agent-b"}, nil, nil); err != nil {
+		t.Fatalf("Failed to save agent: %v", err)
+	}
+
+	agents, err := store.LoadAgents()
+	if err != nil || len(agents) != 2 {
+		t.Fatalf("Expected 2 agents, got %d (%v)", len(agents), err)
+	}
+	mcpAgents, err := store.LoadMCPAgents()
+	if err != nil || len(mcpAgents) != 1 || mcpAgents[0].Tools[0].Name != "math.add" {
+		t.Fatalf("Unexpected MCP agents: %+v (%v)", mcpAgents, err)
+	}
+
+	// Saving again replaces the agent's tools
+	tools = []*RegisteredTool{{AgentID: "agent-a", Tool: protocol.MCPTool{Name: "math.multiply"}}}
+	if err := store.SaveAgent(agent, mcpAgent, tools); err != nil {
+		t.Fatalf("Failed to save agent: %v", err)
+	}
+	loadedTools, err := store.LoadTools()
+	if err != nil || len(loadedTools) != 1 || loadedTools[0].Tool.Name != "math.multiply" {
+		t.Fatalf("Unexpected tools: %+v (%v)", loadedTools, err)
+	}
+
+	if err := store.DeleteAgent("agent-a"); err != nil {
+		t.Fatalf("Failed to delete agent: %v", err)
+	}
+	agents, _ = store.LoadAgents()
+	loadedTools, _ = store.LoadTools()
+	if len(agents) != 1 || len(loadedTools) != 0 {
+		t.Errorf("Expected agent and tools to be deleted, got %d agents and %d tools", len(agents), len(loadedTools))
+	}
+
+	// Subscriptions
+	sub := Subscription{AgentID: "agent-b", Patterns: []string{"sensor.*"}, Endpoint: "https://agent-b/events"}
+	if err := store.SaveSubscription(sub); err != nil {
+		t.Fatalf("Failed to save subscription: %v", err)
+	}
+	sub.Patterns = append(sub.Patterns, "job.*")
+	if err := store.SaveSubscription(sub); err != nil {
+		t.Fatalf("Failed to save subscription: %v", err)
+	}
+	subs, err := store.LoadSubscriptions()
+	if err != nil || len(subs) != 1 || len(subs[0].Patterns) != 2 {
+		t.Fatalf("Unexpected subscriptions: %+v (%v)", subs, err)
+	}
+	if err := store.DeleteSubscription("agent-b"); err != nil {
+		t.Fatalf("Failed to delete subscription: %v", err)
+	}
+	if subs, _ := store.LoadSubscriptions(); len(subs) != 0 {
+		t.Errorf("Expected subscription to be deleted, got %d", len(subs))
+	}
+
+	// Revocations
+	revocation := Revocation{AgentID: "agent-b", Capabilities: []string{"file.*"}}
+	if err := store.SaveRevocation(revocation); err != nil {
+		t.Fatalf("Failed to save revocation: %v", err)
+	}
+	revocation.Tools = []string{"job.run"}
+	if err := store.SaveRevocation(revocation); err != nil {
+		t.Fatalf("Failed to save revocation: %v", err)
+	}
+	revocations, err := store.LoadRevocations()
+	if err != nil || len(revocations) != 1 || len(revocations[0].Capabilities) != 1 || len(revocations[0].Tools) != 1 {
+		t.Fatalf("Unexpected revocations: %+v (%v)", revocations, err)
+	}
+	if err := store.DeleteRevocation("agent-b"); err != nil {
+		t.Fatalf("Failed to delete revocation: %v", err)
+	}
+	if revocations, _ := store.LoadRevocations(); len(revocations) != 0 {
+		t.Errorf("Expected revocation to be deleted, got %d", len(revocations))
+	}
+
+	// Nonces
+	expires := time.Now().Add(time.Minute)
+	if fresh, err := store.RecordNonce("agent-b", "n-1", expires); err != nil || !fresh {
+		t.Fatalf("Expected first nonce to be fresh, got %v (%v)", fresh, err)
+	}
+	if fresh, err := store.RecordNonce("agent-b", "n-1", expires); err != nil || fresh {
+		t.Errorf("Expected repeated nonce to be rejected, got %v (%v)", fresh, err)
+	}
+	if fresh, _ := store.RecordNonce("agent-c", "n-1", expires); !fresh {
+		t.Error("Expected nonces to be scoped to their agent")
+	}
+
+	if fresh, _ := store.RecordNonce("agent-b", "n-2", time.Now().Add(-time.Second)); !fresh {
+		t.Fatal("Expected new nonce to be fresh")
+	}
+	if err := store.PruneNonces(time.Now()); err != nil {
+		t.Fatalf("Failed to prune nonces: %v", err)
+	}
+	if fresh, _ := store.RecordNonce("agent-b", "n-2", expires); !fresh {
+		t.Error("Expected expired nonce to be accepted again")
+	}
+	if fresh, _ := store.RecordNonce("agent-b", "n-1", expires); fresh {
+		t.Error("Expected unexpired nonce to survive pruning")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStorage(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "broker.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	testStorage(t, store)
+}
+
+func TestOpenStorage(t *testing.T) {
+	if _, err := OpenStorage("etcd", "", ""); err == nil {
+		t.Error("Expected unknown backend to be rejected")
+	}
+	if _, err := OpenStorage(StorageBolt, "", ""); err == nil {
+		t.Error("Expected bolt storage without a file to be rejected")
+	}
+
+	store, err := OpenStorage(StorageMemory, "", "")
+	if err != nil {
+		t.Fatalf("Failed to open memory storage: %v", err)
+	}
+	if _, ok := store.(*MemoryStore); !ok {
+		t.Errorf("Expected *MemoryStore, got %T", store)
+	}
+}
+
+func TestSQLStoreRebind(t *testing.T) {
+	store := &SQLStore{dollars: true}
+	if got := store.rebind("DELETE FROM t WHERE a = ? AND b = ?"); got != "DELETE FROM t WHERE a = $1 AND b = $2" {
+		t.Errorf("Unexpected rebound query: %s", got)
+	}
+
+	store.dollars = false
+	if got := store.rebind("SELECT ?"); got != "SELECT ?" {
+		t.Errorf("Expected query to be unchanged, got %s", got)
+	}
+}
+
+func TestBrokerRejectsReplayedEnvelopes(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	env := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "sensor-agent")
+	env.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "sensor.temperature"})
+	data, _ := json.Marshal(env)
+
+	for i, expected := range []int{http.StatusOK, http.StatusConflict} {
+		resp, err := client.Post(server.URL+"/", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != expected {
+			t.Errorf("Attempt %d: expected status %d, got %d", i+1, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestBrokerRejectsStaleEnvelopes(t *testing.T) {
+	if 2*maxClockSkew > nonceRetention {
+		t.Fatalf("Nonces are forgotten after %v, before envelopes %v old are refused", nonceRetention, 2*maxClockSkew)
+	}
+
+	broker := NewBroker()
+	emit := func(ts time.Time, nonce string) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeEmitEvent}}
+		env.Agent = "sensor-agent"
+		env.TS = ts.UnixMilli()
+		env.Nonce = nonce
+		env.Body, _ = json.Marshal(protocol.EmitEventBody{Event: "sensor.temperature"})
+		recorder := newBufferedResponse()
+		broker.dispatchEnvelope(recorder, env)
+		return recorder
+	}
+
+	now := time.Now()
+	for name, ts := range map[string]time.Time{"old": now.Add(-maxClockSkew - time.Minute), "future": now.Add(maxClockSkew + time.Minute), "unset": time.UnixMilli(0)} {
+		recorder := emit(ts, protocol.NewNonce())
+		if recorder.status != http.StatusBadRequest || !strings.Contains(recorder.body.String(), protocol.ErrorStale) {
+			t.Errorf("%s: expected the envelope to be refused as stale, got %d: %s", name, recorder.status, recorder.body.String())
+		}
+	}
+	if recorder := emit(now, ""); recorder.status != http.StatusBadRequest {
+		t.Errorf("Expected an envelope without a nonce to be refused, got %d", recorder.status)
+	}
+	if recorder := emit(now.Add(-maxClockSkew+time.Minute), protocol.NewNonce()); recorder.status != http.StatusOK {
+		t.Errorf("Expected an envelope within the skew to be accepted, got %d: %s", recorder.status, recorder.body.String())
+	}
+}
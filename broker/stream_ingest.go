@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/fep-fem/protocol"
+)
+
+// StreamResult reports the outcome of one envelope from a streamed batch.
+// A failed envelope's error envelope is its response, with the message
+// repeated in error.
+type StreamResult struct {
+	Index    int                   `json:"index"`
+	Type     protocol.EnvelopeType `json:"type,omitempty"`
+	Agent    string                `json:"agent,omitempty"`
+	Status   int                   `json:"status"`
+	Response json.RawMessage       `json:"response,omitempty"`
+	Error    string                `json:"error,omitempty"`
+}
+
+// StreamSummary is written as the final line of a stream ingestion response
+type StreamSummary struct {
+	Processed int    `json:"processed"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleStreamIngest processes envelopes posted to /stream as they arrive.
+// The body may be newline-delimited JSON or a single JSON array. One result
+// line is written (and flushed) per envelope, followed by a summary line.
+func (b *Broker) handleStreamIngest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	reader := bufio.NewReader(r.Body)
+	decoder := json.NewDecoder(reader)
+
+	// Results are written while the request body is still being read
+	http.NewResponseController(w).EnableFullDuplex()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	summary := StreamSummary{}
+
+	finish := func() {
+		encoder.Encode(summary)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		slog.Info("Stream ingestion finished", "processed", summary.Processed, "failed", summary.Failed)
+	}
+
+	// A leading '[' means the envelopes arrive as a JSON array
+	isArray, err := startsWithArray(reader)
+	if err != nil {
+		finish()
+		return
+	}
+	if isArray {
+		if _, err := decoder.Token(); err != nil {
+			summary.Error = fmt.Sprintf("invalid stream: %v", err)
+			finish()
+			return
+		}
+	}
+
+	for index := 0; decoder.More(); index++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			summary.Error = fmt.Sprintf("invalid stream at envelope %d: %v", index, err)
+			finish()
+			return
+		}
+
+		result := b.ingestStreamedEnvelope(index, raw, r)
+		summary.Processed++
+		if result.Status != http.StatusOK {
+			summary.Failed++
+		}
+
+		encoder.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	finish()
+}
+
+// ingestStreamedEnvelope parses and dispatches a single streamed envelope
+// sent in request r
+func (b *Broker) ingestStreamedEnvelope(index int, raw json.RawMessage, r *http.Request) StreamResult {
+	result := StreamResult{Index: index}
+
+	envelope, err := protocol.ParseEnvelope(raw)
+	if errors.Is(err, protocol.ErrEnvelopeTooLarge) {
+		result.Status = http.StatusRequestEntityTooLarge
+		result.Error = err.Error()
+		return result
+	} else if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result
+	}
+	envelope.RemoteAddr = r.RemoteAddr
+	envelope.ClientCert = clientCertificate(r)
+	envelope.Session = r.Header.Get(protocol.HeaderSession)
+	envelope.Bearer = bearerToken(r)
+	result.Type = envelope.Type
+	result.Agent = envelope.Agent
+
+	recorder := newBufferedResponse()
+	b.dispatchEnvelope(recorder, envelope)
+	b.recordEnvelope(envelope, len(raw), recorder.body.Len(), recorder.status)
+
+	result.Status = recorder.status
+	result.Response, result.Error = splitReply(recorder.status, recorder.body.Bytes())
+
+	return result
+}
+
+// startsWithArray reports whether the next non-whitespace byte is '['
+func startsWithArray(reader *bufio.Reader) (bool, error) {
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c == '[', reader.UnreadByte()
+	}
+}
+
+// bufferedResponse captures a handler response in memory so individual
+// envelope results can be embedded in a larger response
+type bufferedResponse struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	r.status = status
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func streamEnvelope(t *testing.T, envType protocol.EnvelopeType, agent string, body interface{}) string {
+	t.Helper()
+	env := protocol.NewEnvelope(envType, agent)
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal body: %v", err)
+	}
+	env.Body = raw
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatalf("Failed to marshal envelope: %v", err)
+	}
+	return string(data)
+}
+
+func readStreamResponse(t *testing.T, resp *http.Response) ([]StreamResult, StreamSummary) {
+	t.Helper()
+	var results []StreamResult
+	var summary StreamSummary
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) == 0 {
+		t.Fatal("Expected at least a summary line")
+	}
+
+	for _, line := range lines[:len(lines)-1] {
+		var result StreamResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("Failed to decode result line %q: %v", line, err)
+		}
+		results = append(results, result)
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+		t.Fatalf("Failed to decode summary line: %v", err)
+	}
+	return results, summary
+}
+
+func TestStreamIngestNDJSON(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	lines := []string{
+		streamEnvelope(t, protocol.EnvelopeEmitEvent, "sensor-1", protocol.EmitEventBody{Event: "sensor.temperature"}),
+		streamEnvelope(t, protocol.EnvelopeEmitEvent, "sensor-2", protocol.EmitEventBody{Event: "sensor.humidity"}),
+		streamEnvelope(t, protocol.EnvelopeType("bogus"), "sensor-3", map[string]string{}),
+	}
+
+	resp, err := http.Post(server.URL+"/stream", "application/x-ndjson", strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("Failed to send stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	results, summary := readStreamResponse(t, resp)
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	if results[0].Status != http.StatusOK || results[0].Agent != "sensor-1" {
+		t.Errorf("Unexpected first result: %+v", results[0])
+	}
+	if results[2].Status != http.StatusBadRequest || results[2].Error == "" {
+		t.Errorf("Expected unknown envelope type to fail, got %+v", results[2])
+	}
+
+	if summary.Processed != 3 || summary.Failed != 1 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
+
+func TestStreamIngestArray(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	items := []string{
+		streamEnvelope(t, protocol.EnvelopeEmitEvent, "sensor-1", protocol.EmitEventBody{Event: "sensor.temperature"}),
+		streamEnvelope(t, protocol.EnvelopeEmitEvent, "sensor-1", protocol.EmitEventBody{Event: "sensor.pressure"}),
+	}
+	body := " [" + strings.Join(items, ",") + "]"
+
+	resp, err := http.Post(server.URL+"/stream", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to send stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	results, summary := readStreamResponse(t, resp)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(results[1].Response, &response); err != nil {
+		t.Fatalf("Failed to decode embedded response: %v", err)
+	}
+	if response["event"] != "sensor.pressure" {
+		t.Errorf("Expected event 'sensor.pressure', got %v", response["event"])
+	}
+
+	if summary.Processed != 2 || summary.Failed != 0 || summary.Error != "" {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
+
+func TestStreamIngestMalformed(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	valid := streamEnvelope(t, protocol.EnvelopeEmitEvent, "sensor-1", protocol.EmitEventBody{Event: "sensor.temperature"})
+
+	resp, err := http.Post(server.URL+"/stream", "application/x-ndjson", strings.NewReader(valid+"\n{not json"))
+	if err != nil {
+		t.Fatalf("Failed to send stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	results, summary := readStreamResponse(t, resp)
+	if len(results) != 1 {
+		t.Errorf("Expected the valid envelope to be processed before the error, got %d results", len(results))
+	}
+	if summary.Error == "" {
+		t.Error("Expected summary to report the malformed input")
+	}
+}
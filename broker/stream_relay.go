@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+var (
+	// ErrDuplicateStream is returned when a stream ID is already open
+	ErrDuplicateStream = errors.New("stream ID already open")
+	// ErrUnknownStream is returned for frames that match no open stream the
+	// sender is an end of
+	ErrUnknownStream = errors.New("no open stream with that ID")
+	// ErrStreamNotAccepted is returned for data sent before the tool has
+	// granted the opener a window
+	ErrStreamNotAccepted = errors.New("stream has not been accepted by the tool")
+	// ErrStreamOutOfOrder is returned for a data frame whose sequence number
+	// is not the sender's next one
+	ErrStreamOutOfOrder = errors.New("stream frame out of order")
+	// ErrStreamWindowExceeded is returned for data beyond the credit the
+	// other end has granted
+	ErrStreamWindowExceeded = errors.New("stream window exceeded")
+)
+
+// ToolStream is an open bidirectional stream between an opener and the
+// agent serving a streaming tool. Credit and sequence numbers are kept per
+// sending end.
+type ToolStream struct {
+	StreamID string
+	Opener   string
+	Target   string
+	Tool     string
+	OpenedAt time.Time
+	Accepted bool // The tool has granted the opener its first window
+
+	credit  map[string]int64
+	lastSeq map[string]uint64
+}
+
+// peer returns the other end of the stream from agentID
+func (s *ToolStream) peer(agentID string) string {
+	if agentID == s.Opener {
+		return s.Target
+	}
+	return s.Opener
+}
+
+// StreamTable tracks open tool streams and enforces their flow control
+type StreamTable struct {
+	streams map[string]*ToolStream
+	mu      sync.Mutex
+}
+
+// NewStreamTable creates an empty stream table
+func NewStreamTable() *StreamTable {
+	return &StreamTable{streams: make(map[string]*ToolStream)}
+}
+
+// Open records a stream from opener to target. The target may send up to
+// window bytes before the opener grants more; the opener may send nothing
+// until the target accepts.
+func (t *StreamTable) Open(streamID, opener, target, tool string, window int64) (*ToolStream, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.streams[streamID]; exists {
+		return nil, ErrDuplicateStream
+	}
+
+	stream := &ToolStream{
+		StreamID: streamID,
+		Opener:   opener,
+		Target:   target,
+		Tool:     tool,
+		OpenedAt: time.Now(),
+		credit:   map[string]int64{opener: 0, target: window},
+		lastSeq:  map[string]uint64{opener: 0, target: 0},
+	}
+	t.streams[streamID] = stream
+	return stream, nil
+}
+
+// lookup returns a stream agentID is an end of
+func (t *StreamTable) lookup(streamID, agentID string) (*ToolStream, error) {
+	stream, exists := t.streams[streamID]
+	if !exists || (agentID != stream.Opener && agentID != stream.Target) {
+		return nil, ErrUnknownStream
+	}
+	return stream, nil
+}
+
+// Send accounts for a data frame from agentID, returning the agent to
+// relay it to
+func (t *StreamTable) Send(agentID string, frame protocol.StreamDataBody) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stream, err := t.lookup(frame.StreamID, agentID)
+	if err != nil {
+		return "", err
+	}
+	if !stream.Accepted {
+		return "", ErrStreamNotAccepted
+	}
+	if frame.Seq != stream.lastSeq[agentID]+1 {
+		return "", ErrStreamOutOfOrder
+	}
+	if int64(len(frame.Data)) > stream.credit[agentID] {
+		return "", ErrStreamWindowExceeded
+	}
+
+	stream.lastSeq[agentID] = frame.Seq
+	stream.credit[agentID] -= int64(len(frame.Data))
+	return stream.peer(agentID), nil
+}
+
+// Grant adds credit for the other end of a stream, returning the agent the
+// grant is for. The target's first grant accepts the stream.
+func (t *StreamTable) Grant(agentID string, window protocol.StreamWindowBody) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stream, err := t.lookup(window.StreamID, agentID)
+	if err != nil {
+		return "", err
+	}
+
+	peer := stream.peer(agentID)
+	if window.Credit <= 0 || stream.credit[peer]+window.Credit > protocol.MaxStreamWindow {
+		return "", fmt.Errorf("credit must leave the window between 1 and %d bytes", protocol.MaxStreamWindow)
+	}
+	stream.credit[peer] += window.Credit
+	if agentID == stream.Target {
+		stream.Accepted = true
+	}
+	return peer, nil
+}
+
+// Close removes a stream agentID is an end of, returning it
+func (t *StreamTable) Close(streamID, agentID string) (*ToolStream, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stream, err := t.lookup(streamID, agentID)
+	if err != nil {
+		return nil, err
+	}
+	delete(t.streams, streamID)
+	return stream, nil
+}
+
+// CloseAgent removes every stream agentID is an end of, returning them
+func (t *StreamTable) CloseAgent(agentID string) []*ToolStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var closed []*ToolStream
+	for id, stream := range t.streams {
+		if stream.Opener == agentID || stream.Target == agentID {
+			delete(t.streams, id)
+			closed = append(closed, stream)
+		}
+	}
+	return closed
+}
+
+// GetStreamCount returns the number of open streams
+func (t *StreamTable) GetStreamCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.streams)
+}
+
+// streamError maps stream table errors to HTTP statuses
+func streamError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch err {
+	case ErrUnknownStream:
+		status = http.StatusNotFound
+	case ErrDuplicateStream, ErrStreamNotAccepted, ErrStreamOutOfOrder:
+		status = http.StatusConflict
+	case ErrStreamWindowExceeded:
+		status = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// verifyStreamSender checks the signature of a stream envelope. Streams are
+// relayed over live connections, so the sender must hold one.
+func (b *Broker) verifyStreamSender(w http.ResponseWriter, env *protocol.GenericEnvelope) bool {
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	if !registered {
+		http.Error(w, fmt.Sprintf("Agent %s is not registered", env.Agent), http.StatusNotFound)
+		return false
+	}
+	if agent.PubKey != nil {
+		if err := b.verifySender(w, env, agent.PubKey); err != nil {
+			b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+			return false
+		}
+	}
+	if !b.hub.IsConnected(env.Agent) {
+		http.Error(w, "Streams require a WebSocket or event stream connection", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// relayStreamFrame forwards a stream envelope, still signed by its sender,
+// over the recipient's connection
+func (b *Broker) relayStreamFrame(recipient string, env *protocol.GenericEnvelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return b.hub.SendRaw(recipient, data)
+}
+
+// handleStreamOpen opens a stream to a connected agent serving a streaming
+// tool and relays the streamOpen to it
+func (b *Broker) handleStreamOpen(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.StreamOpenBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.StreamID == "" {
+		http.Error(w, "streamId is required", http.StatusBadRequest)
+		return
+	}
+	if body.Window < 0 || body.Window > protocol.MaxStreamWindow {
+		http.Error(w, fmt.Sprintf("window must be between 0 and %d bytes", protocol.MaxStreamWindow), http.StatusBadRequest)
+		return
+	}
+	if !b.verifyStreamSender(w, env) {
+		return
+	}
+
+	b.mu.RLock()
+	limits := b.paramLimits
+	b.mu.RUnlock()
+	if err := limits.Check(body.Parameters); err != nil {
+		http.Error(w, fmt.Sprintf("Parameters rejected: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Streams are held to the same capability requirements as tool calls
+	b.mu.RLock()
+	agent := b.agents[env.Agent]
+	b.mu.RUnlock()
+	verified := agent != nil && agent.PubKey != nil
+	caller := ""
+	if verified {
+		caller = env.Agent
+	}
+	providers := b.mcpRegistry.FindToolProviders(body.Tool, caller)
+	authorized := b.authorizedProviders(env.Agent, verified, providers)
+	if len(providers) > 0 && len(authorized) == 0 {
+		http.Error(w, fmt.Sprintf("Agent %s holds none of the capabilities tool %s requires", env.Agent, body.Tool), http.StatusForbidden)
+		return
+	}
+	var provider *RegisteredTool
+	for _, candidate := range authorized {
+		if candidate.Tool.Streaming && b.hub.IsConnected(candidate.AgentID) {
+			provider = candidate
+			break
+		}
+	}
+	if provider == nil {
+		http.Error(w, fmt.Sprintf("No connected agent offers streaming tool %s", body.Tool), http.StatusNotFound)
+		return
+	}
+
+	window := body.Window
+	if window == 0 {
+		window = protocol.DefaultStreamWindow
+	}
+	if _, err := b.streams.Open(body.StreamID, env.Agent, provider.AgentID, provider.Tool.Name, window); err != nil {
+		streamError(w, err)
+		return
+	}
+
+	if err := b.relayStreamFrame(provider.AgentID, env); err != nil {
+		b.streams.Close(body.StreamID, env.Agent)
+		http.Error(w, fmt.Sprintf("Failed to reach %s: %v", provider.AgentID, err), http.StatusBadGateway)
+		return
+	}
+
+	slog.Info("Stream opened", "stream", body.StreamID, "agent", env.Agent, "provider", provider.AgentID, "tool", provider.Tool.Name)
+
+	response := map[string]interface{}{
+		"status":   "opened",
+		"streamId": body.StreamID,
+		"agent":    provider.AgentID,
+		"tool":     provider.Tool.Name,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleStreamData relays a data frame to the other end of its stream if it
+// is in order and within the sender's window
+func (b *Broker) handleStreamData(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.StreamDataBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !b.verifyStreamSender(w, env) {
+		return
+	}
+
+	peer, err := b.streams.Send(env.Agent, body)
+	if err != nil {
+		streamError(w, err)
+		return
+	}
+	if err := b.relayStreamFrame(peer, env); err != nil {
+		b.abortStream(body.StreamID, env.Agent, err)
+		http.Error(w, fmt.Sprintf("Failed to reach %s: %v", peer, err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "relayed", "seq": body.Seq})
+}
+
+// handleStreamWindow relays a credit grant to the other end of its stream
+func (b *Broker) handleStreamWindow(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.StreamWindowBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !b.verifyStreamSender(w, env) {
+		return
+	}
+
+	peer, err := b.streams.Grant(env.Agent, body)
+	if err != nil {
+		streamError(w, err)
+		return
+	}
+	if err := b.relayStreamFrame(peer, env); err != nil {
+		b.abortStream(body.StreamID, env.Agent, err)
+		http.Error(w, fmt.Sprintf("Failed to reach %s: %v", peer, err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "granted", "credit": body.Credit})
+}
+
+// handleStreamClose ends a stream and relays the close to its other end
+func (b *Broker) handleStreamClose(w http.ResponseWriter, env *protocol.GenericEnvelope) {
+	var body protocol.StreamCloseBody
+	if err := env.GetBodyAs(&body); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !b.verifyStreamSender(w, env) {
+		return
+	}
+
+	stream, err := b.streams.Close(body.StreamID, env.Agent)
+	if err != nil {
+		streamError(w, err)
+		return
+	}
+	if err := b.relayStreamFrame(stream.peer(env.Agent), env); err != nil {
+		slog.Warn("Failed to relay stream close", "stream", body.StreamID, "agent", stream.peer(env.Agent), "error", err)
+	}
+
+	slog.Info("Stream closed", "stream", body.StreamID, "agent", env.Agent)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "closed", "streamId": body.StreamID})
+}
+
+// abortStream closes a stream whose other end could not be reached and
+// tells the sender, via a broker-signed streamClose, why it ended
+func (b *Broker) abortStream(streamID, agentID string, cause error) {
+	if _, err := b.streams.Close(streamID, agentID); err != nil {
+		return
+	}
+	b.sendStreamClose(agentID, streamID, fmt.Sprintf("relay failed: %v", cause))
+}
+
+// closeAgentStreams ends the streams of an agent whose connection closed,
+// telling each other end with a broker-signed streamClose
+func (b *Broker) closeAgentStreams(agentID string) {
+	for _, stream := range b.streams.CloseAgent(agentID) {
+		b.sendStreamClose(stream.peer(agentID), stream.StreamID, fmt.Sprintf("agent %s disconnected", agentID))
+		slog.Info("Stream closed by disconnect", "stream", stream.StreamID, "agent", agentID)
+	}
+}
+
+func (b *Broker) sendStreamClose(recipient, streamID, reason string) {
+	notice := protocol.NewStreamClose(b.id, streamID, reason)
+	if err := notice.Sign(b.privateKey); err != nil {
+		slog.Error("Failed to sign streamClose", "stream", streamID, "error", err)
+		return
+	}
+	if err := b.hub.Send(recipient, notice); err != nil && err != ErrAgentNotConnected {
+		slog.Warn("Failed to send streamClose", "stream", streamID, "agent", recipient, "error", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestStreamRelay(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	shell := dialTestAgent(t, server, "shell-agent")
+	shell.register(
+		protocol.MCPTool{Name: "shell.exec", Streaming: true},
+		protocol.MCPTool{Name: "shell.version"},
+	)
+
+	caller := dialTestAgent(t, server, "term-agent")
+	caller.register()
+
+	status := func(reply map[string]interface{}) float64 {
+		return reply["status"].(float64)
+	}
+
+	// Only tools declared as streaming can be opened
+	nonce := caller.send("term-agent", protocol.EnvelopeStreamOpen, protocol.StreamOpenBody{StreamID: "s-0", Tool: "shell.version"})
+	if reply := caller.reply(nonce); status(reply) != http.StatusNotFound {
+		t.Errorf("Expected non-streaming tool to be rejected, got %v", reply)
+	}
+
+	nonce = caller.send("term-agent", protocol.EnvelopeStreamOpen, protocol.StreamOpenBody{
+		StreamID:   "s-1",
+		Tool:       "shell.exec",
+		Parameters: map[string]interface{}{"cmd": "sh"},
+		Window:     8,
+	})
+	if reply := caller.reply(nonce); status(reply) != http.StatusOK {
+		t.Fatalf("Stream open failed: %v", reply)
+	}
+
+	open := shell.pushed(protocol.EnvelopeStreamOpen)
+	if open["agent"] != "term-agent" || open["body"].(map[string]interface{})["streamId"] != "s-1" {
+		t.Fatalf("Unexpected relayed streamOpen: %v", open)
+	}
+
+	// The opener may not send until the tool accepts with a window grant
+	nonce = caller.send("term-agent", protocol.EnvelopeStreamData, protocol.StreamDataBody{StreamID: "s-1", Seq: 1, Data: []byte("ls\n")})
+	if reply := caller.reply(nonce); status(reply) != http.StatusConflict {
+		t.Errorf("Expected data before acceptance to be rejected, got %v", reply)
+	}
+
+	nonce = shell.send("shell-agent", protocol.EnvelopeStreamWindow, protocol.StreamWindowBody{StreamID: "s-1", Credit: 4})
+	if reply := shell.reply(nonce); status(reply) != http.StatusOK {
+		t.Fatalf("Window grant failed: %v", reply)
+	}
+	if grant := caller.pushed(protocol.EnvelopeStreamWindow); grant["body"].(map[string]interface{})["credit"] != float64(4) {
+		t.Errorf("Unexpected relayed window: %v", grant)
+	}
+
+	nonce = caller.send("term-agent", protocol.EnvelopeStreamData, protocol.StreamDataBody{StreamID: "s-1", Seq: 1, Channel: "stdin", Data: []byte("ls\n")})
+	if reply := caller.reply(nonce); status(reply) != http.StatusOK {
+		t.Fatalf("Stream data failed: %v", reply)
+	}
+	data := shell.pushed(protocol.EnvelopeStreamData)["body"].(map[string]interface{})
+	if data["channel"] != "stdin" || data["data"] != base64.StdEncoding.EncodeToString([]byte("ls\n")) {
+		t.Errorf("Unexpected relayed data: %v", data)
+	}
+
+	// Frames must be in order and within the granted window
+	nonce = caller.send("term-agent", protocol.EnvelopeStreamData, protocol.StreamDataBody{StreamID: "s-1", Seq: 3, Data: []byte("x")})
+	if reply := caller.reply(nonce); status(reply) != http.StatusConflict {
+		t.Errorf("Expected out-of-order frame to be rejected, got %v", reply)
+	}
+	nonce = caller.send("term-agent", protocol.EnvelopeStreamData, protocol.StreamDataBody{StreamID: "s-1", Seq: 2, Data: []byte("pwd\n")})
+	if reply := caller.reply(nonce); status(reply) != http.StatusTooManyRequests {
+		t.Errorf("Expected frame beyond the window to be rejected, got %v", reply)
+	}
+
+	nonce = shell.send("shell-agent", protocol.EnvelopeStreamData, protocol.StreamDataBody{StreamID: "s-1", Seq: 1, Channel: "stdout", Data: []byte("bin\n")})
+	if reply := shell.reply(nonce); status(reply) != http.StatusOK {
+		t.Fatalf("Stream output failed: %v", reply)
+	}
+	if output := caller.pushed(protocol.EnvelopeStreamData); output["agent"] != "shell-agent" {
+		t.Errorf("Unexpected relayed output: %v", output)
+	}
+
+	// Agents that are not an end of the stream cannot touch it
+	other := dialTestAgent(t, server, "other-agent")
+	other.register()
+	nonce = other.send("other-agent", protocol.EnvelopeStreamClose, protocol.StreamCloseBody{StreamID: "s-1"})
+	if reply := other.reply(nonce); status(reply) != http.StatusNotFound {
+		t.Errorf("Expected close from a third agent to be rejected, got %v", reply)
+	}
+
+	// The broker closes the stream when the tool's connection drops
+	shell.conn.Close()
+	closed := caller.pushed(protocol.EnvelopeStreamClose)
+	if closed["agent"] != broker.id || closed["body"].(map[string]interface{})["error"] == nil {
+		t.Errorf("Unexpected streamClose: %v", closed)
+	}
+	if broker.streams.GetStreamCount() != 0 {
+		t.Errorf("Expected no open streams, got %d", broker.streams.GetStreamCount())
+	}
+}
+
+func TestStreamRequiresConnection(t *testing.T) {
+	broker := NewBroker()
+	broker.agents["http-agent"] = &Agent{ID: "http-agent"}
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeStreamOpen},
+	}
+	env.Agent = "http-agent"
+	env.Body = []byte(`{"streamId":"s-1","tool":"shell.exec"}`)
+
+	recorder := newBufferedResponse()
+	broker.handleStreamOpen(recorder, env)
+	if recorder.status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a live connection, got %d: %s", recorder.status, recorder.body.String())
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// SubscriptionManager tracks event subscriptions and fans emitted events
+// out to subscribed agents
+type SubscriptionManager struct {
+	subscriptions map[string]*Subscription
+	httpClient    *http.Client
+	pusher        EnvelopePusher
+	mu            sync.RWMutex
+}
+
+// EnvelopePusher delivers envelopes over persistent agent connections
+type EnvelopePusher interface {
+	IsConnected(agentID string) bool
+	SendRaw(agentID string, data []byte) error
+}
+
+// Subscription holds the event patterns an agent is subscribed to
+type Subscription struct {
+	AgentID   string
+	Patterns  []string
+	Endpoint  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// NewSubscriptionManager creates a new subscription manager
+func NewSubscriptionManager() *SubscriptionManager {
+	return &SubscriptionManager{
+		subscriptions: make(map[string]*Subscription),
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			// Deliveries stay on the endpoint the subscriber registered
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// SetPusher sets the connection-based delivery path. Subscribers with a live
+// connection receive events over it instead of their HTTP endpoint.
+func (sm *SubscriptionManager) SetPusher(pusher EnvelopePusher) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.pusher = pusher
+}
+
+// Subscribe adds event patterns to an agent's subscription, creating it if
+// needed. A non-empty endpoint replaces the current delivery endpoint.
+func (sm *SubscriptionManager) Subscribe(agentID, endpoint string, patterns []string) Subscription {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	now := time.Now()
+	sub, exists := sm.subscriptions[agentID]
+	if !exists {
+		sub = &Subscription{
+			AgentID:   agentID,
+			CreatedAt: now,
+		}
+		sm.subscriptions[agentID] = sub
+	}
+
+	for _, pattern := range patterns {
+		if !containsString(sub.Patterns, pattern) {
+			sub.Patterns = append(sub.Patterns, pattern)
+		}
+	}
+
+	if endpoint != "" {
+		sub.Endpoint = endpoint
+	}
+	sub.UpdatedAt = now
+
+	copied := *sub
+	copied.Patterns = append([]string(nil), sub.Patterns...)
+	return copied
+}
+
+// Restore puts a previously stored subscription back in place
+func (sm *SubscriptionManager) Restore(sub Subscription) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sub.Patterns = append([]string(nil), sub.Patterns...)
+	sm.subscriptions[sub.AgentID] = &sub
+}
+
+// Unsubscribe removes event patterns from an agent's subscription. An empty
+// pattern list removes the subscription entirely.
+func (sm *SubscriptionManager) Unsubscribe(agentID string, patterns []string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sub, exists := sm.subscriptions[agentID]
+	if !exists {
+		return
+	}
+
+	if len(patterns) == 0 {
+		delete(sm.subscriptions, agentID)
+		return
+	}
+
+	remaining := make([]string, 0, len(sub.Patterns))
+	for _, pattern := range sub.Patterns {
+		if !containsString(patterns, pattern) {
+			remaining = append(remaining, pattern)
+		}
+	}
+	sub.Patterns = remaining
+	sub.UpdatedAt = time.Now()
+
+	if len(sub.Patterns) == 0 {
+		delete(sm.subscriptions, agentID)
+	}
+}
+
+// RemoveAgent drops all subscriptions held by an agent
+func (sm *SubscriptionManager) RemoveAgent(agentID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.subscriptions, agentID)
+}
+
+// GetSubscription returns a copy of an agent's subscription
+func (sm *SubscriptionManager) GetSubscription(agentID string) (Subscription, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sub, exists := sm.subscriptions[agentID]
+	if !exists {
+		return Subscription{}, false
+	}
+
+	copied := *sub
+	copied.Patterns = append([]string(nil), sub.Patterns...)
+	return copied, true
+}
+
+// Matching returns the subscriptions interested in the given event type
+func (sm *SubscriptionManager) Matching(event string) []Subscription {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var matches []Subscription
+	for _, sub := range sm.subscriptions {
+		for _, pattern := range sub.Patterns {
+			if matchPattern(event, pattern) {
+				matches = append(matches, *sub)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// Publish delivers an emitEvent envelope to every matching subscriber other
+// than its sender that visible admits, or every one if visible is nil.
+// Deliveries run in the background; the returned count is the number of
+// subscribers the event was dispatched to.
+func (sm *SubscriptionManager) Publish(env *protocol.GenericEnvelope, event string, visible func(Subscription) bool) int {
+	data, err := json.Marshal(env)
+	if err != nil {
+		slog.Error("Failed to marshal event for delivery", "event", event, "error", err)
+		return 0
+	}
+
+	sm.mu.RLock()
+	pusher := sm.pusher
+	sm.mu.RUnlock()
+
+	dispatched := 0
+	for _, sub := range sm.Matching(event) {
+		if sub.AgentID == env.Agent || (visible != nil && !visible(sub)) {
+			continue
+		}
+
+		if pusher != nil && pusher.IsConnected(sub.AgentID) {
+			dispatched++
+			go func(agentID string) {
+				if err := pusher.SendRaw(agentID, data); err != nil {
+					slog.Warn("Failed to push event", "event", event, "agent", agentID, "error", err)
+				}
+			}(sub.AgentID)
+			continue
+		}
+
+		if sub.Endpoint == "" {
+			continue
+		}
+
+		dispatched++
+		go func(sub Subscription) {
+			if err := sm.deliver(sub.Endpoint, data); err != nil {
+				slog.Warn("Failed to deliver event", "event", event, "agent", sub.AgentID, "error", err)
+			}
+		}(sub)
+	}
+
+	return dispatched
+}
+
+// deliver posts a serialized envelope to a subscriber endpoint
+func (sm *SubscriptionManager) deliver(endpoint string, data []byte) error {
+	resp, err := sm.httpClient.Post(endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("subscriber returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// GetSubscriptionCount returns the number of agents with active subscriptions
+func (sm *SubscriptionManager) GetSubscriptionCount() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return len(sm.subscriptions)
+}
+
+// sameOrigin reports whether two URLs have the same scheme, host and port
+func sameOrigin(a, b string) bool {
+	first, err := url.Parse(a)
+	if err != nil || first.Host == "" {
+		return false
+	}
+	second, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(first.Scheme, second.Scheme) && strings.EqualFold(first.Host, second.Host)
+}
+
+// containsString reports whether a slice contains the given string
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestSubscriptionManagerBasics(t *testing.T) {
+	sm := NewSubscriptionManager()
+
+	sm.Subscribe("agent-a", "http://a.example.com/events", []string{"sensor.*"})
+	sm.Subscribe("agent-a", "", []string{"deploy.finished", "sensor.*"})
+	sm.Subscribe("agent-b", "http://b.example.com/events", []string{"deploy.*"})
+
+	sub, exists := sm.GetSubscription("agent-a")
+	if !exists {
+		t.Fatal("Expected subscription for agent-a")
+	}
+	if len(sub.Patterns) != 2 {
+		t.Errorf("Expected 2 patterns, got %v", sub.Patterns)
+	}
+	if sub.Endpoint != "http://a.example.com/events" {
+		t.Errorf("Expected endpoint to be preserved, got %s", sub.Endpoint)
+	}
+
+	tests := []struct {
+		event    string
+		expected int
+	}{
+		{"sensor.temperature", 1},
+		{"deploy.finished", 2},
+		{"deploy.started", 1},
+		{"unrelated", 0},
+	}
+
+	for _, tt := range tests {
+		if got := len(sm.Matching(tt.event)); got != tt.expected {
+			t.Errorf("Matching(%s): expected %d subscribers, got %d", tt.event, tt.expected, got)
+		}
+	}
+
+	sm.Unsubscribe("agent-a", []string{"sensor.*"})
+	if got := len(sm.Matching("sensor.temperature")); got != 0 {
+		t.Errorf("Expected no subscribers after unsubscribe, got %d", got)
+	}
+
+	sm.Unsubscribe("agent-a", []string{"deploy.finished"})
+	if _, exists := sm.GetSubscription("agent-a"); exists {
+		t.Error("Expected subscription to be removed once empty")
+	}
+
+	sm.RemoveAgent("agent-b")
+	if sm.GetSubscriptionCount() != 0 {
+		t.Errorf("Expected 0 subscriptions, got %d", sm.GetSubscriptionCount())
+	}
+}
+
+func TestBrokerEventFanOut(t *testing.T) {
+	received := make(chan protocol.Envelope, 4)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env protocol.Envelope
+		if err := json.NewDecoder(r.Body).Decode(&env); err == nil {
+			received <- env
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer subscriber.Close()
+
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	send := func(envType protocol.EnvelopeType, agent string, body interface{}) *http.Response {
+		t.Helper()
+		env := protocol.NewEnvelope(envType, agent)
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to marshal body: %v", err)
+		}
+		env.Body = raw
+
+		data, err := json.Marshal(env)
+		if err != nil {
+			t.Fatalf("Failed to marshal envelope: %v", err)
+		}
+
+		resp, err := client.Post(server.URL+"/", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		return resp
+	}
+	post := func(envType protocol.EnvelopeType, agent string, body interface{}) map[string]interface{} {
+		t.Helper()
+		resp := send(envType, agent, body)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, msg)
+		}
+
+		var response map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	// Only registered agents subscribe, and only to their own origin
+	broker.agents["listener-agent"] = &Agent{ID: "listener-agent", Endpoint: subscriber.URL + "/agent"}
+	for agent, endpoint := range map[string]string{
+		"stranger-agent": subscriber.URL,
+		"listener-agent": "http://169.254.169.254/latest/meta-data",
+	} {
+		resp := send(protocol.EnvelopeSubscribe, agent, protocol.SubscribeBody{Events: []string{"sensor.*"}, Endpoint: endpoint})
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("Expected %s subscribing at %s to be refused", agent, endpoint)
+		}
+	}
+
+	response := post(protocol.EnvelopeSubscribe, "listener-agent", protocol.SubscribeBody{
+		Events:   []string{"sensor.*"},
+		Endpoint: subscriber.URL,
+	})
+	if response["status"] != "subscribed" {
+		t.Fatalf("Expected status 'subscribed', got %v", response["status"])
+	}
+
+	response = post(protocol.EnvelopeEmitEvent, "sensor-agent", protocol.EmitEventBody{
+		Event:   "sensor.temperature",
+		Payload: map[string]interface{}{"celsius": 21.5},
+	})
+	if response["subscribers"] != float64(1) {
+		t.Errorf("Expected 1 subscriber, got %v", response["subscribers"])
+	}
+
+	select {
+	case env := <-received:
+		if env.Type != protocol.EnvelopeEmitEvent || env.Agent != "sensor-agent" {
+			t.Errorf("Unexpected delivered envelope: %s from %s", env.Type, env.Agent)
+		}
+		var body protocol.EmitEventBody
+		if err := json.Unmarshal(env.Body, &body); err != nil || body.Event != "sensor.temperature" {
+			t.Errorf("Unexpected delivered body: %s", env.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for event delivery")
+	}
+
+	// Events that don't match the subscription are not delivered
+	response = post(protocol.EnvelopeEmitEvent, "sensor-agent", protocol.EmitEventBody{Event: "deploy.finished"})
+	if response["subscribers"] != float64(0) {
+		t.Errorf("Expected 0 subscribers, got %v", response["subscribers"])
+	}
+
+	post(protocol.EnvelopeUnsubscribe, "listener-agent", protocol.UnsubscribeBody{})
+	if broker.subscriptions.GetSubscriptionCount() != 0 {
+		t.Error("Expected subscription to be removed after unsubscribe")
+	}
+}
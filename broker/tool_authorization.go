@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/fep-fem/protocol"
+)
+
+// CapabilityGrant lets agents whose IDs match Agent hold the capabilities
+// matching Capability, when they declare them
+type CapabilityGrant struct {
+	Agent      string // Matched like capability patterns, e.g. "worker-*"
+	Capability string // A capability or pattern, e.g. "file.*"
+}
+
+// ParseCapabilityGrants parses grants written as
+// "worker-*=file.read,ops-*=*"; an agent may be granted several
+// capabilities by as many grants
+func ParseCapabilityGrants(spec string) ([]CapabilityGrant, error) {
+	var grants []CapabilityGrant
+	for _, field := range parseSinkList(spec) {
+		agent, capability, found := strings.Cut(field, "=")
+		if !found || agent == "" || capability == "" {
+			return nil, fmt.Errorf("invalid capability grant %q, expected agent=capability", field)
+		}
+		grants = append(grants, CapabilityGrant{Agent: agent, Capability: capability})
+	}
+	return grants, nil
+}
+
+// checkGrantsGated refuses capability grants on a broker open to any
+// registration. Grants name agents by ID, so they are only safe where an
+// operator admits each agent, by approval or bootstrap token, and no one
+// else can register under a granted ID.
+func checkGrantsGated(grants []CapabilityGrant, requireApproval, inviteOnly bool) error {
+	if len(grants) > 0 && !requireApproval && !inviteOnly {
+		return fmt.Errorf("capability grants need -require-approval or -invite-only, or any agent could register under a granted ID")
+	}
+	return nil
+}
+
+// SetCapabilityGrants sets the operator's grants of capabilities to agents
+func (b *Broker) SetCapabilityGrants(grants []CapabilityGrant) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.grants = grants
+}
+
+// holdsCapability reports whether any of the held capabilities covers the
+// required one. A held capability may end in a wildcard, such as "file.*".
+func holdsCapability(held []string, required string) bool {
+	for _, capability := range held {
+		if matchPattern(required, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizedFor reports whether an agent holding capabilities may call a
+// tool: the tool requires none, or the agent holds one of those it requires
+// and it was not revoked from the agent
+func authorizedFor(tool protocol.MCPTool, capabilities []string, revoked *Revocation) bool {
+	if len(tool.RequiredCapabilities) == 0 {
+		return true
+	}
+	for _, required := range tool.RequiredCapabilities {
+		if holdsCapability(capabilities, required) && !revoked.coversCapability(required) {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectCapabilities returns what both sets of capability patterns
+// cover: the declared capabilities a grant covers, and the granted ones a
+// broader declaration covers, so that declaring "*" under a grant of
+// "file.*" holds "file.*"
+func intersectCapabilities(declared, granted []string) []string {
+	var held []string
+	for _, capability := range declared {
+		if holdsCapability(granted, capability) {
+			held = append(held, capability)
+			continue
+		}
+		for _, grant := range granted {
+			if matchPattern(grant, capability) {
+				held = append(held, grant)
+			}
+		}
+	}
+	return held
+}
+
+// heldCapabilities returns the capabilities an agent holds: those it
+// declared that the broker granted it, by the bootstrap token it registered
+// with or by the operator's grants. Callers hold b.mu.
+func (b *Broker) heldCapabilities(agent *Agent) []string {
+	granted := append([]string{}, agent.Granted...)
+	for _, grant := range b.grants {
+		if matchPattern(agent.ID, grant.Agent) {
+			granted = append(granted, grant.Capability)
+		}
+	}
+	return intersectCapabilities(agent.Capabilities, granted)
+}
+
+// verifyCaller checks the signature, or session, of an envelope from an
+// agent registered with a key, reporting whether the sender was verified.
+// Senders that cannot be, being unregistered or registered without a key,
+// are anonymous.
+func (b *Broker) verifyCaller(w http.ResponseWriter, env *protocol.GenericEnvelope) (bool, error) {
+	b.mu.RLock()
+	agent, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	if !registered || agent.PubKey == nil {
+		return false, nil
+	}
+	if err := b.verifySender(w, env, agent.PubKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyProvider checks that a tool result, or a chunk of one, comes from a
+// registered agent, verified by its signature or session if it registered
+// with a key, replying with an error if not
+func (b *Broker) verifyProvider(w http.ResponseWriter, env *protocol.GenericEnvelope) bool {
+	b.mu.RLock()
+	_, registered := b.agents[env.Agent]
+	b.mu.RUnlock()
+	if !registered {
+		b.replyError(w, env, http.StatusForbidden, protocol.ErrorForbidden, fmt.Sprintf("Agent %s is not registered", env.Agent))
+		return false
+	}
+	if _, err := b.verifyCaller(w, env); err != nil {
+		b.replyError(w, env, http.StatusUnauthorized, protocol.ErrorInvalidSignature, fmt.Sprintf("Invalid signature: %v", err))
+		return false
+	}
+	return true
+}
+
+// authorizedProviders returns the providers a caller may call. A verified
+// caller may always call its own tools, and otherwise those requiring a
+// capability it holds; anonymous callers only those requiring none.
+func (b *Broker) authorizedProviders(caller string, verified bool, providers []*RegisteredTool) []*RegisteredTool {
+	var capabilities []string
+	var revoked *Revocation
+	if verified {
+		b.mu.RLock()
+		if agent, exists := b.agents[caller]; exists {
+			capabilities = b.heldCapabilities(agent)
+		}
+		revoked = b.revocations[caller]
+		b.mu.RUnlock()
+	}
+
+	authorized := make([]*RegisteredTool, 0, len(providers))
+	for _, provider := range providers {
+		if (verified && provider.AgentID == caller) || authorizedFor(provider.Tool, capabilities, revoked) {
+			authorized = append(authorized, provider)
+		}
+	}
+	return authorized
+}
+
+// writePermissionDenied refuses a tool call with 403 and a broker-signed
+// toolResult whose code and details say which capabilities were missing
+func (b *Broker) writePermissionDenied(w http.ResponseWriter, caller string, body protocol.ToolCallBody, providers []*RegisteredTool) {
+	var required []string
+	seen := make(map[string]bool)
+	for _, provider := range providers {
+		for _, capability := range provider.Tool.RequiredCapabilities {
+			if !seen[capability] {
+				seen[capability] = true
+				required = append(required, capability)
+			}
+		}
+	}
+
+	slog.Warn("Tool call denied", "tool", body.Tool, "caller", caller, "requiredCapabilities", required)
+	b.writeToolResultStatus(w, http.StatusForbidden, protocol.ToolResultBody{
+		RequestID: body.RequestID,
+		Error:     fmt.Sprintf("Agent %s holds none of the capabilities tool %s requires", caller, body.Tool),
+		Code:      protocol.ErrorPermissionDenied,
+		Details: map[string]interface{}{
+			"caller":               caller,
+			"tool":                 body.Tool,
+			"requiredCapabilities": required,
+		},
+	})
+}
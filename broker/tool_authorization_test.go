@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestAuthorizedFor(t *testing.T) {
+	tool := protocol.MCPTool{Name: "file.delete", RequiredCapabilities: []string{"file.write", "admin"}}
+	cases := []struct {
+		capabilities []string
+		want         bool
+	}{
+		{nil, false},
+		{[]string{"file.read"}, false},
+		{[]string{"file.write"}, true},
+		{[]string{"file.*"}, true},
+		{[]string{"admin"}, true},
+		{[]string{"*"}, true},
+	}
+	for _, c := range cases {
+		if got := authorizedFor(tool, c.capabilities, nil); got != c.want {
+			t.Errorf("authorizedFor(%v) = %v, want %v", c.capabilities, got, c.want)
+		}
+	}
+	if !authorizedFor(protocol.MCPTool{Name: "echo"}, nil, nil) {
+		t.Error("Expected a tool requiring nothing to be callable by anyone")
+	}
+	if authorizedFor(tool, []string{"*"}, &Revocation{Capabilities: []string{"file.*", "admin"}}) {
+		t.Error("Expected revoked capabilities not to count, even under a wildcard")
+	}
+}
+
+func TestIntersectCapabilities(t *testing.T) {
+	cases := []struct {
+		declared, granted, want []string
+	}{
+		{[]string{"file.read", "file.write"}, []string{"file.read"}, []string{"file.read"}},
+		{[]string{"file.write"}, []string{"file.*"}, []string{"file.write"}},
+		{[]string{"*"}, []string{"file.*"}, []string{"file.*"}},
+		{[]string{"*"}, nil, nil},
+		{[]string{"admin"}, []string{"file.*"}, nil},
+	}
+	for _, c := range cases {
+		if got := intersectCapabilities(c.declared, c.granted); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("intersectCapabilities(%v, %v) = %v, want %v", c.declared, c.granted, got, c.want)
+		}
+	}
+}
+
+func TestCheckGrantsGated(t *testing.T) {
+	grants, err := ParseCapabilityGrants("worker-*=file.read")
+	if err != nil {
+		t.Fatalf("ParseCapabilityGrants: %v", err)
+	}
+	if err := checkGrantsGated(grants, false, false); err == nil {
+		t.Error("Expected grants to be refused when anyone can register")
+	}
+	if err := checkGrantsGated(grants, true, false); err != nil {
+		t.Errorf("Expected grants with approval to pass, got %v", err)
+	}
+	if err := checkGrantsGated(grants, false, true); err != nil {
+		t.Errorf("Expected grants with invite-only registration to pass, got %v", err)
+	}
+	if err := checkGrantsGated(nil, false, false); err != nil {
+		t.Errorf("Expected no grants to pass, got %v", err)
+	}
+}
+
+func TestToolCallRequiresCapability(t *testing.T) {
+	broker := NewBroker()
+	broker.mcpRegistry.RegisterAgent("file-agent", &MCPAgent{
+		ID:            "file-agent",
+		Tools:         []protocol.MCPTool{{Name: "file.delete", RequiredCapabilities: []string{"file.write"}}},
+		LastHeartbeat: time.Now(),
+	})
+	keys := make(map[string]ed25519.PrivateKey)
+	for id, capabilities := range map[string][]string{
+		"reader-agent": {"file.read"},
+		"writer-agent": {"file.*"},
+		"greedy-agent": {"*"}, // Declares everything, granted nothing
+	} {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		keys[id] = priv
+		broker.agents[id] = &Agent{ID: id, Capabilities: capabilities, PubKey: pub}
+	}
+	grants, err := ParseCapabilityGrants("writer-*=file.write,reader-*=file.read")
+	if err != nil {
+		t.Fatalf("ParseCapabilityGrants: %v", err)
+	}
+	broker.SetCapabilityGrants(grants)
+
+	call := func(caller string, signer ed25519.PrivateKey) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+		env.Agent = caller
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: "file.delete", RequestID: "req-" + caller})
+		if signer != nil {
+			protocol.SignEnvelope(env, signer)
+		}
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+		return recorder
+	}
+
+	for _, caller := range []string{"reader-agent", "greedy-agent", "unknown-agent"} {
+		recorder := call(caller, keys[caller])
+		if recorder.status != http.StatusForbidden {
+			t.Fatalf("Expected %s to be denied, got %d", caller, recorder.status)
+		}
+		var response protocol.ToolResultEnvelope
+		if err := json.Unmarshal(recorder.body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode denial: %v", err)
+		}
+		if response.Type != protocol.EnvelopeToolResult || response.Sig == "" {
+			t.Errorf("Expected a signed toolResult, got %+v", response)
+		}
+		body := response.Body
+		if body.Success || body.Code != protocol.ErrorPermissionDenied || body.RequestID != "req-"+caller {
+			t.Errorf("Unexpected denial: %+v", body)
+		}
+		if required, _ := body.Details["requiredCapabilities"].([]interface{}); len(required) != 1 || required[0] != "file.write" {
+			t.Errorf("Expected the required capabilities in the details, got %+v", body.Details)
+		}
+	}
+
+	// Calls in a registered agent's name must be signed with its key
+	for name, signer := range map[string]ed25519.PrivateKey{"unsigned": nil, "another key": keys["reader-agent"]} {
+		if recorder := call("writer-agent", signer); recorder.status != http.StatusUnauthorized {
+			t.Errorf("%s: expected a call impersonating writer-agent to be refused, got %d", name, recorder.status)
+		}
+	}
+
+	// An authorized call is routed, though the agent has no endpoint to take it
+	recorder := call("writer-agent", keys["writer-agent"])
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected writer-agent to be routed, got %d", recorder.status)
+	}
+	var response protocol.ToolResultEnvelope
+	json.Unmarshal(recorder.body.Bytes(), &response)
+	if response.Body.Code != "" {
+		t.Errorf("Expected no refusal code, got %+v", response.Body)
+	}
+}
+
+func TestPrivateToolNeedsVerifiedCaller(t *testing.T) {
+	broker := NewBroker()
+	broker.mcpRegistry.RegisterAgent("vault-agent", &MCPAgent{
+		ID: "vault-agent",
+		Tools: []protocol.MCPTool{{
+			Name:          "vault.read",
+			Visibility:    protocol.ToolVisibilityPrivate,
+			AllowedAgents: []string{"trusted-agent", "keyless-agent", "ghost-agent"},
+		}},
+		LastHeartbeat: time.Now(),
+	})
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	broker.agents["trusted-agent"] = &Agent{ID: "trusted-agent", PubKey: pub}
+	broker.agents["keyless-agent"] = &Agent{ID: "keyless-agent"}
+
+	send := func(envType protocol.EnvelopeType, caller string, body interface{}, signer ed25519.PrivateKey) *bufferedResponse {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: envType}}
+		env.Agent = caller
+		env.Nonce = protocol.NewNonce()
+		env.Body, _ = json.Marshal(body)
+		if signer != nil {
+			protocol.SignEnvelope(env, signer)
+		}
+		recorder := newBufferedResponse()
+		if envType == protocol.EnvelopeToolCall {
+			broker.handleToolCall(recorder, env)
+		} else {
+			broker.handleDiscoverTools(recorder, env)
+		}
+		return recorder
+	}
+
+	call := protocol.ToolCallBody{Tool: "vault.read", RequestID: "req-1"}
+	if recorder := send(protocol.EnvelopeToolCall, "trusted-agent", call, priv); recorder.status != http.StatusOK {
+		t.Errorf("Expected the verified, allowed caller to be routed, got %d", recorder.status)
+	}
+	// Names on the allowlist that the caller cannot prove are anonymous
+	for _, caller := range []string{"keyless-agent", "ghost-agent"} {
+		if recorder := send(protocol.EnvelopeToolCall, caller, call, nil); recorder.status != http.StatusNotFound {
+			t.Errorf("Expected an unverified call as %s to find no tool, got %d", caller, recorder.status)
+		}
+	}
+
+	discover := protocol.DiscoverToolsBody{Query: protocol.ToolQuery{Capabilities: []string{"vault.*"}}}
+	for caller, want := range map[string]int{"trusted-agent": 1, "ghost-agent": 0} {
+		var signer ed25519.PrivateKey
+		if caller == "trusted-agent" {
+			signer = priv
+		}
+		var response struct {
+			TotalResults int `json:"totalResults"`
+		}
+		json.Unmarshal(send(protocol.EnvelopeDiscoverTools, caller, discover, signer).body.Bytes(), &response)
+		if response.TotalResults != want {
+			t.Errorf("Expected %s to discover %d agents, got %d", caller, want, response.TotalResults)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/fep-fem/protocol"
+)
+
+// CatalogTool is one entry of the tool catalog served at GET /tools
+type CatalogTool struct {
+	AgentID     string                 `json:"agentId"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"inputSchema,omitempty"`
+	Docs        string                 `json:"docs,omitempty"`
+	Examples    []protocol.ToolExample `json:"examples,omitempty"`
+	ProxiedBy   string                 `json:"proxiedBy,omitempty"`
+}
+
+// ToolCatalog lists the public tools of every registered agent, ordered by
+// agent and tool name. Unlisted and private tools are left out since the
+// catalog is served without authentication.
+func (r *MCPRegistry) ToolCatalog() []CatalogTool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var catalog []CatalogTool
+	for _, tool := range r.tools {
+		if !tool.Tool.DiscoverableBy("") {
+			continue
+		}
+		catalog = append(catalog, CatalogTool{
+			AgentID:     tool.AgentID,
+			Name:        tool.Tool.Name,
+			Description: tool.Tool.Description,
+			InputSchema: tool.Tool.InputSchema,
+			Docs:        tool.Tool.Docs,
+			Examples:    tool.Tool.Examples,
+			ProxiedBy:   tool.Proxy,
+		})
+	}
+
+	sort.Slice(catalog, func(i, j int) bool {
+		if catalog[i].AgentID != catalog[j].AgentID {
+			return catalog[i].AgentID < catalog[j].AgentID
+		}
+		return catalog[i].Name < catalog[j].Name
+	})
+	return catalog
+}
+
+// catalogPage renders the tool catalog for browsers. Docs are shown as
+// their markdown source.
+var catalogPage = template.Must(template.New("tools").Funcs(template.FuncMap{
+	"json": func(v interface{}) string {
+		data, _ := json.MarshalIndent(v, "", "  ")
+		return string(data)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>FEM Tool Catalog</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+pre { background: #f4f4f4; padding: 0.75em; overflow-x: auto; white-space: pre-wrap; }
+.agent { color: #666; }
+</style>
+</head>
+<body>
+<h1>Tool Catalog</h1>
+{{range .}}
+<section>
+<h2>{{.Name}} <span class="agent">on {{.AgentID}}{{if .ProxiedBy}} via {{.ProxiedBy}}{{end}}</span></h2>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+{{if .Docs}}<pre>{{.Docs}}</pre>{{end}}
+{{if .InputSchema}}<h3>Parameters</h3><pre>{{json .InputSchema}}</pre>{{end}}
+{{range .Examples}}
+<h3>Example{{if .Description}}: {{.Description}}{{end}}</h3>
+<pre>{{json .Parameters}}</pre>
+{{if .Result}}<p>Returns:</p><pre>{{json .Result}}</pre>{{end}}
+{{end}}
+</section>
+{{else}}
+<p>No tools registered.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// handleToolCatalog serves GET /tools: JSON by default, or an HTML page
+// when the client prefers text/html
+func (b *Broker) handleToolCatalog(w http.ResponseWriter, r *http.Request) {
+	catalog := b.mcpRegistry.ToolCatalog()
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		catalogPage.Execute(w, catalog)
+		return
+	}
+
+	if catalog == nil {
+		catalog = []CatalogTool{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tools": catalog,
+	})
+}
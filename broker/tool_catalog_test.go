@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestToolDocsAndExamples(t *testing.T) {
+	broker := NewBroker()
+
+	add := protocol.MCPTool{
+		Name:        "math.add",
+		Description: "Add two numbers",
+		Docs:        "Adds `a` and `b`.\n\n<b>Both</b> must be numbers.",
+		Examples: []protocol.ToolExample{{
+			Description: "Small integers",
+			Parameters:  map[string]interface{}{"a": 2, "b": 3},
+			Result:      5,
+		}},
+	}
+	secret := protocol.MCPTool{Name: "math.secret", Visibility: protocol.ToolVisibilityPrivate}
+
+	env := &protocol.GenericEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeRegisterAgent},
+	}
+	env.Agent = "calculator"
+	env.Body, _ = json.Marshal(protocol.RegisterAgentBody{
+		MCPEndpoint:    "https://calculator/mcp",
+		BodyDefinition: &protocol.BodyDefinition{Name: "calculator", MCPTools: []protocol.MCPTool{add, secret}},
+	})
+
+	recorder := newBufferedResponse()
+	broker.handleRegisterAgent(recorder, env)
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.status, recorder.body.String())
+	}
+
+	// Discovery returns docs and examples
+	tools, err := broker.mcpRegistry.DiscoverTools(protocol.ToolQuery{Capabilities: []string{"math.add"}})
+	if err != nil || len(tools) != 1 {
+		t.Fatalf("Expected 1 discovered agent, got %d (%v)", len(tools), err)
+	}
+	listed := tools[0].MCPTools[0]
+	if listed.Docs != add.Docs || len(listed.Examples) != 1 || listed.Examples[0].Description != "Small integers" {
+		t.Errorf("Expected docs and examples in discovery, got %+v", listed)
+	}
+
+	// The JSON catalog lists public tools only
+	req := httptest.NewRequest(http.MethodGet, "/tools", nil)
+	rec := httptest.NewRecorder()
+	broker.ServeHTTP(rec, req)
+
+	var catalog struct {
+		Tools []CatalogTool `json:"tools"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+		t.Fatalf("Failed to decode catalog: %v", err)
+	}
+	if len(catalog.Tools) != 1 || catalog.Tools[0].Name != "math.add" || len(catalog.Tools[0].Examples) != 1 {
+		t.Errorf("Unexpected catalog: %+v", catalog.Tools)
+	}
+
+	// Browsers get an HTML page with docs escaped
+	req = httptest.NewRequest(http.MethodGet, "/tools", nil)
+	req.Header.Set("Accept", "text/html")
+	rec = httptest.NewRecorder()
+	broker.ServeHTTP(rec, req)
+
+	page := rec.Body.String()
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Expected HTML, got %s", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(page, "math.add") || !strings.Contains(page, "&lt;b&gt;Both&lt;/b&gt;") || strings.Contains(page, "math.secret") {
+		t.Errorf("Unexpected catalog page: %s", page)
+	}
+}
+
+func TestValidateToolDocs(t *testing.T) {
+	if err := validateTools([]protocol.MCPTool{{Name: "big", Docs: strings.Repeat("x", maxToolDocsSize+1)}}); err == nil {
+		t.Error("Expected oversized docs to be rejected")
+	}
+	if err := validateTools([]protocol.MCPTool{{Name: "many", Examples: make([]protocol.ToolExample, maxToolExamples+1)}}); err == nil {
+		t.Error("Expected too many examples to be rejected")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// deliverToolCall calls a tool on the route's MCP endpoint, retrying failed
+// deliveries as far as the tool's retry policy allows
+func (b *Broker) deliverToolCall(route toolRoute, tool protocol.MCPTool, body protocol.ToolCallBody) (interface{}, error) {
+	attempts := tool.DeliveryAttempts()
+	for attempt := 1; ; attempt++ {
+		output, err := b.toolClient.CallTool(route.Endpoint, route.Tool, toolCallMeta(body), body.Parameters)
+		if err == nil || attempt >= attempts || !isDeliveryFailure(err) {
+			return output, err
+		}
+
+		delay := tool.Retry.Backoff(attempt)
+		slog.Warn("Tool call delivery failed, retrying", "requestId", body.RequestID, "provider", route.AgentID,
+			"attempt", attempt, "attempts", attempts, "delay", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// flakyMCPServer answers with failStatus until it has been called failures
+// times, then succeeds; calls counts every request
+func flakyMCPServer(t *testing.T, failures int32, failStatus int, calls *int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= failures {
+			http.Error(w, "try again", failStatus)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"result":  map[string]interface{}{"ok": true},
+			"id":      1,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBrokerRetriesFailedDeliveries(t *testing.T) {
+	policy := &protocol.RetryPolicy{MaxAttempts: 3, InitialBackoffMs: 1}
+
+	tests := []struct {
+		name       string
+		tool       protocol.MCPTool
+		failures   int32
+		failStatus int
+		success    bool
+		calls      int32
+	}{
+		{"idempotent tool recovers", protocol.MCPTool{Name: "read", Idempotent: true, Retry: policy}, 2, http.StatusServiceUnavailable, true, 3},
+		{"attempts are bounded", protocol.MCPTool{Name: "read", Idempotent: true, Retry: policy}, 5, http.StatusServiceUnavailable, false, 3},
+		{"non-idempotent tool is not retried", protocol.MCPTool{Name: "write", Retry: policy}, 1, http.StatusServiceUnavailable, false, 1},
+		{"client errors are not retried", protocol.MCPTool{Name: "read", Idempotent: true, Retry: policy}, 1, http.StatusBadRequest, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			server := flakyMCPServer(t, tt.failures, tt.failStatus, &calls)
+
+			broker := NewBroker()
+			broker.mcpRegistry.RegisterAgent("flaky-agent", &MCPAgent{
+				ID:            "flaky-agent",
+				MCPEndpoint:   server.URL,
+				Tools:         []protocol.MCPTool{tt.tool},
+				LastHeartbeat: time.Now(),
+			})
+
+			env := &protocol.GenericEnvelope{
+				BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall},
+			}
+			env.Agent = "caller-agent"
+			env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: tt.tool.Name})
+
+			recorder := newBufferedResponse()
+			broker.handleToolCall(recorder, env)
+
+			var result protocol.ToolResultEnvelope
+			if err := json.Unmarshal(recorder.body.Bytes(), &result); err != nil {
+				t.Fatalf("Failed to decode tool result: %v", err)
+			}
+			if result.Body.Success != tt.success {
+				t.Errorf("Expected success=%v, got %v (%s)", tt.success, result.Body.Success, result.Body.Error)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.calls {
+				t.Errorf("Expected %d deliveries, got %d", tt.calls, got)
+			}
+		})
+	}
+
+	if err := validateTools([]protocol.MCPTool{{Name: "bad", Retry: &protocol.RetryPolicy{MaxAttempts: 100}}}); err == nil {
+		t.Error("Expected out-of-range retry policy to be rejected")
+	}
+}
+
+func TestMCPClientRetriesWithToolPolicy(t *testing.T) {
+	// Broker stand-in that is unavailable once, then returns a tool result
+	var calls int32
+	var requestIDs, nonces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env protocol.ToolCallEnvelope
+		json.NewDecoder(r.Body).Decode(&env)
+		requestIDs = append(requestIDs, env.Body.RequestID)
+		nonces = append(nonces, env.Nonce)
+
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type": protocol.EnvelopeToolResult,
+			"body": map[string]interface{}{"requestId": env.Body.RequestID, "success": true, "result": "done"},
+		})
+	}))
+	defer server.Close()
+
+	_, privKey, _ := protocol.GenerateKeyPair()
+	client := NewMCPClient(MCPClientConfig{AgentID: "sdk-agent", BrokerURL: server.URL, PrivateKey: privKey})
+
+	// Without discovery metadata the call is attempted once
+	if _, err := client.CallTool("worker", "job.status", nil); err == nil {
+		t.Fatal("Expected call without retry policy to fail")
+	}
+
+	client.cacheResult("discovered", []protocol.DiscoveredTool{{
+		AgentID: "worker",
+		MCPTools: []protocol.MCPTool{{
+			Name:       "job.status",
+			Idempotent: true,
+			Retry:      &protocol.RetryPolicy{MaxAttempts: 2, InitialBackoffMs: 1},
+		}},
+	}})
+
+	atomic.StoreInt32(&calls, 0)
+	requestIDs, nonces = nil, nil
+	result, err := client.CallTool("worker", "job.status", nil)
+	if err != nil || result != "done" {
+		t.Fatalf("Expected retried call to succeed, got %v (%v)", result, err)
+	}
+	if len(requestIDs) != 2 || requestIDs[0] != requestIDs[1] {
+		t.Errorf("Expected both attempts to share a request ID, got %v", requestIDs)
+	}
+	if nonces[0] == nonces[1] {
+		t.Error("Expected each attempt to carry a fresh nonce")
+	}
+}
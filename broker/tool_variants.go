@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fep-fem/protocol"
+)
+
+// negotiateVariant picks the variant of a tool to call it in: the first
+// the tool offers, in its order of preference, that the caller speaks. A
+// call naming no variants, or a tool offering none, is not negotiated.
+func negotiateVariant(tool protocol.MCPTool, speaks []string) (string, bool) {
+	for _, variant := range tool.Variants {
+		for _, name := range speaks {
+			if variant.Name == name {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// variantProviders returns the providers a call naming variants may go to:
+// those sharing a variant with the caller, or failing that those offering
+// no variants, which take calls as they come. While a tool's providers are
+// upgraded one at a time, callers of a new variant reach the upgraded ones.
+func variantProviders(providers []*RegisteredTool, speaks []string) []*RegisteredTool {
+	if len(speaks) == 0 {
+		return providers
+	}
+	var matched, plain []*RegisteredTool
+	for _, provider := range providers {
+		if _, ok := negotiateVariant(provider.Tool, speaks); ok {
+			matched = append(matched, provider)
+		} else if len(provider.Tool.Variants) == 0 {
+			plain = append(plain, provider)
+		}
+	}
+	if len(matched) > 0 {
+		return matched
+	}
+	return plain
+}
+
+// validateVariants checks that a tool's variants are named, each once
+func validateVariants(tool protocol.MCPTool) error {
+	seen := make(map[string]bool, len(tool.Variants))
+	for _, variant := range tool.Variants {
+		if variant.Name == "" {
+			return fmt.Errorf("tool %s has a variant without a name", tool.Name)
+		}
+		if seen[variant.Name] {
+			return fmt.Errorf("tool %s has variant %s more than once", tool.Name, variant.Name)
+		}
+		seen[variant.Name] = true
+	}
+	return nil
+}
+
+// VariantStats is the outcome of the variant negotiations for one tool
+type VariantStats struct {
+	Selected map[string]int    `json:"selected,omitempty"` // Calls made in each variant
+	Failed   int               `json:"failed,omitempty"`   // Calls refused for sharing no variant with the tool
+	Callers  map[string]string `json:"callers,omitempty"`  // The variant each caller last called the tool in
+}
+
+// VariantNegotiations records which variants callers and tools agreed on,
+// so operators can tell when an old variant is no longer used
+type VariantNegotiations struct {
+	tools map[string]*VariantStats // By toolKey
+	mu    sync.Mutex
+}
+
+// NewVariantNegotiations creates an empty negotiation record
+func NewVariantNegotiations() *VariantNegotiations {
+	return &VariantNegotiations{tools: make(map[string]*VariantStats)}
+}
+
+// stats returns a tool's record, creating it. The caller holds the lock.
+func (v *VariantNegotiations) stats(agentID, tool string) *VariantStats {
+	key := toolKey(agentID, tool)
+	stats, exists := v.tools[key]
+	if !exists {
+		stats = &VariantStats{Selected: make(map[string]int), Callers: make(map[string]string)}
+		v.tools[key] = stats
+	}
+	return stats
+}
+
+// RecordSelected records a call to a tool made in variant
+func (v *VariantNegotiations) RecordSelected(agentID, tool, caller, variant string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stats := v.stats(agentID, tool)
+	stats.Selected[variant]++
+	stats.Callers[caller] = variant
+}
+
+// RecordFailed records a call refused for sharing no variant with a tool
+func (v *VariantNegotiations) RecordFailed(agentID, tool string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.stats(agentID, tool).Failed++
+}
+
+// Stats returns a copy of a tool's record, if it has one
+func (v *VariantNegotiations) Stats(agentID, tool string) (VariantStats, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stats, exists := v.tools[toolKey(agentID, tool)]
+	if !exists {
+		return VariantStats{}, false
+	}
+	copied := VariantStats{Failed: stats.Failed, Selected: make(map[string]int), Callers: make(map[string]string)}
+	for variant, calls := range stats.Selected {
+		copied.Selected[variant] = calls
+	}
+	for caller, variant := range stats.Callers {
+		copied.Callers[caller] = variant
+	}
+	return copied, true
+}
+
+// writeNoCommonVariant refuses a tool call with 406 and a broker-signed
+// toolResult whose details list the variants offered and requested
+func (b *Broker) writeNoCommonVariant(w http.ResponseWriter, caller string, body protocol.ToolCallBody, providers []*RegisteredTool) {
+	var offered []string
+	seen := make(map[string]bool)
+	for _, provider := range providers {
+		b.variants.RecordFailed(provider.AgentID, provider.Tool.Name)
+		for _, variant := range provider.Tool.Variants {
+			if !seen[variant.Name] {
+				seen[variant.Name] = true
+				offered = append(offered, variant.Name)
+			}
+		}
+	}
+
+	slog.Warn("Tool call shares no variant with the tool", "tool", body.Tool, "caller", caller, "offered", offered, "requested", body.Variants)
+	b.writeToolResultStatus(w, http.StatusNotAcceptable, protocol.ToolResultBody{
+		RequestID: body.RequestID,
+		Error:     fmt.Sprintf("Tool %s offers none of the variants %s", body.Tool, strings.Join(body.Variants, ", ")),
+		Code:      protocol.ErrorNoCommonVariant,
+		Details: map[string]interface{}{
+			"caller":    caller,
+			"tool":      body.Tool,
+			"offered":   offered,
+			"requested": body.Variants,
+		},
+	})
+}
+
+// handleVariantStats serves GET /admin/variants/{agent}/{tool}, the
+// outcome of the variant negotiations for a tool
+func (b *Broker) handleVariantStats(w http.ResponseWriter, r *http.Request) {
+	agentID, tool, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/variants/"), "/")
+	stats, exists := b.variants.Stats(agentID, tool)
+	if !found || !exists {
+		http.Error(w, "Unknown tool", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, stats)
+}
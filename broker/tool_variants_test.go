@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestToolCallNegotiatesVariant(t *testing.T) {
+	// Each agent's endpoint answers with the variant the broker sent it
+	variantServer := func() *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var request struct {
+				Params struct {
+					Meta map[string]string `json:"_meta"`
+				} `json:"params"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"result":  map[string]interface{}{"variant": request.Params.Meta["variant"]},
+				"id":      1,
+			})
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	broker := NewBroker()
+	broker.mcpRegistry.RegisterAgent("new-agent", &MCPAgent{
+		ID:          "new-agent",
+		MCPEndpoint: variantServer().URL,
+		Tools: []protocol.MCPTool{
+			{Name: "search", Variants: []protocol.ToolVariant{{Name: "v2"}, {Name: "v1"}}},
+			{Name: "report", Variants: []protocol.ToolVariant{{Name: "v1"}}},
+		},
+		LastHeartbeat: time.Now(),
+	})
+	broker.mcpRegistry.RegisterAgent("old-agent", &MCPAgent{
+		ID:            "old-agent",
+		MCPEndpoint:   variantServer().URL,
+		Tools:         []protocol.MCPTool{{Name: "search"}},
+		LastHeartbeat: time.Now(),
+	})
+
+	call := func(tool string, variants ...string) (int, protocol.ToolResultBody) {
+		env := &protocol.GenericEnvelope{BaseEnvelope: protocol.BaseEnvelope{Type: protocol.EnvelopeToolCall}}
+		env.Agent = "caller-agent"
+		env.Body, _ = json.Marshal(protocol.ToolCallBody{Tool: tool, Variants: variants})
+		recorder := newBufferedResponse()
+		broker.handleToolCall(recorder, env)
+		var response protocol.ToolResultEnvelope
+		json.Unmarshal(recorder.body.Bytes(), &response)
+		return recorder.status, response.Body
+	}
+
+	// The tool's preference wins over the caller's order
+	status, result := call("search", "v1", "v2")
+	if status != http.StatusOK || result.Variant != "v2" || result.Result.(map[string]interface{})["variant"] != "v2" {
+		t.Errorf("Expected the call made in v2, got %d %+v", status, result)
+	}
+
+	// A variant no upgraded provider offers goes to one taking any call
+	status, result = call("search", "v3")
+	if status != http.StatusOK || result.Variant != "" || result.Result.(map[string]interface{})["variant"] != "" {
+		t.Errorf("Expected the call made without a variant, got %d %+v", status, result)
+	}
+
+	status, result = call("report", "v3")
+	if status != http.StatusNotAcceptable || result.Code != protocol.ErrorNoCommonVariant {
+		t.Fatalf("Expected the call refused, got %d %+v", status, result)
+	}
+	if offered, _ := result.Details["offered"].([]interface{}); len(offered) != 1 || offered[0] != "v1" {
+		t.Errorf("Expected the offered variants in the details, got %+v", result.Details)
+	}
+
+	if stats, _ := broker.variants.Stats("new-agent", "search"); stats.Selected["v2"] != 1 || stats.Callers["caller-agent"] != "v2" {
+		t.Errorf("Expected the negotiation recorded, got %+v", stats)
+	}
+	if stats, _ := broker.variants.Stats("new-agent", "report"); stats.Failed != 1 {
+		t.Errorf("Expected the failed negotiation recorded, got %+v", stats)
+	}
+}
+
+func TestValidateVariants(t *testing.T) {
+	for name, variants := range map[string][]protocol.ToolVariant{
+		"unnamed":   {{Name: "v1"}, {}},
+		"duplicate": {{Name: "v1"}, {Name: "v1"}},
+	} {
+		if err := validateTools([]protocol.MCPTool{{Name: "search", Variants: variants}}); err == nil {
+			t.Errorf("%s: expected the variants refused", name)
+		}
+	}
+}
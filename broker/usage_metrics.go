@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AgentUsage holds aggregate usage counters for one agent
+type AgentUsage struct {
+	AgentID         string `json:"agentId"`
+	Envelopes       int64  `json:"envelopes"`
+	Errors          int64  `json:"errors"`
+	BytesIn         int64  `json:"bytesIn"`
+	BytesOut        int64  `json:"bytesOut"`
+	ToolCalls       int64  `json:"toolCalls"`
+	ToolCallsServed int64  `json:"toolCallsServed"`
+	ToolFailures    int64  `json:"toolFailures"`
+
+	// TierCalls counts the tool calls the agent made, by service tier
+	TierCalls map[string]int64 `json:"tierCalls,omitempty"`
+}
+
+func (u *AgentUsage) add(other AgentUsage) {
+	u.Envelopes += other.Envelopes
+	u.Errors += other.Errors
+	u.BytesIn += other.BytesIn
+	u.BytesOut += other.BytesOut
+	u.ToolCalls += other.ToolCalls
+	u.ToolCallsServed += other.ToolCallsServed
+	u.ToolFailures += other.ToolFailures
+	for tier, calls := range other.TierCalls {
+		if u.TierCalls == nil {
+			u.TierCalls = make(map[string]int64)
+		}
+		u.TierCalls[tier] += calls
+	}
+}
+
+// UsageSnapshot holds the usage accumulated between Start and End
+type UsageSnapshot struct {
+	Start  time.Time              `json:"start"`
+	End    time.Time              `json:"end"`
+	Agents map[string]*AgentUsage `json:"agents"`
+}
+
+// UsageStore persists usage snapshots
+type UsageStore interface {
+	Append(snapshot UsageSnapshot) error
+	Range(start, end time.Time) ([]UsageSnapshot, error)
+	// Compact merges and drops snapshots as the retention tiers require
+	Compact(tiers RetentionTiers, now time.Time) error
+	// Size returns the number of stored snapshots and the bytes they take
+	Size() (int, int64, error)
+}
+
+// UsageTracker accumulates per-agent usage and periodically writes the
+// accumulated counters to a UsageStore as a snapshot
+type UsageTracker struct {
+	current     map[string]*AgentUsage
+	periodStart time.Time
+	store       UsageStore
+	mu          sync.Mutex
+}
+
+// NewUsageTracker creates a tracker persisting snapshots to store
+func NewUsageTracker(store UsageStore) *UsageTracker {
+	return &UsageTracker{
+		current:     make(map[string]*AgentUsage),
+		periodStart: time.Now().UTC(),
+		store:       store,
+	}
+}
+
+// SetStore replaces the snapshot store
+func (t *UsageTracker) SetStore(store UsageStore) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.store = store
+}
+
+func (t *UsageTracker) agent(agentID string) *AgentUsage {
+	usage, exists := t.current[agentID]
+	if !exists {
+		usage = &AgentUsage{AgentID: agentID}
+		t.current[agentID] = usage
+	}
+	return usage
+}
+
+// RecordEnvelope counts an envelope sent by an agent and the broker's reply
+func (t *UsageTracker) RecordEnvelope(agentID string, bytesIn, bytesOut int, status int) {
+	if agentID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usage := t.agent(agentID)
+	usage.Envelopes++
+	usage.BytesIn += int64(bytesIn)
+	usage.BytesOut += int64(bytesOut)
+	if status < 200 || status >= 300 {
+		usage.Errors++
+	}
+}
+
+// RecordToolCall counts a tool call routed from caller to target, metered
+// under the tool's service tier
+func (t *UsageTracker) RecordToolCall(caller, target, tier string, success bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	calls := t.agent(caller)
+	calls.ToolCalls++
+	if tier != "" {
+		if calls.TierCalls == nil {
+			calls.TierCalls = make(map[string]int64)
+		}
+		calls.TierCalls[tier]++
+	}
+	served := t.agent(target)
+	served.ToolCallsServed++
+	if !success {
+		served.ToolFailures++
+	}
+}
+
+// Snapshot persists the counters accumulated since the previous snapshot
+// and resets them
+func (t *UsageTracker) Snapshot() error {
+	t.mu.Lock()
+	now := time.Now().UTC()
+	snapshot := UsageSnapshot{
+		Start:  t.periodStart,
+		End:    now,
+		Agents: t.current,
+	}
+	t.current = make(map[string]*AgentUsage)
+	t.periodStart = now
+	store := t.store
+	t.mu.Unlock()
+
+	if len(snapshot.Agents) == 0 {
+		return nil
+	}
+	return store.Append(snapshot)
+}
+
+// Run takes a snapshot every interval until stop is closed
+func (t *UsageTracker) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Snapshot(); err != nil {
+				slog.Error("Failed to persist usage snapshot", "error", err)
+			}
+		case <-stop:
+			if err := t.Snapshot(); err != nil {
+				slog.Error("Failed to persist usage snapshot", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// AgentUsageSummary is one agent's usage over a report period
+type AgentUsageSummary struct {
+	AgentUsage
+	ErrorRate       float64 `json:"errorRate"`
+	ToolFailureRate float64 `json:"toolFailureRate"`
+}
+
+// UsageReport summarizes usage over a daily or weekly period
+type UsageReport struct {
+	Period string              `json:"period"`
+	Start  time.Time           `json:"start"`
+	End    time.Time           `json:"end"`
+	Agents []AgentUsageSummary `json:"agents"`
+	Totals AgentUsageSummary   `json:"totals"`
+}
+
+// ReportPeriod returns the UTC bounds of the daily or weekly period
+// containing day. Weeks start on Monday.
+func ReportPeriod(period string, day time.Time) (time.Time, time.Time, error) {
+	day = day.UTC()
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case "daily":
+		return start, start.AddDate(0, 0, 1), nil
+	case "weekly":
+		offset := (int(start.Weekday()) + 6) % 7
+		start = start.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7), nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown report period %q", period)
+	}
+}
+
+// Report builds a usage summary for the period containing day. Snapshots are
+// attributed to the period their end time falls in; counters not yet
+// snapshotted are included when the period covers the present.
+func (t *UsageTracker) Report(period string, day time.Time) (*UsageReport, error) {
+	start, end, err := ReportPeriod(period, day)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	store := t.store
+	t.mu.Unlock()
+
+	snapshots, err := store.Range(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]*AgentUsage)
+	merge := func(agents map[string]*AgentUsage) {
+		for id, usage := range agents {
+			total, exists := totals[id]
+			if !exists {
+				total = &AgentUsage{AgentID: id}
+				totals[id] = total
+			}
+			total.add(*usage)
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		merge(snapshot.Agents)
+	}
+
+	t.mu.Lock()
+	if now := time.Now(); !now.Before(start) && now.Before(end) {
+		merge(t.current)
+	}
+	t.mu.Unlock()
+
+	report := &UsageReport{
+		Period: period,
+		Start:  start,
+		End:    end,
+		Agents: make([]AgentUsageSummary, 0, len(totals)),
+	}
+	for _, usage := range totals {
+		report.Agents = append(report.Agents, summarizeUsage(*usage))
+		report.Totals.add(*usage)
+	}
+	sort.Slice(report.Agents, func(i, j int) bool {
+		return report.Agents[i].AgentID < report.Agents[j].AgentID
+	})
+	report.Totals = summarizeUsage(report.Totals.AgentUsage)
+
+	return report, nil
+}
+
+func summarizeUsage(usage AgentUsage) AgentUsageSummary {
+	summary := AgentUsageSummary{AgentUsage: usage}
+	if usage.Envelopes > 0 {
+		summary.ErrorRate = float64(usage.Errors) / float64(usage.Envelopes)
+	}
+	if usage.ToolCallsServed > 0 {
+		summary.ToolFailureRate = float64(usage.ToolFailures) / float64(usage.ToolCallsServed)
+	}
+	return summary
+}
+
+// handleUsageReport serves GET /admin/reports/usage?period=daily|weekly&date=YYYY-MM-DD
+func (b *Broker) handleUsageReport(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "daily"
+	}
+
+	day := time.Now().UTC()
+	if date := r.URL.Query().Get("date"); date != "" {
+		parsed, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = parsed
+	}
+
+	report, err := b.usage.Report(period, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// usageRetention bounds how long MemoryUsageStore keeps snapshots
+const usageRetention = 35 * 24 * time.Hour
+
+// MemoryUsageStore keeps recent snapshots in memory
+type MemoryUsageStore struct {
+	snapshots []UsageSnapshot
+	mu        sync.RWMutex
+}
+
+// NewMemoryUsageStore creates an in-memory snapshot store
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{}
+}
+
+// Append stores a snapshot and drops snapshots past the retention window
+func (s *MemoryUsageStore) Append(snapshot UsageSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-usageRetention)
+	kept := s.snapshots[:0]
+	for _, existing := range s.snapshots {
+		if existing.End.After(cutoff) {
+			kept = append(kept, existing)
+		}
+	}
+	s.snapshots = append(kept, snapshot)
+	return nil
+}
+
+// Range returns snapshots whose end time falls within [start, end)
+func (s *MemoryUsageStore) Range(start, end time.Time) ([]UsageSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matches []UsageSnapshot
+	for _, snapshot := range s.snapshots {
+		if !snapshot.End.Before(start) && snapshot.End.Before(end) {
+			matches = append(matches, snapshot)
+		}
+	}
+	return matches, nil
+}
+
+// FileUsageStore appends snapshots to a newline-delimited JSON file
+type FileUsageStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileUsageStore creates a snapshot store backed by the file at path
+func NewFileUsageStore(path string) *FileUsageStore {
+	return &FileUsageStore{path: path}
+}
+
+// Append writes a snapshot as one JSON line
+func (s *FileUsageStore) Append(snapshot UsageSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Range returns snapshots whose end time falls within [start, end)
+func (s *FileUsageStore) Range(start, end time.Time) ([]UsageSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []UsageSnapshot
+	for _, snapshot := range snapshots {
+		if !snapshot.End.Before(start) && snapshot.End.Before(end) {
+			matches = append(matches, snapshot)
+		}
+	}
+	return matches, nil
+}
+
+// load reads every snapshot in the file. Caller must hold the lock.
+func (s *FileUsageStore) load() ([]UsageSnapshot, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var snapshots []UsageSnapshot
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var snapshot UsageSnapshot
+		if err := json.Unmarshal(scanner.Bytes(), &snapshot); err != nil {
+			return nil, fmt.Errorf("corrupt usage snapshot in %s: %w", s.path, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, scanner.Err()
+}
+
+// countingResponseWriter records the status and size of a response
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += n
+	return n, err
+}
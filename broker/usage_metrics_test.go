@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestReportPeriod(t *testing.T) {
+	// 2025-06-11 was a Wednesday
+	day := time.Date(2025, 6, 11, 15, 30, 0, 0, time.UTC)
+
+	start, end, err := ReportPeriod("daily", day)
+	if err != nil {
+		t.Fatalf("Failed to compute daily period: %v", err)
+	}
+	if !start.Equal(time.Date(2025, 6, 11, 0, 0, 0, 0, time.UTC)) || !end.Equal(start.AddDate(0, 0, 1)) {
+		t.Errorf("Unexpected daily period: %v - %v", start, end)
+	}
+
+	start, end, err = ReportPeriod("weekly", day)
+	if err != nil {
+		t.Fatalf("Failed to compute weekly period: %v", err)
+	}
+	if !start.Equal(time.Date(2025, 6, 9, 0, 0, 0, 0, time.UTC)) || !end.Equal(start.AddDate(0, 0, 7)) {
+		t.Errorf("Unexpected weekly period: %v - %v", start, end)
+	}
+
+	if _, _, err := ReportPeriod("hourly", day); err == nil {
+		t.Error("Expected error for unknown period")
+	}
+}
+
+func TestUsageTrackerSnapshotsAndReport(t *testing.T) {
+	store := NewFileUsageStore(filepath.Join(t.TempDir(), "usage.jsonl"))
+	tracker := NewUsageTracker(store)
+
+	tracker.RecordEnvelope("agent-a", 100, 50, http.StatusOK)
+	tracker.RecordEnvelope("agent-a", 200, 20, http.StatusBadRequest)
+	tracker.RecordToolCall("agent-a", "agent-b", TierPremium, true)
+	tracker.RecordToolCall("agent-a", "agent-b", TierPremium, false)
+
+	if err := tracker.Snapshot(); err != nil {
+		t.Fatalf("Failed to persist snapshot: %v", err)
+	}
+
+	// Counters recorded after the snapshot are still reported
+	tracker.RecordEnvelope("agent-b", 10, 10, http.StatusOK)
+
+	// Snapshots survive a restart through the file store
+	reopened := NewUsageTracker(NewFileUsageStore(store.path))
+	snapshots, err := reopened.store.Range(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to read snapshots: %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("Expected 1 persisted snapshot, got %d", len(snapshots))
+	}
+
+	report, err := tracker.Report("daily", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+
+	if len(report.Agents) != 2 {
+		t.Fatalf("Expected 2 agents in report, got %d", len(report.Agents))
+	}
+
+	a := report.Agents[0]
+	if a.AgentID != "agent-a" || a.Envelopes != 2 || a.Errors != 1 || a.BytesIn != 300 || a.BytesOut != 70 || a.ToolCalls != 2 {
+		t.Errorf("Unexpected usage for agent-a: %+v", a)
+	}
+	if a.TierCalls[TierPremium] != 2 || report.Totals.TierCalls[TierPremium] != 2 {
+		t.Errorf("Expected tool calls metered under their tier, got %v", a.TierCalls)
+	}
+	if a.ErrorRate != 0.5 {
+		t.Errorf("Expected error rate 0.5, got %v", a.ErrorRate)
+	}
+
+	b := report.Agents[1]
+	if b.AgentID != "agent-b" || b.Envelopes != 1 || b.ToolCallsServed != 2 || b.ToolFailureRate != 0.5 {
+		t.Errorf("Unexpected usage for agent-b: %+v", b)
+	}
+
+	if report.Totals.Envelopes != 3 || report.Totals.BytesIn != 310 {
+		t.Errorf("Unexpected totals: %+v", report.Totals)
+	}
+
+	// A past period has no usage
+	report, err = tracker.Report("weekly", time.Now().AddDate(0, 0, -14))
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+	if len(report.Agents) != 0 {
+		t.Errorf("Expected empty report for past week, got %d agents", len(report.Agents))
+	}
+}
+
+func TestBrokerUsageReportEndpoint(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	env := protocol.NewEnvelope(protocol.EnvelopeEmitEvent, "reporting-agent")
+	env.Body = json.RawMessage(`{"event":"sensor.temperature"}`)
+	data, _ := json.Marshal(env)
+
+	resp, err := client.Post(server.URL+"/", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to send envelope: %v", err)
+	}
+	resp.Body.Close()
+
+	// Usage is only reported to operators
+	resp, err = client.Get(server.URL + "/admin/reports/usage?period=weekly")
+	if err != nil {
+		t.Fatalf("Failed to fetch report: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without the admin token, got %d", resp.StatusCode)
+	}
+
+	client = adminClient(broker, server)
+	resp, err = client.Get(server.URL + "/admin/reports/usage?period=weekly")
+	if err != nil {
+		t.Fatalf("Failed to fetch report: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var report UsageReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+
+	if report.Period != "weekly" || len(report.Agents) != 1 || report.Agents[0].AgentID != "reporting-agent" {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if report.Agents[0].Envelopes != 1 || report.Agents[0].BytesIn != int64(len(data)) || report.Agents[0].BytesOut == 0 {
+		t.Errorf("Unexpected usage: %+v", report.Agents[0])
+	}
+
+	resp, err = client.Get(server.URL + "/admin/reports/usage?date=yesterday")
+	if err != nil {
+		t.Fatalf("Failed to fetch report: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid date, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout   = 10 * time.Second
+	wsPongTimeout    = 60 * time.Second
+	wsPingInterval   = 25 * time.Second
+	wsMaxMessageSize = protocol.MaxEnvelopeSize
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Agents are not browsers; identity is established by envelope signatures
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WSReply answers an envelope received over a WebSocket. Frames pushed by
+// the broker are plain envelopes; replies are distinguished by replyTo,
+// which carries the nonce of the envelope being answered. A failure's
+// error envelope is its response, with the message repeated in error.
+type WSReply struct {
+	ReplyTo  string          `json:"replyTo"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// wsConn is one agent's WebSocket connection. The connection is bound to
+// the agent and key of the first envelope it carries.
+type wsConn struct {
+	conn    *websocket.Conn
+	agentID string
+	pubKey  protocol.PublicKey
+	session string // Issued once an envelope's signature has been verified
+	binary  bool   // frames are MessagePack rather than JSON
+	writeMu sync.Mutex
+}
+
+// write sends a JSON document as a frame in the connection's codec
+func (c *wsConn) write(data []byte) error {
+	messageType := websocket.TextMessage
+	if c.binary {
+		packed, err := protocol.JSONToMsgPack(data)
+		if err != nil {
+			return err
+		}
+		data = packed
+		messageType = websocket.BinaryMessage
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *wsConn) reply(reply WSReply) error {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return c.write(data)
+}
+
+func (c *wsConn) agent() string {
+	return c.agentID
+}
+
+func (c *wsConn) close() {
+	c.conn.Close()
+}
+
+// handleWebSocket upgrades GET /ws to a persistent bidirectional envelope
+// stream. Text frames carry JSON envelopes, binary frames MessagePack.
+func (b *Broker) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+
+	c := &wsConn{conn: conn}
+	clientCert := clientCertificate(r)
+	bearer := bearerToken(r)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		b.sessions.Revoke(c.session)
+		if c.agentID != "" {
+			if b.hub.remove(c) {
+				b.closeAgentStreams(c.agentID)
+			}
+			slog.Info("WebSocket connection closed", "agent", c.agentID)
+		}
+		conn.Close()
+	}()
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	go c.keepAlive(done)
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		codec := protocol.JSONCodec
+		if messageType == websocket.BinaryMessage {
+			codec = protocol.MsgPackCodec
+		}
+
+		envelope, err := protocol.ParseEnvelopeWithCodec(data, codec)
+		if err != nil {
+			b.replyWSError(c, nil, http.StatusBadRequest, protocol.ErrorInvalidEnvelope, fmt.Sprintf("Invalid envelope: %v", err))
+			continue
+		}
+		envelope.RemoteAddr = c.conn.RemoteAddr().String()
+		envelope.ClientCert = clientCert
+		envelope.Bearer = bearer
+
+		if c.agentID == "" {
+			c.binary = messageType == websocket.BinaryMessage
+			if err := b.bindWSIdentity(c, envelope); err != nil {
+				b.replyWSError(c, envelope, http.StatusUnauthorized, protocol.ErrorUnauthorized, err.Error())
+				return
+			}
+		}
+
+		if envelope.Agent != c.agentID {
+			b.replyWSError(c, envelope, http.StatusForbidden, protocol.ErrorForbidden, "envelope agent does not match connection identity")
+			continue
+		}
+
+		// Once one envelope has been verified, the connection's session
+		// vouches for the rest until it expires or is revoked
+		now := time.Now()
+		if !b.sessions.Valid(c.session, c.agentID, envelope.RemoteAddr, now) {
+			if err := envelope.VerifyKey(c.pubKey); err != nil {
+				b.replyWSError(c, envelope, http.StatusUnauthorized, protocol.ErrorInvalidSignature, err.Error())
+				continue
+			}
+			c.session, _ = b.sessions.Issue(c.agentID, envelope.RemoteAddr, now)
+		}
+		envelope.Session = c.session
+
+		// Tool calls block until the result arrives, which may itself
+		// come in over this connection
+		if envelope.Type == protocol.EnvelopeToolCall {
+			go b.dispatchWS(c, envelope, len(data))
+		} else {
+			b.dispatchWS(c, envelope, len(data))
+		}
+	}
+}
+
+// keepAlive pings the peer until done is closed
+func (c *wsConn) keepAlive(done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// WriteControl may be called concurrently with other writes
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// bindWSIdentity ties a connection to the agent of its first envelope. The
+// agent's registered key is used, or for a registerAgent envelope the key
+// it registers.
+func (b *Broker) bindWSIdentity(c *wsConn, envelope *protocol.GenericEnvelope) error {
+	b.mu.RLock()
+	agent, registered := b.agents[envelope.Agent]
+	b.mu.RUnlock()
+
+	var pubKey protocol.PublicKey
+	if registered && agent.PubKey != nil {
+		pubKey = agent.PubKey
+	} else if envelope.Type == protocol.EnvelopeRegisterAgent {
+		var body protocol.RegisterAgentBody
+		if err := envelope.GetBodyAs(&body); err == nil {
+			pubKey, _ = protocol.ParsePublicKey(body.PubKey)
+		}
+	}
+	if pubKey == nil {
+		return fmt.Errorf("no public key known for agent %s; register first", envelope.Agent)
+	}
+
+	c.agentID = envelope.Agent
+	c.pubKey = pubKey
+	if previous := b.hub.add(c); previous != nil {
+		previous.close()
+	}
+
+	slog.Info("WebSocket connection bound", "agent", c.agentID)
+	go b.broadcasts.Deliver(c.agentID)
+	go b.outbox.Deliver(c.agentID)
+	return nil
+}
+
+// dispatchWS dispatches an envelope received over a WebSocket and sends the
+// handler's response back as a reply frame
+func (b *Broker) dispatchWS(c *wsConn, envelope *protocol.GenericEnvelope, size int) {
+	recorder := newBufferedResponse()
+	b.dispatchEnvelope(recorder, envelope)
+	b.recordEnvelope(envelope, size, recorder.body.Len(), recorder.status)
+
+	reply := WSReply{ReplyTo: envelope.Nonce, Status: recorder.status}
+	reply.Response, reply.Error = splitReply(recorder.status, recorder.body.Bytes())
+
+	if err := c.reply(reply); err != nil {
+		slog.Warn("Failed to send WebSocket reply", "agent", c.agentID, "error", err)
+	}
+}
+
+// replyWSError answers an envelope the connection refused before dispatch
+// with an error envelope
+func (b *Broker) replyWSError(c *wsConn, envelope *protocol.GenericEnvelope, status int, code, message string) {
+	recorder := newBufferedResponse()
+	b.replyError(recorder, envelope, status, code, message)
+
+	reply := WSReply{Status: status}
+	if envelope != nil {
+		reply.ReplyTo = envelope.Nonce
+	}
+	reply.Response, reply.Error = splitReply(status, recorder.body.Bytes())
+	if err := c.reply(reply); err != nil {
+		slog.Warn("Failed to send WebSocket reply", "agent", c.agentID, "error", err)
+	}
+}
+
+// pushToolCall forwards a tool call to an agent holding a connection; the
+// agent answers with a toolResult envelope for the request ID, or with
+// toolResultChunk envelopes if the result is sent in pieces. Agents that
+// ack get the call again until they ack it or the caller stops waiting.
+func (b *Broker) pushToolCall(agentID, tool string, body protocol.ToolCallBody) error {
+	call := &protocol.ToolCallEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{
+			Type: protocol.EnvelopeToolCall,
+			CommonHeaders: protocol.CommonHeaders{
+				Agent: b.id,
+				TS:    time.Now().UnixMilli(),
+				Nonce: protocol.NewNonce(),
+			},
+		},
+		Body: protocol.ToolCallBody{
+			Tool:         tool,
+			Parameters:   body.Parameters,
+			RequestID:    body.RequestID,
+			Priority:     body.Priority,
+			StreamResult: body.StreamResult,
+			Deadline:     body.Deadline,
+			Variant:      body.Variant,
+			Enc:          body.Enc,
+			Receipt:      body.Receipt,
+		},
+	}
+	if err := call.Sign(b.privateKey); err != nil {
+		return err
+	}
+	expires := time.Now().Add(b.pending.Timeout())
+	if deadline := time.UnixMilli(body.Deadline); body.Deadline > 0 && deadline.Before(expires) {
+		expires = deadline
+	}
+	return b.outbox.SendBefore(agentID, call, expires)
+}
+
+// announceTools pushes an agent's current tools to every other connected
+// agent as a toolsDiscovered envelope, limited to the tools each recipient
+// is allowed to discover
+func (b *Broker) announceTools(agentID string) {
+	agent, exists := b.mcpRegistry.GetAgent(agentID)
+	if !exists {
+		return
+	}
+
+	for _, recipient := range b.hub.ConnectedAgents() {
+		if recipient == agentID {
+			continue
+		}
+
+		var tools []protocol.MCPTool
+		for _, tool := range agent.Tools {
+			if tool.DiscoverableBy(recipient) {
+				tool.AllowedAgents = nil
+				tools = append(tools, tool)
+			}
+		}
+		if len(tools) == 0 {
+			continue
+		}
+
+		update := &protocol.ToolsDiscoveredEnvelope{
+			BaseEnvelope: protocol.BaseEnvelope{
+				Type: protocol.EnvelopeToolsDiscovered,
+				CommonHeaders: protocol.CommonHeaders{
+					Agent: b.id,
+					TS:    time.Now().UnixMilli(),
+					Nonce: protocol.NewNonce(),
+				},
+			},
+			Body: protocol.ToolsDiscoveredBody{
+				Tools: []protocol.DiscoveredTool{{
+					AgentID:         agent.ID,
+					MCPEndpoint:     b.mcpRegistry.ListedEndpoint(agent),
+					Capabilities:    b.mcpRegistry.extractCapabilities(tools),
+					EnvironmentType: agent.EnvironmentType,
+					MCPTools:        tools,
+					ProxiedBy:       agent.DiscoveryProxy,
+				}},
+				TotalResults: 1,
+			},
+		}
+		if err := update.Sign(b.privateKey); err != nil {
+			slog.Error("Failed to sign discovery update", "error", err)
+			return
+		}
+
+		if err := b.hub.Send(recipient, update); err != nil {
+			slog.Warn("Failed to push discovery update", "agent", recipient, "error", err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// wsTestAgent is a minimal agent holding a broker WebSocket
+type wsTestAgent struct {
+	t       *testing.T
+	id      string
+	pubKey  ed25519.PublicKey
+	privKey ed25519.PrivateKey
+	conn    *websocket.Conn
+}
+
+func dialTestAgent(t *testing.T, server *httptest.Server, id string) *wsTestAgent {
+	t.Helper()
+
+	pubKey, privKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	url := "wss" + strings.TrimPrefix(server.URL, "https") + "/ws"
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &wsTestAgent{t: t, id: id, pubKey: pubKey, privKey: privKey, conn: conn}
+}
+
+// send signs and sends an envelope, returning its nonce
+func (a *wsTestAgent) send(agent string, envType protocol.EnvelopeType, body interface{}) string {
+	a.t.Helper()
+
+	env := protocol.NewEnvelope(envType, agent)
+	raw, err := json.Marshal(body)
+	if err != nil {
+		a.t.Fatalf("Failed to marshal body: %v", err)
+	}
+	env.Body = raw
+	if err := env.Sign(a.privKey); err != nil {
+		a.t.Fatalf("Failed to sign envelope: %v", err)
+	}
+
+	if err := a.conn.WriteJSON(env); err != nil {
+		a.t.Fatalf("Failed to send envelope: %v", err)
+	}
+	return env.Nonce
+}
+
+// next reads frames until one satisfies match
+func (a *wsTestAgent) next(match func(frame map[string]interface{}) bool) map[string]interface{} {
+	a.t.Helper()
+
+	a.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame map[string]interface{}
+		if err := a.conn.ReadJSON(&frame); err != nil {
+			a.t.Fatalf("Failed to read frame for %s: %v", a.id, err)
+		}
+		if match(frame) {
+			return frame
+		}
+	}
+}
+
+func (a *wsTestAgent) reply(nonce string) map[string]interface{} {
+	a.t.Helper()
+	return a.next(func(frame map[string]interface{}) bool { return frame["replyTo"] == nonce })
+}
+
+func (a *wsTestAgent) pushed(envType protocol.EnvelopeType) map[string]interface{} {
+	a.t.Helper()
+	return a.next(func(frame map[string]interface{}) bool { return frame["type"] == string(envType) })
+}
+
+func (a *wsTestAgent) register(tools ...protocol.MCPTool) {
+	a.t.Helper()
+
+	body := protocol.RegisterAgentBody{
+		PubKey:       protocol.EncodePublicKey(a.pubKey),
+		Capabilities: []string{"test"},
+	}
+	if len(tools) > 0 {
+		body.BodyDefinition = &protocol.BodyDefinition{Name: a.id, MCPTools: tools}
+	}
+
+	nonce := a.send(a.id, protocol.EnvelopeRegisterAgent, body)
+	if reply := a.reply(nonce); reply["status"] != float64(http.StatusOK) {
+		a.t.Fatalf("Registration of %s failed: %v", a.id, reply)
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	caller := dialTestAgent(t, server, "ws-caller")
+	caller.register()
+
+	worker := dialTestAgent(t, server, "ws-worker")
+	worker.register(protocol.MCPTool{Name: "job.run", Description: "Run a job"})
+
+	// The caller is told about the worker's tools
+	update := caller.pushed(protocol.EnvelopeToolsDiscovered)
+	tools := update["body"].(map[string]interface{})["tools"].([]interface{})
+	if tools[0].(map[string]interface{})["agentId"] != "ws-worker" {
+		t.Errorf("Unexpected discovery update: %v", update)
+	}
+
+	if broker.hub.GetConnectionCount() != 2 {
+		t.Errorf("Expected 2 connections, got %d", broker.hub.GetConnectionCount())
+	}
+
+	// Events are pushed to subscribers without an HTTP endpoint
+	nonce := caller.send("ws-caller", protocol.EnvelopeSubscribe, protocol.SubscribeBody{Events: []string{"job.*"}})
+	if reply := caller.reply(nonce); reply["status"] != float64(http.StatusOK) {
+		t.Fatalf("Subscribe failed: %v", reply)
+	}
+
+	nonce = worker.send("ws-worker", protocol.EnvelopeEmitEvent, protocol.EmitEventBody{Event: "job.started"})
+	if reply := worker.reply(nonce); reply["status"] != float64(http.StatusOK) {
+		t.Fatalf("Emit failed: %v", reply)
+	}
+
+	event := caller.pushed(protocol.EnvelopeEmitEvent)
+	if event["agent"] != "ws-worker" {
+		t.Errorf("Unexpected event sender: %v", event["agent"])
+	}
+
+	// Tool calls are pushed to the worker and its result returned to the caller
+	callNonce := caller.send("ws-caller", protocol.EnvelopeToolCall, protocol.ToolCallBody{
+		Tool:       "job.run",
+		Parameters: map[string]interface{}{"job": "build"},
+		RequestID:  "ws-req-1",
+	})
+
+	call := worker.pushed(protocol.EnvelopeToolCall)
+	callBody := call["body"].(map[string]interface{})
+	if callBody["tool"] != "job.run" || callBody["requestId"] != "ws-req-1" {
+		t.Fatalf("Unexpected pushed tool call: %v", callBody)
+	}
+
+	nonce = worker.send("ws-worker", protocol.EnvelopeToolResult, protocol.ToolResultBody{
+		RequestID: "ws-req-1",
+		Success:   true,
+		Result:    "built",
+	})
+	if reply := worker.reply(nonce); reply["status"] != float64(http.StatusOK) {
+		t.Fatalf("Tool result was not delivered: %v", reply)
+	}
+
+	reply := caller.reply(callNonce)
+	result := reply["response"].(map[string]interface{})
+	resultBody := result["body"].(map[string]interface{})
+	if result["type"] != "toolResult" || resultBody["success"] != true || resultBody["result"] != "built" {
+		t.Errorf("Unexpected tool result: %v", result)
+	}
+
+	// Envelopes for another agent are rejected on a bound connection
+	nonce = caller.send("ws-worker", protocol.EnvelopeEmitEvent, protocol.EmitEventBody{Event: "job.spoofed"})
+	if reply := caller.reply(nonce); reply["status"] != float64(http.StatusForbidden) {
+		t.Errorf("Expected spoofed envelope to be rejected, got %v", reply)
+	}
+}
+
+func TestWebSocketRequiresKnownKey(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewTLSServer(broker)
+	defer server.Close()
+
+	stranger := dialTestAgent(t, server, "ws-stranger")
+	nonce := stranger.send("ws-stranger", protocol.EnvelopeEmitEvent, protocol.EmitEventBody{Event: "hello"})
+	if reply := stranger.reply(nonce); reply["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("Expected unknown agent to be rejected, got %v", reply)
+	}
+
+	// A registered agent's envelopes must carry its registered signature
+	agent := dialTestAgent(t, server, "ws-agent")
+	agent.register()
+
+	_, otherKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	agent.privKey = otherKey
+	nonce = agent.send("ws-agent", protocol.EnvelopeEmitEvent, protocol.EmitEventBody{Event: "hello"})
+	if reply := agent.reply(nonce); reply["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("Expected bad signature to be rejected, got %v", reply)
+	}
+}
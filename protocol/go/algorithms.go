@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// Signature algorithms, named as in JOSE (RFC 7518). Envelopes carry theirs
+// in the alg header; an envelope without one is signed with Ed25519.
+const (
+	AlgEdDSA = "EdDSA" // Ed25519
+	AlgES256 = "ES256" // ECDSA over P-256 with SHA-256, signature r||s
+	AlgPS256 = "PS256" // RSA-PSS with SHA-256 and a 32-byte salt
+)
+
+// minRSABits is the smallest RSA key accepted for PS256
+const minRSABits = 2048
+
+// PublicKey is a key signatures are verified with: an ed25519.PublicKey, an
+// *ecdsa.PublicKey on P-256 or an *rsa.PublicKey, each of which has Equal
+type PublicKey interface {
+	Equal(crypto.PublicKey) bool
+}
+
+// KeyAlgorithm returns the algorithm signatures by key are made with
+func KeyAlgorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		if len(k) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("invalid public key size: got %d, want %d", len(k), ed25519.PublicKeySize)
+		}
+		return AlgEdDSA, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return AlgES256, nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+	case *rsa.PublicKey:
+		if k.N.BitLen() >= minRSABits {
+			return AlgPS256, nil
+		}
+		return "", fmt.Errorf("RSA key of %d bits is shorter than %d", k.N.BitLen(), minRSABits)
+	}
+	return "", fmt.Errorf("unsupported public key %T", key)
+}
+
+// FormatPublicKey encodes a public key for the pubkey field of a
+// registration: an Ed25519 key as its 32 bytes in base64, as
+// EncodePublicKey does, and other keys as base64 PKIX (SubjectPublicKeyInfo)
+func FormatPublicKey(key PublicKey) (string, error) {
+	if _, err := KeyAlgorithm(key); err != nil {
+		return "", err
+	}
+	if edKey, ok := key.(ed25519.PublicKey); ok {
+		return EncodePublicKey(edKey), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParsePublicKey decodes a public key encoded by FormatPublicKey, refusing
+// keys of an algorithm FEM does not support
+func ParsePublicKey(encoded string) (PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+	if len(data) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(data), nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	key, ok := parsed.(PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key %T", parsed)
+	}
+	if _, err := KeyAlgorithm(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// signerAlgorithm returns the algorithm signer signs with
+func signerAlgorithm(signer Signer) (string, error) {
+	if noSigner(signer) {
+		return "", fmt.Errorf("%w: signing key", ErrMissingField)
+	}
+	return KeyAlgorithm(signer.Public())
+}
+
+// signMessage signs message with signer by the algorithm of its key, and
+// checks the signature before returning it
+func signMessage(signer Signer, message []byte) ([]byte, error) {
+	alg, err := signerAlgorithm(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var signature []byte
+	switch alg {
+	case AlgEdDSA:
+		signature, err = signer.Sign(rand.Reader, message, crypto.Hash(0))
+	case AlgES256:
+		digest := sha256.Sum256(message)
+		if signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+			signature, err = ecdsaRawSignature(signature)
+		}
+	case AlgPS256:
+		digest := sha256.Sum256(message)
+		signature, err = signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing failed: %w", err)
+	}
+	if err := VerifySignature(signer.Public(), message, signature); err != nil {
+		return nil, fmt.Errorf("signer returned a bad signature: %w", err)
+	}
+	return signature, nil
+}
+
+// VerifySignature checks a signature of message by publicKey, under the
+// algorithm of the key, and fails with ErrBadSignature if it does not hold
+func VerifySignature(publicKey crypto.PublicKey, message, signature []byte) error {
+	alg, err := KeyAlgorithm(publicKey)
+	if err != nil {
+		return err
+	}
+
+	verified := false
+	switch alg {
+	case AlgEdDSA:
+		verified = ed25519.Verify(publicKey.(ed25519.PublicKey), message, signature)
+	case AlgES256:
+		if len(signature) == 64 {
+			digest := sha256.Sum256(message)
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			verified = ecdsa.Verify(publicKey.(*ecdsa.PublicKey), digest[:], r, s)
+		}
+	case AlgPS256:
+		digest := sha256.Sum256(message)
+		verified = rsa.VerifyPSS(publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}
+	if !verified {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ecdsaRawSignature converts an ASN.1 ECDSA signature, as crypto.Signer
+// returns, to the fixed-size r||s form of JOSE
+func ecdsaRawSignature(der []byte) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil || sig.R.BitLen() > 256 || sig.S.BitLen() > 256 {
+		return nil, fmt.Errorf("invalid ECDSA signature")
+	}
+	raw := make([]byte, 64)
+	sig.R.FillBytes(raw[:32])
+	sig.S.FillBytes(raw[32:])
+	return raw, nil
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSignatureAlgorithms(t *testing.T) {
+	_, edKey, _ := GenerateKeyPair()
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	for alg, signer := range map[string]Signer{AlgEdDSA: edKey, AlgES256: ecKey, AlgPS256: rsaKey} {
+		pub, err := SignerPublicKey(signer)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		ping := NewPing("sensor", "hello")
+		if err := SignEnvelope(ping, signer); err != nil {
+			t.Fatalf("%s: SignEnvelope failed: %v", alg, err)
+		}
+		if want := map[bool]string{true: "", false: alg}[alg == AlgEdDSA]; ping.Alg != want {
+			t.Errorf("%s: expected alg header %q, got %q", alg, want, ping.Alg)
+		}
+
+		// The key travels in registrations and the signature over either codec
+		encoded, err := FormatPublicKey(pub)
+		if err != nil {
+			t.Fatalf("%s: FormatPublicKey failed: %v", alg, err)
+		}
+		parsed, err := ParsePublicKey(encoded)
+		if err != nil || !parsed.Equal(pub) {
+			t.Fatalf("%s: expected the key to round-trip, got %v", alg, err)
+		}
+		data, _ := json.Marshal(ping)
+		received, _ := JSONCodec.Unmarshal(data)
+		packed, _ := MsgPackCodec.Marshal(received)
+		unpacked, err := MsgPackCodec.Unmarshal(packed)
+		if err != nil {
+			t.Fatalf("%s: msgpack round trip failed: %v", alg, err)
+		}
+		if err := VerifyEnvelope(unpacked, parsed); err != nil {
+			t.Errorf("%s: expected the received envelope to verify: %v", alg, err)
+		}
+
+		header, err := SignEventStreamRequestWith("sensor", signer)
+		if err != nil || VerifyEventStreamRequest(header, pub) != nil {
+			t.Errorf("%s: expected a signed event stream request, got %v", alg, err)
+		}
+	}
+
+	// A signature is only checked under its key's algorithm
+	ping := NewPing("sensor", "hello")
+	SignEnvelope(ping, ecKey)
+	ping.Alg = AlgEdDSA
+	if err := VerifyEnvelope(ping, &ecKey.PublicKey); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a changed alg header refused, got %v", err)
+	}
+	ping.Alg = AlgES256
+	if err := VerifyEnvelope(ping, edKey.Public().(PublicKey)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected an ES256 envelope refused under an Ed25519 key, got %v", err)
+	}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if _, err := FormatPublicKey(&p384.PublicKey); err == nil {
+		t.Error("Expected a P-384 key refused")
+	}
+	if err := SignEnvelope(NewPing("sensor", "hello"), p384); err == nil {
+		t.Error("Expected signing with a P-384 key refused")
+	}
+}
@@ -0,0 +1,294 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderAttachmentGrant carries the broker's grant, as base64 JSON, when a
+// requester fetches an attachment from the agent serving it
+const HeaderAttachmentGrant = "X-FEM-Attachment-Grant"
+
+// ErrAttachmentDenied is returned when a grant does not authorize a fetch
+var ErrAttachmentDenied = errors.New("attachment fetch not authorized")
+
+// AttachmentClaim is a claim ticket for a tool result too large to pass
+// through the broker. The agent that ran the tool signs it and serves the
+// payload itself; the requester fetches the payload from URL with a grant
+// the broker issues, and checks it against Digest.
+type AttachmentClaim struct {
+	ID          string `json:"id"`
+	Agent       string `json:"agent"` // Agent serving the payload, which signs the claim
+	URL         string `json:"url"`   // Where the payload is fetched from
+	Size        int64  `json:"size"`
+	Digest      string `json:"digest"` // Hex SHA-256 of the payload
+	ContentType string `json:"contentType,omitempty"`
+	Expires     int64  `json:"expires"` // Unix time in milliseconds after which the payload is gone
+	Sig         string `json:"sig,omitempty"`
+}
+
+// Verify checks that the claim is signed by the agent serving it
+func (c *AttachmentClaim) Verify(pubKey PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(c.Sig)
+	if err != nil {
+		return fmt.Errorf("%w: attachment claim signature encoding: %v", ErrBadSignature, err)
+	}
+
+	unsigned := *c
+	unsigned.Sig = ""
+	verified, err := verifyJSON(pubKey, unsigned, signature)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("%w: attachment claim", ErrBadSignature)
+	}
+	return nil
+}
+
+// AttachmentGrant is the broker's authorization for one requester to fetch
+// one attachment from the agent serving it
+type AttachmentGrant struct {
+	Attachment string `json:"attachment"` // ID of the claim
+	Agent      string `json:"agent"`      // Agent serving the attachment
+	Requester  string `json:"requester"`
+	Digest     string `json:"digest"` // Of the payload, as claimed
+	Broker     string `json:"broker"`
+	Expires    int64  `json:"expires"` // Unix time in milliseconds
+	Sig        string `json:"sig,omitempty"`
+}
+
+// NewAttachmentGrant authorizes requester to fetch the attachment of claim
+// until expires, signed with the broker's key
+func NewAttachmentGrant(broker string, key ed25519.PrivateKey, claim *AttachmentClaim, requester string, expires time.Time) (*AttachmentGrant, error) {
+	grant := &AttachmentGrant{
+		Attachment: claim.ID,
+		Agent:      claim.Agent,
+		Requester:  requester,
+		Digest:     claim.Digest,
+		Broker:     broker,
+		Expires:    expires.UnixMilli(),
+	}
+	data, err := marshalCanonical(grant)
+	if err != nil {
+		return nil, err
+	}
+	grant.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return grant, nil
+}
+
+// Verify checks that the grant is signed by the broker
+func (g *AttachmentGrant) Verify(brokerKey ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(g.Sig)
+	if err != nil {
+		return fmt.Errorf("%w: attachment grant signature encoding: %v", ErrBadSignature, err)
+	}
+
+	unsigned := *g
+	unsigned.Sig = ""
+	verified, err := verifyJSON(brokerKey, unsigned, signature)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("%w: attachment grant", ErrBadSignature)
+	}
+	return nil
+}
+
+// attachment is a payload an AttachmentServer holds
+type attachment struct {
+	claim   AttachmentClaim
+	payload []byte
+}
+
+// AttachmentServer lets an agent serve large tool results to requesters
+// directly. The agent adds a payload, returns the claim in its toolResult,
+// and serves requesters presenting a grant signed by its broker.
+type AttachmentServer struct {
+	agent       string
+	key         Signer
+	baseURL     string // Attachments are served at baseURL/<id>
+	brokerKey   ed25519.PublicKey
+	attachments map[string]*attachment
+	now         func() time.Time
+	mu          sync.Mutex
+}
+
+// NewAttachmentServer creates a server for agent, which signs claims with
+// key and is mounted at baseURL. Grants must be signed with brokerKey.
+func NewAttachmentServer(agent string, key Signer, baseURL string, brokerKey ed25519.PublicKey) *AttachmentServer {
+	return &AttachmentServer{
+		agent:       agent,
+		key:         key,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		brokerKey:   brokerKey,
+		attachments: make(map[string]*attachment),
+		now:         time.Now,
+	}
+}
+
+// Add holds payload for ttl and returns the signed claim for it
+func (s *AttachmentServer) Add(payload []byte, contentType string, ttl time.Duration) (*AttachmentClaim, error) {
+	digest := sha256.Sum256(payload)
+	now := s.now()
+	id := NewNonce()
+	claim := AttachmentClaim{
+		ID:          id,
+		Agent:       s.agent,
+		URL:         s.baseURL + "/" + id,
+		Size:        int64(len(payload)),
+		Digest:      hex.EncodeToString(digest[:]),
+		ContentType: contentType,
+		Expires:     now.Add(ttl).UnixMilli(),
+	}
+	data, err := marshalCanonical(claim)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signMessage(s.key, data)
+	if err != nil {
+		return nil, err
+	}
+	claim.Sig = base64.StdEncoding.EncodeToString(signature)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for existing, held := range s.attachments {
+		if now.UnixMilli() >= held.claim.Expires {
+			delete(s.attachments, existing)
+		}
+	}
+	s.attachments[id] = &attachment{claim: claim, payload: payload}
+	return &claim, nil
+}
+
+// Attach holds payload for ttl and sets its claim on a tool result
+func (s *AttachmentServer) Attach(result *ToolResultBody, payload []byte, contentType string, ttl time.Duration) error {
+	claim, err := s.Add(payload, contentType, ttl)
+	if err != nil {
+		return err
+	}
+	result.Attachment = claim
+	return nil
+}
+
+// ServeHTTP serves GET <baseURL>/<id> to requesters whose grant, signed by
+// the broker, names the attachment and has not expired
+func (s *AttachmentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	s.mu.Lock()
+	held, exists := s.attachments[id]
+	s.mu.Unlock()
+	now := s.now()
+	if !exists || now.UnixMilli() >= held.claim.Expires {
+		http.Error(w, "Unknown attachment", http.StatusNotFound)
+		return
+	}
+
+	grant, err := DecodeAttachmentGrant(r.Header.Get(HeaderAttachmentGrant))
+	if err == nil {
+		err = s.authorize(grant, &held.claim, now)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if held.claim.ContentType != "" {
+		w.Header().Set("Content-Type", held.claim.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(held.payload)))
+	w.Write(held.payload)
+}
+
+// authorize checks a grant against the claim it is presented for
+func (s *AttachmentServer) authorize(grant *AttachmentGrant, claim *AttachmentClaim, now time.Time) error {
+	if err := grant.Verify(s.brokerKey); err != nil {
+		return fmt.Errorf("%w: %w", ErrAttachmentDenied, err)
+	}
+	switch {
+	case grant.Attachment != claim.ID || grant.Agent != claim.Agent || grant.Digest != claim.Digest:
+		return fmt.Errorf("%w: grant is for another attachment", ErrAttachmentDenied)
+	case now.UnixMilli() >= grant.Expires:
+		return fmt.Errorf("%w: grant %w", ErrAttachmentDenied, ErrExpired)
+	}
+	return nil
+}
+
+// EncodeAttachmentGrant formats a grant for HeaderAttachmentGrant
+func EncodeAttachmentGrant(grant *AttachmentGrant) (string, error) {
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeAttachmentGrant reads a grant from HeaderAttachmentGrant
+func DecodeAttachmentGrant(value string) (*AttachmentGrant, error) {
+	if value == "" {
+		return nil, fmt.Errorf("%w: no grant", ErrAttachmentDenied)
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid grant encoding", ErrAttachmentDenied)
+	}
+	var grant AttachmentGrant
+	if err := json.Unmarshal(data, &grant); err != nil {
+		return nil, fmt.Errorf("%w: invalid grant", ErrAttachmentDenied)
+	}
+	return &grant, nil
+}
+
+// FetchAttachment fetches the payload of claim from the agent serving it,
+// presenting grant, and checks it against the claimed size and digest
+func FetchAttachment(client *http.Client, claim *AttachmentClaim, grant *AttachmentGrant) ([]byte, error) {
+	header, err := EncodeAttachmentGrant(grant)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, claim.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderAttachmentGrant, header)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch attachment: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("agent %s refused attachment (%d): %s", claim.Agent, resp.StatusCode, bytes.TrimSpace(message))
+	}
+
+	// A payload longer than claimed is cut off and fails the size check
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, claim.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	digest := sha256.Sum256(payload)
+	if int64(len(payload)) != claim.Size || hex.EncodeToString(digest[:]) != claim.Digest {
+		return nil, fmt.Errorf("attachment %s does not match its claim", claim.ID)
+	}
+	return payload, nil
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachmentFetch(t *testing.T) {
+	agentPub, agentKey, _ := GenerateKeyPair()
+	brokerPub, brokerKey, _ := GenerateKeyPair()
+	_, strangerKey, _ := GenerateKeyPair()
+
+	server := NewAttachmentServer("agent-a", agentKey, "", brokerPub)
+	agent := httptest.NewServer(server)
+	defer agent.Close()
+	server.baseURL = agent.URL + "/attachments"
+
+	payload := bytes.Repeat([]byte("result "), 1000)
+	claim, err := server.Add(payload, "text/plain", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to add attachment: %v", err)
+	}
+	if err := claim.Verify(agentPub); err != nil {
+		t.Fatalf("Expected the claim to verify, got %v", err)
+	}
+	if claim.Size != int64(len(payload)) || !strings.HasPrefix(claim.URL, agent.URL) {
+		t.Fatalf("Unexpected claim %+v", claim)
+	}
+
+	grant, _ := NewAttachmentGrant("broker-a", brokerKey, claim, "agent-b", time.Now().Add(time.Minute))
+	fetched, err := FetchAttachment(agent.Client(), claim, grant)
+	if err != nil {
+		t.Fatalf("Expected the fetch to succeed, got %v", err)
+	}
+	if !bytes.Equal(fetched, payload) {
+		t.Fatal("Fetched payload differs from the attachment")
+	}
+
+	forged, _ := NewAttachmentGrant("broker-a", strangerKey, claim, "agent-b", time.Now().Add(time.Minute))
+	expired, _ := NewAttachmentGrant("broker-a", brokerKey, claim, "agent-b", time.Now().Add(-time.Second))
+	other := *claim
+	other.Digest = strings.Repeat("0", 64)
+	misdirected, _ := NewAttachmentGrant("broker-a", brokerKey, &other, "agent-b", time.Now().Add(time.Minute))
+	for name, grant := range map[string]*AttachmentGrant{
+		"forged":      forged,
+		"expired":     expired,
+		"misdirected": misdirected,
+	} {
+		if _, err := FetchAttachment(agent.Client(), claim, grant); err == nil {
+			t.Errorf("Expected the %s grant to be refused", name)
+		}
+	}
+
+	// A payload that does not match the claim is rejected by the requester
+	tampered := *claim
+	tampered.Size--
+	if _, err := FetchAttachment(agent.Client(), &tampered, grant); err == nil {
+		t.Error("Expected a payload longer than claimed to be rejected")
+	}
+}
+
+func TestAttachmentClaimTampered(t *testing.T) {
+	agentPub, agentKey, _ := GenerateKeyPair()
+	brokerPub, _, _ := GenerateKeyPair()
+	server := NewAttachmentServer("agent-a", agentKey, "https://agent-a.example/attachments/", brokerPub)
+
+	var result ToolResultBody
+	if err := server.Attach(&result, []byte("payload"), "", time.Minute); err != nil {
+		t.Fatalf("Failed to attach: %v", err)
+	}
+	if result.Attachment == nil || !strings.HasPrefix(result.Attachment.URL, "https://agent-a.example/attachments/") {
+		t.Fatalf("Unexpected attachment %+v", result.Attachment)
+	}
+
+	claim := *result.Attachment
+	claim.URL = "https://elsewhere.example/payload"
+	if err := claim.Verify(agentPub); err == nil {
+		t.Error("Expected a tampered claim to fail verification")
+	}
+}
+
+func TestAttachmentServerRejectsMissingGrant(t *testing.T) {
+	_, agentKey, _ := GenerateKeyPair()
+	brokerPub, _, _ := GenerateKeyPair()
+	server := NewAttachmentServer("agent-a", agentKey, "/attachments", brokerPub)
+	claim, _ := server.Add([]byte("payload"), "", time.Minute)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, claim.URL, nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a grant, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/attachments/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown attachment, got %d", recorder.Code)
+	}
+}
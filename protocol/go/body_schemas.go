@@ -0,0 +1,253 @@
+package protocol
+
+import (
+	"embed"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:generate go run ./cmd/fem-schemas schemas
+
+// bodySchemaFiles are the JSON Schemas of the envelope bodies, generated
+// from the body types by cmd/fem-schemas
+//
+//go:embed schemas/*.schema.json
+var bodySchemaFiles embed.FS
+
+// BodySchemaTypes returns the envelope types that have a body schema, in
+// name order
+func BodySchemaTypes() []EnvelopeType {
+	types := make([]EnvelopeType, 0, len(bodyTypes))
+	for envType := range bodyTypes {
+		types = append(types, envType)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// BodySchema returns the JSON Schema (draft-07) of an envelope type's body,
+// as shipped with the package
+func BodySchema(envType EnvelopeType) ([]byte, bool) {
+	data, err := bodySchemaFiles.ReadFile("schemas/" + string(envType) + ".schema.json")
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// GenerateBodySchema derives the JSON Schema of an envelope type's body
+// from its Go type. Fields tagged `fem:"required"` must be present and not
+// empty; nothing else is required, so senders may leave out what Go would
+// omit. Unknown fields are allowed, so newer senders are not refused.
+func GenerateBodySchema(envType EnvelopeType) ([]byte, error) {
+	t, ok := bodyTypes[envType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEnvelopeType, envType)
+	}
+
+	schema := GenerateSchema(t)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = "https://fep-fem.org/schemas/bodies/" + string(envType) + ".schema.json"
+	schema["title"] = fmt.Sprintf("FEM %s body", envType)
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// GenerateSchema derives the JSON Schema of values of a Go type, following
+// the rules of GenerateBodySchema. A field's `description` tag becomes the
+// description of its property. Struct types nested in t are put under
+// definitions.
+func GenerateSchema(t reflect.Type) map[string]interface{} {
+	generator := &schemaGenerator{definitions: make(map[string]interface{})}
+	var schema map[string]interface{}
+	if t.Kind() == reflect.Struct && !selfDescribed(t) {
+		schema = generator.object(t)
+	} else {
+		schema = generator.schema(t)
+	}
+	if len(generator.definitions) > 0 {
+		schema["definitions"] = generator.definitions
+	}
+	return schema
+}
+
+var (
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaGenerator turns Go types into JSON Schemas. Named struct types
+// become definitions, so types that refer to themselves terminate.
+type schemaGenerator struct {
+	definitions map[string]interface{}
+}
+
+// selfDescribed reports whether values of type t are not marshaled from
+// their fields, so their schema does not follow from t's kind
+func selfDescribed(t reflect.Type) bool {
+	return t == rawMessageType || t == timeType ||
+		t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) ||
+		t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType)
+}
+
+// schema returns the schema of values of type t
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		// Types marshaling themselves may take any form
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(g.schema(t.Elem()))
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Base64 in JSON
+			return map[string]interface{}{"type": []interface{}{"string", "null"}}
+		}
+		return map[string]interface{}{"type": []interface{}{"array", "null"}, "items": g.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		schema := map[string]interface{}{"type": []interface{}{"object", "null"}}
+		if values := g.schema(t.Elem()); len(values) > 0 {
+			schema["additionalProperties"] = values
+		}
+		return schema
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, defined := g.definitions[t.Name()]; !defined {
+			g.definitions[t.Name()] = nil // Placeholder while its fields are generated
+			g.definitions[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	default:
+		// Interfaces hold any value
+		return map[string]interface{}{}
+	}
+}
+
+// object returns the schema of a struct type's JSON object
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	g.fields(t, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fields adds a struct's fields to properties, including those of embedded
+// structs, which JSON flattens
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && strings.Split(tag, ",")[0] == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.fields(embedded, properties, required)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name := jsonFieldName(field)
+		schema := g.schema(field.Type)
+		if fieldRequired(field) {
+			*required = append(*required, name)
+			switch field.Type.Kind() {
+			case reflect.String:
+				schema["minLength"] = 1
+			case reflect.Slice, reflect.Map:
+				schema = copySchema(schema)
+				if field.Type.Kind() == reflect.Slice {
+					schema["type"] = "array"
+					schema["minItems"] = 1
+				} else {
+					schema["type"] = "object"
+				}
+			}
+		}
+		if description := field.Tag.Get("description"); description != "" {
+			schema = copySchema(schema)
+			schema["description"] = description
+		}
+		properties[name] = schema
+	}
+}
+
+// fieldRequired reports whether a field's fem tag marks it required
+func fieldRequired(field reflect.StructField) bool {
+	for _, option := range strings.Split(field.Tag.Get("fem"), ",") {
+		if option == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+// nullable lets a schema also match null, as Go marshals nil pointers
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	if ref, ok := schema["$ref"]; ok {
+		return map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"$ref": ref}, map[string]interface{}{"type": "null"}}}
+	}
+	kind, ok := schema["type"].(string)
+	if !ok {
+		return schema
+	}
+	schema = copySchema(schema)
+	schema["type"] = []interface{}{kind, "null"}
+	return schema
+}
+
+// copySchema returns a shallow copy of a schema, to change its keywords
+func copySchema(schema map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(schema)+1)
+	for key, value := range schema {
+		copied[key] = value
+	}
+	return copied
+}
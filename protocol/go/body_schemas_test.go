@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestBodySchemasMatchBodyTypes(t *testing.T) {
+	types := BodySchemaTypes()
+	if len(types) != len(bodyTypes) {
+		t.Fatalf("Expected a schema type for each of %d bodies, got %d", len(bodyTypes), len(types))
+	}
+	for _, envType := range types {
+		shipped, ok := BodySchema(envType)
+		if !ok {
+			t.Errorf("%s: no schema shipped", envType)
+			continue
+		}
+		generated, err := GenerateBodySchema(envType)
+		if err != nil {
+			t.Fatalf("%s: %v", envType, err)
+		}
+		if !bytes.Equal(shipped, generated) {
+			t.Errorf("%s: shipped schema is out of date; run go generate", envType)
+		}
+	}
+
+	if _, err := GenerateBodySchema("teleport"); !errors.Is(err, ErrUnknownEnvelopeType) {
+		t.Errorf("Expected an unknown type to have no schema, got %v", err)
+	}
+}
+
+func TestValidateBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		envType EnvelopeType
+		body    string
+		fields  []FieldError
+	}{
+		{"valid", EnvelopeToolCall, `{"tool": "echo", "parameters": {"text": "hi"}, "requestId": "r1"}`, nil},
+		{"nulls Go would send", EnvelopeToolCall, `{"tool": "echo", "parameters": null, "variants": null, "enc": null}`, nil},
+		{"unknown fields", EnvelopeEmitEvent, `{"event": "sensor.temperature", "unit": "celsius"}`, nil},
+		{"former field name", EnvelopeRenderInstruction, `{"instruction": "draw", "context": {"color": "red"}}`, nil},
+		{"missing required", EnvelopeEmitEvent, `{"payload": {}}`, []FieldError{{"event", "is required"}}},
+		{"empty required", EnvelopeSubscribe, `{"events": []}`, []FieldError{{"events", "must not be empty"}}},
+		{"wrong types", EnvelopeToolCall, `{"tool": 7, "seq": -1, "receipt": "yes"}`, []FieldError{
+			{"receipt", "must be a boolean, not a string"},
+			{"seq", "must be at least 0"},
+			{"tool", "must be a string, not an integer"},
+		}},
+		{"nested", EnvelopeToolCall, `{"tool": "echo", "enc": {"epk": 1}}`, []FieldError{{"enc.epk", "must be a string, not an integer"}}},
+		{"not an object", EnvelopePing, `[1, 2]`, []FieldError{{"body", "must be an object, not an array"}}},
+		{"not JSON", EnvelopePing, `{`, []FieldError{{"body", "is not valid JSON"}}},
+		{"no schema", "teleport", `"anything"`, nil},
+	}
+
+	for _, tt := range tests {
+		err := ValidateBody(tt.envType, json.RawMessage(tt.body))
+		if tt.fields == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		var invalid *ValidationError
+		if !errors.As(err, &invalid) || !errors.Is(err, ErrInvalidBody) {
+			t.Errorf("%s: expected a ValidationError, got %v", tt.name, err)
+			continue
+		}
+		if len(invalid.Fields) != len(tt.fields) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.fields, invalid.Fields)
+			continue
+		}
+		for i := range tt.fields {
+			if invalid.Fields[i] != tt.fields[i] {
+				t.Errorf("%s: expected %v, got %v", tt.name, tt.fields[i], invalid.Fields[i])
+			}
+		}
+	}
+}
+
+func TestValidateEnvelope(t *testing.T) {
+	call := &ToolCallEnvelope{BaseEnvelope: BaseEnvelope{Type: EnvelopeToolCall}, Body: ToolCallBody{Tool: "echo"}}
+	if err := ValidateEnvelope(call); err != nil {
+		t.Errorf("Expected a built tool call to be valid, got %v", err)
+	}
+
+	call.Body.Tool = ""
+	err := ValidateEnvelope(call)
+	if err == nil || err.Error() != "invalid toolCall body: tool must not be empty" {
+		t.Errorf("Expected the empty tool to be named, got %v", err)
+	}
+}
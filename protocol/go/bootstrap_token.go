@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// BootstrapToken lets agents join a broker that runs in closed-registration
+// mode. The broker signs it with its identity key. It names the agents that
+// may use it, by ID pattern, and the capabilities they may register, by
+// capability pattern. A token can be used by any number of matching agents
+// until it expires.
+type BootstrapToken struct {
+	ID           string   `json:"id"` // Random, to tell tokens apart in logs
+	Broker       string   `json:"broker"`
+	Agent        string   `json:"agent"`        // Agent ID pattern, such as "worker-*"
+	Capabilities []string `json:"capabilities"` // Capability patterns agents may register
+	Expires      int64    `json:"expires"`      // Unix time in milliseconds
+	Sig          string   `json:"sig,omitempty"`
+}
+
+// NewBootstrapToken creates a token for agents matching agent, signed by
+// the broker's identity key
+func NewBootstrapToken(broker string, key ed25519.PrivateKey, agent string, capabilities []string, expires time.Time) (*BootstrapToken, error) {
+	token := &BootstrapToken{
+		ID:           NewNonce(),
+		Broker:       broker,
+		Agent:        agent,
+		Capabilities: capabilities,
+		Expires:      expires.UnixMilli(),
+	}
+	data, err := marshalCanonical(token)
+	if err != nil {
+		return nil, err
+	}
+	token.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return token, nil
+}
+
+// Verify checks that the token is signed by the broker
+func (t *BootstrapToken) Verify(brokerKey ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(t.Sig)
+	if err != nil {
+		return fmt.Errorf("%w: bootstrap token signature encoding: %v", ErrBadSignature, err)
+	}
+
+	unsigned := *t
+	unsigned.Sig = ""
+	verified, err := verifyJSON(brokerKey, unsigned, signature)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("%w: bootstrap token", ErrBadSignature)
+	}
+	return nil
+}
+
+// EncodeBootstrapToken encodes a token as the single string operators hand
+// to agents and agents put in RegisterAgentBody.BootstrapToken
+func EncodeBootstrapToken(token *BootstrapToken) (string, error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeBootstrapToken reads a token encoded by EncodeBootstrapToken
+func DecodeBootstrapToken(value string) (*BootstrapToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap token encoding: %w", err)
+	}
+	var token BootstrapToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("invalid bootstrap token: %w", err)
+	}
+	return &token, nil
+}
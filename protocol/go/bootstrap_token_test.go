@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestBootstrapTokenRoundTrip(t *testing.T) {
+	pubKey, key, _ := GenerateKeyPair()
+	otherPub, _, _ := GenerateKeyPair()
+
+	token, err := NewBootstrapToken("broker-a", key, "worker-*", []string{"echo"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	encoded, err := EncodeBootstrapToken(token)
+	if err != nil {
+		t.Fatalf("Failed to encode token: %v", err)
+	}
+	decoded, err := DecodeBootstrapToken(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+	if err := decoded.Verify(pubKey); err != nil {
+		t.Errorf("Expected the token to verify, got %v", err)
+	}
+	if err := decoded.Verify(ed25519.PublicKey(otherPub)); err == nil {
+		t.Error("Expected the token not to verify with another key")
+	}
+
+	// Widening the grant breaks the signature
+	decoded.Capabilities = append(decoded.Capabilities, "*")
+	if err := decoded.Verify(pubKey); err == nil {
+		t.Error("Expected a tampered token not to verify")
+	}
+	if _, err := DecodeBootstrapToken("not a token"); err == nil {
+		t.Error("Expected garbage to be refused")
+	}
+}
@@ -0,0 +1,357 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"fmt"
+	"time"
+)
+
+// envelopeHeaders is what every envelope builder sets before its body: the
+// sending agent and the key to sign with, if any
+type envelopeHeaders struct {
+	agent string
+	key   Signer
+}
+
+// base returns fresh headers for an envelope of the given type, with the
+// current time and a new nonce
+func (h envelopeHeaders) base(envType EnvelopeType) (BaseEnvelope, error) {
+	if h.agent == "" {
+		return BaseEnvelope{}, fmt.Errorf("%w: agent", ErrMissingField)
+	}
+	return BaseEnvelope{
+		Type: envType,
+		CommonHeaders: CommonHeaders{
+			Agent: h.agent,
+			TS:    time.Now().UnixMilli(),
+			Nonce: NewNonce(),
+		},
+	}, nil
+}
+
+// sign signs a built envelope if the builder was given a key
+func (h envelopeHeaders) sign(envelope SignableEnvelope) error {
+	if noSigner(h.key) {
+		return nil
+	}
+	return SignEnvelope(envelope, h.key)
+}
+
+// ToolCallBuilder assembles a toolCall envelope; see NewToolCall
+type ToolCallBuilder struct {
+	envelopeHeaders
+	body      ToolCallBody
+	deadline  time.Time
+	recipient *ecdh.PublicKey
+}
+
+// NewToolCall starts a toolCall from agent. Build checks that the call
+// names a tool and that its deadline has not passed, and fills in the
+// timestamp, the nonce and, if none is set, a request ID. Each Build makes
+// a new envelope, so a builder can make the retries of one call.
+//
+//	call, err := protocol.NewToolCall("caller-agent").
+//		Tool("weather.read").
+//		Params(map[string]interface{}{"city": "Oslo"}).
+//		Deadline(time.Now().Add(5 * time.Second)).
+//		SignWith(key).
+//		Build()
+func NewToolCall(agent string) *ToolCallBuilder {
+	return &ToolCallBuilder{envelopeHeaders: envelopeHeaders{agent: agent}}
+}
+
+// Tool sets the tool to call, as name or agent/name
+func (b *ToolCallBuilder) Tool(name string) *ToolCallBuilder {
+	b.body.Tool = name
+	return b
+}
+
+// Params sets the call's parameters, replacing any set before
+func (b *ToolCallBuilder) Params(parameters map[string]interface{}) *ToolCallBuilder {
+	b.body.Parameters = make(map[string]interface{}, len(parameters))
+	for name, value := range parameters {
+		b.body.Parameters[name] = value
+	}
+	return b
+}
+
+// Param sets one parameter
+func (b *ToolCallBuilder) Param(name string, value interface{}) *ToolCallBuilder {
+	if b.body.Parameters == nil {
+		b.body.Parameters = make(map[string]interface{})
+	}
+	b.body.Parameters[name] = value
+	return b
+}
+
+// RequestID sets the ID the result will carry
+func (b *ToolCallBuilder) RequestID(id string) *ToolCallBuilder {
+	b.body.RequestID = id
+	return b
+}
+
+// Deadline sets when the caller stops waiting for the result
+func (b *ToolCallBuilder) Deadline(deadline time.Time) *ToolCallBuilder {
+	b.deadline = deadline
+	return b
+}
+
+// IdempotencyKey makes the call safe to retry: the broker runs the tool once
+// per key
+func (b *ToolCallBuilder) IdempotencyKey(key string) *ToolCallBuilder {
+	b.body.IdempotencyKey = key
+	return b
+}
+
+// Seq sets the call's sequence number for ordered delivery, from 1
+func (b *ToolCallBuilder) Seq(seq uint64) *ToolCallBuilder {
+	b.body.Seq = seq
+	return b
+}
+
+// StreamResult asks for the result as toolResultChunk envelopes
+func (b *ToolCallBuilder) StreamResult() *ToolCallBuilder {
+	b.body.StreamResult = true
+	return b
+}
+
+// Receipt asks for a DeliveryReceipt with the result
+func (b *ToolCallBuilder) Receipt() *ToolCallBuilder {
+	b.body.Receipt = true
+	return b
+}
+
+// Variants names the parameter variants the caller speaks, in any order;
+// the parameters must be valid in each
+func (b *ToolCallBuilder) Variants(names ...string) *ToolCallBuilder {
+	b.body.Variants = append(b.body.Variants, names...)
+	return b
+}
+
+// EncryptFor seals the parameters to the encryption key of the agent
+// offering the tool, so brokers on the way cannot read them
+func (b *ToolCallBuilder) EncryptFor(recipient *ecdh.PublicKey) *ToolCallBuilder {
+	b.recipient = recipient
+	return b
+}
+
+// SignWith signs the envelope Build returns with key, an
+// ed25519.PrivateKey or another Signer
+func (b *ToolCallBuilder) SignWith(key Signer) *ToolCallBuilder {
+	b.key = key
+	return b
+}
+
+// Build checks the call and returns it as an envelope
+func (b *ToolCallBuilder) Build() (*ToolCallEnvelope, error) {
+	base, err := b.base(EnvelopeToolCall)
+	if err != nil {
+		return nil, err
+	}
+	if b.body.Tool == "" {
+		return nil, fmt.Errorf("%w: tool", ErrMissingField)
+	}
+	if !b.deadline.IsZero() && !b.deadline.After(time.Now()) {
+		return nil, fmt.Errorf("%w: deadline %s has passed", ErrExpired, b.deadline.Format(time.RFC3339))
+	}
+
+	envelope := &ToolCallEnvelope{BaseEnvelope: base, Body: b.body}
+	envelope.Body.Parameters = make(map[string]interface{}, len(b.body.Parameters))
+	for name, value := range b.body.Parameters {
+		envelope.Body.Parameters[name] = value
+	}
+	envelope.Body.Variants = append([]string(nil), b.body.Variants...)
+	if envelope.Body.RequestID == "" {
+		envelope.Body.RequestID = NewNonce()
+	}
+	if !b.deadline.IsZero() {
+		envelope.Body.Deadline = b.deadline.UnixMilli()
+	}
+	if b.recipient != nil {
+		if err := envelope.EncryptParameters(b.recipient); err != nil {
+			return nil, err
+		}
+	}
+	return envelope, b.sign(envelope)
+}
+
+// ToolResultBuilder assembles a toolResult envelope; see NewToolResult
+type ToolResultBuilder struct {
+	envelopeHeaders
+	body     ToolResultBody
+	answered bool
+	timing   *DeliveryReceipt
+}
+
+// NewToolResult starts the toolResult agent sends for the call requestID.
+// Build checks that the result has an outcome: Result, Fail or Attachment.
+func NewToolResult(agent, requestID string) *ToolResultBuilder {
+	return &ToolResultBuilder{envelopeHeaders: envelopeHeaders{agent: agent}, body: ToolResultBody{RequestID: requestID}}
+}
+
+// Result reports the call succeeded with result
+func (b *ToolResultBuilder) Result(result interface{}) *ToolResultBuilder {
+	b.body = NewToolResultBody(b.body.RequestID, result, nil)
+	b.answered = true
+	return b
+}
+
+// Fail reports the call failed with err. A BusyError is reported as busy,
+// with its retry hint.
+func (b *ToolResultBuilder) Fail(err error) *ToolResultBuilder {
+	if err == nil {
+		err = fmt.Errorf("tool failed")
+	}
+	b.body = NewToolResultBody(b.body.RequestID, nil, err)
+	b.answered = true
+	return b
+}
+
+// Attachment reports the call succeeded with a result the agent serves
+// itself, under claim
+func (b *ToolResultBuilder) Attachment(claim *AttachmentClaim) *ToolResultBuilder {
+	b.body = ToolResultBody{RequestID: b.body.RequestID, Success: true, Attachment: claim}
+	b.answered = claim != nil
+	return b
+}
+
+// Timing reports when the agent took the call, started running the tool
+// and had its result, for the broker to pass on in a DeliveryReceipt
+func (b *ToolResultBuilder) Timing(accepted, started, finished time.Time) *ToolResultBuilder {
+	b.timing = &DeliveryReceipt{Accepted: accepted.UnixMilli(), Started: started.UnixMilli(), Finished: finished.UnixMilli()}
+	return b
+}
+
+// SignWith signs the envelope Build returns with key
+func (b *ToolResultBuilder) SignWith(key Signer) *ToolResultBuilder {
+	b.key = key
+	return b
+}
+
+// Build checks the result and returns it as an envelope
+func (b *ToolResultBuilder) Build() (*ToolResultEnvelope, error) {
+	base, err := b.base(EnvelopeToolResult)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b.body.RequestID == "":
+		return nil, fmt.Errorf("%w: requestId", ErrMissingField)
+	case !b.answered:
+		return nil, fmt.Errorf("%w: result, error or attachment", ErrMissingField)
+	}
+
+	envelope := &ToolResultEnvelope{BaseEnvelope: base, Body: b.body}
+	envelope.Body.Receipt = b.timing
+	return envelope, b.sign(envelope)
+}
+
+// RegisterAgentBuilder assembles a registerAgent envelope; see
+// NewRegisterAgent
+type RegisterAgentBuilder struct {
+	envelopeHeaders
+	body      RegisterAgentBody
+	publicKey PublicKey
+}
+
+// NewRegisterAgent starts the registration of agent. Build checks that it
+// carries a valid public key, taken from the signing key if none is set.
+func NewRegisterAgent(agent string) *RegisterAgentBuilder {
+	return &RegisterAgentBuilder{envelopeHeaders: envelopeHeaders{agent: agent}}
+}
+
+// PublicKey sets the key the agent signs its envelopes with
+func (b *RegisterAgentBuilder) PublicKey(key PublicKey) *RegisterAgentBuilder {
+	b.publicKey = key
+	return b
+}
+
+// EncryptionKey publishes the key callers seal tool parameters to
+func (b *RegisterAgentBuilder) EncryptionKey(key *ecdh.PublicKey) *RegisterAgentBuilder {
+	b.body.EncKey = EncodeEncryptionKey(key)
+	return b
+}
+
+// Capabilities adds to the capabilities the agent declares
+func (b *RegisterAgentBuilder) Capabilities(capabilities ...string) *RegisterAgentBuilder {
+	b.body.Capabilities = append(b.body.Capabilities, capabilities...)
+	return b
+}
+
+// MCPEndpoint sets the URL of the agent's MCP server
+func (b *RegisterAgentBuilder) MCPEndpoint(endpoint string) *RegisterAgentBuilder {
+	b.body.MCPEndpoint = endpoint
+	return b
+}
+
+// BodyDefinition sets the tools the agent offers in its environment
+func (b *RegisterAgentBuilder) BodyDefinition(definition *BodyDefinition) *RegisterAgentBuilder {
+	b.body.BodyDefinition = definition
+	return b
+}
+
+// EnvironmentType sets the kind of environment the agent runs in, such as
+// "local" or "cloud"
+func (b *RegisterAgentBuilder) EnvironmentType(environmentType string) *RegisterAgentBuilder {
+	b.body.EnvironmentType = environmentType
+	return b
+}
+
+// Metadata sets one metadata entry
+func (b *RegisterAgentBuilder) Metadata(name string, value interface{}) *RegisterAgentBuilder {
+	if b.body.Metadata == nil {
+		b.body.Metadata = make(map[string]interface{})
+	}
+	b.body.Metadata[name] = value
+	return b
+}
+
+// Acks declares that the agent acks pushed envelopes
+func (b *RegisterAgentBuilder) Acks() *RegisterAgentBuilder {
+	b.body.Acks = true
+	return b
+}
+
+// BootstrapToken sets the encoded token a broker closed to registration
+// requires
+func (b *RegisterAgentBuilder) BootstrapToken(token string) *RegisterAgentBuilder {
+	b.body.BootstrapToken = token
+	return b
+}
+
+// Invitation sets the invitation token approving the agent
+func (b *RegisterAgentBuilder) Invitation(invitation string) *RegisterAgentBuilder {
+	b.body.Invitation = invitation
+	return b
+}
+
+// SignWith signs the envelope Build returns with key
+func (b *RegisterAgentBuilder) SignWith(key Signer) *RegisterAgentBuilder {
+	b.key = key
+	return b
+}
+
+// Build checks the registration and returns it as an envelope
+func (b *RegisterAgentBuilder) Build() (*RegisterAgentEnvelope, error) {
+	base, err := b.base(EnvelopeRegisterAgent)
+	if err != nil {
+		return nil, err
+	}
+	body := b.body
+	publicKey := b.publicKey
+	if publicKey == nil && !noSigner(b.key) {
+		if publicKey, err = SignerPublicKey(b.key); err != nil {
+			return nil, err
+		}
+	}
+	if publicKey == nil {
+		return nil, fmt.Errorf("%w: pubkey", ErrMissingField)
+	}
+	if body.PubKey, err = FormatPublicKey(publicKey); err != nil {
+		return nil, err
+	}
+	body.Capabilities = append([]string{}, body.Capabilities...)
+
+	envelope := &RegisterAgentEnvelope{BaseEnvelope: base, Body: body}
+	return envelope, b.sign(envelope)
+}
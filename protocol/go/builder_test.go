@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestToolCallBuilder(t *testing.T) {
+	pub, priv, _ := GenerateKeyPair()
+	deadline := time.Now().Add(5 * time.Second)
+	params := map[string]interface{}{"city": "Oslo"}
+
+	builder := NewToolCall("caller-agent").Tool("weather.read").Params(params).Param("units", "metric").Deadline(deadline).Variants("v1", "v2").SignWith(priv)
+	call, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if call.Type != EnvelopeToolCall || call.Agent != "caller-agent" || call.Nonce == "" || call.TS == 0 {
+		t.Errorf("Expected the headers filled in, got %+v", call.BaseEnvelope)
+	}
+	if call.Body.Tool != "weather.read" || call.Body.RequestID == "" || call.Body.Deadline != deadline.UnixMilli() || len(call.Body.Parameters) != 2 || len(call.Body.Variants) != 2 {
+		t.Errorf("Unexpected body %+v", call.Body)
+	}
+	if len(params) != 1 {
+		t.Error("Expected the caller's parameters left alone")
+	}
+	if err := call.Verify(pub); err != nil {
+		t.Errorf("Expected the call signed: %v", err)
+	}
+
+	// Each build is a new envelope
+	again, _ := builder.Build()
+	if again.Nonce == call.Nonce {
+		t.Error("Expected a fresh nonce for each build")
+	}
+	if unsigned, _ := NewToolCall("caller-agent").Tool("echo").Build(); unsigned.Sig != "" || unsigned.Body.Parameters == nil {
+		t.Errorf("Expected an unsigned call with empty parameters, got %+v", unsigned)
+	}
+
+	for name, tc := range map[string]struct {
+		builder *ToolCallBuilder
+		err     error
+	}{
+		"no agent": {NewToolCall("").Tool("echo"), ErrMissingField},
+		"no tool":  {NewToolCall("caller-agent"), ErrMissingField},
+		"past":     {NewToolCall("caller-agent").Tool("echo").Deadline(time.Now().Add(-time.Second)), ErrExpired},
+	} {
+		if _, err := tc.builder.Build(); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestToolResultBuilder(t *testing.T) {
+	result, err := NewToolResult("worker", "req-1").Result(map[string]interface{}{"answer": 42}).Build()
+	if err != nil || !result.Body.Success || result.Body.RequestID != "req-1" || result.Type != EnvelopeToolResult {
+		t.Errorf("Expected a successful result, got %+v, %v", result, err)
+	}
+
+	busy, _ := NewToolResult("worker", "req-2").Fail(&BusyError{RetryAfter: time.Second}).Build()
+	if busy.Body.Success || !busy.Body.Busy || busy.Body.RetryAfterMs != 1000 {
+		t.Errorf("Expected a busy result, got %+v", busy.Body)
+	}
+
+	if _, err := NewToolResult("worker", "req-3").Build(); !errors.Is(err, ErrMissingField) {
+		t.Errorf("Expected a result without an outcome refused, got %v", err)
+	}
+	if _, err := NewToolResult("worker", "").Result(nil).Build(); !errors.Is(err, ErrMissingField) {
+		t.Errorf("Expected a result without a request ID refused, got %v", err)
+	}
+}
+
+func TestRegisterAgentBuilder(t *testing.T) {
+	pub, priv, _ := GenerateKeyPair()
+
+	// The public key comes from the signing key unless set
+	registration, err := NewRegisterAgent("weather-agent").Capabilities("weather.read").Acks().SignWith(priv).Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if registration.Body.PubKey != EncodePublicKey(pub) || !registration.Body.Acks || registration.Body.Capabilities[0] != "weather.read" {
+		t.Errorf("Unexpected body %+v", registration.Body)
+	}
+	if err := registration.Verify(pub); err != nil {
+		t.Errorf("Expected the registration signed: %v", err)
+	}
+
+	if _, err := NewRegisterAgent("weather-agent").Build(); !errors.Is(err, ErrMissingField) {
+		t.Errorf("Expected a registration without a key refused, got %v", err)
+	}
+	if _, err := NewRegisterAgent("weather-agent").PublicKey(pub[:8]).Build(); err == nil {
+		t.Error("Expected a truncated key refused")
+	}
+}
@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Canonicalize returns JSON in the canonical form of RFC 8785, the JSON
+// Canonicalization Scheme (JCS), which is what FEM signatures cover:
+// no whitespace, object members sorted by the UTF-16 code units of their
+// names, strings with only the escapes JSON requires, and numbers as
+// ECMAScript prints them. Numbers are IEEE 754 doubles, so integers beyond
+// 2^53 lose precision and should be sent as strings.
+func Canonicalize(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCanonicalForm, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: unexpected data after the JSON value", ErrBadCanonicalForm)
+	}
+
+	var out bytes.Buffer
+	if err := writeCanonical(&out, value); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCanonicalForm, err)
+	}
+	return out.Bytes(), nil
+}
+
+// marshalCanonical marshals v and returns it in canonical form
+func marshalCanonical(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Canonicalize(data)
+}
+
+// verifyJSON checks a signature over v in canonical form. Ed25519
+// signatures made before canonical signing, over v as encoding/json
+// marshals it, are still accepted.
+func verifyJSON(publicKey PublicKey, v interface{}, signature []byte) (bool, error) {
+	alg, err := KeyAlgorithm(publicKey)
+	if err != nil {
+		return false, err
+	}
+	legacy, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	canonical, err := Canonicalize(legacy)
+	if err != nil {
+		return false, err
+	}
+	if VerifySignature(publicKey, canonical, signature) == nil {
+		return true, nil
+	}
+	return alg == AlgEdDSA && VerifySignature(publicKey, legacy, signature) == nil, nil
+}
+
+// writeCanonical writes a decoded JSON value in canonical form
+func writeCanonical(out *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		number, err := canonicalNumber(v)
+		if err != nil {
+			return err
+		}
+		out.WriteString(number)
+	case string:
+		writeCanonicalString(out, v)
+	case []interface{}:
+		out.WriteByte('[')
+		for i, element := range v {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeCanonical(out, element); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return lessUTF16(names[i], names[j]) })
+
+		out.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeCanonicalString(out, name)
+			out.WriteByte(':')
+			if err := writeCanonical(out, v[name]); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected JSON value %T", value)
+	}
+	return nil
+}
+
+// lessUTF16 orders strings by their UTF-16 code units, as JCS sorts names
+func lessUTF16(a, b string) bool {
+	x, y := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return len(x) < len(y)
+}
+
+// writeCanonicalString writes a string escaping only quotes, backslashes
+// and control characters, the latter in their short form where JSON has one
+func writeCanonicalString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\b':
+			out.WriteString(`\b`)
+		case '\f':
+			out.WriteString(`\f`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(out, `\u%04x`, r)
+			} else {
+				var encoded [utf8.UTFMax]byte
+				out.Write(encoded[:utf8.EncodeRune(encoded[:], r)])
+			}
+		}
+	}
+	out.WriteByte('"')
+}
+
+// canonicalNumber formats a number as ECMAScript's Number.prototype.toString
+// does: the shortest digits that read back as the same double, in plain
+// notation from 1e-6 up to 1e21 and in exponent notation outside it
+func canonicalNumber(n json.Number) (string, error) {
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("number %s is not a finite double", n)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+
+	sign := ""
+	if f < 0 {
+		sign, f = "-", -f
+	}
+	// Shortest digits d.ddd and exponent; the value is 0.dddd × 10^point
+	formatted := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exponent, _ := strings.Cut(formatted, "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, _ := strconv.Atoi(exponent)
+	point := e + 1
+
+	switch {
+	case len(digits) <= point && point <= 21:
+		return sign + digits + strings.Repeat("0", point-len(digits)), nil
+	case 0 < point && point <= 21:
+		return sign + digits[:point] + "." + digits[point:], nil
+	case -6 < point && point <= 0:
+		return sign + "0." + strings.Repeat("0", -point) + digits, nil
+	}
+	exponentSign := "+"
+	if point-1 < 0 {
+		exponentSign = "-"
+	}
+	mantissa = digits[:1]
+	if len(digits) > 1 {
+		mantissa += "." + digits[1:]
+	}
+	return sign + mantissa + "e" + exponentSign + strconv.Itoa(abs(point-1)), nil
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
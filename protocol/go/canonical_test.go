@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	// Examples from RFC 8785
+	tests := []struct {
+		input, want string
+	}{
+		{
+			`{"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+			  "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+			  "literals": [null, true, false]}`,
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			`{"\u20ac": 1, "\r": 2, "\ufb33": 3, "1": 4, "\ud83d\ude00": 5, "\u0080": 6, "\u00f6": 7}`,
+			"{\"\\r\":2,\"1\":4,\"\u0080\":6,\"ö\":7,\"€\":1,\"😀\":5,\"\ufb33\":3}",
+		},
+		{`{"b": {"z": [], "a": {}}, "a": "<&>"}`, `{"a":"<&>","b":{"a":{},"z":[]}}`},
+	}
+	for _, tt := range tests {
+		got, err := Canonicalize([]byte(tt.input))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("Canonicalize(%s):\n got %s (%v)\nwant %s", tt.input, got, err, tt.want)
+		}
+	}
+
+	numbers := map[uint64]string{
+		0x0000000000000000: "0",
+		0x8000000000000000: "0",
+		0x0000000000000001: "5e-324",
+		0x8000000000000001: "-5e-324",
+		0x7fefffffffffffff: "1.7976931348623157e+308",
+		0x4340000000000000: "9007199254740992",
+		0x4430000000000000: "295147905179352830000",
+		0x44b52d02c7e14af5: "9.999999999999997e+22",
+		0x44b52d02c7e14af6: "1e+23",
+		0x3eb0c6f7a0b5ed8d: "0.000001",
+		0x3eb0c6f7a0b5ed8c: "9.999999999999997e-7",
+		0x41b3de4355555555: "333333333.3333333",
+		0x444b1ae4d6e2ef4e: "999999999999999700000",
+		0x444b1ae4d6e2ef50: "1e+21",
+	}
+	for bits, want := range numbers {
+		input := strconv.FormatFloat(math.Float64frombits(bits), 'g', -1, 64)
+		if got, err := canonicalNumber(json.Number(input)); err != nil || got != want {
+			t.Errorf("Number %016x: got %s (%v), want %s", bits, got, err, want)
+		}
+	}
+
+	for _, invalid := range []string{`{"a":1} {}`, `{"a":}`, `1e400`} {
+		if _, err := Canonicalize([]byte(invalid)); err == nil {
+			t.Errorf("Expected %s to be refused", invalid)
+		}
+	}
+}
+
+func TestCanonicalSignatures(t *testing.T) {
+	publicKey, privateKey, _ := GenerateKeyPair()
+
+	// An envelope signed by another implementation, over the canonical form
+	// of its own serialization, verifies whatever order it sends fields in
+	signed := `{"agent":"agent-a","body":{"event":"a<b","payload":{"m":[1,2],"n":1.5}},"nonce":"n-1","ts":1700000000000,"type":"emitEvent"}`
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signed)))
+	sent := `{"type":"emitEvent","ts":1700000000000,"nonce":"n-1","agent":"agent-a","sig":"` + sig + `",
+	          "body":{"payload":{"m":[1,2],"n":1.50},"event":"a\u003cb"}}`
+	envelope, err := ParseEnvelope([]byte(sent))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if err := envelope.Verify(publicKey); err != nil {
+		t.Errorf("Expected the canonical signature to verify, got %v", err)
+	}
+
+	// Signatures over the legacy serialization are still accepted
+	legacy := &Envelope{Type: EnvelopeEmitEvent, CommonHeaders: CommonHeaders{Agent: "agent-a", TS: 1700000000000, Nonce: "n-2"}, Body: json.RawMessage(`{"event":"a<b"}`)}
+	data, _ := json.Marshal(legacy)
+	legacy.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data))
+	if err := legacy.Verify(publicKey); err != nil {
+		t.Errorf("Expected the legacy signature to verify, got %v", err)
+	}
+	legacy.Nonce = "n-3"
+	if err := legacy.Verify(publicKey); err == nil {
+		t.Error("Expected a changed envelope to fail verification")
+	}
+}
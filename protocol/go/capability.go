@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -35,7 +36,7 @@ func (cm *CapabilityManager) CreateCapability(scope, issuer, subject string, per
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
-			ID:        generateNonce(),
+			ID:        NewNonce(),
 		},
 		Scope:       scope,
 		Permissions: permissions,
@@ -56,6 +57,9 @@ func (cm *CapabilityManager) ValidateCapability(tokenString string) (*Capability
 		return cm.signingKey, nil
 	})
 
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, fmt.Errorf("%w: %w", ErrExpired, err)
+	}
 	if err != nil {
 		return nil, err
 	}
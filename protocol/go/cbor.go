@@ -0,0 +1,602 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CBOR (RFC 8949) support for envelopes, for constrained agents that carry
+// a CBOR library but no JSON parser.
+//
+// As with MessagePack, bodies are transcoded between JSON and CBOR token by
+// token, preserving map key order and number formatting, so that an envelope
+// signed over its JSON form still verifies after a round trip through CBOR.
+// Indefinite-length items and tags are accepted on input; tags are dropped
+// and the tagged item transcoded as is.
+
+// ContentTypeCBOR is the content type of CBOR encoded envelopes
+const ContentTypeCBOR = "application/cbor"
+
+// ErrCBORTruncated is returned when CBOR input ends unexpectedly
+var ErrCBORTruncated = errors.New("cbor: unexpected end of input")
+
+// CBORCodec encodes envelopes as CBOR
+var CBORCodec Codec = cborCodec{}
+
+// maxCBORDepth bounds nesting when transcoding untrusted input
+const maxCBORDepth = MaxEnvelopeDepth
+
+// CBOR major types
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+
+	// cborIndefinite is the additional information marking an
+	// indefinite-length item, ended by cborBreak
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string { return ContentTypeCBOR }
+
+// Marshal encodes the envelope headers directly and transcodes the JSON body
+func (cborCodec) Marshal(envelope *Envelope) ([]byte, error) {
+	fields := 5
+	if envelope.Alg != "" {
+		fields++
+	}
+	if envelope.Sig != "" {
+		fields++
+	}
+
+	buf := make([]byte, 0, 64+len(envelope.Body))
+	buf = appendCBORHeader(buf, cborMap, uint64(fields))
+	buf = appendCBORString(buf, "type")
+	buf = appendCBORString(buf, string(envelope.Type))
+	buf = appendCBORString(buf, "agent")
+	buf = appendCBORString(buf, envelope.Agent)
+	buf = appendCBORString(buf, "ts")
+	buf = appendCBORInt(buf, envelope.TS)
+	buf = appendCBORString(buf, "nonce")
+	buf = appendCBORString(buf, envelope.Nonce)
+	if envelope.Alg != "" {
+		buf = appendCBORString(buf, "alg")
+		buf = appendCBORString(buf, envelope.Alg)
+	}
+	if envelope.Sig != "" {
+		buf = appendCBORString(buf, "sig")
+		buf = appendCBORString(buf, envelope.Sig)
+	}
+	buf = appendCBORString(buf, "body")
+
+	body := envelope.Body
+	if len(body) == 0 {
+		body = json.RawMessage("null")
+	}
+	return appendJSONAsCBOR(buf, body)
+}
+
+// Unmarshal decodes a CBOR envelope, transcoding the body back to JSON
+func (cborCodec) Unmarshal(data []byte) (*Envelope, error) {
+	r := &cborReader{data: data}
+	if err := r.skipTags(); err != nil {
+		return nil, err
+	}
+	major, n, indefinite, err := r.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMap {
+		return nil, fmt.Errorf("cbor: expected map, got major type %d", major>>5)
+	}
+
+	var envelope Envelope
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite && r.atBreak() {
+			r.pos++
+			break
+		}
+
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case "type":
+			s, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			envelope.Type = EnvelopeType(s)
+		case "agent":
+			if envelope.Agent, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "ts":
+			if envelope.TS, err = r.readInt(); err != nil {
+				return nil, err
+			}
+		case "nonce":
+			if envelope.Nonce, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "alg":
+			if envelope.Alg, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "sig":
+			if envelope.Sig, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "body":
+			body, err := r.appendJSON(nil, 0)
+			if err != nil {
+				return nil, err
+			}
+			envelope.Body = body
+		default:
+			// Skip unknown fields
+			if _, err := r.appendJSON(nil, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if r.pos != len(r.data) {
+		return nil, fmt.Errorf("cbor: %d trailing bytes", len(r.data)-r.pos)
+	}
+
+	return &envelope, nil
+}
+
+// JSONToCBOR transcodes an arbitrary JSON document to CBOR, preserving
+// object key order
+func JSONToCBOR(data []byte) ([]byte, error) {
+	return appendJSONAsCBOR(make([]byte, 0, len(data)), data)
+}
+
+// CBORToJSON transcodes a CBOR document to compact JSON, preserving map
+// key order
+func CBORToJSON(data []byte) ([]byte, error) {
+	r := &cborReader{data: data}
+	out, err := r.appendJSON(make([]byte, 0, len(data)*2), 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(r.data) {
+		return nil, fmt.Errorf("cbor: %d trailing bytes", len(r.data)-r.pos)
+	}
+	return out, nil
+}
+
+// JSON to CBOR
+
+func appendJSONAsCBOR(dst []byte, data []byte) ([]byte, error) {
+	// Validate up front so the scanner below can assume well-formed input
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("cbor: invalid JSON input")
+	}
+
+	s := &cborScanner{jsonScanner{data: data}}
+	return s.appendValue(dst, 0)
+}
+
+// cborScanner walks a validated JSON document and emits CBOR
+type cborScanner struct {
+	jsonScanner
+}
+
+func (s *cborScanner) appendValue(dst []byte, depth int) ([]byte, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("cbor: nesting exceeds %d levels", maxCBORDepth)
+	}
+
+	s.skipSpace()
+	switch c := s.data[s.pos]; c {
+	case 'n':
+		s.pos += 4
+		return append(dst, 0xf6), nil
+	case 't':
+		s.pos += 4
+		return append(dst, 0xf5), nil
+	case 'f':
+		s.pos += 5
+		return append(dst, 0xf4), nil
+	case '"':
+		str, err := s.readString()
+		if err != nil {
+			return nil, err
+		}
+		dst = appendCBORHeader(dst, cborText, uint64(len(str)))
+		return append(dst, str...), nil
+	case '{', '[':
+		return s.appendContainer(dst, c, depth)
+	default:
+		start := s.pos
+		for s.pos < len(s.data) && strings.IndexByte("+-0123456789.eE", s.data[s.pos]) >= 0 {
+			s.pos++
+		}
+		return appendCBORNumber(dst, s.data[start:s.pos])
+	}
+}
+
+// appendContainer encodes an object or array with a definite length. A one
+// byte header is reserved and widened in place if the element count turns
+// out to need more room.
+func (s *cborScanner) appendContainer(dst []byte, open byte, depth int) ([]byte, error) {
+	s.pos++
+	headerPos := len(dst)
+	dst = append(dst, 0)
+
+	count := 0
+	var err error
+	for {
+		s.skipSpace()
+		if c := s.data[s.pos]; c == '}' || c == ']' {
+			s.pos++
+			break
+		} else if c == ',' {
+			s.pos++
+			s.skipSpace()
+		}
+
+		if open == '{' {
+			key, err := s.readString()
+			if err != nil {
+				return nil, err
+			}
+			dst = appendCBORHeader(dst, cborText, uint64(len(key)))
+			dst = append(dst, key...)
+			s.skipSpace()
+			s.pos++ // ':'
+		}
+		if dst, err = s.appendValue(dst, depth+1); err != nil {
+			return nil, err
+		}
+		count++
+	}
+
+	major := byte(cborArray)
+	if open == '{' {
+		major = cborMap
+	}
+	header := appendCBORHeader(nil, major, uint64(count))
+	if len(header) == 1 {
+		dst[headerPos] = header[0]
+		return dst, nil
+	}
+
+	// Shift the elements right to make room for a wider header
+	extra := len(header) - 1
+	dst = append(dst, header[:extra]...)
+	copy(dst[headerPos+len(header):], dst[headerPos+1:len(dst)-extra])
+	copy(dst[headerPos:], header)
+	return dst, nil
+}
+
+func appendCBORNumber(dst []byte, number []byte) ([]byte, error) {
+	s := string(number)
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return appendCBORInt(dst, i), nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return appendCBORHeader(dst, cborUint, u), nil
+		}
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("cbor: invalid number %q", s)
+	}
+	dst = append(dst, cborSimple|27)
+	return binary.BigEndian.AppendUint64(dst, math.Float64bits(f)), nil
+}
+
+func appendCBORInt(dst []byte, i int64) []byte {
+	if i >= 0 {
+		return appendCBORHeader(dst, cborUint, uint64(i))
+	}
+	// Negative integers are encoded as -1 - n
+	return appendCBORHeader(dst, cborNegInt, uint64(^i))
+}
+
+func appendCBORString(dst []byte, s string) []byte {
+	dst = appendCBORHeader(dst, cborText, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// appendCBORHeader appends the initial bytes of an item of a major type,
+// in the shortest form that holds n
+func appendCBORHeader(dst []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(dst, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, major|27), n)
+	}
+}
+
+// CBOR to JSON
+
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *cborReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, ErrCBORTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *cborReader) atBreak() bool {
+	return r.pos < len(r.data) && r.data[r.pos] == cborBreak
+}
+
+// skipTags steps over any tags before the next item
+func (r *cborReader) skipTags() error {
+	for r.pos < len(r.data) && r.data[r.pos]&0xe0 == cborTag {
+		if _, _, _, err := r.readHeader(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHeader reads the initial bytes of an item: its major type and its
+// argument, or indefinite for an indefinite-length string, array or map.
+// For floats the argument is the raw bits.
+func (r *cborReader) readHeader() (major byte, argument uint64, indefinite bool, err error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	major, info := b[0]&0xe0, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, uint64(info), false, nil
+	case info <= 27:
+		b, err := r.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, false, err
+		}
+		return major, readBigEndian(b), false, nil
+	case info == cborIndefinite && major >= cborBytes && major <= cborMap:
+		return major, 0, true, nil
+	default:
+		return 0, 0, false, fmt.Errorf("cbor: invalid initial byte 0x%02x", b[0])
+	}
+}
+
+// readLength reads the length of a definite-length item, which cannot
+// exceed the input
+func (r *cborReader) readLength(n uint64) (int, error) {
+	if n > uint64(len(r.data)) {
+		return 0, ErrCBORTruncated
+	}
+	return int(n), nil
+}
+
+// readString reads a text string, definite or indefinite length
+func (r *cborReader) readString() (string, error) {
+	if err := r.skipTags(); err != nil {
+		return "", err
+	}
+	major, n, indefinite, err := r.readHeader()
+	if err != nil {
+		return "", err
+	}
+	if major != cborText {
+		return "", fmt.Errorf("cbor: expected text string, got major type %d", major>>5)
+	}
+	b, err := r.readChunks(cborText, n, indefinite)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readChunks returns the content of a string of a major type. An
+// indefinite-length string is the concatenation of definite-length chunks
+// of the same type.
+func (r *cborReader) readChunks(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		length, err := r.readLength(n)
+		if err != nil {
+			return nil, err
+		}
+		return r.next(length)
+	}
+
+	var out []byte
+	for !r.atBreak() {
+		chunkMajor, n, chunkIndefinite, err := r.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, fmt.Errorf("cbor: invalid chunk in indefinite-length string")
+		}
+		length, err := r.readLength(n)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := r.next(length)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+	}
+	r.pos++
+	return out, nil
+}
+
+func (r *cborReader) readInt() (int64, error) {
+	start := r.pos
+	out, err := r.appendJSON(nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(string(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cbor: expected integer at offset %d", start)
+	}
+	return i, nil
+}
+
+// appendJSON transcodes the next CBOR item to JSON
+func (r *cborReader) appendJSON(dst []byte, depth int) ([]byte, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("cbor: nesting exceeds %d levels", maxCBORDepth)
+	}
+
+	if err := r.skipTags(); err != nil {
+		return nil, err
+	}
+	if r.atBreak() {
+		return nil, fmt.Errorf("cbor: unexpected break")
+	}
+	initial := r.pos
+	major, n, indefinite, err := r.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return strconv.AppendUint(dst, n, 10), nil
+	case cborNegInt:
+		if n == math.MaxUint64 {
+			return append(dst, "-18446744073709551616"...), nil
+		}
+		dst = append(dst, '-')
+		return strconv.AppendUint(dst, n+1, 10), nil
+	case cborBytes:
+		b, err := r.readChunks(cborBytes, n, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, '"')
+		dst = append(dst, base64.StdEncoding.EncodeToString(b)...)
+		return append(dst, '"'), nil
+	case cborText:
+		b, err := r.readChunks(cborText, n, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONStringBytes(dst, b)
+	case cborArray:
+		return r.appendJSONArray(dst, n, indefinite, depth)
+	case cborMap:
+		return r.appendJSONMap(dst, n, indefinite, depth)
+	}
+
+	// Major type 7: simple values and floats
+	switch info := r.data[initial] & 0x1f; info {
+	case 20:
+		return append(dst, "false"...), nil
+	case 21:
+		return append(dst, "true"...), nil
+	case 22, 23: // null, undefined
+		return append(dst, "null"...), nil
+	case 25:
+		return appendJSONFloat(dst, float64(halfToFloat32(uint16(n))), 32)
+	case 26:
+		return appendJSONFloat(dst, float64(math.Float32frombits(uint32(n))), 32)
+	case 27:
+		return appendJSONFloat(dst, math.Float64frombits(n), 64)
+	default:
+		return nil, fmt.Errorf("cbor: unsupported simple value 0x%02x", r.data[initial])
+	}
+}
+
+func (r *cborReader) appendJSONMap(dst []byte, n uint64, indefinite bool, depth int) ([]byte, error) {
+	dst = append(dst, '{')
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite && r.atBreak() {
+			r.pos++
+			break
+		}
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		key, err := r.readString()
+		if err != nil {
+			return nil, fmt.Errorf("cbor: map keys must be text strings: %w", err)
+		}
+		if dst, err = appendJSONStringBytes(dst, []byte(key)); err != nil {
+			return nil, err
+		}
+		dst = append(dst, ':')
+		if dst, err = r.appendJSON(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+func (r *cborReader) appendJSONArray(dst []byte, n uint64, indefinite bool, depth int) ([]byte, error) {
+	dst = append(dst, '[')
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite && r.atBreak() {
+			r.pos++
+			break
+		}
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		var err error
+		if dst, err = r.appendJSON(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+// halfToFloat32 widens an IEEE 754 half-precision float
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+
+	switch exp {
+	case 0:
+		// Zero or subnormal
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		// Infinity or NaN
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	default:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+	}
+}
@@ -0,0 +1,216 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCBORTranscodingRoundTrip(t *testing.T) {
+	inputs := []string{
+		`null`,
+		`true`,
+		`false`,
+		`"hello"`,
+		`0`,
+		`23`,
+		`24`,
+		`-1`,
+		`-25`,
+		`65536`,
+		`-2147483649`,
+		`18446744073709551615`,
+		`1.5`,
+		`1e+21`,
+		`1e-7`,
+		`[]`,
+		`{}`,
+		`{"z":1,"a":[1,2,{"nested":"value"}],"m":null}`,
+		`"line\nbreak \u003c\u003e \u0026 \"quoted\" ünïcode"`,
+		`[0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21,22,23,24,25]`,
+	}
+
+	for _, input := range inputs {
+		encoded, err := JSONToCBOR([]byte(input))
+		if err != nil {
+			t.Errorf("JSONToCBOR(%s) failed: %v", input, err)
+			continue
+		}
+
+		output, err := CBORToJSON(encoded)
+		if err != nil {
+			t.Errorf("CBORToJSON(%s) failed: %v", input, err)
+			continue
+		}
+
+		if string(output) != input {
+			t.Errorf("Round trip mismatch: got %s, want %s", output, input)
+		}
+	}
+}
+
+// TestCBORDecodesForeignEncodings covers encodings other CBOR libraries
+// produce but JSONToCBOR never writes
+func TestCBORDecodesForeignEncodings(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"half float", []byte{0xf9, 0x3e, 0x00}, `1.5`},
+		{"negative half float", []byte{0xf9, 0xc4, 0x00}, `-4`},
+		{"single float", []byte{0xfa, 0x47, 0xc3, 0x50, 0x00}, `100000`},
+		{"undefined", []byte{0xf7}, `null`},
+		{"byte string", []byte{0x43, 0x01, 0x02, 0x03}, `"AQID"`},
+		{"tagged", []byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, `1363896240`},
+		{"self-described", []byte{0xd9, 0xd9, 0xf7, 0x80}, `[]`},
+		{"smallest negative", []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `-18446744073709551616`},
+		{"indefinite array", []byte{0x9f, 0x01, 0x9f, 0xff, 0xff}, `[1,[]]`},
+		{"indefinite map", []byte{0xbf, 0x61, 'a', 0x01, 0xff}, `{"a":1}`},
+		{"indefinite string", []byte{0x7f, 0x62, 'a', 'b', 0x61, 'c', 0xff}, `"abc"`},
+	} {
+		output, err := CBORToJSON(tc.input)
+		if err != nil {
+			t.Errorf("%s: decoding failed: %v", tc.name, err)
+			continue
+		}
+		if string(output) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, output, tc.want)
+		}
+	}
+}
+
+func TestCBOREnvelopeSignatureSurvivesRoundTrip(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	typed := newTestToolCall(t)
+	if err := typed.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign envelope: %v", err)
+	}
+
+	data, err := json.Marshal(typed)
+	if err != nil {
+		t.Fatalf("Failed to marshal envelope: %v", err)
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("Failed to unmarshal envelope: %v", err)
+	}
+
+	encoded, err := CBORCodec.Marshal(&envelope)
+	if err != nil {
+		t.Fatalf("Failed to encode CBOR envelope: %v", err)
+	}
+
+	if len(encoded) >= len(data) {
+		t.Errorf("Expected CBOR (%d bytes) to be smaller than JSON (%d bytes)", len(encoded), len(data))
+	}
+
+	decoded, err := CBORCodec.Unmarshal(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode CBOR envelope: %v", err)
+	}
+
+	if decoded.Type != envelope.Type || decoded.Agent != envelope.Agent || decoded.TS != envelope.TS || decoded.Nonce != envelope.Nonce {
+		t.Errorf("Header mismatch after round trip: %+v", decoded.CommonHeaders)
+	}
+
+	if !bytes.Equal(decoded.Body, envelope.Body) {
+		t.Errorf("Body mismatch after round trip:\ngot  %s\nwant %s", decoded.Body, envelope.Body)
+	}
+
+	if err := decoded.Verify(pubKey); err != nil {
+		t.Errorf("Signature verification failed after CBOR round trip: %v", err)
+	}
+}
+
+func TestParseEnvelopeWithCBORCodec(t *testing.T) {
+	envelope := NewEnvelope(EnvelopeEmitEvent, "test.agent")
+	envelope.Body = json.RawMessage(`{"event":"sensor.temperature","payload":{"celsius":21.5}}`)
+
+	encoded, err := CBORCodec.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Failed to encode CBOR envelope: %v", err)
+	}
+
+	codec := CodecForContentType("application/cbor")
+	if codec != CBORCodec {
+		t.Fatalf("Expected CBOR codec, got %v", codec)
+	}
+
+	generic, err := ParseEnvelopeWithCodec(encoded, codec)
+	if err != nil {
+		t.Fatalf("Failed to parse CBOR envelope: %v", err)
+	}
+
+	var body EmitEventBody
+	if err := generic.GetBodyAs(&body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	if body.Event != "sensor.temperature" || body.Payload["celsius"] != 21.5 {
+		t.Errorf("Unexpected body: %+v", body)
+	}
+
+	// Both transcoders are reachable through the codec
+	transcoded, err := TranscodeFromJSON(codec, envelope.Body)
+	if err != nil {
+		t.Fatalf("Failed to transcode body: %v", err)
+	}
+	back, err := TranscodeToJSON(codec, transcoded)
+	if err != nil || !bytes.Equal(back, envelope.Body) {
+		t.Errorf("Expected body to transcode back unchanged, got %s (%v)", back, err)
+	}
+}
+
+func TestCBORRejectsMalformedInput(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0xa1},                         // map missing entries
+		{0x65, 'a', 'b'},               // truncated string
+		{0x7a, 0xff, 0xff, 0xff, 0xff}, // string longer than input
+		{0xa1, 0x01, 0x02},             // non-string map key
+		{0x1c},                         // reserved additional information
+		{0xff},                         // break outside an indefinite item
+		{0x9f, 0x01},                   // unterminated indefinite array
+		{0x7f, 0x41, 'a', 0xff},        // byte string chunk in a text string
+		{0xf8, 0x20},                   // unassigned simple value
+		{0xf9, 0x7c, 0x00},             // infinity
+		{0x01, 0x02},                   // trailing bytes
+	}
+
+	for _, input := range inputs {
+		if _, err := CBORToJSON(input); err == nil {
+			t.Errorf("Expected error for input %x", input)
+		}
+	}
+
+	if _, err := CBORToJSON([]byte{0x65, 'a'}); !errors.Is(err, ErrCBORTruncated) {
+		t.Errorf("Expected ErrCBORTruncated, got %v", err)
+	}
+	if _, err := CBORCodec.Unmarshal([]byte{0x81, 0x01}); err == nil {
+		t.Error("Expected error for non-map envelope")
+	}
+}
+
+func BenchmarkEnvelopeEncodeCBOR(b *testing.B) {
+	envelope := benchmarkEnvelope(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, _ := CBORCodec.Marshal(envelope)
+		b.SetBytes(int64(len(data)))
+	}
+}
+
+func BenchmarkEnvelopeDecodeCBOR(b *testing.B) {
+	data, _ := CBORCodec.Marshal(benchmarkEnvelope(b))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		CBORCodec.Unmarshal(data)
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+)
+
+// NewCertificateRequest creates a key and a PEM certificate request naming
+// an agent, to send as RegisterAgentBody.CSR to a broker that issues client
+// certificates
+func NewCertificateRequest(agentID string) (string, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: agentID},
+	}, key)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), key, nil
+}
+
+// IssuedCertificate pairs the PEM certificate a broker issued with the key
+// its request was made with, for use as a TLS client certificate
+func IssuedCertificate(certPEM string, key *ecdsa.PrivateKey) (tls.Certificate, error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("issued certificate does not match the key: %w", err)
+	}
+	return cert, nil
+}
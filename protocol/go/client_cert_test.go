@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCertificateRequest(t *testing.T) {
+	csrPEM, key, err := NewCertificateRequest("weather-agent")
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		t.Fatalf("Expected a PEM certificate request, got %q", csrPEM)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		t.Fatalf("Expected a valid self-signed request: %v", err)
+	}
+	if csr.Subject.CommonName != "weather-agent" {
+		t.Errorf("Expected the request to name the agent, got %q", csr.Subject.CommonName)
+	}
+
+	// The certificate issued for the request pairs with its key
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: csr.Subject, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if _, err := IssuedCertificate(certPEM, key); err != nil {
+		t.Errorf("Expected the issued certificate to load: %v", err)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := IssuedCertificate(certPEM, other); err == nil {
+		t.Error("Expected a certificate not to load with another key")
+	}
+}
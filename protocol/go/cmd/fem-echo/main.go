@@ -0,0 +1,67 @@
+// Command fem-echo is a test harness for FEM SDK authors. POST an envelope
+// to it and it answers with what it verified: the exact bytes the signature
+// must cover, their hash, and whether the signature checks out. When it
+// does not, the report names the likely cause.
+//
+//	fem-echo -listen localhost:8089
+//	curl -s --data-binary @envelope.json localhost:8089/?pubkey=<base64 key>
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxEnvelopeSize bounds the envelopes fem-echo reads
+const maxEnvelopeSize = 1 << 20
+
+func main() {
+	listen := flag.String("listen", "localhost:8089", "Address to serve on")
+	pubkey := flag.String("pubkey", "", "Base64 Ed25519 public key to verify every envelope with, unless the request names one")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, usage)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxEnvelopeSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key := *pubkey
+		if requested := r.Header.Get("X-FEM-Public-Key"); requested != "" {
+			key = requested
+		}
+		if requested := r.URL.Query().Get("pubkey"); requested != "" {
+			key = requested
+		}
+		report := Diagnose(data, key, time.Now())
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Verified {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	})
+
+	log.Printf("fem-echo listening on http://%s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+const usage = `fem-echo: POST an envelope to check its signature.
+
+The public key is taken from, in order: the pubkey query parameter, the
+X-FEM-Public-Key header, the -pubkey flag, and the body of a registerAgent
+envelope. The report gives the bytes the signature must cover (signedBytes),
+their SHA-256, and hints when verification fails.
+`
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// Report is fem-echo's answer to an envelope
+type Report struct {
+	Type        string   `json:"type,omitempty"`
+	Agent       string   `json:"agent,omitempty"`
+	TS          int64    `json:"ts,omitempty"`
+	Nonce       string   `json:"nonce,omitempty"`
+	ClockSkewMs int64    `json:"clockSkewMs"`           // How far ts is behind the harness's clock
+	SignedBytes string   `json:"signedBytes,omitempty"` // Exactly what the signature must cover
+	SignedHash  string   `json:"signedSha256,omitempty"`
+	BodyHash    string   `json:"bodySha256,omitempty"` // Of the compact body
+	PublicKey   string   `json:"publicKey,omitempty"`
+	KeySource   string   `json:"keySource,omitempty"`
+	Verified    bool     `json:"verified"`
+	Problems    []string `json:"problems"`
+	Hint        string   `json:"hint,omitempty"` // What the signature does cover, when it is not SignedBytes
+
+	// Where the envelope as sent, minus sig, first differs from SignedBytes
+	FirstDifference *Difference `json:"firstDifference,omitempty"`
+}
+
+// Difference shows where two serializations part
+type Difference struct {
+	Offset    int    `json:"offset"`
+	Sent      string `json:"sent"`
+	Canonical string `json:"canonical"`
+}
+
+// sigField matches the sig member of a JSON object as sent
+var sigField = regexp.MustCompile(`,?\s*"sig"\s*:\s*"[^"]*"`)
+
+// Diagnose checks an envelope's signature with the base64 public key, or
+// with the key a registerAgent envelope carries if key is empty
+func Diagnose(data []byte, key string, now time.Time) *Report {
+	report := &Report{Problems: []string{}}
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	envelope, err := protocol.ParseEnvelope(data)
+	if err != nil {
+		problem("%v", err)
+		return report
+	}
+	report.Type, report.Agent, report.TS, report.Nonce = string(envelope.Type), envelope.Agent, envelope.TS, envelope.Nonce
+	if report.TS != 0 {
+		report.ClockSkewMs = now.UnixMilli() - report.TS
+	}
+	for _, field := range []struct {
+		name    string
+		missing bool
+	}{
+		{"type", envelope.Type == ""},
+		{"agent", envelope.Agent == ""},
+		{"ts", envelope.TS == 0},
+		{"nonce", envelope.Nonce == ""},
+		{"body", len(envelope.Body) == 0},
+	} {
+		if field.missing {
+			problem("%s is missing", field.name)
+		}
+	}
+	if report.TS != 0 && report.TS < 1e12 {
+		problem("ts %d looks like seconds; it must be Unix milliseconds", report.TS)
+	}
+
+	signed, err := envelope.SigningBytes()
+	if err != nil {
+		problem("body is not valid JSON: %v", err)
+		return report
+	}
+	report.SignedBytes = string(signed)
+	report.SignedHash = hash(signed)
+	var body bytes.Buffer
+	if json.Compact(&body, envelope.Body) == nil {
+		report.BodyHash = hash(body.Bytes())
+	}
+
+	if key == "" && envelope.Type == protocol.EnvelopeRegisterAgent {
+		var register protocol.RegisterAgentBody
+		if envelope.GetBodyAs(&register) == nil {
+			key, report.KeySource = register.PubKey, "body.pubkey"
+		}
+	} else if key != "" {
+		report.KeySource = "request"
+	}
+	report.PublicKey = key
+	if key == "" {
+		problem("no public key: pass ?pubkey=, X-FEM-Public-Key or -pubkey")
+		return report
+	}
+	publicKey, err := protocol.ParsePublicKey(key)
+	if err != nil {
+		problem("%v", err)
+		return report
+	}
+	alg, _ := protocol.KeyAlgorithm(publicKey)
+	if claimed := envelope.Alg; claimed != alg && !(claimed == "" && alg == protocol.AlgEdDSA) {
+		problem("alg is %q, but the key is for %s", claimed, alg)
+		return report
+	}
+
+	if envelope.Sig == "" {
+		problem("sig is missing")
+		return report
+	}
+	signature, err := base64.StdEncoding.DecodeString(envelope.Sig)
+	if err != nil {
+		problem("sig is not standard base64 with padding: %v", err)
+		return report
+	}
+	if alg == protocol.AlgEdDSA && len(signature) != ed25519.SignatureSize {
+		problem("sig decodes to %d bytes; an Ed25519 signature is %d", len(signature), ed25519.SignatureSize)
+		return report
+	}
+
+	if protocol.VerifySignature(publicKey, signed, signature) == nil {
+		report.Verified = true
+		return report
+	}
+	if legacy, err := json.Marshal(unsigned(envelope)); err == nil && alg == protocol.AlgEdDSA && protocol.VerifySignature(publicKey, legacy, signature) == nil {
+		report.Verified = true
+		report.Hint = "the signature covers the legacy serialization, with fields in the order type, agent, ts, nonce, body and <, > and & escaped; brokers still accept it, but sign signedBytes instead"
+		return report
+	}
+	problem("signature does not verify over signedBytes")
+
+	sent := sigField.ReplaceAll(data, nil)
+	sent = bytes.Replace(bytes.TrimSpace(sent), []byte("{,"), []byte("{"), 1)
+	report.FirstDifference = firstDifference(sent, signed)
+	report.Hint = guessSignedBytes(envelope, sent, body.Bytes(), publicKey, signature)
+	return report
+}
+
+// guessSignedBytes tries serializations SDKs commonly sign by mistake,
+// describing the first the signature verifies over
+func guessSignedBytes(envelope *protocol.GenericEnvelope, sent, body []byte, publicKey protocol.PublicKey, signature []byte) string {
+	type candidate struct {
+		hint  string
+		bytes func() []byte
+	}
+	candidates := []candidate{
+		{"the signature covers the body alone; it must cover the whole envelope without sig", func() []byte {
+			canonical, _ := protocol.Canonicalize(body)
+			return canonical
+		}},
+		{"the signature covers the envelope with <, > or & escaped as \\u003c, \\u003e and \\u0026; leave them as they are", func() []byte {
+			signed, _ := envelope.SigningBytes()
+			return []byte(htmlEscaper.Replace(string(signed)))
+		}},
+		{"the signature covers the envelope with its keys unsorted; sort the keys of every object by their UTF-16 code units", func() []byte {
+			var out bytes.Buffer
+			encoder := json.NewEncoder(&out)
+			encoder.SetEscapeHTML(false)
+			encoder.Encode(unsigned(envelope))
+			return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+		}},
+		{`the signature covers the envelope with "sig":""; leave sig out entirely`, func() []byte {
+			signed, _ := envelope.SigningBytes()
+			return bytes.Replace(signed, []byte(`,"ts":`), []byte(`,"sig":"","ts":`), 1)
+		}},
+		{"the signature covers the envelope as sent, minus sig; sign the canonical form in signedBytes instead", func() []byte {
+			return sent
+		}},
+	}
+	for _, c := range candidates {
+		if data := c.bytes(); data != nil && protocol.VerifySignature(publicKey, data, signature) == nil {
+			return c.hint
+		}
+	}
+	return "the signature matches none of the common mistakes; check that the key is the agent's and that the body was not changed after signing"
+}
+
+// htmlEscaper escapes <, > and & as encoding/json does by default
+var htmlEscaper = strings.NewReplacer("<", `\u003c`, ">", `\u003e`, "&", `\u0026`)
+
+// unsigned is the envelope as signed
+func unsigned(envelope *protocol.GenericEnvelope) protocol.Envelope {
+	headers := envelope.CommonHeaders
+	headers.Sig = ""
+	return protocol.Envelope{Type: envelope.Type, CommonHeaders: headers, Body: envelope.Body}
+}
+
+// firstDifference locates where sent and canonical part, or nil if equal
+func firstDifference(sent, canonical []byte) *Difference {
+	if bytes.Equal(sent, canonical) {
+		return nil
+	}
+	offset := 0
+	for offset < len(sent) && offset < len(canonical) && sent[offset] == canonical[offset] {
+		offset++
+	}
+	excerpt := func(data []byte) string {
+		end := offset + 24
+		if end > len(data) {
+			end = len(data)
+		}
+		return string(data[offset:end])
+	}
+	return &Difference{Offset: offset, Sent: excerpt(sent), Canonical: excerpt(canonical)}
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func TestDiagnose(t *testing.T) {
+	publicKey, privateKey, _ := protocol.GenerateKeyPair()
+	key := protocol.EncodePublicKey(publicKey)
+	now := time.Now()
+
+	ping := protocol.NewPing("agent-a", "<hello & goodbye>")
+	ping.Sign(privateKey)
+	data, _ := json.Marshal(ping)
+	report := Diagnose(data, key, now)
+	if !report.Verified || len(report.Problems) != 0 || report.Hint != "" || report.FirstDifference != nil {
+		t.Fatalf("Expected a verified report, got %+v", report)
+	}
+	if !strings.HasPrefix(report.SignedBytes, `{"agent":"agent-a","body":{"payload":"<hello & goodbye>"}`) || strings.Contains(report.SignedBytes, `"sig"`) || len(report.SignedHash) != 64 {
+		t.Errorf("Unexpected signed bytes %s (%s)", report.SignedBytes, report.SignedHash)
+	}
+
+	// signedAs sends an envelope whose signature covers signed
+	signedAs := func(signed, sent string) []byte {
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signed)))
+		return []byte(strings.Replace(sent, `"body":`, `"sig":"`+sig+`","body":`, 1))
+	}
+	headers := `"agent":"agent-a","ts":` + jsonNumber(ping.TS) + `,"nonce":"` + ping.Nonce + `"`
+	canonical := `{"agent":"agent-a","body":{"payload":"<hi & bye>"},"nonce":"` + ping.Nonce + `","ts":` + jsonNumber(ping.TS) + `,"type":"ping"}`
+	escaped := strings.NewReplacer("<", `\u003c`, "&", `\u0026`, ">", `\u003e`).Replace(canonical)
+	unsorted := `{"type":"ping",` + headers + `,"body":{"payload":"<hi & bye>"}}`
+	legacy := `{"type":"ping",` + headers + `,"body":{"payload":"\u003chi \u0026 bye\u003e"}}`
+	ownOrder := `{"type":"ping","ts":` + jsonNumber(ping.TS) + `,"agent":"agent-a","nonce":"` + ping.Nonce + `","body":{"payload":"hi"}}`
+
+	tests := []struct {
+		name string
+		data []byte
+		hint string
+	}{
+		{"body only", signedAs(`{"payload":"<hi & bye>"}`, canonical), "body alone"},
+		{"escaped", signedAs(escaped, canonical), "leave them as they are"},
+		{"unsorted keys", signedAs(unsorted, unsorted), "keys unsorted"},
+		{"empty sig", signedAs(strings.Replace(canonical, `,"ts":`, `,"sig":"","ts":`, 1), canonical), "leave sig out"},
+		{"own serialization", signedAs(ownOrder, ownOrder), "as sent"},
+		{"unknown", signedAs("something else", canonical), "none of the common mistakes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := Diagnose(tt.data, key, now)
+			if report.Verified || !strings.Contains(report.Hint, tt.hint) {
+				t.Errorf("Expected hint %q, got %+v", tt.hint, report)
+			}
+		})
+	}
+
+	// Where a serialization of the sender's own parts from the canonical one
+	report = Diagnose(signedAs(ownOrder, ownOrder), key, now)
+	if diff := report.FirstDifference; diff == nil || diff.Offset != len(`{"`) || !strings.HasPrefix(diff.Sent, "type") || !strings.HasPrefix(diff.Canonical, "agent") {
+		t.Errorf("Expected the first difference at the first key, got %+v", diff)
+	}
+
+	// Signatures over the legacy serialization verify, with a warning
+	if report := Diagnose(signedAs(legacy, legacy), key, now); !report.Verified || !strings.Contains(report.Hint, "legacy") {
+		t.Errorf("Expected the legacy signature to verify with a hint, got %+v", report)
+	}
+
+	// A registerAgent envelope is checked with the key it registers
+	register := &protocol.RegisterAgentEnvelope{
+		BaseEnvelope: protocol.BaseEnvelope{
+			Type:          protocol.EnvelopeRegisterAgent,
+			CommonHeaders: protocol.CommonHeaders{Agent: "agent-a", TS: now.UnixMilli(), Nonce: protocol.NewNonce()},
+		},
+		Body: protocol.RegisterAgentBody{PubKey: key, Capabilities: []string{"code.execute"}},
+	}
+	register.Sign(privateKey)
+	data, _ = json.Marshal(register)
+	if report := Diagnose(data, "", now); !report.Verified || report.KeySource != "body.pubkey" {
+		t.Errorf("Expected the registered key to verify, got %+v", report)
+	}
+
+	if report := Diagnose([]byte(`{"type":"ping","agent":"a","ts":1700000000,"nonce":"n","body":{}}`), key, now); len(report.Problems) < 2 || !strings.Contains(report.Problems[0], "seconds") {
+		t.Errorf("Expected a seconds timestamp and missing sig to be reported, got %v", report.Problems)
+	}
+}
+
+func jsonNumber(n int64) string {
+	data, _ := json.Marshal(n)
+	return string(data)
+}
@@ -0,0 +1,35 @@
+// Command fem-schemas writes the JSON Schema of every envelope body,
+// derived from the protocol package's body types, to a directory. The
+// package embeds the schemas it writes; run it through go generate after
+// changing a body type.
+//
+//	go run ./cmd/fem-schemas schemas
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fep-fem/protocol"
+)
+
+func main() {
+	dir := "schemas"
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, envType := range protocol.BodySchemaTypes() {
+		schema, err := protocol.GenerateBodySchema(envType)
+		if err != nil {
+			log.Fatalf("%s: %v", envType, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, string(envType)+".schema.json"), schema, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// EncX25519AES256GCM is the algorithm of sealed boxes: an X25519 key
+// agreement with a one-time key, HKDF-SHA256 and AES-256-GCM
+const EncX25519AES256GCM = "X25519-HKDF-SHA256-A256GCM"
+
+// sealInfo binds derived keys to their use
+const sealInfo = "fem sealed box v1"
+
+// SealedBox is data encrypted to one recipient's encryption key, so the
+// brokers relaying it cannot read it
+type SealedBox struct {
+	Alg        string `json:"alg"`
+	EPK        string `json:"epk"`        // Base64 one-time X25519 public key of the sender
+	Ciphertext []byte `json:"ciphertext"` // Base64 in JSON, with the GCM tag
+}
+
+// GenerateEncryptionKey generates an X25519 key for receiving sealed
+// bodies. It is separate from the agent's signing key; agents publish its
+// public half with their registration.
+func GenerateEncryptionKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodeEncryptionKey encodes an X25519 public key to base64
+func EncodeEncryptionKey(key *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+// ParseEncryptionKey decodes an X25519 public key encoded by
+// EncodeEncryptionKey
+func ParseEncryptionKey(encoded string) (*ecdh.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key encoding: %w", err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext to recipient. The box opens only with the same
+// additional data, which ties it to its context, such as a request ID.
+func Seal(recipient *ecdh.PublicKey, plaintext, additionalData []byte) (*SealedBox, error) {
+	ephemeral, err := GenerateEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %w", err)
+	}
+	aead, err := sealCipher(shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+	// The key is used once, so the nonce may be fixed
+	nonce := make([]byte, aead.NonceSize())
+	return &SealedBox{
+		Alg:        EncX25519AES256GCM,
+		EPK:        EncodeEncryptionKey(ephemeral.PublicKey()),
+		Ciphertext: aead.Seal(nil, nonce, plaintext, additionalData),
+	}, nil
+}
+
+// Open decrypts a sealed box with the recipient's key and the additional
+// data it was sealed with
+func Open(key *ecdh.PrivateKey, box *SealedBox, additionalData []byte) ([]byte, error) {
+	if box == nil {
+		return nil, fmt.Errorf("%w: nothing sealed", ErrDecryption)
+	}
+	if box.Alg != EncX25519AES256GCM {
+		return nil, fmt.Errorf("%w: unknown algorithm %q", ErrDecryption, box.Alg)
+	}
+	ephemeral, err := ParseEncryptionKey(box.EPK)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	aead, err := sealCipher(shared, ephemeral, key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), box.Ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	return plaintext, nil
+}
+
+// sealCipher derives a box's AES-256-GCM key from the shared secret with
+// HKDF-SHA256, salted with both public keys
+func sealCipher(shared []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, append(ephemeral.Bytes(), recipient.Bytes()...))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(append([]byte(sealInfo), 1))
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptParameters seals the call's parameters to the recipient agent's
+// encryption key, leaving the tool and request ID for the broker to route
+// by. The call must have its request ID, which the parameters are tied to.
+func (e *ToolCallEnvelope) EncryptParameters(recipient *ecdh.PublicKey) error {
+	if e.Body.RequestID == "" {
+		return fmt.Errorf("%w: requestId", ErrMissingField)
+	}
+	data, err := json.Marshal(e.Body.Parameters)
+	if err != nil {
+		return err
+	}
+	if e.Body.Enc, err = Seal(recipient, data, []byte(e.Body.RequestID)); err != nil {
+		return err
+	}
+	e.Body.Parameters = map[string]interface{}{}
+	return nil
+}
+
+// DecryptParameters opens the parameters sealed by EncryptParameters. A
+// call without sealed parameters is left as it is.
+func (e *ToolCallEnvelope) DecryptParameters(key *ecdh.PrivateKey) error {
+	if e.Body.Enc == nil {
+		return nil
+	}
+	data, err := Open(key, e.Body.Enc, []byte(e.Body.RequestID))
+	if err != nil {
+		return err
+	}
+	var parameters map[string]interface{}
+	if err := json.Unmarshal(data, &parameters); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	e.Body.Parameters, e.Body.Enc = parameters, nil
+	return nil
+}
+
+// EncryptResult seals the result to the caller's encryption key
+func (e *ToolResultEnvelope) EncryptResult(recipient *ecdh.PublicKey) error {
+	data, err := json.Marshal(e.Body.Result)
+	if err != nil {
+		return err
+	}
+	if e.Body.Enc, err = Seal(recipient, data, []byte(e.Body.RequestID)); err != nil {
+		return err
+	}
+	e.Body.Result = nil
+	return nil
+}
+
+// DecryptResult opens the result sealed by EncryptResult. A result
+// without a sealed result is left as it is.
+func (e *ToolResultEnvelope) DecryptResult(key *ecdh.PrivateKey) error {
+	if e.Body.Enc == nil {
+		return nil
+	}
+	data, err := Open(key, e.Body.Enc, []byte(e.Body.RequestID))
+	if err != nil {
+		return err
+	}
+	var result interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	e.Body.Result, e.Body.Enc = result, nil
+	return nil
+}
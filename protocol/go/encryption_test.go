@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedToolCall(t *testing.T) {
+	pub, priv, _ := GenerateKeyPair()
+	agentKey, _ := GenerateEncryptionKey()
+	otherKey, _ := GenerateEncryptionKey()
+	recipient, err := ParseEncryptionKey(EncodeEncryptionKey(agentKey.PublicKey()))
+	if err != nil {
+		t.Fatalf("ParseEncryptionKey failed: %v", err)
+	}
+
+	call, err := NewToolCall("caller-agent").Tool("vault.store").RequestID("req-1").
+		Param("secret", "hunter2").EncryptFor(recipient).SignWith(priv).Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if len(call.Body.Parameters) != 0 || call.Body.Enc == nil || call.Body.Enc.Alg != EncX25519AES256GCM {
+		t.Fatalf("Expected the parameters sealed, got %+v", call.Body)
+	}
+	if err := call.Verify(pub); err != nil {
+		t.Errorf("Expected the sealed call signed: %v", err)
+	}
+
+	// The box survives the wire and opens only with the agent's key
+	data, _ := json.Marshal(call)
+	var received ToolCallEnvelope
+	json.Unmarshal(data, &received)
+	if err := received.DecryptParameters(otherKey); !errors.Is(err, ErrDecryption) {
+		t.Errorf("Expected another key refused, got %v", err)
+	}
+	moved := received
+	moved.Body.RequestID = "req-2"
+	if err := moved.DecryptParameters(agentKey); !errors.Is(err, ErrDecryption) {
+		t.Errorf("Expected the box refused under another request, got %v", err)
+	}
+	if err := received.DecryptParameters(agentKey); err != nil || received.Body.Parameters["secret"] != "hunter2" || received.Body.Enc != nil {
+		t.Errorf("Expected the parameters opened, got %+v, %v", received.Body, err)
+	}
+
+	// Results are sealed back to the caller the same way
+	callerKey, _ := GenerateEncryptionKey()
+	result, _ := NewToolResult("vault-agent", "req-1").Result(map[string]interface{}{"stored": true}).Build()
+	if err := result.EncryptResult(callerKey.PublicKey()); err != nil || result.Body.Result != nil {
+		t.Fatalf("Expected the result sealed, got %+v, %v", result.Body, err)
+	}
+	if err := result.DecryptResult(callerKey); err != nil || result.Body.Result.(map[string]interface{})["stored"] != true {
+		t.Errorf("Expected the result opened, got %+v, %v", result.Body, err)
+	}
+
+	if _, err := NewToolCall("caller-agent").Tool("vault.store").EncryptFor(recipient).Build(); err != nil {
+		t.Errorf("Expected the builder's request ID to bind the box, got %v", err)
+	}
+	if _, err := ParseEncryptionKey("c2hvcnQ="); err == nil {
+		t.Error("Expected a short key refused")
+	}
+}
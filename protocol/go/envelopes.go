@@ -2,7 +2,8 @@ package protocol
 
 import (
 	"crypto/ed25519"
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -18,11 +19,65 @@ const (
 	EnvelopeRenderInstruction  EnvelopeType = "renderInstruction"
 	EnvelopeToolCall           EnvelopeType = "toolCall"
 	EnvelopeToolResult         EnvelopeType = "toolResult"
+	EnvelopeToolResultChunk    EnvelopeType = "toolResultChunk"
 	EnvelopeRevoke             EnvelopeType = "revoke"
 	// MCP Integration envelope types
 	EnvelopeDiscoverTools      EnvelopeType = "discoverTools"
 	EnvelopeToolsDiscovered    EnvelopeType = "toolsDiscovered"
 	EnvelopeEmbodimentUpdate   EnvelopeType = "embodimentUpdate"
+	// Event subscription envelope types
+	EnvelopeSubscribe   EnvelopeType = "subscribe"
+	EnvelopeUnsubscribe EnvelopeType = "unsubscribe"
+	// Liveness envelope types
+	EnvelopePing           EnvelopeType = "ping"
+	EnvelopePong           EnvelopeType = "pong"
+	EnvelopeAgentHeartbeat EnvelopeType = "agentHeartbeat"
+	// Lifecycle envelope types
+	EnvelopeDeregisterAgent EnvelopeType = "deregisterAgent"
+	// Streaming tool envelope types
+	EnvelopeStreamOpen   EnvelopeType = "streamOpen"
+	EnvelopeStreamData   EnvelopeType = "streamData"
+	EnvelopeStreamWindow EnvelopeType = "streamWindow"
+	EnvelopeStreamClose  EnvelopeType = "streamClose"
+	// Federation envelope types
+	EnvelopeRegistryDigest EnvelopeType = "registryDigest"
+	EnvelopeRegistryDelta  EnvelopeType = "registryDelta"
+	EnvelopeCatalogSummary EnvelopeType = "catalogSummary"
+	// Fleet envelope types
+	EnvelopeBroadcast EnvelopeType = "broadcast"
+	// Upgrade envelope types
+	EnvelopeBrokerDraining EnvelopeType = "brokerDraining"
+	EnvelopeStateHandoff   EnvelopeType = "stateHandoff"
+	// Error envelope types
+	EnvelopeError EnvelopeType = "error"
+	// Delivery envelope types
+	EnvelopeAck   EnvelopeType = "ack"
+	EnvelopeBatch EnvelopeType = "batch"
+)
+
+// EventAgentDeregistered is emitted by the broker to subscribers when an
+// agent deregisters; the payload carries "agent" and "reason"
+const EventAgentDeregistered = "agent.deregistered"
+
+// EventToolSchemaChanged is sent by the broker to agents that recently
+// called a tool whose schema changed incompatibly; the payload carries
+// "agent", "tool", "version", "previousVersion" and "breaking"
+const EventToolSchemaChanged = "tool.schemaChanged"
+
+// EventQuotaWarning is sent by the broker to an agent whose use of a rate
+// limit crossed a warning threshold or began its grace period; the payload
+// carries "type", "used" and "threshold", in percent, and "graceMs"
+const EventQuotaWarning = "quota.warning"
+
+// EventCapabilityRevoked is sent by the broker to an agent when some of its
+// capabilities or tools are revoked; the payload carries "agent",
+// "capabilities", "tools" and "reason"
+const EventCapabilityRevoked = "capability.revoked"
+
+// Stream flow control limits, in bytes of streamData payload
+const (
+	DefaultStreamWindow = 256 << 10 // Opener's window when streamOpen gives none
+	MaxStreamWindow     = 16 << 20  // Most unused credit one end may hold
 )
 
 // CommonHeaders contains headers present in all FEP envelopes
@@ -30,7 +85,8 @@ type CommonHeaders struct {
 	Agent string `json:"agent"`           // UTF-8 agent identifier
 	TS    int64  `json:"ts"`              // Unix timestamp in milliseconds
 	Nonce string `json:"nonce"`           // Replay guard
-	Sig   string `json:"sig,omitempty"`   // Base64(Ed25519(body))
+	Alg   string `json:"alg,omitempty"`   // Signature algorithm; Ed25519 if empty
+	Sig   string `json:"sig,omitempty"`   // Base64 signature by alg
 }
 
 // BaseEnvelope is the base structure for all FEP envelopes
@@ -53,6 +109,14 @@ type RegisterAgentBody struct {
 	MCPEndpoint     string                 `json:"mcpEndpoint,omitempty"`    // HTTP URL for MCP server
 	BodyDefinition  *BodyDefinition        `json:"bodyDefinition,omitempty"` // Environment-specific tool definitions
 	EnvironmentType string                 `json:"environmentType,omitempty"`// Environment type (e.g., "local", "cloud")
+	DiscoveryProxy  string                 `json:"discoveryProxy,omitempty"` // Agent (or broker) answering discovery and relaying tool calls for this agent
+	CSR             string                 `json:"csr,omitempty"`            // PEM certificate request for a client certificate from the broker's CA
+	Challenge       string                 `json:"challenge,omitempty"`      // Broker's registration challenge, echoed back
+	ChallengeSig    string                 `json:"challengeSig,omitempty"`   // Signature of the challenge by the registered key, see SignKeyProof
+	Invitation      string                 `json:"invitation,omitempty"`     // Invitation token from the broker's operator, approving the agent
+	BootstrapToken  string                 `json:"bootstrapToken,omitempty"` // Encoded BootstrapToken, required by brokers closed to registration
+	Acks            bool                   `json:"acks,omitempty"`           // The agent acks envelopes pushed to it; the broker redelivers those it does not
+	EncKey          string                 `json:"encKey,omitempty"`         // Base64 X25519 key callers seal tool parameters to, see EncryptParameters
 }
 
 // RegisterBrokerEnvelope registers a broker node
@@ -63,11 +127,20 @@ type RegisterBrokerEnvelope struct {
 
 type RegisterBrokerBody struct {
 	BrokerID     string   `json:"brokerId"`
-	Endpoint     string   `json:"endpoint"`      // TLS endpoint
-	PubKey       string   `json:"pubkey"`        // Base64 Ed25519 public key
+	Endpoint     string   `json:"endpoint" fem:"required"` // TLS endpoint
+	PubKey       string   `json:"pubkey"`                  // Base64 Ed25519 public key
 	Capabilities []string `json:"capabilities"`
+	Role         string   `json:"role,omitempty"` // BrokerRoleChild when registering with a parent
+	// Federation the broker belongs to, and the chain of trust from one of
+	// its anchors to PubKey
+	Federation string      `json:"federation,omitempty"`
+	TrustChain []TrustLink `json:"trustChain,omitempty"`
 }
 
+// BrokerRoleChild marks a registerBroker from a child broker joining its
+// parent in a broker hierarchy
+const BrokerRoleChild = "child"
+
 // EmitEventEnvelope emits events from agents
 type EmitEventEnvelope struct {
 	BaseEnvelope
@@ -75,7 +148,7 @@ type EmitEventEnvelope struct {
 }
 
 type EmitEventBody struct {
-	Event   string                 `json:"event"`
+	Event   string                 `json:"event" fem:"required"`
 	Payload map[string]interface{} `json:"payload"`
 }
 
@@ -86,8 +159,40 @@ type RenderInstructionEnvelope struct {
 }
 
 type RenderInstructionBody struct {
-	Instruction string                 `json:"instruction"`
-	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Instruction string                 `json:"instruction" fem:"required"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty" fem:"was=context"` // Sent as "context" by older agents
+	RequestID   string                 `json:"requestId,omitempty"`
+	Renderer    string                 `json:"renderer,omitempty"` // Agent to render with, instead of any that can
+}
+
+// RenderCapabilityPrefix starts the capability an agent advertises for each
+// instruction it renders, such as "render.chart", or "render.*" for all
+const RenderCapabilityPrefix = "render."
+
+// RenderCapability is the capability advertised by agents rendering an
+// instruction
+func RenderCapability(instruction string) string {
+	return RenderCapabilityPrefix + instruction
+}
+
+// RenderArtifact is one output of a rendered instruction, carried inline in
+// Data or by reference at URL
+type RenderArtifact struct {
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Data        string `json:"data,omitempty"` // Base64 content, for artifacts carried inline
+	URL         string `json:"url,omitempty"`  // Where the artifact is fetched from, for references
+	Size        int64  `json:"size,omitempty"`
+}
+
+// RenderResultBody is the broker's answer to a renderInstruction. Agents
+// rendering an instruction return its artifacts as {"artifacts": [...]}.
+type RenderResultBody struct {
+	Status      string           `json:"status"`
+	RequestID   string           `json:"requestId"`
+	Instruction string           `json:"instruction"`
+	Renderer    string           `json:"renderer"` // Agent that rendered it, or the broker's ID
+	Artifacts   []RenderArtifact `json:"artifacts"`
 }
 
 // ToolCallEnvelope requests tool execution
@@ -97,9 +202,32 @@ type ToolCallEnvelope struct {
 }
 
 type ToolCallBody struct {
-	Tool       string                 `json:"tool"`
+	Tool       string                 `json:"tool" fem:"required"`
 	Parameters map[string]interface{} `json:"parameters"`
 	RequestID  string                 `json:"requestId"`
+	Seq        uint64                 `json:"seq,omitempty"`      // Ordered delivery: the sender's sequence number for the recipient, from 1
+	Priority   int                    `json:"priority,omitempty"` // Set by the broker from the tool's service tier; higher runs first
+	// IdempotencyKey makes retries safe: the broker runs the tool once per
+	// key from the same caller and replays the result to repeated calls
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// StreamResult asks for the result as toolResultChunk envelopes pushed
+	// over the caller's WebSocket or event stream as the tool sends them
+	StreamResult bool `json:"streamResult,omitempty"`
+	// Deadline is the Unix time in milliseconds after which the caller
+	// stops waiting; the broker gives up on the call then if that comes
+	// before its own tool timeout
+	Deadline int64 `json:"deadline,omitempty"`
+	// Variants names the parameter variants of the tool the caller speaks;
+	// the broker picks one the tool offers and sets Variant to it on the
+	// call it delivers
+	Variants []string `json:"variants,omitempty"`
+	Variant  string   `json:"variant,omitempty"`
+	// Enc holds the parameters sealed to the providing agent, which only
+	// it can open; see EncryptParameters
+	Enc *SealedBox `json:"enc,omitempty"`
+	// Receipt asks for a DeliveryReceipt with the result, timing each leg
+	// of the call
+	Receipt bool `json:"receipt,omitempty"`
 }
 
 // ToolResultEnvelope returns tool execution results
@@ -109,12 +237,47 @@ type ToolResultEnvelope struct {
 }
 
 type ToolResultBody struct {
-	RequestID string                 `json:"requestId"`
-	Success   bool                   `json:"success"`
-	Result    interface{}            `json:"result,omitempty"`
-	Error     string                 `json:"error,omitempty"`
+	RequestID       string                 `json:"requestId"`
+	Success         bool                   `json:"success"`
+	Result          interface{}            `json:"result,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+	Busy            bool                   `json:"busy,omitempty"`            // The agent had no room for the call; it was not run
+	RetryAfterMs    int64                  `json:"retryAfterMs,omitempty"`    // With busy, when the agent expects to have room
+	Code            string                 `json:"code,omitempty"`            // Why the broker refused the call, such as ErrorPermissionDenied
+	Details         map[string]interface{} `json:"details,omitempty"`         // With code, what the refusal was about
+	Attachment      *AttachmentClaim       `json:"attachment,omitempty"`      // A result the agent serves directly instead
+	AttachmentGrant *AttachmentGrant       `json:"attachmentGrant,omitempty"` // Set by the broker, lets the caller fetch the attachment
+	Replayed        bool                   `json:"replayed,omitempty"`        // The result of an earlier call with the same idempotency key; the tool did not run again
+	Chunks          uint64                 `json:"chunks,omitempty"`          // The result was streamed to the caller in this many toolResultChunk envelopes
+	Variant         string                 `json:"variant,omitempty"`         // Set by the broker, the parameter variant the call was made in
+	Enc             *SealedBox             `json:"enc,omitempty"`             // The result sealed to the caller; see EncryptResult
+	Receipt         *DeliveryReceipt       `json:"receipt,omitempty"`         // When the call asked for one, where its time went
 }
 
+// ToolResultChunkEnvelope carries one piece of a tool result too large, or
+// too slow, to send whole. The agent sends chunks for the request ID in
+// place of a toolResult; the final chunk ends the call.
+type ToolResultChunkEnvelope struct {
+	BaseEnvelope
+	Body ToolResultChunkBody `json:"body"`
+}
+
+type ToolResultChunkBody struct {
+	RequestID string `json:"requestId" fem:"required"`
+	Seq       uint64 `json:"seq"`             // Chunk number, starting at 1
+	Final     bool   `json:"final,omitempty"` // The last chunk of the result
+	Data      []byte `json:"data,omitempty"`  // Base64 in JSON
+	Error     string `json:"error,omitempty"` // With final, why the tool failed after streaming part of its result
+}
+
+// ErrorPermissionDenied is the toolResult code for a call whose caller does
+// not hold a capability the tool requires
+const ErrorPermissionDenied = "PERMISSION_DENIED"
+
+// ErrorNoCommonVariant is the toolResult code for a call naming parameter
+// variants none of the tool's providers offer
+const ErrorNoCommonVariant = "NO_COMMON_VARIANT"
+
 // RevokeEnvelope revokes registrations/capabilities
 type RevokeEnvelope struct {
 	BaseEnvelope
@@ -122,10 +285,16 @@ type RevokeEnvelope struct {
 }
 
 type RevokeBody struct {
-	Target string `json:"target"` // Agent or broker ID to revoke
-	Reason string `json:"reason,omitempty"`
+	Target     string `json:"target"`               // Agent or broker ID to revoke
+	Capability string `json:"capability,omitempty"` // Revoke only this capability of the agent, and the tools it covers
+	Tool       string `json:"tool,omitempty"`       // Revoke only this tool of the agent
+	Reason     string `json:"reason,omitempty"`
 }
 
+// RevokeCapability is the capability a sender of revoke envelopes must
+// hold, granted by the broker rather than only declared
+const RevokeCapability = "fem.revoke"
+
 // MCP Integration envelope types
 
 // DiscoverToolsEnvelope requests MCP tool discovery
@@ -144,6 +313,7 @@ type ToolQuery struct {
 	EnvironmentType string   `json:"environmentType,omitempty"`
 	MaxResults      int      `json:"maxResults,omitempty"`
 	IncludeMetadata bool     `json:"includeMetadata,omitempty"`
+	Federated       bool     `json:"federated,omitempty"` // Also query federated peer brokers
 }
 
 // ToolsDiscoveredEnvelope returns discovered MCP tools
@@ -166,12 +336,98 @@ type DiscoveredTool struct {
 	EnvironmentType string       `json:"environmentType"`
 	MCPTools        []MCPTool    `json:"mcpTools"`
 	Metadata        ToolMetadata `json:"metadata,omitempty"`
+	ProxiedBy       string       `json:"proxiedBy,omitempty"` // Discovery proxy relaying calls to this agent
+	Broker          string       `json:"broker,omitempty"`    // Broker the agent is registered with, in federated results
+	EncKey          string       `json:"encKey,omitempty"`    // The agent's encryption key, for sealing parameters to it
 }
 
 type MCPTool struct {
-	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
-	InputSchema map[string]interface{} `json:"inputSchema"`
+	Name          string                 `json:"name"`
+	Description   string                 `json:"description"`
+	InputSchema   map[string]interface{} `json:"inputSchema"`
+	OutputSchema  map[string]interface{} `json:"outputSchema,omitempty"` // Shape of the tool's result
+	Visibility    ToolVisibility         `json:"visibility,omitempty"`    // Defaults to public
+	AllowedAgents []string               `json:"allowedAgents,omitempty"` // Agents allowed to call a private tool
+	Docs          string                 `json:"docs,omitempty"`          // Markdown usage documentation
+	Examples      []ToolExample          `json:"examples,omitempty"`      // Example invocations
+	Idempotent    bool                   `json:"idempotent,omitempty"`    // Safe to call more than once with the same parameters
+	Retry         *RetryPolicy           `json:"retry,omitempty"`         // Suggested retry policy for failed deliveries
+	Streaming     bool                   `json:"streaming,omitempty"`     // Served over a bidirectional stream opened with streamOpen
+	// Capabilities a caller must hold one of to call the tool
+	RequiredCapabilities []string `json:"requiredCapabilities,omitempty"`
+	// Variants are the parameter variants the tool accepts besides
+	// InputSchema, most preferred first, so callers can move to a new
+	// shape of the tool's parameters one at a time
+	Variants []ToolVariant `json:"variants,omitempty"`
+}
+
+// ToolVariant is one named shape of a tool's parameters and result
+type ToolVariant struct {
+	Name         string                 `json:"name"`
+	InputSchema  map[string]interface{} `json:"inputSchema,omitempty"`
+	OutputSchema map[string]interface{} `json:"outputSchema,omitempty"`
+}
+
+// ToolExample is a sample invocation of a tool, showing callers (human or
+// LLM) what correct parameters look like and what comes back
+type ToolExample struct {
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters"`
+	Result      interface{}            `json:"result,omitempty"`
+}
+
+// ToolVisibility controls who can discover and call a tool
+type ToolVisibility string
+
+const (
+	// ToolVisibilityPublic tools are discoverable and callable by anyone
+	ToolVisibilityPublic ToolVisibility = "public"
+	// ToolVisibilityUnlisted tools are hidden from discovery but callable by name
+	ToolVisibilityUnlisted ToolVisibility = "unlisted"
+	// ToolVisibilityPrivate tools are discoverable and callable only by allowlisted agents
+	ToolVisibilityPrivate ToolVisibility = "private"
+)
+
+// Valid reports whether v is a known visibility; empty means public
+func (v ToolVisibility) Valid() bool {
+	switch v {
+	case "", ToolVisibilityPublic, ToolVisibilityUnlisted, ToolVisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// DiscoverableBy reports whether agentID may see the tool in discovery results
+func (t MCPTool) DiscoverableBy(agentID string) bool {
+	switch t.Visibility {
+	case ToolVisibilityUnlisted:
+		return false
+	case ToolVisibilityPrivate:
+		return t.allows(agentID)
+	}
+	return true
+}
+
+// CallableBy reports whether agentID may call the tool. agentID must have
+// been verified; an empty one stands for an anonymous caller, which no
+// allowlist names.
+func (t MCPTool) CallableBy(agentID string) bool {
+	if t.Visibility == ToolVisibilityPrivate {
+		return t.allows(agentID)
+	}
+	return true
+}
+
+func (t MCPTool) allows(agentID string) bool {
+	if agentID == "" {
+		return false
+	}
+	for _, allowed := range t.AllowedAgents {
+		if allowed == agentID {
+			return true
+		}
+	}
+	return false
 }
 
 type ToolMetadata struct {
@@ -202,6 +458,306 @@ type BodyDefinition struct {
 	Metadata     map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// SubscribeEnvelope subscribes an agent to emitted events
+type SubscribeEnvelope struct {
+	BaseEnvelope
+	Body SubscribeBody `json:"body"`
+}
+
+type SubscribeBody struct {
+	Events   []string `json:"events" fem:"required"` // Event type patterns, e.g. "sensor.*"
+	Endpoint string   `json:"endpoint,omitempty"`    // Delivery URL, defaults to the agent's registered endpoint
+}
+
+// UnsubscribeEnvelope removes event subscriptions
+type UnsubscribeEnvelope struct {
+	BaseEnvelope
+	Body UnsubscribeBody `json:"body"`
+}
+
+type UnsubscribeBody struct {
+	Events []string `json:"events,omitempty"` // Patterns to remove, empty removes all
+}
+
+// PingEnvelope checks liveness and measures round-trip latency
+type PingEnvelope struct {
+	BaseEnvelope
+	Body PingBody `json:"body"`
+}
+
+type PingBody struct {
+	Payload string `json:"payload,omitempty"` // Opaque data echoed back in the pong
+}
+
+// PongEnvelope answers a ping
+type PongEnvelope struct {
+	BaseEnvelope
+	Body PongBody `json:"body"`
+}
+
+type PongBody struct {
+	PingNonce         string `json:"pingNonce"`         // Nonce of the ping being answered
+	PingTS            int64  `json:"pingTs"`            // Timestamp of the ping being answered
+	Payload           string `json:"payload,omitempty"` // Payload copied from the ping
+	SignatureVerified bool   `json:"signatureVerified"` // Whether the ping signature was checked against a known key
+	PubKey            string `json:"pubkey,omitempty"`  // Base64 Ed25519 key the pong is signed with
+}
+
+// AgentHeartbeatEnvelope tells the broker a registered agent is still alive.
+// Agents that stop sending heartbeats are marked stale and later evicted.
+type AgentHeartbeatEnvelope struct {
+	BaseEnvelope
+	Body AgentHeartbeatBody `json:"body"`
+}
+
+type AgentHeartbeatBody struct {
+	Status   string `json:"status,omitempty"`   // Optional agent-defined status, such as "ok" or "busy"
+	InFlight int    `json:"inFlight,omitempty"` // Tool calls the agent is running
+	Queued   int    `json:"queued,omitempty"`   // Tool calls waiting for a free slot
+}
+
+// DeregisterAgentEnvelope removes the sending agent and its MCP tools from
+// the broker
+type DeregisterAgentEnvelope struct {
+	BaseEnvelope
+	Body DeregisterAgentBody `json:"body"`
+}
+
+type DeregisterAgentBody struct {
+	Reason string `json:"reason,omitempty"` // Optional reason passed on to subscribers
+}
+
+// StreamOpenEnvelope starts a bidirectional stream to a streaming tool. The
+// broker relays it, and every later frame of the stream, over the live
+// connections of the opener and the agent serving the tool.
+type StreamOpenEnvelope struct {
+	BaseEnvelope
+	Body StreamOpenBody `json:"body"`
+}
+
+type StreamOpenBody struct {
+	StreamID   string                 `json:"streamId" fem:"required"` // Chosen by the opener, unique while the stream is open
+	Tool       string                 `json:"tool"`                    // Tool name, or "agentID/toolName"
+	Parameters map[string]interface{} `json:"parameters,omitempty"`    // Tool parameters, as in toolCall
+	Window     int64                  `json:"window,omitempty"`        // Bytes the opener accepts before granting more; DefaultStreamWindow if zero
+}
+
+// StreamDataEnvelope carries one frame of stream data from either end
+type StreamDataEnvelope struct {
+	BaseEnvelope
+	Body StreamDataBody `json:"body"`
+}
+
+type StreamDataBody struct {
+	StreamID string `json:"streamId"`
+	Seq      uint64 `json:"seq"`               // Per-sender frame number, starting at 1
+	Channel  string `json:"channel,omitempty"` // Tool-defined channel, such as "stdin", "stdout" or "stderr"
+	Data     []byte `json:"data"`              // Base64 in JSON
+}
+
+// StreamWindowEnvelope grants the other end of a stream credit to send more
+// data. The tool's first window grant accepts the stream.
+type StreamWindowEnvelope struct {
+	BaseEnvelope
+	Body StreamWindowBody `json:"body"`
+}
+
+type StreamWindowBody struct {
+	StreamID string `json:"streamId"`
+	Credit   int64  `json:"credit"` // Additional bytes of data the other end may send
+}
+
+// StreamCloseEnvelope ends a stream. Either end may close it; the broker
+// closes it when an end disconnects.
+type StreamCloseEnvelope struct {
+	BaseEnvelope
+	Body StreamCloseBody `json:"body"`
+}
+
+type StreamCloseBody struct {
+	StreamID string `json:"streamId"`
+	Error    string `json:"error,omitempty"`    // Why the stream failed, empty on a clean close
+	ExitCode *int   `json:"exitCode,omitempty"` // Exit status of process-like tools
+}
+
+// RegistryDigestEnvelope is sent by a broker to a peer to pull the registry
+// entries it is missing. The peer answers with a registryDelta.
+type RegistryDigestEnvelope struct {
+	BaseEnvelope
+	Body RegistryDigestBody `json:"body"`
+}
+
+type RegistryDigestBody struct {
+	Versions map[string]map[string]int64 `json:"versions"` // Known entry versions, by origin broker and then agent ID
+}
+
+// RegistryDeltaEnvelope answers a registryDigest with every entry newer than
+// the version the digest lists for it
+type RegistryDeltaEnvelope struct {
+	BaseEnvelope
+	Body RegistryDeltaBody `json:"body"`
+}
+
+type RegistryDeltaBody struct {
+	Entries []RegistryEntry `json:"entries"`
+}
+
+// RegistryEntry is one agent's public tools as last known to the broker the
+// agent is registered with. Versions only grow, so the highest one wins.
+type RegistryEntry struct {
+	Broker  string          `json:"broker"` // Origin broker the agent is registered with
+	AgentID string          `json:"agentId"`
+	Version int64           `json:"version"`           // Origin's Unix time in milliseconds of the change
+	Removed bool            `json:"removed,omitempty"` // The agent has left the origin broker
+	Tool    *DiscoveredTool `json:"tool,omitempty"`    // Discovery listing, absent when removed
+}
+
+// CatalogSummaryEnvelope is sent by a child broker to its parent, listing
+// the tools reachable below it
+type CatalogSummaryEnvelope struct {
+	BaseEnvelope
+	Body CatalogSummaryBody `json:"body"`
+}
+
+type CatalogSummaryBody struct {
+	Tools []CatalogTool `json:"tools"`
+}
+
+// CatalogTool summarizes the agents below a broker offering one tool
+type CatalogTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"inputSchema,omitempty"`
+	Providers   int                    `json:"providers"` // Agents offering the tool
+}
+
+// BroadcastEnvelope delivers one event to a group of agents. The broker
+// stores the envelope once and pushes the same signed bytes to every
+// recipient, tracking delivery to each; recipients offline when it is sent
+// receive it when they next connect, until it expires.
+type BroadcastEnvelope struct {
+	BaseEnvelope
+	Body BroadcastBody `json:"body"`
+}
+
+type BroadcastBody struct {
+	Recipients []string               `json:"recipients,omitempty"` // Agent IDs to deliver to
+	Capability string                 `json:"capability,omitempty"` // Also deliver to every agent with this capability
+	Event      string                 `json:"event" fem:"required"`
+	Payload    map[string]interface{} `json:"payload,omitempty"`
+	TTL        int64                  `json:"ttl,omitempty"` // Milliseconds pending deliveries are kept; broker default if zero
+}
+
+// BrokerDrainingEnvelope tells agents that the broker is shutting down for
+// an upgrade and names the broker to move to. The draining broker pushes it
+// over live connections and answers envelopes it no longer accepts with it.
+type BrokerDrainingEnvelope struct {
+	BaseEnvelope
+	Body BrokerDrainingBody `json:"body"`
+}
+
+type BrokerDrainingBody struct {
+	Successor string `json:"successor"` // ID of the broker taking over
+	Endpoint  string `json:"endpoint"`  // URL agents reach the successor at
+}
+
+// StateHandoffEnvelope is sent by a draining broker to its successor with
+// the state agents would otherwise lose: broadcasts still owed to offline
+// recipients, and the tool calls awaiting results, whose results the
+// successor relays back if they arrive there
+type StateHandoffEnvelope struct {
+	BaseEnvelope
+	Body StateHandoffBody `json:"body"`
+}
+
+type StateHandoffBody struct {
+	Broadcasts []HandoffBroadcast `json:"broadcasts"`
+	Requests   []HandoffRequest   `json:"requests"`
+}
+
+// HandoffBroadcast is a broadcast with the recipients it is still owed to
+type HandoffBroadcast struct {
+	ID         string          `json:"id"`
+	Sender     string          `json:"sender"`
+	Event      string          `json:"event"`
+	Envelope   json.RawMessage `json:"envelope"` // The broadcast envelope as its sender signed it
+	Expires    int64           `json:"expires"`  // Unix time in milliseconds
+	Recipients []string        `json:"recipients"`
+}
+
+// HandoffRequest is a tool call the draining broker is waiting on
+type HandoffRequest struct {
+	RequestID string `json:"requestId"`
+	Caller    string `json:"caller"`
+	Target    string `json:"target"` // Agent expected to send the result
+	Tool      string `json:"tool"`
+	Expires   int64  `json:"expires"` // Unix time in milliseconds
+}
+
+// ErrorEnvelope is the broker's answer to an envelope it refused or failed
+// to handle, sent with the failure's HTTP status so clients can act on the
+// code instead of parsing text
+type ErrorEnvelope struct {
+	BaseEnvelope
+	Body ErrorBody `json:"body"`
+}
+
+type ErrorBody struct {
+	Code          string                 `json:"code"`                    // Machine-readable reason, such as ErrorRateLimited
+	Message       string                 `json:"message"`                 // Human-readable description
+	Retryable     bool                   `json:"retryable"`               // Whether sending the envelope again may succeed
+	CorrelationID string                 `json:"correlationId,omitempty"` // Nonce of the envelope that failed
+	RetryAfterMs  int64                  `json:"retryAfterMs,omitempty"`  // With retryable, how long to wait first
+	Details       map[string]interface{} `json:"details,omitempty"`
+}
+
+// AckEnvelope confirms that an agent received envelopes the broker pushed
+// over its connection. Agents that register with acks get pushed events and
+// tool calls again until they ack them or they expire, so they must ignore
+// nonces they have already handled.
+type AckEnvelope struct {
+	BaseEnvelope
+	Body AckBody `json:"body"`
+}
+
+type AckBody struct {
+	Nonces []string `json:"nonces"` // Nonces of the pushed envelopes received
+}
+
+// MaxBatchSize bounds the envelopes one batch may carry
+const MaxBatchSize = 100
+
+// BatchEnvelope carries several envelopes from one agent in one request.
+// The broker handles them in order, as if each had been sent alone, and
+// answers with a BatchResponse holding each one's outcome.
+type BatchEnvelope struct {
+	BaseEnvelope
+	Body BatchBody `json:"body"`
+}
+
+type BatchBody struct {
+	Envelopes []json.RawMessage `json:"envelopes" fem:"required"` // Signed envelopes of the batch's agent
+}
+
+// BatchResult is the outcome of one envelope of a batch. A failed
+// envelope's error envelope is its response, with the message repeated in
+// error.
+type BatchResult struct {
+	Index    int             `json:"index"`
+	Type     EnvelopeType    `json:"type,omitempty"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// BatchResponse is the broker's answer to a batch
+type BatchResponse struct {
+	Status    string        `json:"status"`
+	Processed int           `json:"processed"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+}
+
 // Envelope is a generic envelope that can hold any envelope type
 type Envelope struct {
 	Type EnvelopeType `json:"type"`
@@ -211,137 +767,522 @@ type Envelope struct {
 
 // Sign signs the envelope with the given private key
 func (e *Envelope) Sign(privateKey ed25519.PrivateKey) error {
-	// Remove existing signature
-	e.Sig = ""
-	
-	// Marshal the envelope without signature
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	
-	// Sign the data
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	
-	return nil
+	return SignEnvelope(e, privateKey)
 }
 
-// Sign methods for specific envelope types
+// Sign and Verify methods for specific envelope types
 func (e *RegisterAgentEnvelope) Sign(privateKey ed25519.PrivateKey) error {
-	// Remove existing signature
-	e.Sig = ""
-	
-	// Marshal the envelope without signature
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	
-	// Sign the data
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	
-	return nil
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *RegisterAgentEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
 }
 
 func (e *RegisterBrokerEnvelope) Sign(privateKey ed25519.PrivateKey) error {
-	e.Sig = ""
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	return nil
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *RegisterBrokerEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *RenderInstructionEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *RenderInstructionEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
 }
 
 func (e *ToolCallEnvelope) Sign(privateKey ed25519.PrivateKey) error {
-	e.Sig = ""
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	return nil
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *ToolCallEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
 }
 
 func (e *ToolResultEnvelope) Sign(privateKey ed25519.PrivateKey) error {
-	e.Sig = ""
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	return nil
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *ToolResultEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *ToolResultChunkEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *ToolResultChunkEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
 }
 
 // MCP Integration envelope signing methods
 
 func (e *DiscoverToolsEnvelope) Sign(privateKey ed25519.PrivateKey) error {
-	e.Sig = ""
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	return nil
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *DiscoverToolsEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
 }
 
 func (e *ToolsDiscoveredEnvelope) Sign(privateKey ed25519.PrivateKey) error {
-	e.Sig = ""
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	return nil
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *ToolsDiscoveredEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
 }
 
 func (e *EmbodimentUpdateEnvelope) Sign(privateKey ed25519.PrivateKey) error {
-	e.Sig = ""
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-	signature := ed25519.Sign(privateKey, data)
-	e.Sig = base64.StdEncoding.EncodeToString(signature)
-	return nil
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *EmbodimentUpdateEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Event subscription envelope signing methods
+
+func (e *SubscribeEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *SubscribeEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *UnsubscribeEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *UnsubscribeEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Liveness envelope signing methods
+
+func (e *PingEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *PingEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *PongEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *PongEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *AgentHeartbeatEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *AgentHeartbeatEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Lifecycle envelope signing methods
+
+func (e *DeregisterAgentEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *DeregisterAgentEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Streaming tool envelope signing methods
+
+func (e *StreamOpenEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *StreamOpenEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *StreamDataEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *StreamDataEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *StreamWindowEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *StreamWindowEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *StreamCloseEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *StreamCloseEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Federation envelope signing methods
+
+func (e *RegistryDigestEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *RegistryDigestEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *RegistryDeltaEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *RegistryDeltaEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *CatalogSummaryEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *CatalogSummaryEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Fleet envelope signing methods
+
+func (e *BroadcastEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *BroadcastEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Upgrade envelope signing methods
+
+func (e *BrokerDrainingEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *BrokerDrainingEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *StateHandoffEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *StateHandoffEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Error envelope signing methods
+
+func (e *ErrorEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *ErrorEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+// Delivery envelope signing methods
+
+func (e *AckEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *AckEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
+}
+
+func (e *BatchEnvelope) Sign(privateKey ed25519.PrivateKey) error {
+	return SignEnvelope(e, privateKey)
+}
+
+func (e *BatchEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return VerifyEnvelope(e, publicKey)
 }
 
 // Verify verifies the envelope signature with the given public key
 func (e *Envelope) Verify(publicKey ed25519.PublicKey) error {
-	if e.Sig == "" {
-		return fmt.Errorf("envelope has no signature")
+	return VerifyEnvelope(e, publicKey)
+}
+
+// NewPing creates a ping envelope carrying an optional payload
+func NewPing(agent, payload string) *PingEnvelope {
+	return &PingEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopePing,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: PingBody{Payload: payload},
+	}
+}
+
+// NewPong creates the pong answering ping, sent by agent
+func NewPong(agent string, ping *PingEnvelope) *PongEnvelope {
+	return &PongEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopePong,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: PongBody{
+			PingNonce: ping.Nonce,
+			PingTS:    ping.TS,
+			Payload:   ping.Body.Payload,
+		},
+	}
+}
+
+// NewAgentHeartbeat creates a heartbeat for agent with an optional status
+func NewAgentHeartbeat(agent, status string) *AgentHeartbeatEnvelope {
+	return &AgentHeartbeatEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeAgentHeartbeat,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: AgentHeartbeatBody{Status: status},
+	}
+}
+
+// NewDeregisterAgent creates a deregistration for agent with an optional
+// reason
+func NewDeregisterAgent(agent, reason string) *DeregisterAgentEnvelope {
+	return &DeregisterAgentEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeDeregisterAgent,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: DeregisterAgentBody{Reason: reason},
+	}
+}
+
+// NewStreamOpen creates a streamOpen for tool with the given stream ID,
+// parameters and initial receive window
+func NewStreamOpen(agent, streamID, tool string, parameters map[string]interface{}, window int64) *StreamOpenEnvelope {
+	return &StreamOpenEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeStreamOpen,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: StreamOpenBody{StreamID: streamID, Tool: tool, Parameters: parameters, Window: window},
+	}
+}
+
+// NewStreamData creates frame seq of a stream on the given channel
+func NewStreamData(agent, streamID string, seq uint64, channel string, data []byte) *StreamDataEnvelope {
+	return &StreamDataEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeStreamData,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: StreamDataBody{StreamID: streamID, Seq: seq, Channel: channel, Data: data},
+	}
+}
+
+// NewStreamWindow grants the other end of a stream credit bytes
+func NewStreamWindow(agent, streamID string, credit int64) *StreamWindowEnvelope {
+	return &StreamWindowEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeStreamWindow,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: StreamWindowBody{StreamID: streamID, Credit: credit},
+	}
+}
+
+// NewStreamClose closes a stream, with errMsg empty on a clean close
+func NewStreamClose(agent, streamID, errMsg string) *StreamCloseEnvelope {
+	return &StreamCloseEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeStreamClose,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: StreamCloseBody{StreamID: streamID, Error: errMsg},
+	}
+}
+
+// NewRegistryDigest creates a registryDigest listing the entry versions a
+// broker already knows
+func NewRegistryDigest(broker string, versions map[string]map[string]int64) *RegistryDigestEnvelope {
+	return &RegistryDigestEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeRegistryDigest,
+			CommonHeaders: CommonHeaders{
+				Agent: broker,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: RegistryDigestBody{Versions: versions},
+	}
+}
+
+// NewRegistryDelta creates a registryDelta carrying entries
+func NewRegistryDelta(broker string, entries []RegistryEntry) *RegistryDeltaEnvelope {
+	return &RegistryDeltaEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeRegistryDelta,
+			CommonHeaders: CommonHeaders{
+				Agent: broker,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: RegistryDeltaBody{Entries: entries},
+	}
+}
+
+// NewCatalogSummary creates a catalogSummary listing the tools below a broker
+func NewCatalogSummary(broker string, tools []CatalogTool) *CatalogSummaryEnvelope {
+	return &CatalogSummaryEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeCatalogSummary,
+			CommonHeaders: CommonHeaders{
+				Agent: broker,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: CatalogSummaryBody{Tools: tools},
+	}
+}
+
+// NewBroadcast creates a broadcast of event to recipients and to agents
+// with capability; either may be empty
+func NewBroadcast(agent string, recipients []string, capability, event string, payload map[string]interface{}) *BroadcastEnvelope {
+	return &BroadcastEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeBroadcast,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: BroadcastBody{Recipients: recipients, Capability: capability, Event: event, Payload: payload},
 	}
-	
-	// Decode signature
-	signature, err := base64.StdEncoding.DecodeString(e.Sig)
-	if err != nil {
-		return fmt.Errorf("invalid signature encoding: %w", err)
+}
+
+// NewBrokerDraining creates a notice from a draining broker naming its
+// successor
+func NewBrokerDraining(broker, successor, endpoint string) *BrokerDrainingEnvelope {
+	return &BrokerDrainingEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeBrokerDraining,
+			CommonHeaders: CommonHeaders{
+				Agent: broker,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: BrokerDrainingBody{Successor: successor, Endpoint: endpoint},
 	}
-	
-	// Store and remove signature
-	sig := e.Sig
-	e.Sig = ""
-	defer func() { e.Sig = sig }()
-	
-	// Marshal envelope without signature
-	data, err := json.Marshal(e)
-	if err != nil {
-		return err
+}
+
+// NewStateHandoff creates the handoff of a draining broker's state
+func NewStateHandoff(broker string, body StateHandoffBody) *StateHandoffEnvelope {
+	return &StateHandoffEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeStateHandoff,
+			CommonHeaders: CommonHeaders{
+				Agent: broker,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: body,
 	}
-	
-	// Verify signature
-	if !ed25519.Verify(publicKey, data, signature) {
-		return fmt.Errorf("signature verification failed")
+}
+
+// NewError creates a broker's answer to an envelope that failed
+func NewError(broker string, body ErrorBody) *ErrorEnvelope {
+	return &ErrorEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeError,
+			CommonHeaders: CommonHeaders{
+				Agent: broker,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: body,
+	}
+}
+
+// NewAck creates an agent's ack of the pushed envelopes with the given
+// nonces
+func NewAck(agent string, nonces ...string) *AckEnvelope {
+	return &AckEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeAck,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: AckBody{Nonces: nonces},
+	}
+}
+
+// NewBatch creates a batch of an agent's marshaled envelopes
+func NewBatch(agent string, envelopes ...json.RawMessage) *BatchEnvelope {
+	return &BatchEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeBatch,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: BatchBody{Envelopes: envelopes},
 	}
-	
-	return nil
 }
 
 // NewEnvelope creates a new envelope with common headers
@@ -351,13 +1292,21 @@ func NewEnvelope(envType EnvelopeType, agent string) *Envelope {
 		CommonHeaders: CommonHeaders{
 			Agent: agent,
 			TS:    time.Now().UnixMilli(),
-			Nonce: generateNonce(),
+			Nonce: NewNonce(),
 		},
 	}
 }
 
-// generateNonce generates a random nonce for replay protection
-func generateNonce() string {
-	// In production, use crypto/rand
-	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().Unix())
+// NonceSize is the number of random bytes in a nonce generated by NewNonce
+const NonceSize = 16
+
+// NewNonce generates a cryptographically random 128-bit nonce for replay
+// protection, hex encoded. Nonces are opaque to the parser, so envelopes
+// carrying the older timestamp-based format are still accepted.
+func NewNonce() string {
+	var b [NonceSize]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("protocol: failed to generate nonce: %v", err))
+	}
+	return hex.EncodeToString(b[:])
 }
\ No newline at end of file
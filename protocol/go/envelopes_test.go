@@ -2,7 +2,10 @@ package protocol
 
 import (
 	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -95,6 +98,27 @@ func TestEnvelopeSignAndVerify(t *testing.T) {
 	}
 }
 
+func TestSigningBytes(t *testing.T) {
+	publicKey, privateKey, _ := GenerateKeyPair()
+	ping := NewPing("agent-a", "<tag>")
+	ping.Sign(privateKey)
+	data, _ := json.Marshal(ping)
+	envelope, _ := ParseEnvelope(data)
+
+	signed, err := envelope.SigningBytes()
+	if err != nil {
+		t.Fatalf("SigningBytes failed: %v", err)
+	}
+	want := `{"agent":"agent-a","body":{"payload":"<tag>"},"nonce":"` + ping.Nonce + `","ts":` + strconv.FormatInt(ping.TS, 10) + `,"type":"ping"}`
+	if string(signed) != want {
+		t.Errorf("Expected %s, got %s", want, signed)
+	}
+	signature, _ := base64.StdEncoding.DecodeString(envelope.Sig)
+	if !ed25519.Verify(publicKey, signed, signature) {
+		t.Error("Expected the signature to cover the signing bytes")
+	}
+}
+
 func TestEnvelopeSerialization(t *testing.T) {
 	envelope := NewEnvelope(EnvelopeEmitEvent, "test.agent")
 	envelope.Body = json.RawMessage(`{"event": "test", "payload": {"key": "value"}}`)
@@ -305,4 +329,476 @@ func TestEnvelopeValidation(t *testing.T) {
 	if err == nil {
 		t.Error("Expected verification to fail for invalid signature encoding")
 	}
-}
\ No newline at end of file
+}
+
+func TestNewNonce(t *testing.T) {
+	nonce := NewNonce()
+	if len(nonce) != NonceSize*2 {
+		t.Errorf("Expected nonce length %d, got %d", NonceSize*2, len(nonce))
+	}
+
+	if _, err := hex.DecodeString(nonce); err != nil {
+		t.Errorf("Expected hex encoded nonce, got %q: %v", nonce, err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		n := NewNonce()
+		if seen[n] {
+			t.Fatalf("Duplicate nonce generated: %s", n)
+		}
+		seen[n] = true
+	}
+}
+
+func TestLegacyNonceAccepted(t *testing.T) {
+	data := []byte(`{"type":"emitEvent","agent":"test.agent","ts":1700000000000,"nonce":"1700000000000000000-1700000000","body":{}}`)
+
+	envelope, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope with legacy nonce: %v", err)
+	}
+
+	if envelope.Nonce != "1700000000000000000-1700000000" {
+		t.Errorf("Expected legacy nonce to be preserved, got %s", envelope.Nonce)
+	}
+}
+
+func TestSubscribeEnvelope(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	envelope := &SubscribeEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeSubscribe,
+			CommonHeaders: CommonHeaders{
+				Agent: "test.agent",
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: SubscribeBody{
+			Events:   []string{"sensor.*", "deploy.finished"},
+			Endpoint: "https://agent.example.com/events",
+		},
+	}
+
+	if err := envelope.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign SubscribeEnvelope: %v", err)
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Failed to marshal SubscribeEnvelope: %v", err)
+	}
+
+	var generic Envelope
+	if err := json.Unmarshal(data, &generic); err != nil {
+		t.Fatalf("Failed to unmarshal generic envelope: %v", err)
+	}
+	if err := generic.Verify(pubKey); err != nil {
+		t.Errorf("Failed to verify SubscribeEnvelope signature: %v", err)
+	}
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+
+	typed, err := parsed.ParseTypedEnvelope()
+	if err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+
+	subscribe, ok := typed.(*SubscribeEnvelope)
+	if !ok {
+		t.Fatalf("Expected *SubscribeEnvelope, got %T", typed)
+	}
+
+	if len(subscribe.Body.Events) != 2 || subscribe.Body.Events[0] != "sensor.*" {
+		t.Errorf("Unexpected events: %v", subscribe.Body.Events)
+	}
+
+	if subscribe.Body.Endpoint != "https://agent.example.com/events" {
+		t.Errorf("Unexpected endpoint: %s", subscribe.Body.Endpoint)
+	}
+}
+
+func TestUnsubscribeEnvelope(t *testing.T) {
+	data := []byte(`{"type":"unsubscribe","agent":"test.agent","ts":1700000000000,"nonce":"n","body":{"events":["sensor.*"]}}`)
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+
+	typed, err := parsed.ParseTypedEnvelope()
+	if err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+
+	unsubscribe, ok := typed.(*UnsubscribeEnvelope)
+	if !ok {
+		t.Fatalf("Expected *UnsubscribeEnvelope, got %T", typed)
+	}
+
+	if len(unsubscribe.Body.Events) != 1 || unsubscribe.Body.Events[0] != "sensor.*" {
+		t.Errorf("Unexpected events: %v", unsubscribe.Body.Events)
+	}
+}
+
+func TestPingPongEnvelopes(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	ping := NewPing("test.agent", "hello")
+	if err := ping.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign PingEnvelope: %v", err)
+	}
+
+	data, err := json.Marshal(ping)
+	if err != nil {
+		t.Fatalf("Failed to marshal PingEnvelope: %v", err)
+	}
+
+	var generic Envelope
+	if err := json.Unmarshal(data, &generic); err != nil {
+		t.Fatalf("Failed to unmarshal generic envelope: %v", err)
+	}
+	if err := generic.Verify(pubKey); err != nil {
+		t.Errorf("Failed to verify PingEnvelope signature: %v", err)
+	}
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	typed, err := parsed.ParseTypedEnvelope()
+	if err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+	parsedPing, ok := typed.(*PingEnvelope)
+	if !ok {
+		t.Fatalf("Expected *PingEnvelope, got %T", typed)
+	}
+
+	pong := NewPong("test.broker", parsedPing)
+	if pong.Type != EnvelopePong || pong.Body.PingNonce != ping.Nonce || pong.Body.PingTS != ping.TS || pong.Body.Payload != "hello" {
+		t.Errorf("Pong does not echo ping: %+v", pong.Body)
+	}
+	if pong.Nonce == ping.Nonce {
+		t.Error("Expected pong to carry its own nonce")
+	}
+
+	if err := pong.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign PongEnvelope: %v", err)
+	}
+	data, err = json.Marshal(pong)
+	if err != nil {
+		t.Fatalf("Failed to marshal PongEnvelope: %v", err)
+	}
+	parsed, err = ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if typed, err = parsed.ParseTypedEnvelope(); err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+	if _, ok := typed.(*PongEnvelope); !ok {
+		t.Fatalf("Expected *PongEnvelope, got %T", typed)
+	}
+}
+
+func TestAgentHeartbeatEnvelope(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	heartbeat := NewAgentHeartbeat("test.agent", "busy")
+	if err := heartbeat.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign AgentHeartbeatEnvelope: %v", err)
+	}
+
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		t.Fatalf("Failed to marshal AgentHeartbeatEnvelope: %v", err)
+	}
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if err := parsed.Verify(pubKey); err != nil {
+		t.Errorf("Failed to verify AgentHeartbeatEnvelope signature: %v", err)
+	}
+
+	typed, err := parsed.ParseTypedEnvelope()
+	if err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+	parsedHeartbeat, ok := typed.(*AgentHeartbeatEnvelope)
+	if !ok {
+		t.Fatalf("Expected *AgentHeartbeatEnvelope, got %T", typed)
+	}
+	if parsedHeartbeat.Agent != "test.agent" || parsedHeartbeat.Body.Status != "busy" {
+		t.Errorf("Unexpected heartbeat: %+v", parsedHeartbeat)
+	}
+}
+func TestDeregisterAgentEnvelope(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	deregister := NewDeregisterAgent("test.agent", "shutting down")
+	if err := deregister.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign DeregisterAgentEnvelope: %v", err)
+	}
+
+	data, err := json.Marshal(deregister)
+	if err != nil {
+		t.Fatalf("Failed to marshal DeregisterAgentEnvelope: %v", err)
+	}
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if err := parsed.Verify(pubKey); err != nil {
+		t.Errorf("Failed to verify DeregisterAgentEnvelope signature: %v", err)
+	}
+
+	typed, err := parsed.ParseTypedEnvelope()
+	if err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+	if parsedDeregister, ok := typed.(*DeregisterAgentEnvelope); !ok || parsedDeregister.Body.Reason != "shutting down" {
+		t.Errorf("Unexpected typed envelope: %#v", typed)
+	}
+}
+
+func TestStreamEnvelopes(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	exitCode := 0
+	closeEnv := NewStreamClose("shell.agent", "s-1", "")
+	closeEnv.Body.ExitCode = &exitCode
+
+	envelopes := []interface {
+		Sign(ed25519.PrivateKey) error
+	}{
+		NewStreamOpen("test.agent", "s-1", "shell.exec", map[string]interface{}{"cmd": "sh"}, 4096),
+		NewStreamData("test.agent", "s-1", 1, "stdin", []byte("ls\n")),
+		NewStreamWindow("shell.agent", "s-1", 8192),
+		closeEnv,
+	}
+
+	for _, env := range envelopes {
+		if err := env.Sign(privKey); err != nil {
+			t.Fatalf("Failed to sign %T: %v", env, err)
+		}
+		data, err := json.Marshal(env)
+		if err != nil {
+			t.Fatalf("Failed to marshal %T: %v", env, err)
+		}
+
+		parsed, err := ParseEnvelope(data)
+		if err != nil {
+			t.Fatalf("Failed to parse %T: %v", env, err)
+		}
+		if err := parsed.Verify(pubKey); err != nil {
+			t.Errorf("Failed to verify %T signature: %v", env, err)
+		}
+
+		typed, err := parsed.ParseTypedEnvelope()
+		if err != nil {
+			t.Fatalf("Failed to parse typed %T: %v", env, err)
+		}
+		switch typed := typed.(type) {
+		case *StreamOpenEnvelope:
+			if typed.Body.Tool != "shell.exec" || typed.Body.Window != 4096 {
+				t.Errorf("Unexpected streamOpen body: %+v", typed.Body)
+			}
+		case *StreamDataEnvelope:
+			if string(typed.Body.Data) != "ls\n" || typed.Body.Seq != 1 || typed.Body.Channel != "stdin" {
+				t.Errorf("Unexpected streamData body: %+v", typed.Body)
+			}
+		case *StreamWindowEnvelope:
+			if typed.Body.Credit != 8192 {
+				t.Errorf("Unexpected streamWindow body: %+v", typed.Body)
+			}
+		case *StreamCloseEnvelope:
+			if typed.Body.ExitCode == nil || *typed.Body.ExitCode != 0 {
+				t.Errorf("Unexpected streamClose body: %+v", typed.Body)
+			}
+		default:
+			t.Errorf("Unexpected typed envelope %T", typed)
+		}
+	}
+}
+
+func TestRegistryGossipEnvelopes(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	digest := NewRegistryDigest("broker-a", map[string]map[string]int64{"broker-b": {"weather.agent": 1700000000000}})
+	delta := NewRegistryDelta("broker-b", []RegistryEntry{
+		{Broker: "broker-b", AgentID: "weather.agent", Version: 1700000000001, Tool: &DiscoveredTool{AgentID: "weather.agent"}},
+		{Broker: "broker-c", AgentID: "old.agent", Version: 1700000000002, Removed: true},
+	})
+
+	for _, env := range []interface {
+		Sign(ed25519.PrivateKey) error
+	}{digest, delta} {
+		if err := env.Sign(privKey); err != nil {
+			t.Fatalf("Failed to sign %T: %v", env, err)
+		}
+		data, err := json.Marshal(env)
+		if err != nil {
+			t.Fatalf("Failed to marshal %T: %v", env, err)
+		}
+
+		parsed, err := ParseEnvelope(data)
+		if err != nil {
+			t.Fatalf("Failed to parse %T: %v", env, err)
+		}
+		if err := parsed.Verify(pubKey); err != nil {
+			t.Errorf("Failed to verify %T signature: %v", env, err)
+		}
+
+		typed, err := parsed.ParseTypedEnvelope()
+		if err != nil {
+			t.Fatalf("Failed to parse typed %T: %v", env, err)
+		}
+		switch typed := typed.(type) {
+		case *RegistryDigestEnvelope:
+			if typed.Body.Versions["broker-b"]["weather.agent"] != 1700000000000 {
+				t.Errorf("Unexpected registryDigest body: %+v", typed.Body)
+			}
+		case *RegistryDeltaEnvelope:
+			if len(typed.Body.Entries) != 2 || typed.Body.Entries[0].Tool == nil || !typed.Body.Entries[1].Removed {
+				t.Errorf("Unexpected registryDelta body: %+v", typed.Body)
+			}
+		default:
+			t.Errorf("Unexpected typed envelope %T", typed)
+		}
+	}
+}
+
+func TestBroadcastEnvelope(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	broadcast := NewBroadcast("fleet.controller", []string{"fleet.a", "fleet.b"}, "camera", "config.updated", map[string]interface{}{"version": "42"})
+	if err := broadcast.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign BroadcastEnvelope: %v", err)
+	}
+
+	data, err := json.Marshal(broadcast)
+	if err != nil {
+		t.Fatalf("Failed to marshal BroadcastEnvelope: %v", err)
+	}
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if err := parsed.Verify(pubKey); err != nil {
+		t.Errorf("Failed to verify BroadcastEnvelope signature: %v", err)
+	}
+
+	typed, err := parsed.ParseTypedEnvelope()
+	if err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+	parsedBroadcast, ok := typed.(*BroadcastEnvelope)
+	if !ok || len(parsedBroadcast.Body.Recipients) != 2 || parsedBroadcast.Body.Capability != "camera" || parsedBroadcast.Body.Event != "config.updated" {
+		t.Errorf("Unexpected typed envelope: %#v", typed)
+	}
+}
+
+func TestBrokerDrainingEnvelopes(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	notice := NewBrokerDraining("broker-a", "broker-b", "https://broker-b:4433")
+	handoff := NewStateHandoff("broker-a", StateHandoffBody{
+		Broadcasts: []HandoffBroadcast{{ID: "b1", Sender: "fleet.controller", Event: "config.updated", Envelope: json.RawMessage(`{"type":"broadcast"}`), Recipients: []string{"fleet.a"}}},
+		Requests:   []HandoffRequest{{RequestID: "r1", Caller: "caller", Target: "fleet.a", Tool: "echo", Expires: 1700000000000}},
+	})
+
+	for _, env := range []interface {
+		Sign(ed25519.PrivateKey) error
+	}{notice, handoff} {
+		if err := env.Sign(privKey); err != nil {
+			t.Fatalf("Failed to sign %T: %v", env, err)
+		}
+		data, err := json.Marshal(env)
+		if err != nil {
+			t.Fatalf("Failed to marshal %T: %v", env, err)
+		}
+
+		parsed, err := ParseEnvelope(data)
+		if err != nil {
+			t.Fatalf("Failed to parse %T: %v", env, err)
+		}
+		if err := parsed.Verify(pubKey); err != nil {
+			t.Errorf("Failed to verify %T signature: %v", env, err)
+		}
+
+		typed, err := parsed.ParseTypedEnvelope()
+		if err != nil {
+			t.Fatalf("Failed to parse typed %T: %v", env, err)
+		}
+		switch typed := typed.(type) {
+		case *BrokerDrainingEnvelope:
+			if typed.Body.Successor != "broker-b" || typed.Body.Endpoint != "https://broker-b:4433" {
+				t.Errorf("Unexpected brokerDraining body: %+v", typed.Body)
+			}
+		case *StateHandoffEnvelope:
+			if len(typed.Body.Broadcasts) != 1 || string(typed.Body.Broadcasts[0].Envelope) != `{"type":"broadcast"}` || typed.Body.Requests[0].Target != "fleet.a" {
+				t.Errorf("Unexpected stateHandoff body: %+v", typed.Body)
+			}
+		default:
+			t.Errorf("Unexpected typed envelope %T", typed)
+		}
+	}
+}
+
+func TestAckEnvelope(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	ack := NewAck("agent-a", "n1", "n2")
+	if err := ack.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	data, _ := json.Marshal(ack)
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if err := parsed.Verify(pubKey); err != nil {
+		t.Errorf("Failed to verify signature: %v", err)
+	}
+	typed, err := parsed.ParseTypedEnvelope()
+	if parsedAck, ok := typed.(*AckEnvelope); err != nil || !ok || len(parsedAck.Body.Nonces) != 2 || parsedAck.Body.Nonces[1] != "n2" {
+		t.Errorf("Unexpected typed envelope %#v (%v)", typed, err)
+	}
+}
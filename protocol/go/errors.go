@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors shared across the package. Functions wrap them with the details
+// of the failure, so callers test for them with errors.Is.
+var (
+	// ErrNoSignature is returned for an envelope without a signature
+	ErrNoSignature = errors.New("no signature")
+	// ErrBadSignature is returned for a signature that is not valid base64
+	// or does not verify with the key given
+	ErrBadSignature = errors.New("signature verification failed")
+	// ErrBadCanonicalForm is returned for JSON that has no canonical form,
+	// such as a document with trailing data or a number too large for a
+	// double
+	ErrBadCanonicalForm = errors.New("no canonical form")
+	// ErrUnknownEnvelopeType is returned for an envelope of a type the
+	// package does not know
+	ErrUnknownEnvelopeType = errors.New("unknown envelope type")
+	// ErrExpired is returned for a signed request, token, grant or trust
+	// link used after it stopped being valid
+	ErrExpired = errors.New("expired")
+	// ErrMissingField is returned by the envelope builders for an envelope
+	// lacking a field the protocol requires
+	ErrMissingField = errors.New("missing required field")
+	// ErrDecryption is returned for a sealed body that cannot be opened
+	// with the key given, or was altered or moved to another request
+	ErrDecryption = errors.New("decryption failed")
+)
+
+// Error envelope codes. The broker sends ErrorPermissionDenied for
+// capability refusals as well.
+const (
+	ErrorBadRequest          = "BAD_REQUEST"          // The request could not be read
+	ErrorInvalidEnvelope     = "INVALID_ENVELOPE"     // The envelope or its body is malformed
+	ErrorUnknownType         = "UNKNOWN_TYPE"         // The broker does not handle the envelope type
+	ErrorInvalidSignature    = "INVALID_SIGNATURE"    // The signature does not match the sender's key
+	ErrorUnauthorized        = "UNAUTHORIZED"         // Credentials are missing or invalid
+	ErrorForbidden           = "FORBIDDEN"            // The sender may not do this
+	ErrorNotFound            = "NOT_FOUND"            // The agent, tool or stream is unknown
+	ErrorReplayed            = "REPLAYED"             // The envelope's nonce was already seen
+	ErrorStale               = "STALE"                // The envelope's ts is too far from the broker's clock
+	ErrorConflict            = "CONFLICT"             // The request conflicts with the broker's state
+	ErrorGone                = "GONE"                 // The resource no longer exists
+	ErrorTooLarge            = "TOO_LARGE"            // The envelope exceeds a size limit
+	ErrorRateLimited         = "RATE_LIMITED"         // The sender exceeded its rate limit
+	ErrorAdmissionDenied     = "ADMISSION_DENIED"     // An admission policy refused the envelope
+	ErrorCertificateMismatch = "CERTIFICATE_MISMATCH" // The client certificate names another agent
+	ErrorRegistrationClosed  = "REGISTRATION_CLOSED"  // Registration requires an invite
+	ErrorInternal            = "INTERNAL"             // The broker failed to handle the envelope
+	ErrorBadGateway          = "BAD_GATEWAY"          // An agent or peer broker failed
+	ErrorUnavailable         = "UNAVAILABLE"          // The broker or target is temporarily unavailable
+	ErrorTimeout             = "TIMEOUT"              // An agent or peer broker did not answer in time
+)
+
+// ErrorCodeForStatus is the code of a failure known only by its HTTP status
+func ErrorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorBadRequest
+	case http.StatusUnauthorized:
+		return ErrorUnauthorized
+	case http.StatusForbidden:
+		return ErrorForbidden
+	case http.StatusNotFound:
+		return ErrorNotFound
+	case http.StatusConflict:
+		return ErrorConflict
+	case http.StatusGone:
+		return ErrorGone
+	case http.StatusRequestEntityTooLarge:
+		return ErrorTooLarge
+	case http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case http.StatusBadGateway:
+		return ErrorBadGateway
+	case http.StatusServiceUnavailable:
+		return ErrorUnavailable
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrorTimeout
+	}
+	if status >= 500 {
+		return ErrorInternal
+	}
+	return ErrorBadRequest
+}
+
+// RetryableStatus reports whether a failure with the HTTP status may succeed
+// if the envelope is sent again
+func RetryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RemoteError is a failure reported by a broker, read from its error
+// envelope, or from the status and text of brokers that predate them
+type RemoteError struct {
+	Status int
+	ErrorBody
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// Is matches the package's errors to the codes brokers report them under,
+// so a broker refusing a signature is ErrBadSignature
+func (e *RemoteError) Is(target error) bool {
+	switch target {
+	case ErrBadSignature:
+		return e.Code == ErrorInvalidSignature
+	case ErrUnknownEnvelopeType:
+		return e.Code == ErrorUnknownType
+	}
+	return false
+}
+
+// ParseRemoteError reads the error a broker answered with status
+func ParseRemoteError(status int, data []byte) *RemoteError {
+	var envelope ErrorEnvelope
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.Type == EnvelopeError && envelope.Body.Code != "" {
+		return &RemoteError{Status: status, ErrorBody: envelope.Body}
+	}
+	return &RemoteError{Status: status, ErrorBody: ErrorBody{
+		Code:      ErrorCodeForStatus(status),
+		Message:   strings.TrimSpace(string(data)),
+		Retryable: RetryableStatus(status),
+	}}
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	env := NewError("broker-a", ErrorBody{Code: ErrorRateLimited, Message: "Rate limit exceeded", Retryable: true, CorrelationID: "abc", RetryAfterMs: 1500})
+	if err := env.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	data, _ := json.Marshal(env)
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if err := parsed.Verify(pubKey); err != nil {
+		t.Errorf("Failed to verify signature: %v", err)
+	}
+	typed, err := parsed.ParseTypedEnvelope()
+	if errEnv, ok := typed.(*ErrorEnvelope); err != nil || !ok || errEnv.Body.Code != ErrorRateLimited || errEnv.Body.CorrelationID != "abc" {
+		t.Fatalf("Unexpected typed envelope %#v (%v)", typed, err)
+	}
+
+	remote := ParseRemoteError(http.StatusTooManyRequests, data)
+	if remote.Code != ErrorRateLimited || !remote.Retryable || remote.RetryAfterMs != 1500 || remote.CorrelationID != "abc" {
+		t.Errorf("Unexpected remote error %+v", remote)
+	}
+	var target *RemoteError
+	if err := error(remote); !errors.As(err, &target) || err.Error() != "RATE_LIMITED (429): Rate limit exceeded" {
+		t.Errorf("Unexpected error text %q", err)
+	}
+}
+
+func TestParseRemoteErrorText(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		body      string
+		code      string
+		retryable bool
+	}{
+		{http.StatusServiceUnavailable, "Broker is shutting down\n", ErrorUnavailable, true},
+		{http.StatusConflict, "Replayed envelope\n", ErrorConflict, false},
+		{http.StatusInternalServerError, "", ErrorInternal, false},
+		{http.StatusTeapot, "", ErrorBadRequest, false},
+	} {
+		remote := ParseRemoteError(tc.status, []byte(tc.body))
+		if remote.Code != tc.code || remote.Retryable != tc.retryable || remote.Status != tc.status {
+			t.Errorf("%d: unexpected remote error %+v", tc.status, remote)
+		}
+	}
+	if remote := ParseRemoteError(http.StatusBadRequest, []byte("Unknown envelope type\n")); remote.Message != "Unknown envelope type" {
+		t.Errorf("Expected the text to become the message, got %q", remote.Message)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	pub, priv, _ := GenerateKeyPair()
+	otherPub, _, _ := GenerateKeyPair()
+
+	env := NewPing("sensor", "hello")
+	if err := env.Verify(pub); !errors.Is(err, ErrNoSignature) {
+		t.Errorf("Expected ErrNoSignature, got %v", err)
+	}
+	env.Sign(priv)
+	if err := env.Verify(otherPub); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+	env.Sig = "not base64!"
+	if err := env.Verify(pub); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature for a malformed signature, got %v", err)
+	}
+	if err := VerifyKeyProof("sensor", "challenge", SignKeyProof("sensor", "other", priv), pub); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature for a key proof, got %v", err)
+	}
+
+	for _, data := range []string{`{"a":1} {}`, `{"a":1e400}`, `{"a":`} {
+		if _, err := Canonicalize([]byte(data)); !errors.Is(err, ErrBadCanonicalForm) {
+			t.Errorf("Expected ErrBadCanonicalForm for %s, got %v", data, err)
+		}
+	}
+
+	generic := &GenericEnvelope{BaseEnvelope: BaseEnvelope{Type: "teleport"}}
+	if _, err := generic.ParseTypedEnvelope(); !errors.Is(err, ErrUnknownEnvelopeType) {
+		t.Errorf("Expected ErrUnknownEnvelopeType, got %v", err)
+	}
+
+	header := SignEventStreamRequest("sensor", priv)
+	header.Set(HeaderEventStreamTimestamp, strconv.FormatInt(time.Now().Add(-2*EventStreamMaxSkew).UnixMilli(), 10))
+	if err := VerifyEventStreamRequest(header, pub); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expected ErrExpired for a stale request, got %v", err)
+	}
+	manager := NewCapabilityManager([]byte("secret"))
+	token, _ := manager.CreateCapability("tools", "broker", "sensor", []string{"*"}, -time.Minute)
+	if _, err := manager.ValidateCapability(token); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expected ErrExpired for an expired capability, got %v", err)
+	}
+
+	// Brokers report the same failures as error codes
+	remote := ParseRemoteError(http.StatusUnauthorized, []byte(`{"type":"error","body":{"code":"INVALID_SIGNATURE","message":"Invalid signature"}}`))
+	if !errors.Is(remote, ErrBadSignature) || errors.Is(remote, ErrUnknownEnvelopeType) {
+		t.Errorf("Expected the remote error to be ErrBadSignature, got %v", remote)
+	}
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// EventStreamMaxSkew bounds the age of a signed event stream request
+const EventStreamMaxSkew = 5 * time.Minute
+
+// Headers authenticating an agent opening its event stream. They are
+// headers rather than query parameters so the signature stays out of URLs,
+// which proxies and access logs record.
+const (
+	HeaderEventStreamAgent     = "X-FEM-Stream-Agent"
+	HeaderEventStreamTimestamp = "X-FEM-Stream-Timestamp"
+	HeaderEventStreamNonce     = "X-FEM-Stream-Nonce"
+	HeaderEventStreamSignature = "X-FEM-Stream-Signature"
+)
+
+// eventStreamMessage returns the bytes signed to open an agent's event stream
+func eventStreamMessage(agentID string, ts int64, nonce string) []byte {
+	return []byte(fmt.Sprintf("fem-events:%s:%d:%s", agentID, ts, nonce))
+}
+
+// SignEventStreamRequest returns the headers that authenticate an agent
+// opening its event stream. Each carries a fresh nonce, which the broker
+// accepts once, so sign every connection anew.
+func SignEventStreamRequest(agentID string, privateKey ed25519.PrivateKey) http.Header {
+	header, _ := SignEventStreamRequestWith(agentID, privateKey)
+	return header
+}
+
+// SignEventStreamRequestWith is SignEventStreamRequest for a Signer, such
+// as a key held in a KMS, whose signing can fail
+func SignEventStreamRequestWith(agentID string, signer Signer) (http.Header, error) {
+	ts := time.Now().UnixMilli()
+	nonce := NewNonce()
+	signature, err := signMessage(signer, eventStreamMessage(agentID, ts, nonce))
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set(HeaderEventStreamAgent, agentID)
+	header.Set(HeaderEventStreamTimestamp, strconv.FormatInt(ts, 10))
+	header.Set(HeaderEventStreamNonce, nonce)
+	header.Set(HeaderEventStreamSignature, base64.StdEncoding.EncodeToString(signature))
+	return header, nil
+}
+
+// VerifyEventStreamRequest checks signed event stream headers against the
+// agent's public key. It does not remember nonces: the caller must refuse
+// a nonce it has seen before.
+func VerifyEventStreamRequest(header http.Header, publicKey PublicKey) error {
+	ts, err := strconv.ParseInt(header.Get(HeaderEventStreamTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+
+	age := time.Since(time.UnixMilli(ts))
+	if age > EventStreamMaxSkew {
+		return fmt.Errorf("%w: request timestamp outside allowed window", ErrExpired)
+	}
+	if age < -EventStreamMaxSkew {
+		return fmt.Errorf("request timestamp outside allowed window")
+	}
+
+	nonce := header.Get(HeaderEventStreamNonce)
+	if nonce == "" {
+		return fmt.Errorf("missing nonce")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(header.Get(HeaderEventStreamSignature))
+	if err != nil {
+		return fmt.Errorf("%w: signature encoding: %v", ErrBadSignature, err)
+	}
+
+	return VerifySignature(publicKey, eventStreamMessage(header.Get(HeaderEventStreamAgent), ts, nonce), signature)
+}
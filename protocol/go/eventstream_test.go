@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEventStreamRequestSigning(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	header := SignEventStreamRequest("test.agent", privKey)
+	if header.Get(HeaderEventStreamAgent) != "test.agent" {
+		t.Errorf("Expected agent header, got %q", header.Get(HeaderEventStreamAgent))
+	}
+	if SignEventStreamRequest("test.agent", privKey).Get(HeaderEventStreamNonce) == header.Get(HeaderEventStreamNonce) {
+		t.Error("Expected each request to carry a fresh nonce")
+	}
+
+	if err := VerifyEventStreamRequest(header, pubKey); err != nil {
+		t.Errorf("Failed to verify signed request: %v", err)
+	}
+
+	otherPub, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	if err := VerifyEventStreamRequest(header, otherPub); err == nil {
+		t.Error("Expected verification with the wrong key to fail")
+	}
+
+	// The signature covers the agent ID
+	spoofed := SignEventStreamRequest("test.agent", privKey)
+	spoofed.Set(HeaderEventStreamAgent, "other.agent")
+	if err := VerifyEventStreamRequest(spoofed, pubKey); err == nil {
+		t.Error("Expected verification of a modified agent to fail")
+	}
+
+	stale := SignEventStreamRequest("test.agent", privKey)
+	stale.Set(HeaderEventStreamTimestamp, strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10))
+	if err := VerifyEventStreamRequest(stale, pubKey); err == nil {
+		t.Error("Expected stale request to be rejected")
+	}
+
+	// The signature covers the nonce, so a replay cannot swap it
+	swapped := SignEventStreamRequest("test.agent", privKey)
+	swapped.Set(HeaderEventStreamNonce, NewNonce())
+	if err := VerifyEventStreamRequest(swapped, pubKey); err == nil {
+		t.Error("Expected verification of a modified nonce to fail")
+	}
+	unnonced := SignEventStreamRequest("test.agent", privKey)
+	unnonced.Del(HeaderEventStreamNonce)
+	if err := VerifyEventStreamRequest(unnonced, pubKey); err == nil {
+		t.Error("Expected a request without a nonce to be rejected")
+	}
+}
@@ -0,0 +1,269 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrToolBusy is matched by errors.Is for every BusyError
+var ErrToolBusy = errors.New("tool busy")
+
+// BusyError rejects a tool call because the agent has no room to queue it.
+// Callers should retry after RetryAfter.
+type BusyError struct {
+	Tool       string
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("tool %s busy, retry after %v", e.Tool, e.RetryAfter)
+}
+
+// Is reports BusyErrors as ErrToolBusy
+func (e *BusyError) Is(target error) bool {
+	return target == ErrToolBusy
+}
+
+// Defaults for ExecQueueConfig fields left zero
+const (
+	DefaultToolConcurrency = 4
+	DefaultMaxQueued       = 64
+	defaultRetryAfter      = time.Second
+)
+
+// ExecQueueConfig bounds how many tool calls an agent runs and holds
+type ExecQueueConfig struct {
+	Concurrency     int            // Calls run at once per tool, unless listed in ToolConcurrency
+	ToolConcurrency map[string]int // Calls run at once, by tool name
+	MaxQueued       int            // Calls waiting across all tools before new ones are rejected as busy
+}
+
+// ToolLoad is the work an agent holds for one tool
+type ToolLoad struct {
+	InFlight int `json:"inFlight"`
+	Queued   int `json:"queued"`
+}
+
+// ExecStats is a snapshot of an ExecQueue's work
+type ExecStats struct {
+	InFlight int                 `json:"inFlight"`
+	Queued   int                 `json:"queued"`
+	Tools    map[string]ToolLoad `json:"tools,omitempty"`
+}
+
+// ExecQueue runs an agent's tool calls with a concurrency limit per tool
+// and a bounded number of waiting calls, so a flood of routed calls is
+// turned away with busy errors instead of exhausting the agent. Waiting
+// calls get a free slot in order of priority, then of arrival.
+type ExecQueue struct {
+	config  ExecQueueConfig
+	running map[string]int
+	waiting map[string][]*execWaiter
+	load    map[string]*ToolLoad
+	queued  int
+	average map[string]time.Duration // Moving average of each tool's run time
+	mu      sync.Mutex
+}
+
+// execWaiter is a call waiting for a slot; ready is closed when it gets one
+type execWaiter struct {
+	priority int
+	ready    chan struct{}
+}
+
+// NewExecQueue creates a queue, applying defaults to zero fields of config
+func NewExecQueue(config ExecQueueConfig) *ExecQueue {
+	if config.Concurrency <= 0 {
+		config.Concurrency = DefaultToolConcurrency
+	}
+	if config.MaxQueued <= 0 {
+		config.MaxQueued = DefaultMaxQueued
+	}
+	return &ExecQueue{
+		config:  config,
+		running: make(map[string]int),
+		waiting: make(map[string][]*execWaiter),
+		load:    make(map[string]*ToolLoad),
+		average: make(map[string]time.Duration),
+	}
+}
+
+// limit returns how many calls of a tool may run at once
+func (q *ExecQueue) limit(tool string) int {
+	if limit, ok := q.config.ToolConcurrency[tool]; ok && limit > 0 {
+		return limit
+	}
+	return q.config.Concurrency
+}
+
+// Do runs fn for a call of tool once a slot is free. It returns a
+// BusyError without running fn if the queue is full, and ctx's error if
+// ctx ends while the call waits.
+func (q *ExecQueue) Do(ctx context.Context, tool string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	return q.DoPriority(ctx, tool, 0, fn)
+}
+
+// DoCall runs fn for a routed tool call, at the priority the broker gave it
+func (q *ExecQueue) DoCall(ctx context.Context, call ToolCallBody, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	return q.DoPriority(ctx, call.Tool, call.Priority, fn)
+}
+
+// DoPriority is Do for a call of the given priority. While the tool's
+// slots are taken, higher priority calls are run before lower ones.
+func (q *ExecQueue) DoPriority(ctx context.Context, tool string, priority int, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	q.mu.Lock()
+	load, ok := q.load[tool]
+	if !ok {
+		load = &ToolLoad{}
+		q.load[tool] = load
+	}
+
+	if q.running[tool] < q.limit(tool) && len(q.waiting[tool]) == 0 {
+		q.running[tool]++
+		load.InFlight++
+		q.mu.Unlock()
+	} else {
+		if q.queued >= q.config.MaxQueued {
+			retryAfter := q.retryAfterLocked(tool)
+			q.mu.Unlock()
+			return nil, &BusyError{Tool: tool, RetryAfter: retryAfter}
+		}
+		waiter := &execWaiter{priority: priority, ready: make(chan struct{})}
+		q.enqueueLocked(tool, waiter)
+		q.queued++
+		load.Queued++
+		q.mu.Unlock()
+
+		select {
+		case <-waiter.ready:
+		case <-ctx.Done():
+			q.mu.Lock()
+			select {
+			case <-waiter.ready:
+				// Granted a slot just as ctx ended; hand it on
+				load.InFlight--
+				q.releaseLocked(tool)
+			default:
+				q.removeLocked(tool, waiter)
+				q.queued--
+				load.Queued--
+			}
+			q.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+
+	started := time.Now()
+	defer func() {
+		elapsed := time.Since(started)
+		q.mu.Lock()
+		load.InFlight--
+		if average := q.average[tool]; average == 0 {
+			q.average[tool] = elapsed
+		} else {
+			q.average[tool] = (3*average + elapsed) / 4
+		}
+		q.releaseLocked(tool)
+		q.mu.Unlock()
+	}()
+	return fn(ctx)
+}
+
+// enqueueLocked adds a waiter behind those of the same or higher priority
+func (q *ExecQueue) enqueueLocked(tool string, waiter *execWaiter) {
+	waiting := q.waiting[tool]
+	i := len(waiting)
+	for i > 0 && waiting[i-1].priority < waiter.priority {
+		i--
+	}
+	waiting = append(waiting, nil)
+	copy(waiting[i+1:], waiting[i:])
+	waiting[i] = waiter
+	q.waiting[tool] = waiting
+}
+
+// removeLocked drops a waiter that gave up
+func (q *ExecQueue) removeLocked(tool string, waiter *execWaiter) {
+	waiting := q.waiting[tool]
+	for i, w := range waiting {
+		if w == waiter {
+			q.waiting[tool] = append(waiting[:i], waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// releaseLocked frees a slot of tool, handing it to the first waiter
+func (q *ExecQueue) releaseLocked(tool string) {
+	waiting := q.waiting[tool]
+	if len(waiting) == 0 {
+		q.running[tool]--
+		return
+	}
+	next := waiting[0]
+	q.waiting[tool] = waiting[1:]
+	q.queued--
+	q.load[tool].Queued--
+	q.load[tool].InFlight++
+	close(next.ready)
+}
+
+// retryAfterLocked estimates when a slot for tool will be free: the time
+// to work through the calls already waiting for it at its average run time
+func (q *ExecQueue) retryAfterLocked(tool string) time.Duration {
+	average := q.average[tool]
+	if average == 0 {
+		return defaultRetryAfter
+	}
+	waiting := q.load[tool].Queued + 1
+	return average * time.Duration(waiting) / time.Duration(q.limit(tool))
+}
+
+// Stats returns the calls running and waiting, in total and by tool
+func (q *ExecQueue) Stats() ExecStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := ExecStats{Tools: make(map[string]ToolLoad)}
+	for tool, load := range q.load {
+		if load.InFlight == 0 && load.Queued == 0 {
+			continue
+		}
+		stats.InFlight += load.InFlight
+		stats.Queued += load.Queued
+		stats.Tools[tool] = *load
+	}
+	return stats
+}
+
+// Heartbeat creates an agentHeartbeat reporting the queue's load to the
+// broker, with status "busy" while calls are waiting
+func (q *ExecQueue) Heartbeat(agent string) *AgentHeartbeatEnvelope {
+	stats := q.Stats()
+	status := "ok"
+	if stats.Queued > 0 {
+		status = "busy"
+	}
+	heartbeat := NewAgentHeartbeat(agent, status)
+	heartbeat.Body.InFlight = stats.InFlight
+	heartbeat.Body.Queued = stats.Queued
+	return heartbeat
+}
+
+// NewToolResultBody builds the toolResult body for a call's outcome. Busy
+// rejections are flagged with the retry hint.
+func NewToolResultBody(requestID string, result interface{}, err error) ToolResultBody {
+	if err == nil {
+		return ToolResultBody{RequestID: requestID, Success: true, Result: result}
+	}
+	body := ToolResultBody{RequestID: requestID, Error: err.Error()}
+	var busy *BusyError
+	if errors.As(err, &busy) {
+		body.Busy = true
+		body.RetryAfterMs = busy.RetryAfter.Milliseconds()
+	}
+	return body
+}
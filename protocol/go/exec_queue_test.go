@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecQueueLimitsAndRejects(t *testing.T) {
+	queue := NewExecQueue(ExecQueueConfig{Concurrency: 2, ToolConcurrency: map[string]int{"gpu.render": 1}, MaxQueued: 1})
+
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	block := func(ctx context.Context) (interface{}, error) {
+		started <- "run"
+		<-release
+		return "done", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	run := func(tool string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := queue.Do(context.Background(), tool, block)
+			results <- err
+		}()
+	}
+
+	// gpu.render runs one call at a time; the second waits in the queue
+	run("gpu.render")
+	<-started
+	run("gpu.render")
+	waitFor(t, func() bool { return queue.Stats().Queued == 1 })
+
+	// The queue is full, so a third call is turned away
+	_, err := queue.Do(context.Background(), "gpu.render", block)
+	var busy *BusyError
+	if !errors.As(err, &busy) || !errors.Is(err, ErrToolBusy) || busy.RetryAfter <= 0 {
+		t.Fatalf("Expected a busy error with a retry hint, got %v", err)
+	}
+
+	// Other tools keep their own slots, but share the queue bound
+	run("text.summarize")
+	<-started
+	stats := queue.Stats()
+	if stats.InFlight != 2 || stats.Queued != 1 || stats.Tools["gpu.render"].InFlight != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	heartbeat := queue.Heartbeat("agent-a")
+	if heartbeat.Body.Status != "busy" || heartbeat.Body.InFlight != 2 || heartbeat.Body.Queued != 1 {
+		t.Errorf("Unexpected heartbeat %+v", heartbeat.Body)
+	}
+
+	close(release)
+	wg.Wait()
+	close(results)
+	for err := range results {
+		if err != nil {
+			t.Errorf("Expected queued calls to complete, got %v", err)
+		}
+	}
+	if stats := queue.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Errorf("Expected an idle queue, got %+v", stats)
+	}
+}
+
+func TestExecQueueCancelWhileQueued(t *testing.T) {
+	queue := NewExecQueue(ExecQueueConfig{Concurrency: 1})
+	release := make(chan struct{})
+	go queue.Do(context.Background(), "slow", func(ctx context.Context) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	defer close(release)
+	waitFor(t, func() bool { return queue.Stats().InFlight == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := queue.Do(ctx, "slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the wait to end with the context, got %v", err)
+	}
+	if queue.Stats().Queued != 0 {
+		t.Error("Expected the abandoned call to leave the queue")
+	}
+}
+
+func TestExecQueuePriority(t *testing.T) {
+	queue := NewExecQueue(ExecQueueConfig{Concurrency: 1})
+	release := make(chan struct{})
+	go queue.Do(context.Background(), "gpu.render", func(ctx context.Context) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	waitFor(t, func() bool { return queue.Stats().InFlight == 1 })
+
+	// Calls queue up lowest priority first, and run highest priority first
+	var order []int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, priority := range []int{-1, 0, 1, 0} {
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			queue.DoCall(context.Background(), ToolCallBody{Tool: "gpu.render", Priority: priority}, func(ctx context.Context) (interface{}, error) {
+				mu.Lock()
+				order = append(order, priority)
+				mu.Unlock()
+				return nil, nil
+			})
+		}(priority)
+		waitFor(t, func() bool { return queue.Stats().Queued == i+1 })
+	}
+
+	close(release)
+	wg.Wait()
+	if len(order) != 4 || order[0] != 1 || order[1] != 0 || order[2] != 0 || order[3] != -1 {
+		t.Errorf("Expected calls to run by priority, got %v", order)
+	}
+}
+
+func TestNewToolResultBodyBusy(t *testing.T) {
+	body := NewToolResultBody("req-1", nil, &BusyError{Tool: "gpu.render", RetryAfter: 1500 * time.Millisecond})
+	if body.Success || !body.Busy || body.RetryAfterMs != 1500 {
+		t.Errorf("Unexpected busy result %+v", body)
+	}
+	if body := NewToolResultBody("req-2", 42, nil); !body.Success || body.Busy || body.Result != 42 {
+		t.Errorf("Unexpected result %+v", body)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
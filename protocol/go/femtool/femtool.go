@@ -0,0 +1,245 @@
+// Package femtool exposes ordinary Go functions as MCP tools. Register
+// derives a tool's name, description and input schema from a function's
+// signature, and the Server decodes each call's arguments into the
+// function's parameter and encodes what it returns as the result.
+//
+//	type WeatherQuery struct {
+//		City  string `json:"city" fem:"required" description:"City to report on"`
+//		Units string `json:"units,omitempty"`
+//	}
+//
+//	func GetWeather(ctx context.Context, query WeatherQuery) (Report, error) { ... }
+//
+//	server := femtool.NewServer()
+//	femtool.Register(server, GetWeather) // Tool "getWeather"
+//	http.Handle("/mcp", server)
+//
+// A function may take a context.Context first, followed by at most one
+// parameter: a struct, whose fields are the tool's arguments, a pointer to
+// one, or a map with string keys. It may return a result, an error, both,
+// or nothing. Struct fields follow the rules of protocol.GenerateSchema:
+// fields tagged `fem:"required"` must be given and not be empty.
+package femtool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"github.com/fep-fem/protocol"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Register adds fn to the server as a tool named after the function, such
+// as "getWeather" for GetWeather
+func Register(srv *Server, fn interface{}) error {
+	return RegisterTool(srv, protocol.MCPTool{}, fn)
+}
+
+// RegisterTool adds fn to the server as the given tool. The name,
+// description, input schema and output schema are derived from fn where
+// the tool leaves them empty; its other fields are served as they are.
+// Functions without a name of their own, such as closures, need the tool
+// to name them.
+func RegisterTool(srv *Server, tool protocol.MCPTool, fn interface{}) error {
+	handler, err := newHandler(fn)
+	if err != nil {
+		return err
+	}
+
+	name, named := funcName(handler.fn)
+	if tool.Name == "" {
+		if !named {
+			return errors.New("femtool: name the tool of an anonymous function")
+		}
+		tool.Name = toolName(name)
+	}
+	if tool.Description == "" {
+		if named {
+			tool.Description = describeName(name)
+		} else {
+			tool.Description = "Calls " + tool.Name
+		}
+	}
+	if tool.InputSchema == nil {
+		tool.InputSchema = handler.input
+	}
+	if tool.OutputSchema == nil {
+		tool.OutputSchema = handler.output
+	}
+	handler.tool = tool
+	return srv.add(handler)
+}
+
+// handler calls a registered function
+type handler struct {
+	tool        protocol.MCPTool
+	fn          reflect.Value
+	takesCtx    bool
+	param       reflect.Type // Nil if fn takes no parameter
+	returnsErr  bool
+	returnsData bool
+	input       map[string]interface{} // Derived input schema, checked before each call
+	output      map[string]interface{}
+}
+
+// newHandler checks fn's signature and derives the schemas of its
+// parameter and result
+func newHandler(fn interface{}) (*handler, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, fmt.Errorf("femtool: %T is not a function", fn)
+	}
+	t := v.Type()
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("femtool: %s is variadic", t)
+	}
+
+	h := &handler{fn: v}
+	in := 0
+	if in < t.NumIn() && t.In(in) == contextType {
+		h.takesCtx = true
+		in++
+	}
+	switch t.NumIn() - in {
+	case 0:
+		h.input = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+	case 1:
+		h.param = t.In(in)
+		if !argumentsType(h.param) {
+			return nil, fmt.Errorf("femtool: %s takes %s; tool arguments need a struct or a map with string keys", t, h.param)
+		}
+		schema, err := jsonSchema(h.param)
+		if err != nil {
+			return nil, err
+		}
+		// The arguments are always an object
+		schema["type"] = "object"
+		h.input = schema
+	default:
+		return nil, fmt.Errorf("femtool: %s takes more than one parameter; gather them in a struct", t)
+	}
+
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		h.returnsErr = t.Out(0) == errorType
+		h.returnsData = !h.returnsErr
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, fmt.Errorf("femtool: %s must return its error last", t)
+		}
+		h.returnsErr, h.returnsData = true, true
+	default:
+		return nil, fmt.Errorf("femtool: %s returns more than a result and an error", t)
+	}
+	if h.returnsData && t.Out(0).Kind() != reflect.Interface {
+		schema, err := jsonSchema(t.Out(0))
+		if err != nil {
+			return nil, err
+		}
+		h.output = schema
+	}
+	return h, nil
+}
+
+// argumentsType reports whether values of t can hold a tool's arguments
+func argumentsType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct || (t.Kind() == reflect.Map && t.Key().Kind() == reflect.String)
+}
+
+// jsonSchema generates the schema of t as it reads decoded from JSON,
+// which is how it is served and checked
+func jsonSchema(t reflect.Type) (map[string]interface{}, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	data, err := json.Marshal(protocol.GenerateSchema(t))
+	if err != nil {
+		return nil, fmt.Errorf("femtool: schema of %s: %w", t, err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("femtool: schema of %s: %w", t, err)
+	}
+	return schema, nil
+}
+
+// funcName returns the name a function was declared with, and false for
+// function literals
+func funcName(fn reflect.Value) (string, bool) {
+	f := runtime.FuncForPC(fn.Pointer())
+	if f == nil {
+		return "", false
+	}
+	name := f.Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.TrimSuffix(name, "-fm")   // Method values
+	name = strings.TrimSuffix(name, "[...]") // Instances of generic functions
+	name = name[strings.LastIndex(name, ".")+1:]
+	if name == "" || isLiteralName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// isLiteralName reports whether name is one the compiler gives function
+// literals, such as "func1", or "2" for those nested in them
+func isLiteralName(name string) bool {
+	digits := strings.TrimPrefix(name, "func")
+	if digits == "" {
+		return false
+	}
+	return strings.IndexFunc(digits, func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+}
+
+// toolName lowers the leading capitals of a Go name, so that GetWeather
+// becomes getWeather and HTTPStatus httpStatus
+func toolName(name string) string {
+	runes := []rune(name)
+	for i := range runes {
+		if !unicode.IsUpper(runes[i]) {
+			break
+		}
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// describeName turns a Go name into a sentence, so that GetWeather is
+// described as "Get weather"
+func describeName(name string) string {
+	var words []string
+	runes := []rune(name)
+	start := 0
+	for i := 1; i <= len(runes); i++ {
+		if i < len(runes) && !(unicode.IsUpper(runes[i]) && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			continue
+		}
+		word := string(runes[start:i])
+		if len(words) > 0 && strings.ToUpper(word) != word {
+			word = strings.ToLower(word)
+		}
+		words = append(words, word)
+		start = i
+	}
+	sentence := strings.Join(words, " ")
+	runes = []rune(sentence)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
@@ -0,0 +1,190 @@
+package femtool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fep-fem/protocol"
+)
+
+type WeatherQuery struct {
+	City  string `json:"city" fem:"required" description:"City to report on"`
+	Units string `json:"units,omitempty"`
+	Days  uint   `json:"days,omitempty"`
+}
+
+type Report struct {
+	City        string  `json:"city"`
+	Temperature float64 `json:"temperature"`
+}
+
+func GetWeather(ctx context.Context, query WeatherQuery) (Report, error) {
+	if query.City == "Atlantis" {
+		return Report{}, errors.New("no weather under the sea")
+	}
+	return Report{City: query.City, Temperature: 21.5}, nil
+}
+
+func Ping() string { return "pong" }
+
+func HTTPStatus(arguments map[string]int) int { return arguments["code"] }
+
+func TestRegisterDerivesTheTool(t *testing.T) {
+	server := NewServer()
+	for _, fn := range []interface{}{GetWeather, Ping, HTTPStatus} {
+		if err := Register(server, fn); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+	}
+
+	tools := server.Tools()
+	if len(tools) != 3 || tools[0].Name != "getWeather" || tools[1].Name != "ping" || tools[2].Name != "httpStatus" {
+		t.Fatalf("Unexpected tools: %+v", tools)
+	}
+	if tools[0].Description != "Get weather" || tools[2].Description != "HTTP status" {
+		t.Errorf("Unexpected descriptions %q and %q", tools[0].Description, tools[2].Description)
+	}
+
+	input := tools[0].InputSchema
+	properties, _ := input["properties"].(map[string]interface{})
+	city, _ := properties["city"].(map[string]interface{})
+	if input["type"] != "object" || city["type"] != "string" || city["description"] != "City to report on" {
+		t.Errorf("Unexpected input schema: %v", input)
+	}
+	if !reflect.DeepEqual(input["required"], []interface{}{"city"}) {
+		t.Errorf("Expected city to be required, got %v", input["required"])
+	}
+	if output := tools[0].OutputSchema; output["type"] != "object" {
+		t.Errorf("Expected the report to be described, got %v", output)
+	}
+	if tools[1].InputSchema["type"] != "object" || tools[2].InputSchema["type"] != "object" {
+		t.Errorf("Expected every input schema to be an object, got %v and %v", tools[1].InputSchema, tools[2].InputSchema)
+	}
+
+	if err := Register(server, Ping); err == nil {
+		t.Error("Expected a second tool of the same name to be refused")
+	}
+}
+
+func TestRegisterChecksTheSignature(t *testing.T) {
+	for name, fn := range map[string]interface{}{
+		"not a function":  "GetWeather",
+		"two parameters":  func(a, b WeatherQuery) {},
+		"scalar":          func(city string) {},
+		"error not last":  func() (error, int) { return nil, 0 },
+		"three results":   func() (int, int, error) { return 0, 0, nil },
+		"variadic":        func(queries ...WeatherQuery) {},
+		"unnamed closure": func() {},
+	} {
+		if err := Register(NewServer(), fn); err == nil {
+			t.Errorf("%s: expected Register to fail", name)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	server := NewServer()
+	Register(server, GetWeather)
+	var seen *Report
+	RegisterTool(server, protocol.MCPTool{Name: "remember"}, func(report *Report) error {
+		seen = report
+		return nil
+	})
+
+	result, err := server.Call(context.Background(), "getWeather", json.RawMessage(`{"city": "Oslo"}`))
+	if err != nil || result != (Report{City: "Oslo", Temperature: 21.5}) {
+		t.Fatalf("Unexpected result %v, %v", result, err)
+	}
+	if _, err := server.Call(context.Background(), "getWeather", json.RawMessage(`{"city": "Atlantis"}`)); err == nil || err.Error() != "no weather under the sea" {
+		t.Errorf("Expected the function's error, got %v", err)
+	}
+
+	_, err = server.Call(context.Background(), "getWeather", json.RawMessage(`{"units": 3, "days": -1}`))
+	var invalid *ArgumentError
+	if !errors.As(err, &invalid) || len(invalid.Fields) != 3 {
+		t.Fatalf("Expected three invalid arguments, got %v", err)
+	}
+	if err.Error() != "invalid arguments to getWeather: city is required; days must be at least 0; units must be a string, not an integer" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if result, err := server.Call(context.Background(), "remember", nil); err != nil || result != nil || seen == nil {
+		t.Errorf("Expected a call without arguments to pass an empty report, got %v, %v, %v", result, err, seen)
+	}
+	if _, err := server.Call(context.Background(), "forecast", nil); !errors.Is(err, ErrUnknownTool) {
+		t.Errorf("Expected ErrUnknownTool, got %v", err)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	server := NewServer()
+	Register(server, GetWeather)
+	RegisterTool(server, protocol.MCPTool{Name: "explode"}, func() error { panic("boom") })
+	endpoint := httptest.NewServer(server)
+	defer endpoint.Close()
+
+	rpc := func(method string, params interface{}) map[string]interface{} {
+		t.Helper()
+		data, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 7})
+		resp, err := http.Post(endpoint.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("POST: %v", err)
+		}
+		defer resp.Body.Close()
+		var response map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&response)
+		return response
+	}
+
+	list := rpc("tools/list", map[string]interface{}{})
+	tools, _ := list["result"].(map[string]interface{})["tools"].([]interface{})
+	if len(tools) != 2 || list["id"] != float64(7) {
+		t.Fatalf("Unexpected tools/list response: %v", list)
+	}
+
+	call := rpc("tools/call", map[string]interface{}{"name": "getWeather", "arguments": map[string]interface{}{"city": "Oslo"}})
+	if result, _ := call["result"].(map[string]interface{}); result["city"] != "Oslo" {
+		t.Errorf("Unexpected tools/call response: %v", call)
+	}
+
+	for _, tc := range []struct {
+		params interface{}
+		method string
+		code   float64
+		text   string
+	}{
+		{map[string]interface{}{"name": "getWeather", "arguments": map[string]interface{}{}}, "tools/call", codeInvalidParams, "city is required"},
+		{map[string]interface{}{"name": "forecast"}, "tools/call", codeInvalidParams, "unknown tool"},
+		{map[string]interface{}{"name": "explode"}, "tools/call", codeToolFailed, "panicked: boom"},
+		{map[string]interface{}{}, "resources/list", codeMethodNotFound, "method not found"},
+	} {
+		response := rpc(tc.method, tc.params)
+		rpcErr, _ := response["error"].(map[string]interface{})
+		if rpcErr["code"] != tc.code || !strings.Contains(rpcErr["message"].(string), tc.text) {
+			t.Errorf("%s %v: unexpected response %v", tc.method, tc.params, response)
+		}
+	}
+}
+
+func TestToolNames(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"GetWeather": {"getWeather", "Get weather"},
+		"HTTPStatus": {"httpStatus", "HTTP status"},
+		"URL":        {"url", "URL"},
+		"lookupUser": {"lookupUser", "Lookup user"},
+	} {
+		if got := toolName(name); got != want[0] {
+			t.Errorf("toolName(%q) = %q, want %q", name, got, want[0])
+		}
+		if got := describeName(name); got != want[1] {
+			t.Errorf("describeName(%q) = %q, want %q", name, got, want[1])
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package femtool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/fep-fem/protocol"
+)
+
+// JSON-RPC error codes the server answers with
+const (
+	codeParseError     = -32700
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeToolFailed     = -32000
+)
+
+// ErrUnknownTool is returned for calls to tools the server does not have
+var ErrUnknownTool = errors.New("unknown tool")
+
+// ArgumentError is returned for calls whose arguments do not match the
+// tool's input schema, naming each offending argument
+type ArgumentError struct {
+	Tool   string
+	Fields []protocol.FieldError
+}
+
+func (e *ArgumentError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	return fmt.Sprintf("invalid arguments to %s: %s", e.Tool, strings.Join(messages, "; "))
+}
+
+// Server is an MCP endpoint serving the tools registered with it. It
+// answers tools/list and tools/call as JSON-RPC 2.0 over HTTP POST, the way
+// brokers call agents.
+type Server struct {
+	mu       sync.RWMutex
+	handlers map[string]*handler
+	order    []string // Tool names in the order they were registered
+}
+
+// NewServer creates a server without tools
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]*handler)}
+}
+
+// add serves a handler's tool, refusing a second tool of the same name
+func (s *Server) add(h *handler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.handlers[h.tool.Name]; exists {
+		return fmt.Errorf("femtool: tool %q is already registered", h.tool.Name)
+	}
+	s.handlers[h.tool.Name] = h
+	s.order = append(s.order, h.tool.Name)
+	return nil
+}
+
+// Tools returns the tools the server offers, in the order they were
+// registered, for an agent's registration
+func (s *Server) Tools() []protocol.MCPTool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tools := make([]protocol.MCPTool, len(s.order))
+	for i, name := range s.order {
+		tools[i] = s.handlers[name].tool
+	}
+	return tools
+}
+
+// Call runs a tool with JSON arguments and returns its result. Arguments
+// that do not match the tool's input schema return an *ArgumentError
+// without the function being called.
+func (s *Server) Call(ctx context.Context, name string, arguments json.RawMessage) (interface{}, error) {
+	s.mu.RLock()
+	h, exists := s.handlers[name]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTool, name)
+	}
+	return h.call(ctx, arguments)
+}
+
+// call checks and decodes the arguments and calls the function
+func (h *handler) call(ctx context.Context, arguments json.RawMessage) (result interface{}, err error) {
+	if len(arguments) == 0 || string(arguments) == "null" {
+		arguments = json.RawMessage("{}")
+	}
+	if fields := protocol.CheckSchema(h.input, arguments, "arguments"); len(fields) > 0 {
+		return nil, &ArgumentError{Tool: h.tool.Name, Fields: fields}
+	}
+
+	var in []reflect.Value
+	if h.takesCtx {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	if h.param != nil {
+		param := reflect.New(h.param)
+		if err := json.Unmarshal(arguments, param.Interface()); err != nil {
+			return nil, &ArgumentError{Tool: h.tool.Name, Fields: []protocol.FieldError{{Field: "arguments", Message: err.Error()}}}
+		}
+		in = append(in, param.Elem())
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("tool %s panicked: %v", h.tool.Name, r)
+		}
+	}()
+	out := h.fn.Call(in)
+
+	if h.returnsErr {
+		if failed := out[len(out)-1]; !failed.IsNil() {
+			return nil, failed.Interface().(error)
+		}
+	}
+	if h.returnsData {
+		return out[0].Interface(), nil
+	}
+	return nil, nil
+}
+
+// rpcRequest is the part of a JSON-RPC request the server reads
+type rpcRequest struct {
+	Method string `json:"method"`
+	Params struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"params"`
+	ID interface{} `json:"id"`
+}
+
+// rpcError is the error of a JSON-RPC response
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// ServeHTTP answers a JSON-RPC request for tools/list or tools/call
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request rpcRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, protocol.MaxEnvelopeSize)).Decode(&request); err != nil {
+		writeRPC(w, nil, nil, &rpcError{Code: codeParseError, Message: "Invalid JSON-RPC request"})
+		return
+	}
+
+	switch request.Method {
+	case "tools/list":
+		writeRPC(w, request.ID, map[string]interface{}{"tools": s.Tools()}, nil)
+	case "tools/call":
+		result, err := s.Call(r.Context(), request.Params.Name, request.Params.Arguments)
+		var invalid *ArgumentError
+		switch {
+		case err == nil:
+			writeRPC(w, request.ID, result, nil)
+		case errors.As(err, &invalid):
+			writeRPC(w, request.ID, nil, &rpcError{Code: codeInvalidParams, Message: err.Error(), Data: map[string]interface{}{"fields": invalid.Fields}})
+		case errors.Is(err, ErrUnknownTool):
+			writeRPC(w, request.ID, nil, &rpcError{Code: codeInvalidParams, Message: err.Error()})
+		default:
+			writeRPC(w, request.ID, nil, &rpcError{Code: codeToolFailed, Message: err.Error()})
+		}
+	default:
+		writeRPC(w, request.ID, nil, &rpcError{Code: codeMethodNotFound, Message: "method not found: " + request.Method})
+	}
+}
+
+// writeRPC writes a JSON-RPC response with a result or an error
+func writeRPC(w http.ResponseWriter, id interface{}, result interface{}, rpcErr *rpcError) {
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if rpcErr != nil {
+		response["error"] = rpcErr
+	} else {
+		response["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
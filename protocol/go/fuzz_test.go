@@ -0,0 +1,302 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseEnvelopeLimits(t *testing.T) {
+	deep := `{"type":"toolCall","body":` + strings.Repeat("[", MaxEnvelopeDepth) + strings.Repeat("]", MaxEnvelopeDepth) + `}`
+	large := `{"type":"toolCall","body":"` + strings.Repeat("x", MaxEnvelopeSize) + `"}`
+	for _, tc := range []struct {
+		name string
+		data string
+		want error
+	}{
+		{"deep", deep, ErrEnvelopeTooDeep},
+		{"large", large, ErrEnvelopeTooLarge},
+		{"brackets in strings", `{"type":"toolCall","body":"` + strings.Repeat("[", MaxEnvelopeDepth+1) + `\"{"}`, nil},
+	} {
+		_, err := ParseEnvelope([]byte(tc.data))
+		if !errors.Is(err, tc.want) || (tc.want == nil && err != nil) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	// MessagePack bodies are bounded once transcoded, not only as sent
+	nulls := append([]byte{0x82, 0xa4, 't', 'y', 'p', 'e', 0xa1, 'x', 0xa4, 'b', 'o', 'd', 'y', 0xdd, 0, 0x10, 0, 0}, bytes.Repeat([]byte{0xc0}, 1<<20)...)
+	if _, err := ParseEnvelopeWithCodec(nulls, MsgPackCodec); !errors.Is(err, ErrEnvelopeTooLarge) {
+		t.Errorf("Expected a body growing past the limit to be refused, got %v", err)
+	}
+
+	envelope := NewEnvelope(EnvelopeToolCall, "a")
+	envelope.Sig = "AAAA"
+	if err := envelope.Verify(nil); err == nil {
+		t.Error("Expected verifying with a missing key to fail")
+	}
+}
+
+// fuzzSeeds returns signed envelopes of several types, as JSON, to start
+// the fuzzers from well-formed input
+func fuzzSeeds(t testing.TB) ([][]byte, ed25519.PublicKey) {
+	pub, key, _ := GenerateKeyPair()
+	var seeds [][]byte
+	add := func(envelope interface {
+		Sign(ed25519.PrivateKey) error
+	}) {
+		envelope.Sign(key)
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatalf("Marshaling seed failed: %v", err)
+		}
+		seeds = append(seeds, data)
+	}
+	add(&RegisterAgentEnvelope{
+		BaseEnvelope: BaseEnvelope{Type: EnvelopeRegisterAgent, CommonHeaders: CommonHeaders{Agent: "fuzz", TS: 1, Nonce: "n1"}},
+		Body: RegisterAgentBody{
+			PubKey:         EncodePublicKey(pub),
+			Capabilities:   []string{"a.*"},
+			BodyDefinition: &BodyDefinition{Name: "b", MCPTools: []MCPTool{{Name: "t", InputSchema: map[string]interface{}{"type": "object"}}}},
+		},
+	})
+	add(&ToolCallEnvelope{
+		BaseEnvelope: BaseEnvelope{Type: EnvelopeToolCall, CommonHeaders: CommonHeaders{Agent: "fuzz", TS: 2, Nonce: "n2"}},
+		Body:         ToolCallBody{Tool: "t", Parameters: map[string]interface{}{"text": "<&>", "n": 1.5}, RequestID: "r"},
+	})
+	add(NewAck("fuzz", "n1", "n2"))
+	add(NewStreamData("fuzz", "s", 3, "stdout", []byte{0, 1, 2}))
+	add(NewError("broker", ErrorBody{Code: ErrorRateLimited, Message: "slow down", Retryable: true}))
+	return seeds, pub
+}
+
+// FuzzParseEnvelope checks that no input panics the parser, the typed body
+// decoders, body validation or signature verification, and that accepted
+// input stays within the parse limits
+func FuzzParseEnvelope(f *testing.F) {
+	seeds, pub := fuzzSeeds(f)
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Add([]byte(`{"type":"toolCall","body":[[[[[[[[[[]]]]]]]]]]}`))
+	f.Add([]byte(`{"type":"registerAgent","body":{"capabilities":"x"}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		envelope, err := ParseEnvelope(data)
+		if err != nil {
+			return
+		}
+		if len(data) > MaxEnvelopeSize {
+			t.Fatalf("Accepted an envelope of %d bytes", len(data))
+		}
+		envelope.ParseTypedEnvelope()
+		envelope.SchemaNotices()
+		if err := envelope.Validate(); err != nil {
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) || len(invalid.Fields) == 0 || len(invalid.Fields) > maxFieldErrors {
+				t.Fatalf("Validate returned %v", err)
+			}
+		}
+		envelope.Verify(pub)
+		envelope.Verify(nil)
+		envelope.SigningBytes()
+		if t, ok := bodyTypes[envelope.Type]; ok {
+			envelope.GetBodyAs(reflect.New(t).Interface())
+		}
+	})
+}
+
+// FuzzMsgPackEnvelope checks that no MessagePack input panics the decoder,
+// and that what it decodes transcodes back and stays within the limits
+func FuzzMsgPackEnvelope(f *testing.F) {
+	seeds, _ := fuzzSeeds(f)
+	for _, seed := range seeds {
+		envelope, _ := JSONCodec.Unmarshal(seed)
+		data, err := MsgPackCodec.Marshal(envelope)
+		if err != nil {
+			f.Fatalf("Encoding seed failed: %v", err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		envelope, err := ParseEnvelopeWithCodec(data, MsgPackCodec)
+		if err != nil {
+			return
+		}
+		if len(envelope.Body) > MaxEnvelopeSize {
+			t.Fatalf("Decoded a body of %d bytes", len(envelope.Body))
+		}
+		if len(envelope.Body) > 0 && !json.Valid(envelope.Body) {
+			t.Fatalf("Decoded an invalid JSON body %q", envelope.Body)
+		}
+		if _, err := JSONToMsgPack(envelope.Body); len(envelope.Body) > 0 && err != nil {
+			t.Fatalf("Decoded body does not transcode back: %v", err)
+		}
+	})
+}
+
+// FuzzJSONMsgPackRoundTrip checks that a JSON document survives a round
+// trip through MessagePack unchanged, so signatures still verify
+func FuzzJSONMsgPackRoundTrip(f *testing.F) {
+	seeds, _ := fuzzSeeds(f)
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Add([]byte(`[1e400, -0, 0.1, 18446744073709551616, "é😀"]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packed, err := JSONToMsgPack(data)
+		if err != nil {
+			return
+		}
+		unpacked, err := MsgPackToJSON(packed)
+		if err != nil {
+			t.Fatalf("Transcoding back failed: %v", err)
+		}
+		// Strings and numbers are written back as encoding/json writes them,
+		// so the round trip is exact for bodies it marshaled. Other input
+		// must at least come back stable.
+		again, err := JSONToMsgPack(unpacked)
+		if err != nil {
+			t.Fatalf("Transcoding the result failed: %v", err)
+		}
+		if stable, _ := MsgPackToJSON(again); !bytes.Equal(stable, unpacked) {
+			t.Fatalf("Round trip is not stable: %s became %s", unpacked, stable)
+		}
+		if !canonicalJSON(data) {
+			return
+		}
+		// Compared as signed, compact and with <, > and & escaped
+		want, _ := json.Marshal(json.RawMessage(data))
+		got, _ := json.Marshal(json.RawMessage(unpacked))
+		if !bytes.Equal(want, got) {
+			t.Fatalf("Round trip changed %s into %s", want, got)
+		}
+	})
+}
+
+// FuzzCBOREnvelope checks that no CBOR input panics the decoder, and that
+// what it decodes transcodes back and stays within the limits
+func FuzzCBOREnvelope(f *testing.F) {
+	seeds, _ := fuzzSeeds(f)
+	for _, seed := range seeds {
+		envelope, _ := JSONCodec.Unmarshal(seed)
+		data, err := CBORCodec.Marshal(envelope)
+		if err != nil {
+			f.Fatalf("Encoding seed failed: %v", err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		envelope, err := ParseEnvelopeWithCodec(data, CBORCodec)
+		if err != nil {
+			return
+		}
+		if len(envelope.Body) > MaxEnvelopeSize {
+			t.Fatalf("Decoded a body of %d bytes", len(envelope.Body))
+		}
+		if len(envelope.Body) > 0 && !json.Valid(envelope.Body) {
+			t.Fatalf("Decoded an invalid JSON body %q", envelope.Body)
+		}
+		if _, err := JSONToCBOR(envelope.Body); len(envelope.Body) > 0 && err != nil {
+			t.Fatalf("Decoded body does not transcode back: %v", err)
+		}
+	})
+}
+
+// FuzzJSONCBORRoundTrip checks that a JSON document survives a round trip
+// through CBOR unchanged, so signatures still verify
+func FuzzJSONCBORRoundTrip(f *testing.F) {
+	seeds, _ := fuzzSeeds(f)
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Add([]byte(`[1e400, -0, 0.1, 18446744073709551616, -9223372036854775809, "é😀"]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		encoded, err := JSONToCBOR(data)
+		if err != nil {
+			return
+		}
+		decoded, err := CBORToJSON(encoded)
+		if err != nil {
+			t.Fatalf("Transcoding back failed: %v", err)
+		}
+		again, err := JSONToCBOR(decoded)
+		if err != nil {
+			t.Fatalf("Transcoding the result failed: %v", err)
+		}
+		if stable, _ := CBORToJSON(again); !bytes.Equal(stable, decoded) {
+			t.Fatalf("Round trip is not stable: %s became %s", decoded, stable)
+		}
+		if !canonicalJSON(data) {
+			return
+		}
+		want, _ := json.Marshal(json.RawMessage(data))
+		got, _ := json.Marshal(json.RawMessage(decoded))
+		if !bytes.Equal(want, got) {
+			t.Fatalf("Round trip changed %s into %s", want, got)
+		}
+	})
+}
+
+// FuzzDecodePublicKey checks that no encoded key panics decoding or
+// verification with the key
+func FuzzDecodePublicKey(f *testing.F) {
+	pub, _, _ := GenerateKeyPair()
+	f.Add(EncodePublicKey(pub))
+	f.Add("AAAA")
+
+	f.Fuzz(func(t *testing.T, encoded string) {
+		key, err := DecodePublicKey(encoded)
+		if err != nil {
+			return
+		}
+		envelope := NewEnvelope(EnvelopeToolCall, "fuzz")
+		envelope.Sig = "AAAA"
+		envelope.Verify(key)
+	})
+}
+
+// canonicalJSON reports whether data writes its strings and numbers as
+// encoding/json would, which the transcoder reproduces exactly
+func canonicalJSON(data []byte) bool {
+	if !utf8.Valid(data) || bytes.IndexByte(data, '\\') >= 0 {
+		return false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		number, ok := token.(json.Number)
+		if !ok {
+			continue
+		}
+		var canonical []byte
+		if i, err := strconv.ParseInt(number.String(), 10, 64); err == nil {
+			canonical = strconv.AppendInt(nil, i, 10)
+		} else if u, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+			canonical = strconv.AppendUint(nil, u, 10)
+		} else if f, err := number.Float64(); err == nil {
+			canonical, _ = json.Marshal(f)
+		}
+		if string(canonical) != number.String() {
+			return false
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 )
@@ -9,10 +11,72 @@ import (
 type GenericEnvelope struct {
 	BaseEnvelope
 	Body json.RawMessage `json:"body"`
+	Hops int             `json:"-"` // Brokers that have relayed the envelope, from HeaderHops
+
+	// RemoteAddr is the network address the envelope arrived from, set by
+	// the receiving transport
+	RemoteAddr string `json:"-"`
+
+	// ClientCert is the verified TLS client certificate of the connection
+	// the envelope arrived over, if the client presented one
+	ClientCert *x509.Certificate `json:"-"`
+
+	// Session is the session token the envelope was sent with, from
+	// HeaderSession, standing in for a check of its signature
+	Session string `json:"-"`
+
+	// Bearer is the token from the Authorization header of the request the
+	// envelope arrived in, for brokers that authenticate registrations
+	// with JWTs
+	Bearer string `json:"-"`
 }
 
+// HeaderHops is the HTTP header brokers use to count how many brokers have
+// relayed an envelope, so federated forwarding cannot loop
+const HeaderHops = "X-FEM-Hops"
+
+// HeaderSession carries the session token a broker issues once it has
+// verified an agent's signature over a connection. Agents send it back with
+// later envelopes on the same connection, which the broker then accepts
+// without verifying their signatures again.
+const HeaderSession = "X-FEM-Session"
+
+// HeaderSuccessor is set by a draining broker on the envelopes it refuses,
+// with the URL of the broker agents should move to
+const HeaderSuccessor = "X-FEM-Successor"
+
+// HeaderQuotaWarning is set by a broker on the responses to a sender that
+// has used most of its rate limit, such as "type=toolCall; used=85", with
+// "; grace=12" added while the limit is exceeded but the sender's grace
+// period lets its envelopes through for that many more seconds
+const HeaderQuotaWarning = "X-FEM-Quota-Warning"
+
+// Limits on what parsing one envelope may consume. ParseEnvelope and
+// ParseEnvelopeWithCodec refuse envelopes beyond them before decoding, so
+// untrusted input cannot exhaust the receiver's memory or stack. Receivers
+// should stop reading input at MaxEnvelopeSize rather than buffer more.
+const (
+	// MaxEnvelopeSize bounds an encoded envelope, and its body once
+	// transcoded to JSON
+	MaxEnvelopeSize = 4 << 20
+	// MaxEnvelopeDepth bounds how deeply an envelope nests objects and
+	// arrays
+	MaxEnvelopeDepth = 512
+)
+
+var (
+	// ErrEnvelopeTooLarge is returned for envelopes over MaxEnvelopeSize
+	ErrEnvelopeTooLarge = fmt.Errorf("envelope exceeds %d bytes", MaxEnvelopeSize)
+	// ErrEnvelopeTooDeep is returned for envelopes nesting deeper than
+	// MaxEnvelopeDepth
+	ErrEnvelopeTooDeep = fmt.Errorf("envelope nests deeper than %d levels", MaxEnvelopeDepth)
+)
+
 // ParseEnvelope parses a generic envelope from JSON bytes
 func ParseEnvelope(data []byte) (*GenericEnvelope, error) {
+	if err := checkEnvelopeLimits(data); err != nil {
+		return nil, fmt.Errorf("failed to parse envelope: %w", err)
+	}
 	var envelope GenericEnvelope
 	if err := json.Unmarshal(data, &envelope); err != nil {
 		return nil, fmt.Errorf("failed to parse envelope: %w", err)
@@ -20,13 +84,44 @@ func ParseEnvelope(data []byte) (*GenericEnvelope, error) {
 	return &envelope, nil
 }
 
+// checkEnvelopeLimits refuses JSON over MaxEnvelopeSize or nesting deeper
+// than MaxEnvelopeDepth, scanning it once without decoding
+func checkEnvelopeLimits(data []byte) error {
+	if len(data) > MaxEnvelopeSize {
+		return ErrEnvelopeTooLarge
+	}
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > MaxEnvelopeDepth {
+				return ErrEnvelopeTooDeep
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
 // ParseTypedEnvelope parses a generic envelope into a specific typed envelope
 func (g *GenericEnvelope) ParseTypedEnvelope() (interface{}, error) {
 	switch g.Type {
 	case EnvelopeRegisterAgent:
 		var envelope RegisterAgentEnvelope
 		envelope.BaseEnvelope = g.BaseEnvelope
-		if err := json.Unmarshal(g.Body, &envelope.Body); err != nil {
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
 			return nil, err
 		}
 		return &envelope, nil
@@ -34,7 +129,7 @@ func (g *GenericEnvelope) ParseTypedEnvelope() (interface{}, error) {
 	case EnvelopeRegisterBroker:
 		var envelope RegisterBrokerEnvelope
 		envelope.BaseEnvelope = g.BaseEnvelope
-		if err := json.Unmarshal(g.Body, &envelope.Body); err != nil {
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
 			return nil, err
 		}
 		return &envelope, nil
@@ -42,7 +137,7 @@ func (g *GenericEnvelope) ParseTypedEnvelope() (interface{}, error) {
 	case EnvelopeEmitEvent:
 		var envelope EmitEventEnvelope
 		envelope.BaseEnvelope = g.BaseEnvelope
-		if err := json.Unmarshal(g.Body, &envelope.Body); err != nil {
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
 			return nil, err
 		}
 		return &envelope, nil
@@ -50,7 +145,7 @@ func (g *GenericEnvelope) ParseTypedEnvelope() (interface{}, error) {
 	case EnvelopeRenderInstruction:
 		var envelope RenderInstructionEnvelope
 		envelope.BaseEnvelope = g.BaseEnvelope
-		if err := json.Unmarshal(g.Body, &envelope.Body); err != nil {
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
 			return nil, err
 		}
 		return &envelope, nil
@@ -58,7 +153,7 @@ func (g *GenericEnvelope) ParseTypedEnvelope() (interface{}, error) {
 	case EnvelopeToolCall:
 		var envelope ToolCallEnvelope
 		envelope.BaseEnvelope = g.BaseEnvelope
-		if err := json.Unmarshal(g.Body, &envelope.Body); err != nil {
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
 			return nil, err
 		}
 		return &envelope, nil
@@ -66,7 +161,15 @@ func (g *GenericEnvelope) ParseTypedEnvelope() (interface{}, error) {
 	case EnvelopeToolResult:
 		var envelope ToolResultEnvelope
 		envelope.BaseEnvelope = g.BaseEnvelope
-		if err := json.Unmarshal(g.Body, &envelope.Body); err != nil {
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeToolResultChunk:
+		var envelope ToolResultChunkEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
 			return nil, err
 		}
 		return &envelope, nil
@@ -74,17 +177,199 @@ func (g *GenericEnvelope) ParseTypedEnvelope() (interface{}, error) {
 	case EnvelopeRevoke:
 		var envelope RevokeEnvelope
 		envelope.BaseEnvelope = g.BaseEnvelope
-		if err := json.Unmarshal(g.Body, &envelope.Body); err != nil {
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeSubscribe:
+		var envelope SubscribeEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeUnsubscribe:
+		var envelope UnsubscribeEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopePing:
+		var envelope PingEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopePong:
+		var envelope PongEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeAgentHeartbeat:
+		var envelope AgentHeartbeatEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeDeregisterAgent:
+		var envelope DeregisterAgentEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeStreamOpen:
+		var envelope StreamOpenEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeStreamData:
+		var envelope StreamDataEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeStreamWindow:
+		var envelope StreamWindowEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeStreamClose:
+		var envelope StreamCloseEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeRegistryDigest:
+		var envelope RegistryDigestEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeRegistryDelta:
+		var envelope RegistryDeltaEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeCatalogSummary:
+		var envelope CatalogSummaryEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeBroadcast:
+		var envelope BroadcastEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeBrokerDraining:
+		var envelope BrokerDrainingEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeStateHandoff:
+		var envelope StateHandoffEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeError:
+		var envelope ErrorEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+
+	case EnvelopeAck:
+		var envelope AckEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+	case EnvelopeBatch:
+		var envelope BatchEnvelope
+		envelope.BaseEnvelope = g.BaseEnvelope
+		if err := g.GetBodyAs(&envelope.Body); err != nil {
 			return nil, err
 		}
 		return &envelope, nil
 
 	default:
-		return nil, fmt.Errorf("unknown envelope type: %s", g.Type)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEnvelopeType, g.Type)
 	}
 }
 
-// GetBodyAs unmarshals the envelope body into the provided struct
+// GetBodyAs unmarshals the envelope body into the provided struct. Fields
+// sent under a former name (see FieldChange) are read as their current one.
 func (g *GenericEnvelope) GetBodyAs(v interface{}) error {
-	return json.Unmarshal(g.Body, v)
-}
\ No newline at end of file
+	body, err := upgradeBody(g.Body, v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+// SigningBytes returns the bytes the envelope's signature covers: the
+// envelope without sig in the canonical form of RFC 8785 (see Canonicalize)
+func (g *GenericEnvelope) SigningBytes() ([]byte, error) {
+	envelope := Envelope{
+		Type:          g.Type,
+		CommonHeaders: g.CommonHeaders,
+		Body:          g.Body,
+	}
+	envelope.Sig = ""
+	return marshalCanonical(envelope)
+}
+
+// Verify verifies the envelope signature with the given public key
+func (g *GenericEnvelope) Verify(publicKey ed25519.PublicKey) error {
+	return g.VerifyKey(publicKey)
+}
+
+// VerifyKey is Verify for a public key of any supported algorithm
+func (g *GenericEnvelope) VerifyKey(publicKey PublicKey) error {
+	envelope := Envelope{
+		Type:          g.Type,
+		CommonHeaders: g.CommonHeaders,
+		Body:          g.Body,
+	}
+	return VerifyEnvelope(&envelope, publicKey)
+}
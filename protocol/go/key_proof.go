@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+// StatusChallenge is the status of a registration the broker holds back
+// until the agent proves it owns the key it registers
+const StatusChallenge = "challenge"
+
+// RegistrationChallenge is the broker's answer to a registration that needs
+// a proof of key ownership. The agent registers again with the challenge
+// and its signature in the body.
+type RegistrationChallenge struct {
+	Status    string `json:"status"` // StatusChallenge
+	Agent     string `json:"agent"`
+	Challenge string `json:"challenge"` // Random, base64
+	Expires   int64  `json:"expires"`   // Unix time in milliseconds
+}
+
+// keyProofBytes is what an agent signs to prove it owns its key. The agent
+// ID is included so a proof cannot be replayed under another agent's name.
+func keyProofBytes(agent, challenge string) []byte {
+	return []byte("fem-key-proof:" + agent + ":" + challenge)
+}
+
+// SignKeyProof signs a registration challenge with the key being registered
+func SignKeyProof(agent, challenge string, key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, keyProofBytes(agent, challenge)))
+}
+
+// SignKeyProofWith is SignKeyProof for a Signer, such as a key held in a KMS
+func SignKeyProofWith(agent, challenge string, signer Signer) (string, error) {
+	signature, err := signMessage(signer, keyProofBytes(agent, challenge))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// VerifyKeyProof checks an agent's signature of a registration challenge
+func VerifyKeyProof(agent, challenge, sig string, pubKey PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("%w: key proof encoding: %v", ErrBadSignature, err)
+	}
+	if err := VerifySignature(pubKey, keyProofBytes(agent, challenge), signature); err != nil {
+		return fmt.Errorf("key proof: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,808 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MessagePack support for envelopes.
+//
+// Envelope bodies are transcoded between JSON and MessagePack token by token,
+// preserving map key order and number formatting, so that an envelope signed
+// over its JSON form still verifies after a round trip through MessagePack.
+
+const (
+	// ContentTypeJSON is the content type of JSON encoded envelopes
+	ContentTypeJSON = "application/json"
+	// ContentTypeMsgPack is the content type of MessagePack encoded envelopes
+	ContentTypeMsgPack = "application/msgpack"
+
+	// HeaderCodecs is the response header a broker uses to advertise the
+	// envelope content types it accepts
+	HeaderCodecs = "X-FEM-Codecs"
+)
+
+// ErrMsgPackTruncated is returned when MessagePack input ends unexpectedly
+var ErrMsgPackTruncated = errors.New("msgpack: unexpected end of input")
+
+// Codec encodes and decodes envelopes for a wire content type
+type Codec interface {
+	ContentType() string
+	Marshal(envelope *Envelope) ([]byte, error)
+	Unmarshal(data []byte) (*Envelope, error)
+}
+
+var (
+	// JSONCodec encodes envelopes as JSON
+	JSONCodec Codec = jsonCodec{}
+	// MsgPackCodec encodes envelopes as MessagePack
+	MsgPackCodec Codec = msgpackCodec{}
+)
+
+// CodecForContentType returns the codec for a content type, or nil if the
+// content type is not supported. An empty content type selects JSON.
+func CodecForContentType(contentType string) Codec {
+	mediaType := contentType
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		mediaType = contentType[:i]
+	}
+
+	switch mediaType {
+	case "", ContentTypeJSON:
+		return JSONCodec
+	case ContentTypeMsgPack, "application/x-msgpack":
+		return MsgPackCodec
+	case ContentTypeCBOR:
+		return CBORCodec
+	default:
+		return nil
+	}
+}
+
+// TranscodeFromJSON transcodes a JSON document to a codec's wire format
+func TranscodeFromJSON(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case JSONCodec:
+		return data, nil
+	case MsgPackCodec:
+		return JSONToMsgPack(data)
+	case CBORCodec:
+		return JSONToCBOR(data)
+	default:
+		return nil, fmt.Errorf("no transcoder for %s", codec.ContentType())
+	}
+}
+
+// TranscodeToJSON transcodes a document in a codec's wire format to JSON
+func TranscodeToJSON(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case JSONCodec:
+		return data, nil
+	case MsgPackCodec:
+		return MsgPackToJSON(data)
+	case CBORCodec:
+		return CBORToJSON(data)
+	default:
+		return nil, fmt.Errorf("no transcoder for %s", codec.ContentType())
+	}
+}
+
+// ParseEnvelopeWithCodec parses a generic envelope encoded with the given codec
+func ParseEnvelopeWithCodec(data []byte, codec Codec) (*GenericEnvelope, error) {
+	if codec == JSONCodec {
+		return ParseEnvelope(data)
+	}
+	if len(data) > MaxEnvelopeSize {
+		return nil, fmt.Errorf("failed to parse envelope: %w", ErrEnvelopeTooLarge)
+	}
+
+	envelope, err := codec.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse envelope: %w", err)
+	}
+	// Transcoding can grow a body several times over
+	if len(envelope.Body) > MaxEnvelopeSize {
+		return nil, fmt.Errorf("failed to parse envelope: %w", ErrEnvelopeTooLarge)
+	}
+
+	return &GenericEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type:          envelope.Type,
+			CommonHeaders: envelope.CommonHeaders,
+		},
+		Body: envelope.Body,
+	}, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(envelope *Envelope) ([]byte, error) {
+	return json.Marshal(envelope)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return ContentTypeMsgPack }
+
+// Marshal encodes the envelope headers directly and transcodes the JSON body
+func (msgpackCodec) Marshal(envelope *Envelope) ([]byte, error) {
+	fields := 5
+	if envelope.Alg != "" {
+		fields++
+	}
+	if envelope.Sig != "" {
+		fields++
+	}
+
+	buf := make([]byte, 0, 64+len(envelope.Body))
+	buf = appendMsgPackMapHeader(buf, fields)
+	buf = appendMsgPackString(buf, "type")
+	buf = appendMsgPackString(buf, string(envelope.Type))
+	buf = appendMsgPackString(buf, "agent")
+	buf = appendMsgPackString(buf, envelope.Agent)
+	buf = appendMsgPackString(buf, "ts")
+	buf = appendMsgPackInt(buf, envelope.TS)
+	buf = appendMsgPackString(buf, "nonce")
+	buf = appendMsgPackString(buf, envelope.Nonce)
+	if envelope.Alg != "" {
+		buf = appendMsgPackString(buf, "alg")
+		buf = appendMsgPackString(buf, envelope.Alg)
+	}
+	if envelope.Sig != "" {
+		buf = appendMsgPackString(buf, "sig")
+		buf = appendMsgPackString(buf, envelope.Sig)
+	}
+	buf = appendMsgPackString(buf, "body")
+
+	body := envelope.Body
+	if len(body) == 0 {
+		body = json.RawMessage("null")
+	}
+	return appendJSONAsMsgPack(buf, body)
+}
+
+// Unmarshal decodes a MessagePack envelope, transcoding the body back to JSON
+func (msgpackCodec) Unmarshal(data []byte) (*Envelope, error) {
+	r := &msgpackReader{data: data}
+	n, err := r.readMapHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope Envelope
+	for i := 0; i < n; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case "type":
+			s, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			envelope.Type = EnvelopeType(s)
+		case "agent":
+			if envelope.Agent, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "ts":
+			if envelope.TS, err = r.readInt(); err != nil {
+				return nil, err
+			}
+		case "nonce":
+			if envelope.Nonce, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "alg":
+			if envelope.Alg, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "sig":
+			if envelope.Sig, err = r.readString(); err != nil {
+				return nil, err
+			}
+		case "body":
+			body, err := r.appendJSON(nil, 0)
+			if err != nil {
+				return nil, err
+			}
+			envelope.Body = body
+		default:
+			// Skip unknown fields
+			if _, err := r.appendJSON(nil, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if r.pos != len(r.data) {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(r.data)-r.pos)
+	}
+
+	return &envelope, nil
+}
+
+// JSONToMsgPack transcodes an arbitrary JSON document to MessagePack,
+// preserving object key order
+func JSONToMsgPack(data []byte) ([]byte, error) {
+	return appendJSONAsMsgPack(make([]byte, 0, len(data)), data)
+}
+
+// MsgPackToJSON transcodes a MessagePack document to compact JSON,
+// preserving map key order
+func MsgPackToJSON(data []byte) ([]byte, error) {
+	r := &msgpackReader{data: data}
+	out, err := r.appendJSON(make([]byte, 0, len(data)*2), 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(r.data) {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(r.data)-r.pos)
+	}
+	return out, nil
+}
+
+// maxMsgPackDepth bounds nesting when transcoding untrusted input
+const maxMsgPackDepth = MaxEnvelopeDepth
+
+// JSON to MessagePack
+
+func appendJSONAsMsgPack(dst []byte, data []byte) ([]byte, error) {
+	// Validate up front so the scanner below can assume well-formed input
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("msgpack: invalid JSON input")
+	}
+
+	s := &jsonScanner{data: data}
+	dst, err := s.appendValue(dst, 0)
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// jsonScanner walks a validated JSON document and emits MessagePack
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *jsonScanner) appendValue(dst []byte, depth int) ([]byte, error) {
+	if depth > maxMsgPackDepth {
+		return nil, fmt.Errorf("msgpack: nesting exceeds %d levels", maxMsgPackDepth)
+	}
+
+	s.skipSpace()
+	switch c := s.data[s.pos]; c {
+	case 'n':
+		s.pos += 4
+		return append(dst, 0xc0), nil
+	case 't':
+		s.pos += 4
+		return append(dst, 0xc3), nil
+	case 'f':
+		s.pos += 5
+		return append(dst, 0xc2), nil
+	case '"':
+		str, err := s.readString()
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgPackBytesAsString(dst, str), nil
+	case '{', '[':
+		return s.appendContainer(dst, c, depth)
+	default:
+		start := s.pos
+		for s.pos < len(s.data) && strings.IndexByte("+-0123456789.eE", s.data[s.pos]) >= 0 {
+			s.pos++
+		}
+		return appendMsgPackNumber(dst, s.data[start:s.pos])
+	}
+}
+
+// appendContainer encodes an object or array. A one byte header is reserved
+// and widened in place if the element count turns out to need more room.
+func (s *jsonScanner) appendContainer(dst []byte, open byte, depth int) ([]byte, error) {
+	s.pos++
+	headerPos := len(dst)
+	dst = append(dst, 0)
+
+	count := 0
+	var err error
+	for {
+		s.skipSpace()
+		if c := s.data[s.pos]; c == '}' || c == ']' {
+			s.pos++
+			break
+		} else if c == ',' {
+			s.pos++
+			s.skipSpace()
+		}
+
+		if open == '{' {
+			key, err := s.readString()
+			if err != nil {
+				return nil, err
+			}
+			dst = appendMsgPackBytesAsString(dst, key)
+			s.skipSpace()
+			s.pos++ // ':'
+		}
+		if dst, err = s.appendValue(dst, depth+1); err != nil {
+			return nil, err
+		}
+		count++
+	}
+
+	var header []byte
+	if open == '{' {
+		header = appendMsgPackMapHeader(nil, count)
+	} else {
+		header = appendMsgPackArrayHeader(nil, count)
+	}
+	if len(header) == 1 {
+		dst[headerPos] = header[0]
+		return dst, nil
+	}
+
+	// Shift the elements right to make room for a wider header
+	extra := len(header) - 1
+	dst = append(dst, header[:extra]...)
+	copy(dst[headerPos+len(header):], dst[headerPos+1:len(dst)-extra])
+	copy(dst[headerPos:], header)
+	return dst, nil
+}
+
+// readString returns the string starting at the current quote, decoding
+// escapes only when present
+func (s *jsonScanner) readString() ([]byte, error) {
+	start := s.pos
+	s.pos++
+	escaped := false
+	for s.data[s.pos] != '"' {
+		if s.data[s.pos] == '\\' {
+			escaped = true
+			s.pos++
+		}
+		s.pos++
+	}
+	s.pos++
+
+	if !escaped {
+		return s.data[start+1 : s.pos-1], nil
+	}
+
+	var str string
+	if err := json.Unmarshal(s.data[start:s.pos], &str); err != nil {
+		return nil, err
+	}
+	return []byte(str), nil
+}
+
+func appendMsgPackNumber(dst []byte, number []byte) ([]byte, error) {
+	s := string(number)
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return appendMsgPackInt(dst, i), nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return appendMsgPackUint(dst, u), nil
+		}
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("msgpack: invalid number %q", s)
+	}
+	dst = append(dst, 0xcb)
+	return binary.BigEndian.AppendUint64(dst, math.Float64bits(f)), nil
+}
+
+func appendMsgPackInt(dst []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgPackUint(dst, uint64(i))
+	case i >= -32:
+		return append(dst, byte(i))
+	case i >= math.MinInt8:
+		return append(dst, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(i))
+	}
+}
+
+func appendMsgPackUint(dst []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(dst, byte(u))
+	case u <= math.MaxUint8:
+		return append(dst, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xce), uint32(u))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, 0xcf), u)
+	}
+}
+
+func appendMsgPackString(dst []byte, s string) []byte {
+	dst = appendMsgPackStringHeader(dst, len(s))
+	return append(dst, s...)
+}
+
+func appendMsgPackBytesAsString(dst []byte, b []byte) []byte {
+	dst = appendMsgPackStringHeader(dst, len(b))
+	return append(dst, b...)
+}
+
+func appendMsgPackStringHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 32:
+		dst = append(dst, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, 0xda), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xdb), uint32(n))
+	}
+	return dst
+}
+
+func appendMsgPackMapHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(dst, 0xdf), uint32(n))
+	}
+}
+
+func appendMsgPackArrayHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(dst, 0xdd), uint32(n))
+	}
+}
+
+// MessagePack to JSON
+
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, ErrMsgPackTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgpackReader) readByte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *msgpackReader) readLength(size int) (int, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		n := binary.BigEndian.Uint32(b)
+		if uint64(n) > uint64(len(r.data)) {
+			return 0, ErrMsgPackTruncated
+		}
+		return int(n), nil
+	}
+}
+
+func (r *msgpackReader) readMapHeader() (int, error) {
+	c, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		return r.readLength(2)
+	case c == 0xdf:
+		return r.readLength(4)
+	default:
+		return 0, fmt.Errorf("msgpack: expected map, got 0x%02x", c)
+	}
+}
+
+func (r *msgpackReader) readString() (string, error) {
+	c, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	n, err := r.stringLength(c)
+	if err != nil {
+		return "", err
+	}
+	b, err := r.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (r *msgpackReader) stringLength(c byte) (int, error) {
+	switch {
+	case c&0xe0 == 0xa0:
+		return int(c & 0x1f), nil
+	case c == 0xd9:
+		return r.readLength(1)
+	case c == 0xda:
+		return r.readLength(2)
+	case c == 0xdb:
+		return r.readLength(4)
+	default:
+		return 0, fmt.Errorf("msgpack: expected string, got 0x%02x", c)
+	}
+}
+
+func (r *msgpackReader) readInt() (int64, error) {
+	start := r.pos
+	out, err := r.appendJSON(nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(string(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("msgpack: expected integer at offset %d", start)
+	}
+	return i, nil
+}
+
+// appendJSON transcodes the next MessagePack value to JSON
+func (r *msgpackReader) appendJSON(dst []byte, depth int) ([]byte, error) {
+	if depth > maxMsgPackDepth {
+		return nil, fmt.Errorf("msgpack: nesting exceeds %d levels", maxMsgPackDepth)
+	}
+
+	c, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return strconv.AppendInt(dst, int64(c), 10), nil
+	case c >= 0xe0:
+		return strconv.AppendInt(dst, int64(int8(c)), 10), nil
+	case c&0xf0 == 0x80:
+		return r.appendJSONMap(dst, int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return r.appendJSONArray(dst, int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return r.appendJSONString(dst, int(c&0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return append(dst, "null"...), nil
+	case 0xc2:
+		return append(dst, "false"...), nil
+	case 0xc3:
+		return append(dst, "true"...), nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.readLength(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, '"')
+		dst = append(dst, base64.StdEncoding.EncodeToString(b)...)
+		return append(dst, '"'), nil
+	case 0xca:
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONFloat(dst, float64(math.Float32frombits(binary.BigEndian.Uint32(b))), 32)
+	case 0xcb:
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONFloat(dst, math.Float64frombits(binary.BigEndian.Uint64(b)), 64)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		size := 1 << (c - 0xcc)
+		b, err := r.next(size)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendUint(dst, readBigEndian(b), 10), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		b, err := r.next(size)
+		if err != nil {
+			return nil, err
+		}
+		u := readBigEndian(b)
+		shift := 64 - 8*size
+		return strconv.AppendInt(dst, int64(u<<shift)>>shift, 10), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.stringLength(c)
+		if err != nil {
+			return nil, err
+		}
+		return r.appendJSONString(dst, n)
+	case 0xdc, 0xdd:
+		n, err := r.readLength(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.appendJSONArray(dst, n, depth)
+	case 0xde, 0xdf:
+		n, err := r.readLength(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.appendJSONMap(dst, n, depth)
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+	}
+}
+
+func (r *msgpackReader) appendJSONMap(dst []byte, n int, depth int) ([]byte, error) {
+	dst = append(dst, '{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		c, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.stringLength(c)
+		if err != nil {
+			return nil, fmt.Errorf("msgpack: map keys must be strings: %w", err)
+		}
+		if dst, err = r.appendJSONString(dst, length); err != nil {
+			return nil, err
+		}
+		dst = append(dst, ':')
+		if dst, err = r.appendJSON(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+func (r *msgpackReader) appendJSONArray(dst []byte, n int, depth int) ([]byte, error) {
+	dst = append(dst, '[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		var err error
+		if dst, err = r.appendJSON(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+func (r *msgpackReader) appendJSONString(dst []byte, n int) ([]byte, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONStringBytes(dst, b)
+}
+
+// appendJSONStringBytes appends a string as a JSON string
+func appendJSONStringBytes(dst []byte, b []byte) ([]byte, error) {
+	// Fast path for strings that need no escaping
+	simple := true
+	for _, c := range b {
+		if c < 0x20 || c >= utf8.RuneSelf || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			simple = false
+			break
+		}
+	}
+	if simple {
+		dst = append(dst, '"')
+		dst = append(dst, b...)
+		return append(dst, '"'), nil
+	}
+
+	// Match encoding/json escaping so signed bytes are reproduced exactly
+	quoted, err := json.Marshal(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, quoted...), nil
+}
+
+// appendJSONFloat formats a float the same way encoding/json does
+func appendJSONFloat(dst []byte, f float64, bits int) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, fmt.Errorf("msgpack: unsupported float value %v", f)
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, bits)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
+
+func readBigEndian(b []byte) uint64 {
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u
+}
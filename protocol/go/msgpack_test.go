@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newTestToolCall(t testing.TB) *ToolCallEnvelope {
+	t.Helper()
+	return &ToolCallEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeToolCall,
+			CommonHeaders: CommonHeaders{
+				Agent: "test.agent",
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: ToolCallBody{
+			Tool: "sensor.read",
+			Parameters: map[string]interface{}{
+				"channel":    3,
+				"scale":      0.25,
+				"negative":   -40,
+				"large":      uint64(1) << 40,
+				"tiny":       1e-9,
+				"label":      "temp <inside> & \"outside\"",
+				"enabled":    true,
+				"missing":    nil,
+				"history":    []interface{}{1.5, 2, "three"},
+				"thresholds": map[string]interface{}{"high": 80, "low": -10.5},
+			},
+			RequestID: "req-001",
+		},
+	}
+}
+
+func TestMsgPackTranscodingRoundTrip(t *testing.T) {
+	inputs := []string{
+		`null`,
+		`true`,
+		`"hello"`,
+		`0`,
+		`-1`,
+		`-33`,
+		`255`,
+		`65536`,
+		`-2147483649`,
+		`18446744073709551615`,
+		`1.5`,
+		`1e+21`,
+		`1e-7`,
+		`[]`,
+		`{}`,
+		`{"z":1,"a":[1,2,{"nested":"value"}],"m":null}`,
+		`"line\nbreak \u003c\u003e \u0026 \"quoted\" ünïcode"`,
+	}
+
+	for _, input := range inputs {
+		packed, err := JSONToMsgPack([]byte(input))
+		if err != nil {
+			t.Errorf("JSONToMsgPack(%s) failed: %v", input, err)
+			continue
+		}
+
+		output, err := MsgPackToJSON(packed)
+		if err != nil {
+			t.Errorf("MsgPackToJSON(%s) failed: %v", input, err)
+			continue
+		}
+
+		if string(output) != input {
+			t.Errorf("Round trip mismatch: got %s, want %s", output, input)
+		}
+	}
+}
+
+func TestMsgPackEnvelopeSignatureSurvivesRoundTrip(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	typed := newTestToolCall(t)
+	if err := typed.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign envelope: %v", err)
+	}
+
+	data, err := json.Marshal(typed)
+	if err != nil {
+		t.Fatalf("Failed to marshal envelope: %v", err)
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("Failed to unmarshal envelope: %v", err)
+	}
+
+	packed, err := MsgPackCodec.Marshal(&envelope)
+	if err != nil {
+		t.Fatalf("Failed to encode msgpack envelope: %v", err)
+	}
+
+	if len(packed) >= len(data) {
+		t.Errorf("Expected msgpack (%d bytes) to be smaller than JSON (%d bytes)", len(packed), len(data))
+	}
+
+	decoded, err := MsgPackCodec.Unmarshal(packed)
+	if err != nil {
+		t.Fatalf("Failed to decode msgpack envelope: %v", err)
+	}
+
+	if decoded.Type != envelope.Type || decoded.Agent != envelope.Agent || decoded.TS != envelope.TS || decoded.Nonce != envelope.Nonce {
+		t.Errorf("Header mismatch after round trip: %+v", decoded.CommonHeaders)
+	}
+
+	if !bytes.Equal(decoded.Body, envelope.Body) {
+		t.Errorf("Body mismatch after round trip:\ngot  %s\nwant %s", decoded.Body, envelope.Body)
+	}
+
+	if err := decoded.Verify(pubKey); err != nil {
+		t.Errorf("Signature verification failed after msgpack round trip: %v", err)
+	}
+}
+
+func TestParseEnvelopeWithCodec(t *testing.T) {
+	envelope := NewEnvelope(EnvelopeEmitEvent, "test.agent")
+	envelope.Body = json.RawMessage(`{"event":"sensor.temperature","payload":{"celsius":21.5}}`)
+
+	packed, err := MsgPackCodec.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Failed to encode msgpack envelope: %v", err)
+	}
+
+	codec := CodecForContentType("application/msgpack; charset=binary")
+	if codec != MsgPackCodec {
+		t.Fatalf("Expected msgpack codec, got %v", codec)
+	}
+
+	generic, err := ParseEnvelopeWithCodec(packed, codec)
+	if err != nil {
+		t.Fatalf("Failed to parse msgpack envelope: %v", err)
+	}
+
+	var body EmitEventBody
+	if err := generic.GetBodyAs(&body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+
+	if body.Event != "sensor.temperature" || body.Payload["celsius"] != 21.5 {
+		t.Errorf("Unexpected body: %+v", body)
+	}
+
+	if CodecForContentType("") != JSONCodec {
+		t.Error("Expected empty content type to select JSON")
+	}
+	if CodecForContentType("text/plain") != nil {
+		t.Error("Expected unsupported content type to return nil")
+	}
+}
+
+func TestMsgPackRejectsMalformedInput(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0x81},                         // map missing entries
+		{0xa5, 'a', 'b'},               // truncated string
+		{0xdb, 0xff, 0xff, 0xff, 0xff}, // string longer than input
+		{0x81, 0x01, 0x02},             // non-string map key
+		{0xc1},                         // reserved type
+		{0x01, 0x02},                   // trailing bytes
+	}
+
+	for _, input := range inputs {
+		if _, err := MsgPackToJSON(input); err == nil {
+			t.Errorf("Expected error for input %x", input)
+		}
+	}
+
+	if _, err := MsgPackCodec.Unmarshal([]byte{0x91, 0x01}); err == nil {
+		t.Error("Expected error for non-map envelope")
+	}
+}
+
+func benchmarkEnvelope(b *testing.B) *Envelope {
+	b.Helper()
+	typed := newTestToolCall(b)
+	data, err := json.Marshal(typed)
+	if err != nil {
+		b.Fatalf("Failed to marshal envelope: %v", err)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		b.Fatalf("Failed to unmarshal envelope: %v", err)
+	}
+	return &envelope
+}
+
+func BenchmarkEnvelopeEncodeJSON(b *testing.B) {
+	envelope := benchmarkEnvelope(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, _ := JSONCodec.Marshal(envelope)
+		b.SetBytes(int64(len(data)))
+	}
+}
+
+func BenchmarkEnvelopeEncodeMsgPack(b *testing.B) {
+	envelope := benchmarkEnvelope(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, _ := MsgPackCodec.Marshal(envelope)
+		b.SetBytes(int64(len(data)))
+	}
+}
+
+func BenchmarkEnvelopeDecodeJSON(b *testing.B) {
+	data, _ := JSONCodec.Marshal(benchmarkEnvelope(b))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		JSONCodec.Unmarshal(data)
+	}
+}
+
+func BenchmarkEnvelopeDecodeMsgPack(b *testing.B) {
+	data, _ := MsgPackCodec.Marshal(benchmarkEnvelope(b))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		MsgPackCodec.Unmarshal(data)
+	}
+}
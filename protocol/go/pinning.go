@@ -0,0 +1,246 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnpinnedBroker is returned for a broker whose identity key or
+// certificate does not match the client's pins
+var ErrUnpinnedBroker = errors.New("broker identity is not pinned")
+
+// PinConfig is the broker identity an SDK client trusts. Either list may be
+// empty; a client with neither accepts any broker.
+type PinConfig struct {
+	PublicKeys       []string `json:"publicKeys,omitempty"`       // Base64 Ed25519 keys the broker signs envelopes with
+	CertFingerprints []string `json:"certFingerprints,omitempty"` // SHA-256 of the broker's DER certificate, in hex
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of a DER certificate in
+// lower-case hex, as pinned in PinConfig.CertFingerprints
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts fingerprints as printed by openssl, with
+// colons and in upper case
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
+
+// BrokerPins checks that the broker a client talks to holds a pinned
+// identity, so a man in the middle presenting its own self-signed
+// certificate is refused
+type BrokerPins struct {
+	keys         map[string]ed25519.PublicKey // By base64 encoding
+	fingerprints map[string]bool
+	mu           sync.RWMutex
+}
+
+// NewBrokerPins creates pins from config, rejecting malformed entries
+func NewBrokerPins(config PinConfig) (*BrokerPins, error) {
+	pins := &BrokerPins{
+		keys:         make(map[string]ed25519.PublicKey),
+		fingerprints: make(map[string]bool),
+	}
+	for _, encoded := range config.PublicKeys {
+		key, err := DecodePublicKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("pinned key %q: %w", encoded, err)
+		}
+		pins.keys[EncodePublicKey(key)] = key
+	}
+	for _, fingerprint := range config.CertFingerprints {
+		normalized := normalizeFingerprint(fingerprint)
+		if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("pinned certificate fingerprint %q is not a hex SHA-256 digest", fingerprint)
+		}
+		pins.fingerprints[normalized] = true
+	}
+	return pins, nil
+}
+
+// Config returns the current pins, including keys added by rotation, so
+// they can be saved for the next start
+func (p *BrokerPins) Config() PinConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var config PinConfig
+	for encoded := range p.keys {
+		config.PublicKeys = append(config.PublicKeys, encoded)
+	}
+	for fingerprint := range p.fingerprints {
+		config.CertFingerprints = append(config.CertFingerprints, fingerprint)
+	}
+	return config
+}
+
+// VerifyCertificate checks a TLS peer's leaf certificate against the pinned
+// fingerprints. It has the signature of tls.Config.VerifyPeerCertificate.
+func (p *BrokerPins) VerifyCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.fingerprints) == 0 {
+		return nil
+	}
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%w: no certificate presented", ErrUnpinnedBroker)
+	}
+	if fingerprint := CertFingerprint(rawCerts[0]); !p.fingerprints[fingerprint] {
+		return fmt.Errorf("%w: certificate %s", ErrUnpinnedBroker, fingerprint)
+	}
+	return nil
+}
+
+// TLSConfig returns a client TLS configuration that accepts the broker's
+// certificate only if it matches a pinned fingerprint. Brokers commonly
+// serve self-signed certificates, so the pin replaces chain verification.
+func (p *BrokerPins) TLSConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p.VerifyCertificate,
+		MinVersion:            tls.VersionTLS13,
+	}
+}
+
+// HTTPClient returns an HTTP client for the broker's envelope endpoints
+// that only connects to a pinned certificate
+func (p *BrokerPins) HTTPClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: p.TLSConfig()}}
+}
+
+// VerifyEnvelope checks that an envelope from the broker is signed by a
+// pinned key. Envelopes are accepted unverified when no keys are pinned.
+func (p *BrokerPins) VerifyEnvelope(envelope interface {
+	Verify(publicKey ed25519.PublicKey) error
+}) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.keys) == 0 {
+		return nil
+	}
+	for _, key := range p.keys {
+		if envelope.Verify(key) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: envelope is not signed by a pinned key", ErrUnpinnedBroker)
+}
+
+// Rotate moves the pin from a transition's old key to its new one. The
+// transition must be signed by a currently pinned key.
+func (p *BrokerPins) Rotate(transition *KeyTransition) error {
+	if err := transition.Verify(); err != nil {
+		return err
+	}
+	to, err := DecodePublicKey(transition.To)
+	if err != nil {
+		return fmt.Errorf("transition key: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, pinned := p.keys[transition.From]; !pinned {
+		return fmt.Errorf("%w: transition is from %s", ErrUnpinnedBroker, transition.From)
+	}
+	delete(p.keys, transition.From)
+	p.keys[EncodePublicKey(to)] = to
+	return nil
+}
+
+// Update applies the transitions a broker publishes, oldest first, then
+// checks that the key it now signs with is pinned. Transitions from keys
+// that are no longer pinned are skipped, so publishing the whole history
+// is harmless.
+func (p *BrokerPins) Update(identity *BrokerIdentity) error {
+	for i := range identity.Transitions {
+		transition := &identity.Transitions[i]
+		if err := p.Rotate(transition); err != nil && !errors.Is(err, ErrUnpinnedBroker) {
+			return err
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.keys) == 0 {
+		return nil
+	}
+	if _, pinned := p.keys[identity.PubKey]; !pinned {
+		return fmt.Errorf("%w: broker key %s", ErrUnpinnedBroker, identity.PubKey)
+	}
+	return nil
+}
+
+// BrokerIdentity is what a broker publishes about its identity at
+// GET /identity
+type BrokerIdentity struct {
+	Broker          string          `json:"broker"`
+	PubKey          string          `json:"pubkey"`                    // Key the broker signs envelopes with
+	CertFingerprint string          `json:"certFingerprint,omitempty"` // Of the certificate the broker serves
+	Transitions     []KeyTransition `json:"transitions,omitempty"`     // Oldest first, ending at PubKey
+}
+
+// KeyTransition is a broker's statement, signed with its old identity key,
+// that it now signs with a new one. Clients pinning the old key follow it
+// to the new key without being reconfigured.
+type KeyTransition struct {
+	Broker string `json:"broker"`
+	From   string `json:"from"` // Base64 Ed25519 key being retired
+	To     string `json:"to"`   // Base64 Ed25519 key replacing it
+	TS     int64  `json:"ts"`   // Unix time in milliseconds of the rotation
+	Sig    string `json:"sig,omitempty"`
+}
+
+// NewKeyTransition creates a transition from the key pair of from to the
+// key to, signed with from
+func NewKeyTransition(broker string, from ed25519.PrivateKey, to ed25519.PublicKey) (*KeyTransition, error) {
+	transition := &KeyTransition{
+		Broker: broker,
+		From:   EncodePublicKey(from.Public().(ed25519.PublicKey)),
+		To:     EncodePublicKey(to),
+		TS:     time.Now().UnixMilli(),
+	}
+	data, err := marshalCanonical(transition)
+	if err != nil {
+		return nil, err
+	}
+	transition.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(from, data))
+	return transition, nil
+}
+
+// Verify checks that the transition is signed by its old key
+func (t *KeyTransition) Verify() error {
+	from, err := DecodePublicKey(t.From)
+	if err != nil {
+		return fmt.Errorf("transition key: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(t.Sig)
+	if err != nil {
+		return fmt.Errorf("%w: transition signature encoding: %v", ErrBadSignature, err)
+	}
+
+	unsigned := *t
+	unsigned.Sig = ""
+	verified, err := verifyJSON(from, unsigned, signature)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("%w: transition", ErrBadSignature)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBrokerPinsVerifyEnvelope(t *testing.T) {
+	brokerPub, brokerKey, _ := GenerateKeyPair()
+	_, forgedKey, _ := GenerateKeyPair()
+
+	pins, err := NewBrokerPins(PinConfig{PublicKeys: []string{EncodePublicKey(brokerPub)}})
+	if err != nil {
+		t.Fatalf("Failed to create pins: %v", err)
+	}
+
+	if err := pins.VerifyEnvelope(signedPong(t, brokerKey)); err != nil {
+		t.Errorf("Expected the pinned broker's envelope to verify, got %v", err)
+	}
+
+	if err := pins.VerifyEnvelope(signedPong(t, forgedKey)); !errors.Is(err, ErrUnpinnedBroker) {
+		t.Errorf("Expected a forged envelope to be refused, got %v", err)
+	}
+}
+
+func TestBrokerPinsVerifyCertificate(t *testing.T) {
+	der := []byte("certificate")
+	fingerprint := strings.ToUpper(CertFingerprint(der))
+	var colons []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colons = append(colons, fingerprint[i:i+2])
+	}
+
+	// Fingerprints are accepted in openssl's colon-separated form
+	pins, err := NewBrokerPins(PinConfig{CertFingerprints: []string{strings.Join(colons, ":")}})
+	if err != nil {
+		t.Fatalf("Failed to create pins: %v", err)
+	}
+	if err := pins.VerifyCertificate([][]byte{der}, nil); err != nil {
+		t.Errorf("Expected the pinned certificate to verify, got %v", err)
+	}
+	if err := pins.VerifyCertificate([][]byte{[]byte("self-signed by someone else")}, nil); !errors.Is(err, ErrUnpinnedBroker) {
+		t.Errorf("Expected another certificate to be refused, got %v", err)
+	}
+
+	if _, err := NewBrokerPins(PinConfig{CertFingerprints: []string{"abc"}}); err == nil {
+		t.Error("Expected a malformed fingerprint to be rejected")
+	}
+}
+
+func TestBrokerPinsRotate(t *testing.T) {
+	oldPub, oldKey, _ := GenerateKeyPair()
+	newPub, newKey, _ := GenerateKeyPair()
+	_, strangerKey, _ := GenerateKeyPair()
+
+	pins, _ := NewBrokerPins(PinConfig{PublicKeys: []string{EncodePublicKey(oldPub)}})
+
+	// A transition signed by an unpinned key moves nothing
+	hijack, _ := NewKeyTransition("broker-a", strangerKey, newPub)
+	if err := pins.Rotate(hijack); !errors.Is(err, ErrUnpinnedBroker) {
+		t.Errorf("Expected a transition from an unpinned key to be refused, got %v", err)
+	}
+
+	// Tampering with the new key breaks the signature
+	tampered, _ := NewKeyTransition("broker-a", oldKey, newPub)
+	tampered.To = EncodePublicKey(strangerKey.Public().(ed25519.PublicKey))
+	if err := pins.Rotate(tampered); err == nil || errors.Is(err, ErrUnpinnedBroker) {
+		t.Errorf("Expected a tampered transition to fail verification, got %v", err)
+	}
+
+	transition, _ := NewKeyTransition("broker-a", oldKey, newPub)
+	identity := &BrokerIdentity{Broker: "broker-a", PubKey: EncodePublicKey(newPub), Transitions: []KeyTransition{*transition}}
+	if err := pins.Update(identity); err != nil {
+		t.Fatalf("Expected the transition to be followed, got %v", err)
+	}
+	if keys := pins.Config().PublicKeys; len(keys) != 1 || keys[0] != EncodePublicKey(newPub) {
+		t.Errorf("Expected only the new key to be pinned, got %v", keys)
+	}
+
+	if err := pins.VerifyEnvelope(signedPong(t, newKey)); err != nil {
+		t.Errorf("Expected envelopes signed with the new key to verify, got %v", err)
+	}
+
+	// Publishing the same history again is harmless
+	if err := pins.Update(identity); err != nil {
+		t.Errorf("Expected an already applied transition to be skipped, got %v", err)
+	}
+}
+
+// signedPong returns a pong signed with key, as a client receives it
+func signedPong(t *testing.T, key ed25519.PrivateKey) *GenericEnvelope {
+	t.Helper()
+	pong := NewPong("broker-a", NewPing("agent-a", ""))
+	if err := pong.Sign(key); err != nil {
+		t.Fatalf("Failed to sign pong: %v", err)
+	}
+	data, _ := json.Marshal(pong)
+	envelope, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse pong: %v", err)
+	}
+	return envelope
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import "time"
+
+// DeliveryReceipt times the legs of a routed tool call, for a caller that
+// set Receipt on it. Times are Unix milliseconds; each interval is taken
+// from a single clock, the broker's or the providing agent's, so clocks
+// need not agree.
+type DeliveryReceipt struct {
+	Received  int64 `json:"received,omitempty"`  // The broker accepted the call
+	Delivered int64 `json:"delivered,omitempty"` // The broker handed the call to the provider
+	Accepted  int64 `json:"accepted,omitempty"`  // Reported by the provider: it took the call
+	Started   int64 `json:"started,omitempty"`   // Reported by the provider: the tool started running
+	Finished  int64 `json:"finished,omitempty"`  // Reported by the provider: the tool returned
+	Returned  int64 `json:"returned,omitempty"`  // The broker had the result
+}
+
+// LatencyBreakdown divides the time a call took between the network,
+// waiting in queues and running the tool
+type LatencyBreakdown struct {
+	Network   time.Duration `json:"network"`
+	Queueing  time.Duration `json:"queueing"`
+	Execution time.Duration `json:"execution"`
+}
+
+// Breakdown divides total, the time the caller waited for the result, by
+// the receipt. Queueing is the time the broker held the call before
+// delivering it plus the time the provider held it before starting it,
+// execution the time the tool ran, and network whatever remains. With
+// total zero, the time the broker held the call is divided instead.
+func (r *DeliveryReceipt) Breakdown(total time.Duration) LatencyBreakdown {
+	var breakdown LatencyBreakdown
+	if r == nil {
+		breakdown.Network = total
+		return breakdown
+	}
+	breakdown.Queueing = receiptInterval(r.Received, r.Delivered) + receiptInterval(r.Accepted, r.Started)
+	breakdown.Execution = receiptInterval(r.Started, r.Finished)
+
+	if total == 0 {
+		total = receiptInterval(r.Received, r.Returned)
+	}
+	if network := total - breakdown.Queueing - breakdown.Execution; network > 0 {
+		breakdown.Network = network
+	}
+	return breakdown
+}
+
+// receiptInterval is the time between two receipt timestamps, or zero if
+// either is missing
+func receiptInterval(from, to int64) time.Duration {
+	if from == 0 || to < from {
+		return 0
+	}
+	return time.Duration(to-from) * time.Millisecond
+}
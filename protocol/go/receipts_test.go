@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDeliveryReceiptBreakdown(t *testing.T) {
+	receipt := &DeliveryReceipt{
+		Received:  1000,
+		Delivered: 1020, // 20ms in the broker
+		Accepted:  5000, // The provider's clock is well ahead
+		Started:   5030, // 30ms in the provider's queue
+		Finished:  5130, // 100ms running
+		Returned:  1200,
+	}
+
+	got := receipt.Breakdown(250 * time.Millisecond)
+	want := LatencyBreakdown{Network: 100 * time.Millisecond, Queueing: 50 * time.Millisecond, Execution: 100 * time.Millisecond}
+	if got != want {
+		t.Errorf("Breakdown of the caller's wait: got %+v, want %+v", got, want)
+	}
+
+	// Without the caller's wait, the broker's share is divided
+	if got := receipt.Breakdown(0); got.Network != 50*time.Millisecond {
+		t.Errorf("Expected 50ms of network within the broker's 200ms, got %+v", got)
+	}
+
+	// A provider that reports no timing leaves its share to the network
+	partial := &DeliveryReceipt{Received: 1000, Delivered: 1010, Returned: 1100}
+	if got := partial.Breakdown(0); got.Queueing != 10*time.Millisecond || got.Execution != 0 || got.Network != 90*time.Millisecond {
+		t.Errorf("Unexpected breakdown without provider timing: %+v", got)
+	}
+
+	var missing *DeliveryReceipt
+	if got := missing.Breakdown(time.Second); got.Network != time.Second {
+		t.Errorf("Expected a call without a receipt to count as network, got %+v", got)
+	}
+}
+
+func TestToolResultBuilderTiming(t *testing.T) {
+	_, key, _ := GenerateKeyPair()
+	accepted := time.UnixMilli(1000)
+	envelope, err := NewToolResult("provider", "req-1").
+		Timing(accepted, accepted.Add(5*time.Millisecond), accepted.Add(25*time.Millisecond)).
+		Result("ok").
+		SignWith(key).
+		Build()
+	if err != nil {
+		t.Fatalf("Failed to build tool result: %v", err)
+	}
+	if r := envelope.Body.Receipt; r == nil || r.Accepted != 1000 || r.Started != 1005 || r.Finished != 1025 {
+		t.Errorf("Unexpected timing: %+v", envelope.Body.Receipt)
+	}
+
+	call, err := NewToolCall("caller").Tool("provider/tool").Receipt().SignWith(key).Build()
+	if err != nil {
+		t.Fatalf("Failed to build tool call: %v", err)
+	}
+	data, _ := json.Marshal(call)
+	var decoded ToolCallEnvelope
+	if err := json.Unmarshal(data, &decoded); err != nil || !decoded.Body.Receipt {
+		t.Errorf("Expected the call to ask for a receipt: %s", data)
+	}
+}
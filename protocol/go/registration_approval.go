@@ -0,0 +1,12 @@
+package protocol
+
+import "errors"
+
+// StatusPendingApproval is the status of a registration the broker holds
+// until an operator approves the agent. The registration takes effect on
+// approval, without the agent registering again.
+const StatusPendingApproval = "pendingApproval"
+
+// ErrRegistrationPending is returned by SDK clients whose registration is
+// waiting for an operator's approval
+var ErrRegistrationPending = errors.New("registration is pending approval")
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultResultChunkSize is how much of a result SplitToolResult puts in
+// each chunk, leaving an envelope well under MaxEnvelopeSize once base64
+// encoded
+const DefaultResultChunkSize = 1 << 20
+
+var (
+	// ErrChunkMismatch is returned for a chunk of another request
+	ErrChunkMismatch = errors.New("chunk belongs to another request")
+	// ErrDuplicateChunk is returned for a chunk number already received
+	ErrDuplicateChunk = errors.New("chunk already received")
+	// ErrChunkAfterFinal is returned for a chunk numbered past the final one
+	ErrChunkAfterFinal = errors.New("chunk follows the final chunk")
+	// ErrResultTooLarge is returned when chunks exceed the assembler's limit
+	ErrResultTooLarge = errors.New("result exceeds the size limit")
+)
+
+// ResultAssembler reassembles a tool result from its toolResultChunk
+// envelopes, which may arrive in any order. It is not safe for concurrent
+// use.
+type ResultAssembler struct {
+	requestID string
+	maxBytes  int64
+	chunks    map[uint64][]byte
+	size      int64
+	final     uint64 // Number of the final chunk, zero until it arrives
+	err       string
+}
+
+// NewResultAssembler creates an assembler for the chunks of requestID,
+// holding at most maxBytes of data, or any amount if maxBytes is zero
+func NewResultAssembler(requestID string, maxBytes int64) *ResultAssembler {
+	return &ResultAssembler{requestID: requestID, maxBytes: maxBytes, chunks: make(map[uint64][]byte)}
+}
+
+// Add records a chunk, reporting whether the result is complete: the final
+// chunk and every chunk before it have arrived
+func (a *ResultAssembler) Add(chunk ToolResultChunkBody) (bool, error) {
+	switch {
+	case chunk.RequestID != a.requestID:
+		return false, ErrChunkMismatch
+	case chunk.Seq == 0:
+		return false, fmt.Errorf("chunk numbers start at 1")
+	case a.final != 0 && chunk.Seq > a.final:
+		return false, ErrChunkAfterFinal
+	}
+	if _, seen := a.chunks[chunk.Seq]; seen {
+		return false, ErrDuplicateChunk
+	}
+	if chunk.Final && a.highest() > chunk.Seq {
+		return false, ErrChunkAfterFinal
+	}
+	if a.maxBytes > 0 && a.size+int64(len(chunk.Data)) > a.maxBytes {
+		return false, ErrResultTooLarge
+	}
+	if chunk.Final {
+		a.final = chunk.Seq
+		a.err = chunk.Error
+	}
+
+	a.chunks[chunk.Seq] = chunk.Data
+	a.size += int64(len(chunk.Data))
+	return a.Complete(), nil
+}
+
+// highest returns the largest chunk number received
+func (a *ResultAssembler) highest() uint64 {
+	var highest uint64
+	for seq := range a.chunks {
+		if seq > highest {
+			highest = seq
+		}
+	}
+	return highest
+}
+
+// Complete reports whether every chunk up to the final one has arrived
+func (a *ResultAssembler) Complete() bool {
+	return a.final != 0 && uint64(len(a.chunks)) == a.final
+}
+
+// Bytes returns the data received so far, in chunk order up to the first
+// missing chunk
+func (a *ResultAssembler) Bytes() []byte {
+	data := make([]byte, 0, a.size)
+	for seq := uint64(1); ; seq++ {
+		chunk, ok := a.chunks[seq]
+		if !ok {
+			return data
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// Result returns the reassembled result as a toolResult body, its data as
+// text. A result failed by its final chunk carries the chunk's error.
+func (a *ResultAssembler) Result() ToolResultBody {
+	result := ToolResultBody{RequestID: a.requestID, Success: a.err == "", Error: a.err}
+	if data := a.Bytes(); len(data) > 0 {
+		result.Result = string(data)
+	}
+	return result
+}
+
+// SplitToolResult cuts data into chunks of at most size bytes, or
+// DefaultResultChunkSize if size is zero. The last chunk is final; empty
+// data gives one empty final chunk.
+func SplitToolResult(requestID string, data []byte, size int) []ToolResultChunkBody {
+	if size <= 0 {
+		size = DefaultResultChunkSize
+	}
+	var chunks []ToolResultChunkBody
+	for seq := uint64(1); ; seq++ {
+		n := len(data)
+		if n > size {
+			n = size
+		}
+		chunks = append(chunks, ToolResultChunkBody{RequestID: requestID, Seq: seq, Data: data[:n], Final: n == len(data)})
+		if data = data[n:]; len(data) == 0 {
+			return chunks
+		}
+	}
+}
+
+// NewToolResultChunk creates a toolResultChunk envelope carrying chunk
+func NewToolResultChunk(agent string, chunk ToolResultChunkBody) *ToolResultChunkEnvelope {
+	return &ToolResultChunkEnvelope{
+		BaseEnvelope: BaseEnvelope{
+			Type: EnvelopeToolResultChunk,
+			CommonHeaders: CommonHeaders{
+				Agent: agent,
+				TS:    time.Now().UnixMilli(),
+				Nonce: NewNonce(),
+			},
+		},
+		Body: chunk,
+	}
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestResultAssembler(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 25)
+	chunks := SplitToolResult("req-1", data, 100)
+	if len(chunks) != 3 || !chunks[2].Final || chunks[1].Final || len(chunks[2].Data) != 50 {
+		t.Fatalf("Unexpected chunks %+v", chunks)
+	}
+
+	// Chunks arriving out of order complete once the gap is filled
+	assembler := NewResultAssembler("req-1", 0)
+	for i, index := range []int{2, 0, 1} {
+		complete, err := assembler.Add(chunks[index])
+		if err != nil || complete != (i == 2) {
+			t.Fatalf("Adding chunk %d: complete %v, err %v", chunks[index].Seq, complete, err)
+		}
+	}
+	if !bytes.Equal(assembler.Bytes(), data) {
+		t.Error("Reassembled data differs from the original")
+	}
+	if result := assembler.Result(); !result.Success || result.Result != string(data) || result.RequestID != "req-1" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	refusals := []struct {
+		chunk ToolResultChunkBody
+		err   error
+	}{
+		{ToolResultChunkBody{RequestID: "req-2", Seq: 4}, ErrChunkMismatch},
+		{chunks[1], ErrDuplicateChunk},
+		{ToolResultChunkBody{RequestID: "req-1", Seq: 4}, ErrChunkAfterFinal},
+	}
+	for _, refusal := range refusals {
+		if _, err := assembler.Add(refusal.chunk); !errors.Is(err, refusal.err) {
+			t.Errorf("Expected chunk %+v refused with %v, got %v", refusal.chunk, refusal.err, err)
+		}
+	}
+
+	limited := NewResultAssembler("req-1", 150)
+	limited.Add(chunks[0])
+	if _, err := limited.Add(chunks[1]); !errors.Is(err, ErrResultTooLarge) {
+		t.Errorf("Expected the limit enforced, got %v", err)
+	}
+
+	failed := NewResultAssembler("req-3", 0)
+	failed.Add(ToolResultChunkBody{RequestID: "req-3", Seq: 1, Data: []byte("partial")})
+	if complete, _ := failed.Add(ToolResultChunkBody{RequestID: "req-3", Seq: 2, Final: true, Error: "disk full"}); !complete {
+		t.Fatal("Expected the failed result to be complete")
+	}
+	if result := failed.Result(); result.Success || result.Error != "disk full" || result.Result != "partial" {
+		t.Errorf("Unexpected failed result %+v", result)
+	}
+
+	if empty := SplitToolResult("req-4", nil, 0); len(empty) != 1 || !empty[0].Final {
+		t.Errorf("Expected one final chunk for an empty result, got %+v", empty)
+	}
+}
+
+func TestToolResultChunkEnvelope(t *testing.T) {
+	pubKey, privKey, _ := GenerateKeyPair()
+	env := NewToolResultChunk("agent-a", ToolResultChunkBody{RequestID: "req-1", Seq: 1, Final: true, Data: []byte{0, 1, 2}})
+	if err := env.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	data, _ := json.Marshal(env)
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	typed, err := parsed.ParseTypedEnvelope()
+	chunk, ok := typed.(*ToolResultChunkEnvelope)
+	if err != nil || !ok || !bytes.Equal(chunk.Body.Data, []byte{0, 1, 2}) || !chunk.Body.Final {
+		t.Fatalf("Unexpected envelope %#v (%v)", typed, err)
+	}
+	if err := parsed.Verify(pubKey); err != nil {
+		t.Errorf("Expected the chunk to verify, got %v", err)
+	}
+}
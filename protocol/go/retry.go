@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retry policy defaults and limits
+const (
+	DefaultRetryBackoff    = 200 * time.Millisecond
+	DefaultRetryMultiplier = 2.0
+	MaxRetryAttempts       = 10
+	MaxRetryBackoff        = time.Minute
+)
+
+// RetryPolicy is a tool's suggested handling of failed deliveries: calls
+// that never reached the tool, or that its endpoint answered with a 5xx or
+// 429 status. Errors returned by the tool itself are never retried.
+type RetryPolicy struct {
+	MaxAttempts      int     `json:"maxAttempts"`                // Total attempts, including the first
+	InitialBackoffMs int64   `json:"initialBackoffMs,omitempty"` // Delay before the first retry; defaults to 200ms
+	MaxBackoffMs     int64   `json:"maxBackoffMs,omitempty"`     // Upper bound on any delay; defaults to one minute
+	Multiplier       float64 `json:"multiplier,omitempty"`       // Growth factor between delays; defaults to 2
+}
+
+// Validate checks that the policy is within protocol limits
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 || p.MaxAttempts > MaxRetryAttempts {
+		return fmt.Errorf("maxAttempts must be between 0 and %d", MaxRetryAttempts)
+	}
+	if p.InitialBackoffMs < 0 || p.MaxBackoffMs < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	if p.MaxBackoffMs > MaxRetryBackoff.Milliseconds() {
+		return fmt.Errorf("maxBackoffMs must not exceed %d", MaxRetryBackoff.Milliseconds())
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	return nil
+}
+
+// Backoff returns the delay after the given failed attempt, counting from 1
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := DefaultRetryBackoff
+	if p.InitialBackoffMs > 0 {
+		delay = time.Duration(p.InitialBackoffMs) * time.Millisecond
+	}
+	limit := MaxRetryBackoff
+	if p.MaxBackoffMs > 0 {
+		limit = time.Duration(p.MaxBackoffMs) * time.Millisecond
+	}
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = DefaultRetryMultiplier
+	}
+
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay = time.Duration(float64(delay) * multiplier)
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// DeliveryAttempts returns how many times a call to the tool may be
+// delivered. Only idempotent tools are retried; others get one attempt
+// whatever their policy says.
+func (t MCPTool) DeliveryAttempts() int {
+	if !t.Idempotent || t.Retry == nil || t.Retry.MaxAttempts < 1 {
+		return 1
+	}
+	return t.Retry.MaxAttempts
+}
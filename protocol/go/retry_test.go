@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 5, InitialBackoffMs: 100, MaxBackoffMs: 350}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 350 * time.Millisecond, 350 * time.Millisecond}
+	for i, want := range expected {
+		if got := policy.Backoff(i + 1); got != want {
+			t.Errorf("Backoff(%d) = %v, want %v", i+1, got, want)
+		}
+	}
+
+	if got := (&RetryPolicy{}).Backoff(1); got != DefaultRetryBackoff {
+		t.Errorf("Expected default backoff, got %v", got)
+	}
+	if got := (&RetryPolicy{Multiplier: 1, InitialBackoffMs: 50}).Backoff(4); got != 50*time.Millisecond {
+		t.Errorf("Expected constant backoff, got %v", got)
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	valid := []RetryPolicy{{}, {MaxAttempts: 3, InitialBackoffMs: 10, MaxBackoffMs: 1000, Multiplier: 1.5}}
+	for _, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", p, err)
+		}
+	}
+
+	invalid := []RetryPolicy{
+		{MaxAttempts: -1},
+		{MaxAttempts: MaxRetryAttempts + 1},
+		{InitialBackoffMs: -5},
+		{MaxBackoffMs: MaxRetryBackoff.Milliseconds() + 1},
+		{Multiplier: 0.5},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", p)
+		}
+	}
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3}
+
+	tests := []struct {
+		tool     MCPTool
+		attempts int
+	}{
+		{MCPTool{Name: "plain"}, 1},
+		{MCPTool{Name: "unsafe", Retry: policy}, 1},
+		{MCPTool{Name: "idempotent", Idempotent: true}, 1},
+		{MCPTool{Name: "retried", Idempotent: true, Retry: policy}, 3},
+	}
+	for _, tt := range tests {
+		if got := tt.tool.DeliveryAttempts(); got != tt.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", tt.tool.Name, tt.attempts, got)
+		}
+	}
+}
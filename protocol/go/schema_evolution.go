@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HeaderDeprecated is the HTTP header brokers use to tell a sender which
+// deprecated or renamed body fields its envelope used
+const HeaderDeprecated = "X-FEM-Deprecated"
+
+// FieldChange describes how a body field has evolved. Fields declare it in
+// a fem struct tag: `fem:"was=oldName"` accepts oldName (several separated
+// by "|") in place of the field's JSON name, and `fem:"deprecated"` marks a
+// field that will be removed. The two may be combined with a comma, and
+// with `required`, which marks a field body schemas require (see
+// GenerateBodySchema).
+type FieldChange struct {
+	Field      string   `json:"field"`                // Current JSON name
+	Was        []string `json:"was,omitempty"`        // Former JSON names still accepted
+	Deprecated bool     `json:"deprecated,omitempty"` // The field itself is going away
+}
+
+// bodyTypes maps each envelope type to its body, for FieldChanges
+var bodyTypes = map[EnvelopeType]reflect.Type{
+	EnvelopeRegisterAgent:     reflect.TypeOf(RegisterAgentBody{}),
+	EnvelopeRegisterBroker:    reflect.TypeOf(RegisterBrokerBody{}),
+	EnvelopeEmitEvent:         reflect.TypeOf(EmitEventBody{}),
+	EnvelopeRenderInstruction: reflect.TypeOf(RenderInstructionBody{}),
+	EnvelopeToolCall:          reflect.TypeOf(ToolCallBody{}),
+	EnvelopeToolResult:        reflect.TypeOf(ToolResultBody{}),
+	EnvelopeToolResultChunk:   reflect.TypeOf(ToolResultChunkBody{}),
+	EnvelopeRevoke:            reflect.TypeOf(RevokeBody{}),
+	EnvelopeDiscoverTools:     reflect.TypeOf(DiscoverToolsBody{}),
+	EnvelopeToolsDiscovered:   reflect.TypeOf(ToolsDiscoveredBody{}),
+	EnvelopeEmbodimentUpdate:  reflect.TypeOf(EmbodimentUpdateBody{}),
+	EnvelopeSubscribe:         reflect.TypeOf(SubscribeBody{}),
+	EnvelopeUnsubscribe:       reflect.TypeOf(UnsubscribeBody{}),
+	EnvelopePing:              reflect.TypeOf(PingBody{}),
+	EnvelopePong:              reflect.TypeOf(PongBody{}),
+	EnvelopeAgentHeartbeat:    reflect.TypeOf(AgentHeartbeatBody{}),
+	EnvelopeDeregisterAgent:   reflect.TypeOf(DeregisterAgentBody{}),
+	EnvelopeStreamOpen:        reflect.TypeOf(StreamOpenBody{}),
+	EnvelopeStreamData:        reflect.TypeOf(StreamDataBody{}),
+	EnvelopeStreamWindow:      reflect.TypeOf(StreamWindowBody{}),
+	EnvelopeStreamClose:       reflect.TypeOf(StreamCloseBody{}),
+	EnvelopeRegistryDigest:    reflect.TypeOf(RegistryDigestBody{}),
+	EnvelopeRegistryDelta:     reflect.TypeOf(RegistryDeltaBody{}),
+	EnvelopeCatalogSummary:    reflect.TypeOf(CatalogSummaryBody{}),
+	EnvelopeBroadcast:         reflect.TypeOf(BroadcastBody{}),
+	EnvelopeBrokerDraining:    reflect.TypeOf(BrokerDrainingBody{}),
+	EnvelopeStateHandoff:      reflect.TypeOf(StateHandoffBody{}),
+	EnvelopeError:             reflect.TypeOf(ErrorBody{}),
+	EnvelopeAck:               reflect.TypeOf(AckBody{}),
+	EnvelopeBatch:             reflect.TypeOf(BatchBody{}),
+}
+
+// fieldChanges caches the changes of each struct type
+var fieldChanges sync.Map // reflect.Type -> []FieldChange
+
+// FieldChanges returns the deprecated and renamed fields of an envelope
+// type's body, ordered by field name
+func FieldChanges(envType EnvelopeType) []FieldChange {
+	t, ok := bodyTypes[envType]
+	if !ok {
+		return nil
+	}
+	return structChanges(t)
+}
+
+// structChanges reads the fem tags of a struct type's fields
+func structChanges(t reflect.Type) []FieldChange {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if cached, ok := fieldChanges.Load(t); ok {
+		return cached.([]FieldChange)
+	}
+
+	var changes []FieldChange
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("fem")
+		if tag == "" {
+			continue
+		}
+		change := FieldChange{Field: jsonFieldName(field)}
+		for _, option := range strings.Split(tag, ",") {
+			switch {
+			case option == "deprecated":
+				change.Deprecated = true
+			case strings.HasPrefix(option, "was="):
+				change.Was = append(change.Was, strings.Split(strings.TrimPrefix(option, "was="), "|")...)
+			}
+		}
+		if len(change.Was) > 0 || change.Deprecated {
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	fieldChanges.Store(t, changes)
+	return changes
+}
+
+// jsonFieldName returns the name a struct field has in JSON
+func jsonFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// upgradeBody rewrites the fields of a JSON object that v's type has
+// renamed to their current names. Bodies using no former names, and
+// bodies that are not objects, are returned unchanged.
+func upgradeBody(data json.RawMessage, v interface{}) (json.RawMessage, error) {
+	changes := structChanges(reflect.TypeOf(v))
+	renamed := false
+	for _, change := range changes {
+		renamed = renamed || len(change.Was) > 0
+	}
+	if !renamed || len(data) == 0 || data[0] != '{' {
+		return data, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, change := range changes {
+		for _, was := range change.Was {
+			value, used := fields[was]
+			if !used {
+				continue
+			}
+			// A sender setting both names means the current one
+			if _, current := fields[change.Field]; !current {
+				fields[change.Field] = value
+			}
+			delete(fields, was)
+			changed = true
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(fields)
+}
+
+// SchemaNotices lists the deprecated and renamed body fields an envelope
+// uses, so receivers can warn senders still on an older protocol version
+func (g *GenericEnvelope) SchemaNotices() []string {
+	changes := FieldChanges(g.Type)
+	if len(changes) == 0 || len(g.Body) == 0 || g.Body[0] != '{' {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(g.Body, &fields); err != nil {
+		return nil
+	}
+
+	var notices []string
+	for _, change := range changes {
+		for _, was := range change.Was {
+			if _, used := fields[was]; used {
+				notices = append(notices, fmt.Sprintf("body.%s is renamed to %s", was, change.Field))
+			}
+		}
+		if _, used := fields[change.Field]; used && change.Deprecated {
+			notices = append(notices, fmt.Sprintf("body.%s is deprecated", change.Field))
+		}
+	}
+	return notices
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// evolvedBody exercises every kind of fem tag
+type evolvedBody struct {
+	Target   string `json:"target" fem:"was=agent|agentId"`
+	Priority int    `json:"priority,omitempty" fem:"deprecated"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func TestStructChanges(t *testing.T) {
+	expected := []FieldChange{
+		{Field: "priority", Deprecated: true},
+		{Field: "target", Was: []string{"agent", "agentId"}},
+	}
+	if changes := structChanges(reflect.TypeOf(&evolvedBody{})); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+
+	changes := FieldChanges(EnvelopeRenderInstruction)
+	if len(changes) != 1 || changes[0].Field != "parameters" || changes[0].Was[0] != "context" {
+		t.Errorf("Unexpected renderInstruction changes %+v", changes)
+	}
+	if FieldChanges(EnvelopePing) != nil {
+		t.Error("Expected no changes for ping")
+	}
+}
+
+func TestGetBodyAsReadsFormerNames(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected evolvedBody
+	}{
+		{`{"agentId":"a-1","reason":"r"}`, evolvedBody{Target: "a-1", Reason: "r"}},
+		{`{"agent":"a-2"}`, evolvedBody{Target: "a-2"}},
+		{`{"target":"new","agent":"old"}`, evolvedBody{Target: "new"}},
+		{`{"target":"t","priority":3}`, evolvedBody{Target: "t", Priority: 3}},
+	}
+
+	for _, test := range tests {
+		envelope := &GenericEnvelope{Body: json.RawMessage(test.body)}
+		var body evolvedBody
+		if err := envelope.GetBodyAs(&body); err != nil {
+			t.Errorf("GetBodyAs(%s) failed: %v", test.body, err)
+			continue
+		}
+		if body != test.expected {
+			t.Errorf("GetBodyAs(%s) = %+v, want %+v", test.body, body, test.expected)
+		}
+	}
+}
+
+func TestRenamedFieldKeepsSignature(t *testing.T) {
+	pubKey, privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	// An older agent still sends "context"
+	envelope := NewEnvelope(EnvelopeRenderInstruction, "legacy.agent")
+	envelope.Body = json.RawMessage(`{"instruction":"draw","context":{"color":"red"}}`)
+	if err := envelope.Sign(privKey); err != nil {
+		t.Fatalf("Failed to sign envelope: %v", err)
+	}
+	data, _ := json.Marshal(envelope)
+
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	typed, err := parsed.ParseTypedEnvelope()
+	if err != nil {
+		t.Fatalf("Failed to parse typed envelope: %v", err)
+	}
+	if render := typed.(*RenderInstructionEnvelope); render.Body.Parameters["color"] != "red" {
+		t.Errorf("Expected context to be read as parameters, got %+v", render.Body)
+	}
+	if err := parsed.Verify(pubKey); err != nil {
+		t.Errorf("Expected the original body to still verify: %v", err)
+	}
+	if notices := parsed.SchemaNotices(); len(notices) != 1 || notices[0] != "body.context is renamed to parameters" {
+		t.Errorf("Unexpected notices %v", notices)
+	}
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"io"
+)
+
+// Signer signs with a key which may be held where it cannot be read, such
+// as in a KMS, an HSM, a TPM or the Secure Enclave. Ed25519, ECDSA P-256
+// and RSA keys are supported (see KeyAlgorithm); an ed25519.PrivateKey,
+// *ecdsa.PrivateKey and *rsa.PrivateKey are Signers, as is any crypto.Signer
+// over such a key, such as one a PKCS#11 library returns. Ed25519 signers
+// are given the whole message and crypto.Hash(0); the others a SHA-256
+// digest.
+type Signer interface {
+	crypto.Signer
+}
+
+// SignerPublicKey returns the public key of signer, checking that FEM
+// supports its algorithm
+func SignerPublicKey(signer Signer) (PublicKey, error) {
+	if _, err := signerAlgorithm(signer); err != nil {
+		return nil, err
+	}
+	return signer.Public().(PublicKey), nil
+}
+
+// noSigner reports whether signer is missing, including a nil private key
+func noSigner(signer Signer) bool {
+	key, isKey := signer.(ed25519.PrivateKey)
+	return signer == nil || isKey && key == nil
+}
+
+// RemoteSigner is a Signer for a key held by a service the protocol has no
+// client for, such as AWS KMS or Google Cloud KMS: SignFunc calls the
+// service with what crypto.Signer's Sign is given, the message for Ed25519
+// and its SHA-256 digest otherwise, and returns the signature as Sign does.
+// Every signature is checked against PublicKey before it is used, so a
+// misconfigured key fails when signing rather than when the broker
+// verifies.
+//
+//	signer := &protocol.RemoteSigner{
+//		PublicKey: publicKey,
+//		SignFunc: func(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+//			out, err := kms.Sign(ctx, &kms.SignInput{KeyId: keyID, Message: digest, MessageType: "DIGEST", ...})
+//			if err != nil {
+//				return nil, err
+//			}
+//			return out.Signature, nil
+//		},
+//	}
+type RemoteSigner struct {
+	PublicKey PublicKey
+	SignFunc  func(data []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// Public returns the signer's public key
+func (s *RemoteSigner) Public() crypto.PublicKey {
+	return s.PublicKey
+}
+
+// Sign has the remote service sign data
+func (s *RemoteSigner) Sign(_ io.Reader, data []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.SignFunc(data, opts)
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestRemoteSigner(t *testing.T) {
+	pub, priv, _ := GenerateKeyPair()
+	_, otherPriv, _ := GenerateKeyPair()
+
+	var signed int
+	signer := &RemoteSigner{PublicKey: pub, SignFunc: func(message []byte, _ crypto.SignerOpts) ([]byte, error) {
+		signed++
+		return ed25519.Sign(priv, message), nil
+	}}
+
+	ping := NewPing("sensor", "hello")
+	if err := SignEnvelope(ping, signer); err != nil {
+		t.Fatalf("SignEnvelope failed: %v", err)
+	}
+	if err := ping.Verify(pub); err != nil || signed != 1 {
+		t.Errorf("Expected the remote signature to verify, got %v after %d calls", err, signed)
+	}
+
+	// The public key of the registration is the remote key's
+	registration, err := NewRegisterAgent("sensor").SignWith(signer).Build()
+	if err != nil || registration.Body.PubKey != EncodePublicKey(pub) {
+		t.Fatalf("Expected a registration under the remote key, got %+v, %v", registration, err)
+	}
+
+	header, err := SignEventStreamRequestWith("sensor", signer)
+	if err != nil || VerifyEventStreamRequest(header, pub) != nil {
+		t.Errorf("Expected a signed event stream request, got %v", err)
+	}
+
+	// A service signing with another key is caught before sending
+	signer.SignFunc = func(message []byte, _ crypto.SignerOpts) ([]byte, error) {
+		return ed25519.Sign(otherPriv, message), nil
+	}
+	if err := SignEnvelope(NewPing("sensor", "hello"), signer); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a mismatched key refused, got %v", err)
+	}
+	signer.SignFunc = func([]byte, crypto.SignerOpts) ([]byte, error) { return nil, errors.New("kms unavailable") }
+	if err := SignEnvelope(NewPing("sensor", "hello"), signer); err == nil {
+		t.Error("Expected a failed remote call reported")
+	}
+
+	if err := SignEnvelope(NewPing("sensor", "hello"), ed25519.PrivateKey(nil)); !errors.Is(err, ErrMissingField) {
+		t.Errorf("Expected a nil key refused, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+)
+
+// SignableEnvelope is an envelope carrying the common headers, and so a
+// signature: Envelope, GenericEnvelope and every typed envelope
+type SignableEnvelope interface {
+	headers() *CommonHeaders
+}
+
+// headers returns the headers themselves, making every envelope embedding
+// them a SignableEnvelope
+func (h *CommonHeaders) headers() *CommonHeaders {
+	return h
+}
+
+// copyEnvelope returns a shallow copy of an envelope, whose headers can be
+// changed without changing the original's unless it embeds them by pointer
+func copyEnvelope(envelope SignableEnvelope) SignableEnvelope {
+	v := reflect.ValueOf(envelope)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return envelope
+	}
+	copied := reflect.New(v.Elem().Type())
+	copied.Elem().Set(v.Elem())
+	if c, ok := copied.Interface().(SignableEnvelope); ok {
+		return c
+	}
+	return envelope
+}
+
+// SignEnvelope signs an envelope with signer, an ed25519.PrivateKey or a
+// key held in a KMS or HSM: the signature covers the envelope without sig
+// in canonical form (see Canonicalize)
+func SignEnvelope(envelope SignableEnvelope, signer Signer) error {
+	alg, err := signerAlgorithm(signer)
+	if err != nil {
+		return err
+	}
+	headers := envelope.headers()
+	headers.Sig = ""
+	// Ed25519 envelopes leave alg out, so receivers that predate it can
+	// still verify them
+	headers.Alg = alg
+	if alg == AlgEdDSA {
+		headers.Alg = ""
+	}
+	data, err := marshalCanonical(envelope)
+	if err != nil {
+		return err
+	}
+	signature, err := signMessage(signer, data)
+	if err != nil {
+		return err
+	}
+	headers.Sig = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// VerifyEnvelope verifies an envelope's signature with the given public
+// key, which must be of the algorithm in its alg header. The envelope is
+// checked on a copy and left as it is.
+func VerifyEnvelope(envelope SignableEnvelope, publicKey PublicKey) error {
+	envelope = copyEnvelope(envelope)
+	headers := envelope.headers()
+	if headers.Sig == "" {
+		return fmt.Errorf("envelope has %w", ErrNoSignature)
+	}
+	keyAlg, err := KeyAlgorithm(publicKey)
+	if err != nil {
+		return err
+	}
+	// The algorithm is the key's, whatever the envelope claims, so a
+	// signature is never checked under one its signer did not use
+	if alg := headers.Alg; alg != keyAlg && !(alg == "" && keyAlg == AlgEdDSA) {
+		return fmt.Errorf("%w: signed with %s, but the key is for %s", ErrBadSignature, alg, keyAlg)
+	}
+	signature, err := base64.StdEncoding.DecodeString(headers.Sig)
+	if err != nil {
+		return fmt.Errorf("%w: signature encoding: %v", ErrBadSignature, err)
+	}
+
+	// Put back in case the headers are shared with the caller's envelope
+	sig := headers.Sig
+	headers.Sig = ""
+	defer func() { headers.Sig = sig }()
+
+	verified, err := verifyJSON(publicKey, envelope, signature)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrBadSignature
+	}
+	return nil
+}
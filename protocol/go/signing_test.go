@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestSignVerifyEnvelope(t *testing.T) {
+	pub, priv, _ := GenerateKeyPair()
+	otherPub, _, _ := GenerateKeyPair()
+
+	envelopes := map[string]interface {
+		SignableEnvelope
+		Sign(ed25519.PrivateKey) error
+		Verify(ed25519.PublicKey) error
+	}{
+		"generic":   NewEnvelope(EnvelopeEmitEvent, "sensor"),
+		"ping":      NewPing("sensor", "hello"),
+		"ack":       NewAck("sensor", NewNonce()),
+		"broadcast": NewBroadcast("sensor", []string{"camera"}, "", "motion.detected", map[string]interface{}{"zone": 3}),
+		"chunk":     NewToolResultChunk("sensor", ToolResultChunkBody{RequestID: "req-1", Seq: 1, Final: true, Data: []byte("done")}),
+	}
+	for name, env := range envelopes {
+		if err := env.Verify(pub); err == nil {
+			t.Errorf("%s: expected an unsigned envelope to fail", name)
+		}
+		if err := env.Sign(priv); err != nil {
+			t.Fatalf("%s: Sign failed: %v", name, err)
+		}
+		if err := env.Verify(pub); err != nil {
+			t.Errorf("%s: expected the signature to verify: %v", name, err)
+		}
+		if err := VerifyEnvelope(env, otherPub); err == nil {
+			t.Errorf("%s: expected another key to fail", name)
+		}
+		if env.headers().Sig == "" {
+			t.Errorf("%s: expected verification to leave the signature in place", name)
+		}
+
+		// The typed signature holds for the envelope as received
+		data, _ := json.Marshal(env)
+		received, err := ParseEnvelope(data)
+		if err != nil {
+			t.Fatalf("%s: parse failed: %v", name, err)
+		}
+		if err := received.Verify(pub); err != nil {
+			t.Errorf("%s: expected the received envelope to verify: %v", name, err)
+		}
+		received.Agent = "impostor"
+		if err := received.Verify(pub); err == nil {
+			t.Errorf("%s: expected a tampered envelope to fail", name)
+		}
+	}
+
+	// Helpers and methods sign the same bytes
+	first, second := NewPing("sensor", "hello"), NewPing("sensor", "hello")
+	second.Nonce = first.Nonce
+	first.Sign(priv)
+	SignEnvelope(second, priv)
+	if first.Sig != second.Sig {
+		t.Error("Expected SignEnvelope to match Sign")
+	}
+
+	// Verification works on a copy, so an envelope can be checked from
+	// several goroutines at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := VerifyEnvelope(first, pub); err != nil {
+				t.Errorf("Concurrent verification failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,73 @@
+package simagent
+
+import (
+	"fmt"
+)
+
+// Fleet is a group of simulated agents sharing a config
+type Fleet struct {
+	Agents []*Agent
+}
+
+// Spawn starts n agents named <prefix>-1 to <prefix>-n and registers them
+// with the broker. Each agent draws from its own seed, derived from the
+// config's, so runs with the same seed repeat.
+func Spawn(n int, config Config) (*Fleet, error) {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+
+	fleet := &Fleet{}
+	for i := 1; i <= n; i++ {
+		agentConfig := config
+		agentConfig.Seed = config.Seed + int64(i)
+		agent, err := New(fmt.Sprintf("%s-%d", prefix, i), agentConfig)
+		if err != nil {
+			fleet.Close()
+			return nil, err
+		}
+		fleet.Agents = append(fleet.Agents, agent)
+		if err := agent.Register(); err != nil {
+			fleet.Close()
+			return nil, fmt.Errorf("failed to register %s: %w", agent.ID, err)
+		}
+	}
+	return fleet, nil
+}
+
+// Get returns the agent with an ID
+func (f *Fleet) Get(id string) *Agent {
+	for _, agent := range f.Agents {
+		if agent.ID == id {
+			return agent
+		}
+	}
+	return nil
+}
+
+// Calls returns how many calls of a tool reached any agent of the fleet
+func (f *Fleet) Calls(tool string) int {
+	total := 0
+	for _, agent := range f.Agents {
+		total += agent.Calls(tool)
+	}
+	return total
+}
+
+// Heartbeat reports every agent alive, returning the first failure
+func (f *Fleet) Heartbeat() error {
+	for _, agent := range f.Agents {
+		if err := agent.Heartbeat(); err != nil {
+			return fmt.Errorf("%s: %w", agent.ID, err)
+		}
+	}
+	return nil
+}
+
+// Close stops every agent's endpoint
+func (f *Fleet) Close() {
+	for _, agent := range f.Agents {
+		agent.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package simagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// errSimulatedFailure is the error failing calls answer with
+var errSimulatedFailure = errors.New("simulated failure")
+
+// rpcRequest is the part of a JSON-RPC request the endpoint reads
+type rpcRequest struct {
+	Method string `json:"method"`
+	Params struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+		Meta      struct {
+			RequestID string `json:"requestId"`
+		} `json:"_meta"`
+	} `json:"params"`
+	ID interface{} `json:"id"`
+}
+
+// serveMCP answers tools/list and tools/call as an MCP endpoint would
+func (a *Agent) serveMCP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	down := a.down
+	a.mu.Unlock()
+	if down {
+		http.Error(w, "Agent is down", http.StatusServiceUnavailable)
+		return
+	}
+
+	var request rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON-RPC request", http.StatusBadRequest)
+		return
+	}
+
+	switch request.Method {
+	case "tools/list":
+		tools := make([]protocol.MCPTool, 0, len(a.config.Tools))
+		for _, tool := range a.config.Tools {
+			tools = append(tools, tool.MCPTool)
+		}
+		writeRPC(w, request.ID, map[string]interface{}{"tools": tools}, nil)
+	case "tools/call":
+		a.serveCall(w, r, request)
+	default:
+		writeRPC(w, request.ID, nil, errors.New("method not found: "+request.Method))
+	}
+}
+
+// serveCall runs a tool call with the tool's latency and failure mode
+func (a *Agent) serveCall(w http.ResponseWriter, r *http.Request, request rpcRequest) {
+	tool, exists := a.tools[request.Params.Name]
+	if !exists {
+		writeRPC(w, request.ID, nil, errors.New("unknown tool: "+request.Params.Name))
+		return
+	}
+
+	a.mu.Lock()
+	a.calls[tool.Name]++
+	failed := a.random.Float64() < tool.FailureRate
+	delay := tool.Latency
+	if tool.Jitter > 0 {
+		delay += time.Duration(a.random.Int63n(int64(tool.Jitter)))
+	}
+	a.mu.Unlock()
+
+	if failed {
+		switch tool.Failure {
+		case FailUnavailable:
+			http.Error(w, errSimulatedFailure.Error(), http.StatusServiceUnavailable)
+			return
+		case FailHang:
+			select {
+			case <-r.Context().Done():
+			case <-a.closed:
+			}
+			return
+		}
+	}
+
+	if tool.Async && request.Params.Meta.RequestID != "" {
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			if !a.wait(context.Background(), delay) {
+				return
+			}
+			result, err := a.run(tool, request.Params.Arguments, failed)
+			a.postResult(protocol.NewToolResultBody(request.Params.Meta.RequestID, result, err))
+		}()
+		return
+	}
+
+	if !a.wait(r.Context(), delay) {
+		return
+	}
+	result, err := a.run(tool, request.Params.Arguments, failed)
+	writeRPC(w, request.ID, result, err)
+}
+
+// run computes a call's result, echoing the arguments without a handler
+func (a *Agent) run(tool Tool, arguments map[string]interface{}, failed bool) (interface{}, error) {
+	if failed {
+		return nil, errSimulatedFailure
+	}
+	if tool.Handler == nil {
+		return map[string]interface{}{"agent": a.ID, "tool": tool.Name, "arguments": arguments}, nil
+	}
+	return tool.Handler(arguments)
+}
+
+// wait sleeps for delay, reporting false if the call or agent ends first
+func (a *Agent) wait(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+	case <-a.closed:
+	}
+	return false
+}
+
+// postResult sends the result of an accepted call to the broker
+func (a *Agent) postResult(body protocol.ToolResultBody) {
+	envelope := &protocol.ToolResultEnvelope{
+		BaseEnvelope: a.headers(protocol.EnvelopeToolResult),
+		Body:         body,
+	}
+	if err := envelope.Sign(a.privateKey); err != nil {
+		return
+	}
+	a.send(envelope)
+}
+
+// writeRPC writes a JSON-RPC response with a result or an error
+func writeRPC(w http.ResponseWriter, id interface{}, result interface{}, err error) {
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		response["error"] = map[string]interface{}{"code": -32000, "message": err.Error()}
+	} else {
+		response["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,302 @@
+// Package simagent runs simulated FEM agents for integration tests. Each
+// agent registers with a broker, serves its tools on an MCP endpoint of its
+// own, and can be made slow or unreliable, so tests can exercise discovery,
+// routing and federation end to end against a real broker.
+//
+//	fleet, err := simagent.Spawn(3, simagent.Config{
+//		Broker: server.URL,
+//		Client: server.Client(),
+//		Tools:  []simagent.Tool{{MCPTool: protocol.MCPTool{Name: "echo"}, Latency: 10 * time.Millisecond}},
+//	})
+//	defer fleet.Close()
+package simagent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+// defaultPrefix names agents when the config does not
+const defaultPrefix = "sim-agent"
+
+// FailureMode is how a simulated tool call fails
+type FailureMode int
+
+const (
+	// FailError answers with a JSON-RPC error, which the broker reports as
+	// a failed tool call
+	FailError FailureMode = iota
+	// FailUnavailable answers 503, a delivery failure the broker may retry
+	FailUnavailable
+	// FailHang never answers, until the caller gives up or the agent closes
+	FailHang
+)
+
+// Tool is a tool a simulated agent offers
+type Tool struct {
+	protocol.MCPTool
+	Latency     time.Duration // Added before each call is answered
+	Jitter      time.Duration // Up to this much more, drawn at random
+	FailureRate float64       // Fraction of calls that fail, from 0 to 1
+	Failure     FailureMode   // How failing calls fail
+	Async       bool          // Answer 202 and post the result as a toolResult envelope
+
+	// Handler computes the result; calls are echoed back if it is nil
+	Handler func(arguments map[string]interface{}) (interface{}, error)
+}
+
+// Config describes the agents New and Spawn start
+type Config struct {
+	Broker       string       // URL of the broker agents register with
+	Client       *http.Client // Reaches the broker, http.DefaultClient if nil
+	Prefix       string       // Spawned agents are named <prefix>-<n>
+	Capabilities []string
+	Environment  string
+	Tools        []Tool
+	Seed         int64 // Seeds failure and jitter draws, for repeatable runs
+}
+
+// Agent is one simulated agent
+type Agent struct {
+	ID        string
+	PublicKey ed25519.PublicKey
+
+	privateKey ed25519.PrivateKey
+	config     Config
+	client     *http.Client
+	tools      map[string]Tool
+	server     *httptest.Server
+	closed     chan struct{}
+	calls      map[string]int
+	down       bool
+	random     *rand.Rand
+	mu         sync.Mutex
+}
+
+// New starts the MCP endpoint of an agent. The agent is not registered
+// until Register is called.
+func New(id string, config Config) (*Agent, error) {
+	publicKey, privateKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	agent := &Agent{
+		ID:         id,
+		PublicKey:  publicKey,
+		privateKey: privateKey,
+		config:     config,
+		client:     client,
+		tools:      make(map[string]Tool),
+		closed:     make(chan struct{}),
+		calls:      make(map[string]int),
+		random:     rand.New(rand.NewSource(config.Seed)),
+	}
+	for _, tool := range config.Tools {
+		agent.tools[tool.Name] = tool
+	}
+	agent.server = httptest.NewServer(http.HandlerFunc(agent.serveMCP))
+	return agent, nil
+}
+
+// Endpoint returns the URL of the agent's MCP endpoint
+func (a *Agent) Endpoint() string {
+	return a.server.URL
+}
+
+// Register registers the agent and its tools with the broker, answering
+// the broker's challenge if it asks for a proof of key ownership. It
+// returns protocol.ErrRegistrationPending if the broker holds the
+// registration for an operator's approval.
+func (a *Agent) Register() error {
+	data, err := a.sendRegistration("", "")
+	if err != nil {
+		return err
+	}
+	var challenge protocol.RegistrationChallenge
+	json.Unmarshal(data, &challenge)
+	if challenge.Status == protocol.StatusChallenge {
+		if data, err = a.sendRegistration(challenge.Challenge, protocol.SignKeyProof(a.ID, challenge.Challenge, a.privateKey)); err != nil {
+			return err
+		}
+		challenge = protocol.RegistrationChallenge{}
+		json.Unmarshal(data, &challenge)
+	}
+	if challenge.Status == protocol.StatusPendingApproval {
+		return protocol.ErrRegistrationPending
+	}
+	return nil
+}
+
+// sendRegistration sends one registerAgent envelope, with the answer to a
+// challenge if there is one
+func (a *Agent) sendRegistration(challenge, challengeSig string) ([]byte, error) {
+	tools := make([]protocol.MCPTool, 0, len(a.config.Tools))
+	for _, tool := range a.config.Tools {
+		tools = append(tools, tool.MCPTool)
+	}
+
+	envelope := &protocol.RegisterAgentEnvelope{
+		BaseEnvelope: a.headers(protocol.EnvelopeRegisterAgent),
+		Body: protocol.RegisterAgentBody{
+			PubKey:       protocol.EncodePublicKey(a.PublicKey),
+			Capabilities: a.config.Capabilities,
+			MCPEndpoint:  a.Endpoint(),
+			BodyDefinition: &protocol.BodyDefinition{
+				Name:         a.ID + "-body",
+				Environment:  a.config.Environment,
+				Capabilities: a.config.Capabilities,
+				MCPTools:     tools,
+			},
+			EnvironmentType: a.config.Environment,
+			Challenge:       challenge,
+			ChallengeSig:    challengeSig,
+		},
+	}
+	if err := envelope.Sign(a.privateKey); err != nil {
+		return nil, err
+	}
+	return a.send(envelope)
+}
+
+// Heartbeat reports the agent alive to the broker
+func (a *Agent) Heartbeat() error {
+	heartbeat := protocol.NewAgentHeartbeat(a.ID, "ok")
+	if err := heartbeat.Sign(a.privateKey); err != nil {
+		return err
+	}
+	_, err := a.send(heartbeat)
+	return err
+}
+
+// Deregister tells the broker the agent is leaving
+func (a *Agent) Deregister() error {
+	deregister := protocol.NewDeregisterAgent(a.ID, "simulation ended")
+	if err := deregister.Sign(a.privateKey); err != nil {
+		return err
+	}
+	_, err := a.send(deregister)
+	return err
+}
+
+// Discover asks the broker for tools, as a caller would
+func (a *Agent) Discover(query protocol.ToolQuery) ([]protocol.DiscoveredTool, error) {
+	envelope := &protocol.DiscoverToolsEnvelope{
+		BaseEnvelope: a.headers(protocol.EnvelopeDiscoverTools),
+		Body:         protocol.DiscoverToolsBody{Query: query, RequestID: protocol.NewNonce()},
+	}
+	if err := envelope.Sign(a.privateKey); err != nil {
+		return nil, err
+	}
+	data, err := a.send(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Tools []protocol.DiscoveredTool `json:"tools"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("invalid discovery response: %w", err)
+	}
+	return response.Tools, nil
+}
+
+// CallTool calls a tool through the broker, as a caller would, and returns
+// the broker's toolResult
+func (a *Agent) CallTool(tool string, parameters map[string]interface{}) (protocol.ToolResultBody, error) {
+	envelope := &protocol.ToolCallEnvelope{
+		BaseEnvelope: a.headers(protocol.EnvelopeToolCall),
+		Body:         protocol.ToolCallBody{Tool: tool, Parameters: parameters, RequestID: protocol.NewNonce()},
+	}
+	if err := envelope.Sign(a.privateKey); err != nil {
+		return protocol.ToolResultBody{}, err
+	}
+	data, err := a.send(envelope)
+	if err != nil {
+		return protocol.ToolResultBody{}, err
+	}
+
+	var result protocol.ToolResultEnvelope
+	if err := json.Unmarshal(data, &result); err != nil {
+		return protocol.ToolResultBody{}, fmt.Errorf("invalid tool result: %w", err)
+	}
+	return result.Body, nil
+}
+
+// Calls returns how many calls of a tool reached the agent
+func (a *Agent) Calls(tool string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls[tool]
+}
+
+// SetDown simulates an outage: while down, the agent's endpoint answers
+// every request with 503
+func (a *Agent) SetDown(down bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.down = down
+}
+
+// Close stops the agent's endpoint, releasing calls left hanging
+func (a *Agent) Close() {
+	a.mu.Lock()
+	select {
+	case <-a.closed:
+		a.mu.Unlock()
+		return
+	default:
+		close(a.closed)
+	}
+	a.mu.Unlock()
+	a.server.Close()
+}
+
+// headers returns fresh envelope headers from the agent
+func (a *Agent) headers(envelopeType protocol.EnvelopeType) protocol.BaseEnvelope {
+	return protocol.BaseEnvelope{
+		Type: envelopeType,
+		CommonHeaders: protocol.CommonHeaders{
+			Agent: a.ID,
+			TS:    time.Now().UnixMilli(),
+			Nonce: protocol.NewNonce(),
+		},
+	}
+}
+
+// send posts an envelope to the broker and returns the response body
+func (a *Agent) send(envelope interface{}) ([]byte, error) {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Post(a.config.Broker, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach broker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("broker returned status %d: %s", resp.StatusCode, bytes.TrimSpace(payload))
+	}
+	return payload, nil
+}
@@ -0,0 +1,86 @@
+package simagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fep-fem/protocol"
+)
+
+func callEndpoint(t *testing.T, agent *Agent, tool string) (int, map[string]interface{}) {
+	t.Helper()
+	data, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "tools/call",
+		"params":  map[string]interface{}{"name": tool, "arguments": map[string]interface{}{"x": 1}},
+		"id":      1,
+	})
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Post(agent.Endpoint(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	var response map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return resp.StatusCode, response
+}
+
+func TestAgentFailureModes(t *testing.T) {
+	agent, err := New("sim", Config{Tools: []Tool{
+		{MCPTool: protocol.MCPTool{Name: "echo"}},
+		{MCPTool: protocol.MCPTool{Name: "error"}, FailureRate: 1},
+		{MCPTool: protocol.MCPTool{Name: "unavailable"}, FailureRate: 1, Failure: FailUnavailable},
+		{MCPTool: protocol.MCPTool{Name: "hang"}, FailureRate: 1, Failure: FailHang},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to start agent: %v", err)
+	}
+	defer agent.Close()
+
+	status, response := callEndpoint(t, agent, "echo")
+	result, _ := response["result"].(map[string]interface{})
+	if status != http.StatusOK || result["agent"] != "sim" {
+		t.Errorf("Expected echo to answer, got %d %v", status, response)
+	}
+	if status, response = callEndpoint(t, agent, "error"); status != http.StatusOK || response["error"] == nil {
+		t.Errorf("Expected a JSON-RPC error, got %d %v", status, response)
+	}
+	if status, _ = callEndpoint(t, agent, "unavailable"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", status)
+	}
+	if status, _ = callEndpoint(t, agent, "hang"); status != 0 {
+		t.Errorf("Expected the call to hang until the client gave up, got %d", status)
+	}
+
+	agent.SetDown(true)
+	if status, _ = callEndpoint(t, agent, "echo"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected a down agent to answer 503, got %d", status)
+	}
+	if agent.Calls("echo") != 1 {
+		t.Errorf("Expected calls to a down agent not to be counted, got %d", agent.Calls("echo"))
+	}
+}
+
+func TestAgentFailureRateIsRepeatable(t *testing.T) {
+	outcomes := func() []bool {
+		agent, _ := New("sim", Config{Seed: 7, Tools: []Tool{{MCPTool: protocol.MCPTool{Name: "coin"}, FailureRate: 0.5}}})
+		defer agent.Close()
+		var failed []bool
+		for i := 0; i < 20; i++ {
+			_, response := callEndpoint(t, agent, "coin")
+			failed = append(failed, response["error"] != nil)
+		}
+		return failed
+	}
+
+	first, second := outcomes(), outcomes()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected runs with the same seed to fail the same calls")
+		}
+	}
+}
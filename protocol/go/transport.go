@@ -174,6 +174,7 @@ func (t *Transport) Send(endpoint string, envelope *Envelope) error {
 type Client struct {
 	transport *Transport
 	endpoint  string
+	pins      *BrokerPins
 	conn      net.Conn
 	mu        sync.Mutex
 }
@@ -191,12 +192,24 @@ func NewClient(endpoint string, privateKey ed25519.PrivateKey) (*Client, error)
 	}, nil
 }
 
+// SetPins makes the client refuse servers whose certificate or envelope
+// signatures do not match pins. It takes effect on the next Connect.
+func (c *Client) SetPins(pins *BrokerPins) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pins = pins
+}
+
 // Connect establishes a connection to the server
 func (c *Client) Connect() error {
-	conn, err := tls.Dial("tcp", c.endpoint, &tls.Config{
+	config := &tls.Config{
 		InsecureSkipVerify: true,
 		MinVersion:         tls.VersionTLS13,
-	})
+	}
+	if c.pins != nil {
+		config = c.pins.TLSConfig()
+	}
+	conn, err := tls.Dial("tcp", c.endpoint, config)
 	if err != nil {
 		return err
 	}
@@ -245,6 +258,11 @@ func (c *Client) ReadEnvelope() (*Envelope, error) {
 	if err := json.Unmarshal(line, &envelope); err != nil {
 		return nil, err
 	}
+	if c.pins != nil {
+		if err := c.pins.VerifyEnvelope(&envelope); err != nil {
+			return nil, err
+		}
+	}
 
 	return &envelope, nil
 }
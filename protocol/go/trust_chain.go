@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxTrustChainLength bounds how many links may separate a broker's key
+// from its federation's trust anchor
+const MaxTrustChainLength = 4
+
+// ErrUntrustedBroker is returned when a broker's trust chain does not lead
+// back to a trust anchor of its federation
+var ErrUntrustedBroker = errors.New("broker is not trusted by its federation")
+
+// TrustLink is one signature in a broker's chain of trust: the issuer key
+// vouches for the subject key as a member of a federation. A chain starts
+// at a federation's trust anchor, may pass through intermediate keys, and
+// ends at the key the broker signs envelopes with.
+type TrustLink struct {
+	Federation string `json:"federation"`
+	Issuer     string `json:"issuer"`            // Base64 Ed25519 key signing the link
+	Subject    string `json:"subject"`           // Base64 Ed25519 key vouched for
+	Broker     string `json:"broker,omitempty"`  // Broker the subject key belongs to, on the last link
+	Expires    int64  `json:"expires,omitempty"` // Unix time in milliseconds, never if 0
+	Sig        string `json:"sig,omitempty"`
+}
+
+// NewTrustLink creates a link in which issuer vouches for subject within
+// federation until expires (never if zero). broker names the broker the
+// subject key belongs to, and is left empty for intermediate keys.
+func NewTrustLink(federation string, issuer ed25519.PrivateKey, subject ed25519.PublicKey, broker string, expires time.Time) (*TrustLink, error) {
+	link := &TrustLink{
+		Federation: federation,
+		Issuer:     EncodePublicKey(issuer.Public().(ed25519.PublicKey)),
+		Subject:    EncodePublicKey(subject),
+		Broker:     broker,
+	}
+	if !expires.IsZero() {
+		link.Expires = expires.UnixMilli()
+	}
+	data, err := marshalCanonical(link)
+	if err != nil {
+		return nil, err
+	}
+	link.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(issuer, data))
+	return link, nil
+}
+
+// Verify checks that the link is signed by its issuer key
+func (l *TrustLink) Verify() error {
+	issuer, err := DecodePublicKey(l.Issuer)
+	if err != nil {
+		return fmt.Errorf("trust link issuer: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(l.Sig)
+	if err != nil {
+		return fmt.Errorf("%w: trust link signature encoding: %v", ErrBadSignature, err)
+	}
+
+	unsigned := *l
+	unsigned.Sig = ""
+	verified, err := verifyJSON(issuer, unsigned, signature)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("%w: trust link", ErrBadSignature)
+	}
+	return nil
+}
+
+// VerifyTrustChain checks that chain leads from one of anchors, the trusted
+// root keys of federation, to pubKey, the key of broker. Every link must be
+// signed by the subject of the link before it, belong to federation and be
+// unexpired at now, and a link naming a broker must name this one.
+func VerifyTrustChain(chain []TrustLink, anchors []string, federation, broker, pubKey string, now time.Time) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: no trust chain", ErrUntrustedBroker)
+	}
+	if len(chain) > MaxTrustChainLength {
+		return fmt.Errorf("%w: trust chain has %d links, at most %d are allowed", ErrUntrustedBroker, len(chain), MaxTrustChainLength)
+	}
+
+	anchored := false
+	for _, anchor := range anchors {
+		if anchor == chain[0].Issuer {
+			anchored = true
+			break
+		}
+	}
+	if !anchored {
+		return fmt.Errorf("%w: chain does not start at a trust anchor of %s", ErrUntrustedBroker, federation)
+	}
+
+	for i := range chain {
+		link := &chain[i]
+		if link.Federation != federation {
+			return fmt.Errorf("%w: link %d is for federation %q", ErrUntrustedBroker, i, link.Federation)
+		}
+		if i > 0 && link.Issuer != chain[i-1].Subject {
+			return fmt.Errorf("%w: link %d is not issued by the key link %d vouches for", ErrUntrustedBroker, i, i-1)
+		}
+		if link.Broker != "" && link.Broker != broker {
+			return fmt.Errorf("%w: link %d vouches for broker %s", ErrUntrustedBroker, i, link.Broker)
+		}
+		if link.Expires != 0 && now.UnixMilli() >= link.Expires {
+			return fmt.Errorf("%w: link %d %w", ErrUntrustedBroker, i, ErrExpired)
+		}
+		if err := link.Verify(); err != nil {
+			return fmt.Errorf("%w: link %d: %v", ErrUntrustedBroker, i, err)
+		}
+	}
+	if chain[len(chain)-1].Subject != pubKey {
+		return fmt.Errorf("%w: chain does not end at the broker's key", ErrUntrustedBroker)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifyTrustChain(t *testing.T) {
+	anchorPub, anchorKey, _ := GenerateKeyPair()
+	intermediatePub, intermediateKey, _ := GenerateKeyPair()
+	brokerPub, _, _ := GenerateKeyPair()
+	_, strangerKey, _ := GenerateKeyPair()
+	now := time.Now()
+
+	anchors := []string{EncodePublicKey(anchorPub)}
+	pubKey := EncodePublicKey(brokerPub)
+	first, _ := NewTrustLink("acme", anchorKey, intermediatePub, "", time.Time{})
+	last, _ := NewTrustLink("acme", intermediateKey, brokerPub, "broker-b", now.Add(time.Hour))
+	chain := []TrustLink{*first, *last}
+
+	if err := VerifyTrustChain(chain, anchors, "acme", "broker-b", pubKey, now); err != nil {
+		t.Fatalf("Expected the chain to verify, got %v", err)
+	}
+
+	forged, _ := NewTrustLink("acme", strangerKey, brokerPub, "broker-b", time.Time{})
+	tampered := *last
+	tampered.Broker = "broker-c"
+	otherFederation, _ := NewTrustLink("globex", intermediateKey, brokerPub, "broker-b", time.Time{})
+	cases := map[string]struct {
+		chain  []TrustLink
+		broker string
+		now    time.Time
+	}{
+		"empty":            {nil, "broker-b", now},
+		"not anchored":     {[]TrustLink{*forged}, "broker-b", now},
+		"broken":           {[]TrustLink{*first, *forged}, "broker-b", now},
+		"other broker":     {chain, "broker-c", now},
+		"tampered":         {[]TrustLink{*first, tampered}, "broker-c", now},
+		"expired":          {chain, "broker-b", now.Add(2 * time.Hour)},
+		"other federation": {[]TrustLink{*first, *otherFederation}, "broker-b", now},
+		"too long":         {[]TrustLink{*first, *first, *first, *first, *last}, "broker-b", now},
+	}
+	for name, c := range cases {
+		if err := VerifyTrustChain(c.chain, anchors, "acme", c.broker, pubKey, c.now); !errors.Is(err, ErrUntrustedBroker) {
+			t.Errorf("%s: expected the chain to be untrusted, got %v", name, err)
+		}
+	}
+
+	// The chain must end at the key the broker registers
+	otherPub, _, _ := GenerateKeyPair()
+	if err := VerifyTrustChain(chain, anchors, "acme", "broker-b", EncodePublicKey(otherPub), now); !errors.Is(err, ErrUntrustedBroker) {
+		t.Errorf("Expected a chain for another key to be untrusted, got %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidBody is wrapped by the errors of envelope bodies that do not
+// match their schema
+var ErrInvalidBody = errors.New("invalid body")
+
+// FieldError is one way a body fails its schema. Field is the path to the
+// offending value, such as "parameters.items[2]", or "body" for the body
+// itself.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every way an envelope body fails its schema
+type ValidationError struct {
+	Type   EnvelopeType
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	return fmt.Sprintf("invalid %s body: %s", e.Type, strings.Join(messages, "; "))
+}
+
+// Unwrap makes a ValidationError match ErrInvalidBody
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidBody
+}
+
+// bodySchemas holds the parsed schema of each envelope type's body
+var (
+	bodySchemas     map[EnvelopeType]map[string]interface{}
+	bodySchemasOnce sync.Once
+)
+
+// parsedBodySchema returns the parsed schema of an envelope type's body
+func parsedBodySchema(envType EnvelopeType) (map[string]interface{}, bool) {
+	bodySchemasOnce.Do(func() {
+		bodySchemas = make(map[EnvelopeType]map[string]interface{})
+		for _, t := range BodySchemaTypes() {
+			data, ok := BodySchema(t)
+			if !ok {
+				continue
+			}
+			var schema map[string]interface{}
+			if err := json.Unmarshal(data, &schema); err == nil {
+				bodySchemas[t] = schema
+			}
+		}
+	})
+	schema, ok := bodySchemas[envType]
+	return schema, ok
+}
+
+// ValidateBody checks an envelope body against its type's schema, after
+// reading fields sent under a former name as their current one. Types
+// without a schema are not checked. A body that fails returns a
+// *ValidationError naming each offending field.
+func ValidateBody(envType EnvelopeType, body json.RawMessage) error {
+	schema, ok := parsedBodySchema(envType)
+	if !ok {
+		return nil
+	}
+	if t, known := bodyTypes[envType]; known {
+		upgraded, err := upgradeBody(body, reflect.New(t).Interface())
+		if err == nil {
+			body = upgraded
+		}
+	}
+
+	if fields := CheckSchema(schema, body, "body"); len(fields) > 0 {
+		return &ValidationError{Type: envType, Fields: fields}
+	}
+	return nil
+}
+
+// CheckSchema checks JSON data against a schema of the kind GenerateSchema
+// produces, decoded from JSON, and returns each way the data fails it.
+// Fields are named by their path into the data, and name stands for the
+// data as a whole.
+func CheckSchema(schema map[string]interface{}, data json.RawMessage, name string) []FieldError {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []FieldError{{Field: name, Message: "is not valid JSON"}}
+	}
+	validator := &schemaValidator{root: schema, name: name}
+	validator.check(schema, value, "")
+	return validator.errors
+}
+
+// Validate checks the envelope's body against its type's schema (see
+// ValidateBody)
+func (g *GenericEnvelope) Validate() error {
+	return ValidateBody(g.Type, g.Body)
+}
+
+// ValidateEnvelope checks the body of any envelope against its type's
+// schema, as GenericEnvelope.Validate does
+func ValidateEnvelope(envelope SignableEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	var generic GenericEnvelope
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	return generic.Validate()
+}
+
+// maxFieldErrors bounds the errors reported for one body
+const maxFieldErrors = 20
+
+// schemaValidator checks values against the subset of JSON Schema that
+// GenerateBodySchema produces: type, properties, required,
+// additionalProperties, items, minItems, minLength, minimum, anyOf and
+// $ref to the schema's definitions
+type schemaValidator struct {
+	root   map[string]interface{}
+	name   string // Of the value checked, for errors about it as a whole
+	errors []FieldError
+}
+
+// fail records that the value at path fails the schema
+func (v *schemaValidator) fail(path, message string) {
+	if len(v.errors) >= maxFieldErrors {
+		return
+	}
+	if path == "" {
+		path = v.name
+	}
+	v.errors = append(v.errors, FieldError{Field: path, Message: message})
+}
+
+// resolve follows a schema's $ref into the root's definitions
+func (v *schemaValidator) resolve(schema map[string]interface{}) map[string]interface{} {
+	for depth := 0; depth < 32; depth++ {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+		definitions, _ := v.root["definitions"].(map[string]interface{})
+		resolved, _ := definitions[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+		if resolved == nil {
+			return map[string]interface{}{}
+		}
+		schema = resolved
+	}
+	return schema
+}
+
+// matches reports whether value matches schema without recording errors
+func (v *schemaValidator) matches(schema map[string]interface{}, value interface{}) bool {
+	probe := &schemaValidator{root: v.root}
+	probe.check(schema, value, "")
+	return len(probe.errors) == 0
+}
+
+// check validates value, found at path, against schema
+func (v *schemaValidator) check(schema map[string]interface{}, value interface{}, path string) {
+	schema = v.resolve(schema)
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		for _, option := range anyOf {
+			if option, ok := option.(map[string]interface{}); ok && v.matches(option, value) {
+				return
+			}
+		}
+		// Report against the first option, the one that is not null
+		if first, ok := anyOf[0].(map[string]interface{}); ok {
+			v.check(first, value, path)
+		}
+		return
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		kind := jsonKind(value)
+		allowed := false
+		for _, t := range types {
+			allowed = allowed || t == kind || (t == "number" && kind == "integer")
+		}
+		if !allowed {
+			v.fail(path, "must be "+describeTypes(types)+", not "+describeKind(kind))
+			return
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		v.checkObject(schema, value, path)
+	case []interface{}:
+		if minItems, ok := schema["minItems"].(float64); ok && float64(len(value)) < minItems {
+			v.fail(path, "must not be empty")
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				v.check(items, item, path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	case string:
+		if minLength, ok := schema["minLength"].(float64); ok && float64(len(value)) < minLength {
+			v.fail(path, "must not be empty")
+		}
+	case float64:
+		if minimum, ok := schema["minimum"].(float64); ok && value < minimum {
+			v.fail(path, fmt.Sprintf("must be at least %v", minimum))
+		}
+	}
+}
+
+// checkObject validates an object's properties
+func (v *schemaValidator) checkObject(schema map[string]interface{}, value map[string]interface{}, path string) {
+	prefix := path
+	if prefix != "" {
+		prefix += "."
+	}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			name, _ := name.(string)
+			if _, present := value[name]; !present {
+				v.fail(prefix+name, "is required")
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	additional, _ := schema["additionalProperties"].(map[string]interface{})
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			v.check(property, value[name], prefix+name)
+		} else if additional != nil {
+			v.check(additional, value[name], prefix+name)
+		}
+	}
+}
+
+// schemaTypes reads a schema's type keyword, a name or a list of names
+func schemaTypes(keyword interface{}) []string {
+	switch keyword := keyword.(type) {
+	case string:
+		return []string{keyword}
+	case []interface{}:
+		types := make([]string, 0, len(keyword))
+		for _, t := range keyword {
+			if t, ok := t.(string); ok {
+				types = append(types, t)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// jsonKind names the JSON Schema type of a decoded JSON value
+func jsonKind(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) && !math.IsInf(value, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// describeTypes phrases the types a value may have, such as "a string or null"
+func describeTypes(types []string) string {
+	described := make([]string, len(types))
+	for i, t := range types {
+		described[i] = describeKind(t)
+	}
+	return strings.Join(described, " or ")
+}
+
+// describeKind phrases a JSON Schema type with its article
+func describeKind(kind string) string {
+	switch kind {
+	case "null":
+		return "null"
+	case "integer", "object", "array":
+		return "an " + kind
+	default:
+		return "a " + kind
+	}
+}
@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VaultTransitConfig locates an Ed25519 key in HashiCorp Vault's transit
+// secrets engine
+type VaultTransitConfig struct {
+	// Address is Vault's URL, such as https://vault.example.com:8200
+	Address string
+	// Token authenticates to Vault; it needs read on the key and update on
+	// its sign endpoint
+	Token string
+	// Mount is where the transit engine is mounted (default "transit")
+	Mount string
+	// Key names the transit key, which must be of type ed25519
+	Key string
+	// Namespace, if set, is sent as X-Vault-Namespace
+	Namespace string
+	// HTTPClient, if set, is used instead of a client with a 10s timeout
+	HTTPClient *http.Client
+}
+
+// VaultTransitSigner is a Signer whose key stays in Vault's transit engine.
+// It signs with the key version that was latest when it was created, so
+// rotating the key in Vault does not change the agent's public key until
+// a new signer is made.
+type VaultTransitSigner struct {
+	config    VaultTransitConfig
+	client    *http.Client
+	version   int
+	publicKey ed25519.PublicKey
+}
+
+// NewVaultTransitSigner reads the public key of the configured transit key
+// and returns a signer for it
+func NewVaultTransitSigner(config VaultTransitConfig) (*VaultTransitSigner, error) {
+	if config.Address == "" || config.Key == "" {
+		return nil, fmt.Errorf("%w: vault address and key", ErrMissingField)
+	}
+	if config.Mount == "" {
+		config.Mount = "transit"
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	signer := &VaultTransitSigner{config: config, client: client}
+
+	var key struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	}
+	if err := signer.call(http.MethodGet, "keys", nil, &key); err != nil {
+		return nil, err
+	}
+	if key.Type != "ed25519" {
+		return nil, fmt.Errorf("vault key %s is %s, not ed25519", config.Key, key.Type)
+	}
+	publicKey, err := DecodePublicKey(key.Keys[strconv.Itoa(key.LatestVersion)].PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("vault key %s version %d: %w", config.Key, key.LatestVersion, err)
+	}
+	signer.version, signer.publicKey = key.LatestVersion, publicKey
+	return signer, nil
+}
+
+// Public returns the public key of the key version the signer uses
+func (s *VaultTransitSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign has Vault sign message. Only Ed25519 over the whole message is
+// supported, so opts must not name a hash.
+func (s *VaultTransitSigner) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts != nil && opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 cannot sign a %v digest", opts.HashFunc())
+	}
+	request := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(message),
+		"key_version": s.version,
+	}
+	var response struct {
+		Signature string `json:"signature"`
+	}
+	if err := s.call(http.MethodPost, "sign", request, &response); err != nil {
+		return nil, err
+	}
+
+	// Vault prefixes signatures with vault:v<version>:
+	parts := strings.SplitN(response.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("unexpected vault signature %q", response.Signature)
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault signature encoding: %w", err)
+	}
+	if !ed25519.Verify(s.publicKey, message, signature) {
+		return nil, fmt.Errorf("%w: vault signature does not match key version %d", ErrBadSignature, s.version)
+	}
+	return signature, nil
+}
+
+// call makes a request to the key's transit endpoint and decodes the data
+// of Vault's response into out
+func (s *VaultTransitSigner) call(method, endpoint string, body interface{}, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	address := strings.TrimSuffix(s.config.Address, "/") + "/v1/" + strings.Trim(s.config.Mount, "/") + "/" + endpoint + "/" + url.PathEscape(s.config.Key)
+	req, err := http.NewRequest(method, address, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.config.Token)
+	if s.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.config.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&response); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("invalid vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault %s %s failed (%d): %s", endpoint, s.config.Key, resp.StatusCode, strings.Join(response.Errors, "; "))
+	}
+	if err := json.Unmarshal(response.Data, out); err != nil {
+		return fmt.Errorf("invalid vault response: %w", err)
+	}
+	return nil
+}
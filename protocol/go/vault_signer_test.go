@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeVault serves the transit key and sign endpoints for one ed25519 key
+func fakeVault(t *testing.T, priv ed25519.PrivateKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/transit/keys/agent":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"type":           "ed25519",
+				"latest_version": 1,
+				"keys":           map[string]interface{}{"1": map[string]string{"public_key": EncodePublicKey(priv.Public().(ed25519.PublicKey))}},
+			}})
+		case "/v1/transit/sign/agent":
+			var request struct {
+				Input      string `json:"input"`
+				KeyVersion int    `json:"key_version"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			message, _ := base64.StdEncoding.DecodeString(request.Input)
+			if request.KeyVersion != 1 {
+				t.Errorf("Expected key version 1 pinned, got %d", request.KeyVersion)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+				"signature": "vault:v1:" + base64.StdEncoding.EncodeToString(ed25519.Sign(priv, message)),
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestVaultTransitSigner(t *testing.T) {
+	pub, priv, _ := GenerateKeyPair()
+	vault := fakeVault(t, priv)
+	defer vault.Close()
+
+	signer, err := NewVaultTransitSigner(VaultTransitConfig{Address: vault.URL, Token: "s.token", Key: "agent"})
+	if err != nil {
+		t.Fatalf("NewVaultTransitSigner failed: %v", err)
+	}
+	if key, _ := SignerPublicKey(signer); !key.Equal(pub) {
+		t.Error("Expected the signer to report the vault key")
+	}
+
+	call, err := NewToolCall("agent").Tool("echo").SignWith(signer).Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if err := call.Verify(pub); err != nil {
+		t.Errorf("Expected the vault signature to verify: %v", err)
+	}
+
+	if _, err := NewVaultTransitSigner(VaultTransitConfig{Address: vault.URL, Token: "wrong", Key: "agent"}); err == nil {
+		t.Error("Expected a refused token reported")
+	}
+	if _, err := NewVaultTransitSigner(VaultTransitConfig{Address: vault.URL, Token: "s.token", Key: "missing"}); err == nil {
+		t.Error("Expected a missing key reported")
+	}
+}